@@ -0,0 +1,63 @@
+/**
+ * echoserver is a tiny Windows console server which behaves enough like the
+ * Northstar dedicated server (console title status, stdin commands, quit) to
+ * exercise nswine and nswrap without Titanfall 2 assets.
+ *
+ * - x86_64-w64-mingw32-gcc -Wall -Wextra -O2 echoserver.c -o echoserver.exe
+ *
+ * Commands:
+ * - join: add a player
+ * - leave: remove a player
+ * - quit: exit
+ */
+
+#include <windows.h>
+#include <stdio.h>
+#include <string.h>
+
+static int players;
+
+static void update_title(void) {
+    char title[128];
+    snprintf(title, sizeof(title), "echoserver - mp_echo %d/8 players (echo)", players);
+    SetConsoleTitleA(title);
+}
+
+int main(int argc, char **argv) {
+    setvbuf(stdout, NULL, _IONBF, 0);
+
+    printf("echoserver starting\n");
+    for (int i = 1; i < argc; i++) {
+        printf("arg: %s\n", argv[i]);
+    }
+    update_title();
+
+    HANDLE in = GetStdHandle(STD_INPUT_HANDLE);
+    char line[256];
+    for (;;) {
+        // the title is the watchdog heartbeat for nswrap, so keep updating it
+        if (WaitForSingleObject(in, 1000) == WAIT_TIMEOUT) {
+            update_title();
+            continue;
+        }
+        if (!fgets(line, sizeof(line), stdin)) {
+            break;
+        }
+        line[strcspn(line, "\r\n")] = '\0';
+        if (!*line) {
+            continue;
+        }
+        printf("command: %s\n", line);
+        if (!strcmp(line, "join") && players < 8) {
+            players++;
+        } else if (!strcmp(line, "leave") && players > 0) {
+            players--;
+        } else if (!strcmp(line, "quit")) {
+            break;
+        }
+        update_title();
+    }
+
+    printf("echoserver exiting\n");
+    return 0;
+}
@@ -0,0 +1,73 @@
+#!/bin/sh
+# Test for installing and verifying optional components in nswrap, using a fake
+# runtime (so it doesn't need wine).
+#
+# usage: test-components.sh nswrap
+set -eu
+
+nswrap=$(realpath "$1")
+
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+mkdir -p "$tmp/runtime/bin" "$tmp/runtime/lib64/wine/x86_64-unix" "$tmp/runtime/lib64/wine/x86_64-windows" "$tmp/runtime/prefix" "$tmp/source" "$tmp/game"
+touch "$tmp/game/echoserver.exe"
+printf '{\n\t"compat": 1\n}\n' > "$tmp/runtime/prefix/nswine.json"
+printf 'WINE REGISTRY Version 2\n' > "$tmp/runtime/prefix/system.reg"
+for x in wine wine64-preloader wineserver; do
+    printf '#!/bin/sh\nexit 0\n' > "$tmp/runtime/bin/$x"
+done
+cat > "$tmp/runtime/bin/wine64" <<'EOF'
+#!/bin/sh
+case "$1" in *wineserver*|-k|-w) exit 0;; esac
+IFS=:
+for d in $WINEDLLPATH; do
+    [ -f "$d/test.dll" ] && echo "found test.dll in $d"
+done
+exit 0
+EOF
+chmod +x "$tmp/runtime/bin/"*
+
+echo "component" > "$tmp/source/test.dll"
+sum=$(sha256sum "$tmp/source/test.dll" | cut -d' ' -f1)
+mv "$tmp/source/test.dll" "$tmp/source/$sum"
+printf 'test.dll\t%s\t10\tlib/wine/x86_64-windows/test.dll\t%s/%s\n' "$sum" "$tmp/source" "$sum" > "$tmp/runtime/prefix/components.tsv"
+printf 'bad.dll\t%s\t10\tlib/wine/x86_64-windows/bad.dll\t%s/%s\n' "$(echo | sha256sum | cut -d' ' -f1)" "$tmp/source" "$sum" >> "$tmp/runtime/prefix/components.tsv"
+
+fail() {
+    echo "FAIL: $*" >&2
+    echo "--- output" >&2
+    cat "$tmp/log" >&2
+    exit 1
+}
+
+run() {
+    (
+        cd "$tmp/game"
+        exec env \
+            NSWRAP_RUNTIME="$tmp/runtime" \
+            NSWRAP_DEBUG=1 \
+            NSWRAP_NOPROCTITLE=1 \
+            NSWRAP_NOWATCHDOG=1 \
+            NSWRAP_EXE=echoserver.exe \
+            NSWRAP_INSTANCE_DIR="$tmp/instance" \
+            NSWRAP_COMPONENTS="$1" \
+            "$nswrap" -dedicated
+    ) </dev/null >"$tmp/log" 2>&1 || true
+}
+
+run test.dll
+[ -f "$tmp/instance/components/test.dll" ] || fail "component was not installed into the instance dir"
+[ ! -e "$tmp/runtime/lib/wine/x86_64-windows/test.dll" ] || fail "component was installed into the runtime"
+grep -qF "installing optional component test.dll" "$tmp/log" || fail "component was not installed from the source"
+grep -qF "found test.dll in $tmp/instance/components" "$tmp/log" || fail "component is not in WINEDLLPATH"
+
+run test.dll
+grep -qF "optional component test.dll is already installed" "$tmp/log" || fail "installed component was not reused"
+
+run bad.dll
+grep -qF "optional component bad.dll has the wrong hash" "$tmp/log" || fail "component with the wrong hash was not rejected"
+[ ! -e "$tmp/instance/components/bad.dll" ] || fail "component with the wrong hash was installed"
+[ -z "$(find "$tmp/instance/components" -name '*.nswrap-tmp')" ] || fail "temporary file was not removed"
+
+echo "PASS"
@@ -0,0 +1,67 @@
+#!/bin/sh
+# End-to-end test for nswine and nswrap using echoserver.exe.
+#
+# usage: test.sh nswrap wine_bin_dir wineprefix echoserver.exe
+set -eu
+
+nswrap=$(realpath "$1")
+winebin=$(realpath "$2")
+prefix=$(realpath "$3")
+server=$(realpath "$4")
+
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+mkdir "$tmp/bin" "$tmp/game"
+cp "$server" "$tmp/game/echoserver.exe"
+ln -s "$winebin"/* "$tmp/bin/"
+[ -e "$tmp/bin/wine64" ] || ln -s "$winebin/wine" "$tmp/bin/wine64"
+mkfifo "$tmp/stdin"
+
+fail() {
+    echo "FAIL: $*" >&2
+    echo "--- output" >&2
+    cat "$tmp/log" >&2
+    exit 1
+}
+
+wait_for() {
+    for _ in $(seq 1 300); do
+        grep -qF -- "$1" "$tmp/log" && return 0
+        sleep 1
+    done
+    fail "timed out waiting for $1"
+}
+
+(
+    cd "$tmp/game"
+    exec env \
+        PATH="$tmp/bin:/usr/bin:/bin" \
+        NSWRAP_EXTWINE=1 \
+        NSWRAP_RUNTIME="$tmp" \
+        NSWRAP_DEBUG=1 \
+        NSWRAP_NOPROCTITLE=1 \
+        NSWRAP_EXE=echoserver.exe \
+        NSWRAP_INSTANCE_DIR="$tmp/instance" \
+        WINEPREFIX="$prefix" \
+        "$nswrap" -dedicated +example 1
+) <"$tmp/stdin" >"$tmp/log" 2>&1 &
+pid=$!
+exec 3>"$tmp/stdin"
+
+wait_for "arg: +example"
+echo join >&3
+wait_for "command: join"
+wait_for "1/8 players"
+
+kill -TERM "$pid"
+rc=0
+wait "$pid" || rc=$?
+exec 3>&-
+
+grep -qF "command: quit" "$tmp/log" || fail "server did not receive quit"
+grep -qF "echoserver exiting" "$tmp/log" || fail "server did not exit cleanly"
+[ "$rc" -eq 0 ] || fail "nswrap exited with status $rc"
+[ -f "$tmp/instance/registry/system.reg.delta" ] || fail "instance registry delta was not saved"
+
+echo "PASS"
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// apisetSchema is a parsed version 6 API set schema (the .apiset section of
+// apisetschema.dll).
+type apisetSchema struct {
+	Entries []apisetEntry
+
+	buf        []byte // the entire file
+	off        uint32 // file offset of the namespace
+	hashFactor uint32
+	entryOff   uint32 // relative to the namespace
+	hashOff    uint32 // relative to the namespace
+}
+
+// apisetEntry is an API set namespace entry.
+type apisetEntry struct {
+	Name   string   // lowercased name without the .dll extension
+	Hashed int      // length of the name prefix used for lookups (i.e., without the last version component)
+	Hosts  []string // lowercased default host DLLs
+
+	raw [24]byte
+}
+
+// Key returns the part of the name used for lookups.
+func (e apisetEntry) Key() string {
+	return e.Name[:e.Hashed]
+}
+
+// apisetKey returns the part of an apiset DLL name used for lookups (e.g.,
+// "api-ms-win-core-file-l1-2-1.dll" -> "api-ms-win-core-file-l1-2").
+func apisetKey(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".dll")
+	if i := strings.LastIndexByte(name, '-'); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// isApiset checks if name is an API set DLL name.
+func isApiset(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "api-ms-") || strings.HasPrefix(name, "ext-ms-")
+}
+
+// loadApisetSchema parses apisetschema.dll from dir, returning nil if it
+// doesn't exist.
+func loadApisetSchema(dir string) (*apisetSchema, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, "apisetschema.dll"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s, err := parseApisetSchema(buf)
+	if err != nil {
+		return nil, fmt.Errorf("parse apiset schema: %w", err)
+	}
+	return s, nil
+}
+
+// parseApisetSchema parses the API set schema from apisetschema.dll.
+func parseApisetSchema(buf []byte) (*apisetSchema, error) {
+	f, err := peNewFile(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	sect := f.Section(".apiset")
+	if sect == nil {
+		return nil, fmt.Errorf("no .apiset section")
+	}
+	s := &apisetSchema{
+		buf: buf,
+		off: sect.Offset,
+	}
+	end := uint64(sect.Offset) + uint64(min(sect.Size, sect.VirtualSize))
+	if end > uint64(len(buf)) {
+		return nil, fmt.Errorf(".apiset section out of range")
+	}
+	ns := buf[sect.Offset:end]
+	u32 := func(off uint32) (uint32, error) {
+		if uint64(off)+4 > uint64(len(ns)) {
+			return 0, fmt.Errorf("offset %#x out of range", off)
+		}
+		return binary.LittleEndian.Uint32(ns[off:]), nil
+	}
+	str := func(off, n uint32) (string, error) {
+		if n%2 != 0 || uint64(off)+uint64(n) > uint64(len(ns)) {
+			return "", fmt.Errorf("string at %#x out of range", off)
+		}
+		u := make([]uint16, n/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(ns[off+uint32(i)*2:])
+		}
+		return strings.ToLower(string(utf16.Decode(u))), nil
+	}
+
+	var hdr [7]uint32
+	for i := range hdr {
+		if hdr[i], err = u32(uint32(i) * 4); err != nil {
+			return nil, err
+		}
+	}
+	if hdr[0] != 6 {
+		return nil, fmt.Errorf("unsupported apiset schema version %d", hdr[0])
+	}
+	count := hdr[3]
+	s.entryOff, s.hashOff, s.hashFactor = hdr[4], hdr[5], hdr[6]
+	if uint64(s.entryOff)+uint64(count)*24 > uint64(len(ns)) || uint64(s.hashOff)+uint64(count)*8 > uint64(len(ns)) {
+		return nil, fmt.Errorf("apiset schema entries out of range")
+	}
+	for i := range count {
+		off := s.entryOff + i*24
+		var e apisetEntry
+		copy(e.raw[:], ns[off:])
+		var (
+			nameOff  = binary.LittleEndian.Uint32(e.raw[4:])
+			nameLen  = binary.LittleEndian.Uint32(e.raw[8:])
+			hashLen  = binary.LittleEndian.Uint32(e.raw[12:])
+			valueOff = binary.LittleEndian.Uint32(e.raw[16:])
+			valueCnt = binary.LittleEndian.Uint32(e.raw[20:])
+		)
+		if e.Name, err = str(nameOff, nameLen); err != nil {
+			return nil, err
+		}
+		if e.Hashed = int(hashLen / 2); e.Hashed > len(e.Name) {
+			return nil, fmt.Errorf("apiset entry %q: invalid hashed length", e.Name)
+		}
+		for j := range valueCnt {
+			voff := valueOff + j*20
+			vOff, err := u32(voff + 12)
+			if err != nil {
+				return nil, err
+			}
+			vLen, err := u32(voff + 16)
+			if err != nil {
+				return nil, err
+			}
+			if vLen == 0 {
+				continue
+			}
+			host, err := str(vOff, vLen)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(e.Hosts, host) {
+				e.Hosts = append(e.Hosts, host)
+			}
+		}
+		s.Entries = append(s.Entries, e)
+	}
+
+	for i := range count {
+		hash, _ := u32(s.hashOff + i*8)
+		idx, _ := u32(s.hashOff + i*8 + 4)
+		if idx >= count || hash != s.hash(s.Entries[idx].Key()) {
+			return nil, fmt.Errorf("apiset schema hash table is inconsistent")
+		}
+	}
+	return s, nil
+}
+
+// hash computes the lookup hash of an apiset key.
+func (s *apisetSchema) hash(key string) uint32 {
+	var h uint32
+	for _, c := range utf16.Encode([]rune(strings.ToLower(key))) {
+		h = h*s.hashFactor + uint32(c)
+	}
+	return h
+}
+
+// Resolve gets the hosts for an apiset DLL name.
+func (s *apisetSchema) Resolve(name string) ([]string, bool) {
+	key := apisetKey(name)
+	for _, e := range s.Entries {
+		if e.Key() == key {
+			return e.Hosts, true
+		}
+	}
+	return nil, false
+}
+
+// HostedBy gets the keys of the entries whose hosts are all matched by fn
+// (which is called with the lowercased host names). Entries without any hosts
+// are not included.
+func (s *apisetSchema) HostedBy(fn func(host string) bool) []string {
+	var keys []string
+	for _, e := range s.Entries {
+		if len(e.Hosts) != 0 && !slices.ContainsFunc(e.Hosts, func(host string) bool {
+			return !fn(strings.ToLower(host))
+		}) {
+			keys = append(keys, e.Key())
+		}
+	}
+	return keys
+}
+
+// ResolveImports replaces the apiset DLL names in a list of imports with their
+// hosts, since the loader resolves them using the schema before looking for a
+// file. Names without an entry (or without any hosts) are left as-is. It does
+// nothing if s is nil.
+func (s *apisetSchema) ResolveImports(deps []string) []string {
+	if s == nil {
+		return deps
+	}
+	var res []string
+	add := func(dep string) {
+		if !slices.ContainsFunc(res, func(x string) bool {
+			return strings.EqualFold(x, dep)
+		}) {
+			res = append(res, dep)
+		}
+	}
+	for _, dep := range deps {
+		if hosts, ok := s.Resolve(dep); ok && isApiset(dep) && len(hosts) != 0 {
+			for _, host := range hosts {
+				add(host)
+			}
+		} else {
+			add(dep)
+		}
+	}
+	return res
+}
+
+// Filter returns a copy of the file with only the entries for which keep
+// returns true. The strings are left as-is, and the entry and hash tables are
+// rewritten in-place.
+func (s *apisetSchema) Filter(keep func(e apisetEntry) bool) ([]byte, int) {
+	var kept []apisetEntry
+	for _, e := range s.Entries {
+		if keep(e) {
+			kept = append(kept, e)
+		}
+	}
+	buf := slices.Clone(s.buf)
+	ns := buf[s.off:]
+	binary.LittleEndian.PutUint32(ns[12:], uint32(len(kept)))
+	clear(ns[s.entryOff : s.entryOff+uint32(len(s.Entries))*24])
+	clear(ns[s.hashOff : s.hashOff+uint32(len(s.Entries))*8])
+	type hashEntry struct{ hash, idx uint32 }
+	var hashes []hashEntry
+	for i, e := range kept {
+		copy(ns[s.entryOff+uint32(i)*24:], e.raw[:])
+		hashes = append(hashes, hashEntry{s.hash(e.Key()), uint32(i)})
+	}
+	slices.SortFunc(hashes, func(a, b hashEntry) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	for i, h := range hashes {
+		binary.LittleEndian.PutUint32(ns[s.hashOff+uint32(i)*8:], h.hash)
+		binary.LittleEndian.PutUint32(ns[s.hashOff+uint32(i)*8+4:], h.idx)
+	}
+	return buf, len(s.Entries) - len(kept)
+}
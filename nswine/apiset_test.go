@@ -0,0 +1,159 @@
+package main
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"testing"
+	"unicode/utf16"
+)
+
+// testApisetSchema builds a PE file with a version 6 apiset schema section.
+func testApisetSchema(t *testing.T, entries map[string]string) []byte {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		hdrSize   = 28
+		entrySize = 24
+		valueSize = 20
+		factor    = 0x1F
+	)
+	var (
+		entryOff = uint32(hdrSize)
+		hashOff  = entryOff + uint32(len(names))*entrySize
+		valueOff = hashOff + uint32(len(names))*8
+		strOff   = valueOff + uint32(len(names))*valueSize
+		ns       = make([]byte, strOff)
+	)
+	str := func(s string) (uint32, uint32) {
+		off := uint32(len(ns))
+		for _, c := range utf16.Encode([]rune(s)) {
+			ns = binary.LittleEndian.AppendUint16(ns, c)
+		}
+		return off, uint32(len(ns)) - off
+	}
+	type hashEntry struct{ hash, idx uint32 }
+	var hashes []hashEntry
+	for i, name := range names {
+		nameOff, nameLen := str(name)
+		hostOff, hostLen := str(entries[name])
+		hashed := apisetKey(name)
+		var h uint32
+		for _, c := range hashed {
+			h = h*factor + uint32(c)
+		}
+		hashes = append(hashes, hashEntry{h, uint32(i)})
+		e := ns[entryOff+uint32(i)*entrySize:]
+		binary.LittleEndian.PutUint32(e[4:], nameOff)
+		binary.LittleEndian.PutUint32(e[8:], nameLen)
+		binary.LittleEndian.PutUint32(e[12:], uint32(len(hashed))*2)
+		binary.LittleEndian.PutUint32(e[16:], valueOff+uint32(i)*valueSize)
+		binary.LittleEndian.PutUint32(e[20:], 1)
+		v := ns[valueOff+uint32(i)*valueSize:]
+		binary.LittleEndian.PutUint32(v[12:], hostOff)
+		binary.LittleEndian.PutUint32(v[16:], hostLen)
+	}
+	slices.SortFunc(hashes, func(a, b hashEntry) int {
+		return int(int64(a.hash) - int64(b.hash))
+	})
+	for i, h := range hashes {
+		binary.LittleEndian.PutUint32(ns[hashOff+uint32(i)*8:], h.hash)
+		binary.LittleEndian.PutUint32(ns[hashOff+uint32(i)*8+4:], h.idx)
+	}
+	for i, v := range []uint32{6, uint32(len(ns)), 0, uint32(len(names)), entryOff, hashOff, factor} {
+		binary.LittleEndian.PutUint32(ns[i*4:], v)
+	}
+
+	// take a stub and turn its only section into the .apiset section
+	buf, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "apisetschema.dll", nil)
+	if err != nil {
+		t.Fatalf("generate pe: %v", err)
+	}
+	shdr := 0x80 + 4 + binary.Size(pe.FileHeader{}) + binary.Size(pe.OptionalHeader64{})
+	raw := (len(ns) + 0x1FF) &^ 0x1FF
+	copy(buf[shdr:], ".apiset\x00")
+	binary.LittleEndian.PutUint32(buf[shdr+8:], uint32(len(ns)))   // VirtualSize
+	binary.LittleEndian.PutUint32(buf[shdr+16:], uint32(raw))      // SizeOfRawData
+	binary.LittleEndian.PutUint32(buf[shdr+20:], uint32(len(buf))) // PointerToRawData
+	buf = append(buf, ns...)
+	buf = append(buf, make([]byte, raw-len(ns))...)
+	return buf
+}
+
+func TestApisetSchema(t *testing.T) {
+	buf := testApisetSchema(t, map[string]string{
+		"api-ms-win-core-file-l1-1-0":     "kernelbase.dll",
+		"api-ms-win-core-synch-l1-2-0":    "kernelbase.dll",
+		"api-ms-win-crt-runtime-l1-1-0":   "ucrtbase.dll",
+		"ext-ms-win-gdi-draw-l1-1-0":      "gdi32.dll",
+		"api-ms-win-security-base-l1-1-0": "advapi32.dll",
+	})
+	s, err := parseApisetSchema(buf)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(s.Entries) != 5 {
+		t.Fatalf("expected 5 entries, got %d", len(s.Entries))
+	}
+	if hosts, ok := s.Resolve("API-MS-WIN-CRT-RUNTIME-L1-1-1.dll"); !ok || !slices.Equal(hosts, []string{"ucrtbase.dll"}) {
+		t.Errorf("incorrect resolution: %q", hosts)
+	}
+	if _, ok := s.Resolve("api-ms-win-core-nonexistent-l1-1-0.dll"); ok {
+		t.Errorf("expected nonexistent apiset to not resolve")
+	}
+	if deps, exp := s.ResolveImports([]string{"kernel32.dll", "api-ms-win-core-file-l1-1-0.dll", "API-MS-WIN-CORE-SYNCH-L1-2-0.dll", "api-ms-win-core-nonexistent-l1-1-0.dll"}), []string{"kernel32.dll", "kernelbase.dll", "api-ms-win-core-nonexistent-l1-1-0.dll"}; !slices.Equal(deps, exp) {
+		t.Errorf("expected resolved imports %q, got %q", exp, deps)
+	}
+	if deps := (*apisetSchema)(nil).ResolveImports([]string{"api-ms-win-core-file-l1-1-0.dll"}); !slices.Equal(deps, []string{"api-ms-win-core-file-l1-1-0.dll"}) {
+		t.Errorf("expected imports to be unchanged without a schema, got %q", deps)
+	}
+
+	if keys := s.HostedBy(func(host string) bool { return host == "kernelbase.dll" || host == "ucrtbase.dll" }); !slices.Equal(keys, []string{"api-ms-win-core-file-l1-1", "api-ms-win-core-synch-l1-2", "api-ms-win-crt-runtime-l1-1"}) {
+		t.Errorf("incorrect apisets hosted by kernelbase and ucrtbase: %q", keys)
+	}
+
+	buf, removed := s.Filter(func(e apisetEntry) bool {
+		return e.Key() != "api-ms-win-core-file-l1-1" && e.Key() != "ext-ms-win-gdi-draw-l1-1"
+	})
+	if removed != 2 {
+		t.Errorf("expected 2 removed entries, got %d", removed)
+	}
+	s, err = parseApisetSchema(buf)
+	if err != nil {
+		t.Fatalf("parse filtered: %v", err)
+	}
+	var names []string
+	for _, e := range s.Entries {
+		names = append(names, e.Name)
+	}
+	if exp := []string{"api-ms-win-core-synch-l1-2-0", "api-ms-win-crt-runtime-l1-1-0", "api-ms-win-security-base-l1-1-0"}; !slices.Equal(names, exp) {
+		t.Errorf("expected %q, got %q", exp, names)
+	}
+	if hosts, ok := s.Resolve("api-ms-win-security-base-l1-1-0.dll"); !ok || !slices.Equal(hosts, []string{"advapi32.dll"}) {
+		t.Errorf("incorrect resolution after filtering: %q", hosts)
+	}
+}
+
+func TestApisetProfileRoots(t *testing.T) {
+	// the game's redistributables import the crt apisets, so the built-in
+	// game profile needs to root the module hosting them
+	s, err := parseApisetSchema(testApisetSchema(t, map[string]string{
+		"api-ms-win-crt-runtime-l1-1-0": "ucrtbase.dll",
+		"api-ms-win-crt-stdio-l1-1-0":   "ucrtbase.dll",
+	}))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	profile, err := loadProfile("northstar")
+	if err != nil {
+		t.Fatalf("load profile: %v", err)
+	}
+	if keys := s.HostedBy(func(host string) bool { return matchAny(profile.Roots, host) }); len(keys) != len(s.Entries) {
+		t.Errorf("expected all crt apisets to be hosted by profile roots, got %q", keys)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// modGraph is an import graph of the modules in a directory.
+type modGraph struct {
+	Names map[string]string   // lowercased module name to file name
+	Deps  map[string][]string // lowercased module name to lowercased imports
+}
+
+// peGraph builds the import graph of the PE modules in dir, including the
+// targets of export forwarders. Files which aren't PE modules are ignored.
+func peGraph(dir string) (*modGraph, error) {
+	return modGraphOf(dir, func(name string) ([]string, bool) {
+		deps, err := peImports(name)
+		if err != nil {
+			return nil, false
+		}
+		fwds, err := peForwarders(name)
+		if err != nil {
+			return nil, false
+		}
+		for _, lib := range slices.Sorted(maps.Keys(fwds)) {
+			if !slices.ContainsFunc(deps, func(x string) bool {
+				return strings.EqualFold(x, lib)
+			}) {
+				deps = append(deps, lib)
+			}
+		}
+		return deps, true
+	})
+}
+
+func modGraphOf(dir string, imports func(name string) ([]string, bool)) (*modGraph, error) {
+	dis, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type scan struct {
+		deps []string
+		ok   bool
+	}
+	scans, err := parallelMap(dis, func(di fs.DirEntry) (scan, error) {
+		if !di.Type().IsRegular() {
+			return scan{}, nil
+		}
+		deps, ok := imports(filepath.Join(dir, di.Name()))
+		return scan{deps, ok}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	g := &modGraph{
+		Names: map[string]string{},
+		Deps:  map[string][]string{},
+	}
+	for i, di := range dis {
+		if !scans[i].ok {
+			continue
+		}
+		name := strings.ToLower(di.Name())
+		g.Names[name] = di.Name()
+		for _, dep := range scans[i].deps {
+			g.Deps[name] = append(g.Deps[name], strings.ToLower(dep))
+		}
+	}
+	return g, nil
+}
+
+// Match returns the lowercased names of the modules matching any of the
+// case-insensitive globs, sorted.
+func (g *modGraph) Match(globs []string) []string {
+	var names []string
+	for _, name := range slices.Sorted(maps.Keys(g.Names)) {
+		if matchAny(globs, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Closure returns the lowercased names of the modules reachable from the
+// roots. Roots and imports which aren't in the graph are ignored.
+func (g *modGraph) Closure(roots []string) map[string]bool {
+	reach := map[string]bool{}
+	queue := slices.Clone(roots)
+	for len(queue) != 0 {
+		name := strings.ToLower(queue[0])
+		queue = queue[1:]
+		if _, ok := g.Names[name]; !ok || reach[name] {
+			continue
+		}
+		reach[name] = true
+		queue = append(queue, g.Deps[name]...)
+	}
+	return reach
+}
+
+// unresolvedOrdinals checks that the imports by ordinal of the PE modules in
+// dir are exported by the imported modules (after resolving apisets), returning
+// the ones which aren't (like "a.dll: b.dll#12"), sorted. Imports from modules
+// which aren't in dir are ignored.
+func unresolvedOrdinals(dir string, schema *apisetSchema) ([]string, error) {
+	dis, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	scans, err := parallelMap(dis, func(di fs.DirEntry) (*peScan, error) {
+		if !di.Type().IsRegular() {
+			return nil, nil
+		}
+		sc, err := peScanFile(filepath.Join(dir, di.Name()))
+		if err != nil {
+			return nil, nil // not a pe module
+		}
+		return sc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	exports := map[string][]uint16{}
+	for i, di := range dis {
+		if scans[i] != nil {
+			exports[strings.ToLower(di.Name())] = scans[i].Exports
+		}
+	}
+	var bad []string
+	for i, di := range dis {
+		if scans[i] == nil {
+			continue
+		}
+		for _, lib := range slices.Sorted(maps.Keys(scans[i].Ordinals)) {
+			var hosts []string
+			for _, host := range schema.ResolveImports([]string{lib}) {
+				if _, ok := exports[strings.ToLower(host)]; ok {
+					hosts = append(hosts, strings.ToLower(host))
+				}
+			}
+			if len(hosts) == 0 {
+				continue
+			}
+			for _, ord := range scans[i].Ordinals[lib] {
+				if !slices.ContainsFunc(hosts, func(host string) bool {
+					return slices.Contains(exports[host], ord)
+				}) {
+					bad = append(bad, fmt.Sprintf("%s: %s#%d", strings.ToLower(di.Name()), lib, ord))
+				}
+			}
+		}
+	}
+	slices.Sort(bad)
+	return bad, nil
+}
+
+// peUnixLib gets the name of the unix lib for a PE module (e.g., ntdll.dll
+// -> ntdll.so).
+func peUnixLib(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".so"
+}
+
+// unixLibPairs finds the halves of wine builtins with a unix lib whose other
+// half is missing. Unix libs in unixDir are wine unix libs if they link to
+// ntdll.so, and PE modules in peDirs have one if they import the unix call
+// dispatcher from ntdll.dll. Orphaned unix libs and PE modules missing their
+// unix lib are returned as sorted paths.
+func unixLibPairs(unixDir string, peDirs ...string) (orphans, missing []string, err error) {
+	mods := map[string]bool{} // lowercased, without the extension
+	for _, dir := range peDirs {
+		dis, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		scans, err := parallelMap(dis, func(di fs.DirEntry) (*peScan, error) {
+			if !di.Type().IsRegular() {
+				return nil, nil
+			}
+			sc, err := peScanFile(filepath.Join(dir, di.Name()))
+			if err != nil {
+				return nil, nil // not a pe module
+			}
+			return sc, nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, di := range dis {
+			if scans[i] == nil {
+				continue
+			}
+			mods[strings.ToLower(strings.TrimSuffix(di.Name(), filepath.Ext(di.Name())))] = true
+			if slices.Contains(scans[i].Symbols["ntdll.dll"], "__wine_unix_call_dispatcher") {
+				if _, err := os.Stat(filepath.Join(unixDir, peUnixLib(di.Name()))); err != nil {
+					if !errors.Is(err, fs.ErrNotExist) {
+						return nil, nil, err
+					}
+					missing = append(missing, filepath.Join(dir, di.Name()))
+				}
+			}
+		}
+	}
+	dis, err := os.ReadDir(unixDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, di := range dis {
+		if !di.Type().IsRegular() || filepath.Ext(di.Name()) != ".so" || mods[strings.ToLower(strings.TrimSuffix(di.Name(), ".so"))] {
+			continue
+		}
+		if l, err := elfLibInfo(filepath.Join(unixDir, di.Name())); err == nil && slices.Contains(l.Needed, "ntdll.so") {
+			orphans = append(orphans, filepath.Join(unixDir, di.Name()))
+		}
+	}
+	slices.Sort(orphans)
+	slices.Sort(missing)
+	return orphans, missing, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestModGraphClosure(t *testing.T) {
+	g := &modGraph{
+		Names: map[string]string{
+			"ntdll.dll":    "ntdll.dll",
+			"kernel32.dll": "kernel32.dll",
+			"user32.dll":   "user32.dll",
+			"explorer.exe": "explorer.exe",
+			"wordpad.exe":  "wordpad.exe",
+			"riched20.dll": "riched20.dll",
+		},
+		Deps: map[string][]string{
+			"kernel32.dll": {"ntdll.dll"},
+			"user32.dll":   {"kernel32.dll", "win32u.dll"},
+			"explorer.exe": {"user32.dll", "kernel32.dll"},
+			"wordpad.exe":  {"riched20.dll", "user32.dll"},
+			"riched20.dll": {"user32.dll"},
+		},
+	}
+	if act, exp := g.Match([]string{"*.EXE"}), []string{"explorer.exe", "wordpad.exe"}; !slices.Equal(act, exp) {
+		t.Errorf("expected match %q, got %q", exp, act)
+	}
+	act := slices.Sorted(maps.Keys(g.Closure([]string{"Explorer.exe", "missing.dll"})))
+	if exp := []string{"explorer.exe", "kernel32.dll", "ntdll.dll", "user32.dll"}; !slices.Equal(act, exp) {
+		t.Errorf("expected closure %q, got %q", exp, act)
+	}
+	if act := peUnixLib("ntdll.dll"); act != "ntdll.so" {
+		t.Errorf("expected ntdll.so, got %q", act)
+	}
+}
+
+func TestUnixLibPairs(t *testing.T) {
+	// a stub importing the unix call dispatcher from ntdll
+	unixcall, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "x.dll", nil)
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+	const (
+		rva   = 0x2000
+		ohOff = 0x80 + 4 + 20
+	)
+	sect := make([]byte, 0x200)
+	le := binary.LittleEndian
+	le.PutUint32(sect[0x00:], rva+0x80)  // OriginalFirstThunk
+	le.PutUint32(sect[0x0c:], rva+0x100) // Name
+	le.PutUint32(sect[0x10:], rva+0x90)  // FirstThunk
+	le.PutUint64(sect[0x80:], rva+0x120)
+	le.PutUint64(sect[0x90:], rva+0x120)
+	copy(sect[0x100:], "ntdll.dll\x00")
+	copy(sect[0x122:], "__wine_unix_call_dispatcher\x00")
+	unixcall = peAddSection(t, unixcall, rva, sect)
+	le.PutUint32(unixcall[ohOff+112+8*pe.IMAGE_DIRECTORY_ENTRY_IMPORT:], rva)
+	le.PutUint32(unixcall[ohOff+112+8*pe.IMAGE_DIRECTORY_ENTRY_IMPORT+4:], 40)
+
+	plain, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "y.dll", nil)
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+
+	root := t.TempDir()
+	for name, buf := range map[string][]byte{
+		"x86_64-windows/ntdll.dll":     plain,
+		"x86_64-windows/bcrypt.dll":    unixcall,
+		"x86_64-windows/dnsapi.dll":    unixcall,
+		"x86_64-windows/mountmgr.sys":  unixcall,
+		"x86_64-windows/kernel32.dll":  plain,
+		"i386-windows/ws2_32.dll":      unixcall,
+		"x86_64-unix/ntdll.so":         elfTestLib("", "", "libc.so.6"),
+		"x86_64-unix/bcrypt.so":        elfTestLib("", "", "ntdll.so", "libc.so.6"),
+		"x86_64-unix/mountmgr.so":      elfTestLib("", "", "ntdll.so"),
+		"x86_64-unix/ws2_32.so":        elfTestLib("", "", "ntdll.so"),
+		"x86_64-unix/winex11.so":       elfTestLib("", "", "ntdll.so", "libX11.so.6"),
+		"x86_64-unix/libqemu-arm.so":   elfTestLib("", "", "libc.so.6"),
+		"x86_64-unix/notelf.so":        []byte("not an elf file"),
+		"x86_64-windows/readme.txt":    []byte("not a pe file"),
+		"x86_64-windows/winex11.drv16": []byte("MZ not a pe file"),
+	} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orphans, missing, err := unixLibPairs(filepath.Join(root, "x86_64-unix"), filepath.Join(root, "x86_64-windows"), filepath.Join(root, "i386-windows"))
+	if err != nil {
+		t.Fatalf("check pairs: %v", err)
+	}
+	if exp := []string{filepath.Join(root, "x86_64-unix/winex11.so")}; !slices.Equal(orphans, exp) {
+		t.Errorf("expected orphans %q, got %q", exp, orphans)
+	}
+	if exp := []string{filepath.Join(root, "x86_64-windows/dnsapi.dll")}; !slices.Equal(missing, exp) {
+		t.Errorf("expected missing %q, got %q", exp, missing)
+	}
+}
@@ -0,0 +1,198 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DebugSymbolsIndexName is the name of the index file in the debug symbols
+// directory. It is a tab-separated text file with a line per file:
+//
+//	build_id  path
+//
+// Where path is slash-separated and relative to the wine dir. The debug info
+// for each build ID is in .build-id/xx/yyyy.debug, like gdb's
+// debug-file-directory.
+const DebugSymbolsIndexName = "index.tsv"
+
+// debugSymbols is a file whose debug info was moved to the debug symbols
+// directory.
+type debugSymbols struct {
+	BuildID string
+	Path    string // slash-separated, relative to the wine dir
+}
+
+// splitDebugSymbols moves the debug info from the ELF files in the wine dir
+// into dir, keyed by the build ID, and writes the index. PE files are left
+// as-is, since the build host's objcopy may not support them, and rewriting
+// them with it doesn't preserve their layout.
+func splitDebugSymbols(dir string) ([]debugSymbols, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	var syms []debugSymbols
+	if err := filepath.WalkDir(*Prefix, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		id, ok, err := debugBuildID(path)
+		if err != nil || !ok {
+			return err
+		}
+		rel, err := filepath.Rel(*Prefix, path)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			slog.Warn("not splitting debug symbols for file without a build id", "path", rel)
+			return nil
+		}
+		out := filepath.Join(dir, ".build-id", id[:2], id[2:]+".debug")
+		if err := os.MkdirAll(filepath.Dir(out), 0777); err != nil {
+			return err
+		}
+		slog.Debug("splitting debug symbols", "path", rel, "build_id", id)
+		if err := objcopy("--only-keep-debug", path, out); err != nil {
+			return fmt.Errorf("extract debug symbols from %q: %w", rel, err)
+		}
+		if err := objcopy("--strip-debug", "--add-gnu-debuglink="+out, path); err != nil {
+			return fmt.Errorf("strip debug symbols from %q: %w", rel, err)
+		}
+		provModified(path, "split-debug-symbols")
+		syms = append(syms, debugSymbols{
+			BuildID: id,
+			Path:    filepath.ToSlash(rel),
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# build_id\tpath\n")
+	for _, s := range syms {
+		fmt.Fprintf(&b, "%s\t%s\n", s.BuildID, s.Path)
+	}
+	return syms, os.WriteFile(filepath.Join(dir, DebugSymbolsIndexName), b.Bytes(), 0644)
+}
+
+// stripDebugDirectories removes the debug directories from the PE files in the
+// wine dir (see peStripDebugDirectory), calling fn with the path of each
+// modified file and the number of entries removed.
+func stripDebugDirectories(dir string, fix peFixOptions, fn func(name string, n int)) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, _, err := peHeaderOffsets(buf); err != nil {
+			return nil // not a PE file (or a 16-bit one)
+		}
+		if _, n, err := peStripDebugDirectory(buf); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		} else if n == 0 {
+			return nil
+		}
+		var n int
+		if err := transform(path, trpe(func(buf []byte) (_ []byte, err error) {
+			buf, n, err = peStripDebugDirectory(buf)
+			return buf, err
+		}, fix)); err != nil {
+			return err
+		}
+		if fn != nil {
+			fn(path, n)
+		}
+		return nil
+	})
+}
+
+// objcopy runs objcopy from the build host.
+func objcopy(args ...string) error {
+	if buf, err := exec.Command("objcopy", args...).CombinedOutput(); err != nil {
+		if len(buf) != 0 {
+			err = fmt.Errorf("%w (output: %q)", err, bytes.TrimSpace(buf))
+		}
+		return err
+	}
+	return nil
+}
+
+// debugBuildID checks if name is an ELF file with debug info, returning the
+// lowercase hex GNU build ID (which may be empty if the file doesn't have one).
+func debugBuildID(name string) (string, bool, error) {
+	if f, err := elf.Open(name); err == nil {
+		defer f.Close()
+		var names []string
+		for _, s := range f.Sections {
+			names = append(names, s.Name)
+		}
+		if !hasDebugSections(names) {
+			return "", false, nil
+		}
+		if s := f.Section(".note.gnu.build-id"); s != nil {
+			buf, err := s.Data()
+			if err != nil {
+				return "", false, err
+			}
+			return elfBuildID(buf, f.ByteOrder), true, nil
+		}
+		return "", true, nil
+	}
+	return "", false, nil
+}
+
+// hasDebugSections checks if any of the section names are DWARF debug info.
+func hasDebugSections(names []string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(name, ".debug_") || strings.HasPrefix(name, ".zdebug_") {
+			return true
+		}
+	}
+	return false
+}
+
+// elfBuildID gets the build ID from the contents of a .note.gnu.build-id
+// section.
+func elfBuildID(buf []byte, bo binary.ByteOrder) string {
+	for len(buf) >= 12 {
+		var (
+			namesz = int(bo.Uint32(buf[0:]))
+			descsz = int(bo.Uint32(buf[4:]))
+			typ    = bo.Uint32(buf[8:])
+			name   = (namesz + 3) &^ 3
+			desc   = (descsz + 3) &^ 3
+		)
+		if 12+name+descsz > len(buf) {
+			break
+		}
+		if typ == 3 && namesz == 4 && string(buf[12:16]) == "GNU\x00" && descsz != 0 {
+			return hex.EncodeToString(buf[12+name : 12+name+descsz])
+		}
+		if 12+name+desc > len(buf) {
+			break
+		}
+		buf = buf[12+name+desc:]
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestElfBuildID(t *testing.T) {
+	note := func(name string, typ uint32, desc []byte) []byte {
+		b := binary.LittleEndian.AppendUint32(nil, uint32(len(name)))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(desc)))
+		b = binary.LittleEndian.AppendUint32(b, typ)
+		b = append(b, name...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		b = append(b, desc...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	for _, tc := range []struct {
+		Name string
+		Buf  []byte
+		ID   string
+	}{
+		{"Empty", nil, ""},
+		{"GNU", note("GNU\x00", 3, []byte{0xde, 0xad, 0xbe, 0xef, 0x01}), "deadbeef01"},
+		{"Skip", append(note("Go\x00\x00", 4, []byte("abc")), note("GNU\x00", 3, []byte{0x12, 0x34})...), "1234"},
+		{"WrongType", note("GNU\x00", 1, []byte{0x12, 0x34}), ""},
+		{"Truncated", note("GNU\x00", 3, []byte{0x12, 0x34})[:17], ""},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if id := elfBuildID(tc.Buf, binary.LittleEndian); id != tc.ID {
+				t.Errorf("expected %q, got %q", tc.ID, id)
+			}
+		})
+	}
+}
+
+func TestHasDebugSections(t *testing.T) {
+	if hasDebugSections([]string{".text", ".data", ".symtab"}) {
+		t.Errorf("expected no debug sections")
+	}
+	if !hasDebugSections([]string{".text", ".debug_info"}) {
+		t.Errorf("expected debug sections")
+	}
+	if !hasDebugSections([]string{".zdebug_line"}) {
+		t.Errorf("expected compressed debug sections")
+	}
+}
@@ -0,0 +1,145 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// ManifestDegradation is an optional input which was missing during the build.
+// The build is still valid, but the runtime lacks the functionality described
+// by the effect.
+type ManifestDegradation struct {
+	Component string `json:"component"`
+	Reason    string `json:"reason"`
+	Effect    string `json:"effect"`
+}
+
+var degradations struct {
+	mu sync.Mutex
+	d  []*ManifestDegradation
+}
+
+// degrade records that an optional input is missing, returning an error instead
+// if -strict is set.
+func degrade(component, reason, effect string) error {
+	if *Strict {
+		return fmt.Errorf("%s: %s (%s)", component, reason, effect)
+	}
+	slog.Warn("degraded build", "component", component, "reason", reason, "effect", effect)
+
+	degradations.mu.Lock()
+	defer degradations.mu.Unlock()
+
+	degradations.d = append(degradations.d, &ManifestDegradation{
+		Component: component,
+		Reason:    reason,
+		Effect:    effect,
+	})
+	return nil
+}
+
+// degraded checks if an optional input was recorded as missing.
+func degraded(component string) bool {
+	degradations.mu.Lock()
+	defer degradations.mu.Unlock()
+
+	return slices.ContainsFunc(degradations.d, func(d *ManifestDegradation) bool {
+		return d.Component == component
+	})
+}
+
+// hostLibs are the native libs which wine loads at runtime (and which aren't
+// part of glibc), by the affected functionality.
+var hostLibs = []struct {
+	Name   string
+	Effect string
+}{
+	{"libgnutls.so.30", "schannel and bcrypt will not work (no tls)"},
+	{"libfreetype.so.6", "fonts will not be rendered"},
+}
+
+// hostLib finds a native lib on the build host.
+func hostLib(name string) (string, bool, error) {
+	for _, dir := range []string{
+		filepath.Join("/lib", archt("x86_64-linux-gnu", "aarch64-linux-gnu")),
+		filepath.Join("/usr/lib", archt("x86_64-linux-gnu", "aarch64-linux-gnu")),
+		"/lib64",
+		"/usr/lib64",
+		"/lib",
+		"/usr/lib",
+	} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, true, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", false, err
+		}
+	}
+	return "", false, nil
+}
+
+// vendorHostLibs copies the host libs needed by the ELF files in the wine dir
+// (plus the specified dlopen'd libs), and the libs those need, into its lib
+// dir. Libs from glibc and libs which are already in the wine dir are skipped.
+func vendorHostLibs(prefix string, dlopen []string) error {
+	t, err := elfTreeOf(prefix, "bin", "lib", path.Join("lib/wine", archt("x86_64-unix", "aarch64-unix")))
+	if err != nil {
+		return err
+	}
+	var (
+		n     int
+		done  = map[string]bool{}
+		queue = append(t.ExternalNeeded(), dlopen...)
+	)
+	for len(queue) != 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if done[name] || isGlibcLib(name) {
+			continue
+		}
+		done[name] = true
+
+		dst := filepath.Join(prefix, "lib", name)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		src, ok, err := hostLib(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			slog.Warn("host lib needed by wine not found on the build host", "name", name)
+			continue
+		}
+		buf, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, buf, 0644); err != nil {
+			return err
+		}
+		provVendored(dst, src, "vendor-host-libs")
+		slog.Debug("vendored host lib", "name", name, "source", src)
+		n++
+
+		l, err := elfLibInfo(dst)
+		if err != nil {
+			return fmt.Errorf("read vendored lib %q: %w", name, err)
+		}
+		queue = append(queue, l.Needed...)
+	}
+	slog.Info("vendored host libs", "count", n)
+	return nil
+}
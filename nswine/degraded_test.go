@@ -0,0 +1,30 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDegrade(t *testing.T) {
+	defer func(v bool) {
+		*Strict = v
+		degradations.d = nil
+	}(*Strict)
+
+	*Strict = false
+	if err := degrade("wine-mono", "not found", ".net applications will not run"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(degradations.d) != 1 || *degradations.d[0] != (ManifestDegradation{"wine-mono", "not found", ".net applications will not run"}) {
+		t.Errorf("incorrect degradations %+v", degradations.d)
+	}
+
+	*Strict = true
+	if err := degrade("wine-gecko", "not found", "html rendering will not work"); err == nil {
+		t.Errorf("expected error with -strict")
+	}
+	if len(degradations.d) != 1 {
+		t.Errorf("degradation recorded with -strict")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dllOverridesKey is the registry key wine reads the global dll overrides
+// from.
+const dllOverridesKey = `HKCU\Software\Wine\DllOverrides`
+
+// parseDllOverrideMode normalizes a dll load order like wine's DllOverrides
+// registry values (e.g., "native,builtin", or "" to disable the dll), also
+// accepting the short forms from WINEDLLOVERRIDES (e.g., "n,b" or "d").
+func parseDllOverrideMode(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "d", "disabled":
+		return "", nil
+	}
+	var modes []string
+	for x := range strings.SplitSeq(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(x)) {
+		case "n", "native":
+			x = "native"
+		case "b", "builtin":
+			x = "builtin"
+		default:
+			return "", fmt.Errorf("invalid load order %q: unknown mode %q", s, x)
+		}
+		for _, m := range modes {
+			if m == x {
+				return "", fmt.Errorf("invalid load order %q: duplicate mode %q", s, x)
+			}
+		}
+		modes = append(modes, x)
+	}
+	return strings.Join(modes, ","), nil
+}
+
+// parseDllOverrides parses dll overrides in the WINEDLLOVERRIDES format (e.g.,
+// "mscoree,mshtml=;d3d11=n,b"), returning the normalized names and load
+// orders.
+func parseDllOverrides(s string) (map[string]string, error) {
+	r := map[string]string{}
+	for x := range strings.SplitSeq(s, ";") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		names, mode, ok := strings.Cut(x, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid dll override %q: expected names=mode", x)
+		}
+		mode, err := parseDllOverrideMode(mode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dll override %q: %w", x, err)
+		}
+		for name := range strings.SplitSeq(names, ",") {
+			if name = dllOverrideName(name); name == "" {
+				return nil, fmt.Errorf("invalid dll override %q: empty name", x)
+			}
+			r[name] = mode
+		}
+	}
+	return r, nil
+}
+
+// dllOverrideName normalizes a dll override name like wine does when looking
+// them up (i.e., case-insensitively, and without a .dll extension).
+func dllOverrideName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.TrimSuffix(name, ".dll")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseDllOverrides(t *testing.T) {
+	for _, tc := range []struct {
+		In  string
+		Out map[string]string
+	}{
+		{"", map[string]string{}},
+		{"mscoree,mshtml=", map[string]string{"mscoree": "", "mshtml": ""}},
+		{"d3d11.dll=n,b; dxgi=builtin,native ;winemenubuilder.exe=d", map[string]string{"d3d11": "native,builtin", "dxgi": "builtin,native", "winemenubuilder.exe": ""}},
+		{"A.DLL=N", map[string]string{"a": "native"}},
+		{"a", nil},
+		{"=n", nil},
+		{"a=x", nil},
+		{"a=n,n", nil},
+		{"a=n,d", nil},
+	} {
+		act, err := parseDllOverrides(tc.In)
+		if tc.Out == nil {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.In)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.In, err)
+		} else if !maps.Equal(act, tc.Out) {
+			t.Errorf("%q: expected %q, got %q", tc.In, tc.Out, act)
+		}
+	}
+}
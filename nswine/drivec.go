@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// driveCCruft are case-insensitive globs for the slash-separated paths (relative
+// to drive_c) which wineboot creates but which aren't needed by a headless
+// runtime.
+var driveCCruft = []string{
+	// program skeletons (the fake exes are removed from wine.inf already)
+	"Program Files/Internet Explorer",
+	"Program Files (x86)/Internet Explorer",
+	"Program Files/Windows Media Player",
+	"Program Files (x86)/Windows Media Player",
+	"Program Files/Windows NT",
+	"Program Files (x86)/Windows NT",
+	"Program Files/Common Files/Microsoft Shared",
+	"Program Files (x86)/Common Files/Microsoft Shared",
+
+	// caches
+	"ProgramData/Package Cache",
+	"ProgramData/Microsoft/Windows/Caches",
+	"users/*/AppData/Local/Microsoft/Windows/INetCache",
+	"users/*/AppData/Local/Microsoft/Windows/INetCookies",
+	"users/*/AppData/Local/Microsoft/Windows/History",
+	"users/*/AppData/Local/Microsoft/Windows/Temporary Internet Files",
+	"users/*/AppData/Roaming/Microsoft/Internet Explorer",
+	"windows/Installer",
+	"windows/logs",
+	"windows/temp/*",
+}
+
+// cleanDriveC removes the paths matching cruft from the drive_c at root,
+// except for ones matching keep (or containing a path which could match keep).
+// It returns the removed slash-separated paths relative to root.
+func cleanDriveC(root string, cruft, keep []string) ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if matchAny(keep, rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !driveCMatchUnder(cruft, rel) {
+			return nil
+		}
+		if d.IsDir() && driveCContains(keep, rel) {
+			return nil // remove the contents individually
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		removed = append(removed, rel)
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// neutralizeShellFolders replaces the symlinks in each user profile dir under
+// users (which wineboot points at the build host's XDG user dirs) with empty
+// dirs, returning the replaced slash-separated paths relative to users.
+func neutralizeShellFolders(users string) ([]string, error) {
+	dis, err := os.ReadDir(users)
+	if err != nil {
+		return nil, err
+	}
+	var replaced []string
+	for _, di := range dis {
+		if !di.IsDir() {
+			continue
+		}
+		fis, err := os.ReadDir(filepath.Join(users, di.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if fi.Type()&fs.ModeSymlink == 0 {
+				continue
+			}
+			p := filepath.Join(users, di.Name(), fi.Name())
+			if err := os.Remove(p); err != nil {
+				return nil, err
+			}
+			if err := os.Mkdir(p, 0755); err != nil {
+				return nil, err
+			}
+			replaced = append(replaced, di.Name()+"/"+fi.Name())
+		}
+	}
+	return replaced, nil
+}
+
+// driveCMatchUnder checks if rel or any of its parents matches any of the
+// globs.
+func driveCMatchUnder(globs []string, rel string) bool {
+	for x := rel; x != "."; x = path.Dir(x) {
+		if matchAny(globs, x) {
+			return true
+		}
+	}
+	return false
+}
+
+// driveCContains checks if any of the globs could match a path under dir.
+func driveCContains(globs []string, dir string) bool {
+	ds := strings.Split(strings.ToLower(dir), "/")
+	for _, g := range globs {
+		gs := strings.Split(strings.ToLower(g), "/")
+		if len(gs) <= len(ds) {
+			continue
+		}
+		match := true
+		for i := range ds {
+			if ok, _ := path.Match(gs[i], ds[i]); !ok {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
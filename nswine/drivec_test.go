@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCleanDriveC(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"Program Files/Internet Explorer/iexplore.exe",
+		"Program Files/Common Files/Microsoft Shared/TextConv/x.dll",
+		"Program Files/Common Files/Microsoft Shared/Stationery/y.htm",
+		"users/nswrap/AppData/Local/Microsoft/Windows/INetCache/z",
+		"users/nswrap/Documents/Respawn/profile.cfg",
+		"windows/temp/a.tmp",
+		"windows/system32/kernel32.dll",
+	} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := cleanDriveC(root, driveCCruft, []string{
+		"program files/common files/microsoft shared/textconv",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := []string{
+		"Program Files/Common Files/Microsoft Shared/Stationery",
+		"Program Files/Internet Explorer",
+		"users/nswrap/AppData/Local/Microsoft/Windows/INetCache",
+		"windows/temp/a.tmp",
+	}; !slices.Equal(removed, exp) {
+		t.Errorf("expected removed %q, got %q", exp, removed)
+	}
+	for _, name := range []string{
+		"Program Files/Common Files/Microsoft Shared/TextConv/x.dll",
+		"users/nswrap/Documents/Respawn/profile.cfg",
+		"windows/temp",
+		"windows/system32/kernel32.dll",
+	} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("expected %q to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestNeutralizeShellFolders(t *testing.T) {
+	users := t.TempDir()
+	for _, name := range []string{"Public/Documents", "nswrap/AppData"} {
+		if err := os.MkdirAll(filepath.Join(users, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"Desktop", "Documents"} {
+		if err := os.Symlink("/home/builder/"+name, filepath.Join(users, "nswrap", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replaced, err := neutralizeShellFolders(users)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := []string{"nswrap/Desktop", "nswrap/Documents"}; !slices.Equal(replaced, exp) {
+		t.Errorf("expected replaced %q, got %q", exp, replaced)
+	}
+	for _, name := range []string{"nswrap/Desktop", "nswrap/Documents", "nswrap/AppData", "Public/Documents"} {
+		if fi, err := os.Lstat(filepath.Join(users, name)); err != nil || !fi.IsDir() {
+			t.Errorf("expected %q to be a dir", name)
+		}
+	}
+}
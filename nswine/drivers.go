@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// driverFamily is a group of mutually-exclusive wine drivers, of which at most
+// one is kept in the runtime.
+type driverFamily struct {
+	Value   string              // value name in HKCU\Software\Wine\Drivers
+	None    string              // value to use when no driver is selected
+	Drivers map[string][]string // driver name (as used in the registry value) to wine lib file names
+}
+
+// driverFamilies are the driver families known to the driver policy.
+var driverFamilies = map[string]driverFamily{
+	"graphics": {
+		Value: "Graphics",
+		None:  "null",
+		Drivers: map[string][]string{
+			"x11":     {"winex11.drv", "winex11.so"},
+			"wayland": {"winewayland.drv", "winewayland.so"},
+			"mac":     {"winemac.drv", "winemac.so"},
+		},
+	},
+	"audio": {
+		Value: "Audio",
+		None:  "",
+		Drivers: map[string][]string{
+			"pulse":     {"winepulse.drv", "winepulse.so"},
+			"alsa":      {"winealsa.drv", "winealsa.so"},
+			"oss":       {"wineoss.drv", "wineoss.so"},
+			"coreaudio": {"winecoreaudio.drv", "winecoreaudio.so"},
+		},
+	},
+}
+
+// driverPolicy maps each driver family to the selected driver, or an empty
+// string for none.
+type driverPolicy map[string]string
+
+// parseDriverPolicy parses a comma-separated list of family=driver pairs
+// (e.g., "graphics=x11,audio=none"). Families which aren't specified are set
+// to none.
+func parseDriverPolicy(s string) (driverPolicy, error) {
+	p := driverPolicy{}
+	for family := range driverFamilies {
+		p[family] = ""
+	}
+	for x := range strings.SplitSeq(s, ",") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		family, driver, ok := strings.Cut(x, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid driver selection %q: expected family=driver", x)
+		}
+		f, ok := driverFamilies[family]
+		if !ok {
+			return nil, fmt.Errorf("unknown driver family %q (expected one of %q)", family, slices.Sorted(maps.Keys(driverFamilies)))
+		}
+		if driver == "none" {
+			driver = ""
+		} else if _, ok := f.Drivers[driver]; !ok {
+			return nil, fmt.Errorf("unknown %s driver %q (expected none or one of %q)", family, driver, slices.Sorted(maps.Keys(f.Drivers)))
+		}
+		p[family] = driver
+	}
+	return p, nil
+}
+
+// Keeps checks whether a wine lib file belongs to a driver family, and if so,
+// whether it's part of the selected driver.
+func (p driverPolicy) Keeps(name string) (keep, ok bool) {
+	for family, f := range driverFamilies {
+		for driver, files := range f.Drivers {
+			if matchAny(files, name) {
+				return p[family] == driver, true
+			}
+		}
+	}
+	return false, false
+}
+
+// Removed returns the sorted file names of the drivers which aren't selected.
+func (p driverPolicy) Removed() []string {
+	var names []string
+	for family, f := range driverFamilies {
+		for driver, files := range f.Drivers {
+			if p[family] != driver {
+				names = append(names, files...)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Registry returns the HKCU\Software\Wine\Drivers values for the selected
+// drivers.
+func (p driverPolicy) Registry() map[string]string {
+	m := map[string]string{}
+	for family, f := range driverFamilies {
+		if driver := p[family]; driver != "" {
+			m[f.Value] = driver
+		} else {
+			m[f.Value] = f.None
+		}
+	}
+	return m
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDriverPolicy(t *testing.T) {
+	for _, s := range []string{"graphics", "display=x11", "graphics=xorg", "audio=x11"} {
+		if _, err := parseDriverPolicy(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+
+	p, err := parseDriverPolicy("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := p.Registry(); v["Graphics"] != "null" || v["Audio"] != "" {
+		t.Errorf("incorrect default registry values %q", v)
+	}
+	if keep, ok := p.Keeps("WineX11.drv"); !ok || keep {
+		t.Errorf("expected winex11.drv to be removed")
+	}
+
+	p, err = parseDriverPolicy("graphics=wayland, audio=pulse")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := p.Registry(); v["Graphics"] != "wayland" || v["Audio"] != "pulse" {
+		t.Errorf("incorrect registry values %q", v)
+	}
+	for name, exp := range map[string]bool{
+		"winewayland.drv": true,
+		"winewayland.so":  true,
+		"winepulse.so":    true,
+		"winex11.drv":     false,
+		"winealsa.drv":    false,
+	} {
+		if keep, ok := p.Keeps(name); !ok || keep != exp {
+			t.Errorf("%s: expected keep=%t, got (%t, %t)", name, exp, keep, ok)
+		}
+	}
+	if _, ok := p.Keeps("kernel32.dll"); ok {
+		t.Errorf("kernel32.dll is not a driver")
+	}
+
+}
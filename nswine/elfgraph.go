@@ -0,0 +1,209 @@
+package main
+
+import (
+	"debug/elf"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// elfLib is the dynamic linking information of an ELF executable or shared
+// library.
+type elfLib struct {
+	Soname string   // DT_SONAME, if any
+	Needed []string // DT_NEEDED
+	Rpath  []string // DT_RUNPATH (or DT_RPATH if there isn't one), split but not expanded
+}
+
+// elfLibInfo reads the dynamic linking information of an ELF file.
+func elfLibInfo(name string) (*elfLib, error) {
+	f, err := elf.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var l elfLib
+	soname, err := f.DynString(elf.DT_SONAME)
+	if err != nil {
+		return nil, err
+	}
+	if len(soname) != 0 {
+		l.Soname = soname[0]
+	}
+	if l.Needed, err = f.DynString(elf.DT_NEEDED); err != nil {
+		return nil, err
+	}
+	rpath, err := f.DynString(elf.DT_RUNPATH)
+	if err != nil {
+		return nil, err
+	}
+	if len(rpath) == 0 {
+		if rpath, err = f.DynString(elf.DT_RPATH); err != nil {
+			return nil, err
+		}
+	}
+	for _, x := range rpath {
+		for _, d := range strings.Split(x, ":") {
+			if d != "" {
+				l.Rpath = append(l.Rpath, d)
+			}
+		}
+	}
+	return &l, nil
+}
+
+// elfTree is the dependency graph of the ELF files directly in some directories
+// of a tree (e.g., the wine dir), resolved like the dynamic linker would if the
+// directories were in LD_LIBRARY_PATH. Paths are slash-separated and relative
+// to the root.
+type elfTree struct {
+	Root     string
+	Dirs     []string
+	Libs     map[string]*elfLib
+	Deps     map[string][]string // resolved DT_NEEDED
+	External map[string][]string // DT_NEEDED which aren't in the tree (i.e., from the host)
+}
+
+// elfTreeOf builds the dependency graph of the ELF files in dirs (relative to
+// root). Files which aren't ELF files and dirs which don't exist are ignored.
+func elfTreeOf(root string, dirs ...string) (*elfTree, error) {
+	t := &elfTree{
+		Root:     root,
+		Dirs:     dirs,
+		Libs:     map[string]*elfLib{},
+		Deps:     map[string][]string{},
+		External: map[string][]string{},
+	}
+	for _, dir := range dirs {
+		dis, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		for _, di := range dis {
+			if !di.Type().IsRegular() {
+				continue
+			}
+			rel := path.Join(dir, di.Name())
+			if l, err := elfLibInfo(filepath.Join(root, filepath.FromSlash(rel))); err == nil {
+				t.Libs[rel] = l
+			}
+		}
+	}
+	for rel, l := range t.Libs {
+		for _, need := range l.Needed {
+			if dep, ok := t.resolve(rel, l, need); ok {
+				if dep != rel && !slices.Contains(t.Deps[rel], dep) {
+					t.Deps[rel] = append(t.Deps[rel], dep)
+				}
+			} else if !slices.Contains(t.External[rel], need) {
+				t.External[rel] = append(t.External[rel], need)
+			}
+		}
+	}
+	return t, nil
+}
+
+// resolve finds the file in the tree which would be loaded for a DT_NEEDED
+// entry of the lib at rel. The rpath is searched first (ignoring entries
+// outside the tree), then the tree dirs.
+func (t *elfTree) resolve(rel string, l *elfLib, need string) (string, bool) {
+	if strings.ContainsRune(need, '/') {
+		return "", false
+	}
+	var search []string
+	for _, d := range l.Rpath {
+		d = strings.ReplaceAll(d, "${ORIGIN}", "$ORIGIN")
+		if x, ok := strings.CutPrefix(d, "$ORIGIN"); ok {
+			if d = path.Join(path.Dir(rel), x); d == ".." || strings.HasPrefix(d, "../") {
+				continue
+			}
+			search = append(search, d)
+		}
+	}
+	for _, d := range append(search, t.Dirs...) {
+		cand := path.Join(d, need)
+		if _, ok := t.Libs[cand]; ok {
+			return cand, true
+		}
+		if p, err := filepath.EvalSymlinks(filepath.Join(t.Root, filepath.FromSlash(cand))); err == nil {
+			if root, err := filepath.EvalSymlinks(t.Root); err == nil {
+				if x, err := filepath.Rel(root, p); err == nil {
+					if _, ok := t.Libs[filepath.ToSlash(x)]; ok {
+						return filepath.ToSlash(x), true
+					}
+				}
+			}
+		}
+		for _, x := range slices.Sorted(maps.Keys(t.Libs)) {
+			if path.Dir(x) == d && t.Libs[x].Soname == need {
+				return x, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Closure returns the paths reachable from the roots. Roots which aren't in the
+// tree are ignored.
+func (t *elfTree) Closure(roots []string) map[string]bool {
+	reach := map[string]bool{}
+	queue := slices.Clone(roots)
+	for len(queue) != 0 {
+		rel := queue[0]
+		queue = queue[1:]
+		if _, ok := t.Libs[rel]; !ok || reach[rel] {
+			continue
+		}
+		reach[rel] = true
+		queue = append(queue, t.Deps[rel]...)
+	}
+	return reach
+}
+
+// ExternalNeeded returns the sorted DT_NEEDED entries of all files in the tree
+// which aren't in the tree.
+func (t *elfTree) ExternalNeeded() []string {
+	var needed []string
+	for _, libs := range t.External {
+		for _, lib := range libs {
+			if !slices.Contains(needed, lib) {
+				needed = append(needed, lib)
+			}
+		}
+	}
+	slices.Sort(needed)
+	return needed
+}
+
+// isGlibcLib checks if name is a lib provided by glibc (including the dynamic
+// linker), which must always come from the host.
+func isGlibcLib(name string) bool {
+	return matchAny([]string{
+		"ld-linux*.so.*",
+		"libc.so.*",
+		"libm.so.*",
+		"libmvec.so.*",
+		"libdl.so.*",
+		"libpthread.so.*",
+		"librt.so.*",
+		"libresolv.so.*",
+		"libutil.so.*",
+		"libanl.so.*",
+		"libthread_db.so.*",
+		"libBrokenLocale.so.*",
+		"libnss_*.so.*",
+		"libc_malloc_debug.so.*",
+		"libmemusage.so",
+		"libpcprofile.so",
+		"libSegFault.so",
+	}, name)
+}
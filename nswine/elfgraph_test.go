@@ -0,0 +1,148 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// elfTestLib generates a minimal ELF64 shared library with only a dynamic
+// section.
+func elfTestLib(soname, rpath string, needed ...string) []byte {
+	le := binary.LittleEndian
+
+	dynstr := []byte{0}
+	str := func(s string) uint64 {
+		off := len(dynstr)
+		dynstr = append(append(dynstr, s...), 0)
+		return uint64(off)
+	}
+	var dyn []byte
+	ent := func(tag elf.DynTag, val uint64) {
+		dyn = le.AppendUint64(dyn, uint64(tag))
+		dyn = le.AppendUint64(dyn, val)
+	}
+	for _, x := range needed {
+		ent(elf.DT_NEEDED, str(x))
+	}
+	if soname != "" {
+		ent(elf.DT_SONAME, str(soname))
+	}
+	if rpath != "" {
+		ent(elf.DT_RUNPATH, str(rpath))
+	}
+	ent(elf.DT_NULL, 0)
+	shstr := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+
+	const ehsize, shentsize = 64, 64
+	var (
+		dynstrOff = uint64(ehsize)
+		dynOff    = dynstrOff + uint64(len(dynstr))
+		shstrOff  = dynOff + uint64(len(dyn))
+		shOff     = shstrOff + uint64(len(shstr))
+	)
+	buf := make([]byte, ehsize)
+	copy(buf, "\x7fELF")
+	buf[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	buf[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	buf[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	le.PutUint16(buf[16:], uint16(elf.ET_DYN))
+	le.PutUint16(buf[18:], uint16(elf.EM_X86_64))
+	le.PutUint32(buf[20:], uint32(elf.EV_CURRENT))
+	le.PutUint64(buf[40:], shOff)
+	le.PutUint16(buf[52:], ehsize)
+	le.PutUint16(buf[58:], shentsize)
+	le.PutUint16(buf[60:], 4) // shnum
+	le.PutUint16(buf[62:], 3) // shstrndx
+	buf = append(buf, dynstr...)
+	buf = append(buf, dyn...)
+	buf = append(buf, shstr...)
+
+	sh := func(name uint32, typ elf.SectionType, off, size uint64, link uint32, entsize uint64) {
+		b := make([]byte, shentsize)
+		le.PutUint32(b[0:], name)
+		le.PutUint32(b[4:], uint32(typ))
+		le.PutUint64(b[24:], off)
+		le.PutUint64(b[32:], size)
+		le.PutUint32(b[40:], link)
+		le.PutUint64(b[48:], 1)
+		le.PutUint64(b[56:], entsize)
+		buf = append(buf, b...)
+	}
+	sh(0, elf.SHT_NULL, 0, 0, 0, 0)
+	sh(1, elf.SHT_STRTAB, dynstrOff, uint64(len(dynstr)), 0, 0)
+	sh(9, elf.SHT_DYNAMIC, dynOff, uint64(len(dyn)), 1, 16)
+	sh(18, elf.SHT_STRTAB, shstrOff, uint64(len(shstr)), 0, 0)
+	return buf
+}
+
+func TestElfTree(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel string, buf []byte) {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("lib/wine/x86_64-unix/ntdll.so", elfTestLib("", "", "libc.so.6", "libunwind.so.8"))
+	write("lib/wine/x86_64-unix/winex11.so", elfTestLib("", "", "libX11.so.6", "ntdll.so"))
+	write("lib/wine/x86_64-unix/bcrypt.so", elfTestLib("", "$ORIGIN/../../private", "libhelper.so.1", "libc.so.6"))
+	write("lib/wine/x86_64-unix/notelf.so", []byte("not an elf file"))
+	write("lib/libunwind.so.8.0.1", elfTestLib("libunwind.so.8", "", "liblzma.so.5", "libc.so.6"))
+	write("lib/private/libhelper.so.1", elfTestLib("libhelper.so.1", ""))
+	if err := os.Symlink("libunwind.so.8.0.1", filepath.Join(root, "lib/libunwind.so.8")); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := elfLibInfo(filepath.Join(root, "lib/libunwind.so.8.0.1"))
+	if err != nil {
+		t.Fatalf("read elf: %v", err)
+	}
+	if exp := (&elfLib{Soname: "libunwind.so.8", Needed: []string{"liblzma.so.5", "libc.so.6"}}); !reflect.DeepEqual(l, exp) {
+		t.Errorf("expected %+v, got %+v", exp, l)
+	}
+
+	tree, err := elfTreeOf(root, "lib/wine/x86_64-unix", "lib", "lib/private", "missing")
+	if err != nil {
+		t.Fatalf("build tree: %v", err)
+	}
+	if exp := []string{"lib/libunwind.so.8.0.1", "lib/private/libhelper.so.1", "lib/wine/x86_64-unix/bcrypt.so", "lib/wine/x86_64-unix/ntdll.so", "lib/wine/x86_64-unix/winex11.so"}; !slices.Equal(slices.Sorted(maps.Keys(tree.Libs)), exp) {
+		t.Errorf("expected libs %q, got %q", exp, slices.Sorted(maps.Keys(tree.Libs)))
+	}
+	if exp := []string{"lib/libunwind.so.8.0.1"}; !slices.Equal(tree.Deps["lib/wine/x86_64-unix/ntdll.so"], exp) {
+		t.Errorf("expected ntdll deps %q, got %q", exp, tree.Deps["lib/wine/x86_64-unix/ntdll.so"])
+	}
+	if exp := []string{"lib/private/libhelper.so.1"}; !slices.Equal(tree.Deps["lib/wine/x86_64-unix/bcrypt.so"], exp) {
+		t.Errorf("expected bcrypt deps %q, got %q", exp, tree.Deps["lib/wine/x86_64-unix/bcrypt.so"])
+	}
+	if exp := []string{"libX11.so.6", "libc.so.6", "liblzma.so.5"}; !slices.Equal(tree.ExternalNeeded(), exp) {
+		t.Errorf("expected external %q, got %q", exp, tree.ExternalNeeded())
+	}
+	reach := slices.Sorted(maps.Keys(tree.Closure([]string{"lib/wine/x86_64-unix/winex11.so", "missing.so"})))
+	if exp := []string{"lib/libunwind.so.8.0.1", "lib/wine/x86_64-unix/ntdll.so", "lib/wine/x86_64-unix/winex11.so"}; !slices.Equal(reach, exp) {
+		t.Errorf("expected closure %q, got %q", exp, reach)
+	}
+
+	for name, exp := range map[string]bool{
+		"libc.so.6":              true,
+		"ld-linux-x86-64.so.2":   true,
+		"libnss_files.so.2":      true,
+		"libgnutls.so.30":        false,
+		"libcrypt.so.1":          false,
+		"libc_malloc_debug.so.0": true,
+		"librtmp.so.1":           false,
+		"libfreetype.so.6":       false,
+	} {
+		if act := isGlibcLib(name); act != exp {
+			t.Errorf("isGlibcLib(%q): expected %t, got %t", name, exp, act)
+		}
+	}
+}
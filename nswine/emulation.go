@@ -0,0 +1,146 @@
+package main
+
+import (
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// emulationBackends are the hangover emulators for running x86_64 code
+// (arm64ec) on arm64, by the name used for -emulator. The first file is the
+// emulator DLL which wine loads.
+var emulationBackends = map[string][]string{
+	"fex":  {"libarm64ecfex.dll"},
+	"qemu": {"xtajit64.dll", "libqemu-x86_64.so"},
+}
+
+// emulationUnsupported are the hangover emulators for architectures the
+// runtime never supports on arm64 (arm32, and i386 since wow64 is removed by
+// -optimize).
+var emulationUnsupported = []string{
+	"wowarmhw.dll",
+	"wowarmhw.so",
+	"libqemu-arm.so",
+	"libwow64fex.dll",
+	"wowbox64.dll",
+	"xtajit.dll",
+	"libqemu-i386.so",
+}
+
+// checkEmulationBackend checks if name is a known emulation backend.
+func checkEmulationBackend(name string) error {
+	if _, ok := emulationBackends[name]; !ok {
+		return fmt.Errorf("unknown emulation backend %q (expected one of %q)", name, slices.Sorted(maps.Keys(emulationBackends)))
+	}
+	return nil
+}
+
+// emulationRemoves returns the file names of the emulation pieces which aren't
+// used by the selected backend.
+func emulationRemoves(backend string) []string {
+	names := slices.Clone(emulationUnsupported)
+	for _, name := range slices.Sorted(maps.Keys(emulationBackends)) {
+		if name != backend {
+			names = append(names, emulationBackends[name]...)
+		}
+	}
+	return names
+}
+
+// emulationMissing returns the files of the backend which aren't in the
+// aarch64-windows or aarch64-unix dirs of the wine dir.
+func emulationMissing(dir, backend string) ([]string, error) {
+	var missing []string
+	for _, name := range emulationBackends[backend] {
+		var found bool
+		for _, sub := range []string{"lib/wine/aarch64-windows", "lib/wine/aarch64-unix"} {
+			if _, err := os.Stat(filepath.Join(dir, sub, name)); err == nil {
+				found = true
+				break
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+// emulationCheckBinaries checks that each PE file directly in dir (the
+// aarch64-windows dir) is either pure ARM64 or has valid ARM64EC metadata
+// (i.e., it isn't an x86_64-only binary, which wine would try to load as-is).
+func emulationCheckBinaries(dir string) error {
+	dis, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var bad []string
+	for _, di := range dis {
+		if !di.Type().IsRegular() {
+			continue
+		}
+		if err := emulationCheckBinary(filepath.Join(dir, di.Name())); err != nil {
+			bad = append(bad, fmt.Sprintf("%s: %v", di.Name(), err))
+		}
+	}
+	if len(bad) != 0 {
+		return fmt.Errorf("invalid arm64 binaries: %q", bad)
+	}
+	return nil
+}
+
+// emulationCheckBinary checks a single file for emulationCheckBinaries. Files
+// which aren't PE files are ignored.
+func emulationCheckBinary(name string) error {
+	r, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var magic [2]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || string(magic[:]) != "MZ" {
+		return nil
+	}
+	f, err := peNewFile(r)
+	if err != nil {
+		return fmt.Errorf("invalid pe file: %w", err)
+	}
+	switch f.Machine {
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return nil
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return nil // PE32, emulated with wow64
+	case peMachineARM64EC, peMachineARM64X:
+		if len(f.CodeMap) == 0 {
+			return fmt.Errorf("arm64ec metadata has an empty code map")
+		}
+		var size uint32
+		switch oh := f.OptionalHeader.(type) {
+		case *pe.OptionalHeader64:
+			size = oh.SizeOfImage
+		case *pe.OptionalHeader32:
+			size = oh.SizeOfImage
+		default:
+			return fmt.Errorf("missing optional header")
+		}
+		for _, c := range f.CodeMap {
+			if c.RVA > size || c.Size > size-c.RVA {
+				return fmt.Errorf("arm64ec code map range %#x+%#x is outside the image", c.RVA, c.Size)
+			}
+		}
+		return nil
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return fmt.Errorf("x86_64-only binary (no arm64ec metadata)")
+	default:
+		return fmt.Errorf("unsupported machine type %#x", f.Machine)
+	}
+}
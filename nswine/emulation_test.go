@@ -0,0 +1,92 @@
+package main
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEmulationRemoves(t *testing.T) {
+	if err := checkEmulationBackend("box64"); err == nil {
+		t.Errorf("expected error for unknown backend")
+	}
+	for backend, files := range emulationBackends {
+		if err := checkEmulationBackend(backend); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		remove := emulationRemoves(backend)
+		for _, name := range files {
+			if slices.Contains(remove, name) {
+				t.Errorf("%s: removes own file %q", backend, name)
+			}
+		}
+		for other, files := range emulationBackends {
+			for _, name := range files {
+				if other != backend && !slices.Contains(remove, name) {
+					t.Errorf("%s: does not remove %s file %q", backend, other, name)
+				}
+			}
+		}
+		if !slices.Contains(remove, "wowarmhw.dll") {
+			t.Errorf("%s: does not remove arm32 support", backend)
+		}
+	}
+}
+
+func TestEmulationCheck(t *testing.T) {
+	dir := t.TempDir()
+	win := filepath.Join(dir, "lib/wine/aarch64-windows")
+	if err := os.MkdirAll(win, 0777); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, buf []byte) {
+		if err := os.WriteFile(filepath.Join(win, name), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stub := func(machine uint16) []byte {
+		buf, err := peStub(machine, "test.dll", []string{"Fn"})
+		if err != nil {
+			t.Fatalf("generate stub: %v", err)
+		}
+		return buf
+	}
+
+	write("kernel32.dll", stub(pe.IMAGE_FILE_MACHINE_ARM64))
+	write("libarm64ecfex.dll", stub(pe.IMAGE_FILE_MACHINE_ARM64))
+	write("readme.txt", []byte("not a pe file"))
+	{
+		// minimal PE32 image (wow64 binaries are PE32)
+		buf := make([]byte, 0x40+4+20+224)
+		copy(buf, "MZ")
+		binary.LittleEndian.PutUint32(buf[0x3c:], 0x40)
+		copy(buf[0x40:], "PE\x00\x00")
+		binary.LittleEndian.PutUint16(buf[0x44:], pe.IMAGE_FILE_MACHINE_I386)
+		binary.LittleEndian.PutUint16(buf[0x54:], 224)   // SizeOfOptionalHeader
+		binary.LittleEndian.PutUint16(buf[0x58:], 0x10b) // Magic
+		binary.LittleEndian.PutUint32(buf[0x58+92:], 16) // NumberOfRvaAndSizes
+		write("wow64.dll", buf)
+	}
+	if err := emulationCheckBinaries(win); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	write("x64.dll", stub(pe.IMAGE_FILE_MACHINE_AMD64))
+	write("broken.dll", []byte("MZ but not a pe file"))
+	if err := emulationCheckBinaries(win); err == nil {
+		t.Errorf("expected error")
+	} else if !strings.Contains(err.Error(), "x64.dll") || !strings.Contains(err.Error(), "broken.dll") || strings.Contains(err.Error(), "kernel32.dll") {
+		t.Errorf("incorrect error: %v", err)
+	}
+
+	if missing, err := emulationMissing(dir, "fex"); err != nil || len(missing) != 0 {
+		t.Errorf("fex: expected nothing missing, got %q (err: %v)", missing, err)
+	}
+	if missing, err := emulationMissing(dir, "qemu"); err != nil || !slices.Equal(missing, emulationBackends["qemu"]) {
+		t.Errorf("qemu: expected everything missing, got %q (err: %v)", missing, err)
+	}
+}
@@ -0,0 +1,299 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// A mirror is a local directory of build inputs which is consulted before
+// downloading anything. It is laid out as:
+//
+//	sha256/<hex>  file contents, addressed by their sha256 hash
+//	files/<name>  symlink to ../sha256/<hex> for each component file name
+//
+// Since the contents are hash-addressed, a mirror can be shared between wine
+// versions and architectures, and can be verified without any other metadata.
+type mirror string
+
+// fetchHTTPClient is used to download components. Like profileHTTPClient, the
+// timeout includes reading the body, so it's long enough for the largest
+// components on a slow connection, but still fails a stalled mirror.
+var fetchHTTPClient = &http.Client{Timeout: 30 * time.Minute}
+
+// componentVersions are the versions used to resolve component URLs. These
+// correspond to the Dockerfile args.
+type componentVersions struct {
+	Wine           string
+	Hangover       string
+	Debian         string
+	DebianCodename string
+}
+
+// component is a file downloaded to build the runtime.
+type component struct {
+	Arch string
+	URL  string
+}
+
+// Name gets the file name of the component.
+func (c component) Name() string {
+	if u, err := url.Parse(c.URL); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(c.URL)
+}
+
+// components returns the components for all architectures.
+func components(v componentVersions) []component {
+	var cs []component
+	deb := func(pkg, arch string) {
+		cs = append(cs, component{"amd64", fmt.Sprintf(
+			"https://dl.winehq.org/wine-builds/debian/dists/%[1]s/main/binary-%[3]s/%[2]s_%[4]s~%[1]s-1_%[3]s.deb",
+			v.DebianCodename, pkg, arch, v.Wine,
+		)})
+	}
+	deb("winehq-devel", "amd64")
+	deb("wine-devel", "amd64")
+	deb("wine-devel-amd64", "amd64")
+	deb("wine-devel-i386", "i386")
+
+	hangover := v.Wine
+	if v.Hangover != "" {
+		hangover += "." + v.Hangover
+	}
+	cs = append(cs, component{"arm64", fmt.Sprintf(
+		"https://github.com/AndreRH/hangover/releases/download/hangover-%[1]s/hangover_%[1]s_debian%[2]s_%[3]s_arm64.tar",
+		hangover, v.Debian, v.DebianCodename,
+	)})
+	return cs
+}
+
+// Lookup gets the path to a file in the mirror by name, verifying its hash.
+// If the file isn't in the mirror, it returns an error wrapping
+// os.ErrNotExist.
+func (m mirror) Lookup(name string) (string, error) {
+	if m == "" {
+		return "", os.ErrNotExist
+	}
+	link := filepath.Join(string(m), "files", name)
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+	if filepath.Base(filepath.Dir(target)) != "sha256" {
+		return "", fmt.Errorf("mirror file %q does not point to a hash-addressed file", name)
+	}
+	p := filepath.Join(filepath.Dir(link), target)
+	sum, err := sha256File(p)
+	if err != nil {
+		return "", err
+	}
+	if want := filepath.Base(target); sum != want {
+		return "", fmt.Errorf("mirror file %q is corrupt (expected sha256 %s, got %s)", name, want, sum)
+	}
+	return p, nil
+}
+
+// Missing gets the names of the components which aren't in the mirror. Unlike
+// Lookup, it doesn't verify their hashes, so it's cheap enough to check every
+// component before fetching any of them.
+func (m mirror) Missing(cs []component) []string {
+	var missing []string
+	for _, c := range cs {
+		if m == "" {
+			missing = append(missing, c.Name())
+		} else if _, err := os.Lstat(filepath.Join(string(m), "files", c.Name())); err != nil {
+			missing = append(missing, c.Name())
+		}
+	}
+	return missing
+}
+
+// Put adds a file to the mirror, replacing any existing file with the same
+// name. The file at src is moved into the mirror.
+func (m mirror) Put(name, src string) (string, error) {
+	sum, err := sha256File(src)
+	if err != nil {
+		return "", err
+	}
+	for _, x := range []string{"sha256", "files"} {
+		if err := os.MkdirAll(filepath.Join(string(m), x), 0777); err != nil {
+			return "", err
+		}
+	}
+	p := filepath.Join(string(m), "sha256", sum)
+	if err := os.Rename(src, p); err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(string(m), "files", "."+name+".tmp")
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join("..", "sha256", sum), tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(string(m), "files", name)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return p, nil
+}
+
+// Fetch gets a component from the mirror, or downloads it to dir (or the
+// mirror if dir is empty) if it isn't there and offline is false. It returns
+// the path to the file.
+func (m mirror) Fetch(c component, dir string, offline bool) (string, error) {
+	name := c.Name()
+	p, err := m.Lookup(name)
+	if err == nil {
+		slog.Debug("found component in mirror", "name", name)
+		return p, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if offline {
+		return "", fmt.Errorf("component %q is not in the mirror", name)
+	}
+	if dir == "" && m == "" {
+		return "", fmt.Errorf("no mirror or output directory")
+	}
+
+	slog.Info("downloading component", "name", name, "url", c.URL)
+	tmpdir := dir
+	if tmpdir == "" {
+		tmpdir = string(m)
+	}
+	if err := os.MkdirAll(tmpdir, 0777); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(tmpdir, "."+name+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	resp, err := fetchHTTPClient.Get(c.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download %q: response status %d", c.URL, resp.StatusCode)
+	}
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		return "", fmt.Errorf("download %q: %w", c.URL, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if dir != "" {
+		p = filepath.Join(dir, name)
+		return p, os.Rename(tmp.Name(), p)
+	}
+	return m.Put(name, tmp.Name())
+}
+
+// sha256File hashes a file.
+func sha256File(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fetchMain implements the fetch subcommand, which gets the components
+// required to build the runtime from the mirror or the network.
+func fetchMain(args []string) error {
+	var v componentVersions
+	fset := flag.NewFlagSet("fetch", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s fetch [options]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fset.Output(), "Populates a mirror with the components required to build the runtime, or\ncopies them from the mirror to -output (downloading them if needed).\n\n")
+		fset.PrintDefaults()
+	}
+	var (
+		mirrorDir = fset.String("mirror", "mirror", "mirror directory")
+		output    = fset.String("output", "", "copy components to this directory instead of adding them to the mirror")
+		all       = fset.Bool("all", false, "fetch components for all architectures instead of only the current one")
+		offline   = fset.Bool("offline", false, "only use components from the mirror")
+		debug     = fset.Bool("debug", false, "debug logging")
+	)
+	fset.StringVar(&v.Wine, "wine", "10.6", "wine version")
+	fset.StringVar(&v.Hangover, "hangover", "1", "hangover version suffix")
+	fset.StringVar(&v.Debian, "debian", "12", "debian version")
+	fset.StringVar(&v.DebianCodename, "debian-codename", "bookworm", "debian codename")
+	fset.Parse(args)
+
+	if fset.NArg() != 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	setupLogging(*debug)
+
+	var cs []component
+	for _, c := range components(v) {
+		if *all || c.Arch == runtime.GOARCH {
+			cs = append(cs, c)
+		}
+	}
+	if *offline {
+		if missing := mirror(*mirrorDir).Missing(cs); len(missing) != 0 {
+			return fmt.Errorf("components not in the mirror (fetch them without -offline first): %s", strings.Join(missing, ", "))
+		}
+	}
+
+	var n int
+	for _, c := range cs {
+		p, err := mirror(*mirrorDir).Fetch(c, *output, *offline)
+		if err != nil {
+			return fmt.Errorf("fetch %s: %w", c.Name(), err)
+		}
+		if *output != "" && filepath.Dir(p) != filepath.Clean(*output) {
+			if err := copyFile(p, filepath.Join(*output, c.Name())); err != nil {
+				return fmt.Errorf("fetch %s: %w", c.Name(), err)
+			}
+		}
+		n++
+	}
+	slog.Info("fetched components", "count", n)
+	return nil
+}
+
+// copyFile copies a regular file.
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,100 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestComponents(t *testing.T) {
+	cs := components(componentVersions{
+		Wine:           "10.6",
+		Hangover:       "1",
+		Debian:         "12",
+		DebianCodename: "bookworm",
+	})
+	for _, exp := range []component{
+		{"amd64", "https://dl.winehq.org/wine-builds/debian/dists/bookworm/main/binary-amd64/winehq-devel_10.6~bookworm-1_amd64.deb"},
+		{"amd64", "https://dl.winehq.org/wine-builds/debian/dists/bookworm/main/binary-i386/wine-devel-i386_10.6~bookworm-1_i386.deb"},
+		{"arm64", "https://github.com/AndreRH/hangover/releases/download/hangover-10.6.1/hangover_10.6.1_debian12_bookworm_arm64.tar"},
+	} {
+		var found bool
+		for _, c := range cs {
+			if c == exp {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing component %v", exp)
+		}
+	}
+	if n := (component{URL: "https://example.com/a/b_1~2.deb?x=y"}).Name(); n != "b_1~2.deb" {
+		t.Errorf("incorrect name %q", n)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/dl/test.deb" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("test"))
+	}))
+	defer srv.Close()
+
+	m := mirror(filepath.Join(t.TempDir(), "mirror"))
+	c := component{"amd64", srv.URL + "/dl/test.deb"}
+
+	if _, err := m.Lookup(c.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+	if _, err := m.Fetch(c, "", true); err == nil {
+		t.Fatalf("expected error when offline")
+	}
+	if missing := m.Missing([]component{c}); !slices.Equal(missing, []string{c.Name()}) {
+		t.Errorf("expected %q to be missing, got %q", c.Name(), missing)
+	}
+	if _, err := m.Fetch(component{"amd64", srv.URL + "/dl/missing.deb"}, "", false); err == nil {
+		t.Fatalf("expected error for missing file")
+	}
+
+	p, err := m.Fetch(c, "", false)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if exp := filepath.Join(string(m), "sha256", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"); p != exp {
+		t.Errorf("expected %q, got %q", exp, p)
+	}
+	if _, err := m.Fetch(c, "", true); err != nil {
+		t.Errorf("fetch from mirror: %v", err)
+	}
+	if missing := m.Missing([]component{c}); len(missing) != 0 {
+		t.Errorf("expected nothing to be missing, got %q", missing)
+	}
+
+	out := t.TempDir()
+	if p, err := mirror("").Fetch(c, out, false); err != nil {
+		t.Errorf("fetch to output: %v", err)
+	} else if p != filepath.Join(out, c.Name()) {
+		t.Errorf("incorrect output path %q", p)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+
+	if err := os.WriteFile(p, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Lookup(c.Name()); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected corruption error, got %v", err)
+	}
+}
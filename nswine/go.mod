@@ -5,12 +5,4 @@ go 1.24.2
 require (
 	github.com/lmittmann/tint v1.0.7
 	github.com/rogpeppe/go-internal v1.14.1
-	github.com/willscott/pefile-go v0.0.0-20191203022938-b1d80162b106
-)
-
-require (
-	github.com/edsrzf/mmap-go v1.1.0 // indirect
-	github.com/glaslos/ssdeep v0.4.0 // indirect
-	github.com/pkg/errors v0.8.1 // indirect
-	golang.org/x/sys v0.26.0 // indirect
 )
@@ -0,0 +1,43 @@
+package main
+
+// headlessStubResult is returned by every function exported by the headless
+// stubs (DXGI_ERROR_UNSUPPORTED), so code probing for d3d11/dxgi gets a normal
+// failure it should already handle.
+const headlessStubResult = 0x887A0004
+
+// headlessStubs are the graphics DLLs which are replaced with failing stubs by
+// -headless-stubs after being removed, and the functions they export.
+var headlessStubs = map[string][]string{
+	"d3d11.dll": {
+		"D3D11CreateDevice",
+		"D3D11CreateDeviceAndSwapChain",
+		"D3D11On12CreateDevice",
+	},
+	"dxgi.dll": {
+		"CreateDXGIFactory",
+		"CreateDXGIFactory1",
+		"CreateDXGIFactory2",
+		"DXGIDeclareAdapterRemovalSupport",
+		"DXGIGetDebugInterface1",
+	},
+}
+
+// headlessRegistry are the registry values set in every prefix (unless the
+// profile sets them) so a crashing process prints a backtrace and exits instead
+// of hanging on a crash dialog which nobody can dismiss, or waiting for a
+// debugger to attach. If winedbg.exe isn't kept, starting the debugger fails,
+// and the process exits without the backtrace. The debugger keeps the
+// REG_EXPAND_SZ type wineboot creates it with.
+var headlessRegistry = map[string]map[string]any{
+	`HKCU\Software\Wine\WineDbg`: {
+		"ShowCrashDialog": float64(0),
+	},
+	`HKLM\Software\Microsoft\Windows NT\CurrentVersion\AeDebug`: {
+		"Auto":     "1",
+		"Debugger": map[string]any{"type": "REG_EXPAND_SZ", "value": "winedbg --auto %ld %ld"},
+	},
+	`HKLM\Software\Wow6432Node\Microsoft\Windows NT\CurrentVersion\AeDebug`: {
+		"Auto":     "1",
+		"Debugger": map[string]any{"type": "REG_EXPAND_SZ", "value": "winedbg --auto %ld %ld"},
+	},
+}
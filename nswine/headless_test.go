@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestHeadlessRegistry(t *testing.T) {
+	if err := (&Profile{Registry: headlessRegistry}).validate(); err != nil {
+		t.Errorf("invalid headless registry values: %v", err)
+	}
+	for key, values := range headlessRegistry {
+		if v, ok := values["Debugger"]; ok {
+			if typ, _, err := profileRegValue(v); err != nil || typ != "REG_EXPAND_SZ" {
+				t.Errorf("%s: expected Debugger to be REG_EXPAND_SZ, got %s (%v)", key, typ, err)
+			}
+		}
+	}
+}
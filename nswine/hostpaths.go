@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// hostPathPrefixes are the prefixes of absolute paths from the build host which
+// can end up in binaries (e.g., via __FILE__, PDB paths, DWARF comp dirs, or
+// configure-time defaults). Build dirs (leak=true) don't mean anything at
+// runtime and are safe to normalize, but system paths may be used at runtime
+// (e.g., search paths), so they are only reported. The temporary dirs are
+// also used at runtime (e.g., wine's "/tmp/.wine-%u" server dir).
+var hostPathPrefixes = []struct {
+	Prefix string
+	Leak   bool
+}{
+	{"/home/", true},
+	{"/root/", true},
+	{"/build/", true},
+	{"/builds/", true},
+	{"/tmp/", false},
+	{"/var/tmp/", false},
+	{"/usr/src/", true},
+	{"/usr/lib/", false},
+	{"/usr/local/", false},
+	{"/usr/include/", false},
+	{"/usr/share/", false},
+}
+
+// hostPath is an absolute path from the build host found in a binary.
+type hostPath struct {
+	Offset int
+	Path   string
+	Leak   bool // a build dir rather than a system path
+}
+
+// findHostPaths finds the build host paths in a binary. Only paths at the start
+// of a string are found.
+func findHostPaths(buf []byte) []hostPath {
+	var res []hostPath
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != '/' || (i != 0 && buf[i-1] >= 0x20 && buf[i-1] < 0x7f) {
+			continue
+		}
+		for _, p := range hostPathPrefixes {
+			if !bytes.HasPrefix(buf[i:], []byte(p.Prefix)) {
+				continue
+			}
+			j := i
+			for j < len(buf) && buf[j] > 0x20 && buf[j] < 0x7f {
+				j++
+			}
+			res = append(res, hostPath{i, string(buf[i:j]), p.Leak})
+			i = j
+			break
+		}
+	}
+	return res
+}
+
+// normalizeHostPaths replaces the build dir paths which are null-terminated
+// strings in a binary with their base name (padding the rest of the string
+// with zeros), returning the number replaced. Format strings are never
+// replaced since they're built into paths at runtime.
+func normalizeHostPaths(buf []byte) int {
+	var n int
+	for _, p := range findHostPaths(buf) {
+		end := p.Offset + len(p.Path)
+		if !p.Leak || end >= len(buf) || buf[end] != 0 || strings.ContainsRune(p.Path, '%') {
+			continue
+		}
+		repl := path.Base(p.Path)
+		copy(buf[p.Offset:], repl)
+		clear(buf[p.Offset+len(repl) : end])
+		n++
+	}
+	return n
+}
+
+// scanHostPaths finds the build host paths in the PE and ELF binaries under dir,
+// by slash-separated relative path. If normalize is true, the build dir paths
+// are normalized (see normalizeHostPaths), and fn is called (possibly
+// concurrently) for each modified file. The paths returned are the ones found
+// before normalizing.
+func scanHostPaths(dir string, normalize bool, fn func(name string, n int)) (map[string][]hostPath, error) {
+	var names []string
+	if err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			names = append(names, p)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	found, err := parallelMap(names, func(name string) ([]hostPath, error) {
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(buf, []byte("MZ")) && !bytes.HasPrefix(buf, []byte("\x7fELF")) {
+			return nil, nil
+		}
+		ps := findHostPaths(buf)
+		if normalize && slices.ContainsFunc(ps, func(p hostPath) bool { return p.Leak }) {
+			var n int
+			if err := transform(name, trpe(func(buf []byte) ([]byte, error) {
+				n = normalizeHostPaths(buf)
+				return buf, nil
+			}, peFixOptions{})); err != nil {
+				return nil, err
+			}
+			if n != 0 && fn != nil {
+				fn(name, n)
+			}
+		}
+		return ps, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := map[string][]hostPath{}
+	for i, name := range names {
+		if len(found[i]) != 0 {
+			rel, err := filepath.Rel(dir, name)
+			if err != nil {
+				return nil, err
+			}
+			res[filepath.ToSlash(rel)] = found[i]
+		}
+	}
+	return res, nil
+}
+
+// hostPathSummary summarizes the paths found in a binary for logging.
+func hostPathSummary(ps []hostPath) (leaks, system []string) {
+	for _, p := range ps {
+		if p.Leak {
+			leaks = append(leaks, p.Path)
+		} else {
+			system = append(system, p.Path)
+		}
+	}
+	return
+}
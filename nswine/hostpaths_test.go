@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHostPaths(t *testing.T) {
+	buf := []byte("\x7fELF\x00/build/wine-10.0/dlls/ntdll/unix/debug.c\x00/usr/lib/x86_64-linux-gnu\x00see /home/user/x\x00\x01/home/user/.cache/y")
+	exp := []hostPath{
+		{5, "/build/wine-10.0/dlls/ntdll/unix/debug.c", true},
+		{46, "/usr/lib/x86_64-linux-gnu", false},
+		{90, "/home/user/.cache/y", true},
+	}
+	if act := findHostPaths(buf); !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected %+v, got %+v", exp, act)
+	}
+
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"lib/wine/x86_64-unix/ntdll.so": buf,
+		"share/wine/wine.inf":           []byte("\x00/build/wine-10.0/x\x00"),
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var modified []string
+	found, err := scanHostPaths(dir, true, func(name string, n int) {
+		if n != 1 {
+			t.Errorf("expected one path to be normalized, got %d", n)
+		}
+		modified = append(modified, name)
+	})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if !reflect.DeepEqual(found, map[string][]hostPath{"lib/wine/x86_64-unix/ntdll.so": exp}) {
+		t.Errorf("incorrect paths found: %+v", found)
+	}
+	if exp := []string{filepath.Join(dir, "lib/wine/x86_64-unix/ntdll.so")}; !reflect.DeepEqual(modified, exp) {
+		t.Errorf("expected modified %q, got %q", exp, modified)
+	}
+
+	act, err := os.ReadFile(filepath.Join(dir, "lib/wine/x86_64-unix/ntdll.so"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(act) != len(buf) {
+		t.Fatalf("normalizing changed the file size")
+	}
+	if ps := findHostPaths(act); !reflect.DeepEqual(ps, []hostPath{exp[1], exp[2]}) {
+		t.Errorf("expected only the system path and unterminated path to remain, got %+v", ps)
+	}
+	if s := string(act[5:13]); s != "debug.c\x00" {
+		t.Errorf("expected the path to be replaced with the base name, got %q", s)
+	}
+}
+
+func TestHostPathsRuntime(t *testing.T) {
+	for _, str := range []string{
+		"/tmp/.wine-%u/server-%llx-%llx", // dlls/ntdll/unix/server.c
+		"/home/%s/.wine",
+		"/var/tmp/x",
+	} {
+		buf := []byte("\x00" + str + "\x00")
+		if n := normalizeHostPaths(buf); n != 0 {
+			t.Errorf("%q: expected nothing to be normalized, got %d", str, n)
+		}
+		if act := string(buf[1 : len(buf)-1]); act != str {
+			t.Errorf("%q: modified to %q", str, act)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// prefixIdentity is the machine identity which wineboot would otherwise derive
+// from the build host. The user name isn't included since it's always the one
+// nswrap uses (see wineEnv), and wine's machine SID is already constant.
+type prefixIdentity struct {
+	ComputerName string // uppercase netbios name
+	MachineGUID  string // without braces
+	VolumeSerial uint32 // drive_c
+}
+
+// parseIdentity parses a comma-separated list of key=value identity overrides
+// (computername, machineguid, and serial). The machine guid and volume serial
+// are derived from the computer name (which defaults to NSWRAP) if not set.
+func parseIdentity(s string) (prefixIdentity, error) {
+	var (
+		id     = prefixIdentity{ComputerName: "NSWRAP"}
+		guid   string
+		serial = -1
+	)
+	for x := range strings.SplitSeq(s, ",") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(x, "=")
+		if !ok {
+			return id, fmt.Errorf("invalid identity override %q: expected key=value", x)
+		}
+		switch key {
+		case "computername":
+			if !regex(`^[A-Za-z0-9-]{1,15}$`).MatchString(value) {
+				return id, fmt.Errorf("invalid computer name %q: must be 1-15 letters, digits, or hyphens", value)
+			}
+			id.ComputerName = strings.ToUpper(value)
+		case "machineguid":
+			value = strings.ToLower(strings.Trim(value, "{}"))
+			if !regex(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`).MatchString(value) {
+				return id, fmt.Errorf("invalid machine guid %q", value)
+			}
+			guid = value
+		case "serial":
+			v, err := strconv.ParseUint(strings.ReplaceAll(value, "-", ""), 16, 32)
+			if err != nil {
+				return id, fmt.Errorf("invalid volume serial %q: %w", value, err)
+			}
+			serial = int(v)
+		default:
+			return id, fmt.Errorf("unknown identity key %q (expected computername, machineguid, or serial)", key)
+		}
+	}
+	h := sha256.Sum256([]byte("nswine identity\x00" + id.ComputerName))
+	if id.MachineGUID = guid; guid == "" {
+		h[6] = h[6]&0x0f | 0x80 // version 8 (custom)
+		h[8] = h[8]&0x3f | 0x80 // variant
+		id.MachineGUID = fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+	}
+	if id.VolumeSerial = uint32(serial); serial == -1 {
+		id.VolumeSerial = binary.LittleEndian.Uint32(h[16:])
+	}
+	return id, nil
+}
+
+// RegistryEdits returns the registry edits to replace the identity wineboot
+// sets.
+func (id prefixIdentity) RegistryEdits() []regEdit {
+	var edits []regEdit
+	set := func(key, name, value string) {
+		edits = append(edits, regEdit{Key: key, Value: &regValue{Name: name, Type: regSZ, Data: regStringData(value)}})
+	}
+	set(`HKLM\System\CurrentControlSet\Control\ComputerName\ComputerName`, "ComputerName", id.ComputerName)
+	set(`HKLM\System\CurrentControlSet\Services\Tcpip\Parameters`, "Hostname", strings.ToLower(id.ComputerName))
+	set(`HKLM\System\CurrentControlSet\Services\Tcpip\Parameters`, "NV Hostname", strings.ToLower(id.ComputerName))
+	set(`HKLM\Software\Microsoft\Cryptography`, "MachineGuid", id.MachineGUID)
+	return edits
+}
+
+// SerialFile returns the contents of the .windows-serial file wine's mountmgr
+// reads the volume serial from for drives without one.
+func (id prefixIdentity) SerialFile() []byte {
+	return fmt.Appendf(nil, "%08x\n", id.VolumeSerial)
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestParseIdentity(t *testing.T) {
+	a, err := parseIdentity("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a.ComputerName != "NSWRAP" || !regex(`^[0-9a-f]{8}-[0-9a-f]{4}-8[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(a.MachineGUID) {
+		t.Errorf("incorrect default identity %+v", a)
+	}
+	if b, _ := parseIdentity(""); b != a {
+		t.Errorf("default identity isn't deterministic: %+v != %+v", a, b)
+	}
+
+	b, err := parseIdentity("computername=server-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.ComputerName != "SERVER-1" || b.MachineGUID == a.MachineGUID || b.VolumeSerial == a.VolumeSerial {
+		t.Errorf("expected identity to be derived from the computer name, got %+v", b)
+	}
+
+	c, err := parseIdentity("machineguid={0123ABCD-0000-4000-8000-000000000000}, serial=1234-ABCD")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.ComputerName != "NSWRAP" || c.MachineGUID != "0123abcd-0000-4000-8000-000000000000" || c.VolumeSerial != 0x1234abcd || string(c.SerialFile()) != "1234abcd\n" {
+		t.Errorf("incorrect identity %+v", c)
+	}
+
+	hives := map[string]*regFile{}
+	if err := applyRegEdits(hives, c.RegistryEdits()); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if v, ok := hives["system.reg"].Value(`Software\Microsoft\Cryptography`, "MachineGuid").Str(); !ok || v != c.MachineGUID {
+		t.Errorf("incorrect machine guid %q", v)
+	}
+	if v, ok := hives["system.reg"].Value(`System\CurrentControlSet\Control\ComputerName\ComputerName`, "ComputerName").Str(); !ok || v != "NSWRAP" {
+		t.Errorf("incorrect computer name %q", v)
+	}
+
+	for _, s := range []string{"computername=this-is-too-long", "computername=a_b", "machineguid=x", "serial=xyz", "user=x", "computername"} {
+		if _, err := parseIdentity(s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
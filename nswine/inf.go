@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// infFile is a parsed INF file. Lines which aren't modified are written back
+// as-is, so filtering it only changes what it needs to.
+type infFile struct {
+	Sections []*infSection
+
+	// CRLF is whether to write CRLF newlines. It is set by parseInf if the
+	// first line of the file ends with one, so the original style is preserved
+	// unless it's changed. Internally, newlines are always LF.
+	CRLF bool
+
+	referenced map[string]bool // lowercased sections originally referenced by a directive
+}
+
+// infSection is a section of an INF file. The first section has an empty name
+// and contains the lines before the first section header. Sections can appear
+// multiple times.
+type infSection struct {
+	Name   string
+	Num    int    // line number of the header
+	Header string // the raw header line
+	Lines  []*infLine
+}
+
+// infLine is a logical line in an INF section, which may span multiple physical
+// lines ending with a backslash.
+type infLine struct {
+	Num    int      // line number of the first physical line
+	Raw    string   // the physical lines, or empty if modified
+	Text   string   // the logical line, without comments or continuations
+	Key    string   // the lowercased key, if it's a directive (key=values)
+	Values []string // the unquoted comma-separated values (after the key, if any)
+
+	head   string // the key and separator, as written
+	indent string // the indentation of the continuation lines, if any
+}
+
+// infSectionDirectives are the install section directives whose values are
+// the names of other sections in the same INF.
+var infSectionDirectives = []string{
+	"addreg",
+	"bitreg",
+	"copyfiles",
+	"delfiles",
+	"delreg",
+	"ini2reg",
+	"profileitems",
+	"registerdlls",
+	"renfiles",
+	"unregisterdlls",
+	"updateinifields",
+	"updateinis",
+	"winefakedlls",
+}
+
+// parseInf parses an INF file with LF or CRLF newlines.
+func parseInf(buf []byte) (*infFile, error) {
+	f := &infFile{
+		Sections:   []*infSection{{}},
+		referenced: map[string]bool{},
+	}
+	if line, _, ok := bytes.Cut(buf, []byte("\n")); ok && bytes.HasSuffix(line, []byte("\r")) {
+		f.CRLF = true
+	}
+	buf = bytes.ReplaceAll(buf, []byte("\r\n"), []byte("\n"))
+	var (
+		num  int
+		cur  *infLine
+		cont bool
+	)
+	for line := range bytes.Lines(buf) {
+		num++
+		text := strings.TrimSpace(infStripComment(strings.TrimSuffix(string(line), "\n")))
+		if cont {
+			cur.Raw += string(line)
+			if cur.indent == "" {
+				cur.indent = string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+			}
+		} else if name, ok := infSectionHeader(text); ok {
+			f.Sections = append(f.Sections, &infSection{
+				Name:   name,
+				Num:    num,
+				Header: string(line),
+			})
+			continue
+		} else {
+			cur = &infLine{Num: num, Raw: string(line)}
+			s := f.Sections[len(f.Sections)-1]
+			s.Lines = append(s.Lines, cur)
+		}
+		if text, cont = strings.CutSuffix(text, `\`); cont {
+			text = strings.TrimSpace(text)
+		}
+		cur.Text += text
+		if !cont {
+			cur.parse()
+		}
+	}
+	if cont {
+		cur.parse() // continued at the end of the file
+	}
+	for _, s := range f.Sections {
+		for _, l := range s.Lines {
+			for _, ref := range l.Refs() {
+				f.referenced[strings.ToLower(ref)] = true
+			}
+		}
+	}
+	return f, nil
+}
+
+// infSectionHeader parses a section header line (without the comment).
+func infSectionHeader(text string) (string, bool) {
+	if x, ok := strings.CutPrefix(text, "["); ok {
+		if x, ok := strings.CutSuffix(x, "]"); ok {
+			return strings.TrimSpace(x), true
+		}
+	}
+	return "", false
+}
+
+// parse splits the logical line into the key and values.
+func (l *infLine) parse() {
+	if l.Text == "" {
+		return
+	}
+	var quoted bool
+	for i, c := range l.Text {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			l.Values = infValues(l.Text)
+			return
+		case c == '=' && !quoted:
+			if key := strings.TrimSpace(l.Text[:i]); key != "" {
+				l.Key = strings.ToLower(key)
+				l.Values = infValues(l.Text[i+1:])
+				if j := strings.IndexByte(l.Raw, '='); j != -1 {
+					l.head = l.Raw[:j+1]
+				}
+				return
+			}
+		}
+	}
+	l.Values = infValues(l.Text)
+}
+
+// Refs returns the names of the sections referenced by the line if it's a
+// directive.
+func (l *infLine) Refs() []string {
+	var refs []string
+	switch {
+	case l.Key == "addservice":
+		// name, flags, service-install-section[, event-log-install-section, ...]
+		for i := 2; i < min(len(l.Values), 4); i++ {
+			if l.Values[i] != "" {
+				refs = append(refs, l.Values[i])
+			}
+		}
+	case slices.Contains(infSectionDirectives, l.Key):
+		for _, v := range l.Values {
+			if v != "" && (l.Key != "copyfiles" || !strings.HasPrefix(v, "@")) {
+				refs = append(refs, v)
+			}
+		}
+	}
+	return refs
+}
+
+// Files returns the lowercased file names referenced by the values of the line,
+// including ones in command lines.
+func (l *infLine) Files() []string {
+	var names []string
+	for _, v := range l.Values {
+		for _, x := range strings.Fields(v) {
+			if name := infFileName(x); strings.Contains(name, ".") && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// setValues replaces the values of a directive, marking it as modified.
+func (l *infLine) setValues(values []string) {
+	l.Values, l.Raw = values, ""
+}
+
+// String formats the line, including the trailing newline.
+func (l *infLine) String() string {
+	if l.Raw != "" {
+		return l.Raw
+	}
+	quoted := make([]string, len(l.Values))
+	for i, v := range l.Values {
+		quoted[i] = infQuote(v)
+	}
+	if l.indent == "" {
+		return l.head + strings.Join(quoted, ",") + "\n"
+	}
+	var b strings.Builder
+	b.WriteString(l.head + "\\\n")
+	for i, v := range quoted {
+		b.WriteString(l.indent + v)
+		if i != len(quoted)-1 {
+			b.WriteString(",\\")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// infQuote quotes an INF value if needed.
+func infQuote(v string) string {
+	if strings.ContainsAny(v, `,;"`) || strings.TrimSpace(v) != v {
+		return `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+	}
+	return v
+}
+
+// Bytes formats the INF file.
+func (f *infFile) Bytes() []byte {
+	var b bytes.Buffer
+	for _, s := range f.Sections {
+		b.WriteString(s.Header)
+		for _, l := range s.Lines {
+			b.WriteString(l.String())
+		}
+	}
+	if f.CRLF {
+		return bytes.ReplaceAll(b.Bytes(), []byte("\n"), []byte("\r\n"))
+	}
+	return b.Bytes()
+}
+
+// Has checks if a section exists (case-insensitively).
+func (f *infFile) Has(name string) bool {
+	return slices.ContainsFunc(f.Sections, func(s *infSection) bool {
+		return s.Num != 0 && strings.EqualFold(s.Name, name)
+	})
+}
+
+// Lines returns the lines of the sections with the specified name.
+func (f *infFile) Lines(name string) []*infLine {
+	var lines []*infLine
+	for _, s := range f.Sections {
+		if s.Num != 0 && strings.EqualFold(s.Name, name) {
+			lines = append(lines, s.Lines...)
+		}
+	}
+	return lines
+}
+
+// RemoveLines removes the lines (other than blank lines and comments) for
+// which fn returns true.
+func (f *infFile) RemoveLines(fn func(s *infSection, l *infLine) bool) {
+	for _, s := range f.Sections {
+		s.Lines = slices.DeleteFunc(s.Lines, func(l *infLine) bool {
+			return l.Text != "" && fn(s, l)
+		})
+	}
+}
+
+// RemoveSection removes a section, along with references to it in directives
+// and its DestinationDirs entry. Service install sections are removed with
+// their AddService directive.
+func (f *infFile) RemoveSection(name string) {
+	f.Sections = slices.DeleteFunc(f.Sections, func(s *infSection) bool {
+		return s.Num != 0 && strings.EqualFold(s.Name, name)
+	})
+	for _, s := range f.Sections {
+		s.Lines = slices.DeleteFunc(s.Lines, func(l *infLine) bool {
+			switch {
+			case strings.EqualFold(s.Name, "DestinationDirs"):
+				return l.Key == strings.ToLower(name)
+			case l.Key == "addservice":
+				if len(l.Values) > 2 && strings.EqualFold(l.Values[2], name) {
+					return true
+				}
+				if len(l.Values) > 3 && strings.EqualFold(l.Values[3], name) {
+					l.setValues(l.Values[:3])
+				}
+			case slices.Contains(infSectionDirectives, l.Key):
+				if values := slices.DeleteFunc(slices.Clone(l.Values), func(v string) bool {
+					return strings.EqualFold(v, name)
+				}); len(values) != len(l.Values) {
+					if len(values) == 0 {
+						return true
+					}
+					l.setValues(values)
+				}
+			}
+			return false
+		})
+	}
+}
+
+// RemoveService removes the AddService directives for a service. Its
+// sections are removed by Cleanup.
+func (f *infFile) RemoveService(name string) {
+	f.RemoveLines(func(s *infSection, l *infLine) bool {
+		return l.Key == "addservice" && len(l.Values) != 0 && strings.EqualFold(l.Values[0], name)
+	})
+}
+
+// infKeyedSections are the sections where a directive replaces an existing
+// one with the same key when merging.
+var infKeyedSections = []string{
+	"destinationdirs",
+	"strings",
+}
+
+// Merge appends the lines of the sections in o to the last section in f with
+// the same name, or to a new section at the end. In the Strings and
+// DestinationDirs sections, existing directives with the same key are
+// replaced. Lines before the first section of o must be blank or comments.
+func (f *infFile) Merge(o *infFile) error {
+	for _, s := range o.Sections {
+		if s.Num == 0 {
+			for _, l := range s.Lines {
+				if l.Text != "" {
+					return fmt.Errorf("merge inf: line %d: directive outside of a section", l.Num)
+				}
+			}
+			continue
+		}
+		var dst *infSection
+		for _, x := range f.Sections {
+			if x.Num != 0 && strings.EqualFold(x.Name, s.Name) {
+				dst = x
+			}
+		}
+		if dst == nil {
+			f.terminate()
+			dst = &infSection{
+				Name:   s.Name,
+				Num:    s.Num,
+				Header: "[" + s.Name + "]\n",
+			}
+			f.Sections = append(f.Sections, dst)
+		}
+		for _, l := range s.Lines {
+			if l.Key != "" && slices.Contains(infKeyedSections, strings.ToLower(s.Name)) {
+				for _, x := range f.Sections {
+					if strings.EqualFold(x.Name, s.Name) {
+						x.Lines = slices.DeleteFunc(x.Lines, func(y *infLine) bool {
+							return y.Key == l.Key
+						})
+					}
+				}
+			}
+			f.terminate()
+			dst.Lines = append(dst.Lines, l)
+		}
+	}
+	f.terminate()
+	return nil
+}
+
+// terminate ensures the last line of the file ends with a newline.
+func (f *infFile) terminate() {
+	s := f.Sections[len(f.Sections)-1]
+	if len(s.Lines) == 0 {
+		if s.Header != "" && !strings.HasSuffix(s.Header, "\n") {
+			s.Header += "\n"
+		}
+	} else if l := s.Lines[len(s.Lines)-1]; l.Raw != "" && !strings.HasSuffix(l.Raw, "\n") {
+		l.Raw += "\n"
+	}
+}
+
+// Cleanup removes the sections which were referenced by directives when the
+// file was parsed, but aren't anymore, returning their names.
+func (f *infFile) Cleanup() []string {
+	var removed []string
+	for {
+		refs := map[string]bool{}
+		for _, s := range f.Sections {
+			for _, l := range s.Lines {
+				for _, ref := range l.Refs() {
+					refs[strings.ToLower(ref)] = true
+				}
+			}
+		}
+		var unused []string
+		for _, s := range f.Sections {
+			if name := strings.ToLower(s.Name); s.Num != 0 && f.referenced[name] && !refs[name] && !slices.Contains(unused, name) {
+				unused = append(unused, name)
+			}
+		}
+		if len(unused) == 0 {
+			break
+		}
+		for _, name := range unused {
+			f.RemoveSection(name)
+		}
+		removed = append(removed, unused...)
+	}
+	return removed
+}
+
+// infInstallRoot checks if a section is one of the install sections wineboot
+// runs from wine.inf (DefaultInstall or Wow64Install, with or without a
+// platform decoration, and their Services sections).
+func infInstallRoot(name string) bool {
+	return regex(`(?i)^(DefaultInstall|Wow64Install)(\.nt(amd64|arm64|arm|x86)?)?(\.Services)?$`).MatchString(name)
+}
+
+// Minimal builds a new INF containing only the Version section, the sections
+// for which root returns true, the sections transitively referenced by them,
+// and the DestinationDirs and Strings entries they use. Sections which appear
+// multiple times are combined, and blank or comment-only lines are dropped. It
+// also returns the lowercased names of the sections which weren't kept.
+func (f *infFile) Minimal(root func(name string) bool) (*infFile, []string) {
+	keep := map[string]bool{"version": true}
+	var queue []string
+	for _, s := range f.Sections {
+		if name := strings.ToLower(s.Name); s.Num != 0 && root(s.Name) && !keep[name] {
+			keep[name] = true
+			queue = append(queue, name)
+		}
+	}
+	for len(queue) != 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, l := range f.Lines(name) {
+			for _, ref := range l.Refs() {
+				if ref = strings.ToLower(ref); !keep[ref] && f.Has(ref) {
+					keep[ref] = true
+					queue = append(queue, ref)
+				}
+			}
+		}
+	}
+	m := &infFile{
+		Sections:   []*infSection{{}},
+		CRLF:       f.CRLF,
+		referenced: map[string]bool{},
+	}
+	var removed []string
+	for _, s := range f.Sections {
+		name := strings.ToLower(s.Name)
+		if s.Num == 0 {
+			continue
+		}
+		if !keep[name] && name != "destinationdirs" && name != "strings" {
+			if !slices.Contains(removed, name) {
+				removed = append(removed, name)
+			}
+			continue
+		}
+		var dst *infSection
+		for _, x := range m.Sections {
+			if x.Num != 0 && strings.EqualFold(x.Name, s.Name) {
+				dst = x
+			}
+		}
+		if dst == nil {
+			m.terminate()
+			dst = &infSection{
+				Name:   s.Name,
+				Num:    s.Num,
+				Header: "[" + s.Name + "]\n",
+			}
+			if len(m.Sections) != 1 {
+				dst.Header = "\n" + dst.Header
+			}
+			m.Sections = append(m.Sections, dst)
+		}
+		for _, l := range s.Lines {
+			if l.Text == "" || (name == "destinationdirs" && l.Key != "defaultdestdir" && !keep[l.Key]) {
+				continue
+			}
+			m.terminate()
+			dst.Lines = append(dst.Lines, l)
+			for _, ref := range l.Refs() {
+				m.referenced[strings.ToLower(ref)] = true
+			}
+		}
+	}
+	m.terminate()
+	return m, removed
+}
+
+// Expand substitutes %strkey% tokens in s using the Strings section. Unknown
+// tokens (e.g., dirids like %11%) are left as-is, and %% is replaced with %.
+func (f *infFile) Expand(s string) string {
+	return infSubst(s, f.StringValue)
+}
+
+// Expanded returns a copy of the line with the substitutions in the values
+// expanded, for matching against.
+func (f *infFile) Expanded(l *infLine) *infLine {
+	x := *l
+	x.Values = make([]string, len(l.Values))
+	for i, v := range l.Values {
+		x.Values[i] = f.Expand(v)
+	}
+	return &x
+}
+
+// PruneStrings removes the entries in the Strings section which aren't
+// referenced anywhere else (including by other strings which are kept),
+// returning their lowercased keys.
+func (f *infFile) PruneStrings() []string {
+	var removed []string
+	for {
+		used := map[string]bool{}
+		for _, s := range f.Sections {
+			for _, l := range s.Lines {
+				src := l.Text
+				if strings.EqualFold(s.Name, "Strings") {
+					src = strings.Join(l.Values, ",")
+				}
+				infSubst(src, func(key string) (string, bool) {
+					used[strings.ToLower(key)] = true
+					return "", false
+				})
+			}
+		}
+		n := len(removed)
+		f.RemoveLines(func(s *infSection, l *infLine) bool {
+			if strings.EqualFold(s.Name, "Strings") && l.Key != "" && !used[l.Key] {
+				removed = append(removed, l.Key)
+				return true
+			}
+			return false
+		})
+		if len(removed) == n {
+			return removed
+		}
+	}
+}
+
+// infSubst replaces the %key% tokens in s with the result of fn, leaving them
+// as-is if it returns false. %% is replaced with %.
+func infSubst(s string, fn func(key string) (string, bool)) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '%')
+		if i == -1 {
+			break
+		}
+		j := strings.IndexByte(s[i+1:], '%')
+		if j == -1 {
+			break
+		}
+		b.WriteString(s[:i])
+		if key := s[i+1 : i+1+j]; key == "" {
+			b.WriteByte('%')
+		} else if v, ok := fn(key); ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(s[i : i+1+j+1])
+		}
+		s = s[i+1+j+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// StringValue gets a value from the Strings section.
+func (f *infFile) StringValue(key string) (string, bool) {
+	for _, l := range f.Lines("Strings") {
+		if l.Key == strings.ToLower(key) && len(l.Values) != 0 {
+			return strings.Join(l.Values, ","), true
+		}
+	}
+	return "", false
+}
+
+// infStripComment removes a trailing comment from an INF line.
+func infStripComment(line string) string {
+	var quoted bool
+	for i, c := range line {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// infValues splits a comma-separated INF value list, removing surrounding
+// whitespace and quotes. Like setupapi, "" in a quoted string is a literal
+// quote.
+func infValues(s string) []string {
+	var (
+		values []string
+		cur    strings.Builder
+		quoted bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' && quoted && i+1 < len(s) && s[i+1] == '"':
+			cur.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			values = append(values, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	return append(values, strings.TrimSpace(cur.String()))
+}
+
+// infFileName gets the lowercased file name from an INF path value like
+// "%11%\svchost.exe -k netsvcs".
+func infFileName(s string) string {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), " ")
+	if i := strings.LastIndexAny(s, `\/`); i != -1 {
+		s = s[i+1:]
+	}
+	return strings.ToLower(s)
+}
+
+// infProblem is an internal consistency problem in an INF file.
+type infProblem struct {
+	Num int // line number
+	Msg string
+}
+
+func (p infProblem) String() string {
+	return fmt.Sprintf("line %d: %s", p.Num, p.Msg)
+}
+
+// Validate checks that every section referenced by a directive exists, and
+// that every CopyFiles source and AddService binary is a file for which
+// hasFile (called with the lowercased file name) returns true. File names
+// which can't be resolved using the Strings section are not checked.
+func (f *infFile) Validate(hasFile func(name string) bool) []infProblem {
+	var problems []infProblem
+	checkFile := func(l *infLine, what, name string) {
+		if name = infFileName(f.Expand(name)); name != "" && !strings.Contains(name, "%") && !hasFile(name) {
+			problems = append(problems, infProblem{l.Num, fmt.Sprintf("%s %q does not exist", what, name)})
+		}
+	}
+	for _, s := range f.Sections {
+		for _, l := range s.Lines {
+			for _, ref := range l.Refs() {
+				if !f.Has(ref) {
+					problems = append(problems, infProblem{l.Num, fmt.Sprintf("%s references missing section [%s]", l.Key, ref)})
+				}
+			}
+			if l.Key != "copyfiles" {
+				continue
+			}
+			for _, v := range l.Values {
+				if name, ok := strings.CutPrefix(v, "@"); ok {
+					checkFile(l, "CopyFiles source", name)
+					continue
+				}
+				for _, l := range f.Lines(v) {
+					if len(l.Values) > 1 && l.Values[1] != "" {
+						checkFile(l, "CopyFiles source", l.Values[1])
+					} else if l.Text != "" {
+						checkFile(l, "CopyFiles source", l.Values[0])
+					}
+				}
+			}
+		}
+	}
+	for _, svc := range infServices(f) {
+		if svc.Binary != "" && !hasFile(svc.Binary) {
+			problems = append(problems, infProblem{svc.Num, fmt.Sprintf("binary %q of service %s does not exist", svc.Binary, svc.Name)})
+		}
+	}
+	slices.SortStableFunc(problems, func(a, b infProblem) int {
+		return a.Num - b.Num
+	})
+	return problems
+}
+
+// validateInfFilter checks that filtering an INF file didn't introduce any new
+// consistency problems (see Validate), returning an error referencing the
+// lines of the filtered file if it did.
+func validateInfFilter(orig, filtered []byte, hasFile func(name string) bool) error {
+	a, err := parseInf(orig)
+	if err != nil {
+		return err
+	}
+	b, err := parseInf(filtered)
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for _, p := range a.Validate(hasFile) {
+		existing[p.Msg] = true
+	}
+	var msgs []string
+	for _, p := range b.Validate(hasFile) {
+		if !existing[p.Msg] {
+			msgs = append(msgs, p.String())
+		}
+	}
+	if len(msgs) != 0 {
+		return fmt.Errorf("filtered inf is inconsistent:\n\t%s", strings.Join(msgs, "\n\t"))
+	}
+	return nil
+}
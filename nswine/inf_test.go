@@ -0,0 +1,458 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseInf(t *testing.T) {
+	inf := unindent(`
+		; header comment
+		[Version]
+		Signature="$CHICAGO$"
+
+		[DefaultInstall]
+		AddReg=Classes,\
+		    Misc ; comment
+		CopyFiles=@wine.inf,Fonts
+		[DefaultInstall.Services]
+		AddService=Foo,0,FooService,FooEventLog
+
+		[Strings]
+		Name = "a;b"
+	`)
+	f, err := parseInf([]byte(inf))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if act := string(f.Bytes()); act != inf {
+		t.Errorf("round-trip changed the file:\n%s", act)
+	}
+	var names []string
+	for _, s := range f.Sections {
+		names = append(names, s.Name)
+	}
+	if exp := []string{"", "Version", "DefaultInstall", "DefaultInstall.Services", "Strings"}; !slices.Equal(names, exp) {
+		t.Errorf("expected sections %q, got %q", exp, names)
+	}
+	if l := f.Lines("defaultinstall")[0]; l.Num != 6 || l.Key != "addreg" || !slices.Equal(l.Values, []string{"Classes", "Misc"}) {
+		t.Errorf("wrong continued line %+v", l)
+	}
+	if refs := f.Lines("DefaultInstall")[1].Refs(); !slices.Equal(refs, []string{"Fonts"}) {
+		t.Errorf("expected CopyFiles refs [Fonts], got %q", refs)
+	}
+	if refs := f.Lines("DefaultInstall.Services")[0].Refs(); !slices.Equal(refs, []string{"FooService", "FooEventLog"}) {
+		t.Errorf("expected AddService refs [FooService FooEventLog], got %q", refs)
+	}
+	if v, ok := f.StringValue("NAME"); !ok || v != "a;b" {
+		t.Errorf("expected string a;b, got %q", v)
+	}
+
+	crlf := strings.ReplaceAll(inf, "\n", "\r\n")
+	if f, err = parseInf([]byte(crlf)); err != nil {
+		t.Fatalf("parse crlf: %v", err)
+	}
+	if !f.CRLF {
+		t.Errorf("expected crlf newlines to be detected")
+	}
+	if l := f.Lines("DefaultInstall")[0]; !slices.Equal(l.Values, []string{"Classes", "Misc"}) {
+		t.Errorf("wrong continued crlf line %+v", l)
+	}
+	if act := string(f.Bytes()); act != crlf {
+		t.Errorf("round-trip changed the crlf file:\n%q", act)
+	}
+	if f.CRLF = false; string(f.Bytes()) != inf {
+		t.Errorf("expected newlines to be normalized to lf:\n%q", f.Bytes())
+	}
+}
+
+func TestInfRemoveSection(t *testing.T) {
+	f, err := parseInf([]byte(unindent(`
+		[DefaultInstall]
+		AddReg=Classes,\
+		    Misc,\
+		    Other
+		CopyFiles=Fonts
+		[DefaultInstall.Services]
+		AddService=Foo,0,FooService,FooEventLog
+		AddService=Bar,0,BarService
+		[DestinationDirs]
+		Fonts=22
+		[Classes]
+		HKCR,.txt,,,"txtfile"
+		[Misc]
+		HKLM,Software\Misc,,16
+		[Other]
+		AddReg=Misc
+		[Fonts]
+		arial.ttf
+		[FooService]
+		ServiceBinary="%11%\foo.exe"
+		[FooEventLog]
+		AddReg=FooEventLogKeys
+		[FooEventLogKeys]
+		HKLM,System\CurrentControlSet\Services\EventLog\Application\Foo,,16
+		[BarService]
+		ServiceBinary="%11%\bar.exe"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	f.RemoveSection("classes")
+	f.RemoveSection("Fonts")
+	f.RemoveSection("FooEventLog")
+	f.RemoveService("Bar")
+	removed := f.Cleanup()
+	slices.Sort(removed)
+	if exp := []string{"barservice", "fooeventlogkeys"}; !slices.Equal(removed, exp) {
+		t.Errorf("expected cleanup to remove %q, got %q", exp, removed)
+	}
+	if exp := unindent(`
+		[DefaultInstall]
+		AddReg=\
+		    Misc,\
+		    Other
+		[DefaultInstall.Services]
+		AddService=Foo,0,FooService
+		[DestinationDirs]
+		[Misc]
+		HKLM,Software\Misc,,16
+		[Other]
+		AddReg=Misc
+		[FooService]
+		ServiceBinary="%11%\foo.exe"
+	`); string(f.Bytes()) != exp {
+		t.Errorf("wrong output:\n%s", f.Bytes())
+	}
+
+	f.RemoveSection("Other")
+	if removed := f.Cleanup(); len(removed) != 0 {
+		t.Errorf("expected Misc to be kept since it's still referenced, got %q removed", removed)
+	}
+	if !f.Has("misc") || f.Has("other") {
+		t.Errorf("wrong sections after removing Other")
+	}
+}
+
+func TestInfLineFiles(t *testing.T) {
+	f, err := parseInf([]byte(unindent(`
+		[Misc]
+		HKLM,%CurrentVersion%\RunServices,"winemenubuilder",2,"%11%\winemenubuilder.exe -a -r"
+		system.ini, mci, cdaudio, mcicda.drv
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	lines := f.Lines("Misc")
+	if exp := []string{"winemenubuilder.exe"}; !slices.Equal(lines[0].Files(), exp) {
+		t.Errorf("expected %q, got %q", exp, lines[0].Files())
+	}
+	if exp := []string{"system.ini", "mcicda.drv"}; !slices.Equal(lines[1].Files(), exp) {
+		t.Errorf("expected %q, got %q", exp, lines[1].Files())
+	}
+}
+
+func TestInfExpand(t *testing.T) {
+	f, err := parseInf([]byte(unindent(`
+		[Strings]
+		CurrentVersion="Software\Microsoft\Windows\CurrentVersion"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for in, exp := range map[string]string{
+		`HKLM,%CurrentVersion%\Run`: `HKLM,Software\Microsoft\Windows\CurrentVersion\Run`,
+		`%currentversion%`:          `Software\Microsoft\Windows\CurrentVersion`,
+		`%11%\foo.exe`:              `%11%\foo.exe`,
+		`100%% %Unknown% 50%`:       `100% %Unknown% 50%`,
+	} {
+		if act := f.Expand(in); act != exp {
+			t.Errorf("%q: expected %q, got %q", in, exp, act)
+		}
+	}
+}
+
+func TestInfValues(t *testing.T) {
+	for _, tc := range []struct {
+		In  string
+		Out []string
+	}{
+		{``, []string{""}},
+		{`a`, []string{"a"}},
+		{` a , b,,c `, []string{"a", "b", "", "c"}},
+		{`HKLM,"a,b","c",,"d"`, []string{"HKLM", "a,b", "c", "", "d"}},
+		{`"""%11%\winebrowser.exe"" -nohome"`, []string{`"%11%\winebrowser.exe" -nohome`}},
+		{`"a""b",""`, []string{`a"b`, ""}},
+	} {
+		if act := infValues(tc.In); !slices.Equal(act, tc.Out) {
+			t.Errorf("%q: expected %q, got %q", tc.In, tc.Out, act)
+		}
+	}
+}
+
+func TestInfLineRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		`HKCR,http\shell\open\command,,2,"""%11%\winebrowser.exe"" -nohome"`,
+		`HKLM,Software\Foo,,16`,
+		`HKLM,"a,b",Name,,"x;y"`,
+	} {
+		f, err := parseInf([]byte("[Reg]\n" + in + "\n"))
+		if err != nil {
+			t.Fatalf("parse %q: %v", in, err)
+		}
+		l := f.Lines("Reg")[0]
+		l.setValues(l.Values)
+		if act := strings.TrimSuffix(l.String(), "\n"); act != in {
+			t.Errorf("round-trip changed %q to %q", in, act)
+		}
+	}
+}
+
+func TestInfValidate(t *testing.T) {
+	orig := unindent(`
+		[DefaultInstall]
+		AddReg=Classes
+		CopyFiles=@l_intl.nls,Fonts,Missing
+		[DefaultInstall.Services]
+		AddService=Foo,0,FooService
+		AddService=Bar,0,BarService
+		[Classes]
+		HKCR,.txt,,,"txtfile"
+		[Fonts]
+		tahoma.ttf
+		marlett.ttf,%Src%
+		[FooService]
+		ServiceBinary="%11%\foo.exe"
+		[BarService]
+		ServiceBinary="%11%\bar.exe"
+		[Strings]
+		Src="webdings.ttf"
+	`)
+	has := func(name string) bool {
+		return slices.Contains([]string{"l_intl.nls", "tahoma.ttf", "foo.exe"}, name)
+	}
+	f, err := parseInf([]byte(orig))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	var act []string
+	for _, p := range f.Validate(has) {
+		act = append(act, p.String())
+	}
+	if exp := []string{
+		`line 3: copyfiles references missing section [Missing]`,
+		`line 6: binary "bar.exe" of service Bar does not exist`,
+		`line 11: CopyFiles source "webdings.ttf" does not exist`,
+	}; !slices.Equal(act, exp) {
+		t.Errorf("expected problems %q, got %q", exp, act)
+	}
+
+	f.RemoveLines(func(s *infSection, l *infLine) bool {
+		return s.Name == "DefaultInstall" && l.Key == "addreg"
+	})
+	if err := validateInfFilter([]byte(orig), f.Bytes(), has); err != nil {
+		t.Errorf("unexpected error for consistent filter: %v", err)
+	}
+
+	f.Sections = slices.DeleteFunc(f.Sections, func(s *infSection) bool {
+		return s.Name == "FooService"
+	})
+	err = validateInfFilter([]byte(orig), f.Bytes(), has)
+	if exp := "filtered inf is inconsistent:\n\tline 4: addservice references missing section [FooService]"; err == nil || err.Error() != exp {
+		t.Errorf("expected error %q, got %v", exp, err)
+	}
+}
+
+func TestInfMerge(t *testing.T) {
+	f, err := parseInf([]byte(strings.TrimSuffix(unindent(`
+		[DefaultInstall]
+		AddReg=Classes
+		[Classes]
+		HKCR,.txt,,,"txtfile"
+		[Strings]
+		Foo="foo"
+		Bar="bar"
+	`), "\n"))) // no trailing newline
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	o, err := parseInf([]byte(unindent(`
+		; overlay
+		[defaultinstall]
+		AddReg=Extra
+		[Extra]
+		HKLM,Software\Extra,,16
+		[Strings]
+		foo="baz"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if err := f.Merge(o); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if exp := unindent(`
+		[DefaultInstall]
+		AddReg=Classes
+		AddReg=Extra
+		[Classes]
+		HKCR,.txt,,,"txtfile"
+		[Strings]
+		Bar="bar"
+		foo="baz"
+		[Extra]
+		HKLM,Software\Extra,,16
+	`); string(f.Bytes()) != exp {
+		t.Errorf("wrong output:\n%s", f.Bytes())
+	}
+	if v, _ := f.StringValue("Foo"); v != "baz" {
+		t.Errorf("expected overridden string baz, got %q", v)
+	}
+
+	o, err = parseInf([]byte("HKLM,Software\\Extra,,16\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if err := f.Merge(o); err == nil {
+		t.Errorf("expected error for directive outside of a section")
+	}
+}
+
+func TestInfPruneStrings(t *testing.T) {
+	f, err := parseInf([]byte(unindent(`
+		[Misc]
+		HKLM,%CurrentVersion%\Run,"menu",,"%11%\%MenuBuilder% -a"
+		HKLM,%Control%\Session Manager,,16
+		[Strings]
+		CurrentVersion="Software\Microsoft\Windows\CurrentVersion"
+		Control="System\CurrentControlSet\Control"
+		MenuBuilder="winemenubuilder.exe"
+		Unused="foo"
+		Nested="%Inner%"
+		Inner="bar"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	l := f.Expanded(f.Lines("Misc")[0])
+	if key, _ := infRegKeyOf(l.Values); key != `HKLM\Software\Microsoft\Windows\CurrentVersion\Run` {
+		t.Errorf("wrong expanded key %q", key)
+	}
+	if exp := []string{"winemenubuilder.exe"}; !slices.Equal(l.Files(), exp) {
+		t.Errorf("expected expanded files %q, got %q", exp, l.Files())
+	}
+	if f.Lines("Misc")[0].Values[1] != `%CurrentVersion%\Run` {
+		t.Errorf("expanding modified the original line")
+	}
+
+	f.RemoveLines(func(s *infSection, l *infLine) bool {
+		return s.Name != "Strings" && slices.Contains(f.Expanded(l).Files(), "winemenubuilder.exe")
+	})
+	removed := f.PruneStrings()
+	if exp := []string{"currentversion", "menubuilder", "unused", "nested", "inner"}; !slices.Equal(removed, exp) {
+		t.Errorf("expected pruned strings %q, got %q", exp, removed)
+	}
+	if lines := f.Lines("Strings"); len(lines) != 1 || lines[0].Key != "control" {
+		t.Errorf("expected only the control string to remain, got %d strings", len(lines))
+	}
+}
+
+func TestInfMinimal(t *testing.T) {
+	f, err := parseInf([]byte(unindent(`
+		; wine.inf
+		[Version]
+		Signature="$CHICAGO$"
+
+		[DefaultInstall.ntamd64]
+		AddReg=Classes ; comment
+		CopyFiles=Fonts
+
+		[DefaultInstall.ntamd64.Services]
+		AddService=Spooler,0,SpoolerService
+
+		[Wow64Install.ntamd64]
+		AddReg=Classes
+
+		[Unused]
+		AddReg=UnusedKeys
+
+		[UnusedKeys]
+		HKLM,%Unused%,,16
+
+		[Classes]
+		HKCR,.txt,,,"%TxtFile%"
+
+		[SpoolerService]
+		AddReg=SpoolerKeys
+		ServiceBinary="%11%\spoolsv.exe"
+
+		[SpoolerKeys]
+		HKLM,"System\CurrentControlSet\Services\Spooler","Foo",,"bar"
+
+		[Fonts]
+		tahoma.ttf
+
+		[DestinationDirs]
+		DefaultDestDir=11
+		Fonts=22
+		UnusedFiles=10
+
+		[Classes]
+		HKCR,.log,,,"%TxtFile%"
+
+		[Strings]
+		TxtFile="txtfile"
+		Unused="Software\Unused"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	m, removed := f.Minimal(infInstallRoot)
+	if exp := []string{"unused", "unusedkeys"}; !slices.Equal(removed, exp) {
+		t.Errorf("expected removed %q, got %q", exp, removed)
+	}
+	if exp, act := []string{"unused"}, m.PruneStrings(); !slices.Equal(act, exp) {
+		t.Errorf("expected pruned strings %q, got %q", exp, act)
+	}
+	if exp := unindent(`
+		[Version]
+		Signature="$CHICAGO$"
+
+		[DefaultInstall.ntamd64]
+		AddReg=Classes ; comment
+		CopyFiles=Fonts
+
+		[DefaultInstall.ntamd64.Services]
+		AddService=Spooler,0,SpoolerService
+
+		[Wow64Install.ntamd64]
+		AddReg=Classes
+
+		[Classes]
+		HKCR,.txt,,,"%TxtFile%"
+		HKCR,.log,,,"%TxtFile%"
+
+		[SpoolerService]
+		AddReg=SpoolerKeys
+		ServiceBinary="%11%\spoolsv.exe"
+
+		[SpoolerKeys]
+		HKLM,"System\CurrentControlSet\Services\Spooler","Foo",,"bar"
+
+		[Fonts]
+		tahoma.ttf
+
+		[DestinationDirs]
+		DefaultDestDir=11
+		Fonts=22
+
+		[Strings]
+		TxtFile="txtfile"
+	`); string(m.Bytes()) != exp {
+		t.Errorf("wrong output:\n%s", m.Bytes())
+	}
+	if problems := m.Validate(func(string) bool { return true }); len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+}
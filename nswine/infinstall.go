@@ -0,0 +1,480 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// infInstaller applies INF install sections to a wineprefix without running
+// wine, implementing the subset of setupapi's InstallHinfSection which wineboot
+// relies on for wine.inf: AddReg, DelReg, WineFakeDlls, and the standard
+// directories. Other directives are skipped and recorded.
+type infInstaller struct {
+	Inf    *infFile
+	Hives  map[string]*regFile // keyed like applyRegEdits
+	DriveC string              // the drive_c directory
+	Arch   string              // the platform decoration without the "nt" (amd64 or arm64)
+	User   string              // the user name for the profile directory
+
+	// PEDir returns the directory containing the builtin PE files to create
+	// fake dlls from for a dirid, or an empty string if not supported.
+	PEDir func(dirid int) string
+
+	Skipped  []string // the directives which weren't applied (e.g., "[DefaultInstall] registerdlls")
+	FakeDlls int      // the number of fake dlls created
+}
+
+// infDirids are the windows paths of the standard dirids used by wine.inf,
+// with $USER for the user name.
+var infDirids = map[int]string{
+	10:    `C:\windows`,
+	11:    `C:\windows\system32`,
+	12:    `C:\windows\system32\drivers`,
+	17:    `C:\windows\inf`,
+	18:    `C:\windows\help`,
+	20:    `C:\windows\fonts`,
+	24:    `C:\`,
+	25:    `C:\windows`,
+	30:    `C:\`,
+	50:    `C:\windows\system`,
+	51:    `C:\windows\system32\spool`,
+	52:    `C:\windows\system32\spool\drivers`,
+	53:    `C:\users\$USER`,
+	54:    `C:\`,
+	55:    `C:\windows\system32\spool\prtprocs`,
+	16419: `C:\ProgramData`,                      // CSIDL_COMMON_APPDATA
+	16420: `C:\windows`,                          // CSIDL_WINDOWS
+	16421: `C:\windows\system32`,                 // CSIDL_SYSTEM
+	16422: `C:\Program Files`,                    // CSIDL_PROGRAM_FILES
+	16425: `C:\windows\syswow64`,                 // CSIDL_SYSTEMX86
+	16426: `C:\Program Files (x86)`,              // CSIDL_PROGRAM_FILESX86
+	16427: `C:\Program Files\Common Files`,       // CSIDL_PROGRAM_FILES_COMMON
+	16428: `C:\Program Files (x86)\Common Files`, // CSIDL_PROGRAM_FILES_COMMONX86
+}
+
+// setupapi AddReg flags.
+const (
+	infAddRegBinValueType = 0x00000001
+	infAddRegNoClobber    = 0x00000002
+	infAddRegDelVal       = 0x00000004
+	infAddRegAppend       = 0x00000008
+	infAddRegKeyOnly      = 0x00000010
+	infAddRegOverwrite    = 0x00000020
+	infAddReg32BitKey     = 0x00004000
+	infAddRegTypeMask     = 0xffff0000 | infAddRegBinValueType
+)
+
+// Dirid gets the windows path of a dirid.
+func (in *infInstaller) Dirid(dirid int) (string, bool) {
+	p, ok := infDirids[dirid]
+	return strings.ReplaceAll(p, "$USER", in.User), ok
+}
+
+// expand substitutes strings and dirids in an INF value.
+func (in *infInstaller) expand(s string) string {
+	return infSubst(s, func(key string) (string, bool) {
+		if n, err := strconv.Atoi(key); err == nil {
+			return in.Dirid(n)
+		}
+		return in.Inf.StringValue(key)
+	})
+}
+
+// unixPath converts a windows path on drive C to a path under DriveC.
+func (in *infInstaller) unixPath(p string) (string, error) {
+	if len(p) < 3 || !strings.EqualFold(p[:3], `C:\`) {
+		return "", fmt.Errorf("path %q is not on drive C", p)
+	}
+	if p = strings.Trim(p[3:], `\`); p == "" {
+		return in.DriveC, nil
+	}
+	return safeJoin(in.DriveC, strings.ReplaceAll(p, `\`, "/"))
+}
+
+// CreateDirs creates the directories for the standard dirids.
+func (in *infInstaller) CreateDirs() error {
+	for _, dirid := range slices.Sorted(maps.Keys(infDirids)) {
+		p, _ := in.Dirid(dirid)
+		dir, err := in.unixPath(p)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Install applies an install section, using the most specific platform
+// decoration which exists (e.g., DefaultInstall.ntamd64, DefaultInstall.nt, or
+// DefaultInstall), like SetupDiGetActualSectionToInstall. Files are installed
+// before the registry is modified.
+func (in *infInstaller) Install(section string) error {
+	actual := section
+	for _, x := range []string{section + ".nt" + in.Arch, section + ".nt"} {
+		if in.Inf.Has(x) {
+			actual = x
+			break
+		}
+	}
+	if !in.Inf.Has(actual) {
+		return fmt.Errorf("install section [%s] not found", section)
+	}
+	lines := in.Inf.Lines(actual)
+	for _, key := range []string{"winefakedlls", "delreg", "addreg"} {
+		for _, l := range lines {
+			if l.Key != key {
+				continue
+			}
+			for _, name := range l.Values {
+				var err error
+				switch key {
+				case "winefakedlls":
+					err = in.fakeDlls(name)
+				case "delreg":
+					err = in.delReg(name)
+				case "addreg":
+					err = in.addReg(name)
+				}
+				if err != nil {
+					return fmt.Errorf("[%s] %s=%s: %w", actual, l.Key, name, err)
+				}
+			}
+		}
+	}
+	for _, l := range lines {
+		if l.Key != "" && !slices.Contains([]string{"winefakedlls", "delreg", "addreg"}, l.Key) {
+			in.Skipped = append(in.Skipped, "["+actual+"] "+l.Key)
+		}
+	}
+	return nil
+}
+
+// regKey gets the full registry key for the root and subkey of an
+// AddReg/DelReg line, or false if the root isn't supported.
+func (in *infInstaller) regKey(values []string, flags uint32) (string, bool) {
+	key, ok := infRegKeyOf([]string{values[0], in.expand(values[1])})
+	if !ok || strings.HasPrefix(key, `HKU\`) {
+		return "", false
+	}
+	if flags&infAddReg32BitKey != 0 {
+		// the wow64 view of the registry
+		root, rest, _ := strings.Cut(key, `\`)
+		switch {
+		case root == "HKLM" && len(rest) > 9 && strings.EqualFold(rest[:9], `Software\`):
+			key = `HKLM\Software\Wow6432Node\` + rest[9:]
+		case root == "HKCR":
+			key = `HKCR\Wow6432Node\` + rest
+		}
+	}
+	return key, true
+}
+
+// addReg applies an AddReg section.
+func (in *infInstaller) addReg(section string) error {
+	for _, l := range in.Inf.Lines(section) {
+		if l.Text == "" {
+			continue
+		}
+		if len(l.Values) < 2 {
+			return fmt.Errorf("line %d: missing key", l.Num)
+		}
+		var flags uint32
+		if len(l.Values) > 3 && l.Values[3] != "" {
+			v, err := strconv.ParseUint(l.Values[3], 0, 32)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid flags %q", l.Num, l.Values[3])
+			}
+			flags = uint32(v)
+		}
+		key, ok := in.regKey(l.Values, flags)
+		if !ok {
+			in.Skipped = append(in.Skipped, "["+section+"] "+l.Values[0])
+			continue
+		}
+		hive, rel, ok := regHiveKey(key)
+		if !ok {
+			return fmt.Errorf("line %d: unsupported key %q", l.Num, key)
+		}
+		f := in.Hives[hive]
+		if f == nil {
+			f = &regFile{Header: "WINE REGISTRY Version 2\n"}
+			in.Hives[hive] = f
+		}
+		if len(l.Values) < 3 || flags&infAddRegKeyOnly != 0 {
+			f.CreateKey(rel)
+			continue
+		}
+		name := in.expand(l.Values[2])
+		if flags&infAddRegDelVal != 0 {
+			f.DeleteValue(rel, name)
+			continue
+		}
+		existing := f.Value(rel, name)
+		if (flags&infAddRegNoClobber != 0 && existing != nil) || (flags&infAddRegOverwrite != 0 && existing == nil) {
+			continue
+		}
+		var data []string
+		if len(l.Values) > 4 {
+			data = l.Values[4:]
+		}
+		typ, buf, err := in.regValue(flags, data, existing)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", l.Num, err)
+		}
+		f.SetValue(rel, name, typ, buf)
+	}
+	return nil
+}
+
+// regValue gets the type and data of an AddReg value.
+func (in *infInstaller) regValue(flags uint32, data []string, existing *regValue) (uint32, []byte, error) {
+	str := func() string {
+		if len(data) == 0 {
+			return ""
+		}
+		return in.expand(data[0])
+	}
+	switch flags & infAddRegTypeMask {
+	case 0x00000000:
+		return regSZ, regStringData(str()), nil
+	case 0x00020000:
+		return regExpandSZ, regStringData(str()), nil
+	case 0x00010000:
+		var ss []string
+		if flags&infAddRegAppend != 0 {
+			ss, _ = existing.Strings()
+		}
+		for _, s := range data {
+			if s = in.expand(s); flags&infAddRegAppend == 0 || !slices.Contains(ss, s) {
+				ss = append(ss, s)
+			}
+		}
+		return regMultiSZ, regMultiStringData(ss), nil
+	case 0x00010001:
+		var v uint64
+		if s := str(); s != "" {
+			var err error
+			if v, err = strconv.ParseUint(s, 0, 32); err != nil {
+				return 0, nil, fmt.Errorf("invalid dword %q", s)
+			}
+		}
+		return regDWORD, regDWORDData(uint32(v)), nil
+	}
+	if flags&infAddRegBinValueType == 0 {
+		return 0, nil, fmt.Errorf("unsupported value type flags %#x", flags)
+	}
+	typ := uint32(regBinary)
+	switch flags & infAddRegTypeMask {
+	case 0x00000001:
+	case 0x00020001:
+		typ = regNone
+	default:
+		typ = flags >> 16
+	}
+	var buf []byte
+	for _, s := range data {
+		b, err := strconv.ParseUint(s, 16, 8)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid binary byte %q", s)
+		}
+		buf = append(buf, byte(b))
+	}
+	return typ, buf, nil
+}
+
+// delReg applies a DelReg section.
+func (in *infInstaller) delReg(section string) error {
+	for _, l := range in.Inf.Lines(section) {
+		if l.Text == "" {
+			continue
+		}
+		if len(l.Values) < 2 {
+			return fmt.Errorf("line %d: missing key", l.Num)
+		}
+		key, ok := in.regKey(l.Values, 0)
+		if !ok {
+			in.Skipped = append(in.Skipped, "["+section+"] "+l.Values[0])
+			continue
+		}
+		hive, rel, ok := regHiveKey(key)
+		if !ok {
+			return fmt.Errorf("line %d: unsupported key %q", l.Num, key)
+		}
+		if f := in.Hives[hive]; f != nil {
+			if len(l.Values) < 3 {
+				f.DeleteKey(rel)
+			} else {
+				f.DeleteValue(rel, in.expand(l.Values[2]))
+			}
+		}
+	}
+	return nil
+}
+
+// fakeDlls applies a WineFakeDlls section, where each line is a dirid, an
+// optional subdirectory, a file name (or glob for the builtins in the dirid),
+// and an optional source file name. Like wine, the builtin PE files are copied
+// as-is.
+func (in *infInstaller) fakeDlls(section string) error {
+	for _, l := range in.Inf.Lines(section) {
+		if l.Text == "" {
+			continue
+		}
+		if len(l.Values) < 3 {
+			return fmt.Errorf("line %d: expected dirid,subdir,name", l.Num)
+		}
+		dirid, err := strconv.Atoi(l.Values[0])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid dirid %q", l.Num, l.Values[0])
+		}
+		p, ok := in.Dirid(dirid)
+		if !ok {
+			return fmt.Errorf("line %d: unsupported dirid %d", l.Num, dirid)
+		}
+		if sub := in.expand(l.Values[1]); sub != "" {
+			p += `\` + sub
+		}
+		dst, err := in.unixPath(p)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", l.Num, err)
+		}
+		src := in.PEDir(dirid)
+		if src == "" {
+			return fmt.Errorf("line %d: fake dlls are not supported in dirid %d", l.Num, dirid)
+		}
+		name, srcName := in.expand(l.Values[2]), ""
+		if len(l.Values) > 3 {
+			srcName = in.expand(l.Values[3])
+		}
+		var files [][2]string // source, target
+		if strings.ContainsAny(name, "*?") {
+			dis, err := os.ReadDir(src)
+			if err != nil {
+				return err
+			}
+			for _, di := range dis {
+				if !di.IsDir() && matchAny([]string{name}, di.Name()) {
+					files = append(files, [2]string{di.Name(), di.Name()})
+				}
+			}
+		} else {
+			files = append(files, [2]string{cmp.Or(srcName, name), name})
+		}
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+		for _, x := range files {
+			if err := copyFile(filepath.Join(src, strings.ToLower(x[0])), filepath.Join(dst, x[1])); err != nil {
+				return fmt.Errorf("line %d: %w", l.Num, err)
+			}
+			in.FakeDlls++
+		}
+	}
+	return nil
+}
+
+// infInstallMain implements the inf-install subcommand, which initializes the
+// registry and drive_c of a wineprefix from wine.inf without running wine.
+func infInstallMain(args []string) error {
+	fset := flag.NewFlagSet("inf-install", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s inf-install [options] output\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fset.Output(), "Applies the install sections of a wine.inf to a wineprefix directory without\nrunning wine (creating it if needed), so it works for any architecture. Only\nAddReg, DelReg, and WineFakeDlls are supported, and the other directives are\nlisted so they can be done by wineboot later.\n\n")
+		fset.PrintDefaults()
+	}
+	prefix := fset.String("prefix", "/wine", "wine install prefix")
+	inf := fset.String("inf", "", "the INF file (default share/wine/wine.inf in the prefix)")
+	arch := fset.String("arch", archt("amd64", "arm64"), "target architecture (amd64 or arm64)")
+	sections := fset.String("sections", "DefaultInstall", "comma-separated install sections to apply")
+	fset.Parse(args)
+
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	var pe string
+	switch *arch {
+	case "amd64":
+		pe = "x86_64-windows"
+	case "arm64":
+		pe = "aarch64-windows"
+	default:
+		return fmt.Errorf("unsupported architecture %q", *arch)
+	}
+	if *inf == "" {
+		*inf = filepath.Join(*prefix, "share/wine/wine.inf")
+	}
+	buf, err := os.ReadFile(*inf)
+	if err != nil {
+		return err
+	}
+	f, err := parseInf(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *inf, err)
+	}
+
+	out := fset.Arg(0)
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	in := &infInstaller{
+		Inf:    f,
+		Hives:  map[string]*regFile{},
+		DriveC: filepath.Join(out, "drive_c"),
+		Arch:   *arch,
+		User:   "nswrap",
+		PEDir: func(dirid int) string {
+			switch dirid {
+			case 16425:
+				return filepath.Join(*prefix, "lib/wine/i386-windows")
+			case 10, 11, 12, 16420, 16421:
+				return filepath.Join(*prefix, "lib/wine", pe)
+			}
+			return ""
+		},
+	}
+	for _, hive := range []string{"system.reg", "user.reg"} {
+		buf, err := os.ReadFile(filepath.Join(out, hive))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if in.Hives[hive], err = parseReg(buf); err != nil {
+			return fmt.Errorf("%s: %w", hive, err)
+		}
+	}
+	if err := in.CreateDirs(); err != nil {
+		return err
+	}
+	for name := range strings.SplitSeq(*sections, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if err := in.Install(name); err != nil {
+				return err
+			}
+		}
+	}
+	for hive, reg := range in.Hives {
+		if err := os.WriteFile(filepath.Join(out, hive), reg.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	for _, x := range in.Skipped {
+		slog.Warn("skipped unsupported directive", "directive", x)
+	}
+	slog.Info("applied inf", "sections", *sections, "fake_dlls", in.FakeDlls, "skipped", len(in.Skipped))
+	return nil
+}
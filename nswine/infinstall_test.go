@@ -0,0 +1,164 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestInfInstall(t *testing.T) {
+	f, err := parseInf([]byte(unindent(`
+		[Version]
+		Signature="$CHICAGO$"
+
+		[DefaultInstall]
+		AddReg=Wrong
+
+		[DefaultInstall.ntamd64]
+		AddReg=Classes,Misc
+		DelReg=Cleanup
+		WineFakeDlls=FakeDlls
+		RegisterDlls=RegisterDllsSection
+
+		[Wrong]
+		HKLM,Software\Wrong,,16
+
+		[Classes]
+		HKCR,.txt,,,"txtfile"
+		HKCR,.txt,,0x4000,"txtfile32"
+		HKCR,http\shell\open\command,,,"""%11%\winebrowser.exe"" -nohome"
+
+		[Misc]
+		HKLM,%CurrentVersion%,"ProgramFilesDir",,"%16422%"
+		HKLM,%CurrentVersion%,"Count",0x10001,"0x10"
+		HKLM,%CurrentVersion%,"Data",1,de,ad,be,ef
+		HKLM,%CurrentVersion%,"Multi",0x10000,"a","b"
+		HKLM,%CurrentVersion%,"Multi",0x10008,"b","c"
+		HKLM,%CurrentVersion%,"Path",0x20000,"%%SystemRoot%%\foo"
+		HKLM,%CurrentVersion%,"Keep",2,"new"
+		HKLM,%CurrentVersion%,"Gone",,"x"
+		HKLM,%CurrentVersion%,"Gone",4
+		HKLM,Software\Empty,,16
+		HKCU,Software\Wine,"Version",,"win10"
+		HKU,.Default\Software\Wine,"Version",,"win10"
+
+		[Cleanup]
+		HKLM,%CurrentVersion%,"Old"
+
+		[FakeDlls]
+		11,,*.dll
+		10,,notepad.exe
+		11,sub,foo.exe,notepad.exe
+
+		[Strings]
+		CurrentVersion="Software\Microsoft\Windows\CurrentVersion"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	tmp := t.TempDir()
+	pe := filepath.Join(tmp, "lib")
+	if err := os.MkdirAll(pe, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"kernel32.dll", "ntdll.dll", "notepad.exe"} {
+		if err := os.WriteFile(filepath.Join(pe, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sys, err := parseReg([]byte(unindent(`
+		WINE REGISTRY Version 2
+
+		[Software\\Microsoft\\Windows\\CurrentVersion] 1700000000
+		"Keep"="old"
+		"Old"="old"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	in := &infInstaller{
+		Inf:    f,
+		Hives:  map[string]*regFile{"system.reg": sys},
+		DriveC: filepath.Join(tmp, "drive_c"),
+		Arch:   "amd64",
+		User:   "nswrap",
+		PEDir: func(dirid int) string {
+			return pe
+		},
+	}
+	if err := in.CreateDirs(); err != nil {
+		t.Fatalf("create dirs: %v", err)
+	}
+	if err := in.Install("DefaultInstall"); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	for _, x := range []string{"windows/system32/drivers", "windows/syswow64", "users/nswrap", "Program Files/Common Files"} {
+		if fi, err := os.Stat(filepath.Join(tmp, "drive_c", x)); err != nil || !fi.IsDir() {
+			t.Errorf("expected directory %s", x)
+		}
+	}
+	for x, exp := range map[string]string{
+		"windows/system32/kernel32.dll": "kernel32.dll",
+		"windows/system32/ntdll.dll":    "ntdll.dll",
+		"windows/notepad.exe":           "notepad.exe",
+		"windows/system32/sub/foo.exe":  "notepad.exe",
+	} {
+		if buf, err := os.ReadFile(filepath.Join(tmp, "drive_c", x)); err != nil || string(buf) != exp {
+			t.Errorf("expected fake dll %s copied from %s", x, exp)
+		}
+	}
+	if in.FakeDlls != 4 {
+		t.Errorf("expected 4 fake dlls, got %d", in.FakeDlls)
+	}
+	if exp := []string{"[Misc] HKU", "[DefaultInstall.ntamd64] registerdlls"}; !slices.Equal(in.Skipped, exp) {
+		t.Errorf("expected skipped %q, got %q", exp, in.Skipped)
+	}
+
+	reg := in.Hives["system.reg"]
+	const key = `Software\Microsoft\Windows\CurrentVersion`
+	if reg.HasKey(`Software\Wrong`) || !reg.HasKey(`Software\Empty`) {
+		t.Errorf("wrong install section decoration")
+	}
+	if v, _ := reg.Value(`Software\Classes\.txt`, "").Str(); v != "txtfile" {
+		t.Errorf("expected class txtfile, got %q", v)
+	}
+	if v, _ := reg.Value(`Software\Classes\Wow6432Node\.txt`, "").Str(); v != "txtfile32" {
+		t.Errorf("expected 32-bit class txtfile32, got %q", v)
+	}
+	if v, _ := reg.Value(`Software\Classes\http\shell\open\command`, "").Str(); v != `"C:\windows\system32\winebrowser.exe" -nohome` {
+		t.Errorf("expected quoted command line, got %q", v)
+	}
+	if v, _ := reg.Value(key, "ProgramFilesDir").Str(); v != `C:\Program Files` {
+		t.Errorf("expected expanded dirid, got %q", v)
+	}
+	if v, _ := reg.Value(key, "Count").DWORD(); v != 16 {
+		t.Errorf("expected dword 16, got %d", v)
+	}
+	if v := reg.Value(key, "Data"); v == nil || v.Type != regBinary || string(v.Data) != "\xde\xad\xbe\xef" {
+		t.Errorf("wrong binary value %v", v)
+	}
+	if v, _ := reg.Value(key, "Multi").Strings(); !slices.Equal(v, []string{"a", "b", "c"}) {
+		t.Errorf("expected appended multi-string, got %q", v)
+	}
+	if v := reg.Value(key, "Path"); v == nil || v.Type != regExpandSZ {
+		t.Errorf("expected expand string, got %v", v)
+	} else if s, _ := v.Str(); s != `%SystemRoot%\foo` {
+		t.Errorf("expected unexpanded environment variable, got %q", s)
+	}
+	if v, _ := reg.Value(key, "Keep").Str(); v != "old" {
+		t.Errorf("expected FLG_ADDREG_NOCLOBBER to keep the existing value, got %q", v)
+	}
+	if reg.Value(key, "Old") != nil {
+		t.Errorf("expected value deleted by DelReg")
+	}
+	if reg.Value(key, "Gone") != nil {
+		t.Errorf("expected value deleted by FLG_ADDREG_DELVAL")
+	}
+	if v, _ := in.Hives["user.reg"].Value(`Software\Wine`, "Version").Str(); v != "win10" {
+		t.Errorf("expected user value, got %q", v)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// winLocale is a system locale which can be set in the prefix.
+type winLocale struct {
+	LCID  uint32
+	ACP   int // ansi codepage
+	OEMCP int // oem (console) codepage
+	MACCP int // mac codepage
+}
+
+// winLocales are the locales supported by -locale, by name.
+var winLocales = map[string]winLocale{
+	"en-US": {0x0409, 1252, 437, 10000},
+	"en-GB": {0x0809, 1252, 850, 10000},
+	"de-DE": {0x0407, 1252, 850, 10000},
+	"es-ES": {0x0c0a, 1252, 850, 10000},
+	"fr-FR": {0x040c, 1252, 850, 10000},
+	"it-IT": {0x0410, 1252, 850, 10000},
+	"pl-PL": {0x0415, 1250, 852, 10029},
+	"pt-BR": {0x0416, 1252, 850, 10000},
+	"ru-RU": {0x0419, 1251, 866, 10007},
+	"ja-JP": {0x0411, 932, 932, 10001},
+	"ko-KR": {0x0412, 949, 949, 10003},
+	"zh-CN": {0x0804, 936, 936, 10008},
+	"zh-TW": {0x0404, 950, 950, 10002},
+}
+
+// lookupLocale finds a locale by name, case-insensitively, also accepting
+// underscores like unix locale names (e.g., de_DE).
+func lookupLocale(name string) (string, winLocale, error) {
+	for x, l := range winLocales {
+		if strings.EqualFold(x, strings.ReplaceAll(name, "_", "-")) {
+			return x, l, nil
+		}
+	}
+	return "", winLocale{}, fmt.Errorf("unsupported locale %q (expected one of %q)", name, slices.Sorted(maps.Keys(winLocales)))
+}
+
+// localeEdits returns the registry edits to set the system and user locale
+// (and the codepages for it) to the named locale, and the unix locale wine
+// needs to be run with to keep it (since wine derives the windows locale from
+// the unix one at startup).
+func localeEdits(name string) ([]regEdit, string, error) {
+	name, l, err := lookupLocale(name)
+	if err != nil {
+		return nil, "", err
+	}
+	var edits []regEdit
+	set := func(key, name, value string) {
+		edits = append(edits, regEdit{Key: key, Value: &regValue{Name: name, Type: regSZ, Data: regStringData(value)}})
+	}
+	const nls = `HKLM\System\CurrentControlSet\Control\Nls`
+	set(nls+`\CodePage`, "ACP", strconv.Itoa(l.ACP))
+	set(nls+`\CodePage`, "OEMCP", strconv.Itoa(l.OEMCP))
+	set(nls+`\CodePage`, "MACCP", strconv.Itoa(l.MACCP))
+	set(nls+`\Language`, "Default", fmt.Sprintf("%04x", l.LCID))
+	set(nls+`\Language`, "InstallLanguage", fmt.Sprintf("%04x", l.LCID))
+	set(nls+`\Locale`, "", fmt.Sprintf("%08x", l.LCID))
+	set(`HKCU\Control Panel\International`, "Locale", fmt.Sprintf("%08x", l.LCID))
+	set(`HKCU\Control Panel\International`, "LocaleName", name)
+	return edits, strings.ReplaceAll(name, "-", "_") + ".UTF-8", nil
+}
+
+// timezoneKey is where the time zones wine.inf installs are listed.
+const timezoneKey = `Software\Microsoft\Windows NT\CurrentVersion\Time Zones`
+
+// timezoneEdits returns the registry edits to set the current timezone to the
+// named one (a windows timezone key name like "UTC" or "Pacific Standard
+// Time") from the time zones listed in a system hive, and the equivalent POSIX
+// TZ wine needs to be run with to keep it (since wine derives the timezone from
+// the unix one at startup, using the first listed time zone with the same
+// rules).
+func timezoneEdits(f *regFile, name string) ([]regEdit, string, error) {
+	i := slices.IndexFunc(f.Subkeys(timezoneKey), func(x string) bool {
+		return strings.EqualFold(x, name)
+	})
+	if i == -1 {
+		return nil, "", fmt.Errorf("unknown timezone %q", name)
+	}
+	name = f.Subkeys(timezoneKey)[i]
+	key := timezoneKey + `\` + name
+
+	// REG_TZI_FORMAT: Bias, StandardBias, DaylightBias, StandardDate, DaylightDate
+	tzi := f.Value(key, "TZI")
+	if tzi == nil || tzi.Type != regBinary || len(tzi.Data) != 44 {
+		return nil, "", fmt.Errorf("timezone %q: missing or invalid TZI", name)
+	}
+	posix, err := posixTZ(tzi.Data)
+	if err != nil {
+		return nil, "", fmt.Errorf("timezone %q: %w", name, err)
+	}
+	std, _ := f.Value(key, "Std").Str()
+	dlt, _ := f.Value(key, "Dlt").Str()
+
+	var edits []regEdit
+	set := func(name string, typ uint32, data []byte) {
+		edits = append(edits, regEdit{Key: `HKLM\System\CurrentControlSet\Control\TimeZoneInformation`, Value: &regValue{Name: name, Type: typ, Data: data}})
+	}
+	set("Bias", regDWORD, regDWORDData(binary.LittleEndian.Uint32(tzi.Data[0:])))
+	set("StandardBias", regDWORD, regDWORDData(binary.LittleEndian.Uint32(tzi.Data[4:])))
+	set("DaylightBias", regDWORD, regDWORDData(binary.LittleEndian.Uint32(tzi.Data[8:])))
+	set("StandardStart", regBinary, slices.Clone(tzi.Data[12:28]))
+	set("DaylightStart", regBinary, slices.Clone(tzi.Data[28:44]))
+	set("StandardName", regSZ, regStringData(std))
+	set("DaylightName", regSZ, regStringData(dlt))
+	set("TimeZoneKeyName", regSZ, regStringData(name))
+	set("DynamicDaylightTimeDisabled", regDWORD, regDWORDData(0))
+	return edits, posix, nil
+}
+
+// posixTZ converts a REG_TZI_FORMAT to a POSIX TZ string. The zone names are
+// the UTC offsets (like tzdata uses for zones without abbreviations).
+func posixTZ(tzi []byte) (string, error) {
+	var (
+		bias    = int32(binary.LittleEndian.Uint32(tzi[0:]))
+		stdBias = int32(binary.LittleEndian.Uint32(tzi[4:]))
+		dltBias = int32(binary.LittleEndian.Uint32(tzi[8:]))
+	)
+	zone := func(bias int32) string {
+		var b strings.Builder
+		off, sign := -bias, '+' // the bias is minutes west of UTC
+		if off < 0 {
+			off, sign = -off, '-'
+		}
+		fmt.Fprintf(&b, "<%c%02d", sign, off/60)
+		if off%60 != 0 {
+			fmt.Fprintf(&b, "%02d", off%60)
+		}
+		b.WriteByte('>')
+		if bias < 0 {
+			b.WriteByte('-')
+			bias = -bias
+		}
+		fmt.Fprintf(&b, "%d", bias/60)
+		if bias%60 != 0 {
+			fmt.Fprintf(&b, ":%02d", bias%60)
+		}
+		return b.String()
+	}
+	// SYSTEMTIME: wYear, wMonth, wDayOfWeek, wDay (the week of the month
+	// if wYear is zero, with 5 being the last), wHour, wMinute, wSecond,
+	// wMilliseconds
+	rule := func(st []byte) (string, error) {
+		var w [8]uint16
+		for i := range w {
+			w[i] = binary.LittleEndian.Uint16(st[i*2:])
+		}
+		if w[0] != 0 {
+			return "", fmt.Errorf("unsupported absolute transition date")
+		}
+		if w[1] < 1 || w[1] > 12 || w[2] > 6 || w[3] < 1 || w[3] > 5 {
+			return "", fmt.Errorf("invalid transition date %v", w)
+		}
+		s := fmt.Sprintf(",M%d.%d.%d/%d", w[1], w[3], w[2], w[4])
+		if w[5] != 0 || w[6] != 0 {
+			s += fmt.Sprintf(":%02d", w[5])
+		}
+		if w[6] != 0 {
+			s += fmt.Sprintf(":%02d", w[6])
+		}
+		return s, nil
+	}
+	tz := zone(bias + stdBias)
+	if binary.LittleEndian.Uint16(tzi[30:]) == 0 {
+		return tz, nil // no daylight saving time
+	}
+	dst, err := rule(tzi[28:44])
+	if err != nil {
+		return "", err
+	}
+	std, err := rule(tzi[12:28])
+	if err != nil {
+		return "", err
+	}
+	return tz + zone(bias+dltBias) + dst + std, nil
+}
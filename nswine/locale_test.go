@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLocaleEdits(t *testing.T) {
+	edits, unix, err := localeEdits("ru_ru")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if unix != "ru_RU.UTF-8" {
+		t.Errorf("expected unix locale ru_RU.UTF-8, got %q", unix)
+	}
+	hives := map[string]*regFile{}
+	if err := applyRegEdits(hives, edits); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	for name, exp := range map[string]string{"ACP": "1251", "OEMCP": "866", "MACCP": "10007"} {
+		if v, _ := hives["system.reg"].Value(`System\CurrentControlSet\Control\Nls\CodePage`, name).Str(); v != exp {
+			t.Errorf("expected %s %s, got %q", name, exp, v)
+		}
+	}
+	if v, _ := hives["user.reg"].Value(`Control Panel\International`, "LocaleName").Str(); v != "ru-RU" {
+		t.Errorf("expected locale name ru-RU, got %q", v)
+	}
+	if v, _ := hives["user.reg"].Value(`Control Panel\International`, "Locale").Str(); v != "00000419" {
+		t.Errorf("expected locale 00000419, got %q", v)
+	}
+	if _, _, err := localeEdits("xx-XX"); err == nil {
+		t.Errorf("expected error for unsupported locale")
+	}
+}
+
+func TestTimezoneEdits(t *testing.T) {
+	f, err := parseReg([]byte(unindent(`
+		WINE REGISTRY Version 2
+
+		[Software\\Microsoft\\Windows NT\\CurrentVersion\\Time Zones\\Pacific Standard Time] 1700000000
+		"Dlt"="Pacific Daylight Time"
+		"Std"="Pacific Standard Time"
+		"TZI"=hex:e0,01,00,00,00,00,00,00,c4,ff,ff,ff,00,00,0b,00,00,00,01,00,02,00,00,00,\
+		  00,00,00,00,00,00,03,00,00,00,02,00,02,00,00,00,00,00,00,00
+
+		[Software\\Microsoft\\Windows NT\\CurrentVersion\\Time Zones\\UTC] 1700000000
+		"TZI"=hex:00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,\
+		  00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00,00
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	edits, posix, err := timezoneEdits(f, "pacific standard time")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := "<-08>8<-07>7,M3.2.0/2,M11.1.0/2"; posix != exp {
+		t.Errorf("expected posix tz %q, got %q", exp, posix)
+	}
+	hives := map[string]*regFile{}
+	if err := applyRegEdits(hives, edits); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	const key = `System\CurrentControlSet\Control\TimeZoneInformation`
+	if v, _ := hives["system.reg"].Value(key, "Bias").DWORD(); v != 480 {
+		t.Errorf("expected bias 480, got %d", v)
+	}
+	if v, _ := hives["system.reg"].Value(key, "DaylightBias").DWORD(); int32(v) != -60 {
+		t.Errorf("expected daylight bias -60, got %d", int32(v))
+	}
+	if v := hives["system.reg"].Value(key, "DaylightStart"); v == nil || !bytes.Equal(v.Data, []byte{0, 0, 3, 0, 0, 0, 2, 0, 2, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("wrong daylight start %v", v)
+	}
+	if v, _ := hives["system.reg"].Value(key, "TimeZoneKeyName").Str(); v != "Pacific Standard Time" {
+		t.Errorf("expected key name Pacific Standard Time, got %q", v)
+	}
+	if _, _, err := timezoneEdits(f, "Mars Standard Time"); err == nil {
+		t.Errorf("expected error for unknown timezone")
+	}
+}
+
+func TestPosixTZ(t *testing.T) {
+	for _, tc := range []struct {
+		TZI []byte
+		Exp string
+	}{
+		{ // UTC
+			TZI: make([]byte, 44),
+			Exp: "<+00>0",
+		},
+		{ // India Standard Time
+			TZI: []byte{0xb6, 0xfe, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			Exp: "<+0530>-5:30",
+		},
+		{ // W. Europe Standard Time
+			TZI: []byte{0xc4, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0xc4, 0xff, 0xff, 0xff, 0, 0, 10, 0, 0, 0, 5, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 5, 0, 2, 0, 0, 0, 0, 0, 0, 0},
+			Exp: "<+01>-1<+02>-2,M3.5.0/2,M10.5.0/3",
+		},
+		{ // Newfoundland Standard Time
+			TZI: []byte{0xd2, 0, 0, 0, 0, 0, 0, 0, 0xc4, 0xff, 0xff, 0xff, 0, 0, 11, 0, 0, 0, 1, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 2, 0, 2, 0, 0, 0, 0, 0, 0, 0},
+			Exp: "<-0330>3:30<-0230>2:30,M3.2.0/2,M11.1.0/2",
+		},
+	} {
+		if act, err := posixTZ(tc.TZI); err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.Exp, err)
+		} else if act != tc.Exp {
+			t.Errorf("expected %q, got %q", tc.Exp, act)
+		}
+	}
+	tzi := make([]byte, 44)
+	tzi[30], tzi[28] = 3, 1 // DaylightDate.wYear = 1
+	if _, err := posixTZ(tzi); err == nil {
+		t.Errorf("expected error for absolute transition date")
+	}
+}
@@ -0,0 +1,431 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ManifestName is the name of the manifest file in the output directory.
+const ManifestName = "nswine.json"
+
+// RegTranscriptName is the name of the .reg file in the output directory with
+// the registry changes nswine made after wineboot.
+const RegTranscriptName = "nswine.reg"
+
+// UserTemplateName is the name of the minimal user hive in the output
+// directory which nswrap uses as the base for instance prefixes, if it exists.
+const UserTemplateName = "user.template.reg"
+
+// RuntimeCompat is the runtime compatibility version. It must be incremented
+// (along with NSWRAP_RUNTIME_COMPAT in nswrap) whenever the runtime layout
+// changes in a way which requires a corresponding nswrap change.
+const RuntimeCompat = 1
+
+// Manifest describes the generated runtime. It is the single source of truth
+// for information about the output files.
+type Manifest struct {
+	Compat      int                    `json:"compat"` // must be first so nswrap can find it easily
+	WineBuildID string                 `json:"wine_build_id"`
+	Locale      string                 `json:"locale,omitempty"` // unix locale for nswrap to run wine with (LC_ALL), if -locale was used
+	TZ          string                 `json:"tz,omitempty"`     // posix TZ for nswrap to run wine with, if -tz was used
+	Files       []*ManifestFile        `json:"files"`
+	Services    []*ManifestService     `json:"services,omitempty"`
+	Degraded    []*ManifestDegradation `json:"degraded,omitempty"`        // missing optional inputs
+	Removed     []*ManifestRemoval     `json:"removed,omitempty"`         // files removed from the wine build
+	Registry    []*ManifestRegistry    `json:"registry,omitempty"`        // registry values set by the profile (and drivers)
+	Roots       map[string]string      `json:"roots,omitempty"`           // closure roots (lowercased module names) and why they're roots, if -closure was used
+	Imports     map[string][]string    `json:"imports,omitempty"`         // resolved imports and forwarders of the remaining PE modules (lowercased)
+	Stubs       map[string][]string    `json:"stubs,omitempty"`           // exports of the remaining PE modules which are unimplemented wine stubs (lowercased module names)
+	Binaries    string                 `json:"binaries_sha256,omitempty"` // sha256 of the binary hash list (see writeBinaryHashes)
+}
+
+// ManifestFile describes a single file in the runtime.
+type ManifestFile struct {
+	Root       string     `json:"root"` // "wine" (-prefix) or "prefix" (-output)
+	Path       string     `json:"path"` // slash-separated, relative to the root
+	Size       int64      `json:"size,omitempty"`
+	Link       string     `json:"link,omitempty"`
+	Version    *peVersion `json:"version,omitempty"` // from the version resource, if it's a PE file with one
+	SHA256     string     `json:"sha256,omitempty"`  // if it's a PE or ELF binary
+	Provenance Provenance `json:"provenance"`
+}
+
+// ManifestRemoval describes a file which was removed from the wine build.
+type ManifestRemoval struct {
+	Root   string   `json:"root"`
+	Path   string   `json:"path"`
+	Rule   string   `json:"rule"`             // the step which removed it
+	Detail string   `json:"detail,omitempty"` // human-readable explanation
+	Deps   []string `json:"deps,omitempty"`   // the removed modules which caused it to be removed, if any
+}
+
+// ManifestService describes a service from wine.inf.
+type ManifestService struct {
+	Name    string `json:"name"`
+	Section string `json:"section"`
+	Binary  string `json:"binary,omitempty"`
+	Removed string `json:"removed,omitempty"` // why the service was removed, if it was
+}
+
+// ManifestRegistry describes a registry value set by the profile.
+type ManifestRegistry struct {
+	Key   string `json:"key"`
+	Name  string `json:"name"` // empty for the default value
+	Type  string `json:"type"`
+	Value any    `json:"value"` // as specified in the profile
+}
+
+// Origin is where a file originally came from.
+type Origin string
+
+const (
+	OriginWine      Origin = "wine"      // from the wine build
+	OriginGenerated Origin = "generated" // created during the build
+	OriginVendored  Origin = "vendored"  // copied from the build host
+)
+
+// Provenance describes where a file came from and what touched it.
+type Provenance struct {
+	Origin Origin   `json:"origin"`
+	Source string   `json:"source,omitempty"` // original path, or host package
+	Steps  []string `json:"steps,omitempty"`  // steps which generated or modified the file
+}
+
+var provenance struct {
+	mu       sync.Mutex
+	m        map[string]*Provenance      // keyed by absolute path
+	removed  map[string]*ManifestRemoval // keyed by absolute path, without the root and path
+	roots    map[string]string
+	registry []*ManifestRegistry
+}
+
+// provenanceOf returns the recorded provenance for an absolute path, creating
+// it with the specified origin if it doesn't exist.
+func provenanceOf(path string, origin Origin) *Provenance {
+	if provenance.m == nil {
+		provenance.m = map[string]*Provenance{}
+	}
+	p, ok := provenance.m[path]
+	if !ok {
+		p = &Provenance{Origin: origin}
+		provenance.m[path] = p
+	}
+	return p
+}
+
+// provModified records that step modified a file from the wine build.
+func provModified(path, step string) {
+	provenance.mu.Lock()
+	defer provenance.mu.Unlock()
+
+	p := provenanceOf(path, OriginWine)
+	if !slices.Contains(p.Steps, step) {
+		p.Steps = append(p.Steps, step)
+	}
+}
+
+// provGenerated records that step created a file.
+func provGenerated(path, step string) {
+	provenance.mu.Lock()
+	defer provenance.mu.Unlock()
+
+	p := provenanceOf(path, OriginGenerated)
+	p.Origin = OriginGenerated
+	if !slices.Contains(p.Steps, step) {
+		p.Steps = append(p.Steps, step)
+	}
+}
+
+// provVendored records that a file was copied from source (a host package or
+// path) by step.
+func provVendored(path, source, step string) {
+	provenance.mu.Lock()
+	defer provenance.mu.Unlock()
+
+	p := provenanceOf(path, OriginVendored)
+	p.Origin = OriginVendored
+	p.Source = source
+	if !slices.Contains(p.Steps, step) {
+		p.Steps = append(p.Steps, step)
+	}
+}
+
+// provRemove removes a file, recording that rule removed it (and optionally
+// which removed modules caused it).
+func provRemove(path, rule, detail string, deps ...string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	provenance.mu.Lock()
+	defer provenance.mu.Unlock()
+
+	if provenance.removed == nil {
+		provenance.removed = map[string]*ManifestRemoval{}
+	}
+	provenance.removed[path] = &ManifestRemoval{
+		Rule:   rule,
+		Detail: detail,
+		Deps:   deps,
+	}
+	delete(provenance.m, path)
+	return nil
+}
+
+// provRemovedFrom gets the lowercased names of the files removed from dir.
+func provRemovedFrom(dir string) map[string]bool {
+	provenance.mu.Lock()
+	defer provenance.mu.Unlock()
+
+	names := map[string]bool{}
+	for path := range provenance.removed {
+		if filepath.Dir(path) == filepath.Clean(dir) {
+			names[strings.ToLower(filepath.Base(path))] = true
+		}
+	}
+	return names
+}
+
+// provRoot records that a module is a closure root.
+func provRoot(name, reason string) {
+	provenance.mu.Lock()
+	defer provenance.mu.Unlock()
+
+	if provenance.roots == nil {
+		provenance.roots = map[string]string{}
+	}
+	if _, ok := provenance.roots[name]; !ok {
+		provenance.roots[name] = reason
+	}
+}
+
+// provRegistry records that a registry value was set.
+func provRegistry(key, name, typ string, value any) {
+	provenance.mu.Lock()
+	defer provenance.mu.Unlock()
+
+	provenance.registry = append(provenance.registry, &ManifestRegistry{
+		Key:   key,
+		Name:  name,
+		Type:  typ,
+		Value: value,
+	})
+}
+
+// buildManifest walks the wine and wineprefix dirs, combining the files with
+// the recorded provenance. Untracked files in the wine dir are assumed to be
+// from the wine build, and untracked files in the wineprefix are assumed to
+// have been created by wineboot.
+func buildManifest(wineBuildID string, svcs []*infService) (*Manifest, error) {
+	provenance.mu.Lock()
+	defer provenance.mu.Unlock()
+
+	m := &Manifest{
+		Compat:      RuntimeCompat,
+		WineBuildID: wineBuildID,
+	}
+
+	degradations.mu.Lock()
+	for _, d := range degradations.d {
+		x := *d
+		m.Degraded = append(m.Degraded, &x)
+	}
+	degradations.mu.Unlock()
+
+	for _, svc := range svcs {
+		ms := &ManifestService{
+			Name:    svc.Name,
+			Section: svc.Section,
+			Binary:  svc.Binary,
+		}
+		if svc.Remove {
+			ms.Removed = svc.Reason
+		}
+		m.Services = append(m.Services, ms)
+	}
+	for _, root := range []struct {
+		Name   string
+		Dir    string
+		Origin Origin
+		Step   string
+	}{
+		{"wine", *Prefix, OriginWine, ""},
+		{"prefix", *Output, OriginGenerated, "wineboot"},
+	} {
+		if err := filepath.WalkDir(root.Dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(root.Dir, path)
+			if err != nil {
+				return err
+			}
+			if root.Name == "prefix" && rel == ManifestName {
+				return nil
+			}
+			mf := &ManifestFile{
+				Root: root.Name,
+				Path: filepath.ToSlash(rel),
+			}
+			if p, ok := provenance.m[path]; ok {
+				mf.Provenance = *p
+				mf.Provenance.Steps = slices.Clone(p.Steps)
+			} else {
+				mf.Provenance.Origin = root.Origin
+				if root.Step != "" {
+					mf.Provenance.Steps = []string{root.Step}
+				}
+			}
+			if mf.Provenance.Origin == OriginWine && mf.Provenance.Source == "" {
+				mf.Provenance.Source = path
+			}
+			if d.Type()&fs.ModeSymlink != 0 {
+				if mf.Link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			} else {
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				mf.Size = fi.Size()
+				if v, err := peFileVersion(path); err == nil {
+					mf.Version = v
+				}
+				if mf.SHA256, err = binaryHash(path); err != nil {
+					return err
+				}
+			}
+			m.Files = append(m.Files, mf)
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("walk %s: %w", root.Name, err)
+		}
+	}
+	slices.SortFunc(m.Files, func(a, b *ManifestFile) int {
+		if c := strings.Compare(a.Root, b.Root); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	{
+		h := sha256.New()
+		writeBinaryHashes(h, m)
+		m.Binaries = hex.EncodeToString(h.Sum(nil))
+	}
+
+	for path, r := range provenance.removed {
+		if _, err := os.Lstat(path); err == nil {
+			continue // replaced (e.g., by a stub)
+		}
+		rel, err := filepath.Rel(*Prefix, path)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		x := *r
+		x.Root, x.Path = "wine", filepath.ToSlash(rel)
+		m.Removed = append(m.Removed, &x)
+	}
+	slices.SortFunc(m.Removed, func(a, b *ManifestRemoval) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	for _, r := range provenance.registry {
+		x := *r
+		m.Registry = append(m.Registry, &x)
+	}
+	if len(provenance.roots) != 0 {
+		m.Roots = maps.Clone(provenance.roots)
+	}
+
+	winDir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
+	pg, err := peGraph(winDir)
+	if err != nil {
+		return nil, fmt.Errorf("build import graph: %w", err)
+	}
+	schema, err := loadApisetSchema(winDir)
+	if err != nil {
+		schema = nil // just don't resolve them
+	}
+	m.Imports = map[string][]string{}
+	for name, deps := range pg.Deps {
+		for _, dep := range schema.ResolveImports(deps) {
+			if dep = strings.ToLower(dep); dep != name && !slices.Contains(m.Imports[name], dep) {
+				m.Imports[name] = append(m.Imports[name], dep)
+			}
+		}
+		slices.Sort(m.Imports[name])
+	}
+	mods, err := wineStubsOf(winDir)
+	if err != nil {
+		return nil, fmt.Errorf("find wine stubs: %w", err)
+	}
+	m.Stubs = map[string][]string{}
+	for name, mod := range mods {
+		if len(mod.Stubs) != 0 {
+			m.Stubs[name] = mod.Stubs
+		}
+	}
+	return m, nil
+}
+
+// binaryHash returns the hex sha256 of a file if it's a PE or ELF binary, or an
+// empty string otherwise.
+func binaryHash(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	n, _ := io.ReadFull(f, magic[:])
+	if n < 2 || (string(magic[:2]) != "MZ" && string(magic[:n]) != "\x7fELF") {
+		return "", nil
+	}
+	h := sha256.New()
+	h.Write(magic[:n])
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeBinaryHashes writes the hashes of the binaries in m in sha256sum format,
+// with paths prefixed by the root (e.g., "wine/lib/wine/x86_64-windows/...").
+// The files must be sorted. Nothing is signed, so the hashes can only be used to
+// verify a runtime against a manifest (or binaries_sha256) obtained from
+// somewhere trusted, not to tell whether the manifest itself is authentic.
+func writeBinaryHashes(w io.Writer, m *Manifest) {
+	for _, f := range m.Files {
+		if f.SHA256 != "" {
+			fmt.Fprintf(w, "%s  %s/%s\n", f.SHA256, f.Root, f.Path)
+		}
+	}
+}
+
+// writeManifest writes m to the output directory.
+func writeManifest(m *Manifest) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // nswrap reads the top-level strings without unescaping them
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(*Output, ManifestName), buf.Bytes(), 0644)
+}
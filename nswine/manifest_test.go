@@ -0,0 +1,69 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestManifestCompat(t *testing.T) {
+	buf, err := json.MarshalIndent(&Manifest{Compat: RuntimeCompat}, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "{\n\t\"compat\": " + strconv.Itoa(RuntimeCompat) + ",\n"; !bytes.HasPrefix(buf, []byte(exp)) {
+		t.Errorf("expected manifest to start with %q (nswrap depends on this), got:\n%s", exp, buf)
+	}
+
+	src, err := os.ReadFile("../nswrap/nswrap.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := regex(`(?m)^#define NSWRAP_RUNTIME_COMPAT ([0-9]+)$`).FindSubmatch(src)
+	if m == nil {
+		t.Fatalf("nswrap does not define NSWRAP_RUNTIME_COMPAT")
+	}
+	if v, _ := strconv.Atoi(string(m[1])); v != RuntimeCompat {
+		t.Errorf("nswrap runtime compat %d does not match nswine %d", v, RuntimeCompat)
+	}
+}
+
+func TestBinaryHashes(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.dll":  "MZ...",
+		"b.so":   "\x7fELF...",
+		"c.txt":  "text",
+		"d.elf":  "\x7fEL",
+		"e.json": "",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &Manifest{}
+	for _, name := range []string{"a.dll", "b.so", "c.txt", "d.elf", "e.json"} {
+		h, err := binaryHash(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("hash %s: %v", name, err)
+		}
+		if binary := name == "a.dll" || name == "b.so"; binary != (h != "") {
+			t.Errorf("%s: expected binary=%t, got hash %q", name, binary, h)
+		}
+		m.Files = append(m.Files, &ManifestFile{Root: "wine", Path: name, SHA256: h})
+	}
+	var buf bytes.Buffer
+	writeBinaryHashes(&buf, m)
+	sum := sha256.Sum256([]byte("MZ..."))
+	if exp := hex.EncodeToString(sum[:]) + "  wine/a.dll\n"; !strings.HasPrefix(buf.String(), exp) || strings.Count(buf.String(), "\n") != 2 {
+		t.Errorf("expected hashes to start with %q and have two lines, got:\n%s", exp, buf.String())
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// nlsCodepage gets the codepage from a wine NLS codepage table file name like
+// "c_1252.nls".
+func nlsCodepage(name string) (int, bool) {
+	name = strings.ToLower(name)
+	if x, ok := strings.CutPrefix(name, "c_"); ok {
+		if x, ok := strings.CutSuffix(x, ".nls"); ok {
+			if n, err := strconv.Atoi(x); err == nil && n > 0 {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// nlsBuiltinCodepage checks if the codepage is implemented by wine without a
+// table (i.e., UTF-7 and UTF-8).
+func nlsBuiltinCodepage(cp int) bool {
+	return cp == 65000 || cp == 65001
+}
+
+// parseCodepages parses a comma-separated list of codepages and codepage
+// ranges (e.g., "437,1250-1258").
+func parseCodepages(s string) ([]int, error) {
+	var cps []int
+	for x := range strings.SplitSeq(s, ",") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		a, b, isRange := strings.Cut(x, "-")
+		lo, err := strconv.Atoi(a)
+		if err != nil || lo <= 0 {
+			return nil, fmt.Errorf("invalid codepage %q", x)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(b); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid codepage range %q", x)
+			}
+		}
+		for cp := lo; cp <= hi; cp++ {
+			if !slices.Contains(cps, cp) {
+				cps = append(cps, cp)
+			}
+		}
+	}
+	slices.Sort(cps)
+	return cps, nil
+}
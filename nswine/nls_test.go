@@ -0,0 +1,37 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCodepages(t *testing.T) {
+	for _, tc := range []struct {
+		In  string
+		Out []int
+		Err bool
+	}{
+		{"", nil, false},
+		{"1252", []int{1252}, false},
+		{"1252, 437,1250-1252", []int{437, 1250, 1251, 1252}, false},
+		{"x", nil, true},
+		{"5-1", nil, true},
+		{"0", nil, true},
+	} {
+		out, err := parseCodepages(tc.In)
+		if (err != nil) != tc.Err {
+			t.Errorf("%q: unexpected error state: %v", tc.In, err)
+		} else if !slices.Equal(out, tc.Out) {
+			t.Errorf("%q: expected %v, got %v", tc.In, tc.Out, out)
+		}
+	}
+}
+
+func TestNlsCodepage(t *testing.T) {
+	if n, ok := nlsCodepage("C_1252.NLS"); !ok || n != 1252 {
+		t.Errorf("expected codepage 1252, got %d", n)
+	}
+	if _, ok := nlsCodepage("l_intl.nls"); ok {
+		t.Errorf("expected l_intl.nls to not be a codepage")
+	}
+}
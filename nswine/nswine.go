@@ -12,11 +12,14 @@
 // It does not currently support cross-compiling since it needs to run wineboot
 // to initialize the prefix.
 //
-// It supports x86_64, and arm64 (via fex arm64ec).
+// It supports x86_64, and arm64 (via arm64ec, with fex by default or qemu with
+// -emulator).
 //
 // The generated wineprefix works independently of the system wine.
 //
-// It forces the use of nulldrv for display and no audio driver.
+// By default, it forces the use of nulldrv for display and no audio driver.
+// Other drivers can be selected with -drivers, in which case the others in the
+// same family are still removed.
 //
 // Optionally, it can remove a bunch of unused libraries and services to
 // significantly reduce the size and number of processes.
@@ -26,6 +29,78 @@
 // running Debian, as this is what the wine binaries were built on, and is also
 // where this logic was tested.
 //
+// If optional inputs (the arm64 emulator, wine-mono, wine-gecko, or host libs
+// with -vendor) are missing, the build is still valid, but is flagged as
+// degraded in the manifest. Use -strict to fail instead.
+//
+// The manifest records the removed files and the import graph, so the why
+// subcommand can explain why a file was removed or which roots keep it.
+//
+// Patched PE images get their header checksum fixed. If SOURCE_DATE_EPOCH is
+// set, their timestamp is also set to it. With -strip-signatures, their
+// (invalidated) authenticode signatures are removed. The subsystem subcommand
+// can switch EXEs between GUI and console the same way.
+//
+// Profiles can set system and user environment variables (e.g., TEMP), and
+// append directories to the system PATH.
+//
+// Profiles can substitute fonts (e.g., ones removed from the runtime with
+// ones which are kept), and set fallback fonts for font linking.
+//
+// Profiles can also map drive letters to unix paths in dosdevices (or remove
+// the default z: mapping of the unix root for isolation).
+//
+// Crash dialogs and interactive debugging are disabled in the prefix, so a
+// crashing server prints a backtrace and exits instead of hanging.
+//
+// Profiles can flag builtin dlls as prefer-native (or clear the flag), which
+// changes the default load order without needing DllOverrides. DllOverrides
+// can also be set by the profile, or with -dll-overrides.
+//
+// The machine identity (computer name, machine guid, and volume serial) which
+// wineboot derives from the build host is replaced with deterministic values,
+// which can be overridden with -identity.
+//
+// The locale (and its codepages) and timezone which wineboot derives from the
+// build host can be set with -locale and -tz. Since wine derives them from the
+// unix locale and TZ again at startup, the matching unix locale and POSIX TZ
+// are recorded in the manifest for nswrap to run wine with (the locale must be
+// installed where the runtime is used).
+//
+// The reported windows version can be set with -winver, which writes the same
+// registry keys as winecfg (which may be removed by -optimize).
+//
+// Registry settings can be baked into the prefix by listing typed values in the
+// profile's registry section, or by importing .reg files with -reg-import. Both
+// are applied directly to the hives without running wine, and profile values
+// are recorded in the manifest. The regdiff subcommand compares the registry of
+// two prefixes, which is useful when upgrading wine or changing prune rules.
+// All registry changes made after wineboot are also exported to nswine.reg in
+// the output directory. With -user-template, a minimal user hive with only
+// the user settings nswine and the profile made (and a few wine needs) is
+// written to user.template.reg, which nswrap uses as the base user hive for
+// instance prefixes.
+//
+// Registered services whose ImagePath or ServiceDll doesn't exist in the output
+// are reported, since services.exe would log errors for them on every start.
+// With -service-check=prune, they're removed, and with -service-check=fail,
+// the build fails instead.
+//
+// Additional INF fragments can be merged into wine.inf with -inf-overlay to
+// customize the prefix initialization (e.g., registry keys or services). With
+// -inf-minimal, the filtered wine.inf is rebuilt from scratch with only the
+// sections the install sections wineboot runs actually use.
+//
+// The inf-install subcommand applies the registry and fake dll parts of
+// wine.inf to a prefix directly, without running wine (or needing a matching
+// host architecture).
+//
+// The build steps can be exported as an OpenTelemetry trace with -otlp.
+//
+// Profiles can be shared as archives (see the pack-profile subcommand) and used
+// from an OCI registry or URL with -profile, pinned by digest (unless
+// -allow-unpinned-profile is used).
+//
 // While there are no official ARM64 wine builds, hangover on 10.x is close
 // enough, as it's mostly converged with official wine now, especially when only
 // looking at non-WoW64 arm64ec and ignoring arm32/i386.
@@ -33,15 +108,17 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"debug/pe"
 	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
-	"iter"
 	"log/slog"
 	"maps"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"slices"
 	"strconv"
@@ -57,13 +134,87 @@ var (
 	Optimize = flag.Bool("optimize", false, "remove unused libraries and services")
 	Debug    = flag.Bool("debug", false, "debug logging")
 	Vendor   = flag.Bool("vendor", false, "copy native libs from the build host")
+	Verify   = flag.Bool("verify", false, "initialize a scratch wineprefix after building to check for new errors")
+	Offline  = flag.Bool("offline", false, "guarantee nothing accesses the network during the build (re-executes in a new network namespace if needed)")
+	Closure  = flag.Bool("closure", false, "with -optimize, remove all modules not reachable from the profile roots instead of the built-in list")
+	Strict   = flag.Bool("strict", false, "fail instead of producing a degraded build if optional inputs (emulator, wine-mono, wine-gecko, host libs) are missing")
+
+	Components         = flag.String("components", "", "move the profile's optional components to this directory instead of leaving them in the runtime")
+	ComponentsSource   = flag.String("components-source", "", "base URL or path nswrap will install optional components from (default the absolute -components path)")
+	DebugSymbols       = flag.String("debug-symbols", "", "move the debug info from wine ELF binaries to this directory (keyed by build id) instead of leaving it in the runtime")
+	HeadlessStubs      = flag.Bool("headless-stubs", false, "with -optimize, replace the removed d3d11 and dxgi with stubs which fail to create devices instead of leaving them missing")
+	Emulator           = flag.String("emulator", "fex", "on arm64, the hangover emulation backend for x86_64 code (the others are removed with -optimize)")
+	Drivers            = flag.String("drivers", "", "comma-separated driver selections like graphics=x11,audio=pulse (families not specified use no driver)")
+	Codepages          = flag.String("codepages", "", "comma-separated codepages or ranges to keep in share/wine/nls (default all)")
+	Identity           = flag.String("identity", "", "comma-separated machine identity overrides like computername=NAME,machineguid=GUID,serial=HEX (by default, the computer name is NSWRAP and the rest are derived from it)")
+	DllOverrides       = flag.String("dll-overrides", "", "dll overrides to set in the wineprefix in the WINEDLLOVERRIDES format (e.g., mscoree,mshtml=;d3d11=n,b), applied on top of the profile's")
+	Locale             = flag.String("locale", "", "system and user locale to set in the wineprefix (e.g., en-US), along with its codepages (by default, it's derived from the build host) (nswrap runs wine with the matching unix locale, which must be installed)")
+	Timezone           = flag.String("tz", "", "timezone to set in the wineprefix, as a windows timezone name (e.g., UTC or \"Pacific Standard Time\") (by default, it's derived from the build host) (nswrap runs wine with the matching posix TZ)")
+	WinVer             = flag.String("winver", "", "windows version to report in the wineprefix (win10 or win11), set directly in the registry since winecfg may be removed")
+	UserTemplate       = flag.Bool("user-template", false, "also write a minimal user registry hive for nswrap to use as the base for instance prefixes instead of the full one")
+	ServiceCheck       = flag.String("service-check", "warn", "what to do with registered services whose binary doesn't exist in the output (warn, prune, or fail)")
+	RegImport          = flag.String("reg-import", "", "comma-separated .reg files (in the regedit format) to apply to the wineprefix registry after it's created")
+	InfMinimal         = flag.Bool("inf-minimal", false, "rebuild wine.inf from only the sections reachable from the install sections wineboot runs (after filtering it), which is much smaller and easier to audit")
+	InfOverlay         = flag.String("inf-overlay", "", "comma-separated INF fragments to merge into wine.inf after it's filtered (sections are appended to existing ones, and Strings/DestinationDirs entries replace existing ones)")
+	ProfileName        = flag.String("profile", "northstar", "built-in profile name, path to a profile json file, or remote profile (oci://registry/repository:tag@sha256:digest or https://.../profile.tar#sha256:digest)")
+	UnpinnedProfile    = flag.Bool("allow-unpinned-profile", false, "allow a remote -profile referenced by tag without a digest (not reproducible, since the tag can be moved)")
+	NormalizeHostPaths = flag.Bool("normalize-host-paths", false, "replace build dir paths (e.g., /build/..., /home/...) embedded in binaries with their base names")
+	ScanCache          = flag.Bool("scan-cache", true, "cache the parsed imports and exports of PE files in the user cache dir by file hash (invalidated when the wine build id changes)")
+	StripDebugDirs     = flag.Bool("strip-debug-dirs", false, "remove the debug directories (including the PDB paths) from PE files")
+	StripSignatures    = flag.Bool("strip-signatures", false, "remove the authenticode signatures (which are invalidated by patching) from patched PE images")
+	OTLP               = flag.String("otlp", "", "export the build steps as an OpenTelemetry trace to this OTLP/HTTP endpoint (e.g., http://localhost:4318), or append it as JSON to this file")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		var cmd func(args []string) error
+		switch os.Args[1] {
+		case "fetch":
+			cmd = fetchMain
+		case "check-upstream":
+			cmd = checkUpstreamMain
+		case "report":
+			cmd = reportMain
+		case "pack-profile":
+			cmd = packProfileMain
+		case "why":
+			cmd = whyMain
+		case "subsystem":
+			cmd = subsystemMain
+		case "regdiff":
+			cmd = regdiffMain
+		case "inf-install":
+			cmd = infInstallMain
+		}
+		if cmd != nil {
+			if err := cmd(os.Args[2:]); err != nil {
+				slog.Error("failed", "error", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
+	setupLogging(*Debug)
+	otlpSetup(*OTLP)
+
+	err := run()
+	if err != nil {
+		slog.Error("failed", "error", err)
+	}
+	// export errors are only logged since they shouldn't fail the build
+	if xerr := otlpExport(err); xerr != nil {
+		slog.Warn("failed to export build trace", "endpoint", *OTLP, "error", xerr)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
 
+func setupLogging(debug bool) {
 	level := slog.LevelInfo
-	if *Debug {
+	if debug {
 		level = slog.LevelDebug
 	}
 	slog.SetDefault(slog.New(tint.NewHandler(os.Stdout, &tint.Options{
@@ -71,11 +222,6 @@ func main() {
 		TimeFormat: time.Kitchen,
 		Level:      level,
 	})))
-
-	if err := run(); err != nil {
-		slog.Error("failed", "error", err)
-		os.Exit(1)
-	}
 }
 
 func run() error {
@@ -85,6 +231,160 @@ func run() error {
 		}
 	}
 
+	if *Offline {
+		if reexec, err := ensureOffline(); err != nil || reexec {
+			return err
+		}
+	}
+
+	slog.Info("loading profile", "name", *ProfileName)
+	profileOffline = *Offline
+	profileUnpinned = *UnpinnedProfile
+	profile, err := loadProfile(*ProfileName)
+	if err != nil {
+		return err
+	}
+
+	drivers, err := parseDriverPolicy(*Drivers)
+	if err != nil {
+		return fmt.Errorf("parse drivers: %w", err)
+	}
+	for name, value := range drivers.Registry() {
+		key := `HKCU\Software\Wine\Drivers`
+		if profile.Registry[key] == nil {
+			profile.Registry[key] = map[string]any{}
+		}
+		profile.Registry[key][name] = value
+	}
+	dllOverrides, err := parseDllOverrides(*DllOverrides)
+	if err != nil {
+		return fmt.Errorf("parse dll overrides: %w", err)
+	}
+	for _, o := range []map[string]string{profile.DllOverrideModes(), dllOverrides} {
+		for name, mode := range o {
+			if profile.Registry[dllOverridesKey] == nil {
+				profile.Registry[dllOverridesKey] = map[string]any{}
+			}
+			profile.Registry[dllOverridesKey][name] = mode
+		}
+	}
+	for drive, d := range profile.DosDevices {
+		if d.Type != "" {
+			key := `HKLM\Software\Wine\Drives` // mountmgr reads the drive types from here
+			if profile.Registry[key] == nil {
+				profile.Registry[key] = map[string]any{}
+			}
+			profile.Registry[key][drive] = d.Type
+		}
+	}
+	for _, reg := range []map[string]map[string]any{profile.EnvironmentRegistry(), profile.FontRegistry()} {
+		for key, values := range reg {
+			if profile.Registry[key] == nil {
+				profile.Registry[key] = map[string]any{}
+			}
+			for name, value := range values {
+				maps.DeleteFunc(profile.Registry[key], func(x string, _ any) bool {
+					return strings.EqualFold(x, name)
+				})
+				profile.Registry[key][name] = value
+			}
+		}
+	}
+	for key, values := range headlessRegistry {
+		if profile.Registry[key] == nil {
+			profile.Registry[key] = map[string]any{}
+		}
+		for name, value := range values {
+			if _, ok := profile.Registry[key][name]; !ok {
+				profile.Registry[key][name] = value
+			}
+		}
+	}
+
+	if arm64 {
+		if err := checkEmulationBackend(*Emulator); err != nil {
+			return err
+		}
+		name := emulationBackends[*Emulator][0]
+		if _, err := os.Stat(filepath.Join(*Prefix, "lib/wine/aarch64-windows", name)); err == nil {
+			// make sure the selected backend isn't removed, and make wine use
+			// it (this is the registry equivalent of hangover's HODLL64)
+			profile.Keep = overlayList(profile.Keep, emulationBackends[*Emulator])
+			key := `HKLM\Software\Microsoft\Wow64\amd64`
+			if profile.Registry[key] == nil {
+				profile.Registry[key] = map[string]any{}
+			}
+			profile.Registry[key][""] = name
+		} else if errors.Is(err, fs.ErrNotExist) {
+			if err := degrade("emulator", *Emulator+" backend "+name+" not found", "x86_64 code will not run"); err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	var codepages []int
+	if *Codepages != "" {
+		if codepages, err = parseCodepages(*Codepages); err != nil {
+			return fmt.Errorf("parse codepages: %w", err)
+		}
+	}
+
+	var infOverlays []string
+	for name := range strings.SplitSeq(*InfOverlay, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if _, err := os.Stat(name); err != nil {
+				return fmt.Errorf("inf overlay: %w", err)
+			}
+			infOverlays = append(infOverlays, name)
+		}
+	}
+
+	identity, err := parseIdentity(*Identity)
+	if err != nil {
+		return fmt.Errorf("identity: %w", err)
+	}
+
+	var (
+		localeEdit []regEdit
+		localeUnix string
+		tzPosix    string
+	)
+	if *Locale != "" {
+		if localeEdit, localeUnix, err = localeEdits(*Locale); err != nil {
+			return fmt.Errorf("locale: %w", err)
+		}
+	}
+
+	var winverEdit []regEdit
+	if *WinVer != "" {
+		if winverEdit, err = winverEdits(*WinVer); err != nil {
+			return fmt.Errorf("winver: %w", err)
+		}
+	}
+
+	switch *ServiceCheck {
+	case "warn", "prune", "fail":
+	default:
+		return fmt.Errorf("invalid -service-check %q (expected warn, prune, or fail)", *ServiceCheck)
+	}
+
+	var regImports [][]regEdit
+	for name := range strings.SplitSeq(*RegImport, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			buf, err := os.ReadFile(name)
+			if err != nil {
+				return fmt.Errorf("reg import: %w", err)
+			}
+			edits, err := parseRegedit(buf)
+			if err != nil {
+				return fmt.Errorf("reg import %q: %w", name, err)
+			}
+			regImports = append(regImports, edits)
+		}
+	}
+
 	slog.Info("getting wine version")
 	var wineBuildID string
 	if buf, err := exec.Command(filepath.Join(*Prefix, "bin/wine"), "--version").Output(); err != nil {
@@ -97,17 +397,61 @@ func run() error {
 	}
 	slog.Info("got wine version", "build_id", wineBuildID)
 
+	if *ScanCache {
+		if c, err := openScanCache(wineBuildID); err != nil {
+			slog.Warn("not caching pe scans", "error", err)
+		} else {
+			peScanCache = c
+		}
+	}
+
 	// TODO: patch unix/ntdll.so asciiz string "wine-#.## (Type)" kind of thing (wine --version output) to change the output of wine_get_build_id to "nsSHA[:7]"
 
-	slog.Info("patching default graphics driver to null")
-	// 	- this is the only way other than recompiling to get it to use nulldrv during prefix initialization
-	if err := transform(filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"), "explorer.exe"), func(buf []byte) ([]byte, error) {
-		i := bytes.Index(buf, u8to16[string, []byte]("mac,x11,wayland\x00"))
-		if i == -1 {
-			return nil, fmt.Errorf("couldn't find default graphics driver value")
+	// patched PE images get their checksum fixed, and for reproducible
+	// builds, their timestamp normalized
+	peFix := peFixOptions{
+		StripSignature: *StripSignatures,
+	}
+	if v := os.Getenv("SOURCE_DATE_EPOCH"); v != "" {
+		ts, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+		}
+		peFix.Timestamp = new(uint32)
+		*peFix.Timestamp = uint32(ts)
+	}
+
+	slog.Info("patching wine files", "graphics_driver", drivers.Registry()["Graphics"], "profile_patches", len(profile.Patches))
+	if err := applyPatches(*Prefix, slices.Concat([]PatchRule{{
+		// this is the only way other than recompiling to get it to use nulldrv
+		// (or the selected driver) during prefix initialization
+		Name:     "graphics-driver",
+		File:     path.Join("lib/wine", archt("x86_64-windows", "aarch64-windows"), "explorer.exe"),
+		Section:  ".rdata",
+		Encoding: "utf16",
+		Search:   "mac,x11,wayland\x00",
+		Replace:  drivers.Registry()["Graphics"] + "\x00",
+		Pad:      true,
+	}}, profile.Patches), peFix, func(name string, r PatchRule) {
+		slog.Debug("patched", "name", name, "rule", r.Name)
+		provModified(name, "patch-"+r.Name)
+	}); err != nil {
+		return err
+	}
+
+	slog.Info("applying driver policy")
+	if err := filepath.WalkDir(filepath.Join(*Prefix, "lib/wine"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if keep, ok := drivers.Keeps(d.Name()); !ok || keep {
+			return nil
 		}
-		copy(buf[:i], u8to16[string, []byte]("null\x00"))
-		return buf, nil
+		slog.Debug("removing driver", "name", d.Name())
+		return provRemove(path, "driver-policy", "")
 	}); err != nil {
 		return err
 	}
@@ -128,7 +472,7 @@ func run() error {
 				return nil
 			}
 			slog.Debug("delete", "path", path)
-			return os.Remove(path)
+			return provRemove(path, "non-essential-executables", "")
 		}); err != nil {
 			return err
 		}
@@ -162,7 +506,7 @@ func run() error {
 		if filepath.Ext(path) != ".a" {
 			return nil
 		}
-		return os.Remove(path)
+		return provRemove(path, "static-libs", "")
 	}); err != nil {
 		return err
 	}
@@ -178,8 +522,11 @@ func run() error {
 		if filepath.Ext(path) != ".ax" {
 			return nil
 		}
+		if profile.Keeps(d.Name()) {
+			return nil
+		}
 		slog.Debug("delete", "path", path)
-		return os.Remove(path)
+		return provRemove(path, "directshow-filters", "")
 	}); err != nil {
 		return err
 	}
@@ -195,13 +542,40 @@ func run() error {
 		if filepath.Ext(path) != ".cpl" {
 			return nil
 		}
+		if profile.Keeps(d.Name()) {
+			return nil
+		}
 		slog.Debug("delete", "path", path)
-		return os.Remove(path)
+		return provRemove(path, "control-panel-items", "")
 	}); err != nil {
 		return err
 	}
 
-	slog.Info("removing wine-mono and wine-gecko stubs")
+	slog.Info("checking wine-mono and wine-gecko")
+	// 	- the stubs only work with the addon installed (otherwise they prompt to download it)
+	var addonStubs []string
+	for _, addon := range []struct {
+		Name   string
+		Dir    string
+		Stub   string
+		Effect string
+	}{
+		{"wine-mono", "share/wine/mono", "mscoree.", ".net applications will not run"},
+		{"wine-gecko", "share/wine/gecko", "mshtml.", "html rendering will not work"},
+	} {
+		if _, err := os.Stat(filepath.Join(*Prefix, addon.Dir)); err == nil {
+			slog.Debug("found addon", "name", addon.Name)
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := degrade(addon.Name, "not found in "+addon.Dir, addon.Effect); err != nil {
+			return err
+		}
+		addonStubs = append(addonStubs, addon.Stub)
+	}
+
+	slog.Info("removing stubs for missing wine-mono and wine-gecko")
 	if err := filepath.WalkDir(filepath.Join(*Prefix, "lib/wine"), func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -209,11 +583,13 @@ func run() error {
 		if d.IsDir() {
 			return nil
 		}
-		if !strings.HasPrefix(d.Name(), "mscoree.") && !strings.HasPrefix(d.Name(), "mshtml.") {
+		if !slices.ContainsFunc(addonStubs, func(x string) bool {
+			return strings.HasPrefix(d.Name(), x)
+		}) {
 			return nil
 		}
 		slog.Debug("delete", "path", path)
-		return os.Remove(path)
+		return provRemove(path, "missing-addon-stubs", "")
 	}); err != nil {
 		return err
 	}
@@ -230,12 +606,53 @@ func run() error {
 			return nil
 		}
 		slog.Debug("delete", "path", path)
-		return os.Remove(path)
+		return provRemove(path, "winemenubuilder", "")
 	}); err != nil {
 		return err
 	}
 
 	if *Optimize {
+		slog.Info("removing desktop-only data")
+		// 	- cursors, sound schemes, themes, and icons are useless without a display or audio driver
+		for _, name := range []string{
+			"share/icons",
+			"share/pixmaps",
+			"share/sounds",
+			"share/themes",
+		} {
+			path := filepath.Join(*Prefix, name)
+			slog.Debug("delete", "path", path)
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+		for _, dir := range []string{"share/wine", "lib/wine"} {
+			if err := filepath.WalkDir(filepath.Join(*Prefix, dir), func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return nil
+				}
+				switch strings.ToLower(filepath.Ext(path)) {
+				case ".msstyles":
+				case ".theme":
+				case ".cur":
+				case ".ani":
+				case ".wav":
+				default:
+					return nil
+				}
+				if profile.Keeps(d.Name()) {
+					return nil
+				}
+				slog.Debug("delete", "path", path)
+				return provRemove(path, "desktop-only-data", "")
+			}); err != nil {
+				return err
+			}
+		}
+
 		slog.Info("removing unnecessary drivers")
 		if err := filepath.WalkDir(filepath.Join(*Prefix, "lib/wine"), func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
@@ -250,6 +667,12 @@ func run() error {
 			default:
 				return nil
 			}
+			if profile.Keeps(d.Name()) {
+				return nil
+			}
+			if _, ok := drivers.Keeps(d.Name()); ok {
+				return nil // handled by the driver policy
+			}
 			switch filepath.Base(path) {
 			default:
 				return fmt.Errorf("TODO: is the driver %s needed?", path)
@@ -269,22 +692,18 @@ func run() error {
 			case "mouhid.sys":
 			case "winehid.sys":
 			case "hidparse.sys":
-			case "winepulse.drv":
 			case "wineusb.sys":
 			case "wineps.drv":
 			case "scsiport.sys":
 			case "fltmgr.sys":
-			case "winealsa.drv":
 			case "winexinput.sys":
-			case "winex11.drv":
 			case "hidclass.sys":
 			case "winebth.sys":
 			case "wmilib.sys":
 			case "netio.sys":
-			case "winewayland.drv":
 			}
 			slog.Debug("removing driver", "name", filepath.Base(path))
-			return os.Remove(path)
+			return provRemove(path, "unnecessary-drivers", "")
 		}); err != nil {
 			return err
 		}
@@ -299,117 +718,128 @@ func run() error {
 			return err
 		}
 
-		slog.Info("removing unnecessary libs")
-		if err := filepath.WalkDir(filepath.Join(*Prefix, "lib/wine"), func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
+		if *Closure {
+			slog.Info("removing modules unreachable from the profile roots")
+			if err := pruneClosure(profile); err != nil {
 				return err
 			}
-			if d.IsDir() {
-				return nil
-			}
-			if !slices.ContainsFunc([]string{
-				// d3d/d2d/ddraw/dmusic/opengl/opencl/vulkan stuff (it's big,
-				// and it's definitely completely useless without the
-				// non-nulldrv graphics drivers anyways)
-				"d3d",
-				"d2d",
-				"dxgi",
-				"ddraw",
-				"dmusic",
-				"dplay",
-				"qedit",
-				"winevulkan",
-				"wined3d",
-				"opencl",
-				"opengl",
-				"vulkan",
-
-				// xaudio/xactengine/xapofx/x3daudio
-				"xaudio",
-				"xactengine",
-				"xapofx",
-				"x3daudio",
-
-				// wow64
-				"wow64",
-
-				// some more interactive stuff
-				"comdlg32.",
-				"riched20.",
-				"ieframe.",
-				"ieproxy.",
-				"browseui.",
-				"scrrun.",
-				"cryptdlg.",
-				"rasdlg.",
-				"scarddlg.",
-				"hhctrl.",
-				"dhtmled.",
-				"regedit.",
-				"mshta.",
-
-				// print/scan/telephony/smartcard/media/speech/webcam stuff
-				"tapi32.",
-				"sane.",
-				"twain_32.",
-				"gphoto2.",
-				"wiaservc.",
-				"sapi.",
-				"twinapi.",
-				"winprint.",
-				"localspl.",
-				"winscard.",
-				"ctapi32.",
-				"winegstreamer.",
-				"wmphoto.",
-				"msttsengine.",
-				"qcap.",
-				"wmp.",
-				"windows.gaming.input.",
-				"windows.media.speech.",
-				"mfmediaengine.",
-				"mfreadwrite.",
-
-				// misc
-				"msi.",
-				"wscript.",
-				"cscript.",
-				"jscript.",
-				"vbscript.",
-				"dwrite.",
-				"gdiplus.",
-				"winhlp32.",
-				"oledb32.",
-				"odbc32.",
-				"l3codeca.",
-				"wpcap.",
-			}, func(x string) bool {
-				return strings.HasPrefix(d.Name(), x)
-			}) {
-				return nil
+		} else {
+			slog.Info("removing unnecessary libs")
+			if err := filepath.WalkDir(filepath.Join(*Prefix, "lib/wine"), func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return nil
+				}
+				if profile.Keeps(d.Name()) {
+					return nil
+				}
+				if !profile.Removes(d.Name()) && !slices.ContainsFunc([]string{
+					// d3d/d2d/ddraw/dmusic/opengl/opencl/vulkan stuff (it's big,
+					// and it's definitely completely useless without the
+					// non-nulldrv graphics drivers anyways)
+					"d3d",
+					"d2d",
+					"dxgi",
+					"ddraw",
+					"dmusic",
+					"dplay",
+					"qedit",
+					"winevulkan",
+					"wined3d",
+					"opencl",
+					"opengl",
+					"vulkan",
+
+					// xaudio/xactengine/xapofx/x3daudio
+					"xaudio",
+					"xactengine",
+					"xapofx",
+					"x3daudio",
+
+					// wow64
+					"wow64",
+
+					// some more interactive stuff
+					"comdlg32.",
+					"riched20.",
+					"ieframe.",
+					"ieproxy.",
+					"browseui.",
+					"scrrun.",
+					"cryptdlg.",
+					"rasdlg.",
+					"scarddlg.",
+					"hhctrl.",
+					"dhtmled.",
+					"regedit.",
+					"mshta.",
+
+					// print/scan/telephony/smartcard/media/speech/webcam stuff
+					"tapi32.",
+					"sane.",
+					"twain_32.",
+					"gphoto2.",
+					"wiaservc.",
+					"sapi.",
+					"twinapi.",
+					"winprint.",
+					"localspl.",
+					"winscard.",
+					"ctapi32.",
+					"winegstreamer.",
+					"wmphoto.",
+					"msttsengine.",
+					"qcap.",
+					"wmp.",
+					"windows.gaming.input.",
+					"windows.media.speech.",
+					"mfmediaengine.",
+					"mfreadwrite.",
+
+					// misc
+					"msi.",
+					"wscript.",
+					"cscript.",
+					"jscript.",
+					"vbscript.",
+					"dwrite.",
+					"gdiplus.",
+					"winhlp32.",
+					"oledb32.",
+					"odbc32.",
+					"l3codeca.",
+					"wpcap.",
+				}, func(x string) bool {
+					return strings.HasPrefix(d.Name(), x)
+				}) {
+					return nil
+				}
+				slog.Debug("removing", "name", d.Name())
+				if profile.Removes(d.Name()) {
+					return provRemove(path, "profile-remove", "")
+				}
+				return provRemove(path, "unnecessary-libs", "")
+			}); err != nil {
+				return err
 			}
-			slog.Debug("removing", "name", d.Name())
-			return os.Remove(path)
-		}); err != nil {
-			return err
 		}
 
 		if arm64 {
-			slog.Info("removing 32-bit arm support")
-			for _, name := range []string{
-				"lib/libqemu-arm.so",
-				"lib/libqemu-i386.so",
-				"lib/libqemu-x86_64.so",
-				"lib/wine/aarch64-unix/wowarmhw.so",
-				"lib/wine/aarch64-unix/wowarmhw.so",
-				"lib/wine/aarch64-windows/lib/wowarmhw.dll",
-				"lib/wine/aarch64-windows/lib/wowarmhw.dll",
-			} {
-				path := filepath.Join(*Prefix, name)
-				slog.Debug("delete", "path", path)
-				if err := os.RemoveAll(path); err != nil {
+			slog.Info("removing unused emulation backends", "emulator", *Emulator)
+			remove := emulationRemoves(*Emulator)
+			if err := filepath.WalkDir(filepath.Join(*Prefix, "lib"), func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
 					return err
 				}
+				if d.IsDir() || !matchAny(remove, d.Name()) || profile.Keeps(d.Name()) {
+					return nil
+				}
+				slog.Debug("delete", "path", path)
+				return provRemove(path, "emulation-backends", "")
+			}); err != nil {
+				return err
 			}
 		} else {
 			slog.Info("removing 32-bit support")
@@ -424,7 +854,61 @@ func run() error {
 			}
 		}
 
-		slog.Info("removing dlls/exes which depend on removed stuff")
+		if *HeadlessStubs {
+			slog.Info("generating headless graphics stubs")
+			// 	- some code (including the northstar launcher) probes for d3d11/dxgi and crashes if they're missing
+			dir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
+			for _, name := range slices.Sorted(maps.Keys(headlessStubs)) {
+				path := filepath.Join(dir, name)
+				if _, err := os.Stat(path); err == nil {
+					slog.Debug("not stubbing kept dll", "name", name)
+					continue
+				} else if !errors.Is(err, fs.ErrNotExist) {
+					return err
+				}
+				buf, err := peStubResult(archt[uint16](pe.IMAGE_FILE_MACHINE_AMD64, pe.IMAGE_FILE_MACHINE_ARM64), name, headlessStubs[name], headlessStubResult)
+				if err != nil {
+					return fmt.Errorf("generate stub for %q: %w", name, err)
+				}
+				if err := os.WriteFile(path, buf, 0644); err != nil {
+					return err
+				}
+				provGenerated(path, "headless-stubs")
+
+				// prefer a native dll (e.g., one shipped with the game) if
+				// there is one, but fall back to the stub
+				key := dllOverridesKey
+				if profile.Registry[key] == nil {
+					profile.Registry[key] = map[string]any{}
+				}
+				if _, ok := profile.Registry[key][strings.TrimSuffix(name, ".dll")]; !ok {
+					profile.Registry[key][strings.TrimSuffix(name, ".dll")] = "native,builtin"
+				}
+			}
+		}
+
+		slog.Info("removing pe modules whose unix lib was removed")
+		{
+			peDirs, err := filepath.Glob(filepath.Join(*Prefix, "lib/wine/*-windows"))
+			if err != nil {
+				return err
+			}
+			_, missing, err := unixLibPairs(filepath.Join(*Prefix, "lib/wine", archt("x86_64-unix", "aarch64-unix")), peDirs...)
+			if err != nil {
+				return fmt.Errorf("check unix lib pairs: %w", err)
+			}
+			for _, name := range missing {
+				if profile.Keeps(filepath.Base(name)) {
+					return fmt.Errorf("kept file %q is missing its unix lib %q", filepath.Base(name), peUnixLib(filepath.Base(name)))
+				}
+				slog.Debug("removing", "name", filepath.Base(name))
+				if err := provRemove(name, "missing-unix-lib", "unix lib "+peUnixLib(filepath.Base(name))+" was removed"); err != nil {
+					return err
+				}
+			}
+		}
+
+		slog.Info("removing (or stubbing) modules which depend on removed stuff")
 		if err := func() error {
 			dir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
 
@@ -438,156 +922,1043 @@ func run() error {
 				uncase[strings.ToLower(di.Name())] = di.Name()
 			}
 
-			dlldeps := map[string][]string{}
-			for _, di := range dis {
-				if di.IsDir() {
-					continue
-				}
-				switch filepath.Ext(di.Name()) {
-				case ".dll":
-				case ".exe":
-				default:
-					continue
+			// apiset imports are resolved by the loader using the schema, so
+			// they don't need a forwarder dll
+			schema, err := loadApisetSchema(dir)
+			if err != nil {
+				slog.Warn("not resolving apiset imports", "error", err)
+			}
+
+			// scanning the imports is the slow part, so do it in parallel
+			type scan struct {
+				name string // lowercased
+				deps []string
+				fwds []string
+				imps map[string][]string
+			}
+			scans, err := parallelMap(dis, func(di fs.DirEntry) (*scan, error) {
+				if di.IsDir() || !peModule(di.Name()) {
+					return nil, nil
 				}
 				if di.Name() == "explorer.exe" {
-					continue // this one is special
+					return nil, nil // this one is special
 				}
+				sc := &scan{name: strings.ToLower(di.Name())}
+
 				deps, err := peImports(filepath.Join(dir, di.Name()))
 				if err != nil {
-					return fmt.Errorf("get deps for %q: %w", di.Name(), err)
+					return nil, fmt.Errorf("get deps for %q: %w", di.Name(), err)
 				}
+				deps = schema.ResolveImports(deps)
 				for i, dep := range deps {
 					deps[i] = strings.ToLower(dep)
 				}
-				dlldeps[strings.ToLower(di.Name())] = deps
+				sc.deps = deps
 				//fmt.Println(di.Name(), deps)
+
+				// the import check doesn't catch exports forwarded to a
+				// removed dll, which only fail when they're resolved
+				fwds, err := peForwarders(filepath.Join(dir, di.Name()))
+				if err != nil {
+					return nil, fmt.Errorf("get export forwarders for %q: %w", di.Name(), err)
+				}
+				for _, lib := range schema.ResolveImports(slices.Sorted(maps.Keys(fwds))) {
+					if lib = strings.ToLower(lib); lib != sc.name {
+						sc.fwds = append(sc.fwds, lib)
+					}
+				}
+
+				if len(profile.Stub) != 0 {
+					imps, err := peStubImports(filepath.Join(dir, di.Name()))
+					if err != nil {
+						return nil, fmt.Errorf("get imports for %q: %w", di.Name(), err)
+					}
+					for lib, syms := range imps {
+						if hosts := schema.ResolveImports([]string{lib}); hosts[0] != lib {
+							delete(imps, lib)
+							for _, host := range hosts {
+								imps[host] = append(imps[host], syms...)
+							}
+						}
+					}
+					for lib, syms := range fwds {
+						for _, sym := range syms {
+							if !slices.Contains(imps[lib], sym) {
+								imps[lib] = append(imps[lib], sym)
+							}
+						}
+					}
+					sc.imps = imps
+				}
+				return sc, nil
+			})
+			if err != nil {
+				return err
+			}
+
+			dlldeps := map[string][]string{}
+			dllfwds := map[string][]string{}
+			dllimps := map[string]map[string][]string{}
+			for _, sc := range scans {
+				if sc == nil {
+					continue
+				}
+				dlldeps[sc.name] = sc.deps
+				if sc.fwds != nil {
+					dllfwds[sc.name] = sc.fwds
+				}
+				if sc.imps != nil {
+					dllimps[sc.name] = sc.imps
+				}
 			}
 
+			stubs := map[string]bool{}
+
 			var it int
 			for {
 				remove := map[string][]string{}
+				removeFwd := map[string][]string{}
 				for _, name := range slices.Sorted(maps.Keys(dlldeps)) { // sorted so it's deterministic if there are errors
 					for _, dep := range dlldeps[name] {
-						if _, ok := dlldeps[dep]; !ok {
-							remove[name] = append(remove[name], dep)
+						if _, ok := dlldeps[dep]; ok {
+							continue
+						}
+						if profile.Stubs(dep) {
+							stubs[dep] = true
+							continue
+						}
+						remove[name] = append(remove[name], dep)
+					}
+					for _, dep := range dllfwds[name] {
+						if _, ok := dlldeps[dep]; ok {
+							continue
 						}
+						if profile.Stubs(dep) {
+							stubs[dep] = true
+							continue
+						}
+						removeFwd[name] = append(removeFwd[name], dep)
 					}
 				}
-				if len(remove) == 0 {
+				if len(remove) == 0 && len(removeFwd) == 0 {
 					break
 				}
-				for name, deps := range remove {
-					slog.Debug("removing", "iteration", it, "name", name, "broken_deps", deps)
-					if err := os.Remove(filepath.Join(dir, uncase[name])); err != nil {
+				for _, name := range slices.Sorted(maps.Keys(remove)) {
+					if profile.Keeps(name) {
+						return fmt.Errorf("kept file %q depends on removed files %q", name, remove[name])
+					}
+				}
+				for _, name := range slices.Sorted(maps.Keys(removeFwd)) {
+					if profile.Keeps(name) {
+						return fmt.Errorf("kept file %q forwards exports to removed files %q", name, removeFwd[name])
+					}
+				}
+				for _, name := range slices.Sorted(maps.Keys(dlldeps)) {
+					if remove[name] == nil && removeFwd[name] == nil {
+						continue
+					}
+					slog.Debug("removing", "iteration", it, "name", name, "broken_deps", remove[name], "broken_forwarders", removeFwd[name])
+					var detail []string
+					if len(remove[name]) != 0 {
+						detail = append(detail, "imports "+strings.Join(remove[name], ", "))
+					}
+					if len(removeFwd[name]) != 0 {
+						detail = append(detail, "forwards exports to "+strings.Join(removeFwd[name], ", "))
+					}
+					if err := provRemove(filepath.Join(dir, uncase[name]), "removed-dependencies", strings.Join(detail, "; "), slices.Concat(remove[name], removeFwd[name])...); err != nil {
 						return err
 					}
 					delete(dlldeps, name)
 				}
 				it++
 			}
+
+			for _, dep := range slices.Sorted(maps.Keys(stubs)) {
+				var (
+					exports   []string
+					importers []string
+				)
+				for _, name := range slices.Sorted(maps.Keys(dlldeps)) {
+					if slices.Contains(dlldeps[name], dep) || slices.Contains(dllfwds[name], dep) {
+						importers = append(importers, name)
+						for _, fn := range dllimps[name][dep] {
+							if !slices.Contains(exports, fn) {
+								exports = append(exports, fn)
+							}
+						}
+					}
+				}
+				if len(importers) == 0 {
+					continue
+				}
+				slog.Debug("generating stub", "name", dep, "importers", importers, "exports", exports)
+				buf, err := peStub(archt[uint16](pe.IMAGE_FILE_MACHINE_AMD64, pe.IMAGE_FILE_MACHINE_ARM64), dep, exports)
+				if err != nil {
+					return fmt.Errorf("generate stub for %q: %w", dep, err)
+				}
+				name := filepath.Join(dir, cmp.Or(uncase[dep], dep))
+				if err := os.WriteFile(name, buf, 0644); err != nil {
+					return err
+				}
+				provGenerated(name, "stub-removed-deps")
+			}
 			return nil
 		}(); err != nil {
 			return err
 		}
-	}
+
+		if *Closure {
+			// only with -closure, since otherwise we don't know what the game imports
+			slog.Info("removing unused apiset forwarders")
+			if err := pruneApisets(profile); err != nil {
+				return err
+			}
+		}
+	}
+
+	slog.Info("removing unix libs whose pe module was removed")
+	{
+		peDirs, err := filepath.Glob(filepath.Join(*Prefix, "lib/wine/*-windows"))
+		if err != nil {
+			return err
+		}
+		orphans, missing, err := unixLibPairs(filepath.Join(*Prefix, "lib/wine", archt("x86_64-unix", "aarch64-unix")), peDirs...)
+		if err != nil {
+			return fmt.Errorf("check unix lib pairs: %w", err)
+		}
+		for _, name := range orphans {
+			slog.Debug("removing", "name", filepath.Base(name))
+			if err := provRemove(name, "orphaned-unix-lib", "no pe module loads it"); err != nil {
+				return err
+			}
+		}
+		for _, name := range missing {
+			// these are only removed with -optimize, since their importers
+			// need to be too
+			slog.Warn("pe module is missing its unix lib, and will fail to load", "name", filepath.Base(name), "unix_lib", peUnixLib(filepath.Base(name)))
+		}
+	}
+
+	if len(profile.PreferNative) != 0 || len(profile.PreferBuiltin) != 0 {
+		slog.Info("setting default load order")
+		if err := applyLoadOrder(*Prefix, profile, peFix, func(name string, native bool) {
+			slog.Debug("set load order", "name", name, "prefer_native", native)
+			provModified(name, "load-order")
+		}); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("classifying services")
+	var svcs []*infService
+	{
+		buf, err := os.ReadFile(filepath.Join(*Prefix, "share/wine/wine.inf"))
+		if err != nil {
+			return err
+		}
+		inf, err := parseInf(buf)
+		if err != nil {
+			return fmt.Errorf("wine.inf: %w", err)
+		}
+		dis, err := os.ReadDir(filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows")))
+		if err != nil {
+			return err
+		}
+		have := map[string]bool{}
+		for _, di := range dis {
+			have[strings.ToLower(di.Name())] = true
+		}
+		svcs = infServices(inf)
+		for _, svc := range svcs {
+			switch {
+			case profile.RemovesService(svc.Name, svc.Section):
+				svc.Remove, svc.Reason = true, "profile"
+			case svc.Binary != "" && !have[svc.Binary]:
+				svc.Remove, svc.Reason = true, "missing binary"
+			}
+			slog.Debug("service", "name", svc.Name, "section", svc.Section, "binary", svc.Binary, "remove", svc.Remove, "reason", svc.Reason)
+		}
+	}
 
 	slog.Info("patching wine.inf")
 	// 	- mostly so wineboot doesn't complain as much or error out
 	// 	- a little bit of extra tidying
+	// 	- sections which are no longer referenced are removed afterwards
+	// 	- the result is checked for new dangling references and missing files
+	infHas := map[string]bool{}
+	for _, dir := range []string{"share/wine", filepath.Join("lib/wine", archt("x86_64-windows", "aarch64-windows"))} {
+		if err := filepath.WalkDir(filepath.Join(*Prefix, dir), func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				infHas[strings.ToLower(d.Name())] = true
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+	}
 	if err := transform(filepath.Join(*Prefix, "share/wine/wine.inf"),
-		trdiff(infilt(func(emit func(section string, line string), inf iter.Seq2[string, string]) error {
-			services := "BITS|EventLog|HTTP|MSI|NDIS|NsiProxy|RpcSs|ScardSvr|Spooler|Winmgmt|Sti|PlugPlay|WPFFontCache|LanmanServer|FontCache|TaskScheduler|wuau|Terminal"
-			for section, line := range inf {
-				{
-					var keep bool
-					switch {
-					case strings.HasSuffix(section, "Install.NT"):
-					case strings.HasSuffix(section, "Install.NT.Services"):
-					case (!arm64 || *Optimize) && strings.HasSuffix(section, "Install.ntarm"):
-					case (!arm64 || *Optimize) && strings.HasSuffix(section, "Install.ntarm.Services"):
-					case !arm64 && strings.HasSuffix(section, "Install.ntarm64"):
-					case !arm64 && strings.HasSuffix(section, "Install.ntarm64.Services"):
-					case *Optimize && strings.Contains(section, "CurrentVersionWow64"):
-					case *Optimize && strings.Contains(section, "Wow64Install"):
-					case *Optimize && strings.Contains(section, "FakeDllsWin32"):
-					case *Optimize && strings.Contains(section, "FakeDllsWow64"):
-					case regex(`^(` + services + `)(Services?|ServiceKeys)$`).MatchString(section):
-					default:
-						keep = true
-					}
-					if !keep {
-						continue // ignore entire section
-					}
+		trdiff(func(buf []byte) ([]byte, error) {
+			inf, err := parseInf(buf)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range slices.Clone(inf.Sections) {
+				switch name := s.Name; {
+				case strings.HasSuffix(name, "Install.NT"):
+				case strings.HasSuffix(name, "Install.NT.Services"):
+				case (!arm64 || *Optimize) && strings.HasSuffix(name, "Install.ntarm"):
+				case (!arm64 || *Optimize) && strings.HasSuffix(name, "Install.ntarm.Services"):
+				case !arm64 && strings.HasSuffix(name, "Install.ntarm64"):
+				case !arm64 && strings.HasSuffix(name, "Install.ntarm64.Services"):
+				case *Optimize && strings.Contains(name, "CurrentVersionWow64"):
+				case *Optimize && strings.Contains(name, "Wow64Install"):
+				case *Optimize && strings.Contains(name, "FakeDllsWin32"):
+				case *Optimize && strings.Contains(name, "FakeDllsWow64"):
+				case *Optimize && name == "Tapi": // telephony
+				case *Optimize && name == "DirectX":
+				default:
+					continue
 				}
-				if line != "" {
-					var keep bool
-					switch {
-					default:
-						keep = true
-					case strings.Contains(line, "winemenubuilder"):
-					case *Optimize && section == "Tapi": // telephony
-					case *Optimize && section == "DirectX":
-					case *Optimize && regex(`CurrentVersionWow64.[^.]+,`).MatchString(line):
-					case regex(`(^|[^a-z])wineps\.drv`).MatchString(line):
-					case regex(`(^|[^a-z])(sane|gphoto2)\.ds`).MatchString(line):
-					case regex(`(^|[^a-z])(input|winebus|winebth|winehid|mouhid|wineusb|winexinput)\.inf`).MatchString(line):
-					case regex(`(^|[^a-z])(oledb32|msdaps|msdasql|msado15|winprint|sapi)\.dll`).MatchString(line):
-					case regex(`(^|[^a-z])(wmplayer|wordpad|iexplore)\.exe`).MatchString(line):
-					case regex(`^system\.ini,\s*(mci|drivers32|mail)`).MatchString(line):
-					case regex(`^AddService=.+,(` + services + `)(Services?)$`).MatchString(section):
-					}
-					if !keep {
-						continue // ignore section contents
-					}
+				inf.RemoveSection(s.Name)
+			}
+			for _, svc := range svcs {
+				if svc.Remove {
+					inf.RemoveService(svc.Name)
 				}
-				emit(section, line)
 			}
-			return nil
-		})),
+			files := []string{
+				"winemenubuilder.exe",
+				"wineps.drv",
+				"sane.ds", "gphoto2.ds",
+				"input.inf", "winebus.inf", "winebth.inf", "winehid.inf", "mouhid.inf", "wineusb.inf", "winexinput.inf",
+				"oledb32.dll", "msdaps.dll", "msdasql.dll", "msado15.dll", "winprint.dll", "sapi.dll",
+				"wmplayer.exe", "wordpad.exe", "iexplore.exe",
+			}
+			files = append(files, drivers.Removed()...)
+			if *Optimize {
+				files = append(files, "*.msstyles", "*.theme", "*.cur", "*.ani", "*.wav") // desktop-only data
+			}
+			inf.RemoveLines(func(s *infSection, l *infLine) bool {
+				if strings.EqualFold(s.Name, "Strings") {
+					return false // pruned afterwards if unused
+				}
+				l = inf.Expanded(l)
+				switch {
+				case slices.ContainsFunc(l.Files(), func(name string) bool {
+					return matchAny(files, name)
+				}):
+					return true
+				case l.Key == "" && len(l.Values) > 1 && strings.EqualFold(l.Values[0], "system.ini") && slices.Contains([]string{"mci", "drivers32", "mail"}, strings.ToLower(l.Values[1])):
+					return true
+				case *Optimize && l.Key != "" && profile.RemovesDirective(l.Key):
+					return true
+				case *Optimize:
+					key, ok := infRegKeyOf(l.Values)
+					return ok && (profile.RemovesRegistry(key) || regex(`(?i)(ThemeManager|AppEvents\\Schemes|Control Panel\\Cursors)`).MatchString(key))
+				}
+				return false
+			})
+			for _, name := range inf.Cleanup() {
+				slog.Debug("removed unreferenced wine.inf section", "name", name)
+			}
+			for _, name := range infOverlays {
+				buf, err := os.ReadFile(name)
+				if err != nil {
+					return nil, fmt.Errorf("inf overlay: %w", err)
+				}
+				o, err := parseInf(buf)
+				if err != nil {
+					return nil, fmt.Errorf("inf overlay %q: %w", name, err)
+				}
+				if err := inf.Merge(o); err != nil {
+					return nil, fmt.Errorf("inf overlay %q: %w", name, err)
+				}
+				slog.Info("merged inf overlay", "name", name)
+			}
+			if *InfMinimal {
+				var removed []string
+				inf, removed = inf.Minimal(infInstallRoot)
+				for _, name := range removed {
+					slog.Debug("removed wine.inf section not reachable from the install sections", "name", name)
+				}
+				slog.Info("minimized wine.inf", "sections", len(inf.Sections)-1, "removed", len(removed))
+			}
+			for _, key := range inf.PruneStrings() {
+				slog.Debug("removed unused wine.inf string", "key", key)
+			}
+			out := inf.Bytes()
+			if err := validateInfFilter(buf, out, func(name string) bool {
+				return infHas[name]
+			}); err != nil {
+				return nil, fmt.Errorf("wine.inf: %w", err)
+			}
+			return out, nil
+		}),
 	); err != nil {
 		return err
 	}
+	provModified(filepath.Join(*Prefix, "share/wine/wine.inf"), "patch-wine-inf")
+
+	if codepages != nil {
+		slog.Info("removing unused codepages")
+		dis, err := os.ReadDir(filepath.Join(*Prefix, "share/wine/nls"))
+		if err != nil {
+			return err
+		}
+		for _, di := range dis {
+			if cp, ok := nlsCodepage(di.Name()); ok && !slices.Contains(codepages, cp) {
+				slog.Debug("removing", "name", di.Name())
+				if err := provRemove(filepath.Join(*Prefix, "share/wine/nls", di.Name()), "codepages", ""); err != nil {
+					return err
+				}
+			}
+		}
+	}
 
 	wineEnv := append(os.Environ(), "WINEPREFIX="+*Output, "WINEARCH=win64", "USER=nswrap")
 
 	slog.Info("creating wineprefix")
+	// TODO: fix failure only on -optimize amd64
+	// something to do with https://github.com/wine-mirror/wine/blob/22af42ac22279e6c0c671f033661f95c1761b4bb/dlls/ntdll/unix/env.c#L1952-L1964
+	// there's an i386 binary somewhere getting called by wine.inf, causing wine to try and use the wow64 loader, which we deleted earlier
+	bootErrs, err := wineboot(wineEnv, *Output)
+	if err != nil {
+		return err
+	}
+	bootReg, _, err := readRegistrySet(*Output)
+	if err != nil {
+		return err
+	}
+
+	if *Locale != "" || *Timezone != "" {
+		slog.Info("setting locale and timezone", "locale", *Locale, "timezone", *Timezone)
+		// 	- wineboot derives them from the build host's environment, which pollutes reproducible builds
+		if err := wineserverWait(wineEnv); err != nil {
+			return err
+		}
+		if err := editRegHives(*Output, func(hives map[string]*regFile) error {
+			edits := localeEdit
+			if *Timezone != "" {
+				tz, posix, err := timezoneEdits(hives["system.reg"], *Timezone)
+				if err != nil {
+					return err
+				}
+				tzPosix = posix
+				edits = append(edits, tz...)
+			}
+			return applyRegEdits(hives, edits)
+		}); err != nil {
+			return fmt.Errorf("set locale and timezone: %w", err)
+		}
+		for _, hive := range []string{"system.reg", "user.reg"} {
+			provGenerated(filepath.Join(*Output, hive), "wineboot")
+			provGenerated(filepath.Join(*Output, hive), "locale")
+		}
+	}
+
+	if codepages != nil {
+		slog.Info("checking codepages for the system locale")
+		buf, err := os.ReadFile(filepath.Join(*Output, "system.reg"))
+		if err != nil {
+			return err
+		}
+		reg, err := parseReg(buf)
+		if err != nil {
+			return fmt.Errorf("system.reg: %w", err)
+		}
+		for _, name := range []string{"ACP", "OEMCP", "MACCP"} {
+			v, ok := reg.Value(`System\CurrentControlSet\Control\Nls\CodePage`, name).Str()
+			if !ok {
+				return fmt.Errorf("check codepages: system locale %s not set", name)
+			}
+			cp, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("check codepages: system locale %s: invalid codepage %q", name, v)
+			}
+			if !nlsBuiltinCodepage(cp) && !slices.Contains(codepages, cp) {
+				return fmt.Errorf("check codepages: system locale %s %d was not kept", name, cp)
+			}
+			slog.Debug("system locale codepage", "name", name, "codepage", cp)
+		}
+	}
+
+	slog.Info("removing registry keys for removed services and prune categories")
 	{
-		winedebug := "err-ole,fixme-actctx"
-		if *Debug {
-			winedebug += ",+loaddll"
-			//winedebug += ",+imports"
-			winedebug += ",+module"
+		keys := map[string]string{}
+		for _, svc := range svcs {
+			if svc.Remove {
+				keys[`HKLM\System\CurrentControlSet\Services\`+svc.Name] = "prune-services"
+			}
+		}
+		if *Optimize {
+			for _, key := range profile.PruneRegistryKeys() {
+				keys[key] = "prune-categories"
+			}
+		}
+		hives := map[string]*regFile{}
+		modified := map[string][]string{}
+		for _, key := range slices.Sorted(maps.Keys(keys)) {
+			hive, rel, ok := regHiveKey(key)
+			if !ok {
+				return fmt.Errorf("delete registry key %q: unsupported root", key)
+			}
+			reg, ok := hives[hive]
+			if !ok {
+				buf, err := os.ReadFile(filepath.Join(*Output, hive))
+				if err != nil {
+					return err
+				}
+				if reg, err = parseReg(buf); err != nil {
+					return fmt.Errorf("%s: %w", hive, err)
+				}
+				hives[hive] = reg
+			}
+			if reg.HasKey(rel) {
+				slog.Debug("delete registry key", "key", key)
+				if err := wineReg(wineEnv, "delete", key, "/f"); err != nil {
+					return fmt.Errorf("delete registry key %q: %w", key, err)
+				}
+				if !slices.Contains(modified[hive], keys[key]) {
+					modified[hive] = append(modified[hive], keys[key])
+				}
+			}
+		}
+		if len(modified) != 0 {
+			if err := wineserverWait(wineEnv); err != nil {
+				return err
+			}
+			for hive, steps := range modified {
+				provGenerated(filepath.Join(*Output, hive), "wineboot")
+				for _, step := range steps {
+					provGenerated(filepath.Join(*Output, hive), step)
+				}
+			}
+		}
+	}
+
+	slog.Info("setting machine identity", "computer_name", identity.ComputerName, "machine_guid", identity.MachineGUID, "volume_serial", fmt.Sprintf("%08x", identity.VolumeSerial))
+	// 	- wineboot uses the build host's hostname and a random machine guid, which pollutes reproducible builds and is shared by every instance
+	if err := wineserverWait(wineEnv); err != nil {
+		return err
+	}
+	if err := editRegHives(*Output, func(hives map[string]*regFile) error {
+		return applyRegEdits(hives, identity.RegistryEdits())
+	}); err != nil {
+		return fmt.Errorf("set machine identity: %w", err)
+	}
+	provGenerated(filepath.Join(*Output, "system.reg"), "wineboot")
+	provGenerated(filepath.Join(*Output, "system.reg"), "identity")
+	if err := os.WriteFile(filepath.Join(*Output, "drive_c/.windows-serial"), identity.SerialFile(), 0644); err != nil {
+		return fmt.Errorf("set machine identity: %w", err)
+	}
+	provGenerated(filepath.Join(*Output, "drive_c/.windows-serial"), "identity")
+
+	if len(winverEdit) != 0 {
+		slog.Info("setting windows version", "version", *WinVer)
+		if err := wineserverWait(wineEnv); err != nil {
+			return err
+		}
+		if err := editRegHives(*Output, func(hives map[string]*regFile) error {
+			return applyRegEdits(hives, winverEdit)
+		}); err != nil {
+			return fmt.Errorf("set windows version: %w", err)
+		}
+		for _, hive := range []string{"system.reg", "user.reg"} {
+			provGenerated(filepath.Join(*Output, hive), "wineboot")
+			provGenerated(filepath.Join(*Output, hive), "winver")
+		}
+	}
+
+	if len(profile.Registry) != 0 {
+		slog.Info("setting profile registry values")
+		if err := wineserverWait(wineEnv); err != nil {
+			return err
+		}
+		var (
+			edits []regEdit
+			hives []string
+		)
+		for _, key := range profile.RegistryKeys() {
+			if hive, _, _ := regHiveKey(key); !slices.Contains(hives, hive) {
+				hives = append(hives, hive)
+			}
+			for _, name := range slices.Sorted(maps.Keys(profile.Registry[key])) {
+				value := profile.Registry[key][name]
+				typ, data, err := profileRegValue(value)
+				if err != nil {
+					panic("unreachable") // checked by Profile.validate
+				}
+				if m, ok := value.(map[string]any); ok {
+					value = m["value"]
+				}
+				slog.Debug("set registry value", "key", key, "name", name, "type", typ, "value", value)
+				edits = append(edits, regEdit{Key: key, Value: &regValue{Name: name, Type: profileRegTypes[typ], Data: data}})
+				provRegistry(key, name, typ, value)
+			}
+		}
+		if err := editRegHives(*Output, func(hives map[string]*regFile) error {
+			return applyRegEdits(hives, edits)
+		}); err != nil {
+			return fmt.Errorf("set profile registry values: %w", err)
+		}
+		for _, hive := range hives {
+			provGenerated(filepath.Join(*Output, hive), "wineboot")
+			provGenerated(filepath.Join(*Output, hive), "profile-registry")
+		}
+	}
+
+	if len(profile.PathAppend) != 0 {
+		slog.Info("appending to the system path", "dirs", profile.PathAppend)
+		if err := wineserverWait(wineEnv); err != nil {
+			return err
+		}
+		const key = `System\CurrentControlSet\Control\Session Manager\Environment`
+		if err := editRegHives(*Output, func(hives map[string]*regFile) error {
+			v := hives["system.reg"].Value(key, "PATH")
+			if v == nil {
+				v = &regValue{Name: "PATH"}
+			}
+			path, _ := v.Str()
+			path = envPathAppend(path, profile.PathAppend)
+			hives["system.reg"].SetValue(key, v.Name, regExpandSZ, regStringData(path))
+			provRegistry(`HKLM\`+key, v.Name, "REG_EXPAND_SZ", path)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("append to system path: %w", err)
+		}
+		provGenerated(filepath.Join(*Output, "system.reg"), "wineboot")
+		provGenerated(filepath.Join(*Output, "system.reg"), "path-append")
+	}
+
+	if *Optimize {
+		slog.Info("pruning registry entries for removed files")
+		// 	- wineboot still registers classes, services, etc for some of the dlls we removed
+		// 	- this avoids loader errors when something tries to use them
+		winDir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
+		removed := provRemovedFrom(winDir)
+		for _, hive := range []string{"system.reg", "user.reg"} {
+			var pruned []regPruned
+			if err := transform(filepath.Join(*Output, hive), func(buf []byte) ([]byte, error) {
+				reg, err := parseReg(buf)
+				if err != nil {
+					return nil, err
+				}
+				pruned = pruneRegistry(reg, func(name string) bool {
+					if !removed[name] {
+						return false
+					}
+					_, err := os.Stat(filepath.Join(winDir, name))
+					return errors.Is(err, fs.ErrNotExist)
+				})
+				return reg.Bytes(), nil
+			}); err != nil {
+				return fmt.Errorf("prune %s: %w", hive, err)
+			}
+			for _, p := range pruned {
+				slog.Debug("pruned registry entry", "hive", hive, "key", p.Key, "value", p.Value, "reason", p.Reason)
+			}
+			if len(pruned) != 0 {
+				provGenerated(filepath.Join(*Output, hive), "wineboot")
+				provGenerated(filepath.Join(*Output, hive), "prune-registry")
+			}
+		}
+	}
+
+	if len(regImports) != 0 {
+		slog.Info("importing reg files", "count", len(regImports))
+		if err := editRegHives(*Output, func(hives map[string]*regFile) error {
+			for _, edits := range regImports {
+				if err := applyRegEdits(hives, edits); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("import reg files: %w", err)
+		}
+		for _, hive := range []string{"system.reg", "user.reg"} {
+			provGenerated(filepath.Join(*Output, hive), "wineboot")
+			provGenerated(filepath.Join(*Output, hive), "reg-import")
 		}
-		cmd := exec.Command(filepath.Join(*Prefix, "bin", "wine"), "wineboot", "--init")
-		cmd.Env = append(slices.Clone(wineEnv), "WINEDEBUG="+winedebug)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stdout
-		// TODO: filter out expected err:winediag:nodrv_CreateWindow, err:vulkan:vulkan_init_once, err:win:get_desktop_window
-		if err := cmd.Run(); err != nil {
+	}
+
+	slog.Info("replacing user shell folder links")
+	// 	- wineboot links Desktop, Documents, etc to the build host's home dir, which isn't portable and leaks host paths
+	if replaced, err := neutralizeShellFolders(filepath.Join(*Output, "drive_c/users")); err != nil {
+		return err
+	} else {
+		for _, x := range replaced {
+			slog.Debug("replaced", "path", x)
+		}
+	}
+
+	if *Optimize {
+		slog.Info("removing wineboot cruft from drive_c")
+		removed, err := cleanDriveC(filepath.Join(*Output, "drive_c"), driveCCruft, profile.DriveCKeep)
+		if err != nil {
 			return err
 		}
-		// TODO: fix failure only on -optimize amd64
-		// something to do with https://github.com/wine-mirror/wine/blob/22af42ac22279e6c0c671f033661f95c1761b4bb/dlls/ntdll/unix/env.c#L1952-L1964
-		// there's an i386 binary somewhere getting called by wine.inf, causing wine to try and use the wow64 loader, which we deleted earlier
+		for _, x := range removed {
+			slog.Debug("removed", "path", x)
+		}
+	}
+
+	if len(profile.DriveC) != 0 {
+		slog.Info("customizing drive_c layout")
+		root := filepath.Join(*Output, "drive_c")
+		for _, e := range profile.DriveC {
+			path, err := safeJoin(root, e.Path)
+			if err != nil {
+				return fmt.Errorf("drive_c entry %q: %w", e.Path, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return fmt.Errorf("drive_c entry %q: %w", e.Path, err)
+			}
+			switch {
+			case e.Dir:
+				slog.Debug("create dir", "path", path)
+				err = os.MkdirAll(path, 0755)
+			case e.Link != "":
+				slog.Debug("create symlink", "path", path, "target", e.Link)
+				if err = os.Remove(path); err == nil || errors.Is(err, fs.ErrNotExist) {
+					err = os.Symlink(e.Link, path)
+				}
+			default:
+				slog.Debug("create file", "path", path)
+				err = os.WriteFile(path, []byte(e.Data), 0644)
+			}
+			if err != nil {
+				return fmt.Errorf("drive_c entry %q: %w", e.Path, err)
+			}
+			if !e.Dir {
+				provGenerated(path, "drive-c-layout")
+			}
+		}
+	}
+
+	if len(profile.DosDevices) != 0 {
+		slog.Info("configuring dosdevices")
+		dir := filepath.Join(*Output, "dosdevices")
+		var removed []string
+		for _, drive := range slices.Sorted(maps.Keys(profile.DosDevices)) {
+			d := profile.DosDevices[drive]
+			path := filepath.Join(dir, drive)
+			// the raw device (e.g., z::) is only meaningful for the original mapping
+			for _, x := range []string{path, path + ":"} {
+				if err := os.Remove(x); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return fmt.Errorf("dosdevices entry %q: %w", drive, err)
+				}
+			}
+			if d.Remove {
+				slog.Debug("remove drive", "drive", drive)
+				removed = append(removed, drive)
+				continue
+			}
+			slog.Debug("map drive", "drive", drive, "target", d.Target, "type", d.Type)
+			if err := os.Symlink(d.Target, path); err != nil {
+				return fmt.Errorf("dosdevices entry %q: %w", drive, err)
+			}
+			provGenerated(path, "dosdevices")
+		}
+		if len(removed) != 0 {
+			// mountmgr only updates MountedDevices for drives it finds, so the stale entry would stay around otherwise
+			if err := wineserverWait(wineEnv); err != nil {
+				return err
+			}
+			var changed bool
+			if err := transform(filepath.Join(*Output, "system.reg"), func(buf []byte) ([]byte, error) {
+				reg, err := parseReg(buf)
+				if err != nil {
+					return nil, err
+				}
+				for _, drive := range removed {
+					if reg.DeleteValue(`System\MountedDevices`, `\DosDevices\`+strings.ToUpper(drive)) {
+						slog.Debug("remove mounted device", "drive", drive)
+						changed = true
+					}
+				}
+				if !changed {
+					return buf, nil
+				}
+				return reg.Bytes(), nil
+			}); err != nil {
+				return fmt.Errorf("dosdevices: %w", err)
+			}
+			if changed {
+				provGenerated(filepath.Join(*Output, "system.reg"), "dosdevices")
+			}
+		}
+	}
+
+	slog.Info("verifying registered services", "mode", *ServiceCheck)
+	// 	- services.exe logs an error for each missing service binary on every start
+	// 	- services can be orphaned by -optimize, prune categories, inf overlays, or reg imports
+	if err := wineserverWait(wineEnv); err != nil {
+		return err
+	}
+	{
+		winDir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
+		exists := func(winPath string) bool {
+			drive, rel, ok := strings.Cut(winPath, `:\`)
+			if !ok || !strings.EqualFold(drive, "c") {
+				return true // other drives are mapped at runtime
+			}
+			if name, ok := serviceBuiltinName(winPath); ok {
+				if _, err := os.Stat(filepath.Join(winDir, name)); err == nil {
+					return true
+				}
+			}
+			return existsFold(filepath.Join(*Output, "drive_c"), strings.ReplaceAll(rel, `\`, "/"))
+		}
+		var broken []brokenService
+		if err := transform(filepath.Join(*Output, "system.reg"), func(buf []byte) ([]byte, error) {
+			reg, err := parseReg(buf)
+			if err != nil {
+				return nil, err
+			}
+			broken = checkServices(reg, exists)
+			for _, b := range broken {
+				slog.Warn("registered service binary does not exist", "service", b.Name, "value", b.Value, "path", b.Binary)
+			}
+			if len(broken) == 0 || *ServiceCheck != "prune" {
+				return buf, nil
+			}
+			for _, b := range broken {
+				reg.DeleteKey(`System\CurrentControlSet\Services\` + b.Name)
+			}
+			return reg.Bytes(), nil
+		}); err != nil {
+			return fmt.Errorf("verify services: %w", err)
+		}
+		switch {
+		case len(broken) == 0:
+		case *ServiceCheck == "fail":
+			return fmt.Errorf("verify services: %d registered services have missing binaries", len(broken))
+		case *ServiceCheck == "prune":
+			provGenerated(filepath.Join(*Output, "system.reg"), "wineboot")
+			provGenerated(filepath.Join(*Output, "system.reg"), "service-check")
+		}
+	}
+
+	slog.Info("writing registry transcript")
+	// 	- so the changes we make directly to the hives (or with reg.exe) can be audited against a stock wineboot result
+	if err := wineserverWait(wineEnv); err != nil {
+		return err
+	}
+	finalReg, _, err := readRegistrySet(*Output)
+	if err != nil {
+		return err
+	}
+	transcript := regDiffEdits(diffRegistry(bootReg, finalReg, true))
+	if err := os.WriteFile(filepath.Join(*Output, RegTranscriptName), formatRegedit(transcript), 0644); err != nil {
+		return err
+	}
+	provGenerated(filepath.Join(*Output, RegTranscriptName), "reg-transcript")
+	slog.Info("wrote registry transcript", "edits", len(transcript))
+
+	if *UserTemplate {
+		slog.Info("writing user registry template")
+		// 	- so per-instance user hives start small and identical instead of copying everything wineboot put in user.reg
+		// 	- everything we set in the user hive is kept
+		keep := slices.Clone(userTemplateKeys)
+		if buf, err := os.ReadFile(filepath.Join(*Prefix, "share/wine/wine.inf")); err != nil {
+			return err
+		} else if inf, err := parseInf(buf); err != nil {
+			return fmt.Errorf("wine.inf: %w", err)
+		} else {
+			keep = append(keep, infUserKeys(inf)...)
+		}
+		for _, e := range transcript {
+			if hive, rel, ok := regHiveKey(e.Key); ok && hive == "user.reg" && (!e.Delete || e.Value != nil) {
+				keep = append(keep, rel)
+			}
+		}
+		var ts int64
+		if peFix.Timestamp != nil {
+			ts = int64(*peFix.Timestamp)
+		}
+		tpl := userTemplate(finalReg["user.reg"], keep, ts)
+		if err := os.WriteFile(filepath.Join(*Output, UserTemplateName), tpl.Bytes(), 0644); err != nil {
+			return err
+		}
+		provGenerated(filepath.Join(*Output, UserTemplateName), "user-template")
+		slog.Info("wrote user registry template", "keys", len(tpl.Keys), "full_keys", len(finalReg["user.reg"].Keys))
 	}
 
 	slog.Info("disabling automatic wineprefix updates")
 	if err := os.WriteFile(filepath.Join(*Output, ".update-timestamp"), []byte("disable\n"), 0644); err != nil {
 		return err
 	}
+	provGenerated(filepath.Join(*Output, ".update-timestamp"), "disable-updates")
 
 	if *Optimize {
 		// TODO: clean up empty dirs
 	}
 
+	if *Components != "" {
+		slog.Info("moving optional components", "dir", *Components)
+		cs, err := moveOptionalComponents(profile, *Components, *ComponentsSource)
+		if err != nil {
+			return fmt.Errorf("move optional components: %w", err)
+		}
+		var size int64
+		for _, c := range cs {
+			slog.Debug("optional component", "name", c.Name, "size", c.Size)
+			size += c.Size
+		}
+		slog.Info("moved optional components", "count", len(cs), "size", size)
+
+		var b bytes.Buffer
+		if err := writeOptionalComponents(&b, cs); err != nil {
+			return fmt.Errorf("write optional component manifest: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(*Output, OptionalComponentsName), b.Bytes(), 0644); err != nil {
+			return fmt.Errorf("write optional component manifest: %w", err)
+		}
+		provGenerated(filepath.Join(*Output, OptionalComponentsName), "optional-components")
+	}
+
+	if *DebugSymbols != "" {
+		slog.Info("splitting debug symbols", "dir", *DebugSymbols)
+		syms, err := splitDebugSymbols(*DebugSymbols)
+		if err != nil {
+			return fmt.Errorf("split debug symbols: %w", err)
+		}
+		slog.Info("split debug symbols", "count", len(syms))
+	}
+
+	if *StripDebugDirs {
+		slog.Info("stripping pe debug directories")
+		var files, entries int
+		if err := stripDebugDirectories(*Prefix, peFix, func(name string, n int) {
+			slog.Debug("stripped debug directory", "name", name, "entries", n)
+			provModified(name, "strip-debug-dirs")
+			files, entries = files+1, entries+n
+		}); err != nil {
+			return fmt.Errorf("strip debug directories: %w", err)
+		}
+		slog.Info("stripped pe debug directories", "files", files, "entries", entries)
+	}
+
+	slog.Info("checking for build host paths in binaries", "normalize", *NormalizeHostPaths)
+	if found, err := scanHostPaths(*Prefix, *NormalizeHostPaths, func(name string, n int) {
+		slog.Debug("normalized build host paths", "name", name, "count", n)
+		provModified(name, "normalize-host-paths")
+	}); err != nil {
+		return err
+	} else {
+		var files, leaks int
+		for _, name := range slices.Sorted(maps.Keys(found)) {
+			leak, system := hostPathSummary(found[name])
+			if len(leak) != 0 {
+				files, leaks = files+1, leaks+len(leak)
+				slog.Debug("binary contains build host paths", "name", name, "build", leak, "system", system)
+			} else {
+				slog.Debug("binary contains system paths", "name", name, "system", system)
+			}
+		}
+		if leaks != 0 && !*NormalizeHostPaths {
+			slog.Warn("binaries contain build host paths (use -normalize-host-paths to remove them)", "files", files, "paths", leaks)
+		}
+	}
+
 	// TODO: replace duplicated files in the prefix with symlinks
 	// TODO: set some registry keys required for nswrap
 
-	// TODO: ensure we have some must-have dlls for northstar
+	slog.Info("verifying profile files")
+	{
+		var missing []string
+		for _, name := range profile.Verify {
+			var path string
+			if rel, ok := strings.CutPrefix(name, "wine/"); ok {
+				path = filepath.Join(*Prefix, rel)
+			} else if rel, ok := strings.CutPrefix(name, "prefix/"); ok {
+				path = filepath.Join(*Output, rel)
+			} else {
+				path = filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"), name)
+			}
+			if _, err := os.Stat(path); err != nil {
+				slog.Error("missing required file", "name", name, "error", err)
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) != 0 {
+			return fmt.Errorf("missing files required by the profile: %q", missing)
+		}
+	}
+
+	slog.Info("verifying imports by ordinal")
+	{
+		dir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
+		schema, err := loadApisetSchema(dir)
+		if err != nil {
+			slog.Warn("not resolving apiset imports", "error", err)
+		}
+		bad, err := unresolvedOrdinals(dir, schema)
+		if err != nil {
+			return err
+		}
+		if len(bad) != 0 {
+			return fmt.Errorf("imports by ordinal which aren't exported: %q", bad)
+		}
+	}
+
+	if len(profile.RootImports) != 0 {
+		slog.Info("checking root imports for wine stubs")
+		dir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
+		schema, err := loadApisetSchema(dir)
+		if err != nil {
+			slog.Warn("not resolving apiset imports", "error", err)
+		}
+		mods, err := wineStubsOf(dir)
+		if err != nil {
+			return fmt.Errorf("find wine stubs: %w", err)
+		}
+		for _, name := range profile.RootImports {
+			imps, err := peImportedSymbols(name)
+			if err != nil {
+				return fmt.Errorf("get root imports from %q: %w", name, err)
+			}
+			// these will raise an exception if they're called, but that's
+			// fine as long as the game doesn't actually use them
+			if stubs := wineStubImports(mods, schema, imps); len(stubs) != 0 {
+				slog.Warn("root imports unimplemented wine stubs", "name", filepath.Base(name), "count", len(stubs), "stubs", stubs)
+			}
+		}
+	}
+
+	if arm64 {
+		slog.Info("verifying arm64ec binaries")
+		if err := emulationCheckBinaries(filepath.Join(*Prefix, "lib/wine/aarch64-windows")); err != nil {
+			return err
+		}
+		if !degraded("emulator") {
+			if missing, err := emulationMissing(*Prefix, *Emulator); err != nil {
+				return err
+			} else if len(missing) != 0 {
+				return fmt.Errorf("missing %s emulation backend files: %q", *Emulator, missing)
+			}
+		}
+	}
 
 	if *Vendor {
-		// TODO: copy non-libc libraries into our lib dir
-		// TODO: ensure we have some libs we know we need
+		slog.Info("checking host libs")
+		var dlopen []string
+		for _, lib := range hostLibs {
+			if path, ok, err := hostLib(lib.Name); err != nil {
+				return err
+			} else if ok {
+				slog.Debug("found host lib", "name", lib.Name, "path", path)
+				dlopen = append(dlopen, lib.Name)
+			} else if err := degrade(lib.Name, "not found on the build host", lib.Effect); err != nil {
+				return err
+			}
+		}
+
+		slog.Info("vendoring host libs")
+		if err := vendorHostLibs(*Prefix, dlopen); err != nil {
+			return err
+		}
 	}
 
 	// TODO: remove this
@@ -600,6 +1971,45 @@ func run() error {
 		return nil
 	})
 
+	if *Verify {
+		slog.Info("verifying wineprefix initialization with a scratch prefix")
+		if err := func() error {
+			dir, err := os.MkdirTemp("", "nswine-verify-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+
+			errs, err := wineboot(wineEnv, filepath.Join(dir, "prefix"))
+			if err != nil {
+				return fmt.Errorf("wineboot failed: %w", err)
+			}
+			var n int
+			for _, e := range errs {
+				if !slices.Contains(bootErrs, e) {
+					slog.Error("new error during scratch prefix initialization", "line", e)
+					n++
+				}
+			}
+			if n != 0 {
+				return fmt.Errorf("%d new errors during scratch prefix initialization", n)
+			}
+			return nil
+		}(); err != nil {
+			return fmt.Errorf("verify wineprefix: %w", err)
+		}
+	}
+
+	slog.Info("writing manifest")
+	if m, err := buildManifest(wineBuildID, svcs); err != nil {
+		return fmt.Errorf("build manifest: %w", err)
+	} else {
+		m.Locale, m.TZ = localeUnix, tzPosix
+		if err := writeManifest(m); err != nil {
+			return fmt.Errorf("write manifest: %w", err)
+		}
+	}
+
 	// TODO: replace this with a go impl
 	if tmp, err := exec.Command("du", "-sh", *Prefix).Output(); err == nil {
 		slog.Info(string(bytes.TrimSpace(tmp)))
@@ -610,3 +2020,191 @@ func run() error {
 
 	return errors.ErrUnsupported
 }
+
+// pruneClosure removes the PE modules and unix libs which aren't reachable
+// from the roots.
+func pruneClosure(profile *Profile) error {
+	winDir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
+
+	pg, err := peGraph(winDir)
+	if err != nil {
+		return err
+	}
+	schema, err := loadApisetSchema(winDir)
+	if err != nil {
+		slog.Warn("not resolving apiset imports", "error", err)
+	}
+	for name, deps := range pg.Deps {
+		pg.Deps[name] = schema.ResolveImports(deps)
+	}
+	var roots []string
+	root := func(name, reason string) {
+		if _, ok := pg.Names[strings.ToLower(name)]; ok {
+			roots = append(roots, name)
+			provRoot(strings.ToLower(name), reason)
+		}
+	}
+	for _, x := range []struct {
+		Globs  []string
+		Reason string
+	}{
+		{profile.Roots, "profile roots"},
+		{profile.Keep, "profile keep"},
+		{profile.VerifyModules(), "profile verify"},
+	} {
+		for _, name := range pg.Match(x.Globs) {
+			root(name, x.Reason)
+		}
+	}
+
+	buf, err := os.ReadFile(filepath.Join(*Prefix, "share/wine/wine.inf"))
+	if err != nil {
+		return err
+	}
+	inf, err := parseInf(buf)
+	if err != nil {
+		return fmt.Errorf("wine.inf: %w", err)
+	}
+	for _, svc := range infServices(inf) {
+		if svc.Binary != "" && !profile.RemovesService(svc.Name, svc.Section) {
+			root(svc.Binary, "service "+svc.Name)
+		}
+	}
+	for _, name := range profile.RootImports {
+		deps, err := peImports(name)
+		if err != nil {
+			return fmt.Errorf("get root imports from %q: %w", name, err)
+		}
+		for _, dep := range schema.ResolveImports(deps) {
+			root(dep, "imported by "+filepath.Base(name))
+		}
+	}
+	slog.Debug("closure roots", "roots", roots)
+
+	reach := pg.Closure(roots)
+	for _, name := range slices.Sorted(maps.Keys(pg.Names)) {
+		if !reach[name] {
+			slog.Debug("removing", "name", pg.Names[name])
+			if err := provRemove(filepath.Join(winDir, pg.Names[name]), "closure", "not reachable from the profile roots"); err != nil {
+				return err
+			}
+		}
+	}
+
+	// only wine's unix libs are pruned, but other libs in the wine dir are
+	// roots so their deps are kept
+	unixRel := path.Join("lib/wine", archt("x86_64-unix", "aarch64-unix"))
+	ut, err := elfTreeOf(*Prefix, unixRel, "lib")
+	if err != nil {
+		return err
+	}
+	unixNames := map[string]bool{"ntdll.so": true}
+	for name := range reach {
+		unixNames[peUnixLib(name)] = true
+	}
+	var uroots []string
+	for _, rel := range slices.Sorted(maps.Keys(ut.Libs)) {
+		name := strings.ToLower(path.Base(rel))
+		if path.Dir(rel) != unixRel || unixNames[name] || matchAny(slices.Concat(profile.Roots, profile.Keep), name) {
+			uroots = append(uroots, rel)
+		}
+	}
+	var ukept, uremoved int
+	ureach := ut.Closure(uroots)
+	for _, rel := range slices.Sorted(maps.Keys(ut.Libs)) {
+		if path.Dir(rel) != unixRel {
+			continue
+		}
+		if ureach[rel] {
+			ukept++
+			continue
+		}
+		slog.Debug("removing", "name", path.Base(rel))
+		if err := provRemove(filepath.Join(*Prefix, filepath.FromSlash(rel)), "closure", "not needed by the remaining pe modules"); err != nil {
+			return err
+		}
+		uremoved++
+	}
+	slog.Info("closure", "roots", len(roots), "kept", len(reach), "removed", len(pg.Names)-len(reach), "unix_kept", ukept, "unix_removed", uremoved)
+	return nil
+}
+
+// pruneApisets removes the apiset forwarder DLLs and apiset schema entries
+// which aren't imported by any remaining module or the profile root imports.
+// Apisets hosted only by profile roots are also kept, since those are the
+// modules native code (e.g., the game's own redistributables) is expected to
+// import, and it may do so using the apiset names.
+func pruneApisets(profile *Profile) error {
+	dir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
+
+	pg, err := peGraph(dir)
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for name, deps := range pg.Deps {
+		if isApiset(name) {
+			continue // forwarders importing other forwarders don't count
+		}
+		for _, dep := range deps {
+			if isApiset(dep) {
+				used[apisetKey(dep)] = true
+			}
+		}
+	}
+
+	for _, name := range profile.RootImports {
+		deps, err := peImports(name)
+		if err != nil {
+			return fmt.Errorf("get root imports from %q: %w", name, err)
+		}
+		for _, dep := range deps {
+			if isApiset(dep) {
+				used[apisetKey(dep)] = true
+			}
+		}
+	}
+
+	schema, err := loadApisetSchema(dir)
+	if err != nil {
+		slog.Warn("not pruning apiset forwarders", "error", err)
+		return nil // we can't tell which ones the roots need
+	}
+	if schema != nil {
+		roots := map[string]bool{}
+		for _, name := range pg.Match(profile.Roots) {
+			roots[name] = true
+		}
+		for _, key := range schema.HostedBy(func(host string) bool { return roots[host] }) {
+			used[key] = true
+		}
+	}
+
+	var n int
+	for _, name := range slices.Sorted(maps.Keys(pg.Names)) {
+		if isApiset(name) && !used[apisetKey(name)] && !profile.Keeps(name) {
+			slog.Debug("removing", "name", pg.Names[name])
+			if err := os.Remove(filepath.Join(dir, pg.Names[name])); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	if schema == nil {
+		slog.Info("removed apiset forwarders", "count", n)
+		return nil
+	}
+
+	name := filepath.Join(dir, "apisetschema.dll")
+	buf, removed := schema.Filter(func(e apisetEntry) bool {
+		return used[e.Key()] || profile.Keeps(e.Name+".dll")
+	})
+	if removed != 0 {
+		if err := os.WriteFile(name, buf, 0644); err != nil {
+			return err
+		}
+		provModified(name, "prune-apisets")
+	}
+	slog.Info("removed apiset forwarders", "count", n, "schema_entries", removed, "schema_kept", len(schema.Entries)-removed)
+	return nil
+}
@@ -0,0 +1,119 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// offlineEnv is set when nswine re-executes itself in a new network
+// namespace for -offline.
+const offlineEnv = "NSWINE_OFFLINE_NETNS"
+
+// ensureOffline makes sure nothing nswine runs can access the network. If
+// there are any non-loopback routes, nswine re-executes itself in a new user
+// and network namespace, returning true if it did so (in which case the
+// caller should exit with the child's result).
+func ensureOffline() (bool, error) {
+	online, err := hasNetwork()
+	if err != nil {
+		return false, fmt.Errorf("check network: %w", err)
+	}
+	if !online {
+		slog.Info("network is not available")
+		return false, nil
+	}
+	if os.Getenv(offlineEnv) != "" {
+		return false, fmt.Errorf("network is still available in the new network namespace")
+	}
+
+	slog.Info("network is available, re-executing in a new network namespace")
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Env = append(os.Environ(), offlineEnv+"=1")
+	if otlpIsURL(*OTLP) {
+		f, err := os.CreateTemp("", "nswine-otlp-*.json")
+		if err != nil {
+			return false, err
+		}
+		f.Close()
+		cmd.Env = append(cmd.Env, otlpSpoolEnv+"="+f.Name())
+		defer func() {
+			if err := otlpForward(*OTLP, f.Name()); err != nil {
+				slog.Warn("failed to export build trace", "endpoint", *OTLP, "error", err)
+			}
+		}()
+	}
+	otlpDiscard() // the child exports its own trace
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{{
+			ContainerID: os.Getuid(),
+			HostID:      os.Getuid(),
+			Size:        1,
+		}},
+		GidMappings: []syscall.SysProcIDMap{{
+			ContainerID: os.Getgid(),
+			HostID:      os.Getgid(),
+			Size:        1,
+		}},
+	}
+	if err := cmd.Run(); err != nil {
+		var xx *exec.ExitError
+		if errors.As(err, &xx) {
+			return true, fmt.Errorf("offline build failed")
+		}
+		return true, fmt.Errorf("create network namespace (build with --network=none instead if user namespaces aren't available): %w", err)
+	}
+	return true, nil
+}
+
+// hasNetwork checks if there are any IPv4 or IPv6 routes via non-loopback
+// interfaces.
+func hasNetwork() (bool, error) {
+	for _, x := range []struct {
+		name  string
+		iface func(fields []string) string
+	}{
+		{"/proc/net/route", func(fields []string) string {
+			if fields[0] == "Iface" {
+				return "" // header
+			}
+			return fields[0]
+		}},
+		{"/proc/net/ipv6_route", func(fields []string) string {
+			return fields[len(fields)-1]
+		}},
+	} {
+		f, err := os.Open(x.name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // e.g., ipv6 disabled
+			}
+			return false, err
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if fields := strings.Fields(sc.Text()); len(fields) != 0 {
+				if iface := x.iface(fields); iface != "" && iface != "lo" {
+					f.Close()
+					return true, nil
+				}
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,118 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// OptionalComponentsName is the name of the optional component manifest in
+// the output directory. It is a tab-separated text file (so nswrap can parse it
+// easily) with a line per component:
+//
+//	name  sha256  size  path  source
+//
+// Where path is slash-separated and relative to the wine dir, and source is a
+// URL or absolute path. Lines starting with "#" are comments.
+const OptionalComponentsName = "components.tsv"
+
+// OptionalComponent is a file moved out of the runtime which can be installed
+// on-demand by nswrap.
+type OptionalComponent struct {
+	Name   string // lowercased file name
+	SHA256 string
+	Size   int64
+	Path   string // slash-separated, relative to the wine dir
+	Source string // URL or absolute path to get the file from
+}
+
+// moveOptionalComponents moves the wine PE lib files matching the profile's
+// components to dir (named by their sha256 hash), returning the components
+// sorted by name. If source is empty, the absolute path of dir is used.
+func moveOptionalComponents(profile *Profile, dir, source string) ([]OptionalComponent, error) {
+	winDir := filepath.Join(*Prefix, "lib/wine", archt("x86_64-windows", "aarch64-windows"))
+
+	if source == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		source = abs
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	dis, err := os.ReadDir(winDir)
+	if err != nil {
+		return nil, err
+	}
+	var cs []OptionalComponent
+	for _, di := range dis {
+		if !di.Type().IsRegular() || !profile.Optional(di.Name()) {
+			continue
+		}
+		src := filepath.Join(winDir, di.Name())
+		sum, err := sha256File(src)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := di.Info()
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(*Prefix, src)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("moving optional component", "name", di.Name(), "sha256", sum)
+		if err := moveFile(src, filepath.Join(dir, sum)); err != nil {
+			return nil, fmt.Errorf("move %s: %w", di.Name(), err)
+		}
+		cs = append(cs, OptionalComponent{
+			Name:   strings.ToLower(di.Name()),
+			SHA256: sum,
+			Size:   fi.Size(),
+			Path:   filepath.ToSlash(rel),
+			Source: strings.TrimSuffix(source, "/") + "/" + sum,
+		})
+	}
+	slices.SortFunc(cs, func(a, b OptionalComponent) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return cs, nil
+}
+
+// moveFile moves a file, copying it if it's on a different filesystem.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// writeOptionalComponents writes the optional component manifest to w.
+func writeOptionalComponents(w io.Writer, cs []OptionalComponent) error {
+	var b bytes.Buffer
+	b.WriteString("# name\tsha256\tsize\tpath\tsource\n")
+	for _, c := range cs {
+		for _, x := range []string{c.Name, c.Path, c.Source} {
+			if strings.ContainsAny(x, "\t\r\n") {
+				return fmt.Errorf("component %q: invalid character in %q", c.Name, x)
+			}
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%d\t%s\t%s\n", c.Name, c.SHA256, c.Size, c.Path, c.Source)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
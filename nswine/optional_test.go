@@ -0,0 +1,27 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteOptionalComponents(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeOptionalComponents(&b, []OptionalComponent{
+		{"d3dcompiler_47.dll", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", 4, "lib/wine/x86_64-windows/d3dcompiler_47.dll", "https://example.com/components/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := "# name\tsha256\tsize\tpath\tsource\n" +
+		"d3dcompiler_47.dll\t9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08\t4\tlib/wine/x86_64-windows/d3dcompiler_47.dll\thttps://example.com/components/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08\n"; b.String() != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, b.String())
+	}
+
+	if err := writeOptionalComponents(&b, []OptionalComponent{
+		{Name: "x.dll", Path: "lib/wine/x.dll", Source: "/some\tpath"},
+	}); err == nil {
+		t.Errorf("expected error for invalid source")
+	}
+}
@@ -0,0 +1,328 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otlpSpoolEnv is set to a file to write the trace to instead of exporting it
+// when nswine re-executes itself for -offline, since the endpoint isn't
+// reachable from the new network namespace. The parent exports it afterwards.
+const otlpSpoolEnv = "NSWINE_OTLP_SPOOL"
+
+// otlpTracer records the build steps as spans. Each info-level log message
+// starts a new step (ending the previous one), and warnings and errors are
+// added to the current step as events.
+type otlpTracer struct {
+	mu       sync.Mutex
+	endpoint string
+	trace    string
+	root     *otlpSpan
+	spans    []*otlpSpan
+}
+
+// otlpSpan is a recorded span.
+type otlpSpan struct {
+	ID     string
+	Name   string
+	Start  time.Time
+	End    time.Time
+	Attrs  []otlpKeyValue
+	Events []otlpEvent
+	Error  string
+}
+
+var otlp *otlpTracer
+
+// otlpHTTPClient is used to post traces to an OTLP/HTTP endpoint.
+var otlpHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// otlpSetup starts recording build steps for export to endpoint, which is an
+// OTLP/HTTP base URL or a file to append OTLP JSON lines to.
+func otlpSetup(endpoint string) {
+	if endpoint == "" {
+		return
+	}
+	if spool := os.Getenv(otlpSpoolEnv); spool != "" {
+		endpoint = spool
+	}
+	otlp = &otlpTracer{
+		endpoint: endpoint,
+		trace:    otlpID(16),
+		root: &otlpSpan{
+			ID:    otlpID(8),
+			Name:  "nswine",
+			Start: time.Now(),
+			Attrs: []otlpKeyValue{
+				otlpString("nswine.profile", *ProfileName),
+				otlpString("nswine.arch", runtime.GOARCH),
+				otlpString("nswine.optimize", strconv.FormatBool(*Optimize)),
+			},
+		},
+	}
+	slog.SetDefault(slog.New(&otlpHandler{
+		Handler: slog.Default().Handler(),
+		t:       otlp,
+	}))
+}
+
+// otlpDiscard stops recording build steps without exporting them.
+func otlpDiscard() {
+	otlp = nil
+}
+
+// otlpExport exports the recorded build steps, marking the build as failed if
+// err is not nil.
+func otlpExport(err error) error {
+	if otlp == nil {
+		return nil
+	}
+	buf, jerr := json.Marshal(otlp.encode(err))
+	if jerr != nil {
+		return fmt.Errorf("encode trace: %w", jerr)
+	}
+	return otlpSend(otlp.endpoint, buf)
+}
+
+// otlpForward exports the traces written to the spool file by a re-executed
+// nswine, then removes it.
+func otlpForward(endpoint, spool string) error {
+	defer os.Remove(spool)
+	buf, err := os.ReadFile(spool)
+	if err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	sc.Buffer(nil, len(buf)+1)
+	for sc.Scan() {
+		if err := otlpSend(endpoint, sc.Bytes()); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// otlpIsURL checks if endpoint is an OTLP/HTTP URL rather than a file.
+func otlpIsURL(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://")
+}
+
+// otlpSend posts an OTLP JSON trace to an OTLP/HTTP endpoint, or appends it to
+// a file.
+func otlpSend(endpoint string, buf []byte) error {
+	if !otlpIsURL(endpoint) {
+		f, err := os.OpenFile(endpoint, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(slices.Clip(buf), '\n')); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	url := strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	resp, err := otlpHTTPClient.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("post %q: response status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// record updates the spans for a log record.
+func (t *otlpTracer) record(r slog.Record, attrs []slog.Attr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var kvs []otlpKeyValue
+	for _, a := range attrs {
+		kvs = append(kvs, otlpString(a.Key, a.Value.String()))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		kvs = append(kvs, otlpString(a.Key, a.Value.String()))
+		return true
+	})
+
+	cur := t.root
+	if n := len(t.spans); n != 0 {
+		cur = t.spans[n-1]
+	}
+	switch {
+	case r.Level == slog.LevelInfo:
+		if cur != t.root {
+			cur.End = r.Time
+		}
+		t.spans = append(t.spans, &otlpSpan{
+			ID:    otlpID(8),
+			Name:  r.Message,
+			Start: r.Time,
+			Attrs: kvs,
+		})
+	case r.Level >= slog.LevelWarn:
+		cur.Events = append(cur.Events, otlpEvent{
+			TimeUnixNano: otlpTime(r.Time),
+			Name:         r.Message,
+			Attributes:   kvs,
+		})
+		if r.Level >= slog.LevelError {
+			cur.Error = r.Message
+		}
+	}
+}
+
+// encode ends the spans and converts them to an OTLP trace export request.
+func (t *otlpTracer) encode(err error) otlpTraces {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.root.End.IsZero() {
+		t.root.End = now
+	}
+	if err != nil {
+		t.root.Error = err.Error()
+	}
+	var ss []otlpJSONSpan
+	for _, s := range append([]*otlpSpan{t.root}, t.spans...) {
+		if s.End.IsZero() {
+			s.End = now
+		}
+		js := otlpJSONSpan{
+			TraceID:           t.trace,
+			SpanID:            s.ID,
+			Name:              s.Name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: otlpTime(s.Start),
+			EndTimeUnixNano:   otlpTime(s.End),
+			Attributes:        s.Attrs,
+			Events:            s.Events,
+			Status:            otlpStatus{Code: 1}, // STATUS_CODE_OK
+		}
+		if s != t.root {
+			js.ParentSpanID = t.root.ID
+		}
+		if s.Error != "" {
+			js.Status = otlpStatus{Code: 2, Message: s.Error} // STATUS_CODE_ERROR
+		}
+		ss = append(ss, js)
+	}
+	return otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{
+					otlpString("service.name", "nswine"),
+				},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "nswine"},
+				Spans: ss,
+			}},
+		}},
+	}
+}
+
+// otlpHandler wraps a slog.Handler to record the build steps.
+type otlpHandler struct {
+	slog.Handler
+	t     *otlpTracer
+	attrs []slog.Attr
+}
+
+func (h *otlpHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.t.record(r, h.attrs)
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *otlpHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &otlpHandler{h.Handler.WithAttrs(attrs), h.t, append(slices.Clip(h.attrs), attrs...)}
+}
+
+func (h *otlpHandler) WithGroup(name string) slog.Handler {
+	return &otlpHandler{h.Handler.WithGroup(name), h.t, h.attrs} // attributes are flattened
+}
+
+// otlpID generates a random hex trace or span ID.
+func otlpID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// otlpTime formats a time as OTLP JSON unix nanoseconds.
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpString makes an OTLP string attribute.
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// OTLP JSON encoding (only the parts we use)
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope      `json:"scope"`
+		Spans []otlpJSONSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpJSONSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
@@ -0,0 +1,93 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOTLP(t *testing.T) {
+	defer func(l *slog.Logger) {
+		slog.SetDefault(l)
+		otlp = nil
+	}(slog.Default())
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	fn := filepath.Join(t.TempDir(), "trace.json")
+	otlpSetup(fn)
+
+	slog.Info("step one", "a", 1)
+	slog.Debug("ignored")
+	slog.With("b", "x").Warn("something happened")
+	slog.Info("step two")
+	slog.Error("failed")
+	if err := otlpExport(errors.New("test")); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("read trace: %v", err)
+	}
+	var tr otlpTraces
+	if err := json.Unmarshal(buf, &tr); err != nil {
+		t.Fatalf("decode trace: %v", err)
+	}
+	if len(tr.ResourceSpans) != 1 || len(tr.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("incorrect trace structure")
+	}
+	ss := tr.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(ss) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(ss))
+	}
+	root, one, two := ss[0], ss[1], ss[2]
+	if root.Name != "nswine" || root.ParentSpanID != "" || root.Status.Code != 2 || root.Status.Message != "test" {
+		t.Errorf("incorrect root span %+v", root)
+	}
+	if one.Name != "step one" || one.ParentSpanID != root.SpanID || one.TraceID != root.TraceID || one.Status.Code != 1 {
+		t.Errorf("incorrect first span %+v", one)
+	}
+	if len(one.Attributes) != 1 || one.Attributes[0] != otlpString("a", "1") {
+		t.Errorf("incorrect first span attributes %+v", one.Attributes)
+	}
+	if len(one.Events) != 1 || one.Events[0].Name != "something happened" || len(one.Events[0].Attributes) != 1 || one.Events[0].Attributes[0] != otlpString("b", "x") {
+		t.Errorf("incorrect first span events %+v", one.Events)
+	}
+	if one.EndTimeUnixNano != two.StartTimeUnixNano {
+		t.Errorf("first span should end when the second starts")
+	}
+	if two.Name != "step two" || two.Status.Code != 2 || two.Status.Message != "failed" {
+		t.Errorf("incorrect second span %+v", two)
+	}
+}
+
+func TestOTLPSend(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := io.ReadAll(r.Body)
+		got = append(got, r.URL.Path+" "+r.Header.Get("Content-Type")+" "+string(buf))
+	}))
+	defer srv.Close()
+
+	spool := filepath.Join(t.TempDir(), "spool.json")
+	if err := os.WriteFile(spool, []byte("{\"a\":1}\n{\"b\":2}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := otlpForward(srv.URL+"/", spool); err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	if len(got) != 2 || got[0] != "/v1/traces application/json {\"a\":1}" || got[1] != "/v1/traces application/json {\"b\":2}" {
+		t.Errorf("incorrect requests %q", got)
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("spool file not removed")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// PatchRule is a binary search-and-replace patch for files in the wine dir.
+// Each matched file must contain the search pattern exactly Count times, and
+// every occurrence is replaced.
+type PatchRule struct {
+	// Name identifies the rule for overlaying (a name prefixed with "-"
+	// removes an inherited rule) and provenance.
+	Name string `json:"name"`
+
+	// File is a glob for the slash-separated path of the files to patch,
+	// relative to the wine dir (e.g., "lib/wine/*-windows/explorer.exe"). It
+	// must match at least one file unless Optional is set.
+	File     string `json:"file"`
+	Optional bool   `json:"optional,omitempty"`
+
+	// Encoding is how Search and Replace are converted to bytes. It is one of
+	// "utf8" (the default), "utf16" (little-endian), or "hex".
+	Encoding string `json:"encoding,omitempty"`
+
+	Search  string `json:"search"`
+	Replace string `json:"replace"`
+
+	// Count is the number of times Search must occur in each file. If zero,
+	// it must occur exactly once.
+	Count int `json:"count,omitempty"`
+
+	// Section restricts the search to the initialized data of a PE section
+	// (e.g., ".rdata"), in which case the files must be PE images. Matches of
+	// utf16 patterns must also be 2-byte aligned.
+	Section string `json:"section,omitempty"`
+
+	// Pad allows Replace to be shorter than Search, in which case it is
+	// padded with zeros. Otherwise, they must be the same length.
+	Pad bool `json:"pad,omitempty"`
+}
+
+// compile converts the search and replacement patterns to bytes, checking the
+// length constraints.
+func (r PatchRule) compile() (search, replace []byte, err error) {
+	switch r.Encoding {
+	case "", "utf8":
+		search, replace = []byte(r.Search), []byte(r.Replace)
+	case "utf16":
+		search, replace = u8to16[string, []byte](r.Search), u8to16[string, []byte](r.Replace)
+	case "hex":
+		if search, err = hex.DecodeString(strings.ReplaceAll(r.Search, " ", "")); err != nil {
+			return nil, nil, fmt.Errorf("patch %q: invalid search pattern: %w", r.Name, err)
+		}
+		if replace, err = hex.DecodeString(strings.ReplaceAll(r.Replace, " ", "")); err != nil {
+			return nil, nil, fmt.Errorf("patch %q: invalid replacement: %w", r.Name, err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("patch %q: unknown encoding %q", r.Name, r.Encoding)
+	}
+	switch {
+	case len(search) == 0:
+		return nil, nil, fmt.Errorf("patch %q: empty search pattern", r.Name)
+	case len(replace) > len(search):
+		return nil, nil, fmt.Errorf("patch %q: replacement (%d bytes) is longer than the search pattern (%d bytes)", r.Name, len(replace), len(search))
+	case len(replace) < len(search) && !r.Pad:
+		return nil, nil, fmt.Errorf("patch %q: replacement (%d bytes) is shorter than the search pattern (%d bytes), and padding is not enabled", r.Name, len(replace), len(search))
+	}
+	return search, append(replace, make([]byte, len(search)-len(replace))...), nil
+}
+
+// validate checks the rule.
+func (r PatchRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("patch: missing name")
+	}
+	if r.Count < 0 {
+		return fmt.Errorf("patch %q: invalid count %d", r.Name, r.Count)
+	}
+	if _, err := filepath.Match(r.File, ""); err != nil || r.File == "" || !filepath.IsLocal(filepath.FromSlash(r.File)) {
+		return fmt.Errorf("patch %q: invalid file glob %q", r.Name, r.File)
+	}
+	if len(r.Section) > 8 {
+		return fmt.Errorf("patch %q: invalid section name %q", r.Name, r.Section)
+	}
+	_, _, err := r.compile()
+	return err
+}
+
+// apply patches buf in-place, returning an error if the search pattern doesn't
+// occur the expected number of times.
+func (r PatchRule) apply(buf []byte) ([]byte, error) {
+	search, replace, err := r.compile()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		data  = buf
+		start = 0
+	)
+	if r.Section != "" {
+		off, size, err := peSectionData(buf, r.Section)
+		if err != nil {
+			return nil, fmt.Errorf("patch %q: %w", r.Name, err)
+		}
+		data, start = buf[off:off+size], off
+	}
+	var idx []int
+	for i := 0; ; {
+		j := bytes.Index(data[i:], search)
+		if j == -1 {
+			break
+		}
+		if r.Section != "" && r.Encoding == "utf16" && (start+i+j)%2 != 0 {
+			i += j + 1
+			continue
+		}
+		idx = append(idx, start+i+j)
+		i += j + len(search)
+	}
+	if exp := max(r.Count, 1); len(idx) != exp {
+		return nil, fmt.Errorf("patch %q: expected %d occurrences of the search pattern, found %d", r.Name, exp, len(idx))
+	}
+	for _, i := range idx {
+		copy(buf[i:], replace)
+	}
+	return buf, nil
+}
+
+// applyPatches applies patch rules to the files in the wine dir, calling fn
+// with the path of each patched file. The headers of patched PE images are
+// fixed afterwards.
+func applyPatches(dir string, rules []PatchRule, fix peFixOptions, fn func(name string, r PatchRule)) error {
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return err
+		}
+		names, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(r.File)))
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			if r.Optional {
+				continue
+			}
+			return fmt.Errorf("patch %q: no files match %q", r.Name, r.File)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if err := transform(name, trpe(r.apply, fix)); err != nil {
+				return err
+			}
+			if fn != nil {
+				fn(name, r)
+			}
+		}
+	}
+	return nil
+}
+
+// applyLoadOrder sets or clears the prefer-native flag of the wine builtin PE
+// modules matching the profile's load order lists, calling fn with the path of
+// each changed file.
+func applyLoadOrder(dir string, p *Profile, fix peFixOptions, fn func(name string, native bool)) error {
+	names, err := filepath.Glob(filepath.Join(dir, "lib/wine/*-windows/*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		native, ok := p.LoadOrder(filepath.Base(name))
+		if !ok {
+			continue
+		}
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		changed, err := peSetPreferNative(buf, native)
+		if err != nil {
+			return fmt.Errorf("set load order of %q: %w", name, err)
+		}
+		if !changed {
+			continue
+		}
+		if buf, err = peFixHeader(buf, fix); err != nil {
+			return fmt.Errorf("set load order of %q: %w", name, err)
+		}
+		if err := os.WriteFile(name, buf, 0644); err != nil {
+			return err
+		}
+		if fn != nil {
+			fn(name, native)
+		}
+	}
+	return nil
+}
+
+// overlayPatches adds the rules in o to p, replacing ones with the same name,
+// and removing ones whose name is prefixed with "-".
+func overlayPatches(p, o []PatchRule) []PatchRule {
+	r := slices.Clone(p)
+	for _, x := range o {
+		if name, ok := strings.CutPrefix(x.Name, "-"); ok {
+			r = slices.DeleteFunc(r, func(y PatchRule) bool {
+				return y.Name == name
+			})
+			continue
+		}
+		if i := slices.IndexFunc(r, func(y PatchRule) bool {
+			return y.Name == x.Name
+		}); i != -1 {
+			r[i] = x
+		} else {
+			r = append(r, x)
+		}
+	}
+	return r
+}
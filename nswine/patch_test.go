@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPatchRule(t *testing.T) {
+	for _, tc := range []struct {
+		Rule   PatchRule
+		In     string
+		Out    string
+		Errors bool
+	}{
+		{PatchRule{Name: "a", Search: "abc", Replace: "xyz"}, "-abc-", "-xyz-", false},
+		{PatchRule{Name: "a", Search: "abc", Replace: "xyz"}, "-abc-abc-", "", true},
+		{PatchRule{Name: "a", Search: "abc", Replace: "xyz", Count: 2}, "-abc-abc-", "-xyz-xyz-", false},
+		{PatchRule{Name: "a", Search: "abc", Replace: "xyz"}, "-ab-", "", true},
+		{PatchRule{Name: "a", Search: "abc", Replace: "x"}, "-abc-", "", true},
+		{PatchRule{Name: "a", Search: "abc", Replace: "x", Pad: true}, "-abc-", "-x\x00\x00-", false},
+		{PatchRule{Name: "a", Search: "ab", Replace: "xyz", Pad: true}, "-ab-", "", true},
+		{PatchRule{Name: "a", Search: "aaa", Replace: "bbb", Count: 2}, "aaaaaa", "bbbbbb", false},
+		{PatchRule{Name: "a", Encoding: "utf16", Search: "ab\x00", Replace: "x\x00", Pad: true}, "-a\x00b\x00\x00\x00-", "-x\x00\x00\x00\x00\x00-", false},
+		{PatchRule{Name: "a", Encoding: "hex", Search: "de ad", Replace: "be ef"}, "\xde\xad", "\xbe\xef", false},
+		{PatchRule{Name: "a", Encoding: "hex", Search: "zz", Replace: "00"}, "", "", true},
+		{PatchRule{Name: "a", Encoding: "utf32", Search: "a", Replace: "b"}, "a", "", true},
+		{PatchRule{Name: "a", Search: "", Replace: ""}, "a", "", true},
+	} {
+		out, err := tc.Rule.apply([]byte(tc.In))
+		if tc.Errors {
+			if err == nil {
+				t.Errorf("%+v: expected error", tc.Rule)
+			}
+		} else if err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.Rule, err)
+		} else if string(out) != tc.Out {
+			t.Errorf("%+v: expected %q, got %q", tc.Rule, tc.Out, out)
+		}
+	}
+}
+
+func TestPatchRuleSection(t *testing.T) {
+	img, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "test.dll", nil)
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+	ab := u8to16[string, []byte]("ab\x00")
+	copy(img[0x380:], ab) // in the .text padding, not the initialized data
+
+	rdata := make([]byte, 0x200)
+	copy(rdata[0x11:], ab) // unaligned
+	copy(rdata[0x40:], ab)
+	raw := len(img)
+	img = peAddSection(t, img, 0x2000, rdata)
+
+	r := PatchRule{Name: "a", File: "test.dll", Section: ".rdata", Encoding: "utf16", Search: "ab\x00", Replace: "x\x00", Pad: true}
+	if err := r.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	out, err := r.apply(slices.Clone(img))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if exp := u8to16[string, []byte]("x\x00\x00"); !bytes.Equal(out[raw+0x40:raw+0x46], exp) {
+		t.Errorf("expected aligned match to be replaced, got %q", out[raw+0x40:raw+0x46])
+	}
+	out[raw+0x40], out[raw+0x42] = 'a', 'b'
+	if !bytes.Equal(out, img) {
+		t.Errorf("expected only the aligned match in the section to be replaced")
+	}
+
+	for _, r := range []PatchRule{
+		{Name: "a", Encoding: "utf16", Search: "ab\x00", Replace: "x\x00", Pad: true},
+		{Name: "a", Section: ".bss", Encoding: "utf16", Search: "ab\x00", Replace: "x\x00", Pad: true},
+		{Name: "a", Section: ".rdata", Search: "test.dll"},
+	} {
+		if _, err := r.apply(slices.Clone(img)); err == nil {
+			t.Errorf("%+v: expected error", r)
+		}
+	}
+	if _, err := r.apply([]byte("ab")); err == nil {
+		t.Errorf("expected error for non-pe file")
+	}
+	if err := (PatchRule{Name: "a", File: "a", Search: "a", Replace: "b", Section: ".verylongname"}).validate(); err == nil {
+		t.Errorf("expected error for invalid section name")
+	}
+}
+
+func TestApplyPatches(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"lib/wine/x86_64-windows/a.dll", "lib/wine/x86_64-windows/b.dll", "lib/wine/x86_64-unix/a.so"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("xx hello xx"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var patched []string
+	if err := applyPatches(dir, []PatchRule{
+		{Name: "dlls", File: "lib/wine/*-windows/*.dll", Search: "hello", Replace: "world"},
+		{Name: "missing", File: "lib/wine/*-windows/missing.dll", Search: "a", Replace: "b", Optional: true},
+	}, peFixOptions{}, func(name string, r PatchRule) {
+		rel, _ := filepath.Rel(dir, name)
+		patched = append(patched, r.Name+":"+filepath.ToSlash(rel))
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := []string{"dlls:lib/wine/x86_64-windows/a.dll", "dlls:lib/wine/x86_64-windows/b.dll"}; !slices.Equal(patched, exp) {
+		t.Errorf("expected patched %q, got %q", exp, patched)
+	}
+	for name, exp := range map[string]string{
+		"lib/wine/x86_64-windows/a.dll": "xx world xx",
+		"lib/wine/x86_64-unix/a.so":     "xx hello xx",
+	} {
+		if buf, err := os.ReadFile(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, []byte(exp)) {
+			t.Errorf("%s: expected %q, got %q", name, exp, buf)
+		}
+	}
+
+	for _, rules := range [][]PatchRule{
+		{{Name: "missing", File: "lib/wine/*-windows/missing.dll", Search: "a", Replace: "b"}},
+		{{Name: "again", File: "lib/wine/*-windows/a.dll", Search: "hello", Replace: "world"}},
+		{{Name: "unsafe", File: "../x", Search: "a", Replace: "b"}},
+	} {
+		if err := applyPatches(dir, rules, peFixOptions{}, nil); err == nil {
+			t.Errorf("%s: expected error", rules[0].Name)
+		} else if !strings.Contains(err.Error(), rules[0].Name) {
+			t.Errorf("%s: expected error to mention the rule, got %v", rules[0].Name, err)
+		}
+	}
+
+	if act := overlayPatches([]PatchRule{{Name: "a", Search: "1"}, {Name: "b"}}, []PatchRule{{Name: "-b"}, {Name: "a", Search: "2"}, {Name: "c"}}); !slices.Equal(act, []PatchRule{{Name: "a", Search: "2"}, {Name: "c"}}) {
+		t.Errorf("incorrect overlay: %+v", act)
+	}
+}
+
+func TestApplyLoadOrder(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "lib/wine/x86_64-windows"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"d3d11.dll", "dxgi.dll", "msvcr100.dll", "user32.dll"} {
+		buf, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, name, nil)
+		if err != nil {
+			t.Fatalf("generate stub: %v", err)
+		}
+		if name == "msvcr100.dll" {
+			if _, err := peSetPreferNative(buf, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, "lib/wine/x86_64-windows", name), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Profile{
+		PreferNative:  []string{"d3d*.dll", "DXGI.dll", "msvcr*.dll"},
+		PreferBuiltin: []string{"msvcr*.dll"},
+	}
+	var changed []string
+	if err := applyLoadOrder(dir, p, peFixOptions{}, func(name string, native bool) {
+		changed = append(changed, fmt.Sprintf("%s:%t", filepath.Base(name), native))
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := []string{"d3d11.dll:true", "dxgi.dll:true", "msvcr100.dll:false"}; !slices.Equal(changed, exp) {
+		t.Errorf("expected changed %q, got %q", exp, changed)
+	}
+	for name, exp := range map[string]bool{
+		"d3d11.dll":    true,
+		"dxgi.dll":     true,
+		"msvcr100.dll": false,
+		"user32.dll":   false,
+	} {
+		f, err := pe.Open(filepath.Join(dir, "lib/wine/x86_64-windows", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act := f.OptionalHeader.(*pe.OptionalHeader64).DllCharacteristics&peDllCharacteristicsPreferNative != 0; act != exp {
+			t.Errorf("%s: expected prefer-native %t, got %t", name, exp, act)
+		}
+		f.Close()
+	}
+
+	changed = nil
+	if err := applyLoadOrder(dir, p, peFixOptions{}, func(name string, native bool) {
+		changed = append(changed, name)
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(changed) != 0 {
+		t.Errorf("expected no changes when applied again, got %q", changed)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "lib/wine/x86_64-windows/d3d9.dll"), []byte("MZ not a builtin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyLoadOrder(dir, p, peFixOptions{}, nil); err == nil {
+		t.Errorf("expected error for non-builtin dll")
+	}
+}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Machine types for hybrid images, which aren't in debug/pe. These don't
+// appear in the file header (ARM64EC images claim to be AMD64 and ARM64X
+// images claim to be ARM64), but are what peFile.Machine is set to when the
+// image has hybrid metadata.
+const (
+	peMachineARM64EC = 0xa641
+	peMachineARM64X  = 0xa64e
+)
+
+// peFile is a PE image parsed with debug/pe, plus the things it doesn't
+// understand: the hybrid metadata and ARM64X relocations of ARM64EC and ARM64X
+// images (like Hangover's and wine's arm64 DLLs), and the delay-load and bound
+// import directories.
+type peFile struct {
+	*pe.File
+
+	// Machine is the effective machine type, which is the file header machine
+	// unless it's an ARM64EC or ARM64X image.
+	Machine uint16
+
+	// CodeMap is the hybrid code map of ARM64EC and ARM64X images.
+	CodeMap []peCodeRange
+
+	r      io.ReaderAt
+	closer io.Closer
+	dirs   uint32            // rva (and file offset) of the data directories
+	arm64x map[uint32][]byte // ARM64X value relocations (to switch to the ARM64EC view) by rva
+}
+
+// peCodeRange is an entry in the hybrid code map.
+type peCodeRange struct {
+	RVA     uint32
+	Size    uint32
+	Machine uint16 // ARM64, ARM64EC, or AMD64
+}
+
+// peExport is a function exported by a PE file.
+type peExport struct {
+	Name      string // empty if only exported by ordinal
+	Ordinal   uint16
+	RVA       uint32
+	Forwarder string // e.g., "ntdll.RtlAllocateHeap", if it's a forwarder
+}
+
+// peOpen opens and parses a PE file.
+func peOpen(name string) (*peFile, error) {
+	r, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := peNewFile(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	f.closer = r
+	return f, nil
+}
+
+// peNewFile parses a PE file from r.
+func peNewFile(r io.ReaderAt) (*peFile, error) {
+	p, err := pe.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	f := &peFile{
+		File:    p,
+		Machine: p.Machine,
+		r:       r,
+	}
+	var lfanew [4]byte
+	if _, err := r.ReadAt(lfanew[:], 0x3c); err != nil {
+		return nil, err
+	}
+	f.dirs = binary.LittleEndian.Uint32(lfanew[:]) + 4 + 20
+	switch p.OptionalHeader.(type) {
+	case *pe.OptionalHeader64:
+		f.dirs += 112
+	case *pe.OptionalHeader32:
+		f.dirs += 96
+	}
+	if err := f.parseHybrid(); err != nil {
+		return nil, fmt.Errorf("parse hybrid metadata: %w", err)
+	}
+	return f, nil
+}
+
+// Close closes the file if it was opened with peOpen.
+func (f *peFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+// Imports gets the imported and delay-loaded libraries and functions (imports
+// by ordinal are not included). For ARM64X images, this includes the imports of
+// both the native and ARM64EC views. Libraries are in the order they appear,
+// and are only included once (case-insensitively).
+func (f *peFile) Imports() ([]peImport, error) {
+	views := []func(int) pe.DataDirectory{f.DataDirectory}
+	if f.arm64x != nil {
+		views = append(views, f.ECDataDirectory)
+	}
+	var imps []peImport
+	for _, dd := range views {
+		imp, err := peImportDirectory(f.File, dd(pe.IMAGE_DIRECTORY_ENTRY_IMPORT))
+		if err != nil {
+			return nil, fmt.Errorf("parse imports: %w", err)
+		}
+		delay, err := peDelayImports(f.File, dd(pe.IMAGE_DIRECTORY_ENTRY_DELAY_IMPORT))
+		if err != nil {
+			return nil, fmt.Errorf("parse delay-load imports: %w", err)
+		}
+		imps = peMergeImports(imps, append(imp, delay...))
+	}
+	return imps, nil
+}
+
+// Exports gets the exported functions in ordinal order. Unused ordinals are
+// skipped.
+func (f *peFile) Exports() ([]peExport, error) {
+	dd := f.DataDirectory(pe.IMAGE_DIRECTORY_ENTRY_EXPORT)
+	if dd.VirtualAddress == 0 {
+		return nil, nil
+	}
+	dir, err := peReadRVA(f.File, dd.VirtualAddress, 40)
+	if err != nil {
+		return nil, fmt.Errorf("parse exports: %w", err)
+	}
+	var (
+		base     = binary.LittleEndian.Uint32(dir[16:])
+		nfuncs   = binary.LittleEndian.Uint32(dir[20:])
+		nnames   = binary.LittleEndian.Uint32(dir[24:])
+		funcsRVA = binary.LittleEndian.Uint32(dir[28:])
+		namesRVA = binary.LittleEndian.Uint32(dir[32:])
+		ordsRVA  = binary.LittleEndian.Uint32(dir[36:])
+	)
+	if nfuncs > 1<<16 || nnames > nfuncs {
+		return nil, fmt.Errorf("parse exports: invalid export count")
+	}
+	if nfuncs == 0 {
+		return nil, nil
+	}
+	funcs, err := peReadRVA(f.File, funcsRVA, nfuncs*4)
+	if err != nil {
+		return nil, fmt.Errorf("parse exports: %w", err)
+	}
+	names := make([]string, nfuncs)
+	if nnames != 0 {
+		nrvas, err := peReadRVA(f.File, namesRVA, nnames*4)
+		if err != nil {
+			return nil, fmt.Errorf("parse exports: %w", err)
+		}
+		ords, err := peReadRVA(f.File, ordsRVA, nnames*2)
+		if err != nil {
+			return nil, fmt.Errorf("parse exports: %w", err)
+		}
+		for i := range nnames {
+			idx := uint32(binary.LittleEndian.Uint16(ords[i*2:]))
+			if idx >= nfuncs {
+				return nil, fmt.Errorf("parse exports: name ordinal %d out of range", idx)
+			}
+			if names[idx], err = peReadString(f.File, binary.LittleEndian.Uint32(nrvas[i*4:])); err != nil {
+				return nil, fmt.Errorf("parse exports: %w", err)
+			}
+		}
+	}
+	var exps []peExport
+	for i := range nfuncs {
+		rva := binary.LittleEndian.Uint32(funcs[i*4:])
+		if rva == 0 {
+			continue
+		}
+		exp := peExport{
+			Name:    names[i],
+			Ordinal: uint16(base + i),
+			RVA:     rva,
+		}
+		if rva >= dd.VirtualAddress && rva-dd.VirtualAddress < dd.Size {
+			if exp.Forwarder, err = peReadString(f.File, rva); err != nil {
+				return nil, fmt.Errorf("parse exports: %w", err)
+			}
+		}
+		exps = append(exps, exp)
+	}
+	return exps, nil
+}
+
+// BoundImports gets the bound import libraries, including forwarder
+// references.
+func (f *peFile) BoundImports() ([]string, error) {
+	libs, err := peBoundImports(f.File, f.r)
+	if err != nil {
+		return nil, fmt.Errorf("parse bound imports: %w", err)
+	}
+	return libs, nil
+}
+
+// peVersion is the version information from the fixed part of a PE file's
+// version resource (VS_FIXEDFILEINFO), formatted like "10.0.0.0".
+type peVersion struct {
+	File    string `json:"file"`
+	Product string `json:"product"`
+}
+
+// Version gets the version information from the version resource, returning
+// nil if there isn't one.
+func (f *peFile) Version() (*peVersion, error) {
+	buf, err := f.resource(16) // RT_VERSION
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	key := u8to16[string, []byte]("VS_VERSION_INFO\x00")
+	if len(buf) < 6+len(key) || !bytes.Equal(buf[6:6+len(key)], key) {
+		return nil, fmt.Errorf("parse version resource: invalid VS_VERSIONINFO")
+	}
+	off := (6 + len(key) + 3) &^ 3
+	if int(binary.LittleEndian.Uint16(buf[2:])) < 52 || len(buf) < off+52 {
+		return nil, nil // no VS_FIXEDFILEINFO
+	}
+	ffi := buf[off:]
+	if binary.LittleEndian.Uint32(ffi[0:]) != 0xfeef04bd {
+		return nil, fmt.Errorf("parse version resource: invalid VS_FIXEDFILEINFO signature")
+	}
+	ver := func(ms, ls uint32) string {
+		return fmt.Sprintf("%d.%d.%d.%d", ms>>16, ms&0xffff, ls>>16, ls&0xffff)
+	}
+	return &peVersion{
+		File:    ver(binary.LittleEndian.Uint32(ffi[8:]), binary.LittleEndian.Uint32(ffi[12:])),
+		Product: ver(binary.LittleEndian.Uint32(ffi[16:]), binary.LittleEndian.Uint32(ffi[20:])),
+	}, nil
+}
+
+// resource gets the data of the first resource with the specified type id (in
+// any name or language), returning nil if there isn't one.
+func (f *peFile) resource(typ uint32) ([]byte, error) {
+	dd := f.DataDirectory(pe.IMAGE_DIRECTORY_ENTRY_RESOURCE)
+	if dd.VirtualAddress == 0 {
+		return nil, nil
+	}
+	var off uint32
+	for level := range 3 { // type, name, language
+		hdr, err := peReadRVA(f.File, dd.VirtualAddress+off, 16)
+		if err != nil {
+			return nil, fmt.Errorf("parse resources: %w", err)
+		}
+		n := uint32(binary.LittleEndian.Uint16(hdr[12:])) + uint32(binary.LittleEndian.Uint16(hdr[14:]))
+		if n == 0 {
+			return nil, nil
+		}
+		ents, err := peReadRVA(f.File, dd.VirtualAddress+off+16, n*8)
+		if err != nil {
+			return nil, fmt.Errorf("parse resources: %w", err)
+		}
+		var found bool
+		for i := range n {
+			id, data := binary.LittleEndian.Uint32(ents[i*8:]), binary.LittleEndian.Uint32(ents[i*8+4:])
+			if level == 0 && id != typ {
+				continue // named entries have the high bit set, so they won't match
+			}
+			if (data&0x80000000 != 0) != (level != 2) {
+				return nil, fmt.Errorf("parse resources: invalid directory entry")
+			}
+			off, found = data&0x7fffffff, true
+			break
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+	ent, err := peReadRVA(f.File, dd.VirtualAddress+off, 16)
+	if err != nil {
+		return nil, fmt.Errorf("parse resources: %w", err)
+	}
+	rva, size := binary.LittleEndian.Uint32(ent[0:]), binary.LittleEndian.Uint32(ent[4:])
+	if size > 1<<20 {
+		return nil, fmt.Errorf("parse resources: resource too large")
+	}
+	buf, err := peReadRVA(f.File, rva, size)
+	if err != nil {
+		return nil, fmt.Errorf("parse resources: %w", err)
+	}
+	return buf, nil
+}
+
+// DataDirectory gets a data directory entry, returning a zero entry if it
+// doesn't exist.
+func (f *peFile) DataDirectory(idx int) pe.DataDirectory {
+	return peDataDirectory(f.File, idx)
+}
+
+// ECDataDirectory is like DataDirectory, but for the ARM64EC view of an ARM64X
+// image (i.e., with the ARM64X relocations applied).
+func (f *peFile) ECDataDirectory(idx int) pe.DataDirectory {
+	dd := peDataDirectory(f.File, idx)
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[0:], dd.VirtualAddress)
+	binary.LittleEndian.PutUint32(buf[4:], dd.Size)
+	rva := f.dirs + uint32(idx)*8
+	for off, v := range f.arm64x {
+		for i, b := range v {
+			if x := off + uint32(i); x >= rva && x < rva+8 {
+				buf[x-rva] = b
+			}
+		}
+	}
+	return pe.DataDirectory{
+		VirtualAddress: binary.LittleEndian.Uint32(buf[0:]),
+		Size:           binary.LittleEndian.Uint32(buf[4:]),
+	}
+}
+
+// CodeMachine gets the machine type of the code at rva according to the hybrid
+// code map, or the file header machine if it isn't a hybrid image.
+func (f *peFile) CodeMachine(rva uint32) uint16 {
+	if f.CodeMap == nil {
+		return f.File.Machine
+	}
+	for _, r := range f.CodeMap {
+		if rva >= r.RVA && rva-r.RVA < r.Size {
+			return r.Machine
+		}
+	}
+	return 0
+}
+
+// parseHybrid parses the ARM64EC metadata referenced by the load config and
+// the ARM64X dynamic value relocations. It does nothing for images which
+// aren't ARM64EC or ARM64X.
+func (f *peFile) parseHybrid() error {
+	oh, ok := f.OptionalHeader.(*pe.OptionalHeader64)
+	if !ok || (f.File.Machine != pe.IMAGE_FILE_MACHINE_AMD64 && f.File.Machine != pe.IMAGE_FILE_MACHINE_ARM64) {
+		return nil
+	}
+	dd := f.DataDirectory(pe.IMAGE_DIRECTORY_ENTRY_LOAD_CONFIG)
+	if dd.VirtualAddress == 0 {
+		return nil
+	}
+	buf, err := peReadRVA(f.File, dd.VirtualAddress, 4)
+	if err != nil {
+		return err
+	}
+	size := binary.LittleEndian.Uint32(buf)
+	if size < 208 {
+		return nil // too old for CHPEMetadataPointer
+	}
+	if buf, err = peReadRVA(f.File, dd.VirtualAddress, min(size, 232)); err != nil {
+		return err
+	}
+	chpe := binary.LittleEndian.Uint64(buf[200:]) // CHPEMetadataPointer (va)
+	if chpe == 0 {
+		return nil
+	}
+	switch f.File.Machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		f.Machine = peMachineARM64EC
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		f.Machine = peMachineARM64X
+	}
+
+	meta, err := peReadRVA(f.File, uint32(chpe-oh.ImageBase), 12)
+	if err != nil {
+		return fmt.Errorf("read arm64ec metadata: %w", err)
+	}
+	var (
+		codeMap      = binary.LittleEndian.Uint32(meta[4:])
+		codeMapCount = binary.LittleEndian.Uint32(meta[8:])
+	)
+	if codeMapCount > 1<<16 {
+		return fmt.Errorf("too many code map entries (%d)", codeMapCount)
+	}
+	f.CodeMap = []peCodeRange{}
+	if codeMapCount != 0 {
+		cm, err := peReadRVA(f.File, codeMap, codeMapCount*8)
+		if err != nil {
+			return fmt.Errorf("read code map: %w", err)
+		}
+		for i := 0; i < len(cm); i += 8 {
+			var (
+				start = binary.LittleEndian.Uint32(cm[i:])
+				r     = peCodeRange{RVA: start &^ 3, Size: binary.LittleEndian.Uint32(cm[i+4:])}
+			)
+			switch start & 3 {
+			case 0:
+				r.Machine = pe.IMAGE_FILE_MACHINE_ARM64
+			case 1:
+				r.Machine = peMachineARM64EC
+			case 2:
+				r.Machine = pe.IMAGE_FILE_MACHINE_AMD64
+			default:
+				return fmt.Errorf("unknown code map entry type %d", start&3)
+			}
+			f.CodeMap = append(f.CodeMap, r)
+		}
+	}
+
+	var dvrt uint32
+	if len(buf) >= 232 {
+		var (
+			off  = binary.LittleEndian.Uint32(buf[224:]) // DynamicValueRelocTableOffset
+			sect = binary.LittleEndian.Uint16(buf[228:]) // DynamicValueRelocTableSection
+		)
+		if sect != 0 && int(sect) <= len(f.Sections) {
+			dvrt = f.Sections[sect-1].VirtualAddress + off
+		}
+	}
+	if va := binary.LittleEndian.Uint64(buf[192:]); dvrt == 0 && va != 0 { // DynamicValueRelocTable
+		dvrt = uint32(va - oh.ImageBase)
+	}
+	if dvrt != 0 {
+		if err := f.parseARM64X(dvrt); err != nil {
+			return fmt.Errorf("parse dynamic value relocations: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseARM64X parses the ARM64X value relocations from the dynamic value
+// relocation table at rva. Zero-fill and delta relocations are skipped since
+// they aren't used for the headers.
+func (f *peFile) parseARM64X(rva uint32) error {
+	hdr, err := peReadRVA(f.File, rva, 8)
+	if err != nil {
+		return err
+	}
+	if v := binary.LittleEndian.Uint32(hdr); v != 1 {
+		return fmt.Errorf("unsupported version %d", v)
+	}
+	buf, err := peReadRVA(f.File, rva+8, binary.LittleEndian.Uint32(hdr[4:]))
+	if err != nil {
+		return err
+	}
+	for len(buf) >= 12 {
+		var (
+			sym  = binary.LittleEndian.Uint64(buf[0:])
+			size = binary.LittleEndian.Uint32(buf[8:])
+		)
+		if uint64(size) > uint64(len(buf)-12) {
+			return fmt.Errorf("truncated relocations")
+		}
+		relocs := buf[12 : 12+size]
+		buf = buf[12+size:]
+		if sym != 6 { // IMAGE_DYNAMIC_RELOCATION_ARM64X
+			continue
+		}
+		if f.arm64x == nil {
+			f.arm64x = map[uint32][]byte{}
+		}
+		for len(relocs) >= 8 {
+			var (
+				page  = binary.LittleEndian.Uint32(relocs[0:])
+				bsize = binary.LittleEndian.Uint32(relocs[4:])
+			)
+			if bsize < 8 || uint64(bsize) > uint64(len(relocs)) {
+				return fmt.Errorf("invalid relocation block size %d", bsize)
+			}
+			block := relocs[8:bsize]
+			relocs = relocs[bsize:]
+			for len(block) >= 2 {
+				var (
+					e   = binary.LittleEndian.Uint16(block)
+					off = uint32(e & 0xfff)
+					n   = 1 << (e >> 14)
+				)
+				block = block[2:]
+				switch (e >> 12) & 3 {
+				case 0: // zero fill (or padding)
+				case 1: // value
+					if len(block) < n {
+						return fmt.Errorf("truncated value relocation")
+					}
+					f.arm64x[page+off] = bytes.Clone(block[:n])
+					block = block[n:]
+				case 2: // delta
+					if len(block) < 2 {
+						return fmt.Errorf("truncated delta relocation")
+					}
+					block = block[2:]
+				default:
+					return fmt.Errorf("unknown relocation type %d", (e>>12)&3)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// peDataDirectory gets a data directory entry from a PE file, returning a zero
+// entry if it doesn't exist.
+func peDataDirectory(f *pe.File, idx int) pe.DataDirectory {
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader64:
+		if oh.NumberOfRvaAndSizes > uint32(idx) {
+			return oh.DataDirectory[idx]
+		}
+	case *pe.OptionalHeader32:
+		if oh.NumberOfRvaAndSizes > uint32(idx) {
+			return oh.DataDirectory[idx]
+		}
+	}
+	return pe.DataDirectory{}
+}
+
+// peReadRVA reads n bytes at a relative virtual address in a PE file.
+func peReadRVA(f *pe.File, rva, n uint32) ([]byte, error) {
+	for _, s := range f.Sections {
+		if rva >= s.VirtualAddress && rva < s.VirtualAddress+max(s.VirtualSize, s.Size) {
+			buf := make([]byte, n)
+			if _, err := s.ReadAt(buf, int64(rva-s.VirtualAddress)); err != nil {
+				return nil, fmt.Errorf("read rva %#x: %w", rva, err)
+			}
+			return buf, nil
+		}
+	}
+	return nil, fmt.Errorf("rva %#x not in any section", rva)
+}
+
+// peReadString reads a null-terminated string at a relative virtual address in
+// a PE file.
+func peReadString(f *pe.File, rva uint32) (string, error) {
+	for _, s := range f.Sections {
+		if rva >= s.VirtualAddress && rva < s.VirtualAddress+max(s.VirtualSize, s.Size) {
+			buf := make([]byte, 512)
+			n, err := s.ReadAt(buf, int64(rva-s.VirtualAddress))
+			if x, _, ok := bytes.Cut(buf[:n], []byte{0}); ok {
+				return string(x), nil
+			}
+			if err == nil {
+				err = fmt.Errorf("string too long")
+			}
+			return "", fmt.Errorf("read string at rva %#x: %w", rva, err)
+		}
+	}
+	return "", fmt.Errorf("rva %#x not in any section", rva)
+}
+
+// peFixOptions controls how peFixHeader fixes a modified PE image.
+type peFixOptions struct {
+	Timestamp      *uint32 // if non-nil, the file header timestamp is set to it
+	StripSignature bool    // remove the certificate table (which is invalid after patching anyway)
+}
+
+// peFixHeader updates the header of a PE image after it was modified. The
+// optional-header checksum is recomputed unless it was zero (i.e., not used).
+func peFixHeader(buf []byte, opt peFixOptions) ([]byte, error) {
+	oh, dirs, err := peHeaderOffsets(buf)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Timestamp != nil {
+		binary.LittleEndian.PutUint32(buf[oh-20+4:], *opt.Timestamp)
+	}
+	if opt.StripSignature && dirs+4+8*5 <= len(buf) && binary.LittleEndian.Uint32(buf[dirs:]) > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+		dd := dirs + 4 + 8*pe.IMAGE_DIRECTORY_ENTRY_SECURITY
+		if cert, size := int64(binary.LittleEndian.Uint32(buf[dd:])), int64(binary.LittleEndian.Uint32(buf[dd+4:])); cert != 0 && size != 0 {
+			// the certificate table is addressed by file offset, and is
+			// normally the overlay at the end of the file
+			if cert < int64(dirs) || cert+size > int64(len(buf)) {
+				return nil, fmt.Errorf("certificate table is outside the image")
+			}
+			if cert+size == int64(len(buf)) {
+				buf = buf[:cert]
+			} else {
+				clear(buf[cert : cert+size])
+			}
+			binary.LittleEndian.PutUint64(buf[dd:], 0)
+		}
+	}
+	if cs := oh + 64; binary.LittleEndian.Uint32(buf[cs:]) != 0 {
+		binary.LittleEndian.PutUint32(buf[cs:], peChecksum(buf, cs))
+	}
+	return buf, nil
+}
+
+// peHeaderOffsets finds the optional header of a PE image, and the
+// NumberOfRvaAndSizes field (which the data directories follow).
+func peHeaderOffsets(buf []byte) (oh, dirs int, err error) {
+	if len(buf) < 0x40 || string(buf[:2]) != "MZ" {
+		return 0, 0, fmt.Errorf("not a PE image")
+	}
+	off := int(binary.LittleEndian.Uint32(buf[0x3c:]))
+	if off < 0x40 || off+4+20+96 > len(buf) || string(buf[off:off+4]) != "PE\x00\x00" {
+		return 0, 0, fmt.Errorf("not a PE image")
+	}
+	oh = off + 4 + 20
+	switch magic := binary.LittleEndian.Uint16(buf[oh:]); magic {
+	case 0x10b:
+		dirs = oh + 92
+	case 0x20b:
+		dirs = oh + 108
+	default:
+		return 0, 0, fmt.Errorf("unknown optional header magic %#x", magic)
+	}
+	return oh, dirs, nil
+}
+
+// peSectionData finds the initialized data of a named section in a PE image,
+// returning the file offset and size (the smaller of the virtual and raw
+// sizes, so it doesn't include the file alignment padding).
+func peSectionData(buf []byte, name string) (off, size int, err error) {
+	oh, _, err := peHeaderOffsets(buf)
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		nsec = int(binary.LittleEndian.Uint16(buf[oh-20+2:]))
+		sec  = oh + int(binary.LittleEndian.Uint16(buf[oh-20+16:]))
+	)
+	if sec+40*nsec > len(buf) {
+		return 0, 0, fmt.Errorf("section table is outside the image")
+	}
+	found := -1
+	for i := range nsec {
+		sh := sec + 40*i
+		if string(bytes.TrimRight(buf[sh:sh+8], "\x00")) != name {
+			continue
+		}
+		if found != -1 {
+			return 0, 0, fmt.Errorf("multiple %s sections", name)
+		}
+		found = sh
+	}
+	if found == -1 {
+		return 0, 0, fmt.Errorf("no %s section", name)
+	}
+	var (
+		vs = int(binary.LittleEndian.Uint32(buf[found+8:]))
+		rs = int(binary.LittleEndian.Uint32(buf[found+16:]))
+		rp = int(binary.LittleEndian.Uint32(buf[found+20:]))
+	)
+	if vs == 0 {
+		vs = rs // some linkers don't set it
+	}
+	if size = min(vs, rs); rp+size > len(buf) {
+		return 0, 0, fmt.Errorf("%s section is outside the image", name)
+	}
+	return rp, size, nil
+}
+
+// peSetSubsystem changes the subsystem of a PE image between the GUI and
+// console ones, returning whether it was changed.
+func peSetSubsystem(buf []byte, subsystem uint16) (bool, error) {
+	oh, _, err := peHeaderOffsets(buf)
+	if err != nil {
+		return false, err
+	}
+	switch cur := binary.LittleEndian.Uint16(buf[oh+68:]); cur {
+	case subsystem:
+		return false, nil
+	case pe.IMAGE_SUBSYSTEM_WINDOWS_GUI, pe.IMAGE_SUBSYSTEM_WINDOWS_CUI:
+		binary.LittleEndian.PutUint16(buf[oh+68:], subsystem)
+		return true, nil
+	default:
+		return false, fmt.Errorf("not a GUI or console image (subsystem %d)", cur)
+	}
+}
+
+// peDllCharacteristicsPreferNative is the wine-specific DllCharacteristics
+// flag (set by winebuild --prefer-native) which makes the loader use a native
+// dll with the same name instead of the builtin one if the load order is the
+// default (i.e., there isn't a DllOverrides entry for it).
+const peDllCharacteristicsPreferNative = 0x0010
+
+// peSetPreferNative sets or clears the prefer-native flag of a wine builtin
+// PE image, returning whether it was changed.
+func peSetPreferNative(buf []byte, native bool) (bool, error) {
+	oh, _, err := peHeaderOffsets(buf)
+	if err != nil {
+		return false, err
+	}
+	if string(buf[0x40:0x51]) != "Wine builtin DLL\x00" {
+		return false, fmt.Errorf("not a wine builtin dll")
+	}
+	cur := binary.LittleEndian.Uint16(buf[oh+70:])
+	val := cur &^ peDllCharacteristicsPreferNative
+	if native {
+		val |= peDllCharacteristicsPreferNative
+	}
+	binary.LittleEndian.PutUint16(buf[oh+70:], val)
+	return val != cur, nil
+}
+
+// peStripDebugDirectory removes the debug directory of a PE image, zeroing the
+// entries and the data they point to (e.g., the CodeView record with the PDB
+// path), and truncating the data if it's after the sections at the end of the
+// file. It returns the number of entries removed.
+func peStripDebugDirectory(buf []byte) ([]byte, int, error) {
+	oh, dirs, err := peHeaderOffsets(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	dd := dirs + 4 + 8*pe.IMAGE_DIRECTORY_ENTRY_DEBUG
+	if dd+8 > len(buf) || binary.LittleEndian.Uint32(buf[dirs:]) <= pe.IMAGE_DIRECTORY_ENTRY_DEBUG {
+		return buf, 0, nil
+	}
+	rva, size := binary.LittleEndian.Uint32(buf[dd:]), int(binary.LittleEndian.Uint32(buf[dd+4:]))
+	if rva == 0 || size == 0 {
+		return buf, 0, nil
+	}
+	var (
+		nsec   = int(binary.LittleEndian.Uint16(buf[oh-20+2:]))
+		sec    = oh + int(binary.LittleEndian.Uint16(buf[oh-20+16:]))
+		off    = -1
+		rawEnd = sec + 40*nsec // end of the headers and section data
+	)
+	if rawEnd > len(buf) {
+		return nil, 0, fmt.Errorf("section table is outside the image")
+	}
+	for i := range nsec {
+		var (
+			sh = sec + 40*i
+			vs = binary.LittleEndian.Uint32(buf[sh+8:])
+			va = binary.LittleEndian.Uint32(buf[sh+12:])
+			rs = int(binary.LittleEndian.Uint32(buf[sh+16:]))
+			rp = int(binary.LittleEndian.Uint32(buf[sh+20:]))
+		)
+		if off == -1 && rva >= va && rva < va+vs {
+			off = rp + int(rva-va)
+		}
+		rawEnd = max(rawEnd, rp+rs)
+	}
+	if off == -1 || off+size > len(buf) {
+		return nil, 0, fmt.Errorf("debug directory is outside the image")
+	}
+	end := len(buf)
+	for i := off; i+28 <= off+size; i += 28 {
+		data, n := int(binary.LittleEndian.Uint32(buf[i+24:])), int(binary.LittleEndian.Uint32(buf[i+16:]))
+		if data != 0 && n != 0 {
+			if data < dirs || data+n > len(buf) {
+				return nil, 0, fmt.Errorf("debug data is outside the image")
+			}
+			if data >= rawEnd && data+n == len(buf) {
+				end = data // not part of a section
+			}
+			clear(buf[data : data+n])
+		}
+	}
+	clear(buf[off : off+size])
+	binary.LittleEndian.PutUint64(buf[dd:], 0)
+	return buf[:end], size / 28, nil
+}
+
+// peChecksum computes the optional-header checksum of a PE image (like
+// CheckSumMappedFile), skipping the checksum field at offset cs.
+func peChecksum(buf []byte, cs int) uint32 {
+	var sum uint64
+	for i := 0; i < len(buf); i += 2 {
+		if i == cs || i == cs+2 {
+			continue
+		}
+		w := uint64(buf[i])
+		if i+1 < len(buf) {
+			w |= uint64(buf[i+1]) << 8
+		}
+		sum += w
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return uint32(sum) + uint32(len(buf))
+}
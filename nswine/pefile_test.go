@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestPEFileHybrid(t *testing.T) {
+	for machine, exp := range map[uint16]uint16{
+		pe.IMAGE_FILE_MACHINE_AMD64: peMachineARM64EC,
+		pe.IMAGE_FILE_MACHINE_ARM64: peMachineARM64X,
+	} {
+		img, err := peStub(machine, "test.dll", []string{"Fn"})
+		if err != nil {
+			t.Fatalf("generate stub: %v", err)
+		}
+		if f, err := peNewFile(bytes.NewReader(img)); err != nil {
+			t.Fatalf("parse stub: %v", err)
+		} else if f.Machine != machine || f.CodeMap != nil {
+			t.Errorf("non-hybrid stub parsed as hybrid")
+		}
+
+		// add a section with the load config, arm64ec metadata, and an ARM64X
+		// relocation replacing the import directory for the ARM64EC view
+		const (
+			rva  = 0x2000
+			base = 0x180000000
+			dirs = 0x80 + 4 + 20 + 112
+		)
+		sect := make([]byte, 0x400)
+		le := binary.LittleEndian
+		le.PutUint32(sect[0x000:], 232)                // Size
+		le.PutUint64(sect[0x000+192:], base+rva+0x200) // DynamicValueRelocTable
+		le.PutUint64(sect[0x000+200:], base+rva+0x100) // CHPEMetadataPointer
+		le.PutUint32(sect[0x100:], 1)                  // Version
+		le.PutUint32(sect[0x104:], rva+0x180)          // CodeMap
+		le.PutUint32(sect[0x108:], 2)                  // CodeMapCount
+		le.PutUint32(sect[0x180:], 0x1000|1)           // ARM64EC
+		le.PutUint32(sect[0x184:], 0x80)
+		le.PutUint32(sect[0x188:], 0x1080|0) // ARM64
+		le.PutUint32(sect[0x18c:], 0x80)
+		le.PutUint32(sect[0x200:], 1)                                                    // Version
+		le.PutUint32(sect[0x204:], 12+20)                                                // Size
+		le.PutUint64(sect[0x208:], 6)                                                    // Symbol (IMAGE_DYNAMIC_RELOCATION_ARM64X)
+		le.PutUint32(sect[0x210:], 20)                                                   // BaseRelocSize
+		le.PutUint32(sect[0x214:], 0)                                                    // VirtualAddress
+		le.PutUint32(sect[0x218:], 20)                                                   // SizeOfBlock
+		le.PutUint16(sect[0x21c:], (dirs+8*pe.IMAGE_DIRECTORY_ENTRY_IMPORT)|1<<12|2<<14) // value, 4 bytes
+		le.PutUint32(sect[0x21e:], rva+0x300)
+		le.PutUint16(sect[0x222:], (dirs+8*pe.IMAGE_DIRECTORY_ENTRY_IMPORT+4)|1<<12|2<<14)
+		le.PutUint32(sect[0x224:], 40)
+		le.PutUint32(sect[0x300:], rva+0x340) // OriginalFirstThunk
+		le.PutUint32(sect[0x30c:], rva+0x360) // Name
+		le.PutUint32(sect[0x310:], rva+0x340) // FirstThunk
+		le.PutUint64(sect[0x340:], rva+0x370)
+		copy(sect[0x360:], "ec.dll\x00")
+		copy(sect[0x372:], "EcFn\x00") // after the hint
+		img = peAddSection(t, img, rva, sect)
+		le.PutUint32(img[0x80+4+20+112+8*pe.IMAGE_DIRECTORY_ENTRY_LOAD_CONFIG:], rva)
+		le.PutUint32(img[0x80+4+20+112+8*pe.IMAGE_DIRECTORY_ENTRY_LOAD_CONFIG+4:], 232)
+
+		name := filepath.Join(t.TempDir(), "test.dll")
+		if err := os.WriteFile(name, img, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := peOpen(name)
+		if err != nil {
+			t.Fatalf("parse hybrid stub: %v", err)
+		}
+		defer f.Close()
+
+		if f.Machine != exp {
+			t.Errorf("expected machine %#x, got %#x", exp, f.Machine)
+		}
+		if f.File.Machine != machine {
+			t.Errorf("file header machine changed")
+		}
+		if exp := []peCodeRange{
+			{0x1000, 0x80, peMachineARM64EC},
+			{0x1080, 0x80, pe.IMAGE_FILE_MACHINE_ARM64},
+		}; !reflect.DeepEqual(f.CodeMap, exp) {
+			t.Errorf("expected code map %v, got %v", exp, f.CodeMap)
+		}
+		if m := f.CodeMachine(0x1010); m != peMachineARM64EC {
+			t.Errorf("expected arm64ec code, got %#x", m)
+		}
+		if m := f.CodeMachine(0x1100); m != 0 {
+			t.Errorf("expected no code, got %#x", m)
+		}
+		if dd := f.DataDirectory(pe.IMAGE_DIRECTORY_ENTRY_IMPORT); dd.VirtualAddress == rva+0x300 {
+			t.Errorf("native import directory has ARM64X relocation applied")
+		}
+		if dd, exp := f.ECDataDirectory(pe.IMAGE_DIRECTORY_ENTRY_IMPORT), (pe.DataDirectory{VirtualAddress: rva + 0x300, Size: 40}); dd != exp {
+			t.Errorf("expected ARM64EC import directory %+v, got %+v", exp, dd)
+		}
+
+		libs, err := peImports(name)
+		if err != nil {
+			t.Fatalf("get imports: %v", err)
+		}
+		if exp := []string{"ec.dll"}; !reflect.DeepEqual(libs, exp) {
+			t.Errorf("expected imports %q, got %q", exp, libs)
+		}
+		syms, err := peImportedSymbols(name)
+		if err != nil {
+			t.Fatalf("get imported symbols: %v", err)
+		}
+		if exp := map[string][]string{"ec.dll": {"EcFn"}}; !reflect.DeepEqual(syms, exp) {
+			t.Errorf("expected imported symbols %q, got %q", exp, syms)
+		}
+	}
+}
+
+// peAddSection appends a section to a PE stub (which only has one section).
+func peAddSection(t *testing.T, img []byte, rva uint32, sect []byte) []byte {
+	t.Helper()
+
+	const (
+		ohOff = 0x80 + 4 + 20
+		shOff = ohOff + 240 + 40
+	)
+	raw := uint32(len(img))
+	img = append(img, sect...)
+
+	var sh bytes.Buffer
+	s := pe.SectionHeader32{
+		VirtualSize:      uint32(len(sect)),
+		VirtualAddress:   rva,
+		SizeOfRawData:    uint32(len(sect)),
+		PointerToRawData: raw,
+		Characteristics:  pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ,
+	}
+	copy(s.Name[:], ".rdata")
+	binary.Write(&sh, binary.LittleEndian, s)
+	copy(img[shOff:], sh.Bytes())
+	binary.LittleEndian.PutUint16(img[0x80+4+2:], 2)                                  // NumberOfSections
+	binary.LittleEndian.PutUint32(img[ohOff+56:], rva+uint32(len(sect)+0xfff)&^0xfff) // SizeOfImage
+	return img
+}
+
+func TestPEFixHeader(t *testing.T) {
+	img, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "test.dll", []string{"Fn"})
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+	const (
+		tsOff = 0x80 + 4 + 4
+		csOff = 0x80 + 4 + 20 + 64
+	)
+	le := binary.LittleEndian
+
+	le.PutUint32(img[csOff:], 0)
+	if img, err = peFixHeader(img, peFixOptions{}); err != nil {
+		t.Fatalf("fix header: %v", err)
+	}
+	if cs := le.Uint32(img[csOff:]); cs != 0 {
+		t.Errorf("expected unset checksum to be left alone, got %#x", cs)
+	}
+
+	le.PutUint32(img[csOff:], 1)
+	ts := uint32(1234)
+	if img, err = peFixHeader(img, peFixOptions{Timestamp: &ts}); err != nil {
+		t.Fatalf("fix header: %v", err)
+	}
+	if act := le.Uint32(img[tsOff:]); act != ts {
+		t.Errorf("expected timestamp %d, got %d", ts, act)
+	}
+	cs := le.Uint32(img[csOff:])
+	if cs == 0 || cs == 1 {
+		t.Errorf("checksum not updated")
+	}
+
+	for _, tc := range []struct {
+		Buf []byte
+		Cs  int
+		Exp uint32
+	}{
+		{[]byte{0x01, 0x00, 0x02, 0x00}, 8, 3 + 4},
+		{[]byte{0xff, 0xff, 0x02, 0x00, 0x05}, 8, 7 + 5},
+		{[]byte{0x01, 0x00, 0xaa, 0xaa, 0xbb, 0xbb, 0x02, 0x00}, 2, 3 + 8},
+	} {
+		if act := peChecksum(tc.Buf, tc.Cs); act != tc.Exp {
+			t.Errorf("checksum % x: expected %d, got %d", tc.Buf, tc.Exp, act)
+		}
+	}
+
+	img[0x200] ^= 0xff
+	if img, err = peFixHeader(img, peFixOptions{}); err != nil {
+		t.Fatalf("fix header: %v", err)
+	}
+	if act := le.Uint32(img[csOff:]); act == cs {
+		t.Errorf("checksum not updated after modification")
+	}
+	if act, exp := le.Uint32(img[csOff:]), peChecksum(img, csOff); act != exp {
+		t.Errorf("expected checksum %#x, got %#x", exp, act)
+	}
+
+	const secOff = 0x80 + 4 + 20 + 112 + 8*pe.IMAGE_DIRECTORY_ENTRY_SECURITY
+	n := len(img)
+	signed := append(slices.Clone(img), make([]byte, 0x40)...)
+	le.PutUint32(signed[secOff:], uint32(n))
+	le.PutUint32(signed[secOff+4:], 0x40)
+	if x, err := peFixHeader(slices.Clone(signed), peFixOptions{}); err != nil {
+		t.Fatalf("fix header: %v", err)
+	} else if len(x) != n+0x40 || le.Uint32(x[secOff:]) != uint32(n) {
+		t.Errorf("certificate table removed without StripSignature")
+	}
+	if x, err := peFixHeader(slices.Clone(signed), peFixOptions{StripSignature: true}); err != nil {
+		t.Fatalf("fix header: %v", err)
+	} else if len(x) != n || le.Uint64(x[secOff:]) != 0 {
+		t.Errorf("certificate table not removed")
+	} else if !bytes.Equal(x, img) {
+		t.Errorf("unsigned image differs after stripping signature")
+	}
+	le.PutUint32(signed[secOff+4:], 0x80)
+	if _, err := peFixHeader(signed, peFixOptions{StripSignature: true}); err == nil {
+		t.Errorf("expected error for out-of-bounds certificate table")
+	}
+
+	if _, err := peFixHeader([]byte("MZ not a pe file"), peFixOptions{}); err == nil {
+		t.Errorf("expected error for invalid image")
+	}
+}
+
+func TestPEFileVersion(t *testing.T) {
+	img, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "test.dll", []string{"Fn"})
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+	if f, err := peNewFile(bytes.NewReader(img)); err != nil {
+		t.Fatalf("parse stub: %v", err)
+	} else if v, err := f.Version(); err != nil || v != nil {
+		t.Errorf("expected no version for stub, got %v (err: %v)", v, err)
+	}
+
+	// add a resource section with a named resource (which should be skipped),
+	// and an RT_VERSION one
+	const rva = 0x2000
+	sect := make([]byte, 0x200)
+	le := binary.LittleEndian
+	dir := func(off int, named, ids uint16, ents ...uint32) {
+		le.PutUint16(sect[off+12:], named)
+		le.PutUint16(sect[off+14:], ids)
+		for i, x := range ents {
+			le.PutUint32(sect[off+16+i*4:], x)
+		}
+	}
+	dir(0x00, 1, 1, 0x80000000|0x90, 0x80000000|0x30, 16, 0x80000000|0x48) // type
+	dir(0x30, 0, 0)                                                        // named type (empty)
+	dir(0x48, 0, 1, 1, 0x80000000|0x60)                                    // name
+	dir(0x60, 0, 1, 0x409, 0x78)                                           // language
+	le.PutUint32(sect[0x78:], rva+0x100)                                   // data rva
+	le.PutUint32(sect[0x7c:], 92)                                          // data size
+
+	vi := sect[0x100:]
+	le.PutUint16(vi[0:], 92) // wLength
+	le.PutUint16(vi[2:], 52) // wValueLength
+	copy(vi[6:], u8to16[string, []byte]("VS_VERSION_INFO\x00"))
+	le.PutUint32(vi[40:], 0xfeef04bd)
+	le.PutUint32(vi[48:], 10<<16|0)
+	le.PutUint32(vi[52:], 1<<16|2)
+	le.PutUint32(vi[56:], 10<<16|0)
+	le.PutUint32(vi[60:], 0)
+
+	img = peAddSection(t, img, rva, sect)
+	le.PutUint32(img[0x80+4+20+112+8*pe.IMAGE_DIRECTORY_ENTRY_RESOURCE:], rva)
+	le.PutUint32(img[0x80+4+20+112+8*pe.IMAGE_DIRECTORY_ENTRY_RESOURCE+4:], uint32(len(sect)))
+
+	name := filepath.Join(t.TempDir(), "test.dll")
+	if err := os.WriteFile(name, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, err := peFileVersion(name)
+	if err != nil {
+		t.Fatalf("get version: %v", err)
+	}
+	if exp := (&peVersion{File: "10.0.1.2", Product: "10.0.0.0"}); !reflect.DeepEqual(v, exp) {
+		t.Errorf("expected version %+v, got %+v", exp, v)
+	}
+}
+
+func TestPESetSubsystem(t *testing.T) {
+	img, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "test.exe", nil)
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+	const ssOff = 0x80 + 4 + 20 + 68
+	le := binary.LittleEndian
+
+	le.PutUint16(img[ssOff:], pe.IMAGE_SUBSYSTEM_WINDOWS_GUI)
+	for _, tc := range []struct {
+		To      uint16
+		Changed bool
+	}{
+		{pe.IMAGE_SUBSYSTEM_WINDOWS_CUI, true},
+		{pe.IMAGE_SUBSYSTEM_WINDOWS_CUI, false},
+		{pe.IMAGE_SUBSYSTEM_WINDOWS_GUI, true},
+	} {
+		if changed, err := peSetSubsystem(img, tc.To); err != nil {
+			t.Fatalf("set subsystem %d: %v", tc.To, err)
+		} else if changed != tc.Changed {
+			t.Errorf("set subsystem %d: expected changed=%t", tc.To, tc.Changed)
+		}
+		if f, err := pe.NewFile(bytes.NewReader(img)); err != nil {
+			t.Fatalf("parse: %v", err)
+		} else if act := f.OptionalHeader.(*pe.OptionalHeader64).Subsystem; act != tc.To {
+			t.Errorf("expected subsystem %d, got %d", tc.To, act)
+		}
+	}
+
+	le.PutUint16(img[ssOff:], pe.IMAGE_SUBSYSTEM_NATIVE)
+	if _, err := peSetSubsystem(img, pe.IMAGE_SUBSYSTEM_WINDOWS_CUI); err == nil {
+		t.Errorf("expected error for native image")
+	}
+}
+
+func TestPEStripDebugDirectory(t *testing.T) {
+	img, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "test.dll", nil)
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+	const (
+		dbgOff = 0x80 + 4 + 20 + 112 + 8*pe.IMAGE_DIRECTORY_ENTRY_DEBUG
+		vsOff  = 0x80 + 4 + 20 + 240 + 8
+	)
+	le := binary.LittleEndian
+
+	if _, n, err := peStripDebugDirectory(slices.Clone(img)); err != nil || n != 0 {
+		t.Errorf("expected nothing to be stripped without a debug directory, got %d (err: %v)", n, err)
+	}
+
+	// put the directory and a codeview record in the .text padding, and a
+	// repro record after the section
+	le.PutUint32(img[vsOff:], 0x200)
+	cv := append([]byte("RSDS"), make([]byte, 20)...)
+	cv = append(cv, `C:\build\test.pdb`+"\x00"...)
+	copy(img[0x300:], cv)
+	n := len(img)
+	img = append(img, 0xaa, 0xbb, 0xcc, 0xdd)
+	ent := func(i, typ, size, ptr int) {
+		le.PutUint32(img[0x2c0+28*i+12:], uint32(typ))
+		le.PutUint32(img[0x2c0+28*i+16:], uint32(size))
+		le.PutUint32(img[0x2c0+28*i+20:], uint32(0x1000+ptr-0x200))
+		le.PutUint32(img[0x2c0+28*i+24:], uint32(ptr))
+	}
+	ent(0, 2, len(cv), 0x300)
+	ent(1, 16, 4, n)
+	le.PutUint32(img[dbgOff:], 0x10c0)
+	le.PutUint32(img[dbgOff+4:], 2*28)
+
+	if _, err := pe.NewFile(bytes.NewReader(img)); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	img, cnt, err := peStripDebugDirectory(img)
+	if err != nil {
+		t.Fatalf("strip: %v", err)
+	}
+	if cnt != 2 {
+		t.Errorf("expected 2 entries to be removed, got %d", cnt)
+	}
+	if len(img) != n {
+		t.Errorf("expected trailing debug data to be truncated")
+	}
+	if bytes.Contains(img, []byte("test.pdb")) || bytes.Contains(img, []byte("RSDS")) {
+		t.Errorf("codeview record not removed")
+	}
+	if le.Uint64(img[dbgOff:]) != 0 {
+		t.Errorf("debug data directory not cleared")
+	}
+	if !bytes.Equal(img[0x2c0:0x2c0+2*28], make([]byte, 2*28)) {
+		t.Errorf("debug directory entries not cleared")
+	}
+	if _, err := pe.NewFile(bytes.NewReader(img)); err != nil {
+		t.Errorf("parse stripped image: %v", err)
+	}
+
+	le.PutUint32(img[dbgOff:], 0x5000)
+	le.PutUint32(img[dbgOff+4:], 28)
+	if _, _, err := peStripDebugDirectory(img); err == nil {
+		t.Errorf("expected error for debug directory outside any section")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// peImport is a library imported by a PE file.
+type peImport struct {
+	DLL      string
+	Symbols  []string // imports by ordinal are not included
+	Ordinals []uint16 // imports by ordinal
+}
+
+// peModule checks whether a file in the wine PE dir is a module which imports
+// other modules or can be imported itself, and so needs to be removed if it
+// depends on a removed module. Drivers and codecs can import removed dlls too,
+// and they can be imported themselves (e.g., winspool.drv).
+func peModule(name string) bool {
+	switch filepath.Ext(name) {
+	case ".dll", ".exe", ".sys", ".drv", ".ocx", ".acm", ".ax":
+		return true
+	}
+	return false
+}
+
+// peImportDirectory parses an import directory of a PE file.
+func peImportDirectory(f *pe.File, dd pe.DataDirectory) ([]peImport, error) {
+	if dd.VirtualAddress == 0 {
+		return nil, nil
+	}
+	_, is64 := f.OptionalHeader.(*pe.OptionalHeader64)
+	var imps []peImport
+	for off := uint32(0); ; off += 20 {
+		desc, err := peReadRVA(f, dd.VirtualAddress+off, 20)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			iltRVA  = binary.LittleEndian.Uint32(desc[0:])
+			nameRVA = binary.LittleEndian.Uint32(desc[12:])
+			iatRVA  = binary.LittleEndian.Uint32(desc[16:])
+		)
+		if nameRVA == 0 {
+			break
+		}
+		dll, err := peReadString(f, nameRVA)
+		if err != nil {
+			return nil, err
+		}
+		if iltRVA == 0 {
+			iltRVA = iatRVA // some linkers don't emit the lookup table
+		}
+		syms, ords, err := peThunkSymbols(f, iltRVA, is64, func(v uint64) uint32 { return uint32(v) })
+		if err != nil {
+			return nil, err
+		}
+		imps = append(imps, peImport{DLL: dll, Symbols: syms, Ordinals: ords})
+	}
+	return imps, nil
+}
+
+// peDelayImports parses a delay-load import directory of a PE file.
+func peDelayImports(f *pe.File, dd pe.DataDirectory) ([]peImport, error) {
+	var (
+		base uint64
+		is64 bool
+	)
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader64:
+		base, is64 = oh.ImageBase, true
+	case *pe.OptionalHeader32:
+		base = uint64(oh.ImageBase)
+	}
+	if dd.VirtualAddress == 0 {
+		return nil, nil
+	}
+	var imps []peImport
+	for off := uint32(0); ; off += 32 {
+		desc, err := peReadRVA(f, dd.VirtualAddress+off, 32)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			attrs   = binary.LittleEndian.Uint32(desc[0:])
+			nameRVA = binary.LittleEndian.Uint32(desc[4:])
+			intRVA  = binary.LittleEndian.Uint32(desc[16:])
+		)
+		if nameRVA == 0 {
+			break
+		}
+		rva := func(v uint64) uint32 {
+			if attrs&1 == 0 {
+				v -= base // old-style descriptors (pre-VC7) use VAs
+			}
+			return uint32(v)
+		}
+		dll, err := peReadString(f, rva(uint64(nameRVA)))
+		if err != nil {
+			return nil, err
+		}
+		syms, ords, err := peThunkSymbols(f, rva(uint64(intRVA)), is64, rva)
+		if err != nil {
+			return nil, err
+		}
+		imps = append(imps, peImport{DLL: dll, Symbols: syms, Ordinals: ords})
+	}
+	return imps, nil
+}
+
+// peThunkSymbols reads the names and ordinals from a null-terminated import
+// name table at thunks, where rva converts a hint/name thunk to an rva.
+func peThunkSymbols(f *pe.File, thunks uint32, is64 bool, rva func(uint64) uint32) ([]string, []uint16, error) {
+	if thunks == 0 {
+		return nil, nil, nil
+	}
+	size := uint32(4)
+	if is64 {
+		size = 8
+	}
+	var (
+		syms []string
+		ords []uint16
+	)
+	for i := uint32(0); ; i += size {
+		buf, err := peReadRVA(f, thunks+i, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		var v uint64
+		var ordinal bool
+		if is64 {
+			v = binary.LittleEndian.Uint64(buf)
+			ordinal = v&(1<<63) != 0
+		} else {
+			v = uint64(binary.LittleEndian.Uint32(buf))
+			ordinal = v&(1<<31) != 0
+		}
+		if v == 0 {
+			break
+		}
+		if ordinal {
+			ords = append(ords, uint16(v))
+			continue
+		}
+		sym, err := peReadString(f, rva(v)+2) // skip the hint
+		if err != nil {
+			return nil, nil, err
+		}
+		syms = append(syms, sym)
+	}
+	return syms, ords, nil
+}
+
+// peMergeImports appends the imports in b to a, merging libraries
+// case-insensitively.
+func peMergeImports(a, b []peImport) []peImport {
+	for _, imp := range b {
+		i := slices.IndexFunc(a, func(x peImport) bool {
+			return strings.EqualFold(x.DLL, imp.DLL)
+		})
+		if i == -1 {
+			a = append(a, peImport{DLL: imp.DLL, Symbols: slices.Clone(imp.Symbols), Ordinals: slices.Clone(imp.Ordinals)})
+			continue
+		}
+		for _, sym := range imp.Symbols {
+			if !slices.Contains(a[i].Symbols, sym) {
+				a[i].Symbols = append(a[i].Symbols, sym)
+			}
+		}
+		for _, ord := range imp.Ordinals {
+			if !slices.Contains(a[i].Ordinals, ord) {
+				a[i].Ordinals = append(a[i].Ordinals, ord)
+			}
+		}
+	}
+	return a
+}
+
+// peBoundImports parses the bound import directory of a PE file, returning the
+// bound libraries and the libraries they forward to.
+func peBoundImports(f *pe.File, r io.ReaderAt) ([]string, error) {
+	dd := peDataDirectory(f, pe.IMAGE_DIRECTORY_ENTRY_BOUND_IMPORT)
+	if dd.VirtualAddress == 0 || dd.Size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, dd.Size)
+	if _, err := r.ReadAt(buf, int64(dd.VirtualAddress)); err != nil { // it's a file offset, not an rva
+		return nil, err
+	}
+	name := func(off uint16) (string, error) {
+		if int(off) >= len(buf) {
+			return "", fmt.Errorf("module name offset %#x out of range", off)
+		}
+		s, _, _ := bytes.Cut(buf[off:], []byte{0})
+		return string(s), nil
+	}
+	var libs []string
+	for i := 0; i+8 <= len(buf); {
+		var (
+			ts   = binary.LittleEndian.Uint32(buf[i:])
+			off  = binary.LittleEndian.Uint16(buf[i+4:])
+			nref = binary.LittleEndian.Uint16(buf[i+6:])
+		)
+		if ts == 0 && off == 0 && nref == 0 {
+			break
+		}
+		i += 8
+		lib, err := name(off)
+		if err != nil {
+			return nil, err
+		}
+		libs = append(libs, lib)
+		for range nref {
+			if i+8 > len(buf) {
+				return nil, fmt.Errorf("truncated forwarder references")
+			}
+			lib, err := name(binary.LittleEndian.Uint16(buf[i+4:]))
+			if err != nil {
+				return nil, err
+			}
+			libs = append(libs, lib)
+			i += 8
+		}
+	}
+	return libs, nil
+}
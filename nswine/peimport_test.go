@@ -0,0 +1,197 @@
+package main
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPEImports(t *testing.T) {
+	img, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "test.dll", []string{"Fn"})
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+
+	// add a section with a delay-load import directory and a bound import
+	// directory
+	const (
+		rva      = 0x2000
+		ohOff    = 0x80 + 4 + 20
+		boundOff = 0x180
+	)
+	raw := uint32(len(img))
+	sect := make([]byte, 0x200)
+	le := binary.LittleEndian
+	le.PutUint32(sect[0x00:], 1)          // Attributes (rvas)
+	le.PutUint32(sect[0x04:], rva+0x100)  // DllNameRVA
+	le.PutUint32(sect[0x10:], rva+0x80)   // ImportNameTableRVA
+	le.PutUint64(sect[0x80:], rva+0x120)  // by name
+	le.PutUint64(sect[0x88:], 1<<63|5)    // by ordinal
+	copy(sect[0x100:], "delayed.dll\x00") // DllName
+	copy(sect[0x122:], "DelayedFn\x00")   // after the hint
+	le.PutUint32(sect[boundOff+0:], 1)    // TimeDateStamp
+	le.PutUint16(sect[boundOff+4:], 24)   // OffsetModuleName
+	le.PutUint16(sect[boundOff+6:], 1)    // NumberOfModuleForwarderRefs
+	le.PutUint32(sect[boundOff+8:], 1)    // TimeDateStamp
+	le.PutUint16(sect[boundOff+12:], 34)  // OffsetModuleName
+	copy(sect[boundOff+24:], "bound.dll\x00fwd.dll\x00")
+	img = peAddSection(t, img, rva, sect)
+
+	le.PutUint32(img[ohOff+112+8*pe.IMAGE_DIRECTORY_ENTRY_DELAY_IMPORT:], rva) // VirtualAddress
+	le.PutUint32(img[ohOff+112+8*pe.IMAGE_DIRECTORY_ENTRY_DELAY_IMPORT+4:], 64)
+	le.PutUint32(img[ohOff+112+8*pe.IMAGE_DIRECTORY_ENTRY_BOUND_IMPORT:], raw+boundOff) // file offset
+	le.PutUint32(img[ohOff+112+8*pe.IMAGE_DIRECTORY_ENTRY_BOUND_IMPORT+4:], 64)
+
+	name := filepath.Join(t.TempDir(), "test.dll")
+	if err := os.WriteFile(name, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	libs, err := peImports(name)
+	if err != nil {
+		t.Fatalf("get imports: %v", err)
+	}
+	if exp := []string{"delayed.dll", "bound.dll", "fwd.dll"}; !reflect.DeepEqual(libs, exp) {
+		t.Errorf("expected imports %q, got %q", exp, libs)
+	}
+
+	syms, err := peImportedSymbols(name)
+	if err != nil {
+		t.Fatalf("get imported symbols: %v", err)
+	}
+	if exp := map[string][]string{"delayed.dll": {"DelayedFn"}}; !reflect.DeepEqual(syms, exp) {
+		t.Errorf("expected imported symbols %q, got %q", exp, syms)
+	}
+	sc, err := peScanFile(name)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if exp := map[string][]uint16{"delayed.dll": {5}}; !reflect.DeepEqual(sc.Ordinals, exp) {
+		t.Errorf("expected imported ordinals %v, got %v", exp, sc.Ordinals)
+	}
+
+	stubImps, err := peStubImports(name)
+	if err != nil {
+		t.Fatalf("get stub imports: %v", err)
+	}
+	if exp := map[string][]string{"delayed.dll": {"DelayedFn", "#5"}}; !reflect.DeepEqual(stubImps, exp) {
+		t.Errorf("expected stub imports %q, got %q", exp, stubImps)
+	}
+
+	// the ordinal must be exported by delayed.dll if it's there
+	dir := filepath.Dir(name)
+	if bad, err := unresolvedOrdinals(dir, nil); err != nil || len(bad) != 0 {
+		t.Errorf("expected imports from missing modules to be ignored, got %q (err: %v)", bad, err)
+	}
+	for _, tc := range []struct {
+		Exports []string
+		Bad     []string
+	}{
+		{[]string{"A", "B", "C", "D"}, []string{"test.dll: delayed.dll#5"}},
+		{[]string{"A", "B", "C", "D", "E"}, nil},
+		{stubImps["delayed.dll"], nil}, // a stub generated for the importer
+	} {
+		stub, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "delayed.dll", tc.Exports)
+		if err != nil {
+			t.Fatalf("generate stub: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "delayed.dll"), stub, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if sc, err := peScanFile(filepath.Join(dir, "delayed.dll")); err != nil || len(sc.Exports) != len(tc.Exports) {
+			t.Errorf("expected %d exported ordinals, got %v (err: %v)", len(tc.Exports), sc, err)
+		}
+		if bad, err := unresolvedOrdinals(dir, nil); err != nil {
+			t.Errorf("check ordinals: %v", err)
+		} else if !reflect.DeepEqual(bad, tc.Bad) {
+			t.Errorf("expected unresolved ordinals %q, got %q", tc.Bad, bad)
+		}
+	}
+}
+
+func TestPEForwarders(t *testing.T) {
+	img, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "test.dll", []string{"Fn"})
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+
+	// replace the export directory with one which has forwarders
+	const (
+		rva   = 0x2000
+		ohOff = 0x80 + 4 + 20
+	)
+	sect := make([]byte, 0x200)
+	le := binary.LittleEndian
+	le.PutUint32(sect[0x10:], 1)         // Base
+	le.PutUint32(sect[0x14:], 4)         // NumberOfFunctions
+	le.PutUint32(sect[0x18:], 2)         // NumberOfNames
+	le.PutUint32(sect[0x1c:], rva+0x40)  // AddressOfFunctions
+	le.PutUint32(sect[0x20:], rva+0x60)  // AddressOfNames
+	le.PutUint32(sect[0x24:], rva+0x70)  // AddressOfNameOrdinals
+	le.PutUint32(sect[0x40:], rva+0x100) // forwarder by name
+	le.PutUint32(sect[0x44:], rva+0x120) // forwarder by ordinal
+	le.PutUint32(sect[0x48:], 0x1000)    // not a forwarder
+	le.PutUint32(sect[0x4c:], rva+0x140) // forwarder to an apiset
+	le.PutUint32(sect[0x60:], rva+0x180)
+	le.PutUint32(sect[0x64:], rva+0x190)
+	le.PutUint16(sect[0x70:], 0)
+	le.PutUint16(sect[0x72:], 2)
+	copy(sect[0x100:], "NTDLL.RtlFoo\x00")
+	copy(sect[0x120:], "KERNELBASE.#5\x00")
+	copy(sect[0x140:], "api-ms-win-core-test-l1-1-0.Foo\x00")
+	copy(sect[0x180:], "Fwd\x00")
+	copy(sect[0x190:], "Real\x00")
+	img = peAddSection(t, img, rva, sect)
+
+	le.PutUint32(img[ohOff+112+8*pe.IMAGE_DIRECTORY_ENTRY_EXPORT:], rva)
+	le.PutUint32(img[ohOff+112+8*pe.IMAGE_DIRECTORY_ENTRY_EXPORT+4:], 0x180)
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "test.dll")
+	if err := os.WriteFile(name, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fwds, err := peForwarders(name)
+	if err != nil {
+		t.Fatalf("get forwarders: %v", err)
+	}
+	if exp := map[string][]string{
+		"ntdll.dll":                       {"RtlFoo"},
+		"kernelbase.dll":                  nil,
+		"api-ms-win-core-test-l1-1-0.dll": {"Foo"},
+	}; !reflect.DeepEqual(fwds, exp) {
+		t.Errorf("expected forwarders %q, got %q", exp, fwds)
+	}
+
+	g, err := peGraph(dir)
+	if err != nil {
+		t.Fatalf("build graph: %v", err)
+	}
+	if exp := []string{"api-ms-win-core-test-l1-1-0.dll", "kernelbase.dll", "ntdll.dll"}; !reflect.DeepEqual(g.Deps["test.dll"], exp) {
+		t.Errorf("expected graph deps %q, got %q", exp, g.Deps["test.dll"])
+	}
+}
+
+func TestPEModule(t *testing.T) {
+	for name, exp := range map[string]bool{
+		"kernel32.dll":     true,
+		"winedbg.exe":      true,
+		"mountmgr.sys":     true,
+		"winspool.drv":     true,
+		"msxml3.ocx":       true,
+		"msadp32.acm":      true,
+		"quartz.ax":        true,
+		"kernel32.so":      false,
+		"wine.inf":         false,
+		"l_intl.nls":       false,
+		"msacm32.dll.orig": false,
+	} {
+		if act := peModule(name); act != exp {
+			t.Errorf("%q: expected %t, got %t", name, exp, act)
+		}
+	}
+}
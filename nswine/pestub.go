@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// peStub generates a minimal PE32+ DLL (marked as a wine builtin) named name
+// which exports the specified functions. All exported functions return zero.
+// Names starting with "#" are exported by ordinal only.
+func peStub(machine uint16, name string, exports []string) ([]byte, error) {
+	return peStubResult(machine, name, exports, 0)
+}
+
+// peStubResult is like peStub, but the exported functions return the specified
+// 32-bit value (e.g., a failure HRESULT) instead of zero.
+func peStubResult(machine uint16, name string, exports []string, result uint32) ([]byte, error) {
+	var code []byte
+	switch machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		if result == 0 {
+			code = append(code, 0x31, 0xC0) // xor eax, eax
+		} else {
+			code = binary.LittleEndian.AppendUint32(append(code, 0xB8), result) // mov eax, imm32
+		}
+		code = append(code, 0xC3) // ret
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		if result == 0 {
+			code = binary.LittleEndian.AppendUint32(code, 0xD2800000) // mov x0, #0
+		} else {
+			code = binary.LittleEndian.AppendUint32(code, 0x52800000|(result&0xFFFF)<<5)     // movz w0, #lo
+			code = binary.LittleEndian.AppendUint32(code, 0x72A00000|(result>>16&0xFFFF)<<5) // movk w0, #hi, lsl #16
+		}
+		code = binary.LittleEndian.AppendUint32(code, 0xD65F03C0) // ret
+	default:
+		return nil, fmt.Errorf("unsupported machine %#x", machine)
+	}
+
+	const (
+		fileAlign = 0x200
+		sectAlign = 0x1000
+		textRVA   = sectAlign
+		hdrSize   = fileAlign
+		lfanew    = 0x80
+	)
+
+	// figure out the ordinals
+	var (
+		names    []string
+		ordinals = map[uint32]bool{}
+	)
+	for _, x := range exports {
+		if x, ok := strings.CutPrefix(x, "#"); ok {
+			var n uint32
+			if _, err := fmt.Sscan(x, &n); err != nil || n == 0 || n > 0xFFFF {
+				return nil, fmt.Errorf("invalid ordinal %q", x)
+			}
+			ordinals[n] = true
+			continue
+		}
+		if !slices.Contains(names, x) {
+			names = append(names, x)
+		}
+	}
+	slices.Sort(names) // the loader binary-searches the name table
+	nameOrdinal := map[string]uint32{}
+	var next uint32 = 1
+	for _, x := range names {
+		for ordinals[next] {
+			next++
+		}
+		nameOrdinal[x] = next
+		ordinals[next] = true
+	}
+	var nfuncs uint32
+	for n := range ordinals {
+		nfuncs = max(nfuncs, n)
+	}
+
+	// build the .text section (code, then the export directory)
+	var text bytes.Buffer
+	text.Write(code)
+	for text.Len()%8 != 0 {
+		text.WriteByte(0xCC)
+	}
+	var (
+		edirRVA    = textRVA + uint32(text.Len())
+		funcsRVA   = edirRVA + 40
+		namesRVA   = funcsRVA + 4*nfuncs
+		ordsRVA    = namesRVA + 4*uint32(len(names))
+		strRVA     = ordsRVA + 2*uint32(len(names))
+		strs       bytes.Buffer
+		nameRVAs   []uint32
+		dllNameRVA = strRVA
+	)
+	strs.WriteString(name + "\x00")
+	for _, x := range names {
+		nameRVAs = append(nameRVAs, strRVA+uint32(strs.Len()))
+		strs.WriteString(x + "\x00")
+	}
+	w := func(v any) {
+		binary.Write(&text, binary.LittleEndian, v)
+	}
+	w(uint32(0))          // Characteristics
+	w(uint32(0))          // TimeDateStamp
+	w(uint16(0))          // MajorVersion
+	w(uint16(0))          // MinorVersion
+	w(dllNameRVA)         // Name
+	w(uint32(1))          // Base
+	w(nfuncs)             // NumberOfFunctions
+	w(uint32(len(names))) // NumberOfNames
+	w(funcsRVA)           // AddressOfFunctions
+	w(namesRVA)           // AddressOfNames
+	w(ordsRVA)            // AddressOfNameOrdinals
+	for n := uint32(1); n <= nfuncs; n++ {
+		if ordinals[n] {
+			w(uint32(textRVA))
+		} else {
+			w(uint32(0))
+		}
+	}
+	for _, rva := range nameRVAs {
+		w(rva)
+	}
+	for _, x := range names {
+		w(uint16(nameOrdinal[x] - 1))
+	}
+	text.Write(strs.Bytes())
+	edirSize := uint32(text.Len()) - (edirRVA - textRVA)
+
+	var (
+		textVirt = uint32(text.Len())
+		textRaw  = (textVirt + fileAlign - 1) &^ (fileAlign - 1)
+	)
+	for uint32(text.Len()) < textRaw {
+		text.WriteByte(0)
+	}
+
+	// build the image
+	var img bytes.Buffer
+	w = func(v any) {
+		binary.Write(&img, binary.LittleEndian, v)
+	}
+	dos := make([]byte, lfanew)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3C:], lfanew)
+	copy(dos[0x40:], "Wine builtin DLL\x00")
+	img.Write(dos)
+	img.WriteString("PE\x00\x00")
+	w(pe.FileHeader{
+		Machine:              machine,
+		NumberOfSections:     1,
+		SizeOfOptionalHeader: uint16(binary.Size(pe.OptionalHeader64{})),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE | pe.IMAGE_FILE_LARGE_ADDRESS_AWARE | pe.IMAGE_FILE_DLL,
+	})
+	oh := pe.OptionalHeader64{
+		Magic:                       0x20B,
+		MajorLinkerVersion:          2,
+		SizeOfCode:                  textRaw,
+		BaseOfCode:                  textRVA,
+		ImageBase:                   0x180000000,
+		SectionAlignment:            sectAlign,
+		FileAlignment:               fileAlign,
+		MajorOperatingSystemVersion: 6,
+		MajorSubsystemVersion:       6,
+		SizeOfImage:                 textRVA + (textVirt+sectAlign-1)&^(sectAlign-1),
+		SizeOfHeaders:               hdrSize,
+		Subsystem:                   pe.IMAGE_SUBSYSTEM_WINDOWS_CUI,
+		DllCharacteristics:          pe.IMAGE_DLLCHARACTERISTICS_HIGH_ENTROPY_VA | pe.IMAGE_DLLCHARACTERISTICS_DYNAMIC_BASE | pe.IMAGE_DLLCHARACTERISTICS_NX_COMPAT,
+		SizeOfStackReserve:          0x100000,
+		SizeOfStackCommit:           0x1000,
+		SizeOfHeapReserve:           0x100000,
+		SizeOfHeapCommit:            0x1000,
+		NumberOfRvaAndSizes:         16,
+	}
+	oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_EXPORT] = pe.DataDirectory{
+		VirtualAddress: edirRVA,
+		Size:           edirSize,
+	}
+	w(oh)
+	sh := pe.SectionHeader32{
+		VirtualSize:      textVirt,
+		VirtualAddress:   textRVA,
+		SizeOfRawData:    textRaw,
+		PointerToRawData: hdrSize,
+		Characteristics:  pe.IMAGE_SCN_CNT_CODE | pe.IMAGE_SCN_MEM_EXECUTE | pe.IMAGE_SCN_MEM_READ,
+	}
+	copy(sh.Name[:], ".text")
+	w(sh)
+	if img.Len() > hdrSize {
+		panic("headers too large")
+	}
+	for img.Len() < hdrSize {
+		img.WriteByte(0)
+	}
+	img.Write(text.Bytes())
+	return img.Bytes(), nil
+}
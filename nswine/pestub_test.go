@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"slices"
+	"testing"
+)
+
+func TestPEStub(t *testing.T) {
+	for _, machine := range []uint16{pe.IMAGE_FILE_MACHINE_AMD64, pe.IMAGE_FILE_MACHINE_ARM64} {
+		buf, err := peStub(machine, "test.dll", []string{"b", "#3", "a", "c", "a"})
+		if err != nil {
+			t.Fatalf("generate stub: %v", err)
+		}
+		if !bytes.Equal(buf[0x40:0x51], []byte("Wine builtin DLL\x00")) {
+			t.Errorf("missing wine builtin signature")
+		}
+
+		f, err := pe.NewFile(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("parse stub: %v", err)
+		}
+		if f.Machine != machine {
+			t.Errorf("wrong machine %#x", f.Machine)
+		}
+		if f.Characteristics&pe.IMAGE_FILE_DLL == 0 {
+			t.Errorf("not a dll")
+		}
+
+		pf, err := peNewFile(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("parse stub: %v", err)
+		}
+		exps, err := pf.Exports()
+		if err != nil {
+			t.Fatalf("parse stub exports: %v", err)
+		}
+		if len(exps) == 0 {
+			t.Fatalf("missing exports")
+		}
+		var names []string
+		ordinals := map[string]uint16{}
+		for _, exp := range exps {
+			if exp.Name != "" {
+				names = append(names, exp.Name)
+				ordinals[exp.Name] = exp.Ordinal
+			}
+		}
+		if exp := []string{"a", "b", "c"}; !slices.Equal(names, exp) {
+			t.Errorf("expected exports %q, got %q", exp, names)
+		}
+		if ordinals["a"] == 3 || ordinals["b"] == 3 || ordinals["c"] == 3 {
+			t.Errorf("named export assigned to explicit ordinal: %v", ordinals)
+		}
+	}
+	if _, err := peStub(pe.IMAGE_FILE_MACHINE_I386, "test.dll", nil); err == nil {
+		t.Errorf("expected error for unsupported machine")
+	}
+	if _, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "test.dll", []string{"#0"}); err == nil {
+		t.Errorf("expected error for invalid ordinal")
+	}
+}
+
+func TestPEStubResult(t *testing.T) {
+	for _, tc := range []struct {
+		machine uint16
+		result  uint32
+		code    []byte
+	}{
+		{pe.IMAGE_FILE_MACHINE_AMD64, 0, []byte{0x31, 0xC0, 0xC3}},
+		{pe.IMAGE_FILE_MACHINE_AMD64, 0x887A0004, []byte{0xB8, 0x04, 0x00, 0x7A, 0x88, 0xC3}},
+		{pe.IMAGE_FILE_MACHINE_ARM64, 0x887A0004, []byte{0x80, 0x00, 0x80, 0x52, 0x40, 0x0F, 0xB1, 0x72, 0xC0, 0x03, 0x5F, 0xD6}},
+	} {
+		buf, err := peStubResult(tc.machine, "test.dll", []string{"a"}, tc.result)
+		if err != nil {
+			t.Fatalf("generate stub: %v", err)
+		}
+		f, err := pe.NewFile(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("parse stub: %v", err)
+		}
+		text, err := f.Section(".text").Data()
+		if err != nil {
+			t.Fatalf("read stub code: %v", err)
+		}
+		if !bytes.HasPrefix(text, tc.code) {
+			t.Errorf("machine %#x result %#x: expected code % x, got % x", tc.machine, tc.result, tc.code, text[:len(tc.code)])
+		}
+	}
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+//go:embed profiles/*.json
+var builtinProfiles embed.FS
+
+// Profile configures what ends up in the runtime. Profiles can extend another
+// profile, in which case list entries are added to the inherited ones, and
+// list entries prefixed with "-" remove an inherited entry. Registry values
+// set to null remove an inherited value.
+type Profile struct {
+	// Extends is the name of a built-in profile, a path (relative to the
+	// profile) to a profile JSON file, or a remote profile reference.
+	Extends string `json:"extends,omitempty"`
+
+	// Keep is a list of case-insensitive globs for wine files which must not
+	// be removed by -optimize.
+	Keep []string `json:"keep,omitempty"`
+
+	// Remove is a list of case-insensitive globs for additional wine files
+	// to remove with -optimize.
+	Remove []string `json:"remove,omitempty"`
+
+	// RemoveServices is a list of case-insensitive globs for services (by
+	// name or INF install section) to remove from wine.inf. Services whose
+	// binary is missing are always removed.
+	RemoveServices []string `json:"remove_services,omitempty"`
+
+	// Roots is a list of case-insensitive globs for wine modules which must
+	// be kept with -closure, along with everything they import. Kept files and
+	// the module names in Verify are also roots.
+	Roots []string `json:"roots,omitempty"`
+
+	// RootImports is a list of paths to PE files (e.g., the game executable)
+	// whose imports are roots for -closure. Relative paths are resolved
+	// against the current directory.
+	RootImports []string `json:"root_imports,omitempty"`
+
+	// Prune is a list of prune categories (see pruneCategories) to remove
+	// with -optimize.
+	Prune []string `json:"prune,omitempty"`
+
+	// Stub is a list of case-insensitive globs for removed DLLs which should
+	// be replaced with generated stubs exporting no-op functions for the
+	// imported names instead of removing everything which depends on them.
+	Stub []string `json:"stub,omitempty"`
+
+	// Components is a list of case-insensitive globs for large, rarely-needed
+	// wine PE lib files to move out of the runtime into optional components
+	// with -components, which nswrap can install on-demand.
+	Components []string `json:"components,omitempty"`
+
+	// PreferNative is a list of case-insensitive globs for wine builtin
+	// modules to flag as prefer-native, so a native dll with the same name
+	// (e.g., a game stub or redistributable) is loaded instead by default.
+	// Unlike DllOverrides, this still works if the prefix registry is
+	// regenerated.
+	PreferNative []string `json:"prefer_native,omitempty"`
+
+	// PreferBuiltin is a list of case-insensitive globs for wine builtin
+	// modules to clear the prefer-native flag from (e.g., ones wine builds
+	// with it, like msvcr*). It takes precedence over PreferNative.
+	PreferBuiltin []string `json:"prefer_builtin,omitempty"`
+
+	// Registry is a map of registry keys to values to set in the prefix
+	// (e.g., DllOverrides, Direct3D settings, or Winsock parameters). Values
+	// may be strings (REG_SZ), integers (REG_DWORD), or objects with a type
+	// (REG_SZ, REG_EXPAND_SZ, REG_MULTI_SZ, REG_DWORD, REG_QWORD, or
+	// REG_BINARY) and a value (a string, a list of strings, an integer, or a
+	// hex string, respectively). They are written directly to the prefix
+	// hives in sorted order after wineboot, and recorded in the manifest.
+	Registry map[string]map[string]any `json:"registry,omitempty"`
+
+	// DllOverrides is a map of dll names (without the .dll extension) to load
+	// orders (e.g., "native,builtin", or "" to disable it) to set in the
+	// prefix's global DllOverrides, which take precedence over the ones in
+	// Registry. Short forms like "n,b" are also accepted.
+	DllOverrides map[string]*string `json:"dll_overrides,omitempty"`
+
+	// DriveC is a list of additional directories, symlinks, and files to
+	// create in the prefix's drive_c. Entries with a path prefixed with "-"
+	// remove an inherited entry.
+	DriveC []DriveCEntry `json:"drive_c,omitempty"`
+
+	// Environment and UserEnvironment are maps of environment variables to set
+	// in the system (HKLM\System\CurrentControlSet\Control\Session
+	// Manager\Environment) and user (HKCU\Environment) environment as
+	// REG_EXPAND_SZ values, which take precedence over the ones in Registry.
+	// Values set to null remove an inherited value. Note that wine sets TEMP
+	// and TMP in the user environment, which overrides the system one.
+	Environment     map[string]*string `json:"environment,omitempty"`
+	UserEnvironment map[string]*string `json:"user_environment,omitempty"`
+
+	// PathAppend is a list of directories (e.g., for injected tools) to append
+	// to the system PATH after wineboot (and Environment) set it.
+	PathAppend []string `json:"path_append,omitempty"`
+
+	// FontSubstitutes is a map of font face names (e.g., Arial) to the face
+	// names to use instead (e.g., of ones kept in share/wine/fonts), and
+	// FontLink is a map of font face names to the fallback fonts to use for
+	// missing glyphs (as "file.ttf,Face Name" or "file.ttf"). They're written
+	// to the FontSubstitutes and FontLink\SystemLink keys, and take precedence
+	// over the ones in Registry. Entries set to null remove an inherited entry.
+	// Face names are case-insensitive.
+	FontSubstitutes map[string]*string   `json:"font_substitutes,omitempty"`
+	FontLink        map[string]*[]string `json:"font_link,omitempty"`
+
+	// DosDevices is a map of drive letters (e.g., "g:") to drives to create in
+	// the prefix's dosdevices. Entries set to null remove an inherited entry.
+	DosDevices map[string]*DosDevice `json:"dosdevices,omitempty"`
+
+	// Patches is a list of binary patches to apply to wine files. Rules with
+	// the same name as an inherited one replace it.
+	Patches []PatchRule `json:"patches,omitempty"`
+
+	// DriveCKeep is a list of case-insensitive globs for slash-separated
+	// paths (relative to drive_c) which must not be removed as wineboot cruft
+	// by -optimize.
+	DriveCKeep []string `json:"drive_c_keep,omitempty"`
+
+	// Verify is a list of files which must exist in the final runtime. Paths
+	// starting with "wine/" or "prefix/" are relative to the wine dir or the
+	// prefix, and anything else is a module name in the wine PE lib dir.
+	Verify []string `json:"verify,omitempty"`
+}
+
+// DriveCEntry is a directory, symlink, or file to create in drive_c.
+type DriveCEntry struct {
+	Path string `json:"path"`           // slash-separated, relative to drive_c
+	Dir  bool   `json:"dir,omitempty"`  // create a directory
+	Link string `json:"link,omitempty"` // create a symlink to this target
+	Data string `json:"data,omitempty"` // create a file with this content
+}
+
+// DosDevice is a drive mapping in dosdevices.
+type DosDevice struct {
+	Target string `json:"target,omitempty"` // symlink target (an absolute unix path, or relative to dosdevices)
+	Type   string `json:"type,omitempty"`   // drive type for mountmgr (hd, network, cdrom, or floppy), if not auto-detected
+	Remove bool   `json:"remove,omitempty"` // remove the drive (e.g., the default z: mapping of the unix root)
+}
+
+// dosDeviceTypes are the drive types wine's mountmgr accepts in
+// HKLM\Software\Wine\Drives.
+var dosDeviceTypes = []string{"hd", "network", "cdrom", "floppy"}
+
+// loadProfile loads and flattens a profile by name, path, or remote profile
+// reference.
+func loadProfile(name string) (*Profile, error) {
+	return loadProfileChain(name, "", nil)
+}
+
+func loadProfileChain(name, rel string, seen []string) (*Profile, error) {
+	var (
+		buf []byte
+		err error
+		id  string
+	)
+	if isRemoteProfile(name) {
+		dir, err := fetchProfile(name)
+		if err != nil {
+			return nil, fmt.Errorf("load profile %q: %w", name, err)
+		}
+		name = filepath.Join(dir, profileArtifactEntry)
+	}
+	if isProfilePath(name) {
+		if rel != "" && !filepath.IsAbs(name) {
+			name = filepath.Join(rel, name)
+		}
+		id = name
+		buf, err = os.ReadFile(name)
+	} else {
+		id = name
+		buf, err = builtinProfiles.ReadFile(path.Join("profiles", name+".json"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load profile %q: %w", name, err)
+	}
+	if slices.Contains(seen, id) {
+		return nil, fmt.Errorf("load profile %q: inheritance cycle (%s)", name, strings.Join(append(seen, id), " -> "))
+	}
+	seen = append(seen, id)
+
+	var p Profile
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("load profile %q: %w", name, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("load profile %q: %w", name, err)
+	}
+	if p.Extends == "" {
+		return p.overlay(&Profile{}), nil
+	}
+	var next string
+	if isProfilePath(id) {
+		next = filepath.Dir(id)
+	}
+	base, err := loadProfileChain(p.Extends, next, seen)
+	if err != nil {
+		return nil, err
+	}
+	return base.overlay(&p), nil
+}
+
+// isProfilePath returns true if name refers to a file rather than a built-in
+// profile.
+func isProfilePath(name string) bool {
+	return strings.ContainsRune(name, '/') || strings.HasSuffix(name, ".json")
+}
+
+// validate checks a single (non-flattened) profile.
+func (p *Profile) validate() error {
+	for _, x := range [][]string{p.Keep, p.Remove, p.RemoveServices, p.Stub, p.Roots, p.Components, p.PreferNative, p.PreferBuiltin, p.DriveCKeep} {
+		for _, g := range x {
+			if _, err := path.Match(strings.TrimPrefix(g, "-"), ""); err != nil {
+				return fmt.Errorf("invalid glob %q: %w", g, err)
+			}
+		}
+	}
+	for _, c := range p.Prune {
+		if _, ok := pruneCategories[strings.TrimPrefix(c, "-")]; !ok {
+			return fmt.Errorf("unknown prune category %q", c)
+		}
+	}
+	for _, e := range p.DriveC {
+		if x, ok := strings.CutPrefix(e.Path, "-"); ok {
+			if e.Dir || e.Link != "" || e.Data != "" {
+				return fmt.Errorf("drive_c entry %q: removal must not specify anything else", e.Path)
+			}
+			e.Path = x
+		}
+		if !filepath.IsLocal(filepath.FromSlash(e.Path)) {
+			return fmt.Errorf("drive_c entry %q: path must be local", e.Path)
+		}
+		if e.Dir && (e.Link != "" || e.Data != "") {
+			return fmt.Errorf("drive_c entry %q: must be only one of a dir, link, or file", e.Path)
+		}
+		if e.Link != "" && e.Data != "" {
+			return fmt.Errorf("drive_c entry %q: must be only one of a dir, link, or file", e.Path)
+		}
+	}
+	for _, r := range p.Patches {
+		if strings.HasPrefix(r.Name, "-") {
+			if r.File != "" || r.Search != "" || r.Replace != "" {
+				return fmt.Errorf("patch %q: removal must not specify anything else", r.Name)
+			}
+			continue
+		}
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	for _, env := range []map[string]*string{p.Environment, p.UserEnvironment} {
+		for name := range env {
+			if name == "" || strings.ContainsAny(name, "=\x00") {
+				return fmt.Errorf("invalid environment variable name %q", name)
+			}
+		}
+	}
+	for name, value := range p.FontSubstitutes {
+		if name == "" || (value != nil && *value == "") {
+			return fmt.Errorf("invalid font substitute %q", name)
+		}
+	}
+	for name, fonts := range p.FontLink {
+		if name == "" || (fonts != nil && (len(*fonts) == 0 || slices.Contains(*fonts, ""))) {
+			return fmt.Errorf("invalid font link %q", name)
+		}
+	}
+	for _, dir := range p.PathAppend {
+		if x := strings.TrimPrefix(dir, "-"); x == "" || strings.Contains(x, ";") {
+			return fmt.Errorf("invalid path_append entry %q", dir)
+		}
+	}
+	for drive, d := range p.DosDevices {
+		switch {
+		case !regex(`^[a-zA-Z]:$`).MatchString(drive):
+			return fmt.Errorf("dosdevices entry %q: must be a drive letter followed by a colon", drive)
+		case strings.EqualFold(drive, "c:"):
+			return fmt.Errorf("dosdevices entry %q: drive_c must not be changed", drive)
+		case d == nil:
+		case d.Remove && (d.Target != "" || d.Type != ""):
+			return fmt.Errorf("dosdevices entry %q: removal must not specify anything else", drive)
+		case !d.Remove && d.Target == "":
+			return fmt.Errorf("dosdevices entry %q: target is required", drive)
+		case d.Type != "" && !slices.Contains(dosDeviceTypes, d.Type):
+			return fmt.Errorf("dosdevices entry %q: unknown type %q (expected one of %q)", drive, d.Type, dosDeviceTypes)
+		}
+	}
+	for name, mode := range p.DllOverrides {
+		if mode != nil {
+			if _, err := parseDllOverrideMode(*mode); err != nil {
+				return fmt.Errorf("dll override %s: %w", name, err)
+			}
+		}
+	}
+	for key, values := range p.Registry {
+		if _, _, ok := regHiveKey(key); !ok {
+			return fmt.Errorf("registry key %s: unsupported root", key)
+		}
+		for name, value := range values {
+			if value == nil {
+				continue
+			}
+			if _, _, err := profileRegValue(value); err != nil {
+				return fmt.Errorf("registry value %s\\%s: %w", key, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// overlay returns a new profile with o applied on top of p. The result does
+// not extend anything.
+func (p *Profile) overlay(o *Profile) *Profile {
+	r := &Profile{
+		Keep:   overlayList(p.Keep, o.Keep),
+		Remove: overlayList(p.Remove, o.Remove),
+		Stub:   overlayList(p.Stub, o.Stub),
+		Prune:  overlayList(p.Prune, o.Prune),
+		Roots:  overlayList(p.Roots, o.Roots),
+
+		Components:     overlayList(p.Components, o.Components),
+		RootImports:    overlayList(p.RootImports, o.RootImports),
+		PreferNative:   overlayList(p.PreferNative, o.PreferNative),
+		PreferBuiltin:  overlayList(p.PreferBuiltin, o.PreferBuiltin),
+		RemoveServices: overlayList(p.RemoveServices, o.RemoveServices),
+		DriveCKeep:     overlayList(p.DriveCKeep, o.DriveCKeep),
+		Registry:       map[string]map[string]any{},
+		DllOverrides:   map[string]*string{},
+		DosDevices:     map[string]*DosDevice{},
+		PathAppend:     overlayList(p.PathAppend, o.PathAppend),
+		Verify:         overlayList(p.Verify, o.Verify),
+		Patches:        overlayPatches(p.Patches, o.Patches),
+	}
+	for _, e := range slices.Concat(p.DriveC, o.DriveC) {
+		if x, ok := strings.CutPrefix(e.Path, "-"); ok {
+			r.DriveC = slices.DeleteFunc(r.DriveC, func(y DriveCEntry) bool {
+				return y.Path == x
+			})
+			continue
+		}
+		if i := slices.IndexFunc(r.DriveC, func(y DriveCEntry) bool {
+			return y.Path == e.Path
+		}); i != -1 {
+			r.DriveC[i] = e
+		} else {
+			r.DriveC = append(r.DriveC, e)
+		}
+	}
+	for _, reg := range []map[string]map[string]any{p.Registry, o.Registry} {
+		for key, values := range reg {
+			if r.Registry[key] == nil {
+				r.Registry[key] = map[string]any{}
+			}
+			for name, value := range values {
+				if value == nil {
+					delete(r.Registry[key], name)
+				} else {
+					r.Registry[key][name] = value
+				}
+			}
+			if len(r.Registry[key]) == 0 {
+				delete(r.Registry, key)
+			}
+		}
+	}
+	r.Environment = overlayFold(p.Environment, o.Environment)
+	r.UserEnvironment = overlayFold(p.UserEnvironment, o.UserEnvironment)
+	r.FontSubstitutes = overlayFold(p.FontSubstitutes, o.FontSubstitutes)
+	r.FontLink = overlayFold(p.FontLink, o.FontLink)
+	for _, o := range []map[string]*DosDevice{p.DosDevices, o.DosDevices} {
+		for drive, d := range o {
+			if d == nil {
+				delete(r.DosDevices, strings.ToLower(drive))
+			} else {
+				r.DosDevices[strings.ToLower(drive)] = d
+			}
+		}
+	}
+	for _, o := range []map[string]*string{p.DllOverrides, o.DllOverrides} {
+		for name, mode := range o {
+			if mode == nil {
+				delete(r.DllOverrides, dllOverrideName(name))
+			} else {
+				r.DllOverrides[dllOverrideName(name)] = mode
+			}
+		}
+	}
+	return r
+}
+
+// overlayFold applies the entries in o to p (e.g., environment variables),
+// removing ones set to null. Names are case-insensitive.
+func overlayFold[T any](p, o map[string]*T) map[string]*T {
+	r := map[string]*T{}
+	for _, env := range []map[string]*T{p, o} {
+		for name, value := range env {
+			for x := range r {
+				if strings.EqualFold(x, name) {
+					delete(r, x)
+				}
+			}
+			if value != nil {
+				r[name] = value
+			}
+		}
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	return r
+}
+
+// overlayList adds the entries in o to p, removing ones prefixed with "-".
+func overlayList(p, o []string) []string {
+	r := slices.Clone(p)
+	for _, x := range o {
+		if x, ok := strings.CutPrefix(x, "-"); ok {
+			r = slices.DeleteFunc(r, func(y string) bool {
+				return y == x
+			})
+			continue
+		}
+		if !slices.Contains(r, x) {
+			r = append(r, x)
+		}
+	}
+	return r
+}
+
+// Keeps checks if the file name matches the keep list.
+func (p *Profile) Keeps(name string) bool {
+	return matchAny(p.Keep, name)
+}
+
+// Removes checks if the file name matches the remove list or a prune
+// category.
+func (p *Profile) Removes(name string) bool {
+	if matchAny(p.Remove, name) {
+		return true
+	}
+	for _, c := range p.Prune {
+		if matchAny(pruneCategories[c].Files, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemovesService checks if the service name or install section matches the
+// service remove list or a prune category.
+func (p *Profile) RemovesService(name, section string) bool {
+	if matchAny(p.RemoveServices, name) || matchAny(p.RemoveServices, section) {
+		return true
+	}
+	for _, c := range p.Prune {
+		if matchAny(pruneCategories[c].Services, name) || matchAny(pruneCategories[c].Services, section) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemovesRegistry checks if the registry key is the same as or a subkey of
+// a prune category key.
+func (p *Profile) RemovesRegistry(key string) bool {
+	for _, c := range p.Prune {
+		for _, x := range pruneCategories[c].Registry {
+			if regKeyUnder(key, x) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RemovesDirective checks if the INF install section directive is in a prune
+// category.
+func (p *Profile) RemovesDirective(key string) bool {
+	for _, c := range p.Prune {
+		if slices.ContainsFunc(pruneCategories[c].Directives, func(x string) bool {
+			return strings.EqualFold(x, key)
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// PruneRegistryKeys returns the registry keys of the prune categories.
+func (p *Profile) PruneRegistryKeys() []string {
+	var keys []string
+	for _, c := range p.Prune {
+		keys = append(keys, pruneCategories[c].Registry...)
+	}
+	return keys
+}
+
+// Stubs checks if the file name matches the stub list.
+func (p *Profile) Stubs(name string) bool {
+	return matchAny(p.Stub, name)
+}
+
+// Optional checks if the file name matches the optional components list.
+func (p *Profile) Optional(name string) bool {
+	return matchAny(p.Components, name)
+}
+
+// LoadOrder checks if the module name matches the prefer-builtin or
+// prefer-native lists, returning whether it should prefer native dlls.
+func (p *Profile) LoadOrder(name string) (native, ok bool) {
+	if matchAny(p.PreferBuiltin, name) {
+		return false, true
+	}
+	if matchAny(p.PreferNative, name) {
+		return true, true
+	}
+	return false, false
+}
+
+// VerifyModules returns the module names in the verify list.
+func (p *Profile) VerifyModules() []string {
+	var names []string
+	for _, x := range p.Verify {
+		if !strings.HasPrefix(x, "wine/") && !strings.HasPrefix(x, "prefix/") {
+			names = append(names, x)
+		}
+	}
+	return names
+}
+
+// profileRegTypes maps registry type names to the type.
+var profileRegTypes = map[string]uint32{
+	"REG_SZ":        regSZ,
+	"REG_EXPAND_SZ": regExpandSZ,
+	"REG_MULTI_SZ":  regMultiSZ,
+	"REG_DWORD":     regDWORD,
+	"REG_QWORD":     regQWORD,
+	"REG_BINARY":    regBinary,
+}
+
+// profileRegValue converts a profile registry value to the registry type name
+// and data.
+func profileRegValue(value any) (string, []byte, error) {
+	typ := "REG_SZ"
+	switch v := value.(type) {
+	case string:
+	case float64:
+		typ = "REG_DWORD"
+	case map[string]any:
+		t, ok := v["type"].(string)
+		if !ok || len(v) != 2 {
+			return "", nil, fmt.Errorf("typed value must have only a type and a value")
+		}
+		if _, ok := profileRegTypes[t]; !ok {
+			return "", nil, fmt.Errorf("unsupported type %q", t)
+		}
+		typ, value = t, v["value"]
+	default:
+		return "", nil, fmt.Errorf("unsupported type %T", value)
+	}
+	switch typ {
+	case "REG_SZ", "REG_EXPAND_SZ":
+		if s, ok := value.(string); ok {
+			return typ, regStringData(s), nil
+		}
+		return "", nil, fmt.Errorf("%s value must be a string", typ)
+	case "REG_MULTI_SZ":
+		if l, ok := value.([]any); ok {
+			ss := make([]string, len(l))
+			for i, x := range l {
+				if ss[i], ok = x.(string); !ok {
+					return "", nil, fmt.Errorf("%s value must be a list of strings", typ)
+				}
+			}
+			return typ, regMultiStringData(ss), nil
+		}
+		return "", nil, fmt.Errorf("%s value must be a list of strings", typ)
+	case "REG_DWORD":
+		if v, ok := value.(float64); ok && v == math.Trunc(v) && v >= 0 && v <= math.MaxUint32 {
+			return typ, regDWORDData(uint32(v)), nil
+		}
+		return "", nil, fmt.Errorf("number %v is not a valid %s", value, typ)
+	case "REG_QWORD":
+		if v, ok := value.(float64); ok && v == math.Trunc(v) && v >= 0 && v <= 1<<53 {
+			return typ, binary.LittleEndian.AppendUint64(nil, uint64(v)), nil
+		}
+		return "", nil, fmt.Errorf("number %v is not a valid %s", value, typ)
+	case "REG_BINARY":
+		if s, ok := value.(string); ok {
+			b, err := hex.DecodeString(strings.NewReplacer(",", "", " ", "").Replace(s))
+			if err != nil {
+				return "", nil, fmt.Errorf("%s value must be a hex string: %w", typ, err)
+			}
+			return typ, b, nil
+		}
+		return "", nil, fmt.Errorf("%s value must be a hex string", typ)
+	}
+	panic("unreachable")
+}
+
+// DllOverrideModes returns the normalized dll overrides.
+func (p *Profile) DllOverrideModes() map[string]string {
+	r := map[string]string{}
+	for name, mode := range p.DllOverrides {
+		if mode != nil {
+			r[dllOverrideName(name)], _ = parseDllOverrideMode(*mode)
+		}
+	}
+	return r
+}
+
+// EnvironmentRegistry returns the environment variables as profile registry
+// values.
+func (p *Profile) EnvironmentRegistry() map[string]map[string]any {
+	r := map[string]map[string]any{}
+	for key, env := range map[string]map[string]*string{
+		`HKLM\System\CurrentControlSet\Control\Session Manager\Environment`: p.Environment,
+		`HKCU\Environment`: p.UserEnvironment,
+	} {
+		for name, value := range env {
+			if value != nil {
+				if r[key] == nil {
+					r[key] = map[string]any{}
+				}
+				r[key][name] = map[string]any{"type": "REG_EXPAND_SZ", "value": *value}
+			}
+		}
+	}
+	return r
+}
+
+// FontRegistry returns the font substitutes and links as profile registry
+// values.
+func (p *Profile) FontRegistry() map[string]map[string]any {
+	r := map[string]map[string]any{}
+	const key = `HKLM\Software\Microsoft\Windows NT\CurrentVersion`
+	for name, value := range p.FontSubstitutes {
+		if value != nil {
+			if r[key+`\FontSubstitutes`] == nil {
+				r[key+`\FontSubstitutes`] = map[string]any{}
+			}
+			r[key+`\FontSubstitutes`][name] = *value
+		}
+	}
+	for name, fonts := range p.FontLink {
+		if fonts != nil {
+			if r[key+`\FontLink\SystemLink`] == nil {
+				r[key+`\FontLink\SystemLink`] = map[string]any{}
+			}
+			value := make([]any, len(*fonts)) // like decoded json
+			for i, x := range *fonts {
+				value[i] = x
+			}
+			r[key+`\FontLink\SystemLink`][name] = map[string]any{"type": "REG_MULTI_SZ", "value": value}
+		}
+	}
+	return r
+}
+
+// envPathAppend appends the directories which aren't already in a PATH-style
+// list.
+func envPathAppend(path string, dirs []string) string {
+	for _, dir := range dirs {
+		if !slices.ContainsFunc(strings.Split(path, ";"), func(x string) bool {
+			return strings.EqualFold(strings.TrimSuffix(x, `\`), strings.TrimSuffix(dir, `\`))
+		}) {
+			if path != "" && !strings.HasSuffix(path, ";") {
+				path += ";"
+			}
+			path += dir
+		}
+	}
+	return path
+}
+
+// RegistryKeys returns the registry keys in sorted order.
+func (p *Profile) RegistryKeys() []string {
+	return slices.Sorted(maps.Keys(p.Registry))
+}
+
+// matchAny checks if name case-insensitively matches any of the globs.
+func matchAny(globs []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, g := range globs {
+		if ok, _ := path.Match(strings.ToLower(g), name); ok {
+			return true
+		}
+	}
+	return false
+}
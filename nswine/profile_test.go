@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOverlayList(t *testing.T) {
+	for _, tc := range []struct {
+		Base, Overlay, Result []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a", "b"}, nil, []string{"a", "b"}},
+		{[]string{"a", "b"}, []string{"c"}, []string{"a", "b", "c"}},
+		{[]string{"a", "b"}, []string{"b", "c"}, []string{"a", "b", "c"}},
+		{[]string{"a", "b"}, []string{"-a"}, []string{"b"}},
+		{[]string{"a", "b"}, []string{"-a", "a"}, []string{"b", "a"}},
+		{[]string{"a"}, []string{"-x"}, []string{"a"}},
+	} {
+		if act := overlayList(tc.Base, tc.Overlay); !slices.Equal(act, tc.Result) {
+			t.Errorf("overlay %q with %q: expected %q, got %q", tc.Base, tc.Overlay, tc.Result, act)
+		}
+	}
+}
+
+func TestBuiltinProfiles(t *testing.T) {
+	dis, err := builtinProfiles.ReadDir("profiles")
+	if err != nil {
+		t.Fatalf("read builtin profiles: %v", err)
+	}
+	for _, di := range dis {
+		name := strings.TrimSuffix(di.Name(), ".json")
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadProfile(name); err != nil {
+				t.Errorf("load: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("base.json", `{
+		"keep": ["a.dll", "b.dll"],
+		"registry": {"HKCU\\Software\\Wine": {"Version": "win10", "Foo": 1}},
+		"drive_c": [{"path": "logs", "dir": true}, {"path": "a.txt", "data": "a"}],
+		"verify": ["ntdll.dll"],
+		"dll_overrides": {"mscoree": "", "D3D11.dll": "n,b"},
+		"dosdevices": {"z:": {"remove": true}, "G:": {"target": "/mnt/game"}},
+		"environment": {"Foo": "1", "Bar": "2"},
+		"user_environment": {"TEMP": "T:\\"},
+		"path_append": ["C:\\tools", "C:\\old"],
+		"font_substitutes": {"Arial": "Tahoma", "Times New Roman": "Tahoma"},
+		"font_link": {"Tahoma": ["SIMSUN.TTC,SimSun"], "Lucida Console": ["x.ttf"]}
+	}`)
+	write("child.json", `{
+		"extends": "base.json",
+		"keep": ["-a.dll", "c*.dll"],
+		"drive_c": [{"path": "-logs"}, {"path": "a.txt", "data": "b"}, {"path": "game", "link": "/mnt/game"}],
+		"registry": {"HKCU\\Software\\Wine": {"Foo": null}, "HKCU\\Software\\Wine\\Drivers": {"Audio": ""}},
+		"dll_overrides": {"mscoree": null, "d3d11": "builtin"},
+		"dosdevices": {"z:": null, "h:": {"target": "/mnt/data", "type": "network"}},
+		"environment": {"FOO": "3", "bar": null},
+		"path_append": ["-C:\\old"],
+		"font_substitutes": {"times new roman": null, "Courier New": "Courier"},
+		"font_link": {"lucida console": null}
+	}`)
+	write("cycle1.json", `{"extends": "cycle2.json"}`)
+	write("cycle2.json", `{"extends": "cycle1.json"}`)
+	write("invalid.json", `{"registry": {"HKCU": {"x": 1.5}}}`)
+	write("baddrive.json", `{"dosdevices": {"gg:": {"target": "/"}}}`)
+	write("baddrivec.json", `{"dosdevices": {"C:": {"target": "/"}}}`)
+	write("baddrivetype.json", `{"dosdevices": {"g:": {"target": "/", "type": "ramdisk"}}}`)
+	write("baddriveremove.json", `{"dosdevices": {"g:": {"target": "/", "remove": true}}}`)
+	write("badenv.json", `{"environment": {"A=B": "x"}}`)
+	write("badfont.json", `{"font_substitutes": {"Arial": ""}}`)
+	write("badfontlink.json", `{"font_link": {"Tahoma": []}}`)
+	write("badoverride.json", `{"dll_overrides": {"x": "native,native"}}`)
+	write("badtype.json", `{"registry": {"HKCU": {"x": {"type": "REG_QWORD", "value": "1"}}}}`)
+	write("badroot.json", `{"registry": {"HKU\\.Default": {"x": 1}}}`)
+	write("unknown.json", `{"kep": []}`)
+	write("unsafe.json", `{"drive_c": [{"path": "../x", "dir": true}]}`)
+	write("badprune.json", `{"prune": ["nonexistent"]}`)
+	write("ambiguous.json", `{"drive_c": [{"path": "x", "dir": true, "data": "x"}]}`)
+
+	p, err := loadProfile(filepath.Join(dir, "child.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := []string{"b.dll", "c*.dll"}; !slices.Equal(p.Keep, exp) {
+		t.Errorf("expected keep %q, got %q", exp, p.Keep)
+	}
+	if !p.Keeps("B.DLL") || !p.Keeps("cabinet.dll") || p.Keeps("a.dll") {
+		t.Errorf("incorrect keep matching")
+	}
+	if exp := []string{"ntdll.dll"}; !slices.Equal(p.Verify, exp) {
+		t.Errorf("expected verify %q, got %q", exp, p.Verify)
+	}
+	if v := p.Registry[`HKCU\Software\Wine`]; len(v) != 1 || v["Version"] != "win10" {
+		t.Errorf("incorrect registry overlay: %v", p.Registry)
+	}
+	if v := p.Registry[`HKCU\Software\Wine\Drivers`]; len(v) != 1 || v["Audio"] != "" {
+		t.Errorf("incorrect registry overlay: %v", p.Registry)
+	}
+
+	if exp := map[string]string{"d3d11": "builtin"}; !maps.Equal(p.DllOverrideModes(), exp) {
+		t.Errorf("incorrect dll overrides %q", p.DllOverrideModes())
+	}
+
+	if len(p.DosDevices) != 2 || *p.DosDevices["g:"] != (DosDevice{Target: "/mnt/game"}) || *p.DosDevices["h:"] != (DosDevice{Target: "/mnt/data", Type: "network"}) {
+		t.Errorf("incorrect dosdevices %v", p.DosDevices)
+	}
+
+	if exp := []string{`C:\tools`}; !slices.Equal(p.PathAppend, exp) {
+		t.Errorf("expected path_append %q, got %q", exp, p.PathAppend)
+	}
+	if env := p.EnvironmentRegistry(); len(env) != 2 ||
+		!reflect.DeepEqual(env[`HKLM\System\CurrentControlSet\Control\Session Manager\Environment`], map[string]any{"FOO": map[string]any{"type": "REG_EXPAND_SZ", "value": "3"}}) ||
+		!reflect.DeepEqual(env[`HKCU\Environment`], map[string]any{"TEMP": map[string]any{"type": "REG_EXPAND_SZ", "value": `T:\`}}) {
+		t.Errorf("incorrect environment %v", env)
+	}
+	const fonts = `HKLM\Software\Microsoft\Windows NT\CurrentVersion`
+	if reg := p.FontRegistry(); len(reg) != 2 ||
+		!reflect.DeepEqual(reg[fonts+`\FontSubstitutes`], map[string]any{"Arial": "Tahoma", "Courier New": "Courier"}) ||
+		!reflect.DeepEqual(reg[fonts+`\FontLink\SystemLink`], map[string]any{"Tahoma": map[string]any{"type": "REG_MULTI_SZ", "value": []any{"SIMSUN.TTC,SimSun"}}}) {
+		t.Errorf("incorrect fonts %v", reg)
+	}
+
+	if exp := []DriveCEntry{{Path: "a.txt", Data: "b"}, {Path: "game", Link: "/mnt/game"}}; !slices.Equal(p.DriveC, exp) {
+		t.Errorf("expected drive_c %v, got %v", exp, p.DriveC)
+	}
+
+	for _, name := range []string{"cycle1.json", "invalid.json", "unknown.json", "missing.json", "unsafe.json", "ambiguous.json", "badprune.json", "badtype.json", "badroot.json", "badoverride.json", "baddrive.json", "baddrivec.json", "baddrivetype.json", "baddriveremove.json", "badenv.json", "badfont.json", "badfontlink.json"} {
+		if _, err := loadProfile(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestProfileRegValue(t *testing.T) {
+	for _, tc := range []struct {
+		Value string
+		Type  string
+		Data  []byte
+	}{
+		{`"a"`, "REG_SZ", []byte{'a', 0, 0, 0}},
+		{`42`, "REG_DWORD", []byte{42, 0, 0, 0}},
+		{`{"type": "REG_EXPAND_SZ", "value": "%a%"}`, "REG_EXPAND_SZ", regStringData("%a%")},
+		{`{"type": "REG_MULTI_SZ", "value": ["a", "b"]}`, "REG_MULTI_SZ", regMultiStringData([]string{"a", "b"})},
+		{`{"type": "REG_QWORD", "value": 4294967296}`, "REG_QWORD", []byte{0, 0, 0, 0, 1, 0, 0, 0}},
+		{`{"type": "REG_BINARY", "value": "01,02, ff"}`, "REG_BINARY", []byte{1, 2, 0xff}},
+		{`{"type": "REG_DWORD", "value": 4294967296}`, "", nil},
+		{`{"type": "REG_BINARY", "value": "xyz"}`, "", nil},
+		{`{"type": "REG_MULTI_SZ", "value": [1]}`, "", nil},
+		{`{"type": "REG_NONE", "value": ""}`, "", nil},
+		{`{"type": "REG_SZ", "value": "", "x": 1}`, "", nil},
+		{`1.5`, "", nil},
+		{`true`, "", nil},
+	} {
+		var v any
+		if err := json.Unmarshal([]byte(tc.Value), &v); err != nil {
+			t.Fatal(err)
+		}
+		typ, data, err := profileRegValue(v)
+		if tc.Type == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.Value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Value, err)
+		} else if typ != tc.Type || !bytes.Equal(data, tc.Data) {
+			t.Errorf("%s: expected %s %x, got %s %x", tc.Value, tc.Type, tc.Data, typ, data)
+		}
+	}
+}
+
+func TestEnvPathAppend(t *testing.T) {
+	for _, tc := range []struct {
+		Path string
+		Dirs []string
+		Out  string
+	}{
+		{"", []string{`C:\a`}, `C:\a`},
+		{`%SystemRoot%\system32;%SystemRoot%`, []string{`C:\a`, `%systemroot%\`, `C:\b`}, `%SystemRoot%\system32;%SystemRoot%;C:\a;C:\b`},
+		{`C:\x;`, []string{`C:\a`, `c:\A`}, `C:\x;C:\a`},
+	} {
+		if act := envPathAppend(tc.Path, tc.Dirs); act != tc.Out {
+			t.Errorf("%q + %q: expected %q, got %q", tc.Path, tc.Dirs, tc.Out, act)
+		}
+	}
+}
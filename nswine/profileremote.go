@@ -0,0 +1,495 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Remote profiles are tar archives containing profileArtifactEntry and any
+// profiles it extends by relative path. They can be fetched from an OCI
+// registry:
+//
+//	oci://ghcr.io/someone/profiles/name:1.2
+//	oci://ghcr.io/someone/profiles/name@sha256:<hex>
+//	oci://ghcr.io/someone/profiles/name:1.2@sha256:<hex>
+//
+// Where the digest is of the manifest, and the profile is the first layer with
+// profileMediaType (or a regular tar layer). Or from a URL, which must be
+// pinned by the sha256 of the archive:
+//
+//	https://example.com/name-1.2.tar#sha256:<hex>
+//
+// OCI refs without a digest are rejected unless -allow-unpinned-profile is used,
+// since the tag can be moved to a different profile. They are unpacked into the
+// user cache dir by digest, so refs pinned by digest can be used with -offline
+// once they have been fetched.
+const (
+	profileArtifactEntry = "profile.json"
+	profileMediaType     = "application/vnd.nswine.profile.v1.tar"
+)
+
+// profileOffline makes remote profiles only be loaded from the cache. It is set
+// from -offline.
+var profileOffline bool
+
+// profileUnpinned allows remote profiles which aren't pinned by digest. It is
+// set from -allow-unpinned-profile.
+var profileUnpinned bool
+
+// profileHTTPClient is used to fetch remote profiles. The timeout is generous
+// since it includes reading the profile archive.
+var profileHTTPClient = &http.Client{Timeout: 2 * time.Minute}
+
+// profileRef is a parsed remote profile reference.
+type profileRef struct {
+	URL string // for archives
+
+	Registry   string // for oci
+	Repository string // for oci
+	Tag        string // for oci, empty if pinned by digest only
+
+	Digest string // hex sha256, empty if not pinned
+}
+
+// isRemoteProfile returns true if name refers to a remote profile artifact.
+func isRemoteProfile(name string) bool {
+	return strings.HasPrefix(name, "oci://") || strings.HasPrefix(name, "https://") || strings.HasPrefix(name, "http://")
+}
+
+// parseProfileRef parses a remote profile reference.
+func parseProfileRef(s string) (*profileRef, error) {
+	var r profileRef
+	if x, ok := strings.CutPrefix(s, "oci://"); ok {
+		if x, d, ok := strings.Cut(x, "@"); ok {
+			hx, ok := strings.CutPrefix(d, "sha256:")
+			if !ok || !isSHA256(hx) {
+				return nil, fmt.Errorf("invalid digest %q (must be sha256:<hex>)", d)
+			}
+			r.Digest, s = hx, x
+		} else {
+			s = x
+		}
+		var ok bool
+		if r.Registry, r.Repository, ok = strings.Cut(s, "/"); !ok || r.Registry == "" || r.Repository == "" {
+			return nil, fmt.Errorf("missing repository")
+		}
+		if i := strings.LastIndexByte(r.Repository, ':'); i != -1 {
+			r.Repository, r.Tag = r.Repository[:i], r.Repository[i+1:]
+			if r.Tag == "" {
+				return nil, fmt.Errorf("empty tag")
+			}
+		} else if r.Digest == "" {
+			r.Tag = "latest"
+		}
+		if !regex(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`).MatchString(r.Repository) {
+			return nil, fmt.Errorf("invalid repository %q", r.Repository)
+		}
+		return &r, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	hx, ok := strings.CutPrefix(u.Fragment, "sha256:")
+	if !ok || !isSHA256(hx) {
+		return nil, fmt.Errorf("profile archive url must be pinned with #sha256:<hex>")
+	}
+	u.Fragment = ""
+	r.URL, r.Digest = u.String(), hx
+	return &r, nil
+}
+
+// isSHA256 checks if s is a lowercase hex sha256 hash.
+func isSHA256(s string) bool {
+	return len(s) == sha256.Size*2 && strings.Trim(s, "0123456789abcdef") == ""
+}
+
+// fetchProfile gets the directory a remote profile was unpacked to, fetching it
+// if it isn't already cached.
+func fetchProfile(ref string) (string, error) {
+	r, err := parseProfileRef(ref)
+	if err != nil {
+		return "", fmt.Errorf("parse profile ref: %w", err)
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	cache = filepath.Join(cache, "nswine", "profiles")
+
+	if r.Digest != "" {
+		if _, err := os.Stat(filepath.Join(cache, r.Digest, profileArtifactEntry)); err == nil {
+			slog.Debug("using cached profile", "ref", ref, "digest", r.Digest)
+			return filepath.Join(cache, r.Digest), nil
+		}
+	}
+	if r.Digest == "" && !profileUnpinned {
+		return "", fmt.Errorf("profile %q must be pinned by digest (add @sha256:<digest>, or use -allow-unpinned-profile)", ref)
+	}
+	if profileOffline {
+		if r.Digest == "" {
+			return "", fmt.Errorf("profile %q must be pinned by digest to use it offline", ref)
+		}
+		return "", fmt.Errorf("profile %q is not cached (fetch it without -offline first)", ref)
+	}
+
+	var key string
+	var buf []byte
+	if r.URL != "" {
+		slog.Info("downloading profile", "url", r.URL)
+		if buf, err = profileGet(r.URL, nil); err != nil {
+			return "", err
+		}
+		if sum := sha256.Sum256(buf); hex.EncodeToString(sum[:]) != r.Digest {
+			return "", fmt.Errorf("profile archive %q digest mismatch (expected sha256:%s, got sha256:%x)", r.URL, r.Digest, sum)
+		}
+		key = r.Digest
+	} else {
+		if key, buf, err = r.pull(); err != nil {
+			return "", fmt.Errorf("pull %s/%s: %w", r.Registry, r.Repository, err)
+		}
+		if _, err := os.Stat(filepath.Join(cache, key, profileArtifactEntry)); err == nil {
+			return filepath.Join(cache, key), nil
+		}
+	}
+
+	if err := os.MkdirAll(cache, 0777); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(cache, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := untarProfile(buf, tmp); err != nil {
+		return "", fmt.Errorf("unpack profile %q: %w", ref, err)
+	}
+	if err := os.Rename(tmp, filepath.Join(cache, key)); err != nil {
+		if _, serr := os.Stat(filepath.Join(cache, key, profileArtifactEntry)); serr != nil {
+			return "", err
+		} // else, it was unpacked concurrently
+	}
+	return filepath.Join(cache, key), nil
+}
+
+// pull gets the profile layer from an OCI registry, returning the manifest
+// digest (which is verified if the ref is pinned) and the layer contents.
+func (r *profileRef) pull() (string, []byte, error) {
+	var (
+		token string
+		get   func(p string, accept ...string) ([]byte, error)
+	)
+	get = func(p string, accept ...string) ([]byte, error) {
+		u := "https://" + r.Registry + "/v2/" + r.Repository + "/" + p
+		buf, err := profileGet(u, func(req *http.Request) {
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			for _, a := range accept {
+				req.Header.Add("Accept", a)
+			}
+		})
+		var ae *profileAuthError
+		if token == "" && errors.As(err, &ae) {
+			if token, err = ae.token(); err != nil {
+				return nil, fmt.Errorf("get registry token: %w", err)
+			}
+			return get(p, accept...)
+		}
+		return buf, err
+	}
+	ref := r.Tag
+	if r.Digest != "" {
+		ref = "sha256:" + r.Digest
+	}
+	slog.Info("pulling profile", "registry", r.Registry, "repository", r.Repository, "ref", ref)
+	buf, err := get("manifests/"+ref, "application/vnd.oci.image.manifest.v1+json", "application/vnd.docker.distribution.manifest.v2+json")
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(buf)
+	digest := hex.EncodeToString(sum[:])
+	if r.Digest != "" && digest != r.Digest {
+		return "", nil, fmt.Errorf("manifest digest mismatch (expected sha256:%s, got sha256:%s)", r.Digest, digest)
+	}
+	if r.Digest == "" {
+		slog.Info("resolved profile tag (pin it with @sha256:<digest> for reproducible builds)", "tag", r.Tag, "digest", "sha256:"+digest)
+	}
+
+	var m struct {
+		Layers []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return "", nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	var layer string
+	for _, mt := range []string{profileMediaType, "application/vnd.oci.image.layer.v1.tar", "application/vnd.oci.image.layer.v1.tar+gzip"} {
+		for _, l := range m.Layers {
+			if layer == "" && l.MediaType == mt {
+				layer = l.Digest
+			}
+		}
+	}
+	hx, ok := strings.CutPrefix(layer, "sha256:")
+	if !ok || !isSHA256(hx) {
+		return "", nil, fmt.Errorf("manifest does not have a profile layer with a sha256 digest")
+	}
+	if buf, err = get("blobs/" + layer); err != nil {
+		return "", nil, err
+	}
+	if sum := sha256.Sum256(buf); hex.EncodeToString(sum[:]) != hx {
+		return "", nil, fmt.Errorf("layer digest mismatch (expected %s, got sha256:%x)", layer, sum)
+	}
+	return digest, buf, nil
+}
+
+// profileAuthError is returned by profileGet if the registry requires a bearer
+// token.
+type profileAuthError struct {
+	Challenge string
+}
+
+func (e *profileAuthError) Error() string {
+	return "unauthorized (" + e.Challenge + ")"
+}
+
+// token gets an anonymous bearer token for the challenge.
+func (e *profileAuthError) token() (string, error) {
+	params := map[string]string{}
+	rest, ok := strings.CutPrefix(e.Challenge, "Bearer ")
+	if !ok {
+		return "", fmt.Errorf("unsupported auth challenge %q", e.Challenge)
+	}
+	for _, m := range regex(`(\w+)="([^"]*)"`).FindAllStringSubmatch(rest, -1) {
+		params[m[1]] = m[2]
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil || u.Scheme != "https" {
+		return "", fmt.Errorf("invalid auth realm %q", params["realm"])
+	}
+	q := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if v := params[k]; v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	buf, err := profileGet(u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(buf, &t); err != nil {
+		return "", err
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	if t.Token == "" {
+		return "", fmt.Errorf("no token in response")
+	}
+	return t.Token, nil
+}
+
+// profileGet downloads a URL, which must be smaller than 16 MiB.
+func profileGet(u string, fn func(*http.Request)) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if fn != nil {
+		fn(req)
+	}
+	resp, err := profileHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		if c := resp.Header.Get("WWW-Authenticate"); c != "" {
+			return nil, &profileAuthError{c}
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %q: response status %d", u, resp.StatusCode)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20+1))
+	if err != nil {
+		return nil, fmt.Errorf("get %q: %w", u, err)
+	}
+	if len(buf) > 16<<20 {
+		return nil, fmt.Errorf("get %q: response too large", u)
+	}
+	return buf, nil
+}
+
+// untarProfile unpacks a (optionally gzipped) profile archive to dir. Only
+// regular files with local paths are allowed.
+func untarProfile(buf []byte, dir string) error {
+	var r io.Reader = bytes.NewReader(buf)
+	if bytes.HasPrefix(buf, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	tr := tar.NewReader(bufio.NewReader(r))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return fmt.Errorf("entry %q: not a regular file", hdr.Name)
+		}
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return fmt.Errorf("entry %q: path must be local", hdr.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, profileArtifactEntry)); err != nil {
+		return fmt.Errorf("missing %s", profileArtifactEntry)
+	}
+	return nil
+}
+
+// packProfile writes a reproducible profile archive for the profile at name,
+// including the profiles it extends by path (which must be in the same
+// directory).
+func packProfile(w io.Writer, name string) error {
+	if _, err := loadProfile(name); err != nil {
+		return err
+	}
+	files := map[string][]byte{}
+	for cur, entry := name, profileArtifactEntry; ; {
+		buf, err := os.ReadFile(cur)
+		if err != nil {
+			return err
+		}
+		if _, ok := files[entry]; ok {
+			return fmt.Errorf("profile %q conflicts with %s", cur, entry)
+		}
+		files[entry] = buf
+
+		var p struct {
+			Extends string `json:"extends"`
+		}
+		if err := json.Unmarshal(buf, &p); err != nil {
+			return fmt.Errorf("load profile %q: %w", cur, err)
+		}
+		if p.Extends == "" || !isProfilePath(p.Extends) {
+			break // built-in or remote
+		}
+		if strings.ContainsRune(p.Extends, '/') {
+			return fmt.Errorf("profile %q extends %q, which is not in the same directory", cur, p.Extends)
+		}
+		cur, entry = filepath.Join(filepath.Dir(cur), p.Extends), p.Extends
+	}
+	tw := tar.NewWriter(w)
+	for _, name := range slices.Sorted(func(yield func(string) bool) {
+		for k := range files {
+			if !yield(k) {
+				return
+			}
+		}
+	}) {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			Format:   tar.FormatUSTAR,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// packProfileMain implements the pack-profile subcommand, which creates a
+// profile archive for publishing.
+func packProfileMain(args []string) error {
+	fset := flag.NewFlagSet("pack-profile", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s pack-profile [options] profile.json\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fset.Output(), "Creates a reproducible archive of a profile (and the profiles it extends by\npath) which can be used with -profile. Publish it as a file, then use it as\nhttps://.../name.tar#sha256:<hex>, or push it to an OCI registry with:\n\n")
+		fmt.Fprintf(fset.Output(), "\toras push registry/repository:tag name.tar:%s\n\n", profileMediaType)
+		fmt.Fprintf(fset.Output(), "then use it as oci://registry/repository:tag@sha256:<manifest digest>.\n\n")
+		fset.PrintDefaults()
+	}
+	output := fset.String("o", "", "output file (default the profile name with .tar)")
+	fset.Parse(args)
+
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	name := fset.Arg(0)
+	if !isProfilePath(name) {
+		return fmt.Errorf("profile %q must be a path to a json file", name)
+	}
+	if *output == "" {
+		*output = strings.TrimSuffix(filepath.Base(name), ".json") + ".tar"
+	}
+
+	var buf bytes.Buffer
+	if err := packProfile(&buf, name); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	fmt.Printf("%s sha256:%x\n", *output, sum)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRemoteProfile(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "base.json"), []byte(`{"extends": "minimal", "keep": ["x.dll"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "test.json"), []byte(`{"extends": "base.json", "keep": ["y.dll"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var layer bytes.Buffer
+	if err := packProfile(&layer, filepath.Join(dir, "test.json")); err != nil {
+		t.Fatalf("pack profile: %v", err)
+	}
+	var layer2 bytes.Buffer
+	if err := packProfile(&layer2, filepath.Join(dir, "test.json")); err != nil {
+		t.Fatalf("pack profile: %v", err)
+	}
+	if !bytes.Equal(layer.Bytes(), layer2.Bytes()) {
+		t.Errorf("profile archive is not reproducible")
+	}
+	layerSum := sha256.Sum256(layer.Bytes())
+	layerDigest := "sha256:" + hex.EncodeToString(layerSum[:])
+
+	manifest, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"layers": []map[string]any{
+			{"mediaType": "application/vnd.example.other", "digest": "sha256:" + strings.Repeat("0", 64)},
+			{"mediaType": profileMediaType, "digest": layerDigest, "size": layer.Len()},
+		},
+	})
+	manifestSum := sha256.Sum256(manifest)
+	manifestDigest := hex.EncodeToString(manifestSum[:])
+
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/test.tar":
+			w.Write(layer.Bytes())
+		case r.URL.Path == "/token":
+			if r.URL.Query().Get("scope") != "repository:test/profile:pull" {
+				http.Error(w, "bad scope", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"token":"abc"}`))
+		case r.Header.Get("Authorization") != "Bearer abc":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test",scope="repository:test/profile:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/test/profile/manifests/1.0", r.URL.Path == "/v2/test/profile/manifests/sha256:"+manifestDigest:
+			w.Write(manifest)
+		case r.URL.Path == "/v2/test/profile/blobs/"+layerDigest:
+			w.Write(layer.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := srv.Client()
+	defer func(c *http.Client) { profileHTTPClient = c }(profileHTTPClient)
+	profileHTTPClient = client
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	check := func(ref string) {
+		t.Helper()
+		p, err := loadProfile(ref)
+		if err != nil {
+			t.Errorf("load %q: %v", ref, err)
+			return
+		}
+		if !p.Keeps("x.dll") || !p.Keeps("y.dll") || !slices.Contains(p.Roots, "sc.exe") {
+			t.Errorf("load %q: incorrect profile", ref)
+		}
+	}
+	check("oci://" + host + "/test/profile:1.0@sha256:" + manifestDigest)
+	check(srv.URL + "/test.tar#" + layerDigest)
+
+	for _, ref := range []string{
+		"oci://" + host + "/test/profile:1.0",
+		"oci://" + host + "/test/profile:1.0@sha256:" + strings.Repeat("1", 64),
+		srv.URL + "/test.tar",
+		srv.URL + "/test.tar#sha256:" + strings.Repeat("1", 64),
+	} {
+		if _, err := loadProfile(ref); err == nil {
+			t.Errorf("load %q: expected error", ref)
+		}
+	}
+
+	profileUnpinned = true
+	check("oci://" + host + "/test/profile:1.0")
+	if _, err := loadProfile("oci://" + host + "/test/profile:2.0"); err == nil {
+		t.Errorf("expected error when loading a missing tag")
+	}
+	profileUnpinned = false
+
+	profileOffline = true
+	defer func() { profileOffline = false }()
+	srv.Close()
+
+	check("oci://" + host + "/test/profile@sha256:" + manifestDigest)
+	check(srv.URL + "/test.tar#" + layerDigest)
+	if _, err := loadProfile("oci://" + host + "/test/profile:1.0"); err == nil {
+		t.Errorf("expected error when loading unpinned profile offline")
+	}
+}
+
+func TestParseProfileRef(t *testing.T) {
+	h := strings.Repeat("a", 64)
+	for _, tc := range []struct {
+		Ref string
+		Res *profileRef
+	}{
+		{"oci://ghcr.io/a/b", &profileRef{Registry: "ghcr.io", Repository: "a/b", Tag: "latest"}},
+		{"oci://localhost:5000/a:1.2", &profileRef{Registry: "localhost:5000", Repository: "a", Tag: "1.2"}},
+		{"oci://ghcr.io/a/b@sha256:" + h, &profileRef{Registry: "ghcr.io", Repository: "a/b", Digest: h}},
+		{"oci://ghcr.io/a/b:1@sha256:" + h, &profileRef{Registry: "ghcr.io", Repository: "a/b", Tag: "1", Digest: h}},
+		{"https://example.com/a.tar#sha256:" + h, &profileRef{URL: "https://example.com/a.tar", Digest: h}},
+		{"oci://ghcr.io", nil},
+		{"oci://ghcr.io/A/b", nil},
+		{"oci://ghcr.io/a/b:", nil},
+		{"oci://ghcr.io/a/b@sha256:x", nil},
+		{"https://example.com/a.tar", nil},
+	} {
+		r, err := parseProfileRef(tc.Ref)
+		if tc.Res == nil {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.Ref)
+			}
+		} else if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.Ref, err)
+		} else if *r != *tc.Res {
+			t.Errorf("%q: expected %+v, got %+v", tc.Ref, *tc.Res, *r)
+		}
+	}
+}
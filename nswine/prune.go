@@ -0,0 +1,273 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// pruneCategory is a group of related components which are removed together:
+// the files, the services installed for them, and the registry keys which
+// reference them.
+type pruneCategory struct {
+	Files      []string // case-insensitive globs for wine lib files to remove
+	Services   []string // case-insensitive globs for services (by name or INF install section) to remove
+	Registry   []string // registry keys (HKLM, HKCU, or HKCR) to remove from wine.inf and the prefix
+	Directives []string // INF install section directives (e.g., ProfileItems) to remove from wine.inf
+}
+
+// pruneCategories are the categories which can be enabled by profiles.
+var pruneCategories = map[string]pruneCategory{
+	"terminal-services": {
+		Files: []string{
+			"termsv.exe",
+			"termsrv.dll",
+			"mstsc.exe",
+			"mstscax.dll",
+			"rdpclip.exe",
+			"rdpencom.dll",
+			"rdpsnd.dll",
+			"wtsapi32.dll",
+		},
+		Services: []string{
+			"TermService*",
+			"Terminal*",
+			"UmRdpService*",
+			"SessionEnv*",
+		},
+		Registry: []string{
+			`HKLM\System\CurrentControlSet\Control\Terminal Server`,
+			`HKLM\Software\Microsoft\Windows NT\CurrentVersion\Terminal Server`,
+			`HKLM\Software\Policies\Microsoft\Windows NT\Terminal Services`,
+		},
+	},
+	"desktop-shell": {
+		// things which only matter for interactive desktop use: start menu
+		// shortcuts, shell namespace folders, the shell folder path cache
+		// (shell32 recreates it on demand), and file and protocol
+		// associations for viewers and editors
+		Registry: []string{
+			`HKLM\Software\Microsoft\Windows\CurrentVersion\Explorer\Shell Folders`,
+			`HKCU\Software\Microsoft\Windows\CurrentVersion\Explorer\Shell Folders`,
+			`HKCU\Software\Microsoft\Windows\CurrentVersion\Explorer\MenuOrder`,
+			`HKLM\Software\Microsoft\Windows\CurrentVersion\Explorer\Desktop\NameSpace`,
+			`HKLM\Software\Microsoft\Windows\CurrentVersion\Explorer\MyComputer\NameSpace`,
+			`HKCR\.txt`, `HKCR\txtfile`,
+			`HKCR\.ini`, `HKCR\inifile`,
+			`HKCR\.htm`, `HKCR\.html`, `HKCR\htmlfile`,
+			`HKCR\.xml`, `HKCR\xmlfile`,
+			`HKCR\.rtf`, `HKCR\rtffile`,
+			`HKCR\.wri`, `HKCR\wrifile`,
+			`HKCR\.hlp`, `HKCR\hlpfile`,
+			`HKCR\.chm`, `HKCR\chm.file`,
+			`HKCR\.reg`, `HKCR\regfile`,
+			`HKCR\http`, `HKCR\https`, `HKCR\ftp`, `HKCR\mailto`,
+		},
+		Directives: []string{
+			"ProfileItems",
+		},
+	},
+	"eventlog-wmi": {
+		// event log sources and wmi providers, which a headless server has no
+		// consumer for (modules importing these files are removed along with
+		// them by the usual dependency closure, unless they're stubbed by the
+		// profile, and the com classes registered for them are pruned from
+		// the prefix with the rest of the registry entries for removed files)
+		Files: []string{
+			"eventcreate.exe",
+			"wevtapi.dll",
+			"wevtsvc.dll",
+			"mofcomp.exe",
+			"wbemdisp.dll",
+			"wbemprox.dll",
+			"wmi.dll",
+			"wmic.exe",
+			"wmisvc.dll",
+			"wmiutils.dll",
+		},
+		Services: []string{
+			"EventLog*",
+			"winmgmt*",
+		},
+		Registry: []string{
+			`HKLM\System\CurrentControlSet\Services\EventLog`,
+			`HKLM\System\CurrentControlSet\Control\WMI`,
+			`HKLM\Software\Microsoft\Wbem`,
+			`HKLM\Software\Wow6432Node\Microsoft\Wbem`,
+		},
+	},
+	"uninstall": {
+		// add/remove programs data (e.g., from installing wine-mono and
+		// wine-gecko), which a sealed runtime has no use for (the msi product
+		// registration is kept, since appwiz.cpl uses it to check whether
+		// they're installed)
+		Files: []string{
+			"uninstaller.exe",
+		},
+		Registry: []string{
+			`HKLM\Software\Microsoft\Windows\CurrentVersion\Uninstall`,
+			`HKLM\Software\Wow6432Node\Microsoft\Windows\CurrentVersion\Uninstall`,
+			`HKCU\Software\Microsoft\Windows\CurrentVersion\Uninstall`,
+		},
+	},
+}
+
+// infRegKey gets the full registry key (with a HKLM/HKCU/HKCR/HKU root) from
+// an AddReg/DelReg line.
+func infRegKey(line string) (string, bool) {
+	return infRegKeyOf(infValues(infStripComment(line)))
+}
+
+// infRegKeyOf is like infRegKey, but for the values of an already split line.
+func infRegKeyOf(values []string) (string, bool) {
+	if len(values) < 2 {
+		return "", false
+	}
+	switch root := strings.ToUpper(values[0]); root {
+	case "HKLM", "HKCU", "HKCR", "HKU":
+		return root + `\` + values[1], true
+	}
+	return "", false
+}
+
+// regHiveKey splits a HKLM, HKCU, or HKCR registry key into the wine hive file
+// name and the key relative to its root.
+func regHiveKey(key string) (hive, rel string, ok bool) {
+	root, rest, _ := strings.Cut(key, `\`)
+	switch strings.ToUpper(root) {
+	case "HKLM", "HKEY_LOCAL_MACHINE":
+		hive = "system.reg"
+	case "HKCU", "HKEY_CURRENT_USER":
+		hive = "user.reg"
+	case "HKCR", "HKEY_CLASSES_ROOT":
+		if rest == "" {
+			return "system.reg", "", false
+		}
+		hive, rest = "system.reg", `Software\Classes\`+rest // the machine classes, which is where wine.inf puts them
+	default:
+		return "", "", false
+	}
+	return hive, rest, rest != ""
+}
+
+// regKeyUnder checks if key is the same as or a subkey of parent,
+// case-insensitively.
+func regKeyUnder(key, parent string) bool {
+	key, parent = strings.ToLower(key), strings.ToLower(strings.TrimSuffix(parent, `\`))
+	return key == parent || strings.HasPrefix(key, parent+`\`)
+}
+
+// regPruned is a registry key or value removed by pruneRegistry.
+type regPruned struct {
+	Key    string
+	Value  string // if only a value was removed
+	Reason string
+}
+
+// pruneRegistry removes the registry entries in a hive which reference files
+// for which removed (called with the lowercased file name) returns true:
+// services, COM classes (and the ProgIDs and interfaces using them), type
+// libraries, and DllOverrides.
+func pruneRegistry(f *regFile, removed func(name string) bool) []regPruned {
+	var pruned []regPruned
+	deleteKey := func(key, reason string) {
+		if len(f.DeleteKey(key)) != 0 {
+			pruned = append(pruned, regPruned{Key: key, Reason: reason})
+		}
+	}
+	refs := func(key, name string) (string, bool) {
+		v, ok := f.Value(key, name).Str()
+		if !ok {
+			return "", false
+		}
+		file := regFileName(v)
+		return file, file != "" && removed(file)
+	}
+
+	const services = `System\CurrentControlSet\Services`
+	for _, name := range f.Subkeys(services) {
+		key := services + `\` + name
+		if file, ok := refs(key, "ImagePath"); ok {
+			deleteKey(key, "service binary "+file)
+		} else if file, ok := refs(key+`\Parameters`, "ServiceDll"); ok {
+			deleteKey(key, "service dll "+file)
+		}
+	}
+
+	for _, classes := range []string{`Software\Classes`, `Software\Classes\Wow6432Node`} {
+		clsids := map[string]bool{}
+		for _, clsid := range f.Subkeys(classes + `\CLSID`) {
+			key := classes + `\CLSID\` + clsid
+			for _, server := range []string{"InprocServer32", "LocalServer32"} {
+				if file, ok := refs(key+`\`+server, ""); ok {
+					deleteKey(key, "class server "+file)
+					clsids[strings.ToLower(clsid)] = true
+					break
+				}
+			}
+		}
+		for _, iid := range f.Subkeys(classes + `\Interface`) {
+			key := classes + `\Interface\` + iid
+			if clsid, ok := f.Value(key+`\ProxyStubClsid32`, "").Str(); ok && clsids[strings.ToLower(clsid)] {
+				deleteKey(key, "proxy class "+clsid)
+			}
+		}
+		for _, lib := range f.Subkeys(classes + `\TypeLib`) {
+			for _, ver := range f.Subkeys(classes + `\TypeLib\` + lib) {
+				key := classes + `\TypeLib\` + lib + `\` + ver
+				for _, lcid := range f.Subkeys(key) {
+					for _, plat := range []string{"win32", "win64"} {
+						if file, ok := refs(key+`\`+lcid+`\`+plat, ""); ok {
+							deleteKey(key, "type library "+file)
+						}
+					}
+				}
+			}
+		}
+		if len(clsids) != 0 {
+			for _, progid := range f.Subkeys(classes) {
+				key := classes + `\` + progid
+				if clsid, ok := f.Value(key+`\CLSID`, "").Str(); ok && clsids[strings.ToLower(clsid)] {
+					deleteKey(key, "class "+clsid)
+				}
+			}
+		}
+	}
+
+	const overrides = `Software\Wine\DllOverrides`
+	if k := f.Key(overrides); k != nil {
+		for _, v := range slices.Clone(k.Values) {
+			name := strings.ToLower(strings.TrimPrefix(v.Name, "*"))
+			if path.Ext(name) == "" {
+				name += ".dll"
+			}
+			if removed(name) && f.DeleteValue(overrides, v.Name) {
+				pruned = append(pruned, regPruned{Key: overrides, Value: v.Name, Reason: "dll override " + name})
+			}
+		}
+	}
+	return pruned
+}
+
+// regFileName gets the lowercased file name from a registry path value like
+// "C:\windows\system32\foo.dll", "%SystemRoot%\system32\svchost.exe -k
+// netsvcs", or a quoted path with arguments.
+func regFileName(s string) string {
+	s = regFilePath(s)
+	if i := strings.LastIndexAny(s, `\/`); i != -1 {
+		s = s[i+1:]
+	}
+	return strings.ToLower(s)
+}
+
+// regFilePath gets the path from a registry path value like an ImagePath,
+// without any arguments.
+func regFilePath(s string) string {
+	s = strings.TrimSpace(s)
+	if x, ok := strings.CutPrefix(s, `"`); ok {
+		s, _, _ = strings.Cut(x, `"`)
+	} else {
+		s, _, _ = strings.Cut(s, " ")
+	}
+	return s
+}
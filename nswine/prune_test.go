@@ -0,0 +1,151 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestInfRegKey(t *testing.T) {
+	for _, tc := range []struct {
+		Line, Key string
+		OK        bool
+	}{
+		{`HKLM,"System\CurrentControlSet\Control\Terminal Server","fDenyTSConnections",0x10001,1`, `HKLM\System\CurrentControlSet\Control\Terminal Server`, true},
+		{`hkcu,Software\Wine ; comment`, `HKCU\Software\Wine`, true},
+		{`%11%\termsv.exe`, "", false},
+		{`HKLM`, "", false},
+	} {
+		if key, ok := infRegKey(tc.Line); key != tc.Key || ok != tc.OK {
+			t.Errorf("%q: expected (%q, %t), got (%q, %t)", tc.Line, tc.Key, tc.OK, key, ok)
+		}
+	}
+}
+
+func TestRegHiveKey(t *testing.T) {
+	for _, tc := range []struct {
+		Key, Hive, Rel string
+		OK             bool
+	}{
+		{`HKLM\System\CurrentControlSet`, "system.reg", `System\CurrentControlSet`, true},
+		{`HKEY_CURRENT_USER\Software\Wine`, "user.reg", `Software\Wine`, true},
+		{`HKCR\.txt`, "system.reg", `Software\Classes\.txt`, true},
+		{`HKU\.Default`, "", "", false},
+		{`HKLM`, "system.reg", "", false},
+	} {
+		if hive, rel, ok := regHiveKey(tc.Key); hive != tc.Hive || rel != tc.Rel || ok != tc.OK {
+			t.Errorf("%q: expected (%q, %q, %t), got (%q, %q, %t)", tc.Key, tc.Hive, tc.Rel, tc.OK, hive, rel, ok)
+		}
+	}
+}
+
+func TestPruneCategories(t *testing.T) {
+	p := &Profile{Prune: []string{"terminal-services"}}
+	if !p.Removes("TermSv.exe") || p.Removes("kernel32.dll") {
+		t.Errorf("incorrect file matching")
+	}
+	if !p.RemovesService("TermService", "TermServiceService") || p.RemovesService("MountMgr", "MountMgrService") {
+		t.Errorf("incorrect service matching")
+	}
+	if !p.RemovesRegistry(`hklm\system\currentcontrolset\control\terminal server\wds`) || p.RemovesRegistry(`HKLM\System\CurrentControlSet\Control\Terminal ServerX`) {
+		t.Errorf("incorrect registry matching")
+	}
+
+	p = &Profile{Prune: []string{"desktop-shell"}}
+	if key, _ := infRegKey(`HKCR,txtfile\shell\open\command,,2,"%11%\notepad.exe %1"`); !p.RemovesRegistry(key) || p.RemovesRegistry(`HKCR\exefile\shell\open\command`) {
+		t.Errorf("incorrect file association matching")
+	}
+	if !p.RemovesDirective("profileitems") || p.RemovesDirective("AddReg") {
+		t.Errorf("incorrect directive matching")
+	}
+
+	p = &Profile{Prune: []string{"uninstall"}}
+	if key, _ := infRegKey(`HKLM,Software\Microsoft\Windows\CurrentVersion\Uninstall\Wine Mono Runtime,"DisplayName",,"Wine Mono"`); !p.RemovesRegistry(key) || p.RemovesRegistry(`HKLM\Software\Microsoft\Windows\CurrentVersion\Installer`) {
+		t.Errorf("incorrect uninstall matching")
+	}
+
+	p = &Profile{Prune: []string{"eventlog-wmi"}}
+	if !p.Removes("WbemProx.dll") || !p.Removes("wevtsvc.dll") || p.Removes("advapi32.dll") {
+		t.Errorf("incorrect eventlog-wmi file matching")
+	}
+	if !p.RemovesService("EventLog", "EventLogService") || !p.RemovesService("winmgmt", "WinmgmtService") || p.RemovesService("PlugPlay", "PlugPlayService") {
+		t.Errorf("incorrect eventlog-wmi service matching")
+	}
+	if key, _ := infRegKey(`HKLM,System\CurrentControlSet\Services\EventLog\Application\WSH,"EventMessageFile",,"%11%\wshom.ocx"`); !p.RemovesRegistry(key) || p.RemovesRegistry(`HKLM\Software\Microsoft\WBEMX`) {
+		t.Errorf("incorrect eventlog-wmi registry matching")
+	}
+}
+
+func TestPruneRegistry(t *testing.T) {
+	f, err := parseReg([]byte(unindent(`
+		WINE REGISTRY Version 2
+
+		[Software\\Classes\\CLSID\\{00000001-0000-0000-0000-000000000000}\\InprocServer32] 1700000000
+		@="C:\\windows\\system32\\gone.dll"
+		"ThreadingModel"="Both"
+
+		[Software\\Classes\\CLSID\\{00000002-0000-0000-0000-000000000000}\\InprocServer32] 1700000000
+		@="kept.dll"
+
+		[Software\\Classes\\Gone.Object\\CLSID] 1700000000
+		@="{00000001-0000-0000-0000-000000000000}"
+
+		[Software\\Classes\\Interface\\{00000003-0000-0000-0000-000000000000}\\ProxyStubClsid32] 1700000000
+		@="{00000001-0000-0000-0000-000000000000}"
+
+		[Software\\Classes\\TypeLib\\{00000004-0000-0000-0000-000000000000}\\1.0\\0\\win64] 1700000000
+		@="C:\\windows\\system32\\gone.dll"
+
+		[Software\\Wine\\DllOverrides] 1700000000
+		"*gone"="native,builtin"
+		"kept"="builtin"
+
+		[System\\CurrentControlSet\\Services\\GoneSvc] 1700000000
+		"ImagePath"="C:\\windows\\system32\\svchost.exe -k netsvcs"
+
+		[System\\CurrentControlSet\\Services\\GoneSvc\\Parameters] 1700000000
+		"ServiceDll"="C:\\windows\\system32\\gonesvc.dll"
+
+		[System\\CurrentControlSet\\Services\\KeptSvc] 1700000000
+		"ImagePath"="\"C:\\Program Files\\kept.exe\" -arg"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if exp := []string{"CLSID", "Gone.Object", "Interface", "TypeLib"}; !slices.Equal(f.Subkeys(`Software\Classes`), exp) {
+		t.Errorf("expected subkeys %q, got %q", exp, f.Subkeys(`Software\Classes`))
+	}
+	pruned := pruneRegistry(f, func(name string) bool {
+		return name == "gone.dll" || name == "gonesvc.dll"
+	})
+	var act []string
+	for _, p := range pruned {
+		act = append(act, p.Key+":"+p.Value)
+	}
+	if exp := []string{
+		`System\CurrentControlSet\Services\GoneSvc:`,
+		`Software\Classes\CLSID\{00000001-0000-0000-0000-000000000000}:`,
+		`Software\Classes\Interface\{00000003-0000-0000-0000-000000000000}:`,
+		`Software\Classes\TypeLib\{00000004-0000-0000-0000-000000000000}\1.0:`,
+		`Software\Classes\Gone.Object:`,
+		`Software\Wine\DllOverrides:*gone`,
+	}; !slices.Equal(act, exp) {
+		t.Errorf("expected pruned %q, got %q", exp, act)
+	}
+	var keys []string
+	for _, k := range f.Keys {
+		keys = append(keys, k.Name)
+	}
+	if exp := []string{
+		`Software\Classes\CLSID\{00000002-0000-0000-0000-000000000000}\InprocServer32`,
+		`Software\Wine\DllOverrides`,
+		`System\CurrentControlSet\Services\KeptSvc`,
+	}; !slices.Equal(keys, exp) {
+		t.Errorf("expected remaining keys %q, got %q", exp, keys)
+	}
+	if f.Value(`Software\Wine\DllOverrides`, "kept") == nil {
+		t.Errorf("expected kept override to remain")
+	}
+	if exp := "kept.exe"; regFileName(`"C:\Program Files\kept.exe" -arg`) != exp {
+		t.Errorf("expected quoted file name %q", exp)
+	}
+}
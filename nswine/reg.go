@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Registry value types.
+const (
+	regNone     = 0
+	regSZ       = 1
+	regExpandSZ = 2
+	regBinary   = 3
+	regDWORD    = 4
+	regLink     = 6
+	regMultiSZ  = 7
+	regQWORD    = 11
+)
+
+// regFile is a parsed wine registry hive (e.g., system.reg or user.reg). Keys
+// and values which aren't modified are written back as-is, and modified ones
+// are formatted the same way wineserver does, so editing it only changes what
+// it needs to.
+type regFile struct {
+	Header string // the raw lines before the first key (e.g., the version and #arch)
+	Keys   []*regKey
+
+	// Time is the unix time to set on keys modified by edits. If zero, the
+	// current time is used.
+	Time int64
+}
+
+// regKey is a key in a registry hive. Keys which only have subkeys aren't
+// written to hives by wine, so they may not exist.
+type regKey struct {
+	Name   string // relative to the hive root, unescaped
+	Time   int64  // modification time (unix)
+	Class  string // #class, if any
+	Link   bool   // #link (i.e., a symbolic link)
+	Values []*regValue
+
+	raw     string   // the header and option lines, or empty if modified
+	modif   uint64   // the #time (a FILETIME), or zero to use Time
+	options []string // other option lines
+}
+
+// regValue is a registry value. The data is stored as-is (i.e., strings are
+// UTF-16LE with a null terminator).
+type regValue struct {
+	Name string // empty for the default value
+	Type uint32
+	Data []byte
+
+	raw string // the physical lines, or empty if modified
+}
+
+// parseReg parses a wine registry hive.
+func parseReg(buf []byte) (*regFile, error) {
+	var (
+		f   = &regFile{}
+		key *regKey
+		val *regValue
+		num int
+	)
+	hdr := true
+	for line := range bytes.Lines(bytes.ReplaceAll(buf, []byte("\r\n"), []byte("\n"))) {
+		num++
+		text := strings.TrimRight(string(line), "\n")
+		if val != nil {
+			// continuation of a hex value
+			val.raw += string(line)
+			if err := val.parse(); err != nil {
+				return nil, fmt.Errorf("parse reg: line %d: %w", num, err)
+			}
+			if !strings.HasSuffix(text, `\`) {
+				val = nil
+			}
+			continue
+		}
+		if hdr && !strings.HasPrefix(text, "[") {
+			f.Header += string(line)
+			continue
+		}
+		hdr = false
+		switch {
+		case strings.TrimSpace(text) == "" || strings.HasPrefix(text, ";"):
+			continue
+		case strings.HasPrefix(text, "["):
+			name, rest, err := regUnescape(text[1:], ']')
+			if err != nil {
+				return nil, fmt.Errorf("parse reg: line %d: invalid key: %w", num, err)
+			}
+			key = &regKey{Name: name, raw: string(line)}
+			if rest = strings.TrimSpace(rest); rest != "" {
+				if key.Time, err = strconv.ParseInt(rest, 10, 64); err != nil {
+					return nil, fmt.Errorf("parse reg: line %d: invalid key time %q", num, rest)
+				}
+			}
+			f.Keys = append(f.Keys, key)
+		case key == nil:
+			return nil, fmt.Errorf("parse reg: line %d: expected key", num)
+		case strings.HasPrefix(text, "#"):
+			if len(key.Values) != 0 {
+				return nil, fmt.Errorf("parse reg: line %d: key option after values", num)
+			}
+			key.raw += string(line)
+			switch opt := text[1:]; {
+			case strings.HasPrefix(opt, "time="):
+				var err error
+				if key.modif, err = strconv.ParseUint(opt[5:], 16, 64); err != nil {
+					return nil, fmt.Errorf("parse reg: line %d: invalid key time %q", num, opt[5:])
+				}
+			case opt == "link":
+				key.Link = true
+			case strings.HasPrefix(opt, `class="`):
+				class, _, err := regUnescape(opt[len(`class="`):], '"')
+				if err != nil {
+					return nil, fmt.Errorf("parse reg: line %d: invalid class: %w", num, err)
+				}
+				key.Class = class
+			default:
+				key.options = append(key.options, text)
+			}
+		default:
+			v := &regValue{raw: string(line)}
+			if err := v.parse(); err != nil {
+				return nil, fmt.Errorf("parse reg: line %d: %w", num, err)
+			}
+			key.Values = append(key.Values, v)
+			if strings.HasSuffix(text, `\`) {
+				val = v
+			}
+		}
+	}
+	if val != nil {
+		return nil, fmt.Errorf("parse reg: unterminated value %q", val.Name)
+	}
+	if h, ok := strings.CutSuffix(f.Header, "\n\n"); ok {
+		f.Header = h + "\n" // the blank line before each key is written by Bytes
+	}
+	return f, nil
+}
+
+// parse parses the raw value lines.
+func (v *regValue) parse() error {
+	if strings.HasSuffix(strings.TrimRight(v.raw, "\n"), `\`) {
+		return nil // incomplete
+	}
+	text := strings.TrimRight(strings.ReplaceAll(v.raw, "\\\n", ""), "\n")
+
+	var rest string
+	if x, ok := strings.CutPrefix(text, "@="); ok {
+		v.Name, rest = "", x
+	} else if x, ok := strings.CutPrefix(text, `"`); ok {
+		name, x, err := regUnescape(x, '"')
+		if err != nil {
+			return fmt.Errorf("invalid value name: %w", err)
+		}
+		if x, ok = strings.CutPrefix(x, "="); !ok {
+			return fmt.Errorf("expected = after value name %q", name)
+		}
+		v.Name, rest = name, x
+	} else {
+		return fmt.Errorf("expected value")
+	}
+
+	typ, data, err := regParseData(rest)
+	if err != nil {
+		return fmt.Errorf("value %q: %w", v.Name, err)
+	}
+	v.Type, v.Data = typ, data
+	return nil
+}
+
+// regParseData parses value data as written by wineserver (which is a superset
+// of the regedit format, other than string escapes).
+func regParseData(rest string) (uint32, []byte, error) {
+	var typ uint32 = regSZ
+	if x, ok := strings.CutPrefix(rest, "str("); ok {
+		n, x, ok := strings.Cut(x, "):")
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid string type")
+		}
+		t, err := strconv.ParseUint(n, 16, 32)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid string type %q", n)
+		}
+		typ, rest = uint32(t), x
+	}
+	switch {
+	case strings.HasPrefix(rest, `"`):
+		s, x, err := regUnescape(rest[1:], '"')
+		if err != nil {
+			return 0, nil, err
+		}
+		if strings.TrimSpace(x) != "" {
+			return 0, nil, fmt.Errorf("unexpected data after string")
+		}
+		return typ, regStringData(s), nil
+	case strings.HasPrefix(rest, "dword:"):
+		n, err := strconv.ParseUint(strings.TrimSpace(rest[6:]), 16, 32)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid dword: %w", err)
+		}
+		return regDWORD, regDWORDData(uint32(n)), nil
+	case strings.HasPrefix(rest, "hex"):
+		typ, x := uint32(regBinary), rest[3:]
+		if x, ok := strings.CutPrefix(x, "("); ok {
+			n, x, ok := strings.Cut(x, ")")
+			if !ok {
+				return 0, nil, fmt.Errorf("invalid hex type")
+			}
+			t, err := strconv.ParseUint(n, 16, 32)
+			if err != nil {
+				return 0, nil, fmt.Errorf("invalid hex type %q", n)
+			}
+			typ, rest = uint32(t), x
+		} else {
+			rest = x
+		}
+		x, ok := strings.CutPrefix(rest, ":")
+		if !ok {
+			return 0, nil, fmt.Errorf("expected : after hex")
+		}
+		data := []byte{}
+		for b := range strings.SplitSeq(x, ",") {
+			if b = strings.TrimSpace(b); b == "" {
+				continue
+			}
+			n, err := strconv.ParseUint(b, 16, 8)
+			if err != nil {
+				return 0, nil, fmt.Errorf("invalid hex byte %q", b)
+			}
+			data = append(data, byte(n))
+		}
+		return typ, data, nil
+	default:
+		return 0, nil, fmt.Errorf("unknown data format")
+	}
+}
+
+// String formats the value like wineserver, including the trailing newline.
+func (v *regValue) String() string {
+	if v.raw != "" {
+		return v.raw
+	}
+	var b strings.Builder
+	if v.Name != "" {
+		b.WriteString(`"` + regEscape(utf16.Encode([]rune(v.Name)), `"`) + `"=`)
+	} else {
+		b.WriteString("@=")
+	}
+	switch v.Type {
+	case regSZ, regExpandSZ, regMultiSZ:
+		// only properly terminated strings are written as strings
+		if n := len(v.Data); n >= 2 && n%2 == 0 && v.Data[n-2] == 0 && v.Data[n-1] == 0 {
+			if v.Type != regSZ {
+				fmt.Fprintf(&b, "str(%x):", v.Type)
+			}
+			b.WriteString(`"` + regEscape(regUTF16(v.Data), `"`) + `"` + "\n")
+			return b.String()
+		}
+	case regDWORD:
+		if len(v.Data) == 4 {
+			fmt.Fprintf(&b, "dword:%08x\n", binary.LittleEndian.Uint32(v.Data))
+			return b.String()
+		}
+	}
+	if v.Type == regBinary {
+		b.WriteString("hex:")
+	} else {
+		fmt.Fprintf(&b, "hex(%x):", v.Type)
+	}
+	count := b.Len()
+	for i, x := range v.Data {
+		fmt.Fprintf(&b, "%02x", x)
+		count += 2
+		if i < len(v.Data)-1 {
+			b.WriteByte(',')
+			if count++; count > 76 {
+				b.WriteString("\\\n  ")
+				count = 2
+			}
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Str gets the value of a REG_SZ or REG_EXPAND_SZ value.
+func (v *regValue) Str() (string, bool) {
+	if v == nil || (v.Type != regSZ && v.Type != regExpandSZ) {
+		return "", false
+	}
+	s := string(utf16.Decode(regUTF16(v.Data)))
+	s, _, _ = strings.Cut(s, "\x00")
+	return s, true
+}
+
+// Strings gets the value of a REG_MULTI_SZ value.
+func (v *regValue) Strings() ([]string, bool) {
+	if v == nil || v.Type != regMultiSZ {
+		return nil, false
+	}
+	s := strings.TrimRight(string(utf16.Decode(regUTF16(v.Data))), "\x00")
+	if s == "" {
+		return []string{}, true
+	}
+	return strings.Split(s, "\x00"), true
+}
+
+// DWORD gets the value of a REG_DWORD value.
+func (v *regValue) DWORD() (uint32, bool) {
+	if v == nil || v.Type != regDWORD || len(v.Data) != 4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(v.Data), true
+}
+
+// regStringData encodes a REG_SZ or REG_EXPAND_SZ value.
+func regStringData(s string) []byte {
+	return append(u8to16[string, []byte](s), 0, 0)
+}
+
+// regMultiStringData encodes a REG_MULTI_SZ value.
+func regMultiStringData(ss []string) []byte {
+	var b []byte
+	for _, s := range ss {
+		b = append(b, regStringData(s)...)
+	}
+	return append(b, 0, 0)
+}
+
+// regDWORDData encodes a REG_DWORD value.
+func regDWORDData(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+// regUTF16 converts UTF-16LE bytes to code units, ignoring a trailing odd byte.
+func regUTF16(b []byte) []uint16 {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return u
+}
+
+// regEscape escapes a string like wineserver's dump_strW, where escape is the
+// additional characters to escape with a backslash. A trailing null is not
+// written.
+func regEscape(s []uint16, escape string) string {
+	const escapes = ".......abtnvfr.............e...."
+	var b strings.Builder
+	for i, c := range s {
+		left := len(s) - i
+		switch {
+		case c > 127:
+			if left > 1 && s[i+1] < 128 && strings.ContainsRune("0123456789abcdefABCDEF", rune(s[i+1])) {
+				fmt.Fprintf(&b, `\x%04x`, c)
+			} else {
+				fmt.Fprintf(&b, `\x%x`, c)
+			}
+		case c < 32:
+			switch {
+			case c == 0 && left == 1:
+				// terminating null
+			case escapes[c] != '.':
+				b.WriteString(`\` + string(escapes[c]))
+			case left > 1 && s[i+1] >= '0' && s[i+1] <= '7':
+				fmt.Fprintf(&b, `\%03o`, c)
+			default:
+				fmt.Fprintf(&b, `\%o`, c)
+			}
+		default:
+			if c == '\\' || strings.ContainsRune(escape, rune(c)) {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(byte(c))
+		}
+	}
+	return b.String()
+}
+
+// regUnescape unescapes a string like wineserver's parse_strW until the
+// unescaped end character, returning the rest after it.
+func regUnescape(s string, end byte) (string, string, error) {
+	var r []rune
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == end:
+			return string(r), s[i+1:], nil
+		case c != '\\':
+			x, n := utf8.DecodeRuneInString(s[i:])
+			r, i = append(r, x), i+n
+			continue
+		}
+		if i++; i == len(s) {
+			return "", "", fmt.Errorf("unterminated escape")
+		}
+		switch c = s[i]; c {
+		case 'a':
+			r, i = append(r, '\a'), i+1
+		case 'b':
+			r, i = append(r, '\b'), i+1
+		case 'e':
+			r, i = append(r, 0x1b), i+1
+		case 'f':
+			r, i = append(r, '\f'), i+1
+		case 'n':
+			r, i = append(r, '\n'), i+1
+		case 'r':
+			r, i = append(r, '\r'), i+1
+		case 't':
+			r, i = append(r, '\t'), i+1
+		case 'v':
+			r, i = append(r, '\v'), i+1
+		case 'x':
+			j := i + 1
+			for j < len(s) && j < i+5 && strings.IndexByte("0123456789abcdefABCDEF", s[j]) != -1 {
+				j++
+			}
+			if j == i+1 {
+				return "", "", fmt.Errorf("invalid hex escape")
+			}
+			n, _ := strconv.ParseUint(s[i+1:j], 16, 16)
+			r, i = append(r, rune(n)), j
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+				j++
+			}
+			n, _ := strconv.ParseUint(s[i:j], 8, 16)
+			r, i = append(r, rune(n)), j
+		default:
+			r, i = append(r, rune(c)), i+1
+		}
+	}
+	return "", "", fmt.Errorf("missing %q", end)
+}
+
+// Bytes formats the hive.
+func (f *regFile) Bytes() []byte {
+	var b bytes.Buffer
+	b.WriteString(f.Header)
+	for _, k := range f.Keys {
+		b.WriteString("\n")
+		b.WriteString(k.header())
+		for _, v := range k.Values {
+			b.WriteString(v.String())
+		}
+	}
+	return b.Bytes()
+}
+
+// header formats the key header and options like wineserver.
+func (k *regKey) header() string {
+	if k.raw != "" {
+		return k.raw
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %d\n", regEscape(utf16.Encode([]rune(k.Name)), "[]"), k.Time)
+	if k.modif != 0 {
+		fmt.Fprintf(&b, "#time=%x\n", k.modif)
+	} else {
+		fmt.Fprintf(&b, "#time=%x\n", uint64(k.Time+11644473600)*10000000)
+	}
+	if k.Class != "" {
+		fmt.Fprintf(&b, "#class=\"%s\"\n", regEscape(utf16.Encode([]rune(k.Class)), `"`))
+	}
+	if k.Link {
+		b.WriteString("#link\n")
+	}
+	for _, opt := range k.options {
+		b.WriteString(opt + "\n")
+	}
+	return b.String()
+}
+
+// touch marks the key as modified.
+func (k *regKey) touch(f *regFile) {
+	k.raw, k.modif = "", 0
+	if k.Time = f.Time; k.Time == 0 {
+		k.Time = time.Now().Unix()
+	}
+}
+
+// Value gets a value of the key (case-insensitively).
+func (k *regKey) Value(name string) *regValue {
+	if k == nil {
+		return nil
+	}
+	for _, v := range k.Values {
+		if strings.EqualFold(v.Name, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// regCompare compares key paths (or value names) in the order wineserver
+// writes them, which is depth-first with case-insensitively sorted subkeys.
+func regCompare(a, b string) int {
+	as, bs := strings.Split(strings.ToUpper(a), `\`), strings.Split(strings.ToUpper(b), `\`)
+	for i := range min(len(as), len(bs)) {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// regKeyName normalizes a key path.
+func regKeyName(name string) string {
+	return strings.Trim(name, `\`)
+}
+
+// Key gets a key (case-insensitively), or nil if it doesn't exist.
+func (f *regFile) Key(name string) *regKey {
+	name = regKeyName(name)
+	for _, k := range f.Keys {
+		if strings.EqualFold(k.Name, name) {
+			return k
+		}
+	}
+	return nil
+}
+
+// HasKey checks if a key or any of its subkeys exist.
+func (f *regFile) HasKey(name string) bool {
+	name = regKeyName(name)
+	return slices.ContainsFunc(f.Keys, func(k *regKey) bool {
+		return regKeyUnder(k.Name, name)
+	})
+}
+
+// Subkeys gets the names (not the full paths) of the direct subkeys of a key,
+// including ones which only exist implicitly as the parents of other keys.
+func (f *regFile) Subkeys(name string) []string {
+	name = regKeyName(name)
+	var names []string
+	for _, k := range f.Keys {
+		rest := k.Name
+		if name != "" {
+			if len(k.Name) <= len(name) || !strings.EqualFold(k.Name[:len(name)], name) || k.Name[len(name)] != '\\' {
+				continue
+			}
+			rest = k.Name[len(name)+1:]
+		}
+		sub, _, _ := strings.Cut(rest, `\`)
+		if !slices.ContainsFunc(names, func(x string) bool {
+			return strings.EqualFold(x, sub)
+		}) {
+			names = append(names, sub)
+		}
+	}
+	return names
+}
+
+// Value gets a value, or nil if it doesn't exist.
+func (f *regFile) Value(key, name string) *regValue {
+	return f.Key(key).Value(name)
+}
+
+// CreateKey gets a key, creating it in the sorted position if it doesn't
+// exist.
+func (f *regFile) CreateKey(name string) *regKey {
+	name = regKeyName(name)
+	if k := f.Key(name); k != nil {
+		return k
+	}
+	k := &regKey{Name: name}
+	k.touch(f)
+	i, _ := slices.BinarySearchFunc(f.Keys, name, func(k *regKey, name string) int {
+		return regCompare(k.Name, name)
+	})
+	f.Keys = slices.Insert(f.Keys, i, k)
+	return k
+}
+
+// SetValue sets a value, creating the key if needed. It returns false if the
+// value already had the same type and data.
+func (f *regFile) SetValue(key, name string, typ uint32, data []byte) bool {
+	k := f.CreateKey(key)
+	if v := k.Value(name); v != nil {
+		if v.Type == typ && bytes.Equal(v.Data, data) {
+			return false
+		}
+		v.Type, v.Data, v.raw = typ, slices.Clone(data), ""
+	} else {
+		i, _ := slices.BinarySearchFunc(k.Values, name, func(v *regValue, name string) int {
+			return strings.Compare(strings.ToUpper(v.Name), strings.ToUpper(name))
+		})
+		k.Values = slices.Insert(k.Values, i, &regValue{Name: name, Type: typ, Data: slices.Clone(data)})
+	}
+	k.touch(f)
+	return true
+}
+
+// DeleteValue deletes a value, returning false if it didn't exist.
+func (f *regFile) DeleteValue(key, name string) bool {
+	k := f.Key(key)
+	if k == nil || k.Value(name) == nil {
+		return false
+	}
+	k.Values = slices.DeleteFunc(k.Values, func(v *regValue) bool {
+		return strings.EqualFold(v.Name, name)
+	})
+	k.touch(f)
+	return true
+}
+
+// DeleteKey deletes a key and its subkeys, returning the names of the deleted
+// keys.
+func (f *regFile) DeleteKey(name string) []string {
+	name = regKeyName(name)
+	var deleted []string
+	f.Keys = slices.DeleteFunc(f.Keys, func(k *regKey) bool {
+		if regKeyUnder(k.Name, name) {
+			deleted = append(deleted, k.Name)
+			return true
+		}
+		return false
+	})
+	return deleted
+}
+
+// Merge sets the keys and values in o, replacing existing values with the
+// same name.
+func (f *regFile) Merge(o *regFile) {
+	for _, ok := range o.Keys {
+		k := f.CreateKey(ok.Name)
+		if ok.Class != "" && k.Class != ok.Class {
+			k.Class = ok.Class
+			k.touch(f)
+		}
+		for _, v := range ok.Values {
+			f.SetValue(ok.Name, v.Name, v.Type, v.Data)
+		}
+	}
+}
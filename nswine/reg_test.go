@@ -0,0 +1,159 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseReg(t *testing.T) {
+	hive := unindent(`
+		WINE REGISTRY Version 2
+		;; All keys relative to \\Machine
+
+		#arch=win64
+
+		[Software\\Classes\\.bat] 1700000000
+		#time=1da1234567890ab
+		@="batfile"
+		"Content Type"="application/x-msdownload"
+
+		[Software\\Wine\\Test] 1700000000
+		#time=1da1234567890ab
+		#class="Foo \"bar\""
+		"Bin"=hex:00,01,02,03,04,05,06,07,08,09,0a,0b,0c,0d,0e,0f,10,11,12,13,14,15,16,\
+		  17,18,19,1a
+		"Dword"=dword:0000002a
+		"Expand"=str(2):"%SystemRoot%\\system32"
+		"Multi"=str(7):"a\0b\0"
+		"Quote\"d"="tab\tunicode\xe9\x2603!"
+
+		[System\\CurrentControlSet\\Control\\Nls\\CodePage] 1700000000
+		#time=1da1234567890ab
+		"ACP"="1252"
+		"OEMCP"="437"
+	`)
+	f, err := parseReg([]byte(hive))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if act := string(f.Bytes()); act != hive {
+		t.Errorf("round-trip changed the hive:\n%s", act)
+	}
+	if len(f.Keys) != 3 || f.Keys[1].Name != `Software\Wine\Test` || f.Keys[1].Time != 1700000000 || f.Keys[1].Class != `Foo "bar"` {
+		t.Fatalf("wrong keys %+v", f.Keys)
+	}
+	if v, ok := f.Value(`system\currentcontrolset\control\nls\codepage`, "oemcp").Str(); !ok || v != "437" {
+		t.Errorf("expected OEMCP 437, got %q", v)
+	}
+	if v, ok := f.Value(`Software\Classes\.bat`, "").Str(); !ok || v != "batfile" {
+		t.Errorf("expected default value batfile, got %q", v)
+	}
+	if v, ok := f.Value(`Software\Wine\Test`, "Expand").Str(); !ok || v != `%SystemRoot%\system32` {
+		t.Errorf("wrong expand string %q", v)
+	}
+	if v, ok := f.Value(`Software\Wine\Test`, "Multi").Strings(); !ok || !slices.Equal(v, []string{"a", "b"}) {
+		t.Errorf("wrong multi string %q", v)
+	}
+	if v, ok := f.Value(`Software\Wine\Test`, "Dword").DWORD(); !ok || v != 42 {
+		t.Errorf("wrong dword %d", v)
+	}
+	if v, ok := f.Value(`Software\Wine\Test`, `Quote"d`).Str(); !ok || v != "tab\tunicodeé☃!" {
+		t.Errorf("wrong escaped string %q", v)
+	}
+	if v := f.Value(`Software\Wine\Test`, "Bin"); v == nil || v.Type != regBinary || len(v.Data) != 27 || v.Data[26] != 0x1a {
+		t.Errorf("wrong binary value %+v", v)
+	}
+
+	// re-formatting unmodified values must match what wineserver wrote
+	for _, k := range f.Keys {
+		k.raw = ""
+		for _, v := range k.Values {
+			v.raw = ""
+		}
+	}
+	if act := string(f.Bytes()); act != hive {
+		t.Errorf("formatting doesn't match wineserver:\n%s", act)
+	}
+
+	if _, err := parseReg([]byte("WINE REGISTRY Version 2\n\n[A] 0\n\"x\"=bogus:1\n")); err == nil {
+		t.Errorf("expected error for invalid value")
+	}
+	if _, err := parseReg([]byte("WINE REGISTRY Version 2\n\n[A] 0\n\"x\"=hex:01,\\\n")); err == nil {
+		t.Errorf("expected error for unterminated value")
+	}
+}
+
+func TestRegEdit(t *testing.T) {
+	f, err := parseReg([]byte(unindent(`
+		WINE REGISTRY Version 2
+
+		[Software\\B] 1600000000
+		"X"="1"
+
+		[Software\\B\\Sub] 1600000000
+		"Y"="2"
+
+		[Software\\D] 1600000000
+		"Z"="3"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	f.Time = 1700000000
+
+	if f.SetValue(`Software\B`, "X", regSZ, regStringData("1")) {
+		t.Errorf("expected setting an identical value to be a no-op")
+	}
+	if !f.SetValue(`Software\b`, "A", regDWORD, regDWORDData(1)) {
+		t.Errorf("expected new value to be set")
+	}
+	f.SetValue(`Software\C`, "", regMultiSZ, regMultiStringData([]string{"x", "y"}))
+	f.SetValue(`Software\A`, "Bin", regBinary, []byte{1, 2, 3})
+	if !f.HasKey(`software\b`) || f.HasKey(`Software\E`) {
+		t.Errorf("wrong HasKey result")
+	}
+	if f.DeleteValue(`Software\D`, "missing") || !f.DeleteValue(`Software\D`, "z") {
+		t.Errorf("wrong DeleteValue result")
+	}
+	if deleted := f.DeleteKey(`Software\B\Sub`); !slices.Equal(deleted, []string{`Software\B\Sub`}) {
+		t.Errorf("wrong deleted keys %q", deleted)
+	}
+
+	o, err := parseReg([]byte(unindent(`
+		[Software\\A] 0
+		"Bin"="replaced"
+
+		[Software\\B\\New] 0
+		@=dword:00000002
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	f.Merge(o)
+
+	if exp := unindent(`
+		WINE REGISTRY Version 2
+
+		[Software\\A] 1700000000
+		#time=1da1747c66d0000
+		"Bin"="replaced"
+
+		[Software\\B] 1700000000
+		#time=1da1747c66d0000
+		"A"=dword:00000001
+		"X"="1"
+
+		[Software\\B\\New] 1700000000
+		#time=1da1747c66d0000
+		@=dword:00000002
+
+		[Software\\C] 1700000000
+		#time=1da1747c66d0000
+		@=str(7):"x\0y\0"
+
+		[Software\\D] 1700000000
+		#time=1da1747c66d0000
+	`); string(f.Bytes()) != exp {
+		t.Errorf("wrong output:\n%s", f.Bytes())
+	}
+}
@@ -0,0 +1,294 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// regDiffHives are the hives compared when diffing prefixes.
+var regDiffHives = []string{"system.reg", "user.reg", "userdef.reg"}
+
+// regDiffKey is a key which was added, removed, or has changed values.
+type regDiffKey struct {
+	Hive    string
+	Name    string
+	Op      byte // '+', '-', or '~'
+	Subkeys int  // number of added/removed subkeys collapsed into this one
+	Values  []regDiffValue
+}
+
+// regDiffValue is a value which was added, removed, or changed.
+type regDiffValue struct {
+	Op       byte      // '+', '-', or '~'
+	Old, New *regValue // nil if added/removed
+}
+
+// regdiffMain implements the regdiff subcommand, which compares the registry
+// of two prefixes (e.g., runtimes built with different wine versions or
+// profiles).
+func regdiffMain(args []string) error {
+	fset := flag.NewFlagSet("regdiff", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s regdiff [options] old new\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fset.Output(), "Shows the added, removed, and changed registry keys and values between two\nwineprefixes (e.g., nswine output directories), or two hive files. Keys\nare compared case-insensitively, and key timestamps are ignored.\n\n")
+		fset.PrintDefaults()
+	}
+	fi, _ := os.Stdout.Stat()
+	color := fset.Bool("color", fi != nil && fi.Mode()&os.ModeCharDevice != 0 && os.Getenv("NO_COLOR") == "", "colorize the output (defaults to true if stdout is a terminal)")
+	all := fset.Bool("all", false, "list the subkeys of added and removed keys instead of collapsing them")
+	fset.Parse(args)
+
+	if fset.NArg() != 2 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	a, aok, err := readRegistrySet(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, bok, err := readRegistrySet(fset.Arg(1))
+	if err != nil {
+		return err
+	}
+	if aok != bok {
+		return fmt.Errorf("cannot compare a prefix with a hive file")
+	}
+	writeRegDiff(os.Stdout, diffRegistry(a, b, *all), *color)
+	return nil
+}
+
+// readRegistrySet reads the hives of a prefix, or a single hive file (keyed by
+// an empty string), returning whether it was a prefix.
+func readRegistrySet(name string) (map[string]*regFile, bool, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, false, err
+	}
+	hives := map[string]*regFile{}
+	if !fi.IsDir() {
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			return nil, false, err
+		}
+		if hives[""], err = parseReg(buf); err != nil {
+			return nil, false, fmt.Errorf("%s: %w", name, err)
+		}
+		return hives, false, nil
+	}
+	for _, hive := range regDiffHives {
+		buf, err := os.ReadFile(filepath.Join(name, hive))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, false, err
+		}
+		if hives[hive], err = parseReg(buf); err != nil {
+			return nil, false, fmt.Errorf("%s: %w", filepath.Join(name, hive), err)
+		}
+	}
+	if len(hives) == 0 {
+		return nil, false, fmt.Errorf("%s: no registry hives found", name)
+	}
+	return hives, true, nil
+}
+
+// diffRegistry compares two sets of hives. Unless all is true, added or
+// removed keys under another added or removed key are collapsed into it.
+func diffRegistry(a, b map[string]*regFile, all bool) []regDiffKey {
+	var d []regDiffKey
+	hives := slices.Collect(maps.Keys(a))
+	for hive := range b {
+		if _, ok := a[hive]; !ok {
+			hives = append(hives, hive)
+		}
+	}
+	slices.Sort(hives)
+	for _, hive := range hives {
+		keys := func(f *regFile) map[string]*regKey {
+			r := map[string]*regKey{}
+			if f != nil {
+				for _, k := range f.Keys {
+					r[strings.ToUpper(k.Name)] = k
+				}
+			}
+			return r
+		}
+		ak, bk := keys(a[hive]), keys(b[hive])
+		names := slices.Collect(maps.Keys(ak))
+		for name := range bk {
+			if _, ok := ak[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		slices.SortFunc(names, regCompare)
+
+		last := -1 // the index of the last added or removed key
+		for _, name := range names {
+			x, y := ak[name], bk[name]
+			k := regDiffKey{Hive: hive}
+			switch {
+			case y == nil:
+				k.Name, k.Op = x.Name, '-'
+			case x == nil:
+				k.Name, k.Op = y.Name, '+'
+			default:
+				k.Name, k.Op = y.Name, '~'
+			}
+			if k.Op != '~' && !all && last != -1 && d[last].Op == k.Op && regKeyUnder(k.Name, d[last].Name) {
+				d[last].Subkeys++
+				continue
+			}
+			k.Values = diffRegValues(x, y)
+			if k.Op == '~' && len(k.Values) == 0 {
+				continue
+			}
+			d = append(d, k)
+			if last = -1; k.Op != '~' {
+				last = len(d) - 1
+			}
+		}
+	}
+	return d
+}
+
+// diffRegValues compares the values of two keys, either of which may be nil.
+func diffRegValues(a, b *regKey) []regDiffValue {
+	values := func(k *regKey) map[string]*regValue {
+		r := map[string]*regValue{}
+		if k != nil {
+			for _, v := range k.Values {
+				r[strings.ToUpper(v.Name)] = v
+			}
+		}
+		return r
+	}
+	av, bv := values(a), values(b)
+	names := slices.Collect(maps.Keys(av))
+	for name := range bv {
+		if _, ok := av[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var d []regDiffValue
+	for _, name := range names {
+		x, y := av[name], bv[name]
+		switch {
+		case y == nil:
+			d = append(d, regDiffValue{'-', x, nil})
+		case x == nil:
+			d = append(d, regDiffValue{'+', nil, y})
+		case x.Type != y.Type || !bytes.Equal(x.Data, y.Data):
+			d = append(d, regDiffValue{'~', x, y})
+		}
+	}
+	return d
+}
+
+// writeRegDiff writes a human-readable registry diff, optionally with ANSI
+// colors.
+func writeRegDiff(w io.Writer, d []regDiffKey, color bool) {
+	colors := map[byte]string{'+': "\x1b[32m", '-': "\x1b[31m", '~': "\x1b[33m"}
+	line := func(op byte, indent, s string) {
+		if color {
+			fmt.Fprintf(w, "%s%s%c %s\x1b[0m\n", colors[op], indent, op, s)
+		} else {
+			fmt.Fprintf(w, "%s%c %s\n", indent, op, s)
+		}
+	}
+	value := func(op byte, v *regValue) {
+		// values may be wrapped over multiple lines
+		s := strings.ReplaceAll(strings.TrimSuffix(v.String(), "\n"), "\n", "\n    ")
+		line(op, "  ", s)
+	}
+
+	var (
+		hive             string
+		added, removed   int
+		changed, nvalues int
+	)
+	for i, k := range d {
+		if k.Hive != "" && (i == 0 || k.Hive != hive) {
+			if i != 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s:\n", k.Hive)
+		}
+		hive = k.Hive
+
+		s := "[" + k.Name + "]"
+		if k.Subkeys != 0 {
+			s += fmt.Sprintf(" (and %d subkeys)", k.Subkeys)
+		}
+		line(k.Op, "", s)
+		switch k.Op {
+		case '+':
+			added += 1 + k.Subkeys
+		case '-':
+			removed += 1 + k.Subkeys
+		case '~':
+			changed++
+		}
+		for _, v := range k.Values {
+			if v.Old != nil {
+				value('-', v.Old)
+			}
+			if v.New != nil {
+				value('+', v.New)
+			}
+			if k.Op == '~' {
+				nvalues++
+			}
+		}
+	}
+	if len(d) != 0 {
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d keys added, %d removed, %d changed (%d values)\n", added, removed, changed, nvalues)
+}
+
+// regDiffEdits converts a diff (computed with all subkeys listed) to the edits
+// which turn the old registry into the new one. Hives without a root key in
+// regHiveRoots are skipped.
+func regDiffEdits(d []regDiffKey) []regEdit {
+	var (
+		edits   []regEdit
+		deleted string // the last deleted key
+	)
+	for _, k := range d {
+		root, ok := regHiveRoots[k.Hive]
+		if !ok {
+			continue
+		}
+		key := root + `\` + k.Name
+		switch k.Op {
+		case '-':
+			if deleted == "" || !regKeyUnder(key, deleted) {
+				edits = append(edits, regEdit{Key: key, Delete: true})
+				deleted = key
+			}
+			continue
+		case '+':
+			edits = append(edits, regEdit{Key: key})
+		}
+		for _, v := range k.Values {
+			if v.New == nil {
+				edits = append(edits, regEdit{Key: key, Delete: true, Value: &regValue{Name: v.Old.Name}})
+			} else {
+				edits = append(edits, regEdit{Key: key, Value: v.New})
+			}
+		}
+	}
+	return edits
+}
@@ -0,0 +1,152 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegDiff(t *testing.T) {
+	a, err := parseReg([]byte(unindent(`
+		WINE REGISTRY Version 2
+
+		[Software\\Gone] 1600000000
+		"X"="1"
+
+		[Software\\Gone\\Sub] 1600000000
+
+		[Software\\Gone\\Sub\\Deeper] 1600000000
+
+		[Software\\Same] 1600000000
+		"A"="1"
+
+		[Software\\Wine] 1600000000
+		"Changed"="old"
+		"Removed"=dword:00000001
+		"Type"="1"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	b, err := parseReg([]byte(unindent(`
+		WINE REGISTRY Version 2
+
+		[Software\\New] 1700000000
+		@="x"
+
+		[Software\\SAME] 1700000000
+		"a"="1"
+
+		[Software\\Wine] 1700000000
+		"Added"=hex:01,02
+		"Changed"="new"
+		"Type"=dword:00000001
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	d := diffRegistry(map[string]*regFile{"system.reg": a}, map[string]*regFile{"system.reg": b}, false)
+	if len(d) != 3 || d[0].Name != `Software\Gone` || d[0].Op != '-' || d[0].Subkeys != 2 || d[1].Name != `Software\New` || d[1].Op != '+' || d[2].Name != `Software\Wine` || d[2].Op != '~' || len(d[2].Values) != 4 {
+		t.Fatalf("incorrect diff %+v", d)
+	}
+	if d := diffRegistry(map[string]*regFile{"system.reg": a}, map[string]*regFile{"system.reg": b}, true); len(d) != 5 {
+		t.Errorf("expected subkeys to be listed, got %+v", d)
+	}
+
+	var buf bytes.Buffer
+	writeRegDiff(&buf, d, false)
+	if exp := unindent(`
+		system.reg:
+		- [Software\Gone] (and 2 subkeys)
+		  - "X"="1"
+		+ [Software\New]
+		  + @="x"
+		~ [Software\Wine]
+		  + "Added"=hex:01,02
+		  - "Changed"="old"
+		  + "Changed"="new"
+		  - "Removed"=dword:00000001
+		  - "Type"="1"
+		  + "Type"=dword:00000001
+
+		1 keys added, 3 removed, 1 changed (4 values)
+	`); buf.String() != exp {
+		t.Errorf("incorrect output:\n%s", buf.String())
+	}
+}
+
+func TestRegDiffEdits(t *testing.T) {
+	old := unindent(`
+		WINE REGISTRY Version 2
+
+		[Software\\Gone] 1600000000
+		"X"="1"
+
+		[Software\\Gone\\Sub] 1600000000
+
+		[Software\\Wine] 1600000000
+		"Changed"="old"
+		"Removed"=dword:00000001
+	`)
+	a, err := parseReg([]byte(old))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	b, err := parseReg([]byte(unindent(`
+		WINE REGISTRY Version 2
+
+		[Software\\New] 1700000000
+		@="x"
+
+		[Software\\New\\Sub] 1700000000
+		"Bin"=hex:00,01,02,03,04,05,06,07,08,09,0a,0b,0c,0d,0e,0f,10,11,12,13,14,15,16,\
+		  17,18,19,1a,1b,1c,1d,1e,1f
+		"Expand"=str(2):"%SystemRoot%"
+
+		[Software\\Wine] 1700000000
+		"Changed"="new \"quoted\"\n"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	edits := regDiffEdits(diffRegistry(map[string]*regFile{"system.reg": a}, map[string]*regFile{"system.reg": b}, true))
+	buf := formatRegedit(edits)
+	if exp := strings.ReplaceAll(unindent(`
+		Windows Registry Editor Version 5.00
+
+		[-HKEY_LOCAL_MACHINE\Software\Gone]
+
+		[HKEY_LOCAL_MACHINE\Software\New]
+		@="x"
+
+		[HKEY_LOCAL_MACHINE\Software\New\Sub]
+		"Bin"=hex:00,01,02,03,04,05,06,07,08,09,0a,0b,0c,0d,0e,0f,10,11,12,13,14,15,16,\
+		  17,18,19,1a,1b,1c,1d,1e,1f
+		"Expand"=hex(2):25,00,53,00,79,00,73,00,74,00,65,00,6d,00,52,00,6f,00,6f,00,74,\
+		  00,25,00,00,00
+
+		[HKEY_LOCAL_MACHINE\Software\Wine]
+		"Changed"="new \"quoted\"\n"
+		"Removed"=-
+	`), "\n", "\r\n"); string(buf) != exp {
+		t.Errorf("incorrect transcript:\n%s", buf)
+	}
+
+	// applying the transcript to the old registry must result in the new one
+	parsed, err := parseRegedit(buf)
+	if err != nil {
+		t.Fatalf("parse transcript: %v", err)
+	}
+	c, _ := parseReg([]byte(old))
+	hives := map[string]*regFile{"system.reg": c}
+	if err := applyRegEdits(hives, parsed); err != nil {
+		t.Fatalf("apply transcript: %v", err)
+	}
+	if d := diffRegistry(hives, map[string]*regFile{"system.reg": b}, true); len(d) != 0 {
+		t.Errorf("transcript didn't reproduce the registry: %+v", d)
+	}
+}
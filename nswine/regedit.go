@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// regEdit is a change to the registry, as in a .reg file.
+type regEdit struct {
+	Key    string    // full key, with a HKLM/HKCU/HKCR root (or the long forms)
+	Delete bool      // delete the key (or the value, if Value is set)
+	Value  *regValue // the value to set (or delete), if any
+}
+
+// parseRegedit parses a .reg file in the regedit format (either "Windows
+// Registry Editor Version 5.00", usually UTF-16LE, or "REGEDIT4").
+func parseRegedit(buf []byte) ([]regEdit, error) {
+	var s string
+	switch {
+	case bytes.HasPrefix(buf, []byte{0xff, 0xfe}):
+		u := make([]uint16, (len(buf)-2)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(buf[2+i*2:])
+		}
+		s = string(utf16.Decode(u))
+	default:
+		s = string(bytes.TrimPrefix(buf, []byte("\xef\xbb\xbf")))
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+
+	var (
+		edits []regEdit
+		key   string
+		skip  bool // values of deleted keys are ignored
+		v4    bool
+		num   int
+		cont  string // continued hex value
+	)
+	for i, line := range strings.Split(s, "\n") {
+		if cont == "" {
+			num = i + 1
+		}
+		line = strings.TrimSpace(line)
+		if cont != "" {
+			line = cont + line
+		}
+		if x, ok := strings.CutSuffix(line, `\`); ok {
+			cont = x
+			continue
+		}
+		cont = ""
+		if num == 1 {
+			switch line {
+			case "Windows Registry Editor Version 5.00":
+			case "REGEDIT4":
+				v4 = true
+			default:
+				return nil, fmt.Errorf("parse reg file: unsupported header %q", line)
+			}
+			continue
+		}
+		switch {
+		case line == "" || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "["):
+			name, ok := strings.CutSuffix(line[1:], "]")
+			if !ok {
+				return nil, fmt.Errorf("parse reg file: line %d: invalid key", num)
+			}
+			name, del := strings.CutPrefix(name, "-")
+			if _, _, ok := regHiveKey(name); !ok {
+				return nil, fmt.Errorf("parse reg file: line %d: unsupported key %q", num, name)
+			}
+			key, skip = name, del
+			edits = append(edits, regEdit{Key: key, Delete: del})
+		case key == "":
+			return nil, fmt.Errorf("parse reg file: line %d: value outside of a key", num)
+		case skip:
+		default:
+			v, del, err := regeditValue(line, v4)
+			if err != nil {
+				return nil, fmt.Errorf("parse reg file: line %d: %w", num, err)
+			}
+			edits = append(edits, regEdit{Key: key, Delete: del, Value: v})
+		}
+	}
+	if cont != "" {
+		return nil, fmt.Errorf("parse reg file: line %d: unterminated value", num)
+	}
+	return edits, nil
+}
+
+// regeditValue parses a value line of a .reg file, returning whether it's a
+// deletion.
+func regeditValue(line string, v4 bool) (*regValue, bool, error) {
+	v := &regValue{}
+	var rest string
+	if x, ok := strings.CutPrefix(line, "@="); ok {
+		rest = x
+	} else if x, ok := strings.CutPrefix(line, `"`); ok {
+		name, x, ok := regeditUnescape(x)
+		if !ok {
+			return nil, false, fmt.Errorf("invalid value name")
+		}
+		if x, ok = strings.CutPrefix(strings.TrimSpace(x), "="); !ok {
+			return nil, false, fmt.Errorf("expected = after value name %q", name)
+		}
+		v.Name, rest = name, strings.TrimSpace(x)
+	} else {
+		return nil, false, fmt.Errorf("expected value")
+	}
+	if rest == "-" {
+		return v, true, nil
+	}
+	if x, ok := strings.CutPrefix(rest, `"`); ok {
+		str, x, ok := regeditUnescape(x)
+		if !ok || strings.TrimSpace(x) != "" {
+			return nil, false, fmt.Errorf("value %q: invalid string", v.Name)
+		}
+		v.Type, v.Data = regSZ, regStringData(str)
+		return v, false, nil
+	}
+	if strings.HasPrefix(rest, "str(") {
+		return nil, false, fmt.Errorf("value %q: unknown data format", v.Name)
+	}
+	typ, data, err := regParseData(rest)
+	if err != nil {
+		return nil, false, fmt.Errorf("value %q: %w", v.Name, err)
+	}
+	if v4 && (typ == regExpandSZ || typ == regMultiSZ) {
+		// REGEDIT4 strings are ANSI (assume latin1)
+		r := make([]rune, len(data))
+		for i, c := range data {
+			r[i] = rune(c)
+		}
+		data = u8to16[string, []byte](string(r))
+	}
+	v.Type, v.Data = typ, data
+	return v, false, nil
+}
+
+// regeditUnescape unescapes a .reg file string after the opening quote like
+// wine's regedit, returning the rest after the closing quote.
+func regeditUnescape(s string) (string, string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return b.String(), s[i+1:], true
+		case c == '\\' && i+1 < len(s):
+			switch i++; s[i] {
+			case '\\', '"':
+				b.WriteByte(s[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", false
+}
+
+// applyRegEdits applies edits to the hives (keyed by file name, like
+// regHiveKey), creating empty hives if needed.
+func applyRegEdits(hives map[string]*regFile, edits []regEdit) error {
+	for _, e := range edits {
+		hive, rel, ok := regHiveKey(e.Key)
+		if !ok {
+			return fmt.Errorf("apply registry edit: unsupported key %q", e.Key)
+		}
+		f := hives[hive]
+		if f == nil {
+			f = &regFile{Header: "WINE REGISTRY Version 2\n"}
+			hives[hive] = f
+		}
+		switch {
+		case e.Value == nil && e.Delete:
+			f.DeleteKey(rel)
+		case e.Value == nil:
+			f.CreateKey(rel)
+		case e.Delete:
+			f.DeleteValue(rel, e.Value.Name)
+		default:
+			f.SetValue(rel, e.Value.Name, e.Value.Type, e.Value.Data)
+		}
+	}
+	return nil
+}
+
+// editRegHives parses the system and user hives of the prefix at dir, calls fn
+// with them (keyed like applyRegEdits), and writes them back.
+func editRegHives(dir string, fn func(hives map[string]*regFile) error) error {
+	hives := map[string]*regFile{}
+	for _, hive := range []string{"system.reg", "user.reg"} {
+		buf, err := os.ReadFile(filepath.Join(dir, hive))
+		if err != nil {
+			return err
+		}
+		if hives[hive], err = parseReg(buf); err != nil {
+			return fmt.Errorf("%s: %w", hive, err)
+		}
+	}
+	if err := fn(hives); err != nil {
+		return err
+	}
+	for hive, f := range hives {
+		if err := os.WriteFile(filepath.Join(dir, hive), f.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// regHiveRoots are the root keys of the wine hive files, as written in .reg
+// files.
+var regHiveRoots = map[string]string{
+	"system.reg": "HKEY_LOCAL_MACHINE",
+	"user.reg":   "HKEY_CURRENT_USER",
+}
+
+// formatRegedit formats edits as a .reg file in the "Windows Registry Editor
+// Version 5.00" format (but UTF-8 with CRLF newlines, which wine's regedit and
+// parseRegedit accept).
+func formatRegedit(edits []regEdit) []byte {
+	var (
+		b   strings.Builder
+		key string
+		del bool
+	)
+	b.WriteString("Windows Registry Editor Version 5.00\r\n")
+	for i, e := range edits {
+		if i == 0 || e.Value == nil || del || !strings.EqualFold(e.Key, key) {
+			key, del = e.Key, e.Value == nil && e.Delete
+			if del {
+				b.WriteString("\r\n[-" + key + "]\r\n")
+			} else {
+				b.WriteString("\r\n[" + key + "]\r\n")
+			}
+		}
+		if e.Value != nil {
+			b.WriteString(regeditFormatValue(e.Value, e.Delete))
+		}
+	}
+	return []byte(b.String())
+}
+
+// regeditFormatValue formats a value line like wine's regedit exports it,
+// including the trailing newline.
+func regeditFormatValue(v *regValue, del bool) string {
+	var b strings.Builder
+	if v.Name != "" {
+		b.WriteString(`"` + regeditEscape(v.Name) + `"=`)
+	} else {
+		b.WriteString("@=")
+	}
+	if del {
+		b.WriteString("-\r\n")
+		return b.String()
+	}
+	switch v.Type {
+	case regSZ:
+		// only properly terminated strings are written as strings
+		if s, _ := v.Str(); bytes.Equal(regStringData(s), v.Data) {
+			b.WriteString(`"` + regeditEscape(s) + `"` + "\r\n")
+			return b.String()
+		}
+	case regDWORD:
+		if len(v.Data) == 4 {
+			fmt.Fprintf(&b, "dword:%08x\r\n", binary.LittleEndian.Uint32(v.Data))
+			return b.String()
+		}
+	}
+	if v.Type == regBinary {
+		b.WriteString("hex:")
+	} else {
+		fmt.Fprintf(&b, "hex(%x):", v.Type)
+	}
+	count := b.Len()
+	for i, x := range v.Data {
+		fmt.Fprintf(&b, "%02x", x)
+		count += 2
+		if i < len(v.Data)-1 {
+			b.WriteByte(',')
+			if count++; count > 76 {
+				b.WriteString("\\\r\n  ")
+				count = 2
+			}
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// regeditEscape escapes a .reg file string like regeditUnescape expects.
+func regeditEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\x00", `\0`).Replace(s)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRegedit(t *testing.T) {
+	reg := unindent(`
+		Windows Registry Editor Version 5.00
+
+		; comment
+		[HKEY_LOCAL_MACHINE\Software\Foo]
+		@="default"
+		"Path"="C:\\foo \"bar\""
+		"Dword"=dword:0000002a
+		"Multi"=hex(7):61,00,00,00,62,00,00,00,\
+		  00,00
+		"Old"=-
+
+		[-HKEY_CURRENT_USER\Software\Gone]
+		"Ignored"="x"
+
+		[HKEY_CLASSES_ROOT\.foo]
+		@="foofile"
+	`)
+	u := u8to16[string, []byte](reg)
+	edits, err := parseRegedit(append([]byte{0xff, 0xfe}, u...))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(edits) != 9 {
+		t.Fatalf("expected 9 edits, got %d: %+v", len(edits), edits)
+	}
+
+	hives := map[string]*regFile{}
+	for hive, s := range map[string]string{
+		"system.reg": unindent(`
+			WINE REGISTRY Version 2
+
+			[Software\\Foo] 1600000000
+			"Old"="1"
+		`),
+		"user.reg": unindent(`
+			WINE REGISTRY Version 2
+
+			[Software\\Gone\\Sub] 1600000000
+			"X"="1"
+
+			[Software\\Kept] 1600000000
+			"X"="1"
+		`),
+	} {
+		f, err := parseReg([]byte(s))
+		if err != nil {
+			t.Fatalf("parse %s: %v", hive, err)
+		}
+		f.Time = 1700000000
+		hives[hive] = f
+	}
+	if err := applyRegEdits(hives, edits); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	sys := hives["system.reg"]
+	if v, _ := sys.Value(`Software\Foo`, "Path").Str(); v != `C:\foo "bar"` {
+		t.Errorf("wrong string %q", v)
+	}
+	if v, _ := sys.Value(`Software\Foo`, "").Str(); v != "default" {
+		t.Errorf("wrong default value %q", v)
+	}
+	if v, _ := sys.Value(`Software\Foo`, "Dword").DWORD(); v != 42 {
+		t.Errorf("wrong dword %d", v)
+	}
+	if v, _ := sys.Value(`Software\Foo`, "Multi").Strings(); !slices.Equal(v, []string{"a", "b"}) {
+		t.Errorf("wrong multi string %q", v)
+	}
+	if sys.Value(`Software\Foo`, "Old") != nil {
+		t.Errorf("expected value to be deleted")
+	}
+	if v, _ := sys.Value(`Software\Classes\.foo`, "").Str(); v != "foofile" {
+		t.Errorf("wrong class %q", v)
+	}
+	if usr := hives["user.reg"]; usr.HasKey(`Software\Gone`) || !usr.HasKey(`Software\Kept`) {
+		t.Errorf("expected only the deleted key to be removed")
+	}
+
+	edits, err = parseRegedit([]byte("REGEDIT4\r\n\r\n[HKEY_CURRENT_USER\\Software\\Foo]\r\n\"Exp\"=hex(2):25,61,25,00\r\n"))
+	if err != nil {
+		t.Fatalf("parse regedit4: %v", err)
+	}
+	if v := edits[1].Value; v.Type != regExpandSZ || !slices.Equal(v.Data, regStringData("%a%")) {
+		t.Errorf("expected ansi hex(2) to be converted, got %+v", v)
+	}
+
+	for _, s := range []string{
+		"",
+		"Windows Registry Editor Version 5.00\n\n[HKEY_USERS\\.Default]\n",
+		"Windows Registry Editor Version 5.00\n\"x\"=\"y\"\n",
+		"Windows Registry Editor Version 5.00\n\n[HKEY_CURRENT_USER\\Foo]\n\"x\"=hex:01,\\",
+	} {
+		if _, err := parseRegedit([]byte(s)); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
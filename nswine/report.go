@@ -0,0 +1,526 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// reportCategories are the file categories used by reports, in display order.
+var reportCategories = []string{
+	"pe modules",
+	"unix libs",
+	"vendored libs",
+	"executables",
+	"nls",
+	"fonts",
+	"other wine files",
+	"prefix drive_c",
+	"prefix",
+}
+
+// reportCategory categorizes a file in a manifest.
+func reportCategory(f *ManifestFile) string {
+	if f.Root == "prefix" {
+		if strings.HasPrefix(f.Path, "drive_c/") {
+			return "prefix drive_c"
+		}
+		return "prefix"
+	}
+	dir := path.Dir(f.Path)
+	switch {
+	case f.Provenance.Origin == OriginVendored:
+		return "vendored libs"
+	case strings.HasPrefix(dir, "lib/wine/") && strings.HasSuffix(dir, "-windows"):
+		return "pe modules"
+	case strings.HasPrefix(dir, "lib/wine/") && strings.HasSuffix(dir, "-unix"):
+		return "unix libs"
+	case dir == "bin":
+		return "executables"
+	case dir == "share/wine/nls":
+		return "nls"
+	case strings.HasPrefix(dir, "share/wine/fonts"):
+		return "fonts"
+	}
+	return "other wine files"
+}
+
+// reportFileDiff is a file which differs between two manifests. The size is -1
+// if the file doesn't exist.
+type reportFileDiff struct {
+	Path    string // root-relative, prefixed with the root
+	OldSize int64
+	NewSize int64
+}
+
+// reportCategoryDiff is the difference in a file category between two
+// manifests.
+type reportCategoryDiff struct {
+	Name     string
+	OldCount int
+	NewCount int
+	OldSize  int64
+	NewSize  int64
+	Files    []reportFileDiff
+}
+
+// reportServiceDiff is a service which is kept in one manifest but not the
+// other (or only exists in one of them).
+type reportServiceDiff struct {
+	Name       string
+	OldRemoved string // removal reason, "-" if the service doesn't exist
+	NewRemoved string // removal reason, "-" if the service doesn't exist
+}
+
+// reportDegradedDiff is a missing optional input which was added or resolved.
+type reportDegradedDiff struct {
+	Component string
+	Reason    string // empty if resolved
+}
+
+// reportRegistryDiff is a profile registry value which was added, removed, or
+// changed.
+type reportRegistryDiff struct {
+	Name     string // key and value name
+	OldValue string // "-" if it wasn't set
+	NewValue string // "-" if it isn't set
+}
+
+// reportVersionDiff is a PE file in both manifests with a different file
+// version.
+type reportVersionDiff struct {
+	Path       string // root-relative, prefixed with the root
+	OldVersion string // empty if it doesn't have one
+	NewVersion string // empty if it doesn't have one
+}
+
+// reportDiff is the difference between two manifests.
+type reportDiff struct {
+	Categories []reportCategoryDiff
+	Services   []reportServiceDiff
+	Degraded   []reportDegradedDiff
+	Registry   []reportRegistryDiff
+	Versions   []reportVersionDiff
+}
+
+// compareManifests computes the categorized difference between two
+// manifests.
+func compareManifests(a, b *Manifest) *reportDiff {
+	var (
+		d    = &reportDiff{}
+		cats = map[string]*reportCategoryDiff{}
+	)
+	for _, name := range reportCategories {
+		d.Categories = append(d.Categories, reportCategoryDiff{Name: name})
+	}
+	for i := range d.Categories {
+		cats[d.Categories[i].Name] = &d.Categories[i]
+	}
+
+	type file struct {
+		cat  string
+		size int64
+		hash string
+	}
+	files := func(m *Manifest) map[string]file {
+		r := map[string]file{}
+		for _, f := range m.Files {
+			r[f.Root+"/"+f.Path] = file{reportCategory(f), f.Size, f.SHA256}
+		}
+		return r
+	}
+	af, bf := files(a), files(b)
+	for _, f := range af {
+		cats[f.cat].OldCount++
+		cats[f.cat].OldSize += f.size
+	}
+	for _, f := range bf {
+		cats[f.cat].NewCount++
+		cats[f.cat].NewSize += f.size
+	}
+	for _, p := range slices.Sorted(maps.Keys(af)) {
+		if x, ok := bf[p]; !ok {
+			cats[af[p].cat].Files = append(cats[af[p].cat].Files, reportFileDiff{p, af[p].size, -1})
+		} else if x.size != af[p].size || x.hash != af[p].hash {
+			cats[x.cat].Files = append(cats[x.cat].Files, reportFileDiff{p, af[p].size, x.size})
+		}
+	}
+	for _, p := range slices.Sorted(maps.Keys(bf)) {
+		if _, ok := af[p]; !ok {
+			cats[bf[p].cat].Files = append(cats[bf[p].cat].Files, reportFileDiff{p, -1, bf[p].size})
+		}
+	}
+	for i := range d.Categories {
+		slices.SortStableFunc(d.Categories[i].Files, func(x, y reportFileDiff) int {
+			return strings.Compare(x.Path, y.Path)
+		})
+	}
+
+	services := func(m *Manifest) map[string]string {
+		r := map[string]string{}
+		for _, s := range m.Services {
+			r[s.Name] = s.Removed
+		}
+		return r
+	}
+	as, bs := services(a), services(b)
+	names := slices.Collect(maps.Keys(as))
+	for name := range bs {
+		if _, ok := as[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		x, xok := as[name]
+		y, yok := bs[name]
+		if !xok {
+			x = "-"
+		}
+		if !yok {
+			y = "-"
+		}
+		if (x == "") != (y == "") {
+			d.Services = append(d.Services, reportServiceDiff{name, x, y})
+		}
+	}
+
+	degraded := func(m *Manifest) map[string]string {
+		r := map[string]string{}
+		for _, x := range m.Degraded {
+			r[x.Component] = x.Reason
+		}
+		return r
+	}
+	ad, bd := degraded(a), degraded(b)
+	for _, name := range slices.Sorted(maps.Keys(bd)) {
+		if _, ok := ad[name]; !ok {
+			d.Degraded = append(d.Degraded, reportDegradedDiff{name, bd[name]})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(ad)) {
+		if _, ok := bd[name]; !ok {
+			d.Degraded = append(d.Degraded, reportDegradedDiff{name, ""})
+		}
+	}
+
+	registry := func(m *Manifest) map[string]string {
+		r := map[string]string{}
+		for _, x := range m.Registry {
+			r[reportRegistryName(x)] = reportRegistryValue(x)
+		}
+		return r
+	}
+	ar, br := registry(a), registry(b)
+	names = slices.Collect(maps.Keys(ar))
+	for name := range br {
+		if _, ok := ar[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		x, xok := ar[name]
+		y, yok := br[name]
+		if !xok {
+			x = "-"
+		}
+		if !yok {
+			y = "-"
+		}
+		if x != y {
+			d.Registry = append(d.Registry, reportRegistryDiff{name, x, y})
+		}
+	}
+
+	versions := func(m *Manifest) map[string]string {
+		r := map[string]string{}
+		for _, f := range m.Files {
+			if f.Version != nil {
+				r[f.Root+"/"+f.Path] = f.Version.File
+			}
+		}
+		return r
+	}
+	av, bv := versions(a), versions(b)
+	for _, p := range slices.Sorted(maps.Keys(af)) {
+		if _, ok := bf[p]; ok && av[p] != bv[p] {
+			d.Versions = append(d.Versions, reportVersionDiff{p, av[p], bv[p]})
+		}
+	}
+	return d
+}
+
+// writeReportDiff writes a human-readable categorized diff. If files is true,
+// each changed file is listed.
+func writeReportDiff(w io.Writer, d *reportDiff, files bool) {
+	var (
+		oc, nc   int
+		osz, nsz int64
+	)
+	fmt.Fprintf(w, "%-18s %18s %28s\n", "category", "files", "size")
+	for _, c := range d.Categories {
+		if c.OldCount == 0 && c.NewCount == 0 {
+			continue
+		}
+		oc, nc, osz, nsz = oc+c.OldCount, nc+c.NewCount, osz+c.OldSize, nsz+c.NewSize
+		fmt.Fprintf(w, "%-18s %18s %28s\n", c.Name, reportCountChange(c.OldCount, c.NewCount), reportSizeChange(c.OldSize, c.NewSize))
+		if files {
+			for _, f := range c.Files {
+				switch {
+				case f.OldSize == -1:
+					fmt.Fprintf(w, "  + %s (%s)\n", f.Path, reportSize(f.NewSize))
+				case f.NewSize == -1:
+					fmt.Fprintf(w, "  - %s (%s)\n", f.Path, reportSize(f.OldSize))
+				default:
+					fmt.Fprintf(w, "  ~ %s (%s)\n", f.Path, reportSizeChange(f.OldSize, f.NewSize))
+				}
+			}
+		}
+	}
+	fmt.Fprintf(w, "%-18s %18s %28s\n", "total", reportCountChange(oc, nc), reportSizeChange(osz, nsz))
+
+	if len(d.Services) != 0 {
+		fmt.Fprintf(w, "\nservices:\n")
+		for _, s := range d.Services {
+			switch {
+			case s.NewRemoved == "":
+				fmt.Fprintf(w, "  + %s (now kept, was %s)\n", s.Name, reportRemoved(s.OldRemoved))
+			default:
+				fmt.Fprintf(w, "  - %s (no longer kept, %s)\n", s.Name, reportRemoved(s.NewRemoved))
+			}
+		}
+	}
+
+	if len(d.Degraded) != 0 {
+		fmt.Fprintf(w, "\ndegraded:\n")
+		for _, x := range d.Degraded {
+			if x.Reason == "" {
+				fmt.Fprintf(w, "  - %s (resolved)\n", x.Component)
+			} else {
+				fmt.Fprintf(w, "  + %s (%s)\n", x.Component, x.Reason)
+			}
+		}
+	}
+
+	if len(d.Registry) != 0 {
+		fmt.Fprintf(w, "\nregistry:\n")
+		for _, x := range d.Registry {
+			switch {
+			case x.OldValue == "-":
+				fmt.Fprintf(w, "  + %s = %s\n", x.Name, x.NewValue)
+			case x.NewValue == "-":
+				fmt.Fprintf(w, "  - %s = %s\n", x.Name, x.OldValue)
+			default:
+				fmt.Fprintf(w, "  ~ %s (%s -> %s)\n", x.Name, x.OldValue, x.NewValue)
+			}
+		}
+	}
+
+	if len(d.Versions) != 0 {
+		fmt.Fprintf(w, "\nversions:\n")
+		for _, v := range d.Versions {
+			fmt.Fprintf(w, "  ~ %s (%s -> %s)\n", v.Path, cmp.Or(v.OldVersion, "none"), cmp.Or(v.NewVersion, "none"))
+		}
+	}
+}
+
+func reportRegistryName(x *ManifestRegistry) string {
+	return x.Key + `\` + cmp.Or(x.Name, "@")
+}
+
+func reportRegistryValue(x *ManifestRegistry) string {
+	buf, _ := json.Marshal(x.Value)
+	return x.Type + " " + string(buf)
+}
+
+func reportRemoved(reason string) string {
+	if reason == "-" {
+		return "not present"
+	}
+	return "removed: " + reason
+}
+
+func reportCountChange(a, b int) string {
+	if a == b {
+		return fmt.Sprint(a)
+	}
+	return fmt.Sprintf("%d -> %d (%+d)", a, b, b-a)
+}
+
+func reportSizeChange(a, b int64) string {
+	if a == b {
+		return reportSize(a)
+	}
+	if b < a {
+		return fmt.Sprintf("%s -> %s (-%s)", reportSize(a), reportSize(b), reportSize(a-b))
+	}
+	return fmt.Sprintf("%s -> %s (+%s)", reportSize(a), reportSize(b), reportSize(b-a))
+}
+
+func reportSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// writeReportSummary writes a human-readable summary of a manifest.
+func writeReportSummary(w io.Writer, m *Manifest) {
+	d := compareManifests(m, m)
+	var (
+		n    int
+		size int64
+	)
+	fmt.Fprintf(w, "%-18s %8s %12s\n", "category", "files", "size")
+	for _, c := range d.Categories {
+		if c.NewCount != 0 {
+			n, size = n+c.NewCount, size+c.NewSize
+			fmt.Fprintf(w, "%-18s %8d %12s\n", c.Name, c.NewCount, reportSize(c.NewSize))
+		}
+	}
+	fmt.Fprintf(w, "%-18s %8d %12s\n", "total", n, reportSize(size))
+
+	if len(m.Services) != 0 {
+		var kept int
+		for _, s := range m.Services {
+			if s.Removed == "" {
+				kept++
+			}
+		}
+		fmt.Fprintf(w, "\nservices: %d kept, %d removed\n", kept, len(m.Services)-kept)
+		for _, s := range m.Services {
+			if s.Removed != "" {
+				fmt.Fprintf(w, "  - %s (%s)\n", s.Name, s.Removed)
+			}
+		}
+	}
+
+	if len(m.Degraded) != 0 {
+		fmt.Fprintf(w, "\ndegraded build, missing optional inputs:\n")
+		for _, x := range m.Degraded {
+			fmt.Fprintf(w, "  - %s: %s (%s)\n", x.Component, x.Reason, x.Effect)
+		}
+	}
+
+	if len(m.Registry) != 0 {
+		fmt.Fprintf(w, "\nregistry: %d profile values\n", len(m.Registry))
+		for _, x := range m.Registry {
+			fmt.Fprintf(w, "  %s = %s\n", reportRegistryName(x), reportRegistryValue(x))
+		}
+	}
+}
+
+// writeReportVersions writes the file and product versions of the PE files in
+// a manifest which have them.
+func writeReportVersions(w io.Writer, m *Manifest) {
+	fmt.Fprintf(w, "\nversions:\n")
+	for _, f := range m.Files {
+		if f.Version != nil {
+			fmt.Fprintf(w, "  %s/%s %s (product %s)\n", f.Root, f.Path, f.Version.File, f.Version.Product)
+		}
+	}
+}
+
+// writeReportStubs writes the exports of the PE modules in a manifest which are
+// unimplemented wine stubs.
+func writeReportStubs(w io.Writer, m *Manifest) {
+	fmt.Fprintf(w, "\nstubs:\n")
+	for _, name := range slices.Sorted(maps.Keys(m.Stubs)) {
+		fmt.Fprintf(w, "  %s (%d): %s\n", name, len(m.Stubs[name]), strings.Join(m.Stubs[name], ", "))
+	}
+}
+
+// readManifest reads a manifest from a file, or from the manifest file in an
+// output directory.
+func readManifest(name string) (*Manifest, error) {
+	if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+		name = filepath.Join(name, ManifestName)
+	}
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+	return &m, nil
+}
+
+// reportMain implements the report subcommand, which summarizes a build
+// report (the output manifest), or compares two of them.
+func reportMain(args []string) error {
+	fset := flag.NewFlagSet("report", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s report [options] manifest\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fset.Output(), "       %s report -compare [options] old_manifest new_manifest\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fset.Output(), "Summarizes the files and services in a build, or shows what changed between\ntwo builds. Manifests can be the %s file or the output directory containing it.\n\n", ManifestName)
+		fset.PrintDefaults()
+	}
+	var (
+		compare   = fset.Bool("compare", false, "compare two builds")
+		files     = fset.Bool("files", true, "list individual changed files")
+		versions  = fset.Bool("versions", false, "list the versions of the PE files in the build")
+		stubs     = fset.Bool("stubs", false, "list the exports of the PE modules in the build which are unimplemented wine stubs")
+		sha256sum = fset.Bool("sha256sum", false, "only write the hashes of the binaries in the build (in sha256sum format, relative to a directory containing the wine dir as wine/ and the wineprefix as prefix/)")
+	)
+	fset.Parse(args)
+
+	if n := fset.NArg(); (*compare && n != 2) || (!*compare && n != 1) || (*compare && *sha256sum) {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	var ms []*Manifest
+	for _, name := range fset.Args() {
+		m, err := readManifest(name)
+		if err != nil {
+			return err
+		}
+		ms = append(ms, m)
+	}
+	if *sha256sum {
+		writeBinaryHashes(os.Stdout, ms[0])
+		return nil
+	}
+	if !*compare {
+		fmt.Printf("wine: %s\n", ms[0].WineBuildID)
+		if ms[0].Binaries != "" {
+			fmt.Printf("binaries: sha256:%s\n", ms[0].Binaries)
+		}
+		fmt.Printf("\n")
+		writeReportSummary(os.Stdout, ms[0])
+		if *versions {
+			writeReportVersions(os.Stdout, ms[0])
+		}
+		if *stubs {
+			writeReportStubs(os.Stdout, ms[0])
+		}
+		return nil
+	}
+	if ms[0].Compat != ms[1].Compat {
+		fmt.Printf("runtime compat: %d -> %d\n", ms[0].Compat, ms[1].Compat)
+	}
+	if ms[0].WineBuildID != ms[1].WineBuildID {
+		fmt.Printf("wine: %s -> %s\n\n", ms[0].WineBuildID, ms[1].WineBuildID)
+	}
+	if ms[0].Binaries != ms[1].Binaries {
+		fmt.Printf("binaries: sha256:%s -> sha256:%s\n\n", cmp.Or(ms[0].Binaries, "unknown"), cmp.Or(ms[1].Binaries, "unknown"))
+	}
+	writeReportDiff(os.Stdout, compareManifests(ms[0], ms[1]), *files)
+	return nil
+}
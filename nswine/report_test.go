@@ -0,0 +1,110 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompareManifests(t *testing.T) {
+	a := &Manifest{
+		Files: []*ManifestFile{
+			{Root: "wine", Path: "lib/wine/x86_64-windows/d3d11.dll", Size: 2 << 20},
+			{Root: "wine", Path: "lib/wine/x86_64-windows/kernel32.dll", Size: 1000, Version: &peVersion{File: "10.0.0.0"}},
+			{Root: "wine", Path: "lib/wine/x86_64-windows/user32.dll", Size: 1000, SHA256: "aa"},
+			{Root: "wine", Path: "lib/wine/x86_64-unix/ntdll.so", Size: 5000},
+			{Root: "prefix", Path: "system.reg", Size: 300},
+		},
+		Services: []*ManifestService{
+			{Name: "Foo", Section: "FooService"},
+			{Name: "Bar", Section: "BarService", Removed: "profile"},
+			{Name: "Baz", Section: "BazService"},
+		},
+		Degraded: []*ManifestDegradation{
+			{Component: "wine-mono", Reason: "not found in share/wine/mono"},
+		},
+		Registry: []*ManifestRegistry{
+			{Key: `HKCU\Software\Wine\Direct3D`, Name: "VideoMemorySize", Type: "REG_SZ", Value: "512"},
+			{Key: `HKCU\Software\Wine\DllOverrides`, Name: "mshtml", Type: "REG_SZ", Value: ""},
+		},
+	}
+	b := &Manifest{
+		Files: []*ManifestFile{
+			{Root: "wine", Path: "lib/wine/x86_64-windows/kernel32.dll", Size: 1000, Version: &peVersion{File: "10.1.0.0"}},
+			{Root: "wine", Path: "lib/wine/x86_64-windows/user32.dll", Size: 1000, SHA256: "bb"},
+			{Root: "wine", Path: "lib/wine/x86_64-unix/ntdll.so", Size: 4000},
+			{Root: "wine", Path: "lib/libfoo.so.1", Size: 100, Provenance: Provenance{Origin: OriginVendored}},
+			{Root: "prefix", Path: "system.reg", Size: 300},
+		},
+		Services: []*ManifestService{
+			{Name: "Foo", Section: "FooService", Removed: "missing binary"},
+			{Name: "Bar", Section: "BarService"},
+			{Name: "Baz", Section: "BazService"},
+		},
+		Degraded: []*ManifestDegradation{
+			{Component: "libgnutls.so.30", Reason: "not found on the build host"},
+		},
+		Registry: []*ManifestRegistry{
+			{Key: `HKCU\Software\Wine\Direct3D`, Name: "VideoMemorySize", Type: "REG_SZ", Value: "1024"},
+			{Key: `HKLM\System\CurrentControlSet\Services\Tcpip\Parameters`, Name: "DefaultTTL", Type: "REG_DWORD", Value: 64},
+		},
+	}
+	d := compareManifests(a, b)
+
+	cats := map[string]reportCategoryDiff{}
+	for _, c := range d.Categories {
+		cats[c.Name] = c
+	}
+	if c := cats["pe modules"]; c.OldCount != 3 || c.NewCount != 2 || c.OldSize != 2<<20+2000 || c.NewSize != 2000 || len(c.Files) != 2 || c.Files[0] != (reportFileDiff{"wine/lib/wine/x86_64-windows/d3d11.dll", 2 << 20, -1}) || c.Files[1] != (reportFileDiff{"wine/lib/wine/x86_64-windows/user32.dll", 1000, 1000}) {
+		t.Errorf("incorrect pe modules diff %+v", c)
+	}
+	if c := cats["unix libs"]; len(c.Files) != 1 || c.Files[0] != (reportFileDiff{"wine/lib/wine/x86_64-unix/ntdll.so", 5000, 4000}) {
+		t.Errorf("incorrect unix libs diff %+v", c)
+	}
+	if c := cats["vendored libs"]; c.NewCount != 1 || len(c.Files) != 1 || c.Files[0].OldSize != -1 {
+		t.Errorf("incorrect vendored libs diff %+v", c)
+	}
+	if c := cats["prefix"]; c.OldCount != 1 || len(c.Files) != 0 {
+		t.Errorf("incorrect prefix diff %+v", c)
+	}
+	if len(d.Services) != 2 || d.Services[0] != (reportServiceDiff{"Bar", "profile", ""}) || d.Services[1] != (reportServiceDiff{"Foo", "", "missing binary"}) {
+		t.Errorf("incorrect services diff %+v", d.Services)
+	}
+	if len(d.Degraded) != 2 || d.Degraded[0] != (reportDegradedDiff{"libgnutls.so.30", "not found on the build host"}) || d.Degraded[1] != (reportDegradedDiff{"wine-mono", ""}) {
+		t.Errorf("incorrect degraded diff %+v", d.Degraded)
+	}
+	if exp := []reportRegistryDiff{
+		{`HKCU\Software\Wine\Direct3D\VideoMemorySize`, `REG_SZ "512"`, `REG_SZ "1024"`},
+		{`HKCU\Software\Wine\DllOverrides\mshtml`, `REG_SZ ""`, "-"},
+		{`HKLM\System\CurrentControlSet\Services\Tcpip\Parameters\DefaultTTL`, "-", `REG_DWORD 64`},
+	}; !slices.Equal(d.Registry, exp) {
+		t.Errorf("incorrect registry diff %+v", d.Registry)
+	}
+	if len(d.Versions) != 1 || d.Versions[0] != (reportVersionDiff{"wine/lib/wine/x86_64-windows/kernel32.dll", "10.0.0.0", "10.1.0.0"}) {
+		t.Errorf("incorrect versions diff %+v", d.Versions)
+	}
+
+	var buf bytes.Buffer
+	writeReportDiff(&buf, d, true)
+	for _, x := range []string{
+		"pe modules",
+		"3 -> 2 (-1)",
+		"  - wine/lib/wine/x86_64-windows/d3d11.dll (2.0 MiB)",
+		"  ~ wine/lib/wine/x86_64-windows/user32.dll (1000 B)",
+		"  ~ wine/lib/wine/x86_64-unix/ntdll.so (4.9 KiB -> 3.9 KiB (-1000 B))",
+		"  + Bar (now kept, was removed: profile)",
+		"  - Foo (no longer kept, removed: missing binary)",
+		"  + libgnutls.so.30 (not found on the build host)",
+		"  - wine-mono (resolved)",
+		`  ~ HKCU\Software\Wine\Direct3D\VideoMemorySize (REG_SZ "512" -> REG_SZ "1024")`,
+		`  + HKLM\System\CurrentControlSet\Services\Tcpip\Parameters\DefaultTTL = REG_DWORD 64`,
+		"  ~ wine/lib/wine/x86_64-windows/kernel32.dll (10.0.0.0 -> 10.1.0.0)",
+	} {
+		if !strings.Contains(buf.String(), x) {
+			t.Errorf("expected output to contain %q, got:\n%s", x, buf.String())
+		}
+	}
+}
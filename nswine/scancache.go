@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// peScanVersion must be incremented whenever peScan or how it is computed
+// changes, so old cache entries aren't used.
+const peScanVersion = 2
+
+// peScan is the import and export information of a PE file used by the
+// dependency checks (see peImports, peImportedSymbols, peStubImports,
+// peForwarders, and unresolvedOrdinals). Libraries imported only by ordinal are
+// still in Imports, so they're part of the closure.
+type peScan struct {
+	Imports    []string            `json:"imports"`
+	Symbols    map[string][]string `json:"symbols"`
+	Ordinals   map[string][]uint16 `json:"ordinals"`
+	Forwarders map[string][]string `json:"forwarders"`
+	Exports    []uint16            `json:"exports"`
+}
+
+// peScanCache caches PE scans on disk by file hash if non-nil. It is set by
+// the main command once the wine build id is known.
+var peScanCache *scanCache
+
+// scanCache is an on-disk cache of PE scans for a single wine build.
+type scanCache struct {
+	dir string
+}
+
+// openScanCache opens the scan cache for a wine build in the user cache dir.
+// Entries for other builds are removed.
+func openScanCache(buildID string) (*scanCache, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return openScanCacheDir(filepath.Join(cache, "nswine", "scan"), buildID)
+}
+
+// openScanCacheDir is like openScanCache, but uses the specified directory.
+func openScanCacheDir(dir, buildID string) (*scanCache, error) {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d\x00%s", peScanVersion, buildID))
+	key := hex.EncodeToString(sum[:16])
+
+	dis, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, di := range dis {
+		if di.Name() != key {
+			slog.Debug("removing stale scan cache", "name", di.Name())
+			if err := os.RemoveAll(filepath.Join(dir, di.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c := &scanCache{filepath.Join(dir, key)}
+	if err := os.MkdirAll(c.dir, 0777); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// get gets a cached scan, returning nil if there isn't a valid one.
+func (c *scanCache) get(hash string) *peScan {
+	buf, err := os.ReadFile(filepath.Join(c.dir, hash+".json"))
+	if err != nil {
+		return nil
+	}
+	var sc peScan
+	if err := json.Unmarshal(buf, &sc); err != nil {
+		return nil
+	}
+	return &sc
+}
+
+// put caches a scan, ignoring errors.
+func (c *scanCache) put(hash string, sc *peScan) {
+	buf, err := json.Marshal(sc)
+	if err != nil {
+		return
+	}
+	f, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		return
+	}
+	if err := f.Close(); err != nil {
+		return
+	}
+	os.Rename(f.Name(), filepath.Join(c.dir, hash+".json"))
+}
+
+// peScanFile scans a PE file, using the cache if it's enabled.
+func peScanFile(name string) (*peScan, error) {
+	c := peScanCache
+	if c == nil {
+		return peScanParse(name)
+	}
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf)
+	hash := hex.EncodeToString(sum[:])
+
+	sc := c.get(hash)
+	if sc == nil {
+		if sc, err = peScanParse(name); err != nil {
+			return nil, err
+		}
+		c.put(hash, sc)
+	}
+	if sc.Symbols == nil {
+		sc.Symbols = map[string][]string{}
+	}
+	if sc.Ordinals == nil {
+		sc.Ordinals = map[string][]uint16{}
+	}
+	if sc.Forwarders == nil {
+		sc.Forwarders = map[string][]string{}
+	}
+	return sc, nil
+}
+
+// peScanParse scans a PE file without the cache.
+func peScanParse(name string) (*peScan, error) {
+	f, err := peOpen(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	imps, err := f.Imports()
+	if err != nil {
+		return nil, err
+	}
+	bound, err := f.BoundImports()
+	if err != nil {
+		return nil, err
+	}
+	exps, err := f.Exports()
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &peScan{
+		Symbols:    map[string][]string{},
+		Ordinals:   map[string][]uint16{},
+		Forwarders: map[string][]string{},
+	}
+	for _, imp := range imps {
+		sc.Imports = append(sc.Imports, imp.DLL)
+		if len(imp.Symbols) != 0 {
+			lib := strings.ToLower(imp.DLL)
+			sc.Symbols[lib] = append(sc.Symbols[lib], imp.Symbols...)
+		}
+		if len(imp.Ordinals) != 0 {
+			lib := strings.ToLower(imp.DLL)
+			sc.Ordinals[lib] = append(sc.Ordinals[lib], imp.Ordinals...)
+		}
+	}
+	for _, lib := range bound {
+		if !slices.ContainsFunc(sc.Imports, func(x string) bool {
+			return strings.EqualFold(x, lib)
+		}) {
+			sc.Imports = append(sc.Imports, lib)
+		}
+	}
+	for _, exp := range exps {
+		sc.Exports = append(sc.Exports, exp.Ordinal)
+		if exp.Forwarder == "" {
+			continue
+		}
+		lib, sym, ok := peSplitForwarder(exp.Forwarder)
+		if !ok {
+			return nil, fmt.Errorf("export %d: invalid forwarder %q", exp.Ordinal, exp.Forwarder)
+		}
+		if strings.HasPrefix(sym, "#") {
+			if _, ok := sc.Forwarders[lib]; !ok {
+				sc.Forwarders[lib] = nil
+			}
+		} else if !slices.Contains(sc.Forwarders[lib], sym) {
+			sc.Forwarders[lib] = append(sc.Forwarders[lib], sym)
+		}
+	}
+	return sc, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"debug/pe"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScanCache(t *testing.T) {
+	dir := t.TempDir()
+	img, err := peStub(pe.IMAGE_FILE_MACHINE_AMD64, "test.dll", []string{"Fn"})
+	if err != nil {
+		t.Fatalf("generate stub: %v", err)
+	}
+	name := filepath.Join(dir, "test.dll")
+	if err := os.WriteFile(name, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	exp, err := peScanParse(name)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+
+	cache := filepath.Join(dir, "cache")
+	c, err := openScanCacheDir(cache, "wine-10.0")
+	if err != nil {
+		t.Fatalf("open cache: %v", err)
+	}
+	defer func(c *scanCache) { peScanCache = c }(peScanCache)
+	peScanCache = c
+
+	for range 2 {
+		if sc, err := peScanFile(name); err != nil {
+			t.Fatalf("scan: %v", err)
+		} else if !reflect.DeepEqual(sc, exp) {
+			t.Errorf("expected %+v, got %+v", exp, sc)
+		}
+	}
+	ents, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil || len(ents) != 1 {
+		t.Fatalf("expected one cache entry, got %q (err: %v)", ents, err)
+	}
+
+	// a cached entry is used instead of parsing the file again
+	if err := os.WriteFile(ents[0], []byte(`{"imports":["cached.dll"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if libs, err := peImports(name); err != nil || len(libs) != 1 || libs[0] != "cached.dll" {
+		t.Errorf("expected cached imports, got %q (err: %v)", libs, err)
+	}
+	if syms, err := peImportedSymbols(name); err != nil || syms == nil {
+		t.Errorf("expected non-nil symbols map, got %v (err: %v)", syms, err)
+	}
+
+	// corrupt entries are ignored
+	if err := os.WriteFile(ents[0], []byte(`{`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sc, err := peScanFile(name); err != nil || !reflect.DeepEqual(sc, exp) {
+		t.Errorf("expected %+v, got %+v (err: %v)", exp, sc, err)
+	}
+
+	// a different build id invalidates the cache
+	c2, err := openScanCacheDir(cache, "wine-10.1")
+	if err != nil {
+		t.Fatalf("open cache: %v", err)
+	}
+	if c2.dir == c.dir {
+		t.Errorf("expected a different cache dir for a different build id")
+	}
+	if _, err := os.Stat(c.dir); !os.IsNotExist(err) {
+		t.Errorf("expected stale cache to be removed")
+	}
+
+	// files which aren't PE files aren't cached
+	if err := os.WriteFile(name, []byte("not a pe file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	peScanCache = c2
+	if _, err := peScanFile(name); err == nil {
+		t.Errorf("expected error for invalid file")
+	}
+	if ents, _ := filepath.Glob(filepath.Join(c2.dir, "*.json")); len(ents) != 0 {
+		t.Errorf("expected no cache entries, got %q", ents)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// infService is a service installed by an AddService directive in an INF.
+type infService struct {
+	Name    string   // service name
+	Num     int      // line number of the AddService directive
+	Section string   // service install section
+	Binary  string   // lowercase file name of the service binary (or the ServiceDll for svchost services)
+	AddReg  []string // AddReg sections referenced by the service install section
+	Remove  bool     // whether the service should be removed
+	Reason  string   // why the service should be removed
+}
+
+// infServices gets the services installed by AddService directives. The
+// services are not classified.
+func infServices(f *infFile) []*infService {
+	var svcs []*infService
+	for _, s := range f.Sections {
+		for _, l := range s.Lines {
+			if l.Key != "addservice" || len(l.Values) < 3 {
+				continue
+			}
+			svc := &infService{
+				Name:    l.Values[0],
+				Num:     l.Num,
+				Section: l.Values[2],
+			}
+			if slices.ContainsFunc(svcs, func(x *infService) bool {
+				return strings.EqualFold(x.Name, svc.Name)
+			}) {
+				continue
+			}
+			for _, l := range f.Lines(svc.Section) {
+				switch l.Key {
+				case "servicebinary":
+					svc.Binary = infFileName(l.Values[0])
+				case "addreg":
+					svc.AddReg = append(svc.AddReg, l.Values...)
+				}
+			}
+			if svc.Binary == "svchost.exe" {
+				for _, section := range svc.AddReg {
+					for _, l := range f.Lines(section) {
+						if len(l.Values) >= 5 && strings.EqualFold(l.Values[2], "ServiceDll") {
+							svc.Binary = infFileName(l.Values[4])
+						}
+					}
+				}
+			}
+			svcs = append(svcs, svc)
+		}
+	}
+	return svcs
+}
+
+// brokenService is a registered service whose binary doesn't exist.
+type brokenService struct {
+	Name   string // service name
+	Value  string // ImagePath or ServiceDll
+	Binary string // expanded windows path
+}
+
+// checkServices finds the services registered in a system hive whose ImagePath
+// (or ServiceDll, for svchost services) doesn't exist, according to exists,
+// which is called with the expanded windows path (see serviceBinaryPath).
+func checkServices(f *regFile, exists func(path string) bool) []brokenService {
+	var broken []brokenService
+	const services = `System\CurrentControlSet\Services`
+	for _, name := range f.Subkeys(services) {
+		key := services + `\` + name
+		for _, x := range []struct{ key, value string }{
+			{key + `\Parameters`, "ServiceDll"},
+			{key, "ImagePath"},
+		} {
+			v, ok := f.Value(x.key, x.value).Str()
+			if !ok {
+				continue
+			}
+			if path := serviceBinaryPath(v); !exists(path) {
+				broken = append(broken, brokenService{name, x.value, path})
+			}
+			break
+		}
+	}
+	return broken
+}
+
+// serviceBinaryPath expands a service ImagePath or ServiceDll to an absolute
+// windows path (e.g., "C:\windows\system32\foo.exe"), resolving it like
+// services.exe does.
+func serviceBinaryPath(s string) string {
+	s = regFilePath(s)
+	for _, x := range []string{"%SystemRoot%", "%windir%", `\SystemRoot`} {
+		if len(s) >= len(x) && strings.EqualFold(s[:len(x)], x) {
+			s = `C:\windows` + s[len(x):]
+		}
+	}
+	s = strings.TrimPrefix(s, `\??\`)
+	switch {
+	case len(s) >= 2 && s[1] == ':':
+		return s
+	case strings.Contains(s, `\`):
+		return `C:\windows\` + strings.TrimPrefix(s, `\`) // relative to the system root (e.g., drivers)
+	default:
+		return `C:\windows\system32\` + s
+	}
+}
+
+// serviceBuiltinName returns the name of the file in wine's builtin dll dir
+// which a service binary in the system directories (including drivers) may be
+// provided by, since drive_c may only have a fake dll for it.
+func serviceBuiltinName(winPath string) (string, bool) {
+	dir, name := path.Split(strings.ToLower(strings.ReplaceAll(winPath, `\`, "/")))
+	switch dir {
+	case "c:/windows/system32/", "c:/windows/syswow64/", "c:/windows/system32/drivers/", "c:/windows/syswow64/drivers/":
+		return name, name != ""
+	}
+	return "", false
+}
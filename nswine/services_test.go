@@ -0,0 +1,148 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestInfServices(t *testing.T) {
+	inf := []byte(unindent(`
+		[DefaultInstall.NT.Services]
+		AddService=BITS,0,BITSService
+		AddService=MountMgr,0x800,MountMgrService ; comment
+		AddService=Spooler,0,SpoolerService
+
+		[BITSService]
+		AddReg=BITSServiceKeys
+		DisplayName="Background Intelligent Transfer Service"
+		ServiceBinary="%11%\svchost.exe -k netsvcs"
+
+		[BITSServiceKeys]
+		HKLM,"System\CurrentControlSet\Services\BITS\Parameters","ServiceDll",,"qmgr.dll"
+
+		[MountMgrService]
+		ServiceBinary="%12%\mountmgr.sys"
+
+		[SpoolerService]
+		AddReg=SpoolerServiceKeys,SharedKeys
+		ServiceBinary="%11%\spoolsv.exe"
+
+		[SpoolerServiceKeys]
+		HKLM,"System\CurrentControlSet\Services\Spooler","Foo",,"bar"
+
+		[SharedKeys]
+		HKLM,"Software\Foo","Bar",,"baz"
+
+		[Other]
+		AddReg=SharedKeys
+	`))
+	f, err := parseInf(inf)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	svcs := infServices(f)
+	binaries := map[string]string{}
+	for _, svc := range svcs {
+		binaries[svc.Name] = svc.Binary
+	}
+	if exp := map[string]string{
+		"BITS":     "qmgr.dll",
+		"MountMgr": "mountmgr.sys",
+		"Spooler":  "spoolsv.exe",
+	}; !maps.Equal(binaries, exp) {
+		t.Errorf("expected %v, got %v", exp, binaries)
+	}
+	for _, svc := range svcs {
+		if svc.Name != "MountMgr" {
+			f.RemoveService(svc.Name)
+		}
+	}
+	sections := f.Cleanup()
+	slices.Sort(sections)
+	if exp := []string{"bitsservice", "bitsservicekeys", "spoolerservice", "spoolerservicekeys"}; !slices.Equal(sections, exp) {
+		t.Errorf("expected sections %q, got %q", exp, sections)
+	}
+}
+
+func TestCheckServices(t *testing.T) {
+	f, err := parseReg([]byte(unindent(`
+		WINE REGISTRY Version 2
+
+		[System\\CurrentControlSet\\Services\\BITS] 1700000000
+		"ImagePath"=str(2):"%SystemRoot%\\system32\\svchost.exe -k netsvcs"
+
+		[System\\CurrentControlSet\\Services\\BITS\\Parameters] 1700000000
+		"ServiceDll"=str(2):"%SystemRoot%\\system32\\qmgr.dll"
+
+		[System\\CurrentControlSet\\Services\\MountMgr] 1700000000
+		"ImagePath"="system32\\drivers\\mountmgr.sys"
+
+		[System\\CurrentControlSet\\Services\\Spooler] 1700000000
+		"ImagePath"="C:\\windows\\system32\\spoolsv.exe"
+
+		[System\\CurrentControlSet\\Services\\Tcpip\\Parameters] 1700000000
+		"Hostname"="nswrap"
+
+		[System\\CurrentControlSet\\Services\\Other] 1700000000
+		"ImagePath"="\"D:\\Program Files\\other.exe\" -arg"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	var checked []string
+	broken := checkServices(f, func(path string) bool {
+		checked = append(checked, path)
+		return path != `C:\windows\system32\qmgr.dll` && path != `C:\windows\system32\drivers\mountmgr.sys`
+	})
+	if exp := []string{
+		`C:\windows\system32\qmgr.dll`,
+		`C:\windows\system32\drivers\mountmgr.sys`,
+		`C:\windows\system32\spoolsv.exe`,
+		`D:\Program Files\other.exe`,
+	}; !slices.Equal(checked, exp) {
+		t.Errorf("expected checked %q, got %q", exp, checked)
+	}
+	if exp := []brokenService{
+		{"BITS", "ServiceDll", `C:\windows\system32\qmgr.dll`},
+		{"MountMgr", "ImagePath", `C:\windows\system32\drivers\mountmgr.sys`},
+	}; !slices.Equal(broken, exp) {
+		t.Errorf("expected broken %q, got %q", exp, broken)
+	}
+}
+
+func TestServiceBinaryPath(t *testing.T) {
+	for _, tc := range []struct{ in, out string }{
+		{`C:\windows\system32\spoolsv.exe`, `C:\windows\system32\spoolsv.exe`},
+		{`"C:\Program Files\foo.exe" -arg`, `C:\Program Files\foo.exe`},
+		{`%SystemRoot%\system32\svchost.exe -k netsvcs`, `C:\windows\system32\svchost.exe`},
+		{`%windir%\system32\foo.exe`, `C:\windows\system32\foo.exe`},
+		{`\SystemRoot\system32\drivers\foo.sys`, `C:\windows\system32\drivers\foo.sys`},
+		{`\??\C:\windows\system32\foo.sys`, `C:\windows\system32\foo.sys`},
+		{`system32\drivers\foo.sys`, `C:\windows\system32\drivers\foo.sys`},
+		{`foo.dll`, `C:\windows\system32\foo.dll`},
+	} {
+		if act := serviceBinaryPath(tc.in); act != tc.out {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.out, act)
+		}
+	}
+}
+
+func TestServiceBuiltinName(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		name string
+		ok   bool
+	}{
+		{`C:\windows\system32\qmgr.dll`, "qmgr.dll", true},
+		{`C:\windows\system32\drivers\mountmgr.sys`, "mountmgr.sys", true},
+		{`C:\Windows\SysWOW64\Foo.dll`, "foo.dll", true},
+		{`C:\windows\foo.exe`, "", false},
+		{`C:\windows\system32\wbem\wmiprvse.exe`, "", false},
+		{`C:\Program Files\foo.exe`, "", false},
+	} {
+		if name, ok := serviceBuiltinName(tc.in); name != tc.name || ok != tc.ok {
+			t.Errorf("%q: expected %q %t, got %q %t", tc.in, tc.name, tc.ok, name, ok)
+		}
+	}
+}
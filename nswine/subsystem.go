@@ -0,0 +1,49 @@
+package main
+
+import (
+	"debug/pe"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// subsystemMain implements the subsystem subcommand, which switches PE files
+// between the GUI and console subsystems.
+func subsystemMain(args []string) error {
+	fset := flag.NewFlagSet("subsystem", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s subsystem [options] file...\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fset.Output(), "Switches EXEs between the GUI and console subsystems in-place, fixing the\nheader checksum. Console EXEs get attached to the nswrap console instead of\nbeing detached from it, which is useful for wine tools and launch helpers.\n\n")
+		fset.PrintDefaults()
+	}
+	to := fset.String("to", "console", "subsystem to switch to (console or gui)")
+	fset.Parse(args)
+
+	if fset.NArg() == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	var subsystem uint16
+	switch *to {
+	case "console":
+		subsystem = pe.IMAGE_SUBSYSTEM_WINDOWS_CUI
+	case "gui":
+		subsystem = pe.IMAGE_SUBSYSTEM_WINDOWS_GUI
+	default:
+		return fmt.Errorf("unknown subsystem %q", *to)
+	}
+	for _, name := range fset.Args() {
+		var changed bool
+		if err := transform(name, trpe(func(buf []byte) ([]byte, error) {
+			var err error
+			changed, err = peSetSubsystem(buf, subsystem)
+			return buf, err
+		}, peFixOptions{})); err != nil {
+			return err
+		}
+		slog.Info("set subsystem", "name", name, "subsystem", *to, "changed", changed)
+	}
+	return nil
+}
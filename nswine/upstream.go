@@ -0,0 +1,274 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamUpdate is a proposed change to a pinned version.
+type upstreamUpdate struct {
+	Name    string `json:"name"`
+	Arg     string `json:"arg,omitempty"` // Dockerfile arg
+	Current string `json:"current"`
+	Latest  string `json:"latest"`
+	Propose string `json:"propose"` // may differ from latest if it isn't available for all architectures
+	Update  bool   `json:"update"`
+	Source  string `json:"source"`
+	Note    string `json:"note,omitempty"`
+}
+
+// checkUpstreamMain implements the check-upstream subcommand, which compares
+// the versions pinned in the Dockerfile against the latest upstream releases
+// and writes a JSON update proposal to stdout.
+func checkUpstreamMain(args []string) error {
+	fset := flag.NewFlagSet("check-upstream", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s check-upstream [options]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fset.Output(), "Checks the wine, hangover, and fex versions pinned in the Dockerfile against\nthe latest upstream releases, and writes a JSON update proposal to stdout.\n\n")
+		fset.PrintDefaults()
+	}
+	var (
+		dockerfile = fset.String("dockerfile", "Dockerfile", "Dockerfile containing the pinned versions")
+		debug      = fset.Bool("debug", false, "debug logging")
+	)
+	fset.Parse(args)
+
+	if fset.NArg() != 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	setupLogging(*debug)
+
+	buf, err := os.ReadFile(*dockerfile)
+	if err != nil {
+		return err
+	}
+	pins := parseDockerfileArgs(buf)
+	for _, arg := range []string{"WINE", "DEBIAN_CODENAME"} {
+		if pins[arg] == "" {
+			return fmt.Errorf("dockerfile does not pin %s", arg)
+		}
+	}
+
+	wineURL := "https://dl.winehq.org/wine-builds/debian/dists/" + pins["DEBIAN_CODENAME"] + "/main/binary-amd64/Packages"
+	slog.Info("checking wine releases", "url", wineURL)
+	buf, err = upstreamGet(wineURL)
+	if err != nil {
+		return fmt.Errorf("check wine: %w", err)
+	}
+	var wineVersions []string
+	for _, v := range parseDebianPackageVersions(buf, "winehq-devel") {
+		if v, _, ok := strings.Cut(v, "~"); ok {
+			wineVersions = append(wineVersions, v)
+		}
+	}
+	if len(wineVersions) == 0 {
+		return fmt.Errorf("check wine: no winehq-devel packages found")
+	}
+	slices.SortFunc(wineVersions, compareVersions)
+
+	hangoverURL := "https://api.github.com/repos/AndreRH/hangover/releases/latest"
+	slog.Info("checking hangover releases", "url", hangoverURL)
+	hangoverTag, err := githubLatestRelease(hangoverURL)
+	if err != nil {
+		return fmt.Errorf("check hangover: %w", err)
+	}
+	hangoverWine, hangoverSuffix, ok := parseHangoverTag(hangoverTag)
+	if !ok {
+		return fmt.Errorf("check hangover: unexpected release tag %q", hangoverTag)
+	}
+
+	var updates []upstreamUpdate
+
+	// the same wine version is used for both architectures, so it can only be
+	// updated to one which also has a hangover release
+	wine := upstreamUpdate{
+		Name:    "wine",
+		Arg:     "WINE",
+		Current: pins["WINE"],
+		Latest:  wineVersions[len(wineVersions)-1],
+		Propose: pins["WINE"],
+		Source:  wineURL,
+	}
+	if slices.Contains(wineVersions, hangoverWine) && compareVersions(hangoverWine, wine.Current) > 0 {
+		wine.Propose = hangoverWine
+	}
+	if wine.Propose != wine.Latest {
+		wine.Note = "wine " + wine.Latest + " does not have a hangover release yet"
+	}
+	wine.Update = wine.Propose != wine.Current
+	updates = append(updates, wine)
+
+	hangover := upstreamUpdate{
+		Name:    "hangover",
+		Arg:     "HANGOVER",
+		Current: pins["HANGOVER"],
+		Latest:  hangoverSuffix,
+		Propose: pins["HANGOVER"],
+		Source:  hangoverURL,
+	}
+	if hangoverWine == wine.Propose {
+		hangover.Propose = hangoverSuffix
+	}
+	if hangoverWine != wine.Latest || hangoverWine != wine.Propose {
+		hangover.Note = "latest hangover release is for wine " + hangoverWine
+	}
+	hangover.Update = hangover.Propose != hangover.Current
+	updates = append(updates, hangover)
+
+	fexURL := "https://api.github.com/repos/FEX-Emu/FEX/releases/latest"
+	slog.Info("checking fex releases", "url", fexURL)
+	fexTag, err := githubLatestRelease(fexURL)
+	if err != nil {
+		return fmt.Errorf("check fex: %w", err)
+	}
+	fex := upstreamUpdate{
+		Name:    "fex",
+		Arg:     "FEX",
+		Current: pins["FEX"],
+		Latest:  strings.TrimPrefix(fexTag, "FEX-"),
+		Source:  fexURL,
+		Note:    "fex is bundled with hangover, so this is informational",
+	}
+	fex.Propose = fex.Current
+	updates = append(updates, fex)
+
+	for _, u := range updates {
+		slog.Info("checked upstream", "name", u.Name, "current", u.Current, "latest", u.Latest, "propose", u.Propose, "update", u.Update)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(map[string]any{
+		"dockerfile": *dockerfile,
+		"updates":    updates,
+	})
+}
+
+// upstreamHTTPClient is used to check upstream releases.
+var upstreamHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// upstreamGet gets a URL, returning an error if the response isn't 200 OK.
+// If GITHUB_TOKEN is set, it is used for GitHub API requests.
+func upstreamGet(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tok := os.Getenv("GITHUB_TOKEN"); tok != "" && strings.HasPrefix(url, "https://api.github.com/") {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	resp, err := upstreamHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %q: response status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// githubLatestRelease gets the tag name of a GitHub latest release API URL.
+func githubLatestRelease(url string) (string, error) {
+	buf, err := upstreamGet(url)
+	if err != nil {
+		return "", err
+	}
+	var obj struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.Unmarshal(buf, &obj); err != nil {
+		return "", err
+	}
+	if obj.TagName == "" {
+		return "", fmt.Errorf("no tag name in release")
+	}
+	return obj.TagName, nil
+}
+
+// parseDockerfileArgs gets the default values of the ARG instructions in a
+// Dockerfile. Only the first default for each arg is used.
+func parseDockerfileArgs(buf []byte) map[string]string {
+	args := map[string]string{}
+	for line := range bytes.Lines(buf) {
+		m := regex(`^ARG\s+([A-Za-z_][A-Za-z0-9_]*)=(?:"([^"]*)"|(\S*))\s*$`).FindSubmatch(bytes.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		if _, ok := args[string(m[1])]; !ok {
+			args[string(m[1])] = string(m[2]) + string(m[3])
+		}
+	}
+	return args
+}
+
+// parseDebianPackageVersions gets the versions of a package from a Debian
+// repository Packages index.
+func parseDebianPackageVersions(buf []byte, pkg string) []string {
+	var (
+		versions []string
+		name     string
+	)
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			name = ""
+			continue
+		}
+		if x, ok := strings.CutPrefix(line, "Package: "); ok {
+			name = x
+		}
+		if x, ok := strings.CutPrefix(line, "Version: "); ok && name == pkg && !slices.Contains(versions, x) {
+			versions = append(versions, x)
+		}
+	}
+	return versions
+}
+
+// parseHangoverTag splits a hangover release tag (e.g., "hangover-10.6.1")
+// into the wine version and the hangover suffix (which may be empty).
+func parseHangoverTag(tag string) (wine, suffix string, ok bool) {
+	m := regex(`^hangover-([0-9]+\.[0-9]+)(?:\.([0-9]+))?$`).FindStringSubmatch(tag)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// compareVersions compares dot-separated numeric versions.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := range max(len(as), len(bs)) {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
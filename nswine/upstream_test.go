@@ -0,0 +1,77 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestParseDockerfileArgs(t *testing.T) {
+	args := parseDockerfileArgs([]byte("# syntax=docker/dockerfile:1\nARG WINE=\"10.6\"\nARG HANGOVER=1\nARG EMPTY=\"\"\nARG NODEFAULT\nFROM scratch\nARG WINE=\"9.0\"\n"))
+	for k, v := range map[string]string{
+		"WINE":     "10.6",
+		"HANGOVER": "1",
+		"EMPTY":    "",
+	} {
+		if x, ok := args[k]; !ok || x != v {
+			t.Errorf("%s: expected %q, got %q", k, v, x)
+		}
+	}
+	if _, ok := args["NODEFAULT"]; ok {
+		t.Errorf("expected no value for arg without a default")
+	}
+
+	buf, err := os.ReadFile("../Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args = parseDockerfileArgs(buf)
+	for _, k := range []string{"WINE", "HANGOVER", "FEX", "DEBIAN", "DEBIAN_CODENAME"} {
+		if args[k] == "" {
+			t.Errorf("Dockerfile does not pin %s", k)
+		}
+	}
+}
+
+func TestParseDebianPackageVersions(t *testing.T) {
+	buf := []byte("Package: wine-devel\nVersion: 10.7~bookworm-1\n\nPackage: winehq-devel\nArchitecture: amd64\nVersion: 10.5~bookworm-1\n\nPackage: winehq-devel\nVersion: 10.6~bookworm-1\n")
+	if v := parseDebianPackageVersions(buf, "winehq-devel"); !slices.Equal(v, []string{"10.5~bookworm-1", "10.6~bookworm-1"}) {
+		t.Errorf("incorrect versions %q", v)
+	}
+}
+
+func TestParseHangoverTag(t *testing.T) {
+	for _, tc := range []struct {
+		Tag    string
+		Wine   string
+		Suffix string
+		OK     bool
+	}{
+		{"hangover-10.6.1", "10.6", "1", true},
+		{"hangover-10.7", "10.7", "", true},
+		{"v10.7", "", "", false},
+	} {
+		if wine, suffix, ok := parseHangoverTag(tc.Tag); wine != tc.Wine || suffix != tc.Suffix || ok != tc.OK {
+			t.Errorf("%q: expected (%q, %q, %t), got (%q, %q, %t)", tc.Tag, tc.Wine, tc.Suffix, tc.OK, wine, suffix, ok)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		A, B string
+		Exp  int
+	}{
+		{"10.6", "10.6", 0},
+		{"10.10", "10.9", 1},
+		{"9.22", "10.0", -1},
+		{"10.0", "10", 0},
+		{"10.0.1", "10.0", 1},
+	} {
+		if c := compareVersions(tc.A, tc.B); c != tc.Exp {
+			t.Errorf("compare(%q, %q): expected %d, got %d", tc.A, tc.B, tc.Exp, c)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// userTemplateKeys are the user hive keys always kept in the user registry
+// template (along with the ones wine.inf adds, see infUserKeys), since wine
+// doesn't recreate them when they're missing (or the defaults would differ
+// from the built prefix's).
+var userTemplateKeys = []string{
+	`Control Panel\International`,
+	`Environment`,
+	`Software\Microsoft\Windows\CurrentVersion\Explorer\Shell Folders`,
+	`Software\Microsoft\Windows\CurrentVersion\Explorer\User Shell Folders`,
+	`Software\Wine`,
+	`Volatile Environment`,
+}
+
+// userTemplate creates a minimal copy of a user hive with only the keys which
+// are the same as or subkeys of the ones in keep (relative to the hive root).
+// The key timestamps are all set to t, so the result is deterministic.
+func userTemplate(f *regFile, keep []string, t int64) *regFile {
+	r := &regFile{Header: f.Header, Time: t}
+	for _, k := range f.Keys {
+		if !slices.ContainsFunc(keep, func(x string) bool {
+			return regKeyUnder(k.Name, x)
+		}) {
+			continue
+		}
+		x := &regKey{
+			Name:    k.Name,
+			Class:   k.Class,
+			Link:    k.Link,
+			Values:  slices.Clone(k.Values),
+			options: slices.Clone(k.options),
+		}
+		x.touch(r)
+		r.Keys = append(r.Keys, x)
+	}
+	return r
+}
+
+// infUserKeys gets the keys (relative to the user hive) added by the AddReg
+// sections of an INF file. For wine.inf, these are the user defaults wineboot
+// sets when the prefix is created (e.g., Control Panel\Desktop), which wine
+// doesn't recreate when they're missing.
+func infUserKeys(f *infFile) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, s := range f.Sections {
+		for _, l := range s.Lines {
+			if l.Key != "addreg" {
+				continue
+			}
+			for _, name := range l.Values {
+				if seen[strings.ToLower(name)] {
+					continue
+				}
+				seen[strings.ToLower(name)] = true
+				for _, x := range f.Lines(name) {
+					key, ok := infRegKeyOf(f.Expanded(x).Values)
+					if !ok {
+						continue
+					}
+					if hive, rel, ok := regHiveKey(key); ok && hive == "user.reg" && !slices.ContainsFunc(keys, func(k string) bool {
+						return strings.EqualFold(k, rel)
+					}) {
+						keys = append(keys, rel)
+					}
+				}
+			}
+		}
+	}
+	return keys
+}
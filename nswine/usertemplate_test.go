@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUserTemplate(t *testing.T) {
+	f, err := parseReg([]byte(unindent(`
+		WINE REGISTRY Version 2
+		;; All keys relative to \\User\\S-1-5-21-0-0-0-1000
+
+		#arch=win64
+
+		[Control Panel\\Desktop] 1700000000
+		#time=1da0000000000000
+		"Wallpaper"=""
+
+		[Environment] 1700000000
+		#time=1da0000000000000
+		"TEMP"=str(2):"%USERPROFILE%\\AppData\\Local\\Temp"
+
+		[Software\\Game] 1700000000
+		#time=1da0000000000000
+		"Foo"="bar"
+
+		[Software\\Wine\\DllOverrides] 1700000000
+		#time=1da0000000000000
+		"mscoree"=""
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	r := userTemplate(f, append(userTemplateKeys, `software\game`), 1600000000)
+	if exp := unindent(`
+		WINE REGISTRY Version 2
+		;; All keys relative to \\User\\S-1-5-21-0-0-0-1000
+
+		#arch=win64
+
+		[Environment] 1600000000
+		#time=1d689c921a68000
+		"TEMP"=str(2):"%USERPROFILE%\\AppData\\Local\\Temp"
+
+		[Software\\Game] 1600000000
+		#time=1d689c921a68000
+		"Foo"="bar"
+
+		[Software\\Wine\\DllOverrides] 1600000000
+		#time=1d689c921a68000
+		"mscoree"=""
+	`); string(r.Bytes()) != exp {
+		t.Errorf("wrong output:\n%s", r.Bytes())
+	}
+	if f.Key(`Control Panel\Desktop`) == nil || f.Key(`Environment`).Time != 1700000000 {
+		t.Errorf("original hive was modified")
+	}
+}
+
+func TestInfUserKeys(t *testing.T) {
+	f, err := parseInf([]byte(unindent(`
+		[DefaultInstall]
+		AddReg=Desktop,Misc
+		DelReg=Removed
+
+		[Desktop]
+		HKCU,"Control Panel\Desktop","Wallpaper",,""
+		HKCU,"Control Panel\Desktop","Pattern",,"(None)"
+
+		[Misc]
+		HKLM,%CurrentVersion%,"ProgramFilesDir",,"C:\Program Files"
+		HKCU,%CurrentVersion%\Explorer,"ShellState",1,24
+
+		[Removed]
+		HKCU,"Software\Removed"
+
+		[Strings]
+		CurrentVersion="Software\Microsoft\Windows\CurrentVersion"
+	`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if keys, exp := infUserKeys(f), []string{`Control Panel\Desktop`, `Software\Microsoft\Windows\CurrentVersion\Explorer`}; !slices.Equal(keys, exp) {
+		t.Errorf("expected %q, got %q", exp, keys)
+	}
+}
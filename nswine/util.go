@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"iter"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"slices"
@@ -17,7 +19,6 @@ import (
 	"unicode/utf16"
 
 	"github.com/rogpeppe/go-internal/diff"
-	"github.com/willscott/pefile-go"
 )
 
 // architectures
@@ -38,6 +39,38 @@ func archt[T any](amd64, arm64 T) T {
 	}
 }
 
+// parallelMap calls fn for each element of in using a bounded number of
+// goroutines (GOMAXPROCS), returning the results in the same order. If there
+// are errors, the one for the first element is returned.
+func parallelMap[T, U any](in []T, fn func(T) (U, error)) ([]U, error) {
+	var (
+		out  = make([]U, len(in))
+		errs = make([]error, len(in))
+		next = make(chan int)
+		wg   sync.WaitGroup
+	)
+	for range min(runtime.GOMAXPROCS(0), len(in)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				out[i], errs[i] = fn(in[i])
+			}
+		}()
+	}
+	for i := range in {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
 // u8to16 converts utf8 to utf16.
 func u8to16[T, U ~[]byte | ~string](str T) U {
 	r := utf16.Encode([]rune(string(str)))
@@ -77,53 +110,18 @@ func trdiff(fn func(buf []byte) ([]byte, error)) func(buf []byte) ([]byte, error
 	}
 }
 
-// infilt filters an INF file. Line will always be non-empty (it includes the
-// trailing newline) unless the line is a section header. If a line is emitted
-// with a different section, the section header is emitted automatically. If a
-// line is emitted without a trailing newline, it is added. If a line is emitted
-// without a section, the current section is assumed.
-func infilt(fn func(emit func(section, line string), inf iter.Seq2[string, string]) error) func(buf []byte) ([]byte, error) {
+// trpe wraps a transform to fix the header of PE images afterwards (see
+// peFixHeader). Other files are left as-is.
+func trpe(fn func(buf []byte) ([]byte, error), opt peFixOptions) func(buf []byte) ([]byte, error) {
 	return func(buf []byte) ([]byte, error) {
-		if bytes.Contains(buf, []byte("\r")) {
-			return nil, fmt.Errorf("expected linux-style newlines")
-		}
-		in := func(yield func(string, string) bool) {
-			var cur string
-			for line := range bytes.Lines(buf) {
-				if section, ok := bytes.CutPrefix(line, []byte{'['}); ok {
-					if section, ok := bytes.CutSuffix(section, []byte{']', '\n'}); ok {
-						cur = string(section)
-						if !yield(cur, "") {
-							return
-						}
-						continue
-					}
-				}
-				if !yield(cur, string(line)) {
-					return
-				}
-			}
+		buf, err := fn(buf)
+		if err != nil {
+			return nil, err
 		}
-		var res bytes.Buffer
-		var cur string
-		if err := fn(func(section, line string) {
-			if section == "" && line == "" {
-				panic("emitted empty section/line")
-			}
-			if line != "" && !strings.HasSuffix(line, "\n") {
-				panic("line must end with newline")
-			}
-			if section != "" && (line == "" || cur != section) {
-				res.WriteString("[" + section + "]\n")
-				cur = section
-			}
-			if line != "" {
-				res.WriteString(line)
-			}
-		}, in); err != nil {
-			return nil, fmt.Errorf("filter inf: %w", err)
+		if len(buf) >= 2 && string(buf[:2]) == "MZ" {
+			return peFixHeader(buf, opt)
 		}
-		return res.Bytes(), nil
+		return buf, nil
 	}
 }
 
@@ -199,17 +197,150 @@ func colordiff(w io.Writer, indent string, oldName string, old []byte, newName s
 	return bw.Flush()
 }
 
-// peImports gets the list of imported libraries for a DLL or EXE.
+// safeJoin joins a relative slash-separated path to root, ensuring it stays
+// inside root and doesn't traverse any existing symlinks. The path itself must
+// not be an existing symlink either, since writing to it would follow it.
+func safeJoin(root, rel string) (string, error) {
+	rel = filepath.FromSlash(rel)
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("path %q is not local", rel)
+	}
+	cur := root
+	for _, c := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if c == "." {
+			continue
+		}
+		cur = filepath.Join(cur, c)
+		fi, err := os.Lstat(cur)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("path %q traverses symlink %q", rel, cur)
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("path %q traverses non-directory %q", rel, cur)
+		}
+	}
+	path := filepath.Join(root, rel)
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		return "", fmt.Errorf("path %q is a symlink", rel)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	return path, nil
+}
+
+// existsFold checks if a relative slash-separated path exists under root,
+// matching each component case-insensitively like wine does.
+func existsFold(root, rel string) bool {
+	cur := root
+	for _, c := range strings.Split(rel, "/") {
+		if c == "" || c == "." {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(cur, c)); err == nil {
+			cur = filepath.Join(cur, c)
+			continue
+		}
+		es, err := os.ReadDir(cur)
+		if err != nil {
+			return false
+		}
+		i := slices.IndexFunc(es, func(e fs.DirEntry) bool {
+			return strings.EqualFold(e.Name(), c)
+		})
+		if i == -1 {
+			return false
+		}
+		cur = filepath.Join(cur, es[i].Name())
+	}
+	_, err := os.Stat(cur)
+	return err == nil
+}
+
+// peImports gets the list of imported libraries for a DLL or EXE, including
+// delay-loaded and bound imports, and the imports of the ARM64EC view of ARM64X
+// images.
 func peImports(name string) ([]string, error) {
-	pe, err := pefile.NewPEFile(name)
+	sc, err := peScanFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return sc.Imports, nil
+}
+
+// peFileVersion gets the version information of a DLL or EXE, returning nil
+// if it doesn't have any.
+func peFileVersion(name string) (*peVersion, error) {
+	f, err := peOpen(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Version()
+}
+
+// peImportedSymbols gets the names of the functions imported (or delay-loaded)
+// from each library by a DLL or EXE. Library names are lowercased. Imports by
+// ordinal are not included.
+func peImportedSymbols(name string) (map[string][]string, error) {
+	sc, err := peScanFile(name)
 	if err != nil {
 		return nil, err
 	}
-	var libs []string
-	for _, imp := range pe.ImportDescriptors {
-		libs = append(libs, string(imp.Dll))
+	return sc.Symbols, nil
+}
+
+// peStubImports gets the functions imported (or delay-loaded) from each library
+// by a DLL or EXE in the form accepted by peStub, i.e., names, and ordinals
+// with a "#" prefix. Library names are lowercased.
+func peStubImports(name string) (map[string][]string, error) {
+	sc, err := peScanFile(name)
+	if err != nil {
+		return nil, err
+	}
+	imps := map[string][]string{}
+	for lib, syms := range sc.Symbols {
+		imps[lib] = slices.Clone(syms)
+	}
+	for lib, ords := range sc.Ordinals {
+		for _, ord := range ords {
+			imps[lib] = append(imps[lib], "#"+strconv.Itoa(int(ord)))
+		}
+	}
+	return imps, nil
+}
+
+// peForwarders gets the names of the functions forwarded to each library by the
+// exports of a DLL. Library names are lowercased and have a .dll extension if
+// the forwarder doesn't specify one. Forwarders by ordinal have the library
+// included, but not the ordinal.
+func peForwarders(name string) (map[string][]string, error) {
+	sc, err := peScanFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return sc.Forwarders, nil
+}
+
+// peSplitForwarder splits an export forwarder (e.g., "NTDLL.RtlAllocateHeap")
+// into the lowercased library file name and the symbol (which starts with a #
+// if it's an ordinal).
+func peSplitForwarder(fwd string) (lib, sym string, ok bool) {
+	i := strings.LastIndexByte(fwd, '.')
+	if i <= 0 || i == len(fwd)-1 {
+		return "", "", false
+	}
+	lib, sym = strings.ToLower(fwd[:i]), fwd[i+1:]
+	if filepath.Ext(lib) == "" {
+		lib += ".dll"
 	}
-	return libs, nil
+	return lib, sym, true
 }
 
 var reCache sync.Map
@@ -1,166 +1,75 @@
 package main
 
 import (
-	"iter"
-	"strings"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 )
 
-func TestInfilt(t *testing.T) {
-	test := func(name, input, output string, filter func(buf []byte) ([]byte, error)) {
-		t.Run(name, func(t *testing.T) {
-			buf, err := filter([]byte(input))
-			if err != nil {
-				t.Errorf("unexpected error: %v", err)
-			}
-			if act := string(buf); output != act {
-				t.Errorf("wrong output:\n%s", act)
-			}
-		})
+func TestSafeJoin(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a/b"), 0755); err != nil {
+		t.Fatal(err)
 	}
-	input := unindent(`
-		; test
-
-		[Section]
-		sdfsdf,asdasd,dfgdfg
-
-
-		[Section2]
-		[Section2]
-		dfkmgkldmfg,werwer
-		[Section2]
-		erktjnekjrntasd
-	`)
-	test("Passthrough",
-		input,
-		input,
-		infilt(func(emit func(section string, line string), inf iter.Seq2[string, string]) error {
-			for section, line := range inf {
-				emit(section, line)
-			}
-			return nil
-		}),
-	)
-	test("PassthroughImplicit",
-		input,
-		unindent(`
-			; test
-
-			[Section]
-			sdfsdf,asdasd,dfgdfg
-
-
-			[Section2]
-			dfkmgkldmfg,werwer
-			erktjnekjrntasd
-		`),
-		infilt(func(emit func(section string, line string), inf iter.Seq2[string, string]) error {
-			for section, line := range inf {
-				if line != "" {
-					emit(section, line)
-				}
-			}
-			return nil
-		}),
-	)
-	test("RemoveSection",
-		input,
-		unindent(`
-			; test
-
-			[Section2]
-			[Section2]
-			dfkmgkldmfg,werwer
-			[Section2]
-			erktjnekjrntasd
-		`),
-		infilt(func(emit func(section string, line string), inf iter.Seq2[string, string]) error {
-			for section, line := range inf {
-				if section == "Section" {
-					continue
-				}
-				emit(section, line)
-			}
-			return nil
-		}),
-	)
-	test("RemoveLine",
-		input,
-		unindent(`
-			; test
-
-			[Section]
-
-
-			[Section2]
-			[Section2]
-			dfkmgkldmfg,werwer
-			[Section2]
-		`),
-		infilt(func(emit func(section string, line string), inf iter.Seq2[string, string]) error {
-			for section, line := range inf {
-				if strings.Contains(line, "asd") {
-					continue
-				}
-				emit(section, line)
-			}
-			return nil
-		}),
-	)
-	test("RemoveLineImplicit",
-		input,
-		unindent(`
-			; test
-
-			[Section]
-
-
-			[Section2]
-			dfkmgkldmfg,werwer
-		`),
-		infilt(func(emit func(section string, line string), inf iter.Seq2[string, string]) error {
-			for section, line := range inf {
-				if line == "" {
-					continue
-				}
-				if strings.Contains(line, "asd") {
-					continue
-				}
-				emit(section, line)
-			}
-			return nil
-		}),
-	)
-	test("Complex",
-		input,
-		unindent(`
-			; test
-
-			[Section]
-			sdfskjdfnksjndf
-			ertert
-
+	if err := os.Symlink("/", filepath.Join(root, "a/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a/file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Path string
+		OK   bool
+	}{
+		{"a", true},
+		{"a/b/c", true},
+		{"a/new/c/d", true},
+		{"a/link", false}, // writing to it would follow it
+		{"a/new", true},
+		{"a/link/etc", false},
+		{"a/file/x", false},
+		{"../x", false},
+		{"a/../../x", false},
+		{"/etc/passwd", false},
+		{"", false},
+	} {
+		path, err := safeJoin(root, tc.Path)
+		if tc.OK && err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.Path, err)
+		}
+		if !tc.OK && err == nil {
+			t.Errorf("%q: expected error, got %q", tc.Path, path)
+		}
+	}
+}
 
-			[Section2]
-			dfkmgkldmfg,werwer
-			[Section3]
-			dflgmldkfmg
-		`),
-		infilt(func(emit func(section string, line string), inf iter.Seq2[string, string]) error {
-			for section, line := range inf {
-				if section == "Section" && line == "" {
-					emit(section, "sdfskjdfnksjndf\n")
-					emit(section, "ertert\n")
-				}
-				if line != "" {
-					if strings.Contains(line, "asd") {
-						continue
-					}
-					emit(section, line)
-				}
-			}
-			emit("Section3", "dflgmldkfmg\n")
-			return nil
-		}),
-	)
+func TestParallelMap(t *testing.T) {
+	in := make([]int, 1000)
+	for i := range in {
+		in[i] = i
+	}
+	out, err := parallelMap(in, func(x int) (string, error) {
+		return strconv.Itoa(x * 2), nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, x := range out {
+		if x != strconv.Itoa(i*2) {
+			t.Fatalf("incorrect result at %d: %q", i, x)
+		}
+	}
+	if _, err := parallelMap(in, func(x int) (int, error) {
+		if x%100 == 50 {
+			return 0, fmt.Errorf("error %d", x)
+		}
+		return x, nil
+	}); err == nil || err.Error() != "error 50" {
+		t.Errorf("expected the first error, got %v", err)
+	}
+	if out, err := parallelMap([]int(nil), func(x int) (int, error) { return x, nil }); err != nil || len(out) != 0 {
+		t.Errorf("unexpected result for empty input: %v (err: %v)", out, err)
+	}
 }
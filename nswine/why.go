@@ -0,0 +1,152 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// whyMain implements the why subcommand, which explains why a file was removed
+// or kept using a build report (the output manifest).
+func whyMain(args []string) error {
+	fset := flag.NewFlagSet("why", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s why [options] manifest name\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fset.Output(), "Explains whether a file (e.g., a dll, exe, or unix lib) was removed, and by\nwhich rule, or which roots keep it. The name can be a file name, or a module\nname without the extension. Manifests can be the %s file or the output\ndirectory containing it.\n\n", ManifestName)
+		fset.PrintDefaults()
+	}
+	paths := fset.Int("paths", 3, "maximum number of import paths to show for kept modules")
+	fset.Parse(args)
+
+	if fset.NArg() != 2 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	m, err := readManifest(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !writeWhy(os.Stdout, m, fset.Arg(1), *paths) {
+		return fmt.Errorf("no file matching %q in the manifest", fset.Arg(1))
+	}
+	return nil
+}
+
+// writeWhy explains why the files matching name were removed or kept, returning
+// false if there weren't any.
+func writeWhy(w io.Writer, m *Manifest, name string, paths int) bool {
+	var found bool
+	for _, r := range m.Removed {
+		if whyMatch(r.Path, name) {
+			found = true
+			writeWhyRemoved(w, m, r, "", map[string]bool{})
+		}
+	}
+	for _, f := range m.Files {
+		if f.Root != "wine" || !whyMatch(f.Path, name) {
+			continue
+		}
+		found = true
+		fmt.Fprintf(w, "%s/%s: kept (%s", f.Root, f.Path, f.Provenance.Origin)
+		if len(f.Provenance.Steps) != 0 {
+			fmt.Fprintf(w, ", touched by %s", strings.Join(f.Provenance.Steps, ", "))
+		}
+		fmt.Fprintf(w, ")\n")
+
+		mod := strings.ToLower(path.Base(f.Path))
+		if reason, ok := m.Roots[mod]; ok {
+			fmt.Fprintf(w, "  root (%s)\n", reason)
+			continue
+		}
+		if !strings.HasSuffix(path.Dir(f.Path), "-windows") {
+			continue // not a pe module
+		}
+		ps := whyPaths(m, mod, paths)
+		if len(ps) == 0 {
+			fmt.Fprintf(w, "  not imported by any module\n")
+		}
+		for _, p := range ps {
+			if reason, ok := m.Roots[p[0]]; ok {
+				fmt.Fprintf(w, "  root (%s): %s\n", reason, strings.Join(p, " -> "))
+			} else {
+				fmt.Fprintf(w, "  %s\n", strings.Join(p, " -> "))
+			}
+		}
+	}
+	return found
+}
+
+// writeWhyRemoved explains a removal, and recursively, the removals of the
+// dependencies which caused it.
+func writeWhyRemoved(w io.Writer, m *Manifest, r *ManifestRemoval, indent string, seen map[string]bool) {
+	fmt.Fprintf(w, "%s%s/%s: removed by %s", indent, r.Root, r.Path, r.Rule)
+	if r.Detail != "" {
+		fmt.Fprintf(w, " (%s)", r.Detail)
+	}
+	fmt.Fprintf(w, "\n")
+	seen[r.Path] = true
+	for _, dep := range r.Deps {
+		i := slices.IndexFunc(m.Removed, func(x *ManifestRemoval) bool {
+			return strings.EqualFold(path.Base(x.Path), dep) && strings.HasSuffix(path.Dir(x.Path), "-windows")
+		})
+		if i == -1 {
+			fmt.Fprintf(w, "%s  %s: not in the wine build\n", indent, dep)
+		} else if !seen[m.Removed[i].Path] {
+			writeWhyRemoved(w, m, m.Removed[i], indent+"  ", seen)
+		}
+	}
+}
+
+// whyPaths finds up to n of the shortest import paths to a module, starting at
+// a closure root if there are any, or otherwise a module which isn't imported
+// by anything.
+func whyPaths(m *Manifest, mod string, n int) [][]string {
+	importers := map[string][]string{}
+	for _, name := range slices.Sorted(maps.Keys(m.Imports)) {
+		for _, dep := range m.Imports[name] {
+			importers[dep] = append(importers[dep], name)
+		}
+	}
+	var (
+		res   [][]string
+		next  = map[string]string{mod: ""} // towards mod
+		queue = []string{mod}
+	)
+	for len(queue) != 0 && len(res) < n {
+		cur := queue[0]
+		queue = queue[1:]
+		if cur != mod {
+			_, root := m.Roots[cur]
+			if root || (len(m.Roots) == 0 && len(importers[cur]) == 0) {
+				var p []string
+				for x := cur; x != ""; x = next[x] {
+					p = append(p, x)
+				}
+				res = append(res, p)
+				continue
+			}
+		}
+		for _, imp := range importers[cur] {
+			if _, ok := next[imp]; !ok {
+				next[imp] = cur
+				queue = append(queue, imp)
+			}
+		}
+	}
+	return res
+}
+
+// whyMatch checks if the file at p matches name, case-insensitively, with or
+// without the extension.
+func whyMatch(p, name string) bool {
+	base, name := strings.ToLower(path.Base(p)), strings.ToLower(name)
+	return base == name || strings.TrimSuffix(base, path.Ext(base)) == name
+}
@@ -0,0 +1,76 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWhy(t *testing.T) {
+	const dir = "lib/wine/x86_64-windows/"
+	m := &Manifest{
+		Files: []*ManifestFile{
+			{Root: "wine", Path: dir + "ntdll.dll", Provenance: Provenance{Origin: OriginWine}},
+			{Root: "wine", Path: dir + "kernel32.dll", Provenance: Provenance{Origin: OriginWine}},
+			{Root: "wine", Path: dir + "user32.dll", Provenance: Provenance{Origin: OriginWine}},
+			{Root: "wine", Path: dir + "explorer.exe", Provenance: Provenance{Origin: OriginWine, Steps: []string{"patch-explorer"}}},
+			{Root: "wine", Path: dir + "services.exe", Provenance: Provenance{Origin: OriginWine}},
+			{Root: "wine", Path: "lib/wine/x86_64-unix/ntdll.so", Provenance: Provenance{Origin: OriginWine}},
+		},
+		Removed: []*ManifestRemoval{
+			{Root: "wine", Path: dir + "d3d11.dll", Rule: "unnecessary-libs"},
+			{Root: "wine", Path: dir + "dxgi.dll", Rule: "removed-dependencies", Detail: "imports d3d11.dll, opengl32.dll", Deps: []string{"d3d11.dll", "opengl32.dll"}},
+			{Root: "wine", Path: dir + "dxdiag.exe", Rule: "removed-dependencies", Detail: "imports dxgi.dll", Deps: []string{"dxgi.dll"}},
+		},
+		Roots: map[string]string{
+			"explorer.exe": "profile roots",
+			"services.exe": "service services",
+		},
+		Imports: map[string][]string{
+			"kernel32.dll": {"ntdll.dll"},
+			"user32.dll":   {"kernel32.dll", "ntdll.dll"},
+			"explorer.exe": {"kernel32.dll", "user32.dll"},
+			"services.exe": {"kernel32.dll"},
+		},
+	}
+	for _, tc := range []struct {
+		Name   string
+		Output string
+	}{
+		{"DXDIAG", `
+wine/lib/wine/x86_64-windows/dxdiag.exe: removed by removed-dependencies (imports dxgi.dll)
+  wine/lib/wine/x86_64-windows/dxgi.dll: removed by removed-dependencies (imports d3d11.dll, opengl32.dll)
+    wine/lib/wine/x86_64-windows/d3d11.dll: removed by unnecessary-libs
+    opengl32.dll: not in the wine build
+`},
+		{"explorer.exe", `
+wine/lib/wine/x86_64-windows/explorer.exe: kept (wine, touched by patch-explorer)
+  root (profile roots)
+`},
+		{"ntdll", `
+wine/lib/wine/x86_64-windows/ntdll.dll: kept (wine)
+  root (profile roots): explorer.exe -> kernel32.dll -> ntdll.dll
+  root (service services): services.exe -> kernel32.dll -> ntdll.dll
+wine/lib/wine/x86_64-unix/ntdll.so: kept (wine)
+`},
+	} {
+		var b strings.Builder
+		if !writeWhy(&b, m, tc.Name, 3) {
+			t.Errorf("%s: expected match", tc.Name)
+		}
+		if act, exp := b.String(), strings.TrimPrefix(tc.Output, "\n"); act != exp {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", tc.Name, exp, act)
+		}
+	}
+	if writeWhy(&strings.Builder{}, m, "missing.dll", 3) {
+		t.Errorf("expected no match")
+	}
+
+	m.Roots = nil
+	var b strings.Builder
+	writeWhy(&b, m, "kernel32.dll", 1)
+	if exp := "wine/lib/wine/x86_64-windows/kernel32.dll: kept (wine)\n  explorer.exe -> kernel32.dll\n"; b.String() != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, b.String())
+	}
+}
@@ -0,0 +1,89 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// wineboot initializes the wineprefix at prefix, writing the output to stdout
+// and returning the normalized error lines. The wineserver is waited for
+// before returning.
+func wineboot(env []string, prefix string) ([]string, error) {
+	winedebug := "err-ole,fixme-actctx"
+	if *Debug {
+		winedebug += ",+loaddll"
+		//winedebug += ",+imports"
+		winedebug += ",+module"
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan []string)
+	go func() {
+		var errs []string
+		sc := bufio.NewScanner(pr)
+		sc.Buffer(nil, 1024*1024)
+		for sc.Scan() {
+			line := sc.Text()
+			fmt.Fprintln(os.Stdout, line)
+			if e, ok := wineErrLine(line, prefix); ok && !slices.Contains(errs, e) {
+				errs = append(errs, e)
+			}
+		}
+		io.Copy(io.Discard, pr) // in case of a scanner error
+		done <- errs
+	}()
+
+	cmd := exec.Command(filepath.Join(*Prefix, "bin", "wine"), "wineboot", "--init")
+	cmd.Env = append(slices.Clone(env), "WINEPREFIX="+prefix, "WINEDEBUG="+winedebug)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	// TODO: filter out expected err:winediag:nodrv_CreateWindow, err:vulkan:vulkan_init_once, err:win:get_desktop_window
+	err := cmd.Run()
+	pw.Close()
+	errs := <-done
+	if err != nil {
+		return errs, err
+	}
+
+	return errs, wineserverWait(append(slices.Clone(env), "WINEPREFIX="+prefix))
+}
+
+// wineReg runs wine's reg command with the specified arguments.
+func wineReg(env []string, args ...string) error {
+	cmd := exec.Command(filepath.Join(*Prefix, "bin", "wine"), append([]string{"reg"}, args...)...)
+	cmd.Env = append(slices.Clone(env), "WINEDEBUG=-all")
+	cmd.Stdout = io.Discard
+	cmd.Stderr = os.Stdout
+	return cmd.Run()
+}
+
+// wineserverWait waits for the wineserver for the prefix in env to exit.
+func wineserverWait(env []string) error {
+	cmd := exec.Command(filepath.Join(*Prefix, "bin", "wineserver"), "-w")
+	cmd.Env = env
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("wait for wineserver: %w", err)
+	}
+	return nil
+}
+
+// wineErrLine checks if line is a wine error, normalizing it so it can be
+// compared between runs and prefixes.
+func wineErrLine(line, prefix string) (string, bool) {
+	if m := regex(`^(?:[0-9a-f]{4,}:)+(err:.*)$`).FindStringSubmatch(line); m != nil {
+		line = m[1]
+	} else if !strings.HasPrefix(line, "wine: ") {
+		return "", false
+	}
+	line = strings.ReplaceAll(line, prefix, "$WINEPREFIX")
+	line = regex(`0x[0-9a-fA-F]+`).ReplaceAllLiteralString(line, "0x?")
+	return line, true
+}
@@ -0,0 +1,25 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import "testing"
+
+func TestWineErrLine(t *testing.T) {
+	for _, tc := range []struct {
+		Line string
+		Err  string
+		OK   bool
+	}{
+		{"0024:err:ole:CoGetClassObject class {00000000} not registered", "err:ole:CoGetClassObject class {00000000} not registered", true},
+		{"0024:0028:err:module:import_dll Library foo.dll (which is needed by L\"/tmp/x/drive_c/bar.dll\") not found", "err:module:import_dll Library foo.dll (which is needed by L\"$WINEPREFIX/drive_c/bar.dll\") not found", true},
+		{"0030:err:seh:dispatch status 0xc0000005 at 0x7bc0123", "err:seh:dispatch status 0x? at 0x?", true},
+		{"wine: failed to open \"/tmp/x/foo\"", "wine: failed to open \"$WINEPREFIX/foo\"", true},
+		{"0024:fixme:ver:GetCurrentPackageId stub", "", false},
+		{"err:something without a thread id", "", false},
+		{"wineboot output", "", false},
+	} {
+		if err, ok := wineErrLine(tc.Line, "/tmp/x"); ok != tc.OK || err != tc.Err {
+			t.Errorf("%q: expected (%q, %t), got (%q, %t)", tc.Line, tc.Err, tc.OK, err, ok)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// StubExports gets the exports which are wine stubs (i.e., "stub" entries in
+// the spec file), which just raise an exception when called. These are
+// detected by the code winebuild generates for them, which passes the dll and
+// function name (or ordinal) to __wine_spec_unimplemented_stub. Exports by
+// ordinal only are returned as "#ordinal".
+func (f *peFile) StubExports() ([]string, error) {
+	exps, err := f.Exports()
+	if err != nil {
+		return nil, err
+	}
+	var stubs []string
+	for _, exp := range exps {
+		if exp.Forwarder != "" {
+			continue
+		}
+		name, ord, ok := f.wineStubCall(exp.RVA)
+		if !ok {
+			continue
+		}
+		if exp.Name != "" && name == exp.Name {
+			stubs = append(stubs, exp.Name)
+		} else if exp.Name == "" && name == "" && ord == uint32(exp.Ordinal) {
+			stubs = append(stubs, "#"+strconv.Itoa(int(exp.Ordinal)))
+		}
+	}
+	return stubs, nil
+}
+
+// wineStubCall decodes the arguments of a winebuild stub function at rva,
+// returning the function name or ordinal it passes.
+func (f *peFile) wineStubCall(rva uint32) (name string, ordinal uint32, ok bool) {
+	code, err := peReadRVA(f.File, rva, 32)
+	if err != nil {
+		return "", 0, false
+	}
+	le := binary.LittleEndian
+
+	// x86_64:
+	//	subq $n, %rsp
+	//	leaq .L__wine_spec_file_name(%rip), %rcx
+	//	leaq .L<name>_string(%rip), %rdx / movq $<ordinal>, %rdx
+	//	call __wine_spec_unimplemented_stub
+	if code[0] == 0x48 && code[1] == 0x83 && code[2] == 0xec {
+		x, pc := code[4:], rva+4
+		if x[0] == 0x48 && x[1] == 0x8d && x[2] == 0x0d {
+			x, pc = x[7:], pc+7
+			switch {
+			case x[0] == 0x48 && x[1] == 0x8d && x[2] == 0x15:
+				name, err = peReadString(f.File, pc+7+le.Uint32(x[3:]))
+				ok = err == nil && name != ""
+			case x[0] == 0x48 && x[1] == 0xc7 && x[2] == 0xc2:
+				ordinal, ok = le.Uint32(x[3:]), true
+			}
+			if ok && x[7] == 0xe8 {
+				return name, ordinal, true
+			}
+		}
+		return "", 0, false
+	}
+
+	// aarch64 and arm64ec:
+	//	stp x29, x30, [sp, #-16]!
+	//	mov x29, sp
+	//	adrp x0, .L__wine_spec_file_name
+	//	add x0, x0, :lo12:.L__wine_spec_file_name
+	//	adrp x1, .L<name>_string / mov x1, #<ordinal>
+	//	add x1, x1, :lo12:.L<name>_string
+	//	bl __wine_spec_unimplemented_stub
+	ins := func(i int) uint32 {
+		return le.Uint32(code[i*4:])
+	}
+	adrp := func(i int, reg uint32) (uint32, bool) {
+		x := ins(i)
+		if x&0x9f00001f != 0x90000000|reg {
+			return 0, false
+		}
+		imm := int64(x>>29&3|(x>>5&0x7ffff)<<2) << 43 >> 31 // sign-extended, shifted by 12
+		return uint32(int64((rva+uint32(i*4))&^0xfff) + imm), true
+	}
+	add := func(i int, reg uint32) (uint32, bool) {
+		x := ins(i)
+		if x&0xffc003ff != 0x91000000|reg<<5|reg {
+			return 0, false
+		}
+		return x >> 10 & 0xfff, true
+	}
+	if ins(0) != 0xa9bf7bfd || ins(1) != 0x910003fd {
+		return "", 0, false
+	}
+	if _, ok := adrp(2, 0); !ok {
+		return "", 0, false
+	}
+	if _, ok := add(3, 0); !ok {
+		return "", 0, false
+	}
+	if x := ins(4); x&0xffe0001f == 0xd2800001 { // movz x1, #imm16
+		if ins(5)&0xfc000000 == 0x94000000 {
+			return "", x >> 5 & 0xffff, true
+		}
+		return "", 0, false
+	}
+	page, ok := adrp(4, 1)
+	if !ok {
+		return "", 0, false
+	}
+	off, ok := add(5, 1)
+	if !ok || ins(6)&0xfc000000 != 0x94000000 {
+		return "", 0, false
+	}
+	if name, err = peReadString(f.File, page+off); err != nil || name == "" {
+		return "", 0, false
+	}
+	return name, 0, true
+}
+
+// wineStubModule is the stub and forwarded exports of a wine PE module.
+type wineStubModule struct {
+	Stubs      []string
+	Forwarders map[string]string // export name (or #ordinal) to forwarder
+}
+
+// wineStubsOf finds the stub exports of the PE modules in dir, keyed by the
+// lowercased file name.
+func wineStubsOf(dir string) (map[string]*wineStubModule, error) {
+	dis, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, di := range dis {
+		if di.Type().IsRegular() {
+			names = append(names, di.Name())
+		}
+	}
+	mods, err := parallelMap(names, func(name string) (*wineStubModule, error) {
+		f, err := peOpen(filepath.Join(dir, name))
+		if err != nil {
+			return nil, nil // not a PE file
+		}
+		defer f.Close()
+
+		m := &wineStubModule{Forwarders: map[string]string{}}
+		if m.Stubs, err = f.StubExports(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		exps, err := f.Exports()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, exp := range exps {
+			if exp.Forwarder != "" {
+				m.Forwarders["#"+strconv.Itoa(int(exp.Ordinal))] = exp.Forwarder
+				if exp.Name != "" {
+					m.Forwarders[exp.Name] = exp.Forwarder
+				}
+			}
+		}
+		return m, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]*wineStubModule{}
+	for i, m := range mods {
+		if m != nil {
+			res[strings.ToLower(names[i])] = m
+		}
+	}
+	return res, nil
+}
+
+// wineStubImports finds the imported functions (library names to symbols, like
+// from peImportedSymbols) which are wine stubs, following forwarders and
+// resolving apisets. The result is sorted, and each entry is like
+// "kernel32.dll!Func", with " -> kernelbase.dll!Func" appended if the stub
+// was reached through a forwarder.
+func wineStubImports(mods map[string]*wineStubModule, schema *apisetSchema, imports map[string][]string) []string {
+	resolve := func(lib string) string {
+		if schema != nil && isApiset(lib) {
+			if hosts, ok := schema.Resolve(lib); ok && len(hosts) != 0 {
+				return strings.ToLower(hosts[0])
+			}
+		}
+		return strings.ToLower(lib)
+	}
+	var res []string
+	for _, lib := range slices.Sorted(maps.Keys(imports)) {
+		for _, sym := range imports[lib] {
+			cur, curSym := resolve(lib), sym
+			for range 8 { // forwarder chains are short, but could be cyclic
+				m := mods[cur]
+				if m == nil {
+					break
+				}
+				if slices.Contains(m.Stubs, curSym) {
+					x := lib + "!" + sym
+					if cur != strings.ToLower(lib) || curSym != sym {
+						x += " -> " + cur + "!" + curSym
+					}
+					res = append(res, x)
+					break
+				}
+				fwd, ok := m.Forwarders[curSym]
+				if !ok {
+					break
+				}
+				if cur, curSym, ok = peSplitForwarder(fwd); !ok {
+					break
+				}
+				cur = resolve(cur)
+			}
+		}
+	}
+	slices.Sort(res)
+	return slices.Compact(res)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestStubExports(t *testing.T) {
+	le := binary.LittleEndian
+	for _, machine := range []uint16{pe.IMAGE_FILE_MACHINE_AMD64, pe.IMAGE_FILE_MACHINE_ARM64} {
+		img, err := peStub(machine, "test.dll", []string{"Impl", "Stub", "Other", "#5"})
+		if err != nil {
+			t.Fatalf("generate stub: %v", err)
+		}
+		f, err := pe.NewFile(bytes.NewReader(img))
+		if err != nil {
+			t.Fatalf("parse stub: %v", err)
+		}
+		edir := peDataDirectory(f, pe.IMAGE_DIRECTORY_ENTRY_EXPORT)
+		off := func(rva uint32) int {
+			return int(rva - 0x1000 + 0x200) // in the .text padding
+		}
+		funcs := off(le.Uint32(img[off(edir.VirtualAddress)+28:]))
+
+		// Impl (1) is left as-is, and Other (2) passes the wrong name
+		copy(img[off(0x1180):], "test.dll\x00Stub\x00Wrong\x00")
+		const (
+			fileRVA  = 0x1180
+			stubRVA  = 0x1189
+			wrongRVA = 0x118e
+		)
+		for i, fn := range []struct {
+			Ord  int
+			Name uint32 // or zero for the ordinal
+		}{
+			{3, stubRVA},
+			{2, wrongRVA},
+			{5, 0},
+		} {
+			rva := uint32(0x1100 + 0x20*i)
+			le.PutUint32(img[funcs+4*(fn.Ord-1):], rva)
+
+			var code []byte
+			switch machine {
+			case pe.IMAGE_FILE_MACHINE_AMD64:
+				code = append(code, 0x48, 0x83, 0xec, 0x28)
+				code = le.AppendUint32(append(code, 0x48, 0x8d, 0x0d), fileRVA-(rva+uint32(len(code))+7))
+				if fn.Name != 0 {
+					code = le.AppendUint32(append(code, 0x48, 0x8d, 0x15), fn.Name-(rva+uint32(len(code))+7))
+				} else {
+					code = le.AppendUint32(append(code, 0x48, 0xc7, 0xc2), uint32(fn.Ord))
+				}
+				code = le.AppendUint32(append(code, 0xe8), 0)
+			case pe.IMAGE_FILE_MACHINE_ARM64:
+				adrp := func(reg, target uint32) uint32 {
+					pc := rva + uint32(len(code))
+					imm := (target&^0xfff - pc&^0xfff) >> 12
+					return 0x90000000 | imm&3<<29 | imm>>2&0x7ffff<<5 | reg
+				}
+				code = le.AppendUint32(code, 0xa9bf7bfd)
+				code = le.AppendUint32(code, 0x910003fd)
+				code = le.AppendUint32(code, adrp(0, fileRVA))
+				code = le.AppendUint32(code, 0x91000000|fileRVA&0xfff<<10)
+				if fn.Name != 0 {
+					code = le.AppendUint32(code, adrp(1, fn.Name))
+					code = le.AppendUint32(code, 0x91000021|fn.Name&0xfff<<10)
+				} else {
+					code = le.AppendUint32(code, 0xd2800001|uint32(fn.Ord)<<5)
+				}
+				code = le.AppendUint32(code, 0x94000000)
+			}
+			copy(img[off(rva):], code)
+		}
+
+		pf, err := peNewFile(bytes.NewReader(img))
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		stubs, err := pf.StubExports()
+		if err != nil {
+			t.Fatalf("%#x: get stubs: %v", machine, err)
+		}
+		if exp := []string{"Stub", "#5"}; !slices.Equal(stubs, exp) {
+			t.Errorf("%#x: expected stubs %q, got %q", machine, exp, stubs)
+		}
+
+		if machine == pe.IMAGE_FILE_MACHINE_AMD64 {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "Test.dll"), img, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "readme.txt"), []byte("not a pe file"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mods, err := wineStubsOf(dir)
+			if err != nil {
+				t.Fatalf("find stubs: %v", err)
+			}
+			if len(mods) != 1 || mods["test.dll"] == nil {
+				t.Errorf("expected only test.dll, got %q", slices.Collect(maps.Keys(mods)))
+			} else if exp := (&wineStubModule{Stubs: []string{"Stub", "#5"}, Forwarders: map[string]string{}}); !reflect.DeepEqual(mods["test.dll"], exp) {
+				t.Errorf("expected %+v, got %+v", exp, mods["test.dll"])
+			}
+		}
+	}
+}
+
+func TestWineStubImports(t *testing.T) {
+	mods := map[string]*wineStubModule{
+		"kernel32.dll": {
+			Forwarders: map[string]string{
+				"Fwd":   "kernelbase.Fwd2",
+				"Cycle": "KERNEL32.Cycle",
+			},
+		},
+		"kernelbase.dll": {
+			Stubs: []string{"Fwd2", "Direct"},
+		},
+	}
+	act := wineStubImports(mods, nil, map[string][]string{
+		"kernel32.dll":   {"Fwd", "Cycle", "Impl"},
+		"kernelbase.dll": {"Direct", "Direct"},
+		"missing.dll":    {"Fwd"},
+	})
+	if exp := []string{"kernel32.dll!Fwd -> kernelbase.dll!Fwd2", "kernelbase.dll!Direct"}; !slices.Equal(act, exp) {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// winVersion is a windows version which can be reported by the prefix.
+type winVersion struct {
+	Product string
+	Major   uint32
+	Minor   uint32
+	Build   uint32
+}
+
+// winVersions are the versions supported by -winver, named like winecfg's.
+var winVersions = map[string]winVersion{
+	"win10": {"Windows 10 Pro", 10, 0, 19045},
+	"win11": {"Windows 10 Pro", 10, 0, 22631}, // windows 11 still reports itself as windows 10 here
+}
+
+// winverEdits returns the registry edits to make the prefix report the named
+// windows version, like winecfg does when setting the global version.
+func winverEdits(name string) ([]regEdit, error) {
+	v, ok := winVersions[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported windows version %q (expected one of %q)", name, slices.Sorted(maps.Keys(winVersions)))
+	}
+	var edits []regEdit
+	set := func(key, name string, typ uint32, data []byte) {
+		edits = append(edits, regEdit{Key: key, Value: &regValue{Name: name, Type: typ, Data: data}})
+	}
+	for _, key := range []string{
+		`HKLM\Software\Microsoft\Windows NT\CurrentVersion`,
+		`HKLM\Software\Wow6432Node\Microsoft\Windows NT\CurrentVersion`,
+	} {
+		set(key, "CSDVersion", regSZ, regStringData(""))
+		set(key, "CurrentBuild", regSZ, regStringData(strconv.FormatUint(uint64(v.Build), 10)))
+		set(key, "CurrentBuildNumber", regSZ, regStringData(strconv.FormatUint(uint64(v.Build), 10)))
+		set(key, "CurrentMajorVersionNumber", regDWORD, regDWORDData(v.Major))
+		set(key, "CurrentMinorVersionNumber", regDWORD, regDWORDData(v.Minor))
+		set(key, "CurrentVersion", regSZ, regStringData("6.3")) // for compatibility, windows 10+ reports 6.3 here
+		set(key, "ProductName", regSZ, regStringData(v.Product))
+	}
+	set(`HKLM\System\CurrentControlSet\Control\ProductOptions`, "ProductType", regSZ, regStringData("WinNT"))
+	set(`HKLM\System\CurrentControlSet\Control\Windows`, "CSDVersion", regDWORD, regDWORDData(0))
+	set(`HKCU\Software\Wine`, "Version", regSZ, regStringData(name))
+	return edits, nil
+}
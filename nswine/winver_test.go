@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestWinverEdits(t *testing.T) {
+	edits, err := winverEdits("win11")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hives := map[string]*regFile{}
+	if err := applyRegEdits(hives, edits); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	for _, key := range []string{`Software\Microsoft\Windows NT\CurrentVersion`, `Software\Wow6432Node\Microsoft\Windows NT\CurrentVersion`} {
+		if v, ok := hives["system.reg"].Value(key, "CurrentBuildNumber").Str(); !ok || v != "22631" {
+			t.Errorf("%s: expected build 22631, got %q", key, v)
+		}
+		if v, ok := hives["system.reg"].Value(key, "CurrentMajorVersionNumber").DWORD(); !ok || v != 10 {
+			t.Errorf("%s: expected major version 10, got %d", key, v)
+		}
+	}
+	if v, ok := hives["user.reg"].Value(`Software\Wine`, "Version").Str(); !ok || v != "win11" {
+		t.Errorf("expected wine version win11, got %q", v)
+	}
+	if _, err := winverEdits("winxp"); err == nil {
+		t.Errorf("expected error for unsupported version")
+	}
+}
@@ -28,10 +28,36 @@
  *     - title update watchdog
  *     - title update to process title
  *     - ansi escape filtering
- *     - proper stdin handling (buffering, tty, etc)
+ *     - utf-8 output with unix line endings
+ *     - suppression of known-harmless wine debug output (configurable, never suppresses unknown lines)
+ *     - optional json log output, with lines classified by source (nswrap, wine, game), channel (wine debug channel or northstar logger), and severity
+ *     - proper stdin handling (buffering, tty, line endings, etc)
  *   - env var filtering
+ *     - declarative mapping of env vars into the windows environment (NSWRAP_ENV, e.g., NS_*=* to pass NS_ vars without the prefix)
+ *   - user identity setup (passwd/group entries for arbitrary uids, e.g., on OpenShift)
+ *   - per-instance prefixes sharing the runtime prefix (with files in dirs wine writes to copied), with only registry deltas persisted
+ *     - optionally copy-on-write (an overlayfs mount in a private mount namespace, or reflinks, or a parallel copy)
+ *     - based on the minimal user hive template from nswine -user-template, if the runtime has one
+ *   - read-only runtimes (with the instance prefix in a writable dir, checked at startup for paths which would be written to in the runtime, and the game logs redirected to the instance dir if they aren't writable)
+ *   - garbage collection of stale instance dirs (nswrap gc)
+ *   - parallel pre-instantiation of instance prefixes (nswrap instantiate), optionally reflinking files from the runtime prefix
+ *   - running multiple instances with their own instance prefixes, ports, and arguments from one runtime (nswrap multi), with per-instance log prefixes
+ *   - support bundles for bug reports (nswrap support-bundle)
+ *   - crash bundles (recent console output including wine backtraces, exit status, and new minidumps)
+ *   - running the game executable as a windows service through services.exe for tools which require it (NSWRAP_SERVICE)
+ *   - instance disk quotas (periodic checks which fail the readiness check and stop the game server after a grace period, or filesystem project quotas)
+ *   - on-demand installation of optional components moved out of the runtime by nswine (into the instance dir if using one)
+ *   - runtime compatibility check against the nswine manifest
+ *   - running wine with the locale and timezone from the nswine manifest (nswine -locale and -tz), since wine derives the windows ones from them
+ *   - startup time breakdown (logged, and optionally written as otlp json traces)
+ *   - optional opentelemetry export (startup and supervisor event traces, status metrics) to an otlp/http endpoint
  *   - process monitoring
+ *   - optional http health endpoint (/healthz for the wine process tree, /readyz for the game server being up with its udp port bound) and prometheus metrics (/metrics)
+ *   - supervisor mode (restarts with exponential backoff after unexpected exits, support bundles, and structured restart events)
+ *   - graceful shutdown on SIGTERM/SIGINT (quit concommand, then wineserver -k after a grace period) (this can take up to the grace period plus the wineserver timeout, so use docker run --stop-timeout 20 or compose stop_grace_period: 20s)
+ *   - wineserver lifecycle (started persistently, flushed and stopped on shutdown, killed if it doesn't exit in time)
  *   - cleanup
+ *   - exit status propagation (0 if a quit was requested, otherwise the wine exit status, 128+signal if it was killed, or 1)
  *
  * To test this without a patched wine build (it still must be >= wine-9.0), do something like the following:
  * - gcc -Wall -Wextra nswrap.c -o nswrap
@@ -55,9 +81,17 @@
  */
 
 #define _GNU_SOURCE
+#include <ctype.h>
+#include <dirent.h>
 #include <errno.h>
 #include <fcntl.h>
+#include <ftw.h>
+#include <grp.h>
+#include <limits.h>
+#include <locale.h>
+#include <linux/fs.h>
 #include <poll.h>
+#include <pwd.h>
 #include <regex.h>
 #include <sched.h>
 #include <signal.h>
@@ -68,12 +102,21 @@
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
+#include <strings.h>
 #include <termios.h>
 #include <time.h>
 #include <unistd.h>
+#include <arpa/inet.h>
+#include <netinet/in.h>
+#include <sys/file.h>
 #include <sys/ioctl.h>
+#include <sys/mman.h>
+#include <sys/mount.h>
 #include <sys/prctl.h>
+#include <sys/random.h>
+#include <sys/resource.h>
 #include <sys/signalfd.h>
+#include <sys/socket.h>
 #include <sys/stat.h>
 #include <sys/syscall.h>
 #include <sys/sysinfo.h>
@@ -94,6 +137,15 @@
 /** Watchdog timeout. */
 #define NSWRAP_WATCHDOG_TIMEOUT 30
 
+/** Interval for checking instance disk usage against the quota. */
+#define NSWRAP_QUOTA_INTERVAL 60
+
+/** How long instance disk usage can exceed the quota before the game server is stopped. */
+#define NSWRAP_QUOTA_GRACE (5*60)
+
+/** Max number of processes to copy files into copy-on-write instance prefixes with when overlayfs and reflinks aren't usable. */
+#define NSWRAP_INSTANCE_COPY_JOBS 8
+
 /** Whether to pass-through the title if stdout is a TTY. */
 #define NSWRAP_IOPROC_TTY_TITLE true
 
@@ -103,6 +155,52 @@
 /** The chunk size for console i/o (also the maximum length of a parsed title and stdin concommand). */
 #define NSWRAP_IOPROC_OUTPUT_CHUNK_SIZE 2048
 
+/** Milliseconds without any activity before an incomplete output line (e.g., a prompt) is written anyway when processing output by line. */
+#define NSWRAP_IOPROC_LINE_FLUSH_TIMEOUT 250
+
+/** The runtime compatibility version this nswrap supports (must match RuntimeCompat in nswine). */
+#define NSWRAP_RUNTIME_COMPAT 1
+
+/** The maximum number of spans recorded while starting up. */
+#define NSWRAP_TRACE_SPANS 16
+
+/** Interval for exporting metrics to the otlp endpoint. */
+#define NSWRAP_OTLP_INTERVAL 15
+
+/** The number of recent lines of game output to include in crash bundles. */
+#define NSWRAP_CRASH_LINES 500
+
+/** The default udp port the game server listens on. */
+#define NSWRAP_GAME_PORT 37015
+
+/** Default time to wait for the game server to quit after a shutdown signal before killing it (the stop timeout must also cover NSWRAP_WINESERVER_TIMEOUT, which is more than docker's default of 10s). */
+#define NSWRAP_SHUTDOWN_GRACE 8
+
+/** Initial delay before restarting the game server in supervisor mode (doubled after each consecutive restart). */
+#define NSWRAP_RESTART_BACKOFF_INITIAL 5
+
+/** Maximum delay before restarting the game server in supervisor mode. */
+#define NSWRAP_RESTART_BACKOFF_MAX 300
+
+/** Time the game server must run for in supervisor mode before the restart count and backoff are reset. */
+#define NSWRAP_RESTART_STABLE (10*60)
+
+/** Max number of support bundles to keep in the restart diagnostics dir in supervisor mode (the oldest are removed first). */
+#define NSWRAP_RESTART_DIAG_KEEP 5
+
+/** Timeout for the wineserver to flush the registry and exit on shutdown before it's killed. */
+#define NSWRAP_WINESERVER_TIMEOUT 10
+
+/** The user name the wineprefix was created with (the profile dir name in drive_c/users). */
+#define NSWRAP_PREFIX_USER "nswrap"
+
+/** Well-known nss_wrapper library locations. */
+#define NSWRAP_NSS_WRAPPER_PATHS \
+    "/usr/lib/x86_64-linux-gnu/libnss_wrapper.so", \
+    "/usr/lib/aarch64-linux-gnu/libnss_wrapper.so", \
+    "/usr/lib64/libnss_wrapper.so", \
+    "/usr/lib/libnss_wrapper.so"
+
 /** The regexp for matching the console title against to extract the server status. */
 #define NSWRAP_STATUS_RE(_x, _int, _str) _x( \
     " - ([A-Za-z0-9_]+) ([0-9]+)/([0-9]+) players \\(([A-Za-z0-9_]+)\\)", \
@@ -198,6 +296,9 @@ typedef enum {
 static struct {
     bool force_quit;
     bool quit_requested;
+    int supervisor_fd; // pipe to tell the supervisor wine was started (-1 if not supervised)
+    uint64_t supervisor_start; // when the supervisor was started, in unix ns (0 if not supervised)
+    unsigned long supervisor_restarts; // total restarts by the supervisor
 
     struct {
         /* log level */
@@ -218,18 +319,128 @@ static struct {
         /* whether to ignore the watchdog */
         bool nowatchdogquit;
 
+        /* game executable in the current dir */
+        const char *exe;
+
         /* dir with runtime files (defaults to the executable path with bin/nswrap removed) */
         char dir[1024];
 
         /* whether to enable colored logs */
         bool color;
+
+        /* whether to write logs (including game output) as json lines */
+        bool json;
+
+        /* whether to not suppress the built-in known-harmless wine debug output */
+        bool log_nosuppress;
+
+        /* additional semicolon-separated wine debug output prefixes (class:channel:message, without the thread id) to suppress */
+        const char *log_suppress;
+
+        /* whether game output is processed by line (for json or suppression) */
+        bool log_lines;
+
+        /* [host]:port to serve the http health endpoint on (NULL to disable) */
+        const char *health_addr;
+
+        /* dir to write crash bundles to (NULL to disable) */
+        const char *crash_dir;
+
+        /* path to libnss_wrapper.so (defaults to searching the well-known locations) */
+        const char *nss_wrapper;
+
+        /* semicolon-separated rules for env vars to pass to wine (NAME, NAME=NEW, PREFIX*, or PREFIX*=NEWPREFIX*) */
+        const char *env;
+
+        /* max disk usage of the instance dir in bytes (0 to disable) */
+        uint64_t quota;
+
+        /* project id to set on the instance dir for filesystem project quotas (0 to disable) */
+        unsigned quota_projid;
+
+        /* comma-separated optional components to install before starting wine */
+        const char *components;
+
+        /* base URL or path to get optional components from instead of the one in the manifest */
+        const char *component_source;
+
+        /* instance dir to create a prefix in, using the runtime prefix as a template (empty to use the runtime prefix directly) */
+        const char *instance;
+
+        /* whether to reflink files from the template prefix into instance prefixes instead of symlinking them */
+        bool reflink;
+
+        /* whether to make instance prefixes copy-on-write (overlayfs, then reflinks, then copies) instead of symlinking files */
+        bool cow;
+
+        /* whether the runtime (including the template prefix) is read-only */
+        bool readonly;
+
+        /* whether to only warn if the runtime was built for a different nswrap version */
+        bool nocompatcheck;
+
+        /* file to append startup traces to as otlp json lines */
+        const char *trace_file;
+
+        /* otlp/http endpoint to export traces and metrics to (NULL to disable) */
+        const char *otlp_endpoint;
+
+        /* windows service name to run the game executable as (NULL to run it directly) */
+        const char *service;
+
+        /* seconds to wait for the game server to quit after a shutdown signal before killing wine (0 to wait forever) */
+        unsigned shutdown_grace;
+
+        /* max consecutive restarts in supervisor mode (0 to disable supervisor mode) */
+        unsigned restart;
+
+        /* dir to write support bundles to when the game server is restarted (empty to disable) */
+        const char *restart_diag;
     } cfg;
 
+    struct {
+        /* template prefix */
+        char template[2048];
+
+        /* whether the instance prefix was created */
+        bool ready;
+
+        /* whether the instance prefix is an overlayfs mount */
+        bool overlay;
+
+        /* files to copy into the instance prefix after walking the template prefix */
+        struct {
+            char *path;
+            mode_t mode;
+        } *copy;
+        size_t n_copy;
+
+        /* instance lock file (contains the game executable path, mtime is the last use) */
+        int lock;
+    } inst;
+
+    struct {
+        /* home directory for wine */
+        char home[1024];
+
+        /* nss_wrapper library and files, if used */
+        char nss_lib[1024];
+        char nss_passwd[1024];
+        char nss_group[1024];
+    } ident;
+
+    struct {
+        /* unix locale and posix TZ from the nswine manifest to run wine with, since wine derives the windows ones from them (empty if not set) */
+        char locale[64];
+        char tz[128];
+    } runtime;
+
     struct {
         sigset_t origset;
         bool origset_ok;
         int sfd;
         int shutdown_count;
+        int grace_tfd;
     } sig;
 
     struct {
@@ -240,6 +451,10 @@ static struct {
         regex_t title_re;
 
         int state;
+        bool cr; // pending \r which will be dropped if followed by \n
+        size_t n_line;
+        char b_line[NSWRAP_IOPROC_OUTPUT_CHUNK_SIZE]; // incomplete output line for json logs or suppression
+        unsigned long long n_suppressed;
         size_t n_inp, n_tit, n_out;
         char b_inp[NSWRAP_IOPROC_OUTPUT_CHUNK_SIZE];
         char b_tit[NSWRAP_IOPROC_OUTPUT_CHUNK_SIZE + 1]; // +1 for the null terminator
@@ -247,6 +462,7 @@ static struct {
 
         size_t n_stdin, n_stdin_write; // first is buffered stdin length, second is the offset to write until (i.e., newline so line buffered)
         char b_stdin[NSWRAP_IOPROC_OUTPUT_CHUNK_SIZE];
+        bool stdin_cr; // last byte read from stdin was \r (so a following \n is part of a CRLF)
 
         struct {
             char title[NSWRAP_IOPROC_OUTPUT_CHUNK_SIZE + 1];
@@ -264,6 +480,13 @@ static struct {
         struct timespec last;
     } watchdog;
 
+    struct {
+        int tfd;
+        bool exceeded; // degrades the health status and fails the readiness check
+        struct timespec since; // when the quota was first exceeded
+        uint64_t usage; // bytes, as of the last check
+    } quota;
+
     struct {
         int errno_pipe[2];
         pid_t pid;
@@ -271,13 +494,59 @@ static struct {
         bool reaped;
         int wstatus;
     } wine;
+
+    struct {
+        char id[33]; // otlp trace id for this nswrap process
+        char root[17]; // otlp span id of the startup span
+        uint64_t start; // unix nanoseconds
+        uint64_t ready; // unix nanoseconds, 0 if startup didn't complete (yet)
+        bool done;
+        size_t n;
+        struct {
+            const char *name;
+            uint64_t start, end; // unix nanoseconds, end is 0 if not ended yet
+        } span[NSWRAP_TRACE_SPANS];
+    } trace;
+
+    struct {
+        int tfd;
+        pid_t pid; // in-progress metrics export
+    } otlp;
+
+    struct {
+        pid_t pid; // in-progress sc.exe commands
+        bool stopping;
+        char *exe; // wine loader
+        char **envp; // wine environment
+        char wineserver[2048];
+    } service;
+
+    struct {
+        pid_t pid; // wineserver we started, 0 if not running
+        char dir[PATH_MAX]; // socket dir
+    } server;
+
+    struct {
+        int fd; // listener
+        unsigned port; // game server udp port
+    } health;
+
+    struct {
+        char *line[NSWRAP_CRASH_LINES]; // ring of recent game output
+        size_t next;
+        char *reason; // first line indicating a crash, if any
+    } crash;
 } state;
 
+static void nslog_json(const char *level, const char *fmt, ...); // not marked as printf-like since the text output already checks the format, and it has blank lines
+
 #define NSLOG(_level, _level_color, _fmt_color, _fmt, ...) do { \
     int saved_errno = errno; \
     if (nslog_##_level >= state.cfg.level) { \
         errno = saved_errno; \
-        if (state.cfg.color) { \
+        if (state.cfg.json) { \
+            nslog_json(#_level, _fmt, ##__VA_ARGS__); \
+        } else if (state.cfg.color) { \
             printf("\x1b[0m" "\x1b[36m" "[nswrap] " "\x1b[" #_level_color "m" "[" #_level "] " "\x1b[%dm" _fmt "\x1b[0m" "\n", _fmt_color, ##__VA_ARGS__); \
         } else { \
             printf("[nswrap] [" #_level "] " _fmt "\n", ##__VA_ARGS__); \
@@ -298,6 +567,411 @@ static struct {
 #define NSLOG_ERR(fmt, ...)   NSLOG(err, 31, 33, fmt, ##__VA_ARGS__)
 #define NSLOG_ERRNO(fmt, ...) NSLOG(err, 31, 33, fmt ": %s", ##__VA_ARGS__, strerror(errno))
 
+/** Get the current time in unix nanoseconds, for tracing. */
+static uint64_t trace_now(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_REALTIME, &ts);
+    return (uint64_t)(ts.tv_sec) * 1000000000 + (uint64_t)(ts.tv_nsec);
+}
+
+/** Start a startup span. */
+static void trace_begin(const char *name) {
+    if (!state.trace.done && state.trace.n < NSWRAP_TRACE_SPANS) {
+        state.trace.span[state.trace.n].name = name;
+        state.trace.span[state.trace.n].start = trace_now();
+        state.trace.span[state.trace.n].end = 0;
+        state.trace.n++;
+    }
+}
+
+/** End the last startup span with the specified name, if it's still in progress. */
+static void trace_end(const char *name) {
+    for (size_t i = state.trace.n; !state.trace.done && i--; ) {
+        if (!strcmp(state.trace.span[i].name, name)) {
+            if (!state.trace.span[i].end) {
+                state.trace.span[i].end = trace_now();
+            }
+            break;
+        }
+    }
+}
+
+/** Write a random otlp trace or span id. */
+static void trace_id(char *out, size_t bytes) {
+    uint8_t buf[16] = {0};
+    if (getrandom(buf, bytes, 0) != (ssize_t)(bytes)) {
+        uint64_t x = trace_now() ^ (uint64_t)(getpid()) << 32;
+        for (size_t i = 0; i < bytes; i++) {
+            buf[i] = (uint8_t)(x >> (i % 8 * 8)) ^ (uint8_t)(i);
+        }
+    }
+    for (size_t i = 0; i < bytes; i++) {
+        sprintf(out + i*2, "%02x", buf[i]);
+    }
+}
+
+/** Write a json string. */
+static void json_str(FILE *f, const char *s) {
+    fputc('"', f);
+    for (; *s; s++) {
+        if (*s == '"' || *s == '\\') {
+            fprintf(f, "\\%c", *s);
+        } else if ((unsigned char)(*s) < 0x20) {
+            fprintf(f, "\\u%04x", *s);
+        } else {
+            fputc(*s, f);
+        }
+    }
+    fputc('"', f);
+}
+
+/** Write a json log line like slog's json handler, with the source and channel (if not NULL) as attributes. */
+static void log_json(const char *level, const char *source, const char *channel, const char *msg) {
+    struct timespec ts;
+    struct tm tm;
+    char tstr[32];
+    clock_gettime(CLOCK_REALTIME, &ts);
+    strftime(tstr, sizeof(tstr), "%Y-%m-%dT%H:%M:%S", gmtime_r(&ts.tv_sec, &tm));
+    printf("{\"time\":\"%s.%03ldZ\",\"level\":\"%s\",\"msg\":", tstr, ts.tv_nsec / 1000000, level);
+    json_str(stdout, msg);
+    printf(",\"source\":\"%s\"", source);
+    if (channel) {
+        printf(",\"channel\":");
+        json_str(stdout, channel);
+    }
+    if (state.cfg.setproctitle_extra && *state.cfg.setproctitle_extra) {
+        printf(",\"instance\":");
+        json_str(stdout, state.cfg.setproctitle_extra);
+    }
+    printf("}\n");
+    fflush(stdout);
+}
+
+/** Write an nswrap log line as json. */
+static void nslog_json(const char *level, const char *fmt, ...) {
+    char buf[4096];
+    va_list a;
+    va_start(a, fmt);
+    vsnprintf(buf, sizeof(buf), fmt, a);
+    va_end(a);
+    if (!*buf) {
+        return; // blank lines are only for separating sections in the text output
+    }
+    log_json(!strcmp(level, "dbg") ? "DEBUG" : !strcmp(level, "wrn") ? "WARN" : !strcmp(level, "err") ? "ERROR" : "INFO", "nswrap", NULL, buf);
+}
+
+/** Known-harmless wine debug output (class:channel:message prefixes, without the thread id) from the stripped-down runtime. */
+static const char *const log_suppress_builtin[] = {
+    "fixme:advapi:RegisterEventSourceW", // eventlog is pruned
+    "fixme:advapi:ReportEventW",
+    "fixme:advapi:DeregisterEventSource",
+    "fixme:ntdll:EtwEventRegister",
+    "fixme:ntdll:EtwEventSetInformation",
+    "fixme:ntdll:EtwRegisterTraceGuidsW",
+    "fixme:ntdll:NtQuerySystemInformation info_class SYSTEM_PERFORMANCE_INFORMATION",
+    "fixme:heap:RtlSetHeapInformation",
+    "fixme:kernelbase:AppPolicyGetProcessTerminationMethod",
+    "fixme:process:SetProcessShutdownParameters",
+    "fixme:nls:GetThreadPreferredUILanguages",
+    "fixme:nls:get_dummy_preferred_ui_language",
+    "fixme:iphlpapi:NotifyAddrChange",
+    "fixme:iphlpapi:CancelMibChangeNotify2",
+    "fixme:msvcp:_Locinfo__Locinfo_ctor_cat_cstr",
+    "fixme:wbemprox:", // wmi is pruned
+    "fixme:mmdevapi:", // audio is removed
+    "err:mmdevapi:",
+    "err:winmm:",
+    "fixme:dbghelp:", // crash dumps without symbols
+    NULL,
+};
+
+/** Get the regexps for classifying lines of game output, or false if they couldn't be compiled. */
+static bool log_re(regex_t **wine, regex_t **game) {
+    static regex_t wine_re, game_re;
+    static int compiled = 0;
+    if (!compiled) {
+        compiled = regcomp(&wine_re, "^([0-9a-f]+:){0,2}(fixme|err|warn|trace):([^: ]+):", REG_EXTENDED) || regcomp(&game_re, "^\\[[0-9:.]+\\] \\[([^]]+)\\] \\[([a-z]+)\\] ", REG_EXTENDED) ? -1 : 1;
+        if (compiled == -1) {
+            NSLOG_WRN("failed to compile log classification regexps");
+        }
+    }
+    *wine = &wine_re;
+    *game = &game_re;
+    return compiled == 1;
+}
+
+/** Check whether a line of game output is known-harmless wine debug output. */
+static bool log_suppressed(const char *line) {
+    regex_t *wine_re, *game_re;
+    regmatch_t m[3];
+    if (!log_re(&wine_re, &game_re) || regexec(wine_re, line, 3, m, 0)) {
+        return false;
+    }
+    const char *s = line + m[2].rm_so;
+    if (!state.cfg.log_nosuppress) {
+        for (const char *const *p = log_suppress_builtin; *p; p++) {
+            if (starts_with(s, *p)) {
+                return true;
+            }
+        }
+    }
+    for (const char *p = state.cfg.log_suppress, *e; p && *p; p = *e ? e + 1 : e) {
+        e = strchrnul(p, ';');
+        if (e != p && !strncmp(s, p, (size_t)(e - p))) {
+            return true;
+        }
+    }
+    return false;
+}
+
+/** Classify a line of game output by source, channel, and severity, and write it as json. */
+static void log_json_line(char *line) {
+    regex_t *wine_re, *game_re;
+    regmatch_t m[4];
+    if (log_re(&wine_re, &game_re) && !regexec(wine_re, line, 4, m, 0)) {
+        // e.g., 0024:fixme:ntdll:NtQuerySystemInformation info_class ...
+        const char *cls = line + m[2].rm_so;
+        line[m[3].rm_eo] = '\0';
+        log_json(starts_with(cls, "err") ? "ERROR" : starts_with(cls, "warn") ? "WARN" : "DEBUG", "wine", line + m[3].rm_so, line + m[0].rm_eo);
+        return;
+    }
+    if (log_re(&wine_re, &game_re) && !regexec(game_re, line, 3, m, 0)) {
+        // e.g., [12:34:56] [NORTHSTAR] [info] ...
+        const char *lvl = line + m[2].rm_so;
+        line[m[1].rm_eo] = '\0';
+        log_json(starts_with(lvl, "warn") ? "WARN" : starts_with(lvl, "err") || starts_with(lvl, "crit") ? "ERROR" : starts_with(lvl, "debug") || starts_with(lvl, "trace") ? "DEBUG" : "INFO", "game", line + m[1].rm_so, line + m[0].rm_eo);
+        return;
+    }
+    log_json("INFO", "game", NULL, line);
+}
+
+/** Keep a line of game output for crash bundles, checking if it indicates a crash. */
+static void crash_line(const char *line) {
+    free(state.crash.line[state.crash.next]);
+    state.crash.line[state.crash.next] = strdup(line);
+    state.crash.next = (state.crash.next + 1) % NSWRAP_CRASH_LINES;
+    if (!state.crash.reason) {
+        static const char *const markers[] = {"Unhandled exception", "Unhandled page fault", "Backtrace:", "Northstar has crashed", NULL};
+        for (const char *const *m = markers; *m; m++) {
+            if (strstr(line, *m)) {
+                NSLOG_WRN("game crash detected");
+                state.crash.reason = strdup(line);
+                break;
+            }
+        }
+    }
+}
+
+/** Write the buffered line of game output (excluding the newline) unless it's suppressed. */
+static void io_output_line(void) {
+    state.io.b_line[state.io.n_line] = '\0';
+    if (state.cfg.crash_dir) {
+        crash_line(state.io.b_line);
+    }
+    if (log_suppressed(state.io.b_line)) {
+        state.io.n_suppressed++;
+    } else if (state.cfg.json) {
+        log_json_line(state.io.b_line);
+    } else {
+        state.io.b_line[state.io.n_line] = '\n';
+        write(STDOUT_FILENO, state.io.b_line, state.io.n_line + 1);
+        fdatasync(STDOUT_FILENO);
+    }
+    state.io.n_line = 0;
+}
+
+/** Write an incomplete output line which hasn't been finished in time, so line processing doesn't hold back things like prompts. The rest of the line is processed as a separate one. */
+static void io_output_flush(void) {
+    state.io.b_line[state.io.n_line] = '\0';
+    if (log_suppressed(state.io.b_line)) {
+        return; // it'll be suppressed once it's finished anyway
+    }
+    if (state.cfg.json) {
+        io_output_line();
+        return;
+    }
+    if (state.cfg.crash_dir) {
+        crash_line(state.io.b_line);
+    }
+    write(STDOUT_FILENO, state.io.b_line, state.io.n_line);
+    fdatasync(STDOUT_FILENO);
+    state.io.n_line = 0;
+}
+
+/** Write processed game output to stdout, either directly or by line. */
+static void io_output(const char *buf, size_t n) {
+    if (!state.cfg.log_lines) {
+        write(STDOUT_FILENO, buf, n);
+        fdatasync(STDOUT_FILENO);
+        return;
+    }
+    for (size_t i = 0; i < n; i++) {
+        if (buf[i] != '\n' && state.io.n_line < sizeof(state.io.b_line) - 1) {
+            state.io.b_line[state.io.n_line++] = buf[i];
+            continue;
+        }
+        if (buf[i] != '\n') {
+            i--; // overflow, so split the line
+        }
+        io_output_line();
+    }
+}
+
+/** Write the otlp resource for this nswrap process. */
+static void otlp_resource(FILE *f) {
+    fprintf(f, "\"resource\":{\"attributes\":[{\"key\":\"service.name\",\"value\":{\"stringValue\":\"nswrap\"}}");
+    if (state.cfg.setproctitle_extra && *state.cfg.setproctitle_extra) {
+        fprintf(f, ",{\"key\":\"service.instance.id\",\"value\":{\"stringValue\":");
+        json_str(f, state.cfg.setproctitle_extra);
+        fprintf(f, "}}");
+    }
+    fprintf(f, "]}");
+}
+
+/** Write the startup spans as an otlp json trace. */
+static void trace_json(FILE *f, bool ok) {
+    char sid[17];
+    fprintf(f, "{\"resourceSpans\":[{");
+    otlp_resource(f);
+    fprintf(f, ",\"scopeSpans\":[{\"scope\":{\"name\":\"nswrap\"},\"spans\":[");
+    fprintf(f, "{\"traceId\":\"%s\",\"spanId\":\"%s\",\"name\":\"startup\",\"kind\":1,\"startTimeUnixNano\":\"%llu\",\"endTimeUnixNano\":\"%llu\",\"status\":{\"code\":%d}}",
+        state.trace.id, state.trace.root, (unsigned long long)(state.trace.start), (unsigned long long)(trace_now()), ok ? 1 : 2);
+    for (size_t i = 0; i < state.trace.n; i++) {
+        trace_id(sid, 8);
+        fprintf(f, ",{\"traceId\":\"%s\",\"spanId\":\"%s\",\"parentSpanId\":\"%s\",\"name\":", state.trace.id, sid, state.trace.root);
+        json_str(f, state.trace.span[i].name);
+        fprintf(f, ",\"kind\":1,\"startTimeUnixNano\":\"%llu\",\"endTimeUnixNano\":\"%llu\"}",
+            (unsigned long long)(state.trace.span[i].start), (unsigned long long)(state.trace.span[i].end));
+    }
+    fprintf(f, "]}]}]}");
+}
+
+/** Append the startup spans as an otlp json trace to a file (one per line, like the otel collector's file exporter). */
+static void trace_write(const char *fn, bool ok) {
+    FILE *f = fopen(fn, "ae");
+    if (!f) {
+        NSLOG_WRNNO("failed to open trace file %s", fn);
+        return;
+    }
+    trace_json(f, ok);
+    fputc('\n', f);
+    if (fclose(f)) {
+        NSLOG_WRNNO("failed to write trace file %s", fn);
+    }
+}
+
+/** Post an otlp json export request to the otlp/http endpoint in the background using curl, returning the pid. */
+static pid_t otlp_post(const char *path, const char *body, size_t n) {
+    int fd = memfd_create("nswrap-otlp", MFD_CLOEXEC);
+    if (fd == -1) {
+        NSLOG_WRNNO("failed to export to otlp endpoint: memfd_create");
+        return -1;
+    }
+    if (write(fd, body, n) != (ssize_t)(n) || lseek(fd, 0, SEEK_SET) == -1) {
+        NSLOG_WRNNO("failed to export to otlp endpoint: write");
+        close(fd);
+        return -1;
+    }
+    char url[2048];
+    size_t len = strlen(state.cfg.otlp_endpoint);
+    snprintf(url, sizeof(url), "%s%s%s", state.cfg.otlp_endpoint, (len && state.cfg.otlp_endpoint[len-1] == '/') ? "" : "/", path);
+    pid_t pid = fork();
+    if (pid == -1) {
+        NSLOG_WRNNO("failed to export to otlp endpoint: fork");
+        close(fd);
+        return -1;
+    }
+    if (pid == 0) {
+        if (state.sig.origset_ok) {
+            sigprocmask(SIG_SETMASK, &state.sig.origset, NULL);
+        }
+        dup2(fd, STDIN_FILENO);
+        execlp("curl", "curl", "-fsS", "-m", "10", "-o", "/dev/null", "-H", "Content-Type: application/json", "--data-binary", "@-", url, NULL);
+        NSLOG_WRNNO("failed to export to otlp endpoint: failed to execute curl");
+        _exit(127);
+    }
+    close(fd);
+    return pid;
+}
+
+/** Export a supervisor event as a span in the otlp trace for this nswrap process. */
+static void otlp_event(const char *name, const char *detail) {
+    if (!state.cfg.otlp_endpoint) {
+        return;
+    }
+    char *buf = NULL, sid[17];
+    size_t n = 0;
+    FILE *f = open_memstream(&buf, &n);
+    if (!f) {
+        NSLOG_WRNNO("failed to export to otlp endpoint: open_memstream");
+        return;
+    }
+    unsigned long long now = trace_now();
+    trace_id(sid, 8);
+    fprintf(f, "{\"resourceSpans\":[{");
+    otlp_resource(f);
+    fprintf(f, ",\"scopeSpans\":[{\"scope\":{\"name\":\"nswrap\"},\"spans\":[{\"traceId\":\"%s\",\"spanId\":\"%s\",\"name\":", state.trace.id, sid);
+    json_str(f, name);
+    fprintf(f, ",\"kind\":1,\"startTimeUnixNano\":\"%llu\",\"endTimeUnixNano\":\"%llu\"", now, now);
+    if (detail) {
+        fprintf(f, ",\"attributes\":[{\"key\":\"nswrap.detail\",\"value\":{\"stringValue\":");
+        json_str(f, detail);
+        fprintf(f, "}}]");
+    }
+    fprintf(f, "}]}]}]}");
+    if (fclose(f)) {
+        NSLOG_WRNNO("failed to export to otlp endpoint: write");
+    } else {
+        otlp_post("v1/traces", buf, n);
+    }
+    free(buf);
+}
+
+/** Finish tracing startup, logging the breakdown and writing the trace if enabled. */
+static void trace_finish(bool ok) {
+    if (state.trace.done) {
+        return;
+    }
+    uint64_t now = trace_now();
+    for (size_t i = 0; i < state.trace.n; i++) {
+        if (!state.trace.span[i].end) {
+            state.trace.span[i].end = now;
+        }
+    }
+    char buf[512];
+    size_t n = 0;
+    for (size_t i = 0; i < state.trace.n && n < sizeof(buf); i++) {
+        int r = snprintf(buf + n, sizeof(buf) - n, "%s%s %.2fs", i ? ", " : "", state.trace.span[i].name, (state.trace.span[i].end - state.trace.span[i].start) / 1e9);
+        if (r > 0) {
+            n += (size_t)(r);
+        }
+    }
+    if (ok) {
+        NSLOG_INF("startup took %.2fs (%s)", (now - state.trace.start) / 1e9, buf);
+    } else {
+        NSLOG_WRN("startup did not complete after %.2fs (%s)", (now - state.trace.start) / 1e9, buf);
+    }
+    if (state.cfg.trace_file && *state.cfg.trace_file) {
+        trace_write(state.cfg.trace_file, ok);
+    }
+    if (state.cfg.otlp_endpoint) {
+        char *tmp = NULL;
+        size_t tmpn = 0;
+        FILE *f = open_memstream(&tmp, &tmpn);
+        if (f) {
+            trace_json(f, ok);
+            if (!fclose(f)) {
+                otlp_post("v1/traces", tmp, tmpn);
+            }
+            free(tmp);
+        }
+    }
+    if (ok) {
+        state.trace.ready = now;
+    }
+    state.trace.done = true;
+}
+
 static void handle_watchdog_timer_trigger(void) {
     uint64_t tmp;
     if (read(state.watchdog.tfd, &tmp, sizeof(tmp)) == -1) {
@@ -310,8 +984,10 @@ static void handle_watchdog_timer_trigger(void) {
     }
     if (state.watchdog.last.tv_sec) {
         NSLOG_ERR("did not receive a title update in time (%ds): last tick was %lds ago", NSWRAP_WATCHDOG_TIMEOUT, (long)(ts.tv_sec - state.watchdog.last.tv_sec));
+        otlp_event("watchdog.timeout", NULL);
     } else {
         NSLOG_ERR("did not receive initial title update in time (%ds)", NSWRAP_WATCHDOG_TIMEOUT_INITIAL);
+        otlp_event("watchdog.timeout", "initial");
     }
     if (state.cfg.nowatchdogquit) {
         NSLOG_WRN("not force-quitting since watchdog quit is disabled");
@@ -322,6 +998,7 @@ static void handle_watchdog_timer_trigger(void) {
 
 static void maybe_update_proctitle(void) {
     if (state.cfg.setproctitle) {
+        const char *health = state.quota.exceeded ? " (degraded: disk quota)" : "";
         if (state.io.status.parsed) {
             char buf[512];
             char *cur = buf, *end = buf + sizeof(buf);
@@ -343,15 +1020,15 @@ static void maybe_update_proctitle(void) {
             #undef putf
             #undef putft
             if (state.cfg.setproctitle_extra && *state.cfg.setproctitle_extra) {
-                setproctitle(NULL, "northstar %s [%s]", state.cfg.setproctitle_extra, buf);
+                setproctitle(NULL, "northstar %s [%s]%s", state.cfg.setproctitle_extra, buf, health);
             } else {
-                setproctitle(NULL, "northstar [%s]", buf);
+                setproctitle(NULL, "northstar [%s]%s", buf, health);
             }
         } else {
             if (state.cfg.setproctitle_extra && *state.cfg.setproctitle_extra) {
-                setproctitle(NULL, "northstar %s", state.cfg.setproctitle_extra);
+                setproctitle(NULL, "northstar %s%s", state.cfg.setproctitle_extra, health);
             } else {
-                setproctitle(NULL, "northstar");
+                setproctitle(NULL, "northstar%s", health);
             }
         }
     }
@@ -391,6 +1068,8 @@ static void handle_title_update(void) {
     }
     if (state.io.status.parsed) {
         NSLOG_DBG("parsed status update (title: %s)", state.io.status.title);
+        trace_end("ready");
+        trace_finish(true);
         poke_watchdog();
         maybe_update_proctitle();
     }
@@ -405,16 +1084,19 @@ static void handle_io_master_readable(void) {
         return;
     }
     state.io.n_inp = (size_t)(tmp); // note: not EPOLLET, so we don't need to read it all at once; it'll just be triggered again later
+    if (state.io.n_inp && !state.trace.done && state.trace.n && !strcmp(state.trace.span[state.trace.n-1].name, "load")) {
+        trace_end("load"); // first output
+        trace_begin("ready");
+    }
 
-    // fast path when no escape sequences in the buffer
-    if (state.io.state == 0) {
+    // fast path when no escape sequences or carriage returns in the buffer
+    if (state.io.state == 0 && !state.io.cr) {
         for (size_t i = 0; i < state.io.n_inp; i++) {
-            if (state.io.b_inp[i] == 0x1B) {
+            if (state.io.b_inp[i] == 0x1B || state.io.b_inp[i] == '\r') {
                 goto slow;
             }
         }
-        write(STDOUT_FILENO, state.io.b_inp, state.io.n_inp);
-        fdatasync(STDOUT_FILENO);
+        io_output(state.io.b_inp, state.io.n_inp);
         return;
     }
 
@@ -424,11 +1106,18 @@ slow:
         char c = state.io.b_inp[i];
         switch (state.io.state) {
         case 0: // normal output
+            if (state.io.cr && c != '\n') {
+                state.io.b_out[state.io.n_out++] = '\r'; // not a windows line ending
+            }
+            state.io.cr = false;
             switch (c) {
             default:
                 state.io.state = 0;
                 state.io.b_out[state.io.n_out++] = c;
                 break;
+            case '\r':
+                state.io.cr = true;
+                break;
             case 0x1B:
                 state.io.state = 1;
                 break;
@@ -654,8 +1343,7 @@ slow:
         }
     }
     if (state.io.n_out) {
-        write(STDOUT_FILENO, state.io.b_out, state.io.n_out);
-        fdatasync(STDOUT_FILENO);
+        io_output(state.io.b_out, state.io.n_out);
     }
     return;
 }
@@ -682,14 +1370,10 @@ static void handle_io_master_writable(void) {
     }
     NSLOG_DBG("wrote %zd bytes", n);
 
-    if ((size_t)(n) < state.io.n_stdin_write) {
-        state.io.n_stdin -= n;
-        state.io.n_stdin_write -= n;
-        memmove(state.io.b_stdin, &state.io.b_stdin[n], state.io.n_stdin_write);
-    } else  {
-        state.io.n_stdin = 0;
-        state.io.n_stdin_write = 0;
-    }
+    // keep the rest, including any incomplete line after the written ones
+    state.io.n_stdin -= n;
+    state.io.n_stdin_write -= n;
+    memmove(state.io.b_stdin, &state.io.b_stdin[n], state.io.n_stdin);
 }
 
 /* returns false on eof */
@@ -717,16 +1401,25 @@ static bool handle_io_stdin_readable(void) {
     if (n == 0) {
         return false; // EOF
     }
-    state.io.n_stdin += n;
     NSLOG_DBG("read %zd bytes\n", n);
 
-    // find offset of the last line terminator
-    for (ssize_t i = state.io.n_stdin-1; i >= 0; i--) {
-        if (state.io.b_stdin[i] == '\n') {
-            state.io.b_stdin[i] = '\r'; // pty terminates lines with CR
+    // convert line terminators (LF or CRLF) to CR since the pty terminates lines with CR
+    size_t o = state.io.n_stdin;
+    for (size_t i = state.io.n_stdin; i < state.io.n_stdin + (size_t)(n); i++) {
+        char c = state.io.b_stdin[i];
+        bool crlf = c == '\n' && state.io.stdin_cr;
+        state.io.stdin_cr = c == '\r';
+        if (crlf) {
+            continue;
         }
-        if (i == 0 || state.io.b_stdin[i] == '\r') {
-            state.io.n_stdin_write = i+1;
+        state.io.b_stdin[o++] = c == '\n' ? '\r' : c;
+    }
+    state.io.n_stdin = o;
+
+    // find offset of the last line terminator
+    for (size_t i = state.io.n_stdin; i > state.io.n_stdin_write; i--) {
+        if (state.io.b_stdin[i-1] == '\r') {
+            state.io.n_stdin_write = i;
             break;
         }
     }
@@ -736,10 +1429,135 @@ static bool handle_io_stdin_readable(void) {
     return true;
 }
 
+/** Run sc.exe in wine, returning the exit status (-1 on error). */
+static int service_sc(char *const *args) {
+    char *argv[16] = {"wine64", "sc"};
+    for (size_t i = 2; *args && i < sizeof(argv)/sizeof(*argv) - 1; i++) {
+        argv[i] = *args++;
+    }
+    pid_t pid = fork();
+    if (pid == -1) {
+        return -1;
+    }
+    if (pid == 0) {
+        execvpe(state.service.exe, argv, state.service.envp);
+        _exit(127);
+    }
+    int wstatus;
+    if (waitpid(pid, &wstatus, 0) == -1) {
+        return -1;
+    }
+    return WIFEXITED(wstatus) ? WEXITSTATUS(wstatus) : -1;
+}
+
+/** Append a space and an argument quoted for CommandLineToArgvW to buf, returning the length it needs like snprintf. */
+static size_t service_quote(char *buf, size_t size, const char *arg) {
+    size_t n = 0;
+    #define service_quote_c(c) do { if (n + 1 < size) buf[n] = (c); n++; } while (0)
+    service_quote_c(' ');
+    if (*arg && !strpbrk(arg, " \t\"")) {
+        for (const char *c = arg; *c; c++) {
+            service_quote_c(*c);
+        }
+    } else {
+        service_quote_c('"');
+        for (const char *c = arg; ; c++) {
+            size_t bs = 0;
+            for (; *c == '\\'; c++) {
+                bs++;
+            }
+            if (!*c || *c == '"') {
+                bs *= 2; // backslashes are only special before a quote (including the closing one)
+            }
+            for (; bs; bs--) {
+                service_quote_c('\\');
+            }
+            if (!*c) {
+                break;
+            }
+            if (*c == '"') {
+                service_quote_c('\\');
+            }
+            service_quote_c(*c);
+        }
+        service_quote_c('"');
+    }
+    #undef service_quote_c
+    if (size) {
+        buf[n < size ? n : size - 1] = '\0';
+    }
+    return n;
+}
+
+/** Start a process in the background (with the pty as stdio) which re-registers the service with binpath and starts it, or stops it if binpath is NULL, returning the pid (0 on error). */
+static pid_t service_ctl(const char *binpath) {
+    pid_t pid = fork();
+    if (pid == -1) {
+        NSLOG_ERRNO("failed to run sc.exe: fork");
+        return 0;
+    }
+    if (pid == 0) {
+        dup2(state.io.pty_slave_fd, STDIN_FILENO);
+        dup2(state.io.pty_slave_fd, STDOUT_FILENO);
+        dup2(state.io.pty_slave_fd, STDERR_FILENO);
+        close(state.io.pty_mastr_fd);
+        close(state.io.pty_slave_fd);
+        sigprocmask(SIG_SETMASK, &state.sig.origset, NULL);
+        char *name = (char*)(state.cfg.service);
+        if (binpath) {
+            service_sc((char*[]){"delete", name, NULL}); // it might not exist yet
+            if (service_sc((char*[]){"create", name, "binPath=", (char*)(binpath), "type=", "own", "start=", "demand", NULL})) {
+                _exit(1);
+            }
+            if (service_sc((char*[]){"start", name, NULL})) {
+                _exit(1);
+            }
+        } else {
+            if (service_sc((char*[]){"stop", name, NULL})) {
+                _exit(1);
+            }
+        }
+        _exit(0);
+    }
+    return pid;
+}
+
+/** Send a signal to all wine processes (including the service and services.exe) using wineserver -k. */
+static void service_kill(int sig) {
+    char arg[8];
+    snprintf(arg, sizeof(arg), "-k%d", sig);
+    pid_t pid = fork();
+    if (pid == -1) {
+        NSLOG_ERRNO("failed to run wineserver -k: fork");
+        return;
+    }
+    if (pid == 0) {
+        sigprocmask(SIG_SETMASK, &state.sig.origset, NULL);
+        execvpe(state.service.wineserver, (char*[]){"wineserver", arg, NULL}, state.service.envp);
+        _exit(127);
+    }
+    waitpid(pid, NULL, 0);
+}
+
 static void please_quit(void) {
+    if (state.cfg.service) {
+        state.quit_requested = true;
+        if (state.service.pid) {
+            NSLOG_WRN("not requesting service stop since sc.exe is still running");
+            return;
+        }
+        state.service.stopping = true;
+        state.service.pid = service_ctl(NULL);
+        NSLOG_INF("requesting service stop");
+        return;
+    }
+    // queue it after any complete lines, discarding the incomplete one (the leading CR ends the line already in the console, if any)
     const char *cmd = "\rquit\r";
-    memcpy(state.io.b_stdin, cmd, strlen(cmd));
-    state.io.n_stdin = state.io.n_stdin_write = strlen(cmd);
+    if (state.io.n_stdin_write + strlen(cmd) > sizeof(state.io.b_stdin)) {
+        state.io.n_stdin_write = 0;
+    }
+    memcpy(&state.io.b_stdin[state.io.n_stdin_write], cmd, strlen(cmd));
+    state.io.n_stdin = state.io.n_stdin_write += strlen(cmd);
     state.quit_requested = true;
     NSLOG_INF("requesting server quit");
 }
@@ -757,49 +1575,3012 @@ static void handle_sig_chld(void) {
             }
             break;
         }
-        if (rc != 0) {
-            if (rc == state.wine.pid) {
-                NSLOG_DBG("handled sigchld for wine process");
-                state.wine.exited = true;
-                state.wine.reaped = true;
-                state.wine.wstatus = wstatus;
+        if (rc == 0) {
+            break;
+        }
+        if (rc == state.wine.pid) {
+            NSLOG_DBG("handled sigchld for wine process");
+            state.wine.exited = true;
+            state.wine.reaped = true;
+            state.wine.wstatus = wstatus;
+        }
+        if (rc == state.otlp.pid) {
+            if (!WIFEXITED(wstatus) || WEXITSTATUS(wstatus)) {
+                NSLOG_DBG("otlp metrics export failed");
             }
-            NSLOG_INF("child %d exited", (int)(rc));
+            state.otlp.pid = 0;
+            continue;
         }
-        break;
-    }
-}
-
+        if (rc == state.service.pid) {
+            state.service.pid = 0;
+            if (!WIFEXITED(wstatus) || WEXITSTATUS(wstatus)) {
+                NSLOG_ERR("failed to %s service %s", state.service.stopping ? "stop" : "start", state.cfg.service);
+                otlp_event("service.error", state.service.stopping ? "stop" : "start");
+                if (!state.service.stopping) {
+                    state.force_quit = true;
+                }
+            } else {
+                NSLOG_INF("%s service %s", state.service.stopping ? "stopped" : "started", state.cfg.service);
+            }
+            continue;
+        }
+        NSLOG_INF("child %d exited", (int)(rc));
+    }
+}
+
+/** Find the socket dir of the wineserver for a prefix, returning the pid holding its lock if it's a wineserver (or 0 if it isn't running). */
+static pid_t wineserver_find(char *buf, size_t n, const char *prefix) {
+    struct stat st;
+    if (stat(prefix, &st) == -1) {
+        NSLOG_WRNNO("failed to stat wineprefix %s", prefix);
+        return 0;
+    }
+    // wine always uses /tmp (see init_server_dir in ntdll), but some builds are patched to use TMPDIR instead
+    const char *tmpdirs[] = { getenv("TMPDIR"), "/tmp" };
+    int fd = -1;
+    for (size_t i = 0; i < sizeof(tmpdirs)/sizeof(*tmpdirs) && fd == -1; i++) {
+        if (!tmpdirs[i] || !*tmpdirs[i] || (i == 0 && !strcmp(tmpdirs[i], "/tmp"))) {
+            continue;
+        }
+        // wine formats the dev and ino as unsigned longs, splitting them if they don't fit
+        char dev[40], ino[40];
+        if (st.st_dev != (unsigned long)(st.st_dev)) {
+            snprintf(dev, sizeof(dev), "%lx%08lx", (unsigned long)((unsigned long long)(st.st_dev) >> 32), (unsigned long)(st.st_dev));
+        } else {
+            snprintf(dev, sizeof(dev), "%lx", (unsigned long)(st.st_dev));
+        }
+        if (st.st_ino != (unsigned long)(st.st_ino)) {
+            snprintf(ino, sizeof(ino), "%lx%08lx", (unsigned long)((unsigned long long)(st.st_ino) >> 32), (unsigned long)(st.st_ino));
+        } else {
+            snprintf(ino, sizeof(ino), "%lx", (unsigned long)(st.st_ino));
+        }
+        if ((size_t)(snprintf(buf, n, "%s/.wine-%u/server-%s-%s", tmpdirs[i], (unsigned)(getuid()), dev, ino)) >= n) {
+            continue;
+        }
+        char tmp[PATH_MAX+8];
+        snprintf(tmp, sizeof(tmp), "%s/lock", buf);
+        fd = open(tmp, O_RDWR | O_CLOEXEC);
+    }
+    if (fd == -1) {
+        return 0;
+    }
+    struct flock fl = {
+        .l_type = F_WRLCK,
+        .l_whence = SEEK_SET,
+    };
+    pid_t pid = 0;
+    if (fcntl(fd, F_GETLK, &fl) != -1 && fl.l_type != F_UNLCK) {
+        pid = fl.l_pid; // wine uses the lock to detect running servers too
+    }
+    close(fd);
+    if (pid) {
+        // make sure we don't signal an unrelated process (e.g., if the lock is held by something else in another pid namespace)
+        char fn[64], exe[PATH_MAX];
+        snprintf(fn, sizeof(fn), "/proc/%d/exe", (int)(pid));
+        ssize_t r = readlink(fn, exe, sizeof(exe) - 1);
+        if (r == -1) {
+            NSLOG_WRNNO("failed to check wineserver lock holder %d", (int)(pid));
+            return 0;
+        }
+        exe[r] = '\0';
+        const char *base = strrchr(exe, '/') ? strrchr(exe, '/') + 1 : exe;
+        if (!starts_with(base, "wineserver")) {
+            NSLOG_WRN("wineserver lock for %s is held by %s (pid %d), not a wineserver", prefix, exe, (int)(pid));
+            return 0;
+        }
+    }
+    return pid;
+}
+
+/** Stop the wineserver we started (SIGTERM makes it flush the registry before exiting), killing it if it doesn't exit in time. */
+static void wineserver_stop(void) {
+    if (!state.server.pid) {
+        return;
+    }
+    NSLOG_INF("stopping wineserver (pid=%d)", (int)(state.server.pid));
+    if (kill(state.server.pid, SIGTERM) == -1) {
+        if (errno != ESRCH) {
+            NSLOG_WRNNO("failed to stop wineserver");
+        }
+        state.server.pid = 0;
+        return;
+    }
+    struct timespec ts, tc;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    for (;;) {
+        pid_t rc = waitpid(state.server.pid, NULL, WNOHANG);
+        if (rc == state.server.pid || (rc == -1 && errno == ECHILD && kill(state.server.pid, 0) == -1 && errno == ESRCH)) {
+            NSLOG_DBG("wineserver exited");
+            state.server.pid = 0;
+            return;
+        }
+        clock_gettime(CLOCK_MONOTONIC, &tc);
+        if (tc.tv_sec - ts.tv_sec > NSWRAP_WINESERVER_TIMEOUT) {
+            break;
+        }
+        nanosleep(&(struct timespec){
+            .tv_nsec = 100 * 1000 * 1000,
+        }, NULL);
+    }
+    NSLOG_WRN("wineserver did not exit in time, killing it");
+    otlp_event("wineserver.kill", NULL);
+    if (kill(state.server.pid, SIGKILL) == -1) {
+        NSLOG_WRNNO("failed to kill wineserver (pid=%d)", (int)(state.server.pid));
+    } else {
+        waitpid(state.server.pid, NULL, 0);
+    }
+    state.server.pid = 0;
+
+    // remove the stale socket so the next server doesn't have to
+    char tmp[PATH_MAX+8];
+    snprintf(tmp, sizeof(tmp), "%s/socket", state.server.dir);
+    unlink(tmp);
+    snprintf(tmp, sizeof(tmp), "%s/lock", state.server.dir);
+    unlink(tmp);
+    rmdir(state.server.dir);
+}
+
 static void handle_sig_shutdown(void) {
     switch (state.sig.shutdown_count++) {
     case 0:
         NSLOG_INF("received first shutdown signal, requesting game server exit");
+        otlp_event("shutdown", "request exit");
         please_quit();
+        if (state.sig.grace_tfd != -1) {
+            if (timerfd_settime(state.sig.grace_tfd, 0, &(struct itimerspec){
+                .it_value.tv_sec = state.cfg.shutdown_grace,
+            }, NULL) == -1) {
+                NSLOG_WRNNO("failed to set shutdown grace timer");
+            }
+        }
         break;
     case 1:
         NSLOG_INF("received second shutdown signal, terminating wine");
-        if (!state.wine.exited) {
+        otlp_event("shutdown", "terminate wine");
+        if (state.cfg.service) {
+            service_kill(SIGTERM);
+        } else if (!state.wine.exited) {
             if (kill(state.wine.pid, SIGTERM) == -1) {
                 NSLOG_ERRNO("failed to kill wine (pid=%d)", (int)(state.wine.pid));
             }
         }
-        break;
-    case 2:
-        NSLOG_INF("received third shutdown signal, killing wine");
-        if (!state.wine.exited) {
-            if (kill(state.wine.pid, SIGKILL) == -1) {
-                NSLOG_ERRNO("failed to kill wine (pid=%d)", (int)(state.wine.pid));
+        break;
+    case 2:
+        NSLOG_INF("received third shutdown signal, killing wine");
+        otlp_event("shutdown", "kill wine");
+        if (state.cfg.service) {
+            service_kill(SIGKILL);
+        } else if (!state.wine.exited) {
+            if (kill(state.wine.pid, SIGKILL) == -1) {
+                NSLOG_ERRNO("failed to kill wine (pid=%d)", (int)(state.wine.pid));
+            }
+        }
+        break;
+    case 3:
+        NSLOG_INF("received third shutdown signal, forcefully terminating");
+        state.force_quit = true;
+        break;
+    }
+}
+
+static void handle_grace_timer_trigger(void) {
+    uint64_t tmp;
+    if (read(state.sig.grace_tfd, &tmp, sizeof(tmp)) == -1) {
+        NSLOG_WRNNO("failed to read shutdown grace timerfd");
+        return;
+    }
+    if (state.wine.exited) {
+        return;
+    }
+    NSLOG_WRN("game server did not exit within the shutdown grace period (%us), killing wine", state.cfg.shutdown_grace);
+    otlp_event("shutdown", "grace period expired");
+    service_kill(SIGKILL);
+}
+
+/** Create a temporary copy of src with extra appended (if not NULL), writing the path to buf. */
+static bool make_nss_file(char *buf, size_t n, const char *name, const char *src, const char *extra) {
+    if (snprintf(buf, n, "%s/nswrap-%s-XXXXXX", getenv("TMPDIR") ?: "/tmp", name) >= (int)(n)) {
+        NSLOG_ERR("temp dir path is too long");
+        *buf = '\0';
+        return false;
+    }
+    int fd = mkstemp(buf);
+    if (fd == -1) {
+        NSLOG_ERRNO("failed to create temporary %s file", name);
+        *buf = '\0';
+        return false;
+    }
+    int sfd = open(src, O_RDONLY | O_CLOEXEC);
+    if (sfd != -1) {
+        char tmp[4096];
+        ssize_t r;
+        while ((r = read(sfd, tmp, sizeof(tmp))) > 0) {
+            if (write(fd, tmp, r) != r) {
+                break;
+            }
+        }
+        close(sfd);
+    }
+    if (extra && write(fd, extra, strlen(extra)) != (ssize_t)(strlen(extra))) {
+        NSLOG_ERRNO("failed to write temporary %s file", name);
+        close(fd);
+        unlink(buf);
+        *buf = '\0';
+        return false;
+    }
+    close(fd);
+    return true;
+}
+
+/** Append a line to a file. */
+static bool append_line(const char *fn, const char *line) {
+    int fd = open(fn, O_WRONLY | O_APPEND | O_CLOEXEC);
+    if (fd == -1) {
+        return false;
+    }
+    bool ok = write(fd, line, strlen(line)) == (ssize_t)(strlen(line));
+    close(fd);
+    return ok;
+}
+
+/** Ensure getpwuid and getgrgid work for the current uid/gid (which wine depends on), and choose a home dir. */
+static void setup_identity(void) {
+    uid_t uid = getuid();
+    gid_t gid = getgid();
+    struct passwd *pw = getpwuid(uid);
+    struct group *gr = getgrgid(gid);
+
+    const char *home = (pw && pw->pw_dir && *pw->pw_dir == '/') ? pw->pw_dir : getenv("HOME");
+    if (!home || *home != '/') {
+        home = "/";
+    }
+    struct stat statbuf;
+    if (stat(home, &statbuf) == -1 || !S_ISDIR(statbuf.st_mode)) {
+        NSLOG_WRN("home dir %s is not a directory, using /", home);
+        home = "/";
+    }
+    snprintf(state.ident.home, sizeof(state.ident.home), "%s", home);
+
+    if (pw && gr) {
+        NSLOG_DBG("uid %d is %s, gid %d is %s", (int)(uid), pw->pw_name, (int)(gid), gr->gr_name);
+        return;
+    }
+
+    char pwline[sizeof(state.ident.home) + 128], grline[128];
+    snprintf(pwline, sizeof(pwline), "%s:x:%d:%d:%s:%s:/sbin/nologin\n", NSWRAP_PREFIX_USER, (int)(uid), (int)(gid), NSWRAP_PREFIX_USER, state.ident.home);
+    snprintf(grline, sizeof(grline), "%s:x:%d:\n", NSWRAP_PREFIX_USER, (int)(gid));
+
+    /* writable passwd/group (the usual approach for random-uid containers) */
+    if (!pw && access("/etc/passwd", W_OK) == 0) {
+        if (append_line("/etc/passwd", pwline) && (pw = getpwuid(uid))) {
+            NSLOG_INF("added /etc/passwd entry for uid %d", (int)(uid));
+        } else {
+            NSLOG_WRNNO("failed to add /etc/passwd entry for uid %d", (int)(uid));
+        }
+    }
+    if (!gr && access("/etc/group", W_OK) == 0) {
+        if (append_line("/etc/group", grline) && (gr = getgrgid(gid))) {
+            NSLOG_INF("added /etc/group entry for gid %d", (int)(gid));
+        } else {
+            NSLOG_WRNNO("failed to add /etc/group entry for gid %d", (int)(gid));
+        }
+    }
+    if (pw && gr) {
+        return;
+    }
+
+    /* nss_wrapper */
+    if (state.cfg.nss_wrapper) {
+        if (access(state.cfg.nss_wrapper, R_OK) == -1) {
+            NSLOG_WRNNO("cannot access nss_wrapper (%s)", state.cfg.nss_wrapper);
+        } else {
+            snprintf(state.ident.nss_lib, sizeof(state.ident.nss_lib), "%s", state.cfg.nss_wrapper);
+        }
+    } else {
+        const char *paths[] = { NSWRAP_NSS_WRAPPER_PATHS };
+        for (size_t i = 0; i < sizeof(paths)/sizeof(*paths); i++) {
+            if (access(paths[i], R_OK) == 0) {
+                snprintf(state.ident.nss_lib, sizeof(state.ident.nss_lib), "%s", paths[i]);
+                break;
+            }
+        }
+    }
+    if (!*state.ident.nss_lib) {
+        NSLOG_WRN("uid %d or gid %d has no passwd/group entry, and nss_wrapper is not available; wine may not work correctly", (int)(uid), (int)(gid));
+        return;
+    }
+    if (!make_nss_file(state.ident.nss_passwd, sizeof(state.ident.nss_passwd), "passwd", "/etc/passwd", pw ? NULL : pwline) ||
+        !make_nss_file(state.ident.nss_group, sizeof(state.ident.nss_group), "group", "/etc/group", gr ? NULL : grline)) {
+        NSLOG_WRN("failed to set up nss_wrapper; wine may not work correctly");
+        *state.ident.nss_lib = '\0';
+        return;
+    }
+    NSLOG_INF("using nss_wrapper (%s) for uid %d gid %d", state.ident.nss_lib, (int)(uid), (int)(gid));
+}
+
+/** A key block in a wine registry hive. */
+struct reg_block {
+    const char *key; size_t key_len; // key name without brackets
+    const char *body; size_t body_len; // lines after the key line, without the #time line or the trailing newlines
+    const char *raw; size_t raw_len; // the entire block, without the trailing newlines
+    bool deleted; // [-key] (deltas only)
+};
+
+/** A parsed wine registry hive. */
+struct reg_hive {
+    char *buf;
+    size_t len, hdr_len;
+    struct reg_block *blocks;
+    struct reg_block **sorted;
+    size_t n;
+};
+
+static int reg_block_cmp(const void *a, const void *b) {
+    const struct reg_block *x = *(struct reg_block *const *)(a), *y = *(struct reg_block *const *)(b);
+    int r = memcmp(x->key, y->key, x->key_len < y->key_len ? x->key_len : y->key_len);
+    return r ? r : (x->key_len > y->key_len) - (x->key_len < y->key_len);
+}
+
+static void reg_free(struct reg_hive *h) {
+    free(h->buf);
+    free(h->blocks);
+    free(h->sorted);
+    memset(h, 0, sizeof(*h));
+}
+
+/** Read and parse a wine registry hive (or delta), returning false and setting errno on error. */
+static bool reg_read(struct reg_hive *h, const char *fn) {
+    memset(h, 0, sizeof(*h));
+
+    int fd = open(fn, O_RDONLY | O_CLOEXEC);
+    if (fd == -1) {
+        return false;
+    }
+    size_t cap = 0;
+    for (;;) {
+        if (h->len == cap) {
+            char *tmp = realloc(h->buf, (cap = cap ? cap*2 : 65536));
+            if (!tmp) {
+                close(fd);
+                reg_free(h);
+                return false;
+            }
+            h->buf = tmp;
+        }
+        ssize_t r = read(fd, h->buf + h->len, cap - h->len);
+        if (r == -1) {
+            if (errno == EINTR) {
+                continue;
+            }
+            int n = errno;
+            close(fd);
+            reg_free(h);
+            errno = n;
+            return false;
+        }
+        if (!r) {
+            break;
+        }
+        h->len += r;
+    }
+    close(fd);
+
+    // a line starting with [ is always a key since wine escapes newlines in values
+    size_t bcap = 0;
+    struct reg_block *b = NULL;
+    for (const char *p = h->buf, *end = h->buf + h->len; p < end; ) {
+        const char *eol = memchr(p, '\n', end - p) ?: end;
+        const char *next = eol < end ? eol + 1 : end;
+        if (*p == '[') {
+            const char *rb = p;
+            for (const char *x = p; x < eol; x++) {
+                if (*x == ']') {
+                    rb = x;
+                }
+            }
+            if (rb == p) {
+                errno = EINVAL;
+                reg_free(h);
+                return false;
+            }
+            if (h->n == bcap) {
+                struct reg_block *tmp = realloc(h->blocks, (bcap = bcap ? bcap*2 : 1024) * sizeof(*tmp));
+                if (!tmp) {
+                    reg_free(h);
+                    return false;
+                }
+                h->blocks = tmp;
+            }
+            if (!h->n) {
+                h->hdr_len = p - h->buf;
+            }
+            b = &h->blocks[h->n++];
+            b->deleted = p[1] == '-';
+            b->key = p + 1 + b->deleted;
+            b->key_len = rb - b->key;
+            b->raw = p;
+            b->body = next;
+            if (end - next > 6 && !memcmp(next, "#time=", 6)) {
+                b->body = memchr(next, '\n', end - next) ?: end;
+                if (b->body < end) {
+                    b->body++;
+                }
+            }
+        }
+        if (b && eol > p) {
+            b->raw_len = eol - b->raw; // excluding trailing blank lines
+            b->body_len = eol > b->body ? eol - b->body : 0;
+        }
+        p = next;
+    }
+    if (!h->n) {
+        h->hdr_len = h->len;
+    }
+
+    if (!(h->sorted = malloc((h->n ?: 1) * sizeof(*h->sorted)))) {
+        reg_free(h);
+        return false;
+    }
+    for (size_t i = 0; i < h->n; i++) {
+        h->sorted[i] = &h->blocks[i];
+    }
+    qsort(h->sorted, h->n, sizeof(*h->sorted), reg_block_cmp);
+    return true;
+}
+
+/** Find a key in a parsed hive. */
+static struct reg_block *reg_find(struct reg_hive *h, struct reg_block *k) {
+    struct reg_block **r = bsearch(&k, h->sorted, h->n, sizeof(*h->sorted), reg_block_cmp);
+    return r ? *r : NULL;
+}
+
+/** Write a block followed by a blank line. */
+static void reg_write_block(FILE *f, const char *raw, size_t len) {
+    fwrite(raw, 1, len, f);
+    fputs("\n\n", f);
+}
+
+/** Write to fn atomically using fn. */
+static bool reg_write(const char *fn, bool (*fn_write)(FILE *, struct reg_hive *, struct reg_hive *), struct reg_hive *a, struct reg_hive *b) {
+    char tmp[PATH_MAX];
+    if (snprintf(tmp, sizeof(tmp), "%s.tmp", fn) >= (int)(sizeof(tmp))) {
+        errno = ENAMETOOLONG;
+        return false;
+    }
+    FILE *f = fopen(tmp, "we");
+    if (!f) {
+        return false;
+    }
+    fn_write(f, a, b);
+    if (ferror(f) | fclose(f) || rename(tmp, fn)) {
+        int n = errno;
+        unlink(tmp);
+        errno = n;
+        return false;
+    }
+    return true;
+}
+
+/** Write base with delta applied. */
+static bool reg_write_merged(FILE *f, struct reg_hive *base, struct reg_hive *delta) {
+    fwrite(base->buf, 1, base->hdr_len, f);
+    for (size_t i = 0; i < base->n; i++) {
+        struct reg_block *b = &base->blocks[i], *d = reg_find(delta, b);
+        if (!d) {
+            reg_write_block(f, b->raw, b->raw_len);
+        } else if (!d->deleted) {
+            reg_write_block(f, d->raw, d->raw_len);
+        }
+    }
+    for (size_t i = 0; i < delta->n; i++) {
+        struct reg_block *d = &delta->blocks[i];
+        if (!d->deleted && !reg_find(base, d)) {
+            reg_write_block(f, d->raw, d->raw_len);
+        }
+    }
+    return true;
+}
+
+/** Write the keys which differ between base and cur. */
+static bool reg_write_delta(FILE *f, struct reg_hive *base, struct reg_hive *cur) {
+    fputs("WINE REGISTRY Version 2\n;; nswrap registry delta\n\n", f);
+    for (size_t i = 0; i < cur->n; i++) {
+        struct reg_block *c = &cur->blocks[i], *b = reg_find(base, c);
+        if (!b || b->body_len != c->body_len || memcmp(b->body, c->body, c->body_len)) {
+            reg_write_block(f, c->raw, c->raw_len);
+        }
+    }
+    for (size_t i = 0; i < base->n; i++) {
+        struct reg_block *b = &base->blocks[i];
+        if (!reg_find(cur, b)) {
+            fprintf(f, "[-%.*s]\n\n", (int)(b->key_len), b->key);
+        }
+    }
+    return true;
+}
+
+/** Check if path is dir or something in it. */
+static bool path_in(const char *path, const char *dir) {
+    size_t n = strlen(dir);
+    return !strncmp(path, dir, n) && (path[n] == '/' || path[n] == '\0');
+}
+
+/** Dirs in the template prefix which wine writes files in, so they're always copied into instance prefixes rather than symlinked (which would let wine modify the shared template). */
+static const char *instance_private[] = { "/drive_c/users", "/drive_c/windows/temp" };
+
+/** The registry hives stored as deltas for instances. */
+static const char *instance_hives[] = { "system.reg", "user.reg", "userdef.reg" };
+
+/** Get the path of the template hive an instance hive is based on, which is the minimal user hive template written by nswine -user-template for user.reg if the runtime has one. */
+static void instance_base(char *buf, size_t n, const char *hive) {
+    if (!strcmp(hive, "user.reg")) {
+        snprintf(buf, n, "%s/user.template.reg", state.inst.template);
+        if (access(buf, F_OK) == 0) {
+            return;
+        }
+    }
+    snprintf(buf, n, "%s/%s", state.inst.template, hive);
+}
+
+/** Save the registry deltas for the hives in a subdir of the instance dir (the prefix, or the upper dir of an unmounted overlay), then remove the hives from it. */
+static bool instance_save(const char *dir) {
+    bool ok = true;
+    for (size_t i = 0; i < sizeof(instance_hives)/sizeof(*instance_hives); i++) {
+        char bfn[PATH_MAX], cfn[PATH_MAX], dfn[PATH_MAX];
+        instance_base(bfn, sizeof(bfn), instance_hives[i]);
+        snprintf(cfn, sizeof(cfn), "%s/%s/%s", state.cfg.instance, dir, instance_hives[i]);
+        snprintf(dfn, sizeof(dfn), "%s/registry/%s.delta", state.cfg.instance, instance_hives[i]);
+
+        struct reg_hive base, cur;
+        struct stat statbuf;
+        if (lstat(cfn, &statbuf) == 0 && !S_ISREG(statbuf.st_mode)) {
+            continue; // overlay whiteout
+        }
+        if (!reg_read(&cur, cfn)) {
+            if (errno != ENOENT) {
+                NSLOG_WRNNO("failed to read instance registry hive %s", cfn);
+                ok = false;
+            }
+            continue;
+        }
+        if (!reg_read(&base, bfn)) {
+            NSLOG_WRNNO("failed to read base registry hive %s", bfn);
+            reg_free(&cur);
+            ok = false;
+            continue;
+        }
+        if (!reg_write(dfn, reg_write_delta, &base, &cur)) {
+            NSLOG_WRNNO("failed to write instance registry delta %s", dfn);
+            ok = false;
+        } else if (unlink(cfn)) {
+            NSLOG_WRNNO("failed to remove instance registry hive %s", cfn);
+        } else {
+            NSLOG_DBG("saved instance registry delta %s", dfn);
+        }
+        reg_free(&base);
+        reg_free(&cur);
+    }
+    return ok;
+}
+
+static int instance_rm_fn(const char *fpath, const struct stat *sb, int typeflag, struct FTW *ftwbuf) {
+    (void)(sb);
+    (void)(ftwbuf);
+    if ((typeflag == FTW_DP ? rmdir(fpath) : unlink(fpath)) == -1) {
+        NSLOG_ERRNO("failed to remove %s", fpath);
+        return 1;
+    }
+    return 0;
+}
+
+static int instance_copy_fn(const char *fpath, const struct stat *sb, int typeflag, struct FTW *ftwbuf) {
+    (void)(sb);
+    const char *rel = fpath + strlen(state.inst.template);
+    char dst[PATH_MAX];
+    if (snprintf(dst, sizeof(dst), "%s/prefix%s", state.cfg.instance, rel) >= (int)(sizeof(dst))) {
+        NSLOG_ERR("instance path for %s is too long", fpath);
+        return 1;
+    }
+    switch (typeflag) {
+    case FTW_D:
+        if (mkdir(dst, 0755) == -1) {
+            NSLOG_ERRNO("failed to create %s", dst);
+            return 1;
+        }
+        return 0;
+    case FTW_SL: {
+        char tgt[PATH_MAX];
+        ssize_t n = readlink(fpath, tgt, sizeof(tgt) - 1);
+        if (n == -1) {
+            NSLOG_ERRNO("failed to read link %s", fpath);
+            return 1;
+        }
+        tgt[n] = '\0';
+        if (symlink(tgt, dst) == -1) {
+            NSLOG_ERRNO("failed to create link %s", dst);
+            return 1;
+        }
+        return 0;
+    }
+    case FTW_F:
+        if (ftwbuf->level == 1) {
+            for (size_t i = 0; i < sizeof(instance_hives)/sizeof(*instance_hives); i++) {
+                if (!strcmp(fpath + ftwbuf->base, instance_hives[i])) {
+                    return 0; // merged later
+                }
+            }
+        }
+        if (state.cfg.reflink || state.cfg.cow) {
+            static bool unsupported;
+            if (!unsupported) {
+                int sfd = open(fpath, O_RDONLY | O_CLOEXEC);
+                if (sfd == -1) {
+                    NSLOG_ERRNO("failed to open %s", fpath);
+                    return 1;
+                }
+                int dfd = open(dst, O_WRONLY | O_CREAT | O_EXCL | O_CLOEXEC, sb->st_mode & 0777);
+                if (dfd == -1) {
+                    NSLOG_ERRNO("failed to create %s", dst);
+                    close(sfd);
+                    return 1;
+                }
+                int rc = ioctl(dfd, FICLONE, sfd);
+                int err = errno;
+                close(dfd);
+                close(sfd);
+                if (rc == 0) {
+                    return 0;
+                }
+                unlink(dst);
+                if (err != EOPNOTSUPP && err != EXDEV && err != EINVAL && err != ENOTTY) {
+                    errno = err;
+                    NSLOG_ERRNO("failed to reflink %s", dst);
+                    return 1;
+                }
+                NSLOG_WRN("filesystem does not support reflinks from the template prefix, using %s instead", state.cfg.cow ? "copies" : "symlinks");
+                unsupported = true;
+            }
+        }
+        bool private = false;
+        for (size_t i = 0; i < sizeof(instance_private)/sizeof(*instance_private); i++) {
+            if (path_in(rel, instance_private[i])) {
+                private = true;
+                break;
+            }
+        }
+        if (state.cfg.cow || private) {
+            void *p = realloc(state.inst.copy, (state.inst.n_copy + 1) * sizeof(*state.inst.copy));
+            if (!p) {
+                NSLOG_ERRNO("failed to allocate copy list");
+                return 1;
+            }
+            state.inst.copy = p;
+            state.inst.copy[state.inst.n_copy].path = strdup(fpath);
+            state.inst.copy[state.inst.n_copy].mode = sb->st_mode & 0777;
+            state.inst.n_copy++;
+            return 0; // copied in parallel later
+        }
+        // everything else is only read by wine, so files can be shared
+        if (symlink(fpath, dst) == -1) {
+            NSLOG_ERRNO("failed to create link %s", dst);
+            return 1;
+        }
+        return 0;
+    default:
+        NSLOG_ERR("cannot access %s", fpath);
+        return 1;
+    }
+}
+
+/** Copy a file, using copy_file_range if possible (which may also reflink it). */
+static bool copy_file(const char *src, const char *dst, mode_t mode) {
+    int sfd = open(src, O_RDONLY | O_CLOEXEC);
+    if (sfd == -1) {
+        return false;
+    }
+    int dfd = open(dst, O_WRONLY | O_CREAT | O_EXCL | O_CLOEXEC, mode);
+    if (dfd == -1) {
+        close(sfd);
+        return false;
+    }
+    ssize_t n;
+    bool any = false;
+    while ((n = copy_file_range(sfd, NULL, dfd, NULL, 1 << 30, 0)) > 0) {
+        any = true;
+    }
+    if (n == -1 && !any && (errno == EXDEV || errno == EINVAL || errno == ENOSYS || errno == EOPNOTSUPP)) {
+        char buf[65536];
+        while ((n = read(sfd, buf, sizeof(buf))) > 0) {
+            if (write(dfd, buf, (size_t)(n)) != n) {
+                n = -1;
+                break;
+            }
+        }
+    }
+    int err = errno;
+    close(sfd);
+    close(dfd);
+    errno = err;
+    return n == 0;
+}
+
+/** Copy the files queued by instance_copy_fn into the instance prefix, split between multiple processes. */
+static bool instance_copy_files(void) {
+    size_t jobs = (size_t)(nprocs());
+    if (jobs > NSWRAP_INSTANCE_COPY_JOBS) {
+        jobs = NSWRAP_INSTANCE_COPY_JOBS;
+    }
+    if (jobs > state.inst.n_copy) {
+        jobs = state.inst.n_copy;
+    }
+    bool ok = true;
+    pid_t pids[NSWRAP_INSTANCE_COPY_JOBS];
+    size_t running = 0;
+    for (size_t j = 0; j < jobs; j++) {
+        pid_t pid = fork();
+        if (pid == -1) {
+            NSLOG_ERRNO("failed to fork");
+            ok = false;
+            break;
+        }
+        if (pid == 0) {
+            for (size_t i = j; i < state.inst.n_copy; i += jobs) {
+                char dst[PATH_MAX];
+                snprintf(dst, sizeof(dst), "%s/prefix%s", state.cfg.instance, state.inst.copy[i].path + strlen(state.inst.template));
+                if (!copy_file(state.inst.copy[i].path, dst, state.inst.copy[i].mode)) {
+                    NSLOG_ERRNO("failed to copy %s", dst);
+                    _exit(1);
+                }
+            }
+            _exit(0);
+        }
+        pids[running++] = pid;
+    }
+    for (size_t j = 0; j < running; j++) {
+        int wstatus;
+        if (waitpid(pids[j], &wstatus, 0) == -1) {
+            NSLOG_ERRNO("failed to wait for child %d", (int)(pids[j]));
+            ok = false;
+        } else if (!WIFEXITED(wstatus) || WEXITSTATUS(wstatus)) {
+            ok = false;
+        }
+    }
+    if (ok) {
+        NSLOG_DBG("copied %zu files from the template prefix using %zu processes", state.inst.n_copy, jobs);
+    }
+    for (size_t i = 0; i < state.inst.n_copy; i++) {
+        free(state.inst.copy[i].path);
+    }
+    free(state.inst.copy);
+    state.inst.copy = NULL;
+    state.inst.n_copy = 0;
+    return ok;
+}
+
+/** Mount the instance prefix as an overlay of the template prefix in a private mount namespace (so it goes away with nswrap and wine), returning false with errno set if overlayfs can't be used (e.g., without CAP_SYS_ADMIN, or if the instance dir is on an overlayfs). */
+static bool instance_overlay(void) {
+    char upper[PATH_MAX], work[PATH_MAX], prefix[PATH_MAX], opts[PATH_MAX*3];
+    if (strpbrk(state.inst.template, ",:\\") || strpbrk(state.cfg.instance, ",:\\")) {
+        errno = EINVAL; // can't be escaped in the mount options
+        return false;
+    }
+    snprintf(upper, sizeof(upper), "%s/upper", state.cfg.instance);
+    snprintf(work, sizeof(work), "%s/work", state.cfg.instance);
+    snprintf(prefix, sizeof(prefix), "%s/prefix", state.cfg.instance);
+    snprintf(opts, sizeof(opts), "lowerdir=%s,upperdir=%s,workdir=%s", state.inst.template, upper, work);
+    if (mkdir(upper, 0755) == -1 || mkdir(work, 0755) == -1 || mkdir(prefix, 0755) == -1) {
+        return false;
+    }
+    if (unshare(CLONE_NEWNS) == -1 || mount(NULL, "/", NULL, MS_REC | MS_PRIVATE, NULL) == -1 || mount("overlay", prefix, "overlay", 0, opts) == -1) {
+        int err = errno;
+        rmdir(prefix);
+        rmdir(work);
+        rmdir(upper);
+        errno = err;
+        return false;
+    }
+    state.inst.overlay = true;
+    return true;
+}
+
+/** Total size of the files visited by du_fn. */
+static uint64_t du_bytes;
+
+static int du_fn(const char *fpath, const struct stat *sb, int typeflag, struct FTW *ftwbuf) {
+    (void)(fpath);
+    (void)(ftwbuf);
+    if (typeflag != FTW_SL) {
+        du_bytes += (uint64_t)(sb->st_blocks) * 512; // symlinks point to the shared template
+    }
+    return 0;
+}
+
+/** Get the disk usage of a dir, not following symlinks. */
+static uint64_t du(const char *dir) {
+    du_bytes = 0;
+    nftw(dir, du_fn, 16, FTW_PHYS | FTW_MOUNT); // not overlay mounts
+    return du_bytes;
+}
+
+/** Parse a size with an optional K/M/G suffix, returning 0 if invalid. */
+static uint64_t parse_size(const char *s) {
+    char *end;
+    errno = 0;
+    unsigned long long n = strtoull(s, &end, 10);
+    if (errno || end == s) {
+        return 0;
+    }
+    switch (*end) {
+    case 'G': case 'g': n *= 1024; // fallthrough
+    case 'M': case 'm': n *= 1024; // fallthrough
+    case 'K': case 'k': n *= 1024; end++; break;
+    }
+    return *end ? 0 : n;
+}
+
+/** Set the project id for the instance dir so admin-configured project quotas apply to it. */
+static void instance_set_projid(void) {
+    int fd = open(state.cfg.instance, O_RDONLY | O_DIRECTORY | O_CLOEXEC);
+    if (fd == -1) {
+        NSLOG_WRNNO("failed to open instance dir for setting project id");
+        return;
+    }
+    struct fsxattr fsx;
+    if (ioctl(fd, FS_IOC_FSGETXATTR, &fsx) == -1) {
+        NSLOG_WRNNO("project quotas not supported for instance dir");
+    } else {
+        fsx.fsx_projid = state.cfg.quota_projid;
+        fsx.fsx_xflags |= FS_XFLAG_PROJINHERIT;
+        if (ioctl(fd, FS_IOC_FSSETXATTR, &fsx) == -1) {
+            NSLOG_WRNNO("failed to set project id %u for instance dir", state.cfg.quota_projid);
+        } else {
+            NSLOG_DBG("set project id %u for instance dir", state.cfg.quota_projid);
+        }
+    }
+    close(fd);
+}
+
+static void handle_quota_timer_trigger(void) {
+    uint64_t tmp;
+    if (read(state.quota.tfd, &tmp, sizeof(tmp)) == -1) {
+        NSLOG_WRNNO("failed to read quota timerfd");
+        return;
+    }
+    uint64_t n = du(state.cfg.instance);
+    NSLOG_DBG("instance disk usage is %.1f MiB", n / 1048576.0);
+    state.quota.usage = n;
+    if (n > state.cfg.quota) {
+        if (!state.quota.exceeded) {
+            NSLOG_WRN("instance disk usage (%.1f MiB) exceeds quota (%.1f MiB)", n / 1048576.0, state.cfg.quota / 1048576.0);
+            state.quota.exceeded = true;
+            clock_gettime(CLOCK_MONOTONIC, &state.quota.since);
+            maybe_update_proctitle();
+            otlp_event("quota.exceeded", NULL);
+        } else if (!state.sig.shutdown_count) {
+            struct timespec ts;
+            clock_gettime(CLOCK_MONOTONIC, &ts);
+            if (ts.tv_sec - state.quota.since.tv_sec >= NSWRAP_QUOTA_GRACE) {
+                NSLOG_ERR("instance disk usage (%.1f MiB) has exceeded quota (%.1f MiB) for over %ds, stopping game server", n / 1048576.0, state.cfg.quota / 1048576.0, NSWRAP_QUOTA_GRACE);
+                otlp_event("quota.exceeded", "stop");
+                handle_sig_shutdown();
+            }
+        }
+    } else if (state.quota.exceeded) {
+        NSLOG_INF("instance disk usage (%.1f MiB) is within quota again", n / 1048576.0);
+        state.quota.exceeded = false;
+        maybe_update_proctitle();
+        otlp_event("quota.ok", NULL);
+    }
+}
+
+/** Write a gauge or counter (a cumulative value) metric, with optional label key/value pairs (NULL-terminated). */
+typedef void (*metric_fn)(FILE *f, bool *first, const char *name, const char *unit, const char *const *labels, double value, bool integer, bool counter);
+
+/** Write an otlp json gauge or monotonic sum metric. */
+static void otlp_metric(FILE *f, bool *first, const char *name, const char *unit, const char *const *labels, double value, bool integer, bool counter) {
+    fprintf(f, "%s{\"name\":\"%s\",\"unit\":\"%s\",\"%s\":{\"dataPoints\":[{", *first ? "" : ",", name, unit, counter ? "sum" : "gauge");
+    if (counter) {
+        fprintf(f, "\"startTimeUnixNano\":\"%llu\",", (unsigned long long)(state.supervisor_start ?: state.trace.start)); // the only counters are from the supervisor
+    }
+    fprintf(f, "\"timeUnixNano\":\"%llu\"", (unsigned long long)(trace_now()));
+    if (integer) {
+        fprintf(f, ",\"asInt\":\"%lld\"", (long long)(value));
+    } else {
+        fprintf(f, ",\"asDouble\":%f", value);
+    }
+    if (labels && *labels) {
+        fprintf(f, ",\"attributes\":[");
+        for (const char *const *l = labels; *l; l += 2) {
+            fprintf(f, "%s{\"key\":\"%s\",\"value\":{\"stringValue\":", l == labels ? "" : ",", l[0]);
+            json_str(f, l[1]);
+            fprintf(f, "}}");
+        }
+        fprintf(f, "]");
+    }
+    fprintf(f, "}]%s}}", counter ? ",\"aggregationTemporality\":2,\"isMonotonic\":true" : "");
+    *first = false;
+}
+
+/** Write a prometheus text format gauge or counter metric. */
+static void prom_metric(FILE *f, bool *first, const char *name, const char *unit, const char *const *labels, double value, bool integer, bool counter) {
+    (void)(first);
+    (void)(unit); // already in the name
+    fprintf(f, "# TYPE %s %s\n%s", name, counter ? "counter" : "gauge", name);
+    if (labels && *labels) {
+        fputc('{', f);
+        for (const char *const *l = labels; *l; l += 2) {
+            fprintf(f, "%s%s=\"", l == labels ? "" : ",", l[0]);
+            for (const char *c = l[1]; *c; c++) {
+                if (*c == '"' || *c == '\\') {
+                    fputc('\\', f);
+                }
+                if (*c == '\n') {
+                    fputs("\\n", f);
+                } else {
+                    fputc(*c, f);
+                }
+            }
+            fputc('"', f);
+        }
+        fputc('}', f);
+    }
+    if (integer) {
+        fprintf(f, " %lld\n", (long long)(value));
+    } else {
+        fprintf(f, " %f\n", value);
+    }
+}
+
+/** Sum the cpu time and rss of the wine processes (i.e., the wineserver and everything in the session wine was started in), returning the number of processes. */
+static int wine_proc_stats(double *cpu, uint64_t *rss) {
+    DIR *d = opendir("/proc");
+    if (!d) {
+        return -1;
+    }
+    int n = 0;
+    long tck = sysconf(_SC_CLK_TCK), pgsz = sysconf(_SC_PAGESIZE);
+    *cpu = 0;
+    *rss = 0;
+    for (struct dirent *e; (e = readdir(d)); ) {
+        if (*e->d_name < '0' || *e->d_name > '9') {
+            continue;
+        }
+        char fn[300], buf[1024];
+        snprintf(fn, sizeof(fn), "/proc/%s/stat", e->d_name);
+        int fd = open(fn, O_RDONLY | O_CLOEXEC);
+        if (fd == -1) {
+            continue;
+        }
+        ssize_t r = read(fd, buf, sizeof(buf) - 1);
+        close(fd);
+        if (r <= 0) {
+            continue;
+        }
+        buf[r] = '\0';
+        const char *x = strrchr(buf, ')'); // comm may contain spaces
+        int sid;
+        unsigned long utime, stime;
+        long pages;
+        if (!x || sscanf(x + 1, " %*c %*s %*s %d %*s %*s %*s %*s %*s %*s %*s %lu %lu %*s %*s %*s %*s %*s %*s %*s %*s %ld", &sid, &utime, &stime, &pages) != 4) {
+            continue;
+        }
+        if (sid != state.wine.pid && atoi(e->d_name) != state.server.pid) {
+            continue;
+        }
+        *cpu += (double)(utime + stime) / tck;
+        *rss += (uint64_t)(pages) * pgsz;
+        n++;
+    }
+    closedir(d);
+    return n;
+}
+
+/** Write the current metrics. */
+static void metrics_write(FILE *f, metric_fn metric) {
+    bool first = true;
+    metric(f, &first, "nswrap_wine_running", "1", NULL, state.wine.pid && !state.wine.exited, true, false);
+    metric(f, &first, "nswrap_status_parsed", "1", NULL, state.io.status.parsed, true, false);
+    if (state.io.status.parsed) {
+        const char *const labels[] = {"map", state.io.status.map_name, "playlist", state.io.status.playlist_name, NULL};
+        metric(f, &first, "northstar_players", "1", labels, state.io.status.player_count, true, false);
+        metric(f, &first, "northstar_max_players", "1", labels, state.io.status.max_players, true, false);
+    }
+    if (state.watchdog.last.tv_sec) {
+        struct timespec ts;
+        if (clock_gettime(CLOCK_MONOTONIC, &ts) != -1) {
+            metric(f, &first, "nswrap_title_update_age_seconds", "s", NULL, (ts.tv_sec - state.watchdog.last.tv_sec) + (ts.tv_nsec - state.watchdog.last.tv_nsec) / 1e9, false, false);
+        }
+    }
+    if (state.trace.ready) {
+        metric(f, &first, "nswrap_startup_seconds", "s", NULL, (state.trace.ready - state.trace.start) / 1e9, false, false);
+    }
+    metric(f, &first, "nswrap_uptime_seconds", "s", NULL, (trace_now() - state.trace.start) / 1e9, false, false);
+    if (state.supervisor_start) {
+        metric(f, &first, "nswrap_restarts_total", "1", NULL, state.supervisor_restarts, true, true);
+    }
+    if (state.wine.pid && !state.wine.exited) {
+        double cpu;
+        uint64_t rss;
+        int n = wine_proc_stats(&cpu, &rss);
+        if (n != -1) {
+            metric(f, &first, "nswrap_wine_processes", "1", NULL, n, true, false);
+            metric(f, &first, "nswrap_wine_cpu_seconds", "s", NULL, cpu, false, false); // not a counter, since it drops when processes exit
+            metric(f, &first, "nswrap_wine_rss_bytes", "By", NULL, (double)(rss), true, false);
+        }
+    }
+    if (state.server.pid) {
+        char fn[64];
+        snprintf(fn, sizeof(fn), "/proc/%d/fd", (int)(state.server.pid));
+        DIR *d = opendir(fn);
+        if (d) {
+            int n = 0;
+            for (struct dirent *e; (e = readdir(d)); ) {
+                if (*e->d_name != '.') {
+                    n++;
+                }
+            }
+            closedir(d);
+            metric(f, &first, "nswrap_wineserver_fds", "1", NULL, n, true, false);
+        }
+    }
+    if (state.cfg.quota) {
+        metric(f, &first, "nswrap_instance_disk_usage_bytes", "By", NULL, (double)(state.quota.usage), true, false);
+        metric(f, &first, "nswrap_instance_quota_bytes", "By", NULL, (double)(state.cfg.quota), true, false);
+        metric(f, &first, "nswrap_instance_quota_exceeded", "1", NULL, state.quota.exceeded, true, false);
+    }
+    metric(f, &first, "nswrap_shutdown_signals", "1", NULL, state.sig.shutdown_count, true, false);
+    metric(f, &first, "nswrap_suppressed_lines", "1", NULL, (double)(state.io.n_suppressed), true, false);
+}
+
+static void handle_otlp_timer_trigger(void) {
+    uint64_t tmp;
+    if (read(state.otlp.tfd, &tmp, sizeof(tmp)) == -1) {
+        NSLOG_WRNNO("failed to read otlp timerfd");
+        return;
+    }
+    if (state.otlp.pid) {
+        NSLOG_DBG("previous otlp metrics export is still in progress, skipping");
+        return;
+    }
+    char *buf = NULL;
+    size_t n = 0;
+    FILE *f = open_memstream(&buf, &n);
+    if (!f) {
+        NSLOG_WRNNO("failed to export to otlp endpoint: open_memstream");
+        return;
+    }
+    fprintf(f, "{\"resourceMetrics\":[{");
+    otlp_resource(f);
+    fprintf(f, ",\"scopeMetrics\":[{\"scope\":{\"name\":\"nswrap\"},\"metrics\":[");
+    metrics_write(f, otlp_metric);
+    fprintf(f, "]}]}]}");
+    if (fclose(f)) {
+        NSLOG_WRNNO("failed to export to otlp endpoint: write");
+    } else {
+        pid_t pid = otlp_post("v1/metrics", buf, n);
+        if (pid != -1) {
+            state.otlp.pid = pid;
+        }
+    }
+    free(buf);
+}
+
+/** Check whether a udp port is bound on any address. */
+static bool udp_port_bound(unsigned port) {
+    static const char *const fns[] = {"/proc/net/udp", "/proc/net/udp6", NULL};
+    bool bound = false;
+    for (const char *const *fn = fns; *fn && !bound; fn++) {
+        FILE *f = fopen(*fn, "re");
+        if (!f) {
+            continue;
+        }
+        char line[512];
+        unsigned x;
+        while (!bound && fgets(line, sizeof(line), f)) {
+            if (sscanf(line, " %*u: %*[0-9A-Fa-f]:%x", &x) == 1 && x == port) {
+                bound = true;
+            }
+        }
+        fclose(f);
+    }
+    return bound;
+}
+
+static void handle_health_accept(void) {
+    int fd = accept4(state.health.fd, NULL, NULL, SOCK_CLOEXEC);
+    if (fd == -1) {
+        if (errno != EWOULDBLOCK && errno != EAGAIN && errno != EINTR) {
+            NSLOG_WRNNO("failed to accept health check connection");
+        }
+        return;
+    }
+    setsockopt(fd, SOL_SOCKET, SO_RCVTIMEO, &(struct timeval){ .tv_usec = 250 * 1000 }, sizeof(struct timeval)); // don't block the main loop for long
+
+    char req[1024];
+    ssize_t n = read(fd, req, sizeof(req) - 1);
+    if (n <= 0) {
+        close(fd);
+        return;
+    }
+    req[n] = '\0';
+
+    char *body = NULL;
+    size_t len = 0;
+    FILE *f = open_memstream(&body, &len);
+    if (!f) {
+        NSLOG_WRNNO("failed to respond to health check: open_memstream");
+        close(fd);
+        return;
+    }
+    int code = 200;
+    const char *type = "text/plain";
+    #define check(_ok, _fmt, ...) do { \
+        if (!(_ok)) code = 503; \
+        fprintf(f, "%s " _fmt "\n", (_ok) ? "ok" : "fail", ##__VA_ARGS__); \
+    } while (0)
+    #define path_is(_p) (starts_with(path, _p " ") || starts_with(path, _p "?"))
+    bool head = starts_with(req, "HEAD ");
+    const char *path = head ? req + 5 : starts_with(req, "GET ") ? req + 4 : NULL;
+    if (!path) {
+        code = 405;
+        fprintf(f, "method not allowed\n");
+    } else if (path_is("/healthz") || path_is("/readyz")) {
+        check(state.wine.pid && !state.wine.exited, "wine process");
+        if (*state.server.dir) {
+            check(state.server.pid && !kill(state.server.pid, 0), "wineserver");
+        }
+        if (state.quota.exceeded && path_is("/healthz")) {
+            fprintf(f, "degraded disk quota\n");
+        }
+        if (path_is("/readyz")) {
+            check(!state.quota.exceeded, "disk quota");
+            check(state.io.status.parsed, "game server status");
+            check(udp_port_bound(state.health.port), "udp port %u", state.health.port);
+        }
+    } else if (path_is("/metrics")) {
+        type = "text/plain; version=0.0.4";
+        metrics_write(f, prom_metric);
+    } else {
+        code = 404;
+        fprintf(f, "not found\n");
+    }
+    #undef check
+    #undef path_is
+    if (fclose(f)) {
+        NSLOG_WRNNO("failed to respond to health check: write");
+        free(body);
+        close(fd);
+        return;
+    }
+    dprintf(fd, "HTTP/1.0 %d %s\r\nContent-Type: %s\r\nContent-Length: %zu\r\nConnection: close\r\n\r\n",
+        code, code == 200 ? "OK" : code == 404 ? "Not Found" : code == 405 ? "Method Not Allowed" : "Service Unavailable", type, len);
+    for (size_t off = 0; !head && off < len; ) {
+        ssize_t w = write(fd, body + off, len - off);
+        if (w <= 0) {
+            break;
+        }
+        off += (size_t)(w);
+    }
+    free(body);
+    close(fd);
+}
+
+/** Get an identifier for the current template prefix, for checking if a pre-instantiated prefix is still valid. */
+static bool instance_stamp(char *buf, size_t n) {
+    char fn[PATH_MAX];
+    struct stat statbuf;
+    snprintf(fn, sizeof(fn), "%s/system.reg", state.inst.template);
+    if (stat(fn, &statbuf) == -1) {
+        return false;
+    }
+    snprintf(buf, n, "%s %llu %lld.%09ld\n", state.inst.template, (unsigned long long)(statbuf.st_ino), (long long)(statbuf.st_mtim.tv_sec), statbuf.st_mtim.tv_nsec);
+    return true;
+}
+
+/** Create the instance prefix from the template prefix and the instance registry deltas. If instantiate is true, the prefix is always recreated and marked as pre-instantiated, otherwise a pre-instantiated prefix is used as-is. */
+static bool instance_setup(bool instantiate) {
+    char tmp[PATH_MAX], stamp[PATH_MAX+64];
+    if (mkdir(state.cfg.instance, 0755) == -1 && errno != EEXIST) {
+        NSLOG_ERRNO("failed to create instance dir %s", state.cfg.instance);
+        return false;
+    }
+    snprintf(tmp, sizeof(tmp), "%s/instance", state.cfg.instance);
+    if ((state.inst.lock = open(tmp, O_RDWR | O_CREAT | O_CLOEXEC, 0644)) == -1) {
+        NSLOG_ERRNO("failed to open instance lock file %s", tmp);
+        return false;
+    }
+    if (flock(state.inst.lock, LOCK_EX | LOCK_NB) == -1) {
+        if (errno == EWOULDBLOCK) {
+            NSLOG_ERR("instance dir %s is already in use", state.cfg.instance);
+        } else {
+            NSLOG_ERRNO("failed to lock instance lock file %s", tmp);
+        }
+        return false;
+    }
+    {
+        char cwd[PATH_MAX], exe[PATH_MAX*2] = "";
+        if (!instantiate) { // the game dir isn't known yet, so gc only checks the age
+            if (!getcwd(cwd, sizeof(cwd))) {
+                NSLOG_ERRNO("failed to get current dir");
+                return false;
+            }
+            snprintf(exe, sizeof(exe), "%s/%s\n", cwd, state.cfg.exe);
+        }
+        if (ftruncate(state.inst.lock, 0) == -1 || pwrite(state.inst.lock, exe, strlen(exe), 0) != (ssize_t)(strlen(exe))) {
+            NSLOG_ERRNO("failed to write instance lock file %s", tmp);
+            return false;
+        }
+    }
+    snprintf(tmp, sizeof(tmp), "%s/registry", state.cfg.instance);
+    if (mkdir(tmp, 0755) == -1 && errno != EEXIST) {
+        NSLOG_ERRNO("failed to create instance registry dir %s", tmp);
+        return false;
+    }
+
+    snprintf(tmp, sizeof(tmp), "%s/prepared", state.cfg.instance);
+    if (!instantiate && instance_stamp(stamp, sizeof(stamp))) {
+        char buf[sizeof(stamp)] = {0};
+        int fd = open(tmp, O_RDONLY | O_CLOEXEC);
+        if (fd != -1) {
+            ssize_t r = read(fd, buf, sizeof(buf) - 1);
+            close(fd);
+            unlink(tmp); // the prefix will be modified once wine uses it
+            if (r > 0 && !strcmp(buf, stamp)) {
+                NSLOG_INF("using pre-instantiated instance prefix");
+                state.inst.ready = true;
+                return true;
+            }
+            NSLOG_INF("pre-instantiated instance prefix is outdated");
+        }
+    } else if (instantiate) {
+        unlink(tmp);
+    }
+
+    snprintf(tmp, sizeof(tmp), "%s/prefix", state.cfg.instance);
+    if (access(tmp, F_OK) == 0) {
+        NSLOG_INF("recreating instance prefix %s", tmp);
+        if (!instance_save("upper") || !instance_save("prefix")) {
+            NSLOG_ERR("failed to save registry deltas from the previous instance prefix");
+            return false;
+        }
+    }
+    static const char *const prefix_dirs[] = { "prefix", "upper", "work" };
+    for (size_t i = 0; i < sizeof(prefix_dirs)/sizeof(*prefix_dirs); i++) {
+        snprintf(tmp, sizeof(tmp), "%s/%s", state.cfg.instance, prefix_dirs[i]);
+        if (access(tmp, F_OK) == 0 && nftw(tmp, instance_rm_fn, 16, FTW_DEPTH | FTW_PHYS)) {
+            return false;
+        }
+    }
+    if (state.cfg.cow && !instantiate && instance_overlay()) {
+        NSLOG_DBG("mounted instance prefix as an overlay of %s", state.inst.template);
+    } else {
+        if (state.cfg.cow && !instantiate) {
+            NSLOG_WRNNO("cannot use overlayfs for the instance prefix, copying files instead");
+        }
+        if (nftw(state.inst.template, instance_copy_fn, 16, FTW_PHYS)) {
+            return false;
+        }
+        if (state.inst.n_copy && !instance_copy_files()) {
+            return false;
+        }
+    }
+
+    for (size_t i = 0; i < sizeof(instance_hives)/sizeof(*instance_hives); i++) {
+        char bfn[PATH_MAX], cfn[PATH_MAX], dfn[PATH_MAX];
+        instance_base(bfn, sizeof(bfn), instance_hives[i]);
+        snprintf(cfn, sizeof(cfn), "%s/prefix/%s", state.cfg.instance, instance_hives[i]);
+        snprintf(dfn, sizeof(dfn), "%s/registry/%s.delta", state.cfg.instance, instance_hives[i]);
+
+        struct reg_hive base, delta;
+        if (!reg_read(&base, bfn)) {
+            if (errno == ENOENT) {
+                continue;
+            }
+            NSLOG_ERRNO("failed to read base registry hive %s", bfn);
+            return false;
+        }
+        if (!reg_read(&delta, dfn)) {
+            if (errno != ENOENT) {
+                NSLOG_ERRNO("failed to read instance registry delta %s", dfn);
+                reg_free(&base);
+                return false;
+            }
+            memset(&delta, 0, sizeof(delta));
+        }
+        bool ok = reg_write(cfn, reg_write_merged, &base, &delta);
+        if (!ok) {
+            NSLOG_ERRNO("failed to write instance registry hive %s", cfn);
+        } else {
+            NSLOG_DBG("merged %zu keys from %s into %s", delta.n, dfn, cfn);
+        }
+        reg_free(&base);
+        reg_free(&delta);
+        if (!ok) {
+            return false;
+        }
+    }
+    if (instantiate) {
+        snprintf(tmp, sizeof(tmp), "%s/prepared", state.cfg.instance);
+        int fd = instance_stamp(stamp, sizeof(stamp)) ? open(tmp, O_WRONLY | O_CREAT | O_TRUNC | O_CLOEXEC, 0644) : -1;
+        bool ok = fd != -1 && write(fd, stamp, strlen(stamp)) == (ssize_t)(strlen(stamp));
+        if (fd != -1) {
+            close(fd);
+        }
+        if (!ok) {
+            NSLOG_ERRNO("failed to mark instance prefix as pre-instantiated");
+            return false;
+        }
+    }
+    state.inst.ready = true;
+    return true;
+}
+
+/** Paths in the instance prefix which wine writes to while running. */
+static const char *readonly_paths[] = {
+    "",
+    "system.reg",
+    "user.reg",
+    "userdef.reg",
+    "drive_c/windows/temp",
+    "drive_c/users/" NSWRAP_PREFIX_USER,
+    "drive_c/users/" NSWRAP_PREFIX_USER "/AppData/Local/Temp",
+    "drive_c/users/Public",
+};
+
+/** If the game's R2Northstar/logs isn't writable (e.g., if the game dir is also read-only), bind-mount a logs dir in the instance dir over it in a private mount namespace so logs and minidumps are still written. */
+static void readonly_logs(void) {
+    if (access("R2Northstar", F_OK) == -1 || access("R2Northstar/logs", W_OK) == 0 || (errno == ENOENT && access("R2Northstar", W_OK) == 0)) {
+        return; // not northstar, or writable
+    }
+    if (access("R2Northstar/logs", F_OK) == -1) {
+        NSLOG_WRN("game dir R2Northstar is not writable and doesn't contain a logs dir to redirect, so logs and minidumps will not be written (mount a writable volume at R2Northstar/logs)");
+        return;
+    }
+    char dir[PATH_MAX];
+    snprintf(dir, sizeof(dir), "%s/logs", state.cfg.instance);
+    if (mkdir(dir, 0755) == -1 && errno != EEXIST) {
+        NSLOG_WRNNO("failed to create instance logs dir %s, so logs and minidumps will not be written", dir);
+        return;
+    }
+    if ((!state.inst.overlay && (unshare(CLONE_NEWNS) == -1 || mount(NULL, "/", NULL, MS_REC | MS_PRIVATE, NULL) == -1)) || mount(dir, "R2Northstar/logs", NULL, MS_BIND, NULL) == -1) {
+        NSLOG_WRNNO("game dir R2Northstar/logs is not writable and can't be redirected to %s, so logs and minidumps will not be written (mount a writable volume at R2Northstar/logs)", dir);
+        return;
+    }
+    NSLOG_INF("redirected game dir R2Northstar/logs to %s", dir);
+}
+
+/** Check that the paths wine writes to in the instance prefix are writable and don't resolve to somewhere in the read-only runtime or template prefix, and redirect the game logs if needed. */
+static bool readonly_check(void) {
+    char rt[PATH_MAX], tp[PATH_MAX];
+    if (!realpath(state.cfg.dir, rt) || !realpath(state.inst.template, tp)) {
+        NSLOG_ERRNO("failed to resolve runtime dir");
+        return false;
+    }
+    bool ok = true;
+    for (size_t i = 0; i < sizeof(readonly_paths)/sizeof(*readonly_paths); i++) {
+        char fn[PATH_MAX], real[PATH_MAX];
+        snprintf(fn, sizeof(fn), "%s/prefix%s%s", state.cfg.instance, *readonly_paths[i] ? "/" : "", readonly_paths[i]);
+        if (!realpath(fn, real)) {
+            if (errno != ENOENT) { // otherwise, it'll be created in one of the other dirs
+                NSLOG_ERRNO("failed to resolve %s", fn);
+                ok = false;
+            }
+            continue;
+        }
+        if (path_in(real, rt) || path_in(real, tp)) {
+            NSLOG_ERR("%s is in the read-only runtime (%s)", fn, real);
+            ok = false;
+        } else if (access(real, W_OK) == -1) {
+            NSLOG_ERRNO("%s is not writable", fn);
+            ok = false;
+        } else {
+            NSLOG_DBG("%s is writable (%s)", fn, real);
+        }
+    }
+    readonly_logs();
+    return ok;
+}
+
+/** Env vars (with a trailing =) and prefixes which nswrap sets for wine itself, so they can't be mapped with NSWRAP_ENV. */
+static const char *env_reserved[] = {
+    "WINE",
+    "LD_",
+    "NSS_WRAPPER_",
+    "PATH=",
+    "HOME=",
+    "USER=",
+    "LOGNAME=",
+    "HOSTNAME=",
+    "LC_ALL=",
+};
+
+/** Append the env vars matching the NSWRAP_ENV rules to envp (which has n entries and room for max including the terminating NULL), returning the new number of entries or -1 if the rules are invalid. Vars which are reserved or already set are skipped. */
+static ssize_t env_map(char **envp, size_t n, size_t max, const char *rules) {
+    extern char **environ;
+    char *buf = strdupa(rules), *rule;
+    while ((rule = strsep(&buf, ";"))) {
+        if (!*rule) {
+            continue;
+        }
+        char *from = strsep(&rule, "="), *to = rule ?: from;
+        size_t fl = strlen(from), tl = strlen(to);
+        bool prefix = fl && from[fl-1] == '*';
+        if (!fl || !tl || strchr(from, '*') != (prefix ? from + fl - 1 : NULL) || strchr(to, '*') != (prefix ? to + tl - 1 : NULL)) {
+            NSLOG_ERR("invalid env mapping rule %s%s%s (expected NAME, NAME=NEW, PREFIX*, or PREFIX*=NEWPREFIX*)", from, rule ? "=" : "", rule ?: "");
+            return -1;
+        }
+        if (prefix) {
+            fl--;
+            tl--;
+        }
+        for (char **e = environ; e && *e; e++) {
+            size_t kl = strcspn(*e, "=");
+            if (prefix ? (kl < fl || strncmp(*e, from, fl)) : (kl != fl || strncmp(*e, from, fl))) {
+                continue;
+            }
+            char *v;
+            if (asprintf(&v, "%.*s%.*s%s", (int)(tl), to, (int)(kl - fl), *e + fl, *e + kl) == -1) {
+                NSLOG_ERRNO("failed to map env var");
+                return -1;
+            }
+            size_t vl = strcspn(v, "=");
+            bool skip = vl == 0;
+            for (size_t i = 0; !skip && i < sizeof(env_reserved)/sizeof(*env_reserved); i++) {
+                if (starts_with(v, env_reserved[i])) {
+                    NSLOG_WRN("not mapping env var %.*s to reserved env var %.*s", (int)(kl), *e, (int)(vl), v);
+                    skip = true;
+                }
+            }
+            for (size_t i = 0; !skip && i < n; i++) {
+                if (!strncmp(envp[i], v, vl + 1)) {
+                    NSLOG_DBG("not mapping env var %.*s to %.*s since it's already set", (int)(kl), *e, (int)(vl), v);
+                    skip = true;
+                }
+            }
+            if (skip) {
+                free(v);
+                continue;
+            }
+            if (n + 1 >= max) {
+                NSLOG_ERR("too many env vars");
+                free(v);
+                return -1;
+            }
+            NSLOG_DBG("mapping env var %.*s to %.*s", (int)(kl), *e, (int)(vl), v);
+            envp[n++] = v;
+        }
+    }
+    return (ssize_t)(n);
+}
+
+/** SHA-256 state, for verifying optional components. */
+struct sha256 {
+    uint32_t h[8];
+    uint64_t len;
+    uint8_t buf[64];
+    size_t n;
+};
+
+static const uint32_t sha256_k[64] = {
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+};
+
+#define SHA256_ROR(_x, _n) (((_x) >> (_n)) | ((_x) << (32 - (_n))))
+
+static void sha256_block(struct sha256 *s, const uint8_t *p) {
+    uint32_t w[64], v[8];
+    for (int i = 0; i < 16; i++) {
+        w[i] = (uint32_t)(p[i*4]) << 24 | (uint32_t)(p[i*4+1]) << 16 | (uint32_t)(p[i*4+2]) << 8 | (uint32_t)(p[i*4+3]);
+    }
+    for (int i = 16; i < 64; i++) {
+        uint32_t s0 = SHA256_ROR(w[i-15], 7) ^ SHA256_ROR(w[i-15], 18) ^ (w[i-15] >> 3);
+        uint32_t s1 = SHA256_ROR(w[i-2], 17) ^ SHA256_ROR(w[i-2], 19) ^ (w[i-2] >> 10);
+        w[i] = w[i-16] + s0 + w[i-7] + s1;
+    }
+    memcpy(v, s->h, sizeof(v));
+    for (int i = 0; i < 64; i++) {
+        uint32_t t1 = v[7] + (SHA256_ROR(v[4], 6) ^ SHA256_ROR(v[4], 11) ^ SHA256_ROR(v[4], 25)) + ((v[4] & v[5]) ^ (~v[4] & v[6])) + sha256_k[i] + w[i];
+        uint32_t t2 = (SHA256_ROR(v[0], 2) ^ SHA256_ROR(v[0], 13) ^ SHA256_ROR(v[0], 22)) + ((v[0] & v[1]) ^ (v[0] & v[2]) ^ (v[1] & v[2]));
+        memmove(&v[1], &v[0], sizeof(*v) * 7);
+        v[4] += t1;
+        v[0] = t1 + t2;
+    }
+    for (int i = 0; i < 8; i++) {
+        s->h[i] += v[i];
+    }
+}
+
+static void sha256_init(struct sha256 *s) {
+    static const uint32_t h[8] = {
+        0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+    };
+    memset(s, 0, sizeof(*s));
+    memcpy(s->h, h, sizeof(h));
+}
+
+static void sha256_update(struct sha256 *s, const void *buf, size_t n) {
+    const uint8_t *p = buf;
+    s->len += n;
+    while (n) {
+        size_t c = sizeof(s->buf) - s->n;
+        if (c > n) {
+            c = n;
+        }
+        memcpy(s->buf + s->n, p, c);
+        s->n += c;
+        p += c;
+        n -= c;
+        if (s->n == sizeof(s->buf)) {
+            sha256_block(s, s->buf);
+            s->n = 0;
+        }
+    }
+}
+
+/** Finish the hash, writing it as lowercase hex to out. */
+static void sha256_final(struct sha256 *s, char out[65]) {
+    uint64_t bits = s->len * 8;
+    uint8_t pad[72] = {0x80};
+    size_t n = (s->n < 56 ? 56 : 120) - s->n;
+    for (int i = 0; i < 8; i++) {
+        pad[n + i] = (uint8_t)(bits >> (56 - i*8));
+    }
+    sha256_update(s, pad, n + 8);
+    for (int i = 0; i < 8; i++) {
+        snprintf(out + i*8, 9, "%08x", s->h[i]);
+    }
+}
+
+/** Hash a file. */
+static bool sha256_file(const char *fn, char out[65]) {
+    int fd = open(fn, O_RDONLY | O_CLOEXEC);
+    if (fd == -1) {
+        return false;
+    }
+    struct sha256 s;
+    sha256_init(&s);
+    char buf[65536];
+    ssize_t n;
+    while ((n = read(fd, buf, sizeof(buf))) > 0) {
+        sha256_update(&s, buf, n);
+    }
+    int saved_errno = errno;
+    close(fd);
+    if (n == -1) {
+        errno = saved_errno;
+        return false;
+    }
+    sha256_final(&s, out);
+    return true;
+}
+
+/** Copy a file or download a URL (using curl or wget) to dst. */
+static bool component_get(const char *src, const char *dst) {
+    if (starts_with(src, "http://") || starts_with(src, "https://")) {
+        pid_t pid = fork();
+        if (pid == -1) {
+            NSLOG_ERRNO("failed to fork");
+            return false;
+        }
+        if (pid == 0) {
+            execlp("curl", "curl", "-fsSL", "--retry", "3", "-o", dst, src, NULL);
+            execlp("wget", "wget", "-q", "-O", dst, src, NULL);
+            NSLOG_ERRNO("failed to execute curl or wget");
+            _exit(127);
+        }
+        int wstatus;
+        if (waitpid(pid, &wstatus, 0) == -1) {
+            NSLOG_ERRNO("failed to wait for download");
+            return false;
+        }
+        if (!WIFEXITED(wstatus) || WEXITSTATUS(wstatus)) {
+            NSLOG_ERR("failed to download %s", src);
+            return false;
+        }
+        return true;
+    }
+    int in = open(src, O_RDONLY | O_CLOEXEC);
+    if (in == -1) {
+        NSLOG_ERRNO("failed to open %s", src);
+        return false;
+    }
+    int out = open(dst, O_WRONLY | O_CREAT | O_TRUNC | O_CLOEXEC, 0644);
+    if (out == -1) {
+        NSLOG_ERRNO("failed to create %s", dst);
+        close(in);
+        return false;
+    }
+    char buf[65536];
+    ssize_t n;
+    while ((n = read(in, buf, sizeof(buf))) > 0) {
+        if (write(out, buf, n) != n) {
+            n = -1;
+            break;
+        }
+    }
+    if (n == -1) {
+        NSLOG_ERRNO("failed to copy %s", src);
+    }
+    close(in);
+    if (close(out) == -1 && n != -1) {
+        NSLOG_ERRNO("failed to write %s", dst);
+        n = -1;
+    }
+    return n != -1;
+}
+
+/** Install an optional component listed in the runtime's component manifest if it isn't already installed, into the components dir in the instance dir (which is added to WINEDLLPATH) if using one, or the runtime otherwise. */
+static bool component_install(const char *name) {
+    char fn[PATH_MAX];
+    snprintf(fn, sizeof(fn), "%s/prefix/components.tsv", state.cfg.dir);
+    FILE *f = fopen(fn, "re");
+    if (!f) {
+        NSLOG_ERRNO("failed to open optional component manifest %s", fn);
+        return false;
+    }
+    char *line = NULL;
+    size_t cap = 0;
+    char *field[5];
+    bool found = false;
+    while (!found && getline(&line, &cap, f) != -1) {
+        line[strcspn(line, "\r\n")] = '\0';
+        if (*line == '#' || !*line) {
+            continue;
+        }
+        char *p = line;
+        size_t i;
+        for (i = 0; i < 5 && p; i++) {
+            field[i] = strsep(&p, "\t");
+        }
+        if (i != 5 || p) {
+            NSLOG_WRN("ignoring invalid line in optional component manifest %s", fn);
+            continue;
+        }
+        found = !strcasecmp(field[0], name);
+    }
+    fclose(f);
+    if (!found) {
+        NSLOG_ERR("optional component %s does not exist", name);
+        free(line);
+        return false;
+    }
+
+    bool ok = false;
+    char dst[PATH_MAX], tmp[PATH_MAX+16] = "", src[PATH_MAX], sum[65];
+    if (strlen(field[1]) != 64 || *field[3] == '/' || strstr(field[3], "..")) {
+        NSLOG_ERR("invalid optional component %s", name);
+        goto done;
+    }
+    snprintf(dst, sizeof(dst), "%s/%s", state.cfg.dir, field[3]);
+    if (access(dst, F_OK) == 0) {
+        NSLOG_DBG("optional component %s is already installed in the runtime", name);
+        ok = true;
+        goto done;
+    }
+    if (*state.cfg.instance) {
+        snprintf(dst, sizeof(dst), "%s/components", state.cfg.instance);
+        if (mkdir(dst, 0755) == -1 && errno != EEXIST) {
+            NSLOG_ERRNO("failed to create %s", dst);
+            goto done;
+        }
+        snprintf(dst, sizeof(dst), "%s/components/%s", state.cfg.instance, strrchr(field[3], '/') ? strrchr(field[3], '/') + 1 : field[3]);
+        if (access(dst, F_OK) == 0) {
+            NSLOG_DBG("optional component %s is already installed", name);
+            ok = true;
+            goto done;
+        }
+    } else if (state.cfg.readonly) {
+        NSLOG_ERR("optional component %s is not installed, and the runtime is read-only (install it when building the runtime instead)", name);
+        goto done;
+    }
+    if (state.cfg.component_source) {
+        snprintf(src, sizeof(src), "%s/%s", state.cfg.component_source, field[1]);
+    } else {
+        snprintf(src, sizeof(src), "%s", field[4]);
+    }
+    snprintf(tmp, sizeof(tmp), "%s.nswrap-tmp", dst);
+
+    NSLOG_INF("installing optional component %s (%s bytes) from %s", name, field[2], src);
+    if (!component_get(src, tmp)) {
+        goto done;
+    }
+    if (!sha256_file(tmp, sum)) {
+        NSLOG_ERRNO("failed to hash %s", tmp);
+        goto done;
+    }
+    if (strcasecmp(sum, field[1])) {
+        NSLOG_ERR("optional component %s has the wrong hash (expected %s, got %s)", name, field[1], sum);
+        goto done;
+    }
+    if (chmod(tmp, 0644) == -1 || rename(tmp, dst) == -1) {
+        NSLOG_ERRNO("failed to install %s", dst);
+        goto done;
+    }
+    ok = true;
+
+done:
+    if (!ok && *tmp) {
+        unlink(tmp);
+    }
+    free(line);
+    return ok;
+}
+
+/** Read the compatibility version (0 if it doesn't have one), locale, and timezone from the nswine manifest in the runtime prefix, returning false if the manifest doesn't exist. */
+static bool runtime_manifest(int *compat) {
+    char fn[PATH_MAX];
+    snprintf(fn, sizeof(fn), "%s/prefix/nswine.json", state.cfg.dir);
+    FILE *f = fopen(fn, "re");
+    if (!f) {
+        if (errno != ENOENT) {
+            NSLOG_WRNNO("failed to open runtime manifest %s", fn);
+        }
+        return false;
+    }
+    // the manifest is json, but it's written by nswine with one field per line, and the scalar fields are always near the top
+    *compat = 0;
+    char *line = NULL;
+    size_t cap = 0;
+    for (int i = 0; i < 16 && getline(&line, &cap, f) != -1; i++) {
+        char *p = line + strspn(line, " \t");
+        if (starts_with(p, "\"compat\":")) {
+            *compat = atoi(p + sizeof("\"compat\":") - 1);
+            continue;
+        }
+        struct {
+            const char *key;
+            char *buf;
+            size_t n;
+        } strs[] = {
+            {"\"locale\": \"", state.runtime.locale, sizeof(state.runtime.locale)},
+            {"\"tz\": \"", state.runtime.tz, sizeof(state.runtime.tz)},
+        };
+        for (size_t j = 0; j < sizeof(strs)/sizeof(*strs); j++) {
+            if (starts_with(p, strs[j].key)) {
+                p += strlen(strs[j].key);
+                size_t n = strcspn(p, "\"\\");
+                if (p[n] != '"' || n >= strs[j].n) {
+                    NSLOG_WRN("ignoring invalid runtime manifest line %.*s", (int)(strcspn(line, "\n")), line);
+                } else {
+                    memcpy(strs[j].buf, p, n);
+                    strs[j].buf[n] = '\0';
+                }
+            }
+        }
+    }
+    free(line);
+    fclose(f);
+    return true;
+}
+
+/** Remove instance dirs under a root dir which haven't been used recently or whose game dir no longer exists. */
+static int gc_main(int argc, char **argv) {
+    int days = 30;
+    bool yes = false, dry = false;
+    int opt;
+    while ((opt = getopt(argc, argv, "d:yn")) != -1) {
+        switch (opt) {
+        case 'd':
+            days = atoi(optarg);
+            if (days < 0) {
+                NSLOG_ERR("invalid number of days %s", optarg);
+                return 2;
+            }
+            break;
+        case 'y':
+            yes = true;
+            break;
+        case 'n':
+            dry = true;
+            break;
+        default:
+            fprintf(stderr, "usage: %s gc [-d days] [-y] [-n] instances_dir\n", argv[0]);
+            fprintf(stderr, "  -d days  remove instances not used for this many days (default 30)\n");
+            fprintf(stderr, "  -y       don't ask for confirmation\n");
+            fprintf(stderr, "  -n       only list the instances which would be removed\n");
+            return 2;
+        }
+    }
+    if (optind != argc - 1) {
+        fprintf(stderr, "usage: %s gc [-d days] [-y] [-n] instances_dir\n", argv[0]);
+        return 2;
+    }
+    const char *root = argv[optind];
+
+    DIR *dp = opendir(root);
+    if (!dp) {
+        NSLOG_ERRNO("failed to open instances dir %s", root);
+        return 1;
+    }
+
+    struct {
+        char path[PATH_MAX];
+        uint64_t bytes;
+        int lock;
+    } *cand = NULL;
+    size_t n = 0;
+
+    time_t now = time(NULL);
+    struct dirent *de;
+    while ((de = readdir(dp))) {
+        if (de->d_name[0] == '.') {
+            continue;
+        }
+        char dir[PATH_MAX], fn[PATH_MAX + 16];
+        snprintf(dir, sizeof(dir), "%s/%s", root, de->d_name);
+        snprintf(fn, sizeof(fn), "%s/instance", dir);
+
+        int fd = open(fn, O_RDONLY | O_CLOEXEC);
+        if (fd == -1) {
+            continue; // not an instance dir
+        }
+        if (flock(fd, LOCK_EX | LOCK_NB) == -1) {
+            NSLOG_DBG("skipping %s: in use", dir);
+            close(fd);
+            continue;
+        }
+
+        const char *why = NULL;
+        struct stat statbuf;
+        char exe[PATH_MAX] = {0};
+        ssize_t r = read(fd, exe, sizeof(exe) - 1);
+        exe[r > 0 ? r : 0] = '\0';
+        exe[strcspn(exe, "\n")] = '\0';
+        if (*exe && access(exe, F_OK) == -1 && errno == ENOENT) {
+            why = "game executable no longer exists";
+        }
+        if (!why && fstat(fd, &statbuf) == 0 && now - statbuf.st_mtime > (time_t)(days) * 24 * 60 * 60) {
+            why = "not used recently";
+        }
+        if (!why) {
+            close(fd);
+            continue;
+        }
+
+        void *tmp = realloc(cand, (n + 1) * sizeof(*cand));
+        if (!tmp) {
+            NSLOG_ERRNO("realloc");
+            close(fd);
+            break;
+        }
+        cand = tmp;
+        snprintf(cand[n].path, sizeof(cand[n].path), "%s", dir);
+        cand[n].bytes = du(dir);
+        cand[n].lock = fd;
+        NSLOG_INF("%s (%s, %.1f MiB)", dir, why, cand[n].bytes / 1048576.0);
+        n++;
+    }
+    closedir(dp);
+
+    uint64_t total = 0;
+    for (size_t i = 0; i < n; i++) {
+        total += cand[i].bytes;
+    }
+    int rc = 0;
+    if (!n) {
+        NSLOG_INF("no stale instances found");
+    } else if (dry) {
+        NSLOG_INF("would remove %zu instances (%.1f MiB)", n, total / 1048576.0);
+    } else {
+        if (!yes) {
+            if (!isatty(STDIN_FILENO)) {
+                NSLOG_ERR("not removing %zu instances without confirmation (use -y)", n);
+                rc = 1;
+            } else {
+                printf("remove %zu instances (%.1f MiB)? [y/N] ", n, total / 1048576.0);
+                fflush(stdout);
+                char tmp[16];
+                if (!fgets(tmp, sizeof(tmp), stdin) || (*tmp != 'y' && *tmp != 'Y')) {
+                    NSLOG_INF("not removing instances");
+                    rc = 1;
+                } else {
+                    yes = true;
+                }
+            }
+        }
+        if (yes) {
+            uint64_t freed = 0;
+            for (size_t i = 0; i < n; i++) {
+                if (nftw(cand[i].path, instance_rm_fn, 16, FTW_DEPTH | FTW_PHYS)) {
+                    NSLOG_ERR("failed to remove %s", cand[i].path);
+                    rc = 1;
+                } else {
+                    freed += cand[i].bytes;
+                }
+            }
+            NSLOG_INF("reclaimed %.1f MiB", freed / 1048576.0);
+        }
+    }
+    for (size_t i = 0; i < n; i++) {
+        close(cand[i].lock);
+    }
+    free(cand);
+    return rc;
+}
+
+/** Create instance prefixes for multiple instance dirs in parallel, so they're ready to use when the instances are started. */
+static int instantiate_main(int argc, char **argv) {
+    int jobs = nprocs();
+    int opt;
+    while ((opt = getopt(argc, argv, "j:")) != -1) {
+        switch (opt) {
+        case 'j':
+            jobs = atoi(optarg);
+            if (jobs <= 0) {
+                NSLOG_ERR("invalid number of jobs %s", optarg);
+                return 2;
+            }
+            break;
+        default:
+            fprintf(stderr, "usage: %s instantiate [-j jobs] instance_dir...\n", argv[0]);
+            fprintf(stderr, "  -j jobs  number of prefixes to create at once (default the number of cpus)\n");
+            return 2;
+        }
+    }
+    if (optind == argc) {
+        fprintf(stderr, "usage: %s instantiate [-j jobs] instance_dir...\n", argv[0]);
+        return 2;
+    }
+    for (int i = optind; i < argc; i++) {
+        if (*argv[i] != '/' || strlen(argv[i]) > 1024) {
+            NSLOG_ERR("instance dir (%s) must be an absolute path and not too long", argv[i]);
+            return 2;
+        }
+    }
+
+    int running = 0, failed = 0;
+    for (int i = optind; i < argc || running; ) {
+        if (i < argc && running < jobs) {
+            pid_t pid = fork();
+            if (pid == -1) {
+                NSLOG_ERRNO("failed to fork");
+                failed += argc - i;
+                i = argc;
+                continue;
+            }
+            if (pid == 0) {
+                state.cfg.instance = argv[i];
+                _exit(instance_setup(true) ? 0 : 1);
+            }
+            NSLOG_DBG("instantiating %s (pid %d)", argv[i], (int)(pid));
+            running++;
+            i++;
+            continue;
+        }
+        int wstatus;
+        if (wait(&wstatus) == -1) {
+            NSLOG_ERRNO("failed to wait for children");
+            return 1;
+        }
+        running--;
+        if (!WIFEXITED(wstatus) || WEXITSTATUS(wstatus)) {
+            failed++;
+        }
+    }
+    if (failed) {
+        NSLOG_ERR("failed to create %d of %d instance prefixes", failed, argc - optind);
+        return 1;
+    }
+    NSLOG_INF("created %d instance prefixes", argc - optind);
+    return 0;
+}
+
+/** Write s to a support bundle file, redacting anything which looks like a secret (the value of a password/passwd/token/secret/apikey/key/auth* name followed by = or :, and url credentials). */
+static void support_sanitize(FILE *f, const char *s) {
+    static const char *const words[] = {"password", "passwd", "token", "secret", "apikey", "key", "auth", NULL};
+    const char *start = s;
+    while (*s) {
+        if (starts_with(s, "://")) {
+            const char *at = s + 3 + strcspn(s + 3, "@/ \t\r\n\"'");
+            if (*at == '@') {
+                fputs("://<redacted>@", f);
+                s = at + 1;
+                continue;
+            }
+        }
+        size_t n = 0;
+        if (s == start || !isalpha((unsigned char)(s[-1]))) {
+            for (const char *const *w = words; *w; w++) {
+                if (!strncasecmp(s, *w, strlen(*w))) {
+                    n = strlen(*w);
+                    if (!strcmp(*w, "auth")) {
+                        while (isalpha((unsigned char)(s[n]))) {
+                            n++; // e.g., authorization
+                        }
+                    }
+                    break;
+                }
+            }
+        }
+        if (n) {
+            if (s[n] == '"' || s[n] == '\'') {
+                n++; // quoted name
+            }
+            n += strspn(s + n, " \t");
+            n = (s[n] == '=' || s[n] == ':') ? n + 1 : 0; // only whole names followed by a value
+        }
+        if (!n) {
+            fputc(*s++, f);
+            continue;
+        }
+        n += strspn(s + n, " \t\"'");
+        if (!strncasecmp(s + n, "bearer ", 7) || !strncasecmp(s + n, "basic ", 6)) {
+            n += strcspn(s + n, " ") + 1; // auth scheme
+        }
+        fwrite(s, 1, n, f);
+        s += n;
+        if ((n = strcspn(s, " \t\r\n\"'"))) {
+            fputs("<redacted>", f);
+            s += n;
+        }
+    }
+}
+
+/** Write the last lines of a file to a support bundle file, optionally sanitizing them. */
+static bool support_tail(FILE *f, const char *src, size_t lines, bool sanitize) {
+    FILE *in = fopen(src, "re");
+    if (!in) {
+        fprintf(f, "(failed to open %s: %s)\n", src, strerror(errno));
+        return false;
+    }
+    char **ring = calloc(lines, sizeof(*ring));
+    if (!ring) {
+        fclose(in);
+        return false;
+    }
+    size_t i = 0;
+    char *line = NULL;
+    size_t cap = 0;
+    while (getline(&line, &cap, in) != -1) {
+        free(ring[i % lines]);
+        ring[i++ % lines] = strdup(line);
+    }
+    free(line);
+    fclose(in);
+    if (i > lines) {
+        fprintf(f, "(%zu earlier lines omitted)\n", i - lines);
+    }
+    for (size_t j = i > lines ? i - lines : 0; j < i; j++) {
+        if (ring[j % lines]) {
+            if (sanitize) {
+                support_sanitize(f, ring[j % lines]);
+            } else {
+                fputs(ring[j % lines], f);
+            }
+        }
+    }
+    for (size_t j = 0; j < lines; j++) {
+        free(ring[j]);
+    }
+    free(ring);
+    return true;
+}
+
+/** Create a support bundle file. */
+static FILE *support_open(const char *dir, const char *name) {
+    char fn[PATH_MAX*2];
+    snprintf(fn, sizeof(fn), "%s/%s", dir, name);
+    FILE *f = fopen(fn, "we");
+    if (!f) {
+        NSLOG_WRNNO("failed to create %s", fn);
+    }
+    return f;
+}
+
+/** Compare files by descending modification time. */
+static int support_mtime_cmp(const void *a, const void *b) {
+    const struct { char name[256]; struct timespec mtime; } *x = a, *y = b;
+    if (x->mtime.tv_sec != y->mtime.tv_sec) {
+        return x->mtime.tv_sec < y->mtime.tv_sec ? 1 : -1;
+    }
+    return x->mtime.tv_nsec < y->mtime.tv_nsec ? 1 : x->mtime.tv_nsec > y->mtime.tv_nsec ? -1 : 0;
+}
+
+/** Gather diagnostic info (sanitized config, recent logs, crash fingerprints, manifest version, host info, and health) into an archive for bug reports. */
+static int support_bundle_main(int argc, char **argv) {
+    const char *out = NULL;
+    int lines = 2000;
+    int opt;
+    while ((opt = getopt(argc, argv, "o:n:")) != -1) {
+        switch (opt) {
+        case 'o':
+            out = optarg;
+            break;
+        case 'n':
+            lines = atoi(optarg);
+            if (lines <= 0) {
+                NSLOG_ERR("invalid number of lines %s", optarg);
+                return 2;
+            }
+            break;
+        default:
+            fprintf(stderr, "usage: %s support-bundle [-o file] [-n lines] [game_dir]\n", argv[0]);
+            fprintf(stderr, "  -o file   write the archive to this file (default nswrap-support-YYYYMMDD-HHMMSS.tar.gz)\n");
+            fprintf(stderr, "  -n lines  include this many lines from the end of each log (default 2000)\n");
+            return 2;
+        }
+    }
+    if (argc - optind > 1) {
+        fprintf(stderr, "usage: %s support-bundle [-o file] [-n lines] [game_dir]\n", argv[0]);
+        return 2;
+    }
+    const char *game = optind < argc ? argv[optind] : ".";
+
+    char outbuf[64];
+    if (!out) {
+        time_t now = time(NULL);
+        strftime(outbuf, sizeof(outbuf), "nswrap-support-%Y%m%d-%H%M%S.tar.gz", localtime(&now));
+        out = outbuf;
+    }
+
+    char tmp[] = "/tmp/nswrap-support-XXXXXX";
+    if (!mkdtemp(tmp)) {
+        NSLOG_ERRNO("failed to create temporary dir");
+        return 1;
+    }
+    int rc = 1;
+    char dir[PATH_MAX], fn[PATH_MAX*2];
+    FILE *f;
+    snprintf(dir, sizeof(dir), "%s/nswrap-support", tmp);
+    snprintf(fn, sizeof(fn), "%s/logs", dir);
+    if (mkdir(dir, 0755) == -1 || mkdir(fn, 0755) == -1) {
+        NSLOG_ERRNO("failed to create temporary dir");
+        goto cleanup;
+    }
+
+    /* config */
+    NSLOG_INF("gathering config");
+    if ((f = support_open(dir, "config.txt"))) {
+        char cwd[PATH_MAX], path[PATH_MAX];
+        fprintf(f, "nswrap runtime compat: %d\n", NSWRAP_RUNTIME_COMPAT);
+        fprintf(f, "runtime dir: %s\n", state.cfg.dir);
+        fprintf(f, "current dir: %s\n", getcwd(cwd, sizeof(cwd)) ?: "?");
+        fprintf(f, "game dir: %s\n", realpath(game, path) ?: game);
+        fprintf(f, "uid/gid: %d/%d\n", (int)(getuid()), (int)(getgid()));
+        fprintf(f, "\nenvironment:\n");
+        for (char **e = environ; *e; e++) {
+            if (starts_with(*e, "NSWRAP_") || starts_with(*e, "WINE") || starts_with(*e, "OTEL_") || starts_with(*e, "LANG") || starts_with(*e, "LC_") || starts_with(*e, "TZ=") || starts_with(*e, "DOCKER=")) {
+                support_sanitize(f, *e);
+                fputc('\n', f);
+            }
+        }
+        fprintf(f, "\nstartup args:\n");
+        snprintf(fn, sizeof(fn), "%s/ns_startup_args_dedi.txt", game);
+        support_tail(f, fn, lines, true);
+        snprintf(fn, sizeof(fn), "%s/ns_startup_args.txt", game);
+        support_tail(f, fn, lines, true);
+        fclose(f);
+    }
+
+    /* runtime */
+    NSLOG_INF("gathering runtime info");
+    if ((f = support_open(dir, "runtime.txt"))) {
+        static const char *const paths[] = {"bin/wine64", "bin/wine64-preloader", "bin/wineserver", "lib64/wine/x86_64-unix", "lib64/wine/x86_64-windows", "prefix", "prefix/nswine.json", NULL};
+        fprintf(f, "runtime files:\n");
+        for (const char *const *p = paths; *p; p++) {
+            snprintf(fn, sizeof(fn), "%s/%s", state.cfg.dir, *p);
+            fprintf(f, "- %s: %s\n", *p, access(fn, R_OK) == -1 ? strerror(errno) : "ok");
+        }
+        fprintf(f, "\nmanifest:\n");
+        snprintf(fn, sizeof(fn), "%s/prefix/nswine.json", state.cfg.dir);
+        FILE *in = fopen(fn, "re");
+        if (in) {
+            char *line = NULL;
+            size_t cap = 0;
+            while (getline(&line, &cap, in) != -1) {
+                char *p = line + strspn(line, " \t");
+                if (starts_with(p, "\"compat\":") || starts_with(p, "\"wine_build_id\":") || starts_with(p, "\"component\":") || starts_with(p, "\"reason\":") || starts_with(p, "\"effect\":")) {
+                    fputs(p, f);
+                }
+            }
+            free(line);
+            fclose(in);
+        } else {
+            fprintf(f, "(failed to open %s: %s)\n", fn, strerror(errno));
+        }
+        fclose(f);
+    }
+
+    /* host */
+    NSLOG_INF("gathering host info");
+    if ((f = support_open(dir, "host.txt"))) {
+        struct sysinfo sinfo;
+        struct utsname uinfo;
+        if (uname(&uinfo) != -1) {
+            fprintf(f, "kernel: %s %s %s %s\n", uinfo.sysname, uinfo.release, uinfo.version, uinfo.machine); // no nodename
+        }
+        fprintf(f, "processor: %d cores\n", nprocs());
+        if (sysinfo(&sinfo) != -1) {
+            fprintf(f, "memory: %ld total, %ld free, %ld shared, %ld buffer\n", sinfo.totalram*sinfo.mem_unit, sinfo.freeram*sinfo.mem_unit, sinfo.sharedram*sinfo.mem_unit, sinfo.bufferram*sinfo.mem_unit);
+            fprintf(f, "swap: %ld total, %ld free\n", sinfo.totalswap*sinfo.mem_unit, sinfo.freeswap*sinfo.mem_unit);
+            fprintf(f, "uptime: %lds\n", sinfo.uptime);
+            fprintf(f, "load: %.2f %.2f %.2f\n", sinfo.loads[0] / 65536.0, sinfo.loads[1] / 65536.0, sinfo.loads[2] / 65536.0);
+        }
+        static const struct { int res; const char *name; } limits[] = {
+            {RLIMIT_NOFILE, "nofile"},
+            {RLIMIT_NPROC, "nproc"},
+            {RLIMIT_AS, "as"},
+            {RLIMIT_CORE, "core"},
+        };
+        for (size_t i = 0; i < sizeof(limits)/sizeof(*limits); i++) {
+            struct rlimit rl;
+            if (getrlimit(limits[i].res, &rl) != -1) {
+                fprintf(f, "rlimit %s: %lld %lld\n", limits[i].name, rl.rlim_cur == RLIM_INFINITY ? -1LL : (long long)(rl.rlim_cur), rl.rlim_max == RLIM_INFINITY ? -1LL : (long long)(rl.rlim_max));
+            }
+        }
+        static const char *const files[] = {"/proc/self/cgroup", "/proc/sys/kernel/core_pattern", "/proc/sys/vm/overcommit_memory", "/proc/sys/vm/max_map_count", "/etc/os-release", NULL};
+        for (const char *const *p = files; *p; p++) {
+            fprintf(f, "\n%s:\n", *p);
+            support_tail(f, *p, 100, false);
+        }
+        fclose(f);
+    }
+
+    /* health */
+    NSLOG_INF("gathering health snapshot");
+    if ((f = support_open(dir, "health.txt"))) {
+        fprintf(f, "nswrap processes:\n");
+        DIR *dp = opendir("/proc");
+        if (dp) {
+            struct dirent *de;
+            while ((de = readdir(dp))) {
+                if (!isdigit((unsigned char)(*de->d_name))) {
+                    continue;
+                }
+                snprintf(fn, sizeof(fn), "/proc/%s/cmdline", de->d_name);
+                int fd = open(fn, O_RDONLY | O_CLOEXEC);
+                if (fd == -1) {
+                    continue;
+                }
+                char title[512];
+                ssize_t n = read(fd, title, sizeof(title)-1);
+                close(fd);
+                if (n > 0) {
+                    title[n] = '\0';
+                    if (starts_with(title, "northstar")) {
+                        fprintf(f, "- %s: ", de->d_name); // the process title has the status
+                        support_sanitize(f, title);
+                        fputc('\n', f);
+                    }
+                }
+            }
+            closedir(dp);
+        }
+        if (*state.cfg.instance) {
+            struct stat statbuf;
+            fprintf(f, "\ninstance dir: %s\n", state.cfg.instance);
+            snprintf(fn, sizeof(fn), "%s/instance", state.cfg.instance);
+            int fd = open(fn, O_RDONLY | O_CLOEXEC);
+            if (fd == -1) {
+                fprintf(f, "- lock: %s\n", strerror(errno));
+            } else {
+                fprintf(f, "- in use: %s\n", flock(fd, LOCK_SH | LOCK_NB) == -1 && errno == EWOULDBLOCK ? "yes" : "no");
+                if (fstat(fd, &statbuf) != -1) {
+                    fprintf(f, "- last used: %lds ago\n", (long)(time(NULL) - statbuf.st_mtime));
+                }
+                char exe[PATH_MAX];
+                ssize_t n = read(fd, exe, sizeof(exe)-1);
+                if (n > 0) {
+                    exe[n] = '\0';
+                    fprintf(f, "- game: %s", exe);
+                }
+                close(fd);
+            }
+            snprintf(fn, sizeof(fn), "%s/prepared", state.cfg.instance);
+            fprintf(f, "- pre-instantiated: %s\n", access(fn, F_OK) == -1 ? "no" : "yes");
+            fprintf(f, "- disk usage: %.1f MiB\n", du(state.cfg.instance) / 1048576.0);
+            if (state.cfg.quota) {
+                fprintf(f, "- quota: %.1f MiB\n", state.cfg.quota / 1048576.0);
+            }
+        }
+        fclose(f);
+    }
+
+    /* logs and crashes */
+    NSLOG_INF("gathering logs and crash fingerprints");
+    if ((f = support_open(dir, "crashes.txt"))) {
+        char logs[PATH_MAX];
+        snprintf(logs, sizeof(logs), "%s/R2Northstar/logs", game);
+        struct { char name[256]; struct timespec mtime; } *ents = NULL;
+        size_t n = 0;
+        DIR *dp = opendir(logs);
+        if (dp) {
+            struct dirent *de;
+            while ((de = readdir(dp))) {
+                struct stat statbuf;
+                snprintf(fn, sizeof(fn), "%s/%s", logs, de->d_name);
+                if (stat(fn, &statbuf) == -1 || !S_ISREG(statbuf.st_mode)) {
+                    continue;
+                }
+                void *tmp = realloc(ents, (n+1) * sizeof(*ents));
+                if (!tmp) {
+                    break;
+                }
+                ents = tmp;
+                snprintf(ents[n].name, sizeof(ents[n].name), "%s", de->d_name);
+                ents[n++].mtime = statbuf.st_mtim;
+            }
+            closedir(dp);
+        } else {
+            fprintf(f, "(failed to open %s: %s)\n", logs, strerror(errno));
+        }
+        qsort(ents, n, sizeof(*ents), support_mtime_cmp);
+
+        fprintf(f, "minidumps (not included, since they contain process memory):\n");
+        for (size_t i = 0; i < n; i++) {
+            size_t len = strlen(ents[i].name);
+            if (len > 4 && !strcasecmp(ents[i].name + len - 4, ".dmp")) {
+                char hash[65];
+                struct stat statbuf;
+                snprintf(fn, sizeof(fn), "%s/%s", logs, ents[i].name);
+                if (stat(fn, &statbuf) == -1 || !sha256_file(fn, hash)) {
+                    continue;
+                }
+                fprintf(f, "- %s: %lld bytes, %lds ago, sha256 %s\n", ents[i].name, (long long)(statbuf.st_size), (long)(time(NULL) - statbuf.st_mtime), hash);
+            }
+        }
+
+        fprintf(f, "\ncrash lines in recent logs:\n");
+        for (size_t i = 0, m = 0; i < n && m < 5; i++) {
+            size_t len = strlen(ents[i].name);
+            if (len > 4 && !strcasecmp(ents[i].name + len - 4, ".txt")) {
+                char dst[PATH_MAX*2];
+                snprintf(fn, sizeof(fn), "%s/%s", logs, ents[i].name);
+                snprintf(dst, sizeof(dst), "logs/%s", ents[i].name);
+                FILE *lf = support_open(dir, dst);
+                if (lf) {
+                    support_tail(lf, fn, lines, true);
+                    fclose(lf);
+                }
+                FILE *in = fopen(fn, "re");
+                if (in) {
+                    char *line = NULL;
+                    size_t cap = 0;
+                    while (getline(&line, &cap, in) != -1) {
+                        if (strcasestr(line, "crash") || strcasestr(line, "exception") || strcasestr(line, "fatal")) {
+                            fprintf(f, "%s: ", ents[i].name);
+                            support_sanitize(f, line);
+                        }
+                    }
+                    free(line);
+                    fclose(in);
+                }
+                m++;
+            }
+        }
+        free(ents);
+        fclose(f);
+    }
+    if (state.cfg.trace_file && *state.cfg.trace_file) {
+        if ((f = support_open(dir, "logs/trace.json"))) {
+            support_tail(f, state.cfg.trace_file, 100, false);
+            fclose(f);
+        }
+    }
+
+    /* archive */
+    {
+        pid_t pid = fork();
+        if (pid == -1) {
+            NSLOG_ERRNO("failed to fork");
+            goto cleanup;
+        }
+        if (pid == 0) {
+            execlp("tar", "tar", "-czf", out, "-C", tmp, "nswrap-support", NULL);
+            NSLOG_ERRNO("failed to execute tar");
+            _exit(127);
+        }
+        int wstatus;
+        if (waitpid(pid, &wstatus, 0) == -1) {
+            NSLOG_ERRNO("failed to wait for tar");
+            goto cleanup;
+        }
+        if (!WIFEXITED(wstatus) || WEXITSTATUS(wstatus)) {
+            NSLOG_ERR("failed to create archive %s", out);
+            goto cleanup;
+        }
+        NSLOG_INF("wrote support bundle to %s (check it for anything sensitive before sharing it)", out);
+    }
+    rc = 0;
+
+cleanup:
+    if (nftw(tmp, instance_rm_fn, 16, FTW_DEPTH | FTW_PHYS)) {
+        NSLOG_WRN("failed to remove temporary dir %s", tmp);
+    }
+    return rc;
+}
+
+/** Write a crash bundle with the recent game output, exit status, and minidumps written since nswrap started. */
+static void crash_write(void) {
+    char dir[PATH_MAX], fn[PATH_MAX*2], ts[32];
+    time_t now = time(NULL);
+    strftime(ts, sizeof(ts), "%Y%m%d-%H%M%S", localtime(&now));
+    if ((size_t)(snprintf(dir, sizeof(dir), "%s/nswrap-crash-%s-%d", state.cfg.crash_dir, ts, (int)(getpid()))) >= sizeof(dir)) {
+        NSLOG_WRN("crash bundle path is too long");
+        return;
+    }
+    if ((mkdir(state.cfg.crash_dir, 0755) == -1 && errno != EEXIST) || mkdir(dir, 0755) == -1) {
+        NSLOG_WRNNO("failed to create crash bundle dir %s", dir);
+        return;
+    }
+    FILE *f;
+    snprintf(fn, sizeof(fn), "%s/crash.txt", dir);
+    if ((f = fopen(fn, "we"))) {
+        char cwd[PATH_MAX];
+        fprintf(f, "time: %s\n", ts);
+        fprintf(f, "game dir: %s\n", getcwd(cwd, sizeof(cwd)) ?: "?");
+        fprintf(f, "instance: %s\n", state.cfg.setproctitle_extra ?: "");
+        fprintf(f, "uptime: %.1fs\n", (trace_now() - state.trace.start) / 1e9);
+        if (state.wine.reaped) {
+            if (WIFSIGNALED(state.wine.wstatus)) {
+                fprintf(f, "exit: signal %d\n", WTERMSIG(state.wine.wstatus));
+            } else {
+                fprintf(f, "exit: status %d\n", WEXITSTATUS(state.wine.wstatus));
+            }
+        }
+        fprintf(f, "quit requested: %s\n", state.quit_requested ? "yes" : "no");
+        fprintf(f, "last title: %s\n", state.io.status.title);
+        fprintf(f, "crash: %s\n", state.crash.reason ?: "(not detected in output)");
+        fclose(f);
+    }
+    snprintf(fn, sizeof(fn), "%s/console.log", dir);
+    if ((f = fopen(fn, "we"))) {
+        for (size_t i = 0; i < NSWRAP_CRASH_LINES; i++) {
+            const char *line = state.crash.line[(state.crash.next + i) % NSWRAP_CRASH_LINES];
+            if (line) {
+                support_sanitize(f, line);
+                fputc('\n', f);
+            }
+        }
+        fclose(f);
+    }
+    int dumps = 0;
+    DIR *dp = opendir("R2Northstar/logs");
+    if (dp) {
+        for (struct dirent *de; (de = readdir(dp)); ) {
+            struct stat statbuf;
+            size_t len = strlen(de->d_name);
+            snprintf(fn, sizeof(fn), "R2Northstar/logs/%s", de->d_name);
+            if (len <= 4 || strcasecmp(de->d_name + len - 4, ".dmp") || stat(fn, &statbuf) == -1 || (uint64_t)(statbuf.st_mtime) < state.trace.start / 1000000000) {
+                continue;
+            }
+            char dst[PATH_MAX*2];
+            snprintf(dst, sizeof(dst), "%s/%s", dir, de->d_name);
+            if (copy_file(fn, dst, 0644)) {
+                dumps++;
+            } else {
+                NSLOG_WRNNO("failed to copy minidump %s to crash bundle", fn);
+            }
+        }
+        closedir(dp);
+    }
+    NSLOG_WRN("wrote crash bundle to %s (%d minidumps)", dir, dumps);
+    otlp_event("crash", state.crash.reason ?: "unexpected exit");
+}
+
+/** Describe a wait status. */
+static void supervise_status(char *buf, size_t n, int wstatus) {
+    if (WIFSIGNALED(wstatus)) {
+        snprintf(buf, n, "signal %d", WTERMSIG(wstatus));
+    } else {
+        snprintf(buf, n, "status %d", WEXITSTATUS(wstatus));
+    }
+}
+
+/** Log a supervisor event as key=value pairs and export it to the otlp endpoint. */
+static __attribute__ ((__format__ (__printf__, 2, 3))) void supervise_event(const char *event, const char *fmt, ...) {
+    char buf[512];
+    va_list a;
+    va_start(a, fmt);
+    vsnprintf(buf, sizeof(buf), fmt, a);
+    va_end(a);
+    if (strcmp(event, "start")) {
+        NSLOG_WRN("supervisor: event=%s %s", event, buf);
+    } else {
+        NSLOG_INF("supervisor: event=%s %s", event, buf);
+    }
+    char name[64];
+    snprintf(name, sizeof(name), "supervisor.%s", event);
+    otlp_event(name, buf);
+}
+
+static int supervise_diag_filter(const struct dirent *d) {
+    return starts_with(d->d_name, "nswrap-crash-") && strlen(d->d_name) > 7 && !strcmp(d->d_name + strlen(d->d_name) - 7, ".tar.gz");
+}
+
+/** Write a support bundle for a game server which exited unexpectedly, removing the oldest ones so there are at most NSWRAP_RESTART_DIAG_KEEP. */
+static void supervise_diag(void) {
+    if (!*state.cfg.restart_diag) {
+        return;
+    }
+    struct dirent **ents;
+    int n = scandir(state.cfg.restart_diag, &ents, supervise_diag_filter, alphasort); // the names sort by time
+    if (n == -1) {
+        NSLOG_WRNNO("supervisor: failed to list support bundles in %s", state.cfg.restart_diag);
+    } else {
+        for (int i = 0; i < n; i++) {
+            if (i <= n - NSWRAP_RESTART_DIAG_KEEP) {
+                char old[PATH_MAX];
+                snprintf(old, sizeof(old), "%s/%s", state.cfg.restart_diag, ents[i]->d_name);
+                if (unlink(old) == -1) {
+                    NSLOG_WRNNO("supervisor: failed to remove old support bundle %s", old);
+                } else {
+                    NSLOG_DBG("supervisor: removed old support bundle %s", old);
+                }
+            }
+            free(ents[i]);
+        }
+        free(ents);
+    }
+    char fn[PATH_MAX], ts[32];
+    time_t now = time(NULL);
+    strftime(ts, sizeof(ts), "%Y%m%d-%H%M%S", localtime(&now));
+    if ((size_t)(snprintf(fn, sizeof(fn), "%s/nswrap-crash-%s.tar.gz", state.cfg.restart_diag, ts)) >= sizeof(fn)) {
+        NSLOG_WRN("supervisor: diagnostics path is too long");
+        return;
+    }
+    NSLOG_INF("supervisor: writing support bundle to %s", fn);
+    pid_t pid = fork();
+    if (pid == -1) {
+        NSLOG_WRNNO("supervisor: failed to write support bundle: fork");
+        return;
+    }
+    if (pid == 0) {
+        sigprocmask(SIG_SETMASK, &state.sig.origset, NULL);
+        execl("/proc/self/exe", "nswrap", "support-bundle", "-o", fn, NULL);
+        _exit(127);
+    }
+    int wstatus;
+    if (waitpid(pid, &wstatus, 0) == -1 || !WIFEXITED(wstatus) || WEXITSTATUS(wstatus)) {
+        NSLOG_WRN("supervisor: failed to write support bundle");
+    }
+}
+
+/** Tell the supervisor (if any) that wine is being started, so it knows a non-zero exit status is from the game server rather than an nswrap configuration error. */
+static void supervise_started(void) {
+    if (state.supervisor_fd != -1) {
+        if (write(state.supervisor_fd, "1", 1) != 1) {
+            NSLOG_WRNNO("failed to notify supervisor that wine was started");
+        }
+        close(state.supervisor_fd);
+        state.supervisor_fd = -1;
+    }
+}
+
+/** Run nswrap in a child process, restarting it with exponential backoff if it exits unexpectedly, returning the exit status. */
+static int supervise_main(char **argv) {
+    setenv("NSWRAP_SUPERVISED", "1", 1);
+
+    sigset_t sigset;
+    sigemptyset(&sigset);
+    sigaddset(&sigset, SIGTERM);
+    sigaddset(&sigset, SIGINT);
+    sigaddset(&sigset, SIGQUIT);
+    sigaddset(&sigset, SIGCHLD);
+    if (sigprocmask(SIG_BLOCK, &sigset, &state.sig.origset) == -1) {
+        NSLOG_ERRNO("supervisor: sigprocmask");
+        return 1;
+    }
+    state.sig.origset_ok = true;
+    int sfd = signalfd(-1, &sigset, SFD_CLOEXEC);
+    if (sfd == -1) {
+        NSLOG_ERRNO("supervisor: signalfd");
+        return 1;
+    }
+
+    char tmp[32];
+    snprintf(tmp, sizeof(tmp), "%llu", (unsigned long long)(trace_now()));
+    setenv("NSWRAP_SUPERVISOR_START", tmp, 1); // for metrics
+
+    bool stopping = false;
+    unsigned restarts = 0, total = 0, backoff = NSWRAP_RESTART_BACKOFF_INITIAL;
+    for (;;) {
+        snprintf(tmp, sizeof(tmp), "%u", total);
+        setenv("NSWRAP_SUPERVISOR_RESTARTS", tmp, 1); // for metrics (unlike restarts, this isn't reset when the game server is stable)
+
+        int started[2];
+        if (pipe2(started, O_CLOEXEC | O_NONBLOCK) == -1) {
+            NSLOG_ERRNO("supervisor: pipe");
+            return 1;
+        }
+        struct timespec ts, tc;
+        clock_gettime(CLOCK_MONOTONIC, &ts);
+        pid_t pid = fork();
+        if (pid == -1) {
+            NSLOG_ERRNO("supervisor: fork");
+            return 1;
+        }
+        if (pid == 0) {
+            sigprocmask(SIG_SETMASK, &state.sig.origset, NULL);
+            snprintf(tmp, sizeof(tmp), "%d", started[1]);
+            setenv("NSWRAP_SUPERVISOR_FD", tmp, 1);
+            fcntl(started[1], F_SETFD, 0);
+            execv("/proc/self/exe", argv);
+            _exit(127);
+        }
+        close(started[1]);
+        supervise_event("start", "pid=%d restarts=%u", (int)(pid), restarts);
+
+        int wstatus = 0;
+        for (bool exited = false; !exited; ) {
+            struct signalfd_siginfo siginfo;
+            if (read(sfd, &siginfo, sizeof(siginfo)) != sizeof(siginfo)) {
+                if (errno != EINTR && errno != EAGAIN) {
+                    NSLOG_ERRNO("supervisor: failed to read signal from signalfd");
+                    return 1;
+                }
+                continue;
+            }
+            if (siginfo.ssi_signo == SIGCHLD) {
+                int ws;
+                for (pid_t rc; (rc = waitpid(-1, &ws, WNOHANG)) > 0; ) {
+                    if (rc == pid) {
+                        wstatus = ws;
+                        exited = true;
+                    }
+                }
+                continue;
+            }
+            stopping = true;
+            if (siginfo.ssi_code != SI_KERNEL) { // tty signals already went to the whole process group
+                kill(pid, (int)(siginfo.ssi_signo));
+            }
+        }
+        clock_gettime(CLOCK_MONOTONIC, &tc);
+
+        char status[32], c;
+        bool wine = read(started[0], &c, 1) == 1;
+        close(started[0]);
+        supervise_status(status, sizeof(status), wstatus);
+        int code = WIFSIGNALED(wstatus) ? 128 + WTERMSIG(wstatus) : WEXITSTATUS(wstatus);
+        if (stopping || (WIFEXITED(wstatus) && (WEXITSTATUS(wstatus) == 0 || !wine))) { // quit, or nswrap failed before starting wine (e.g., invalid arguments or config)
+            supervise_event("exit", "status=\"%s\" uptime=%lds%s", status, (long)(tc.tv_sec - ts.tv_sec), wine ? "" : " reason=\"wine was not started\"");
+            return code;
+        }
+        if (tc.tv_sec - ts.tv_sec >= NSWRAP_RESTART_STABLE) {
+            restarts = 0;
+            backoff = NSWRAP_RESTART_BACKOFF_INITIAL;
+        }
+        supervise_diag();
+        if (restarts >= state.cfg.restart) {
+            supervise_event("give-up", "status=\"%s\" uptime=%lds restarts=%u", status, (long)(tc.tv_sec - ts.tv_sec), restarts);
+            return code;
+        }
+        restarts++;
+        total++;
+        supervise_event("restart", "status=\"%s\" uptime=%lds attempt=%u/%u backoff=%us", status, (long)(tc.tv_sec - ts.tv_sec), restarts, state.cfg.restart, backoff);
+
+        struct pollfd pfd = { .fd = sfd, .events = POLLIN };
+        clock_gettime(CLOCK_MONOTONIC, &ts);
+        for (;;) {
+            clock_gettime(CLOCK_MONOTONIC, &tc);
+            long left = (long)(backoff) * 1000 - ((tc.tv_sec - ts.tv_sec) * 1000 + (tc.tv_nsec - ts.tv_nsec) / 1000000);
+            if (left <= 0) {
+                break;
+            }
+            if (poll(&pfd, 1, (int)(left)) > 0) {
+                struct signalfd_siginfo siginfo;
+                if (read(sfd, &siginfo, sizeof(siginfo)) == sizeof(siginfo) && siginfo.ssi_signo != SIGCHLD) {
+                    supervise_event("exit", "status=\"%s\" reason=\"shutdown signal during backoff\"", status);
+                    return code;
+                }
+                while (waitpid(-1, NULL, WNOHANG) > 0);
+            }
+        }
+        backoff = backoff * 2 > NSWRAP_RESTART_BACKOFF_MAX ? NSWRAP_RESTART_BACKOFF_MAX : backoff * 2;
+    }
+}
+
+/** Write the complete lines of an instance's output with its name as a prefix (or all of it if flush is true), returning the number of bytes consumed. */
+static size_t multi_output(const char *name, const char *buf, size_t n, bool flush) {
+    size_t done = 0;
+    for (size_t i = 0; i < n; i++) {
+        if (buf[i] == '\n' || (flush && i == n - 1)) {
+            if (state.cfg.json) {
+                write(STDOUT_FILENO, buf + done, i + 1 - done); // already has the instance name
+            } else {
+                dprintf(STDOUT_FILENO, "[%s] %.*s%s", name, (int)(i + 1 - done), buf + done, buf[i] == '\n' ? "" : "\n");
+            }
+            done = i + 1;
+        }
+    }
+    return done;
+}
+
+/** Run multiple game server instances from the same runtime, each with its own instance prefix, port, and extra arguments, returning the first non-zero exit status. */
+static int multi_main(int argc, char **argv) {
+    const char *dir = *state.cfg.instance ? state.cfg.instance : NULL;
+    const char *name = state.cfg.setproctitle_extra && *state.cfg.setproctitle_extra ? state.cfg.setproctitle_extra : "ns";
+    unsigned port = NSWRAP_GAME_PORT;
+    int count = 0, opt, game = 1;
+    while (game < argc && strcmp(argv[game], "-dedicated")) {
+        game++; // the game arguments start at -dedicated
+    }
+    while ((opt = getopt(game, argv, "n:d:p:")) != -1) {
+        switch (opt) {
+        case 'n':
+            if ((count = atoi(optarg)) <= 0 || count > 256) {
+                NSLOG_ERR("invalid number of instances %s", optarg);
+                return 2;
+            }
+            break;
+        case 'd':
+            dir = optarg;
+            break;
+        case 'p':
+            if (!(port = strtoul(optarg, NULL, 10)) || port > 65535) {
+                NSLOG_ERR("invalid port %s", optarg);
+                return 2;
             }
+            break;
+        default:
+            goto usage;
         }
-        break;
-    case 3:
-        NSLOG_INF("received third shutdown signal, forcefully terminating");
-        state.force_quit = true;
-        break;
     }
+    if (optind != game || game == argc || !count || !dir) {
+    usage:
+        fprintf(stderr, "usage: %s multi -n count [-d dir] [-p port] -dedicated [args...]\n", argv[0]);
+        fprintf(stderr, "  -n count  number of instances to run\n");
+        fprintf(stderr, "  -d dir    dir to create the instance dirs (named by index) in (default NSWRAP_INSTANCE_DIR)\n");
+        fprintf(stderr, "  -p port   udp port of the first instance, incremented for each one (default %d)\n", NSWRAP_GAME_PORT);
+        fprintf(stderr, "each instance gets the instance name %s<index> (NSWRAP_INSTANCE), and extra arguments from <dir>/<index>/args (one per line, except -port)\n", name);
+        return 2;
+    }
+    if (*dir != '/' || strlen(dir) > 1000) {
+        NSLOG_ERR("instance dir (%s) must be an absolute path and not too long", dir);
+        return 2;
+    }
+    bool has_port = false;
+    for (int i = game; i < argc; i++) {
+        if (!strcmp(argv[i], "-port")) {
+            has_port = true;
+        }
+    }
+    if (has_port && count > 1) {
+        NSLOG_ERR("-port can't be used with multiple instances (use -p)");
+        return 2;
+    }
+
+    sigset_t sigset;
+    sigemptyset(&sigset);
+    sigaddset(&sigset, SIGTERM);
+    sigaddset(&sigset, SIGINT);
+    sigaddset(&sigset, SIGQUIT);
+    sigaddset(&sigset, SIGCHLD);
+    if (sigprocmask(SIG_BLOCK, &sigset, &state.sig.origset) == -1) {
+        NSLOG_ERRNO("sigprocmask");
+        return 1;
+    }
+    state.sig.origset_ok = true;
+    int sfd = signalfd(-1, &sigset, SFD_CLOEXEC);
+    if (sfd == -1) {
+        NSLOG_ERRNO("signalfd");
+        return 1;
+    }
+
+    struct {
+        char name[64];
+        pid_t pid; // 0 once reaped
+        int fd; // -1 once closed
+        int wstatus;
+        size_t n;
+        char buf[NSWRAP_IOPROC_OUTPUT_CHUNK_SIZE];
+    } *inst = calloc(count, sizeof(*inst));
+    struct pollfd *pfds = calloc(count + 1, sizeof(*pfds));
+    if (!inst || !pfds) {
+        NSLOG_ERRNO("failed to allocate instances");
+        free(inst);
+        free(pfds);
+        return 1;
+    }
+    for (int i = 0; i < count; i++) {
+        inst[i].fd = -1;
+    }
+    int running = 0, rc = 0;
+    for (int i = 0; i < count; i++) {
+        char idir[PATH_MAX], tmp[PATH_MAX+16];
+        snprintf(inst[i].name, sizeof(inst[i].name), "%s%d", name, i);
+        snprintf(idir, sizeof(idir), "%s/%d", dir, i);
+        if ((mkdir(dir, 0755) == -1 && errno != EEXIST) || (mkdir(idir, 0755) == -1 && errno != EEXIST)) {
+            NSLOG_ERRNO("failed to create instance dir %s", idir);
+            rc = 1;
+            break;
+        }
+
+        // arguments: the game ones, the port, then the extra ones for the instance
+        size_t nargs = 0, cap = (size_t)(argc - game) + 8;
+        char **args = malloc(cap * sizeof(*args));
+        if (!args) {
+            NSLOG_ERRNO("failed to allocate arguments for %s", inst[i].name);
+            rc = 1;
+            break;
+        }
+        args[nargs++] = strdup("nswrap");
+        for (int j = game; j < argc; j++) {
+            args[nargs++] = strdup(argv[j]);
+        }
+        if (!has_port) {
+            snprintf(tmp, sizeof(tmp), "%u", port + (unsigned)(i));
+            args[nargs++] = strdup("-port");
+            args[nargs++] = strdup(tmp);
+        }
+        snprintf(tmp, sizeof(tmp), "%s/args", idir);
+        FILE *af = fopen(tmp, "re");
+        if (af) {
+            char *line = NULL;
+            size_t lcap = 0;
+            ssize_t len;
+            while ((len = getline(&line, &lcap, af)) != -1) {
+                while (len && (line[len-1] == '\n' || line[len-1] == '\r')) {
+                    line[--len] = '\0';
+                }
+                if (!len) {
+                    continue;
+                }
+                if (!strcmp(line, "-port")) {
+                    NSLOG_ERR("%s: -port can't be set for an instance (use -p)", tmp);
+                    rc = 2;
+                    break;
+                }
+                if (nargs + 1 >= cap) {
+                    char **p = realloc(args, cap * 2 * sizeof(*args));
+                    if (!p) {
+                        NSLOG_ERRNO("failed to allocate arguments for %s", inst[i].name);
+                        rc = 1;
+                        break;
+                    }
+                    args = p;
+                    cap *= 2;
+                }
+                args[nargs++] = strdup(line);
+            }
+            free(line);
+            fclose(af);
+        }
+        args[nargs] = NULL;
+        for (size_t j = 0; !rc && j < nargs; j++) {
+            if (!args[j]) {
+                NSLOG_ERR("failed to allocate arguments for %s", inst[i].name);
+                rc = 1;
+            }
+        }
+
+        int pfd[2] = {-1, -1};
+        pid_t pid = -1;
+        if (!rc && pipe2(pfd, O_CLOEXEC) == -1) {
+            NSLOG_ERRNO("failed to create output pipe for %s", inst[i].name);
+            rc = 1;
+        }
+        if (!rc && (pid = fork()) == -1) {
+            NSLOG_ERRNO("failed to start %s: fork", inst[i].name);
+            close(pfd[0]);
+            close(pfd[1]);
+            rc = 1;
+        }
+        if (pid == 0) {
+            sigprocmask(SIG_SETMASK, &state.sig.origset, NULL);
+            int null = open("/dev/null", O_RDONLY);
+            dup2(null, STDIN_FILENO); // there's no way to tell which instance input is for
+            dup2(pfd[1], STDOUT_FILENO);
+            dup2(pfd[1], STDERR_FILENO);
+            setenv("NSWRAP_INSTANCE_DIR", idir, 1);
+            setenv("NSWRAP_INSTANCE", inst[i].name, 1);
+            const char *health = getenv("NSWRAP_HEALTH_ADDR");
+            const char *hport = health ? strrchr(health, ':') : NULL;
+            if (hport) {
+                snprintf(tmp, sizeof(tmp), "%.*s:%d", (int)(hport - health), health, atoi(hport + 1) + i);
+                setenv("NSWRAP_HEALTH_ADDR", tmp, 1);
+            }
+            execv("/proc/self/exe", args);
+            _exit(127);
+        }
+        for (size_t j = 0; j < nargs; j++) {
+            free(args[j]);
+        }
+        free(args);
+        if (rc) {
+            break;
+        }
+        close(pfd[1]);
+        inst[i].pid = pid;
+        inst[i].fd = pfd[0];
+        running++;
+        NSLOG_INF("started %s (pid=%d, dir=%s)", inst[i].name, (int)(pid), idir);
+    }
+    if (rc) {
+        for (int i = 0; i < count; i++) {
+            if (inst[i].pid) {
+                kill(inst[i].pid, SIGTERM);
+            }
+        }
+    }
+
+    while (running) {
+        pfds[0] = (struct pollfd){ .fd = sfd, .events = POLLIN };
+        for (int i = 0; i < count; i++) {
+            pfds[i+1] = (struct pollfd){ .fd = inst[i].fd, .events = POLLIN };
+        }
+        if (poll(pfds, count + 1, -1) == -1) {
+            if (errno == EINTR) {
+                continue;
+            }
+            NSLOG_ERRNO("poll failed");
+            break;
+        }
+        for (int i = 0; i < count; i++) {
+            if (inst[i].fd == -1 || !(pfds[i+1].revents & (POLLIN | POLLHUP))) {
+                continue;
+            }
+            ssize_t n = read(inst[i].fd, inst[i].buf + inst[i].n, sizeof(inst[i].buf) - inst[i].n);
+            if (n > 0) {
+                inst[i].n += (size_t)(n);
+                size_t done = multi_output(inst[i].name, inst[i].buf, inst[i].n, inst[i].n == sizeof(inst[i].buf));
+                memmove(inst[i].buf, inst[i].buf + done, inst[i].n - done);
+                inst[i].n -= done;
+            } else if (n == 0 || (errno != EINTR && errno != EAGAIN)) {
+                multi_output(inst[i].name, inst[i].buf, inst[i].n, true);
+                inst[i].n = 0;
+                close(inst[i].fd);
+                inst[i].fd = -1;
+            }
+        }
+        if (pfds[0].revents & POLLIN) {
+            struct signalfd_siginfo siginfo;
+            if (read(sfd, &siginfo, sizeof(siginfo)) != sizeof(siginfo)) {
+                continue;
+            }
+            if (siginfo.ssi_signo == SIGCHLD) {
+                int ws;
+                for (pid_t pid; (pid = waitpid(-1, &ws, WNOHANG)) > 0; ) {
+                    for (int i = 0; i < count; i++) {
+                        if (inst[i].pid == pid) {
+                            char status[32];
+                            supervise_status(status, sizeof(status), ws);
+                            if (WIFEXITED(ws) && !WEXITSTATUS(ws)) {
+                                NSLOG_INF("%s exited with %s", inst[i].name, status);
+                            } else {
+                                NSLOG_WRN("%s exited with %s", inst[i].name, status);
+                                if (!rc) {
+                                    rc = WIFSIGNALED(ws) ? 128 + WTERMSIG(ws) : WEXITSTATUS(ws);
+                                }
+                            }
+                            inst[i].pid = 0;
+                            running--;
+                        }
+                    }
+                }
+            } else if (siginfo.ssi_code != SI_KERNEL) { // tty signals already went to the whole process group
+                for (int i = 0; i < count; i++) {
+                    if (inst[i].pid) {
+                        kill(inst[i].pid, (int)(siginfo.ssi_signo));
+                    }
+                }
+            }
+        }
+    }
+    for (int i = 0; i < count; i++) {
+        if (inst[i].fd != -1) {
+            multi_output(inst[i].name, inst[i].buf, inst[i].n, true);
+            close(inst[i].fd);
+        }
+    }
+    free(pfds);
+    free(inst);
+    return rc;
 }
 
 int main(int argc, char **argv) {
+    state.trace.start = trace_now();
+    trace_id(state.trace.id, 16);
+    trace_id(state.trace.root, 8);
+    trace_begin("setup");
     state.cfg.istty = isatty(STDOUT_FILENO); // whether we'll write ansi escapes to stdout, etc
     state.cfg.level = strcmp(getenv("NSWRAP_DEBUG") ?: "", "1") ? nslog_inf : nslog_dbg; // whether to show debug logs
     state.cfg.setproctitle = strcmp(getenv("NSWRAP_NOPROCTITLE") ?: "", "1"); // don't update the process title
@@ -807,6 +4588,68 @@ int main(int argc, char **argv) {
     state.cfg.extwine = !strcmp(getenv("NSWRAP_EXTWINE") ?: "", "1"); // whether to use the system wine (from PATH and the WINE* env vars) instead of the built-in one
     state.cfg.nowatchdogquit = !strcmp(getenv("NSWRAP_NOWATCHDOGQUIT") ?: "", "1"); // don't force-quit on watchdog trigger
     state.cfg.color = !strcmp(getenv("NSWRAP_COLOR") ?: (state.cfg.istty ? "1" : "0"), "1"); // force enable/disable color (defaults to whether stdout is a tty)
+    state.cfg.json = !strcmp(getenv("NSWRAP_LOG_FORMAT") ?: "", "json"); // write nswrap logs and game output as json lines (like slog), classified by source (nswrap, wine, game), channel, and level
+    if (state.cfg.json) {
+        state.cfg.istty = false; // no title escapes
+        state.cfg.color = false;
+    }
+    state.cfg.log_nosuppress = !strcmp(getenv("NSWRAP_LOG_NOSUPPRESS") ?: "", "1"); // don't suppress the built-in list of known-harmless wine debug output (it's never suppressed if NSWRAP_DEBUG is set)
+    state.cfg.log_suppress = getenv("NSWRAP_LOG_SUPPRESS"); // additional semicolon-separated wine debug output prefixes to suppress (class:channel:message without the thread id, e.g., "fixme:d3d:;err:ole:CoGetClassObject")
+    if (state.cfg.level == nslog_dbg) {
+        state.cfg.log_nosuppress = true;
+        state.cfg.log_suppress = NULL;
+    }
+    state.cfg.crash_dir = getenv("NSWRAP_CRASH_DIR"); // write a crash bundle (recent console output including wine backtraces, exit status, and new minidumps from R2Northstar/logs) to a new dir in this dir if the game crashes or exits unexpectedly
+    if (state.cfg.crash_dir && !*state.cfg.crash_dir) {
+        state.cfg.crash_dir = NULL;
+    }
+    state.cfg.log_lines = state.cfg.json || !state.cfg.log_nosuppress || (state.cfg.log_suppress && *state.cfg.log_suppress) || state.cfg.crash_dir;
+    state.cfg.exe = getenv("NSWRAP_EXE") ?: "NorthstarLauncher.exe"; // the game executable to run (mostly for testing with other console servers)
+    state.cfg.nss_wrapper = getenv("NSWRAP_NSS_WRAPPER"); // path to libnss_wrapper.so to use if the current uid/gid doesn't have a passwd/group entry
+    state.cfg.env = getenv("NSWRAP_ENV"); // semicolon-separated env vars to pass to wine (which makes them part of the windows environment) instead of filtering them out: NAME, NAME=NEW to rename it, PREFIX* for all vars starting with PREFIX, or PREFIX*=NEWPREFIX* to replace the prefix (e.g., "NS_*=*;TZ")
+    state.cfg.components = getenv("NSWRAP_COMPONENTS") ?: ""; // comma-separated optional components (see components.tsv in the prefix) to install into the instance dir (or the runtime without one) before starting wine
+    state.cfg.component_source = getenv("NSWRAP_COMPONENT_SOURCE"); // base URL or path to get optional components from (named by their sha256 hash) instead of the source in the manifest
+    state.cfg.instance = getenv("NSWRAP_INSTANCE_DIR") ?: ""; // create a per-instance prefix in this dir instead of using the runtime prefix directly (only registry changes are persisted)
+    state.cfg.quota = parse_size(getenv("NSWRAP_INSTANCE_QUOTA") ?: "0"); // max disk usage of the instance dir (e.g., 512M), checked periodically (the game server is stopped if it stays exceeded)
+    state.cfg.quota_projid = strtoul(getenv("NSWRAP_INSTANCE_PROJID") ?: "0", NULL, 10); // set this project id on the instance dir (with inheritance) so filesystem project quotas apply
+    state.cfg.reflink = !strcmp(getenv("NSWRAP_INSTANCE_REFLINK") ?: "", "1"); // reflink files from the runtime prefix into the instance prefix (so they're private but share storage) instead of symlinking them, if the filesystem supports it
+    state.cfg.readonly = !strcmp(getenv("NSWRAP_READONLY") ?: "", "1"); // the runtime is mounted read-only, so always use an instance prefix (in TMPDIR if NSWRAP_INSTANCE_DIR isn't set), and check that nothing wine writes to is in the runtime
+    if (state.cfg.readonly && !*state.cfg.instance) {
+        static char instance[PATH_MAX];
+        snprintf(instance, sizeof(instance), "%s/nswrap-instance%s%s", getenv("TMPDIR") ?: "/tmp", state.cfg.setproctitle_extra ? "-" : "", state.cfg.setproctitle_extra ?: "");
+        state.cfg.instance = instance;
+    }
+    state.cfg.cow = !strcmp(getenv("NSWRAP_INSTANCE_COW") ?: "", "1"); // make the instance prefix copy-on-write by mounting it as an overlay of the runtime prefix (needs CAP_SYS_ADMIN), falling back to reflinks, then to copying the files in parallel
+    state.cfg.nocompatcheck = !strcmp(getenv("NSWRAP_NOCOMPATCHECK") ?: "", "1"); // only warn instead of failing if the runtime was built by an incompatible nswine version
+    state.cfg.trace_file = getenv("NSWRAP_TRACE_FILE"); // append the startup time breakdown (setup, instance, wineserver, load, ready) to this file as otlp json traces
+    state.cfg.otlp_endpoint = getenv("NSWRAP_OTLP_ENDPOINT") ?: getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); // otlp/http base url (e.g., http://localhost:4318) to export startup and supervisor event traces and metrics to using curl
+    if (state.cfg.otlp_endpoint && !*state.cfg.otlp_endpoint) {
+        state.cfg.otlp_endpoint = NULL;
+    }
+    state.cfg.service = getenv("NSWRAP_SERVICE"); // run the game executable as a windows service with this name (registered in the prefix and started/stopped with sc.exe through services.exe) for tools which only work under the service control manager (the output is still shown, but since services don't have a console title, the watchdog is disabled)
+    if (state.cfg.service && !*state.cfg.service) {
+        state.cfg.service = NULL;
+    }
+    state.cfg.shutdown_grace = getenv("NSWRAP_SHUTDOWN_GRACE") ? strtoul(getenv("NSWRAP_SHUTDOWN_GRACE"), NULL, 10) : NSWRAP_SHUTDOWN_GRACE; // seconds to wait for the game server to quit after the first shutdown signal before killing all wine processes with wineserver -k (0 to wait for further signals instead) (the container stop timeout should be at least this plus 10s for the wineserver to exit)
+    state.cfg.restart = strtoul(getenv("NSWRAP_RESTART") ?: "0", NULL, 10); // run in supervisor mode, restarting the game server up to this many consecutive times with exponential backoff if it exits unexpectedly
+    state.cfg.restart_diag = getenv("NSWRAP_RESTART_DIAG") ?: (getenv("NSWRAP_INSTANCE_DIR") ?: "/tmp"); // write a support bundle to this dir (defaults to the instance dir, or /tmp) before restarting the game server in supervisor mode, keeping the newest few (empty to disable)
+    state.cfg.health_addr = getenv("NSWRAP_HEALTH_ADDR"); // serve /healthz and /readyz (for container health checks) and /metrics (for prometheus) over http on this [ipv4]:port (e.g., :8080)
+    if (state.cfg.health_addr && !*state.cfg.health_addr) {
+        state.cfg.health_addr = NULL;
+    }
+    state.health.port = strtoul(getenv("NSWRAP_HEALTH_UDP_PORT") ?: "0", NULL, 10); // the game server udp port to check for /readyz (defaults to the -port argument, or 37015)
+    state.quota.tfd = -1;
+    state.otlp.tfd = -1;
+    state.sig.grace_tfd = -1;
+    state.health.fd = -1;
+    state.supervisor_fd = -1;
+
+    /* subcommands */
+    if (argc > 1 && !strcmp(argv[1], "gc")) {
+        return gc_main(argc - 1, argv + 1);
+    }
+    bool instantiate = argc > 1 && !strcmp(argv[1], "instantiate"); // after the runtime dir is resolved
+    bool multi = argc > 1 && !strcmp(argv[1], "multi"); // likewise
 
     /* get runtime dir */
     if (getenv("NSWRAP_RUNTIME")) {
@@ -838,6 +4681,9 @@ int main(int argc, char **argv) {
         }
         setenv("NSWRAP_RUNTIME", state.cfg.dir, 1);
     }
+    if (argc > 1 && !strcmp(argv[1], "support-bundle")) {
+        return support_bundle_main(argc - 1, argv + 1); // before validation, since it's most useful when something is broken
+    }
 
     /* validate runtime dir */
     {
@@ -882,12 +4728,95 @@ int main(int argc, char **argv) {
                 goto cleanup;
             }
             snprintf(tmp, sizeof(tmp), "%s/prefix", state.cfg.dir);
-            if (access(tmp, R_OK|W_OK|X_OK) == -1) {
-                NSLOG_ERRNO("runtime dir must contain writable wineprefix directory 'prefix' (%s) unless NSWRAP_EXTWINE is set", tmp);
+            if (access(tmp, *state.cfg.instance || instantiate || multi ? R_OK|X_OK : R_OK|W_OK|X_OK) == -1) {
+                NSLOG_ERRNO("runtime dir must contain %swineprefix directory 'prefix' (%s) unless NSWRAP_EXTWINE is set", *state.cfg.instance || instantiate || multi ? "" : "writable ", tmp);
                 goto cleanup;
             }
+            int compat;
+            if (!runtime_manifest(&compat)) {
+                NSLOG_WRN("runtime dir does not contain an nswine manifest 'prefix/nswine.json', so runtime compatibility can't be checked");
+            } else if (compat != NSWRAP_RUNTIME_COMPAT) {
+                if (!state.cfg.nocompatcheck) {
+                    NSLOG_ERR("runtime compatibility version %d does not match nswrap (%d), use the nswrap from the same build as the runtime (or set NSWRAP_NOCOMPATCHECK=1 to ignore this)", compat, NSWRAP_RUNTIME_COMPAT);
+                    goto cleanup;
+                }
+                NSLOG_WRN("runtime compatibility version %d does not match nswrap (%d), things may break", compat, NSWRAP_RUNTIME_COMPAT);
+            }
+            if (*state.runtime.locale) {
+                locale_t l = newlocale(LC_ALL_MASK, state.runtime.locale, (locale_t)(0));
+                if (l) {
+                    freelocale(l);
+                } else {
+                    NSLOG_WRN("runtime locale %s is not installed, so wine will use en-US instead", state.runtime.locale);
+                    state.runtime.locale[0] = '\0';
+                }
+            }
+        }
+    }
+
+    /* validate instance dir */
+    if (*state.cfg.instance) {
+        if (*state.cfg.instance != '/') {
+            NSLOG_ERR("instance dir (%s) must be an absolute path", state.cfg.instance);
+            goto cleanup;
+        }
+        if (strlen(state.cfg.instance) > 1024) {
+            NSLOG_ERR("instance dir (%s) is too long", state.cfg.instance);
+            goto cleanup;
+        }
+    } else if (state.cfg.quota || state.cfg.quota_projid) {
+        NSLOG_WRN("instance quotas are only supported with NSWRAP_INSTANCE_DIR");
+        state.cfg.quota = 0;
+        state.cfg.quota_projid = 0;
+    }
+    if (getenv("NSWRAP_SHUTDOWN_GRACE")) {
+        const char *v = getenv("NSWRAP_SHUTDOWN_GRACE");
+        if (!*v || v[strspn(v, "0123456789")] || strlen(v) > 4) {
+            NSLOG_ERR("invalid shutdown grace period %s", v);
+            goto cleanup;
         }
     }
+    if (getenv("NSWRAP_INSTANCE_QUOTA") && !state.cfg.quota && *state.cfg.instance) {
+        NSLOG_ERR("invalid instance quota %s", getenv("NSWRAP_INSTANCE_QUOTA"));
+        goto cleanup;
+    }
+    if (*state.cfg.instance || instantiate) {
+        const char *template = state.cfg.extwine ? getenv("WINEPREFIX") : NULL;
+        if (state.cfg.extwine && !template) {
+            NSLOG_ERR("since NSWRAP_EXTWINE is enabled, WINEPREFIX must be set");
+            goto cleanup;
+        }
+        ssize_t n = template
+            ? snprintf(state.inst.template, sizeof(state.inst.template), "%s", template)
+            : snprintf(state.inst.template, sizeof(state.inst.template), "%s/prefix", state.cfg.dir);
+        if (n == -1 || n >= (ssize_t)(sizeof(state.inst.template))) {
+            NSLOG_ERR("template prefix path is too long");
+            goto cleanup;
+        }
+    }
+    if (instantiate) {
+        return instantiate_main(argc - 1, argv + 1);
+    }
+    if (multi) {
+        return multi_main(argc - 1, argv + 1);
+    }
+
+    /* supervisor */
+    if (getenv("NSWRAP_SUPERVISOR_FD")) {
+        state.supervisor_fd = atoi(getenv("NSWRAP_SUPERVISOR_FD"));
+        fcntl(state.supervisor_fd, F_SETFD, FD_CLOEXEC); // so wineserver and wine don't keep it open
+        unsetenv("NSWRAP_SUPERVISOR_FD");
+    }
+    if (getenv("NSWRAP_SUPERVISOR_START")) {
+        state.supervisor_start = strtoull(getenv("NSWRAP_SUPERVISOR_START"), NULL, 10);
+        state.supervisor_restarts = strtoul(getenv("NSWRAP_SUPERVISOR_RESTARTS") ?: "0", NULL, 10);
+        unsetenv("NSWRAP_SUPERVISOR_START"); // so they don't leak into wine
+        unsetenv("NSWRAP_SUPERVISOR_RESTARTS");
+    }
+    if (state.cfg.restart && strcmp(getenv("NSWRAP_SUPERVISED") ?: "", "1")) {
+        NSLOG_INF("supervisor: restarting the game server up to %u times if it exits unexpectedly", state.cfg.restart);
+        return supervise_main(argv);
+    }
 
     /* arguments, setproctitle */
     {
@@ -913,12 +4842,15 @@ int main(int argc, char **argv) {
     }
 
     /* valid current dir */
-    if (access("NorthstarLauncher.exe", F_OK)) {
+    if (strchr(state.cfg.exe, '/') || access(state.cfg.exe, F_OK)) {
         char tmp[1024];
-        NSLOG_ERR("NorthstarLauncher.exe does not exist in the current directory (%s)", getcwd(tmp, sizeof(tmp)) ?: "?");
+        NSLOG_ERR("%s does not exist in the current directory (%s)", state.cfg.exe, getcwd(tmp, sizeof(tmp)) ?: "?");
         goto cleanup;
     }
 
+    /* identity */
+    setup_identity();
+
     /* info */
     {
         NSLOG_INF("nswrap v2");
@@ -934,8 +4866,58 @@ int main(int argc, char **argv) {
         NSLOG_INF("- %s update process name (instance label: %s)",
             state.cfg.setproctitle ? "will" : "will not", state.cfg.setproctitle_extra ?: "none");
         NSLOG_INF("- using %s wine64", state.cfg.extwine ? "external" : "built-in");
-        NSLOG_INF("- using watchdog initial=%ds interval=%ds no_exit=%s", NSWRAP_WATCHDOG_TIMEOUT_INITIAL, NSWRAP_WATCHDOG_TIMEOUT, state.cfg.nowatchdogquit ? "yes" : "no");
-        NSLOG_INF("- using watchdog title regexp: %s", NSWRAP_STATUS_RE_REGEXP);
+        NSLOG_INF("- running %s", state.cfg.exe);
+        if (state.cfg.service) {
+            NSLOG_INF("- running as service %s", state.cfg.service);
+        }
+        if (*state.runtime.locale || *state.runtime.tz) {
+            NSLOG_INF("- using runtime locale %s and timezone %s", *state.runtime.locale ? state.runtime.locale : "(default)", *state.runtime.tz ? state.runtime.tz : "(default)");
+        }
+        if (state.cfg.env && *state.cfg.env) {
+            NSLOG_INF("- mapping env vars into the windows environment using %s", state.cfg.env);
+        }
+        if (*state.cfg.components) {
+            NSLOG_INF("- using optional components %s (source: %s)", state.cfg.components, state.cfg.component_source ?: "manifest");
+        }
+        if (*state.cfg.instance) {
+            NSLOG_INF("- using instance prefix in %s (template: %s)", state.cfg.instance, state.inst.template);
+            if (state.cfg.readonly) {
+                NSLOG_INF("- runtime is read-only");
+            }
+            if (state.cfg.cow) {
+                NSLOG_INF("- using copy-on-write instance prefix (overlayfs, reflinks, or copies)");
+            }
+            if (state.cfg.quota) {
+                NSLOG_INF("- using instance disk quota %.1f MiB (interval=%ds, grace=%ds)", state.cfg.quota / 1048576.0, NSWRAP_QUOTA_INTERVAL, NSWRAP_QUOTA_GRACE);
+            }
+            if (state.cfg.quota_projid) {
+                NSLOG_INF("- using instance project id %u", state.cfg.quota_projid);
+            }
+        }
+        if (state.cfg.otlp_endpoint) {
+            NSLOG_INF("- exporting traces and metrics to otlp endpoint %s (interval=%ds)", state.cfg.otlp_endpoint, NSWRAP_OTLP_INTERVAL);
+        }
+        if (state.cfg.health_addr) {
+            NSLOG_INF("- serving health endpoint and metrics on %s", state.cfg.health_addr);
+        }
+        if (state.cfg.crash_dir) {
+            NSLOG_INF("- writing crash bundles to %s", state.cfg.crash_dir);
+        }
+        NSLOG_INF("- %s suppress known-harmless wine debug output", state.cfg.log_nosuppress ? "will not" : "will");
+        if (state.cfg.log_suppress && *state.cfg.log_suppress) {
+            NSLOG_INF("- will also suppress wine debug output starting with %s", state.cfg.log_suppress);
+        }
+        if (state.cfg.shutdown_grace) {
+            NSLOG_INF("- using shutdown grace period %us (the stop timeout should be at least %us)", state.cfg.shutdown_grace, state.cfg.shutdown_grace + NSWRAP_WINESERVER_TIMEOUT);
+        } else {
+            NSLOG_INF("- not using a shutdown grace period");
+        }
+        if (state.cfg.service) {
+            NSLOG_INF("- not using watchdog since services don't have a console title");
+        } else {
+            NSLOG_INF("- using watchdog initial=%ds interval=%ds no_exit=%s", NSWRAP_WATCHDOG_TIMEOUT_INITIAL, NSWRAP_WATCHDOG_TIMEOUT, state.cfg.nowatchdogquit ? "yes" : "no");
+            NSLOG_INF("- using watchdog title regexp: %s", NSWRAP_STATUS_RE_REGEXP);
+        }
         NSLOG_INF("");
 
         int np = nprocs();
@@ -1037,6 +5019,7 @@ int main(int argc, char **argv) {
             pty_termios.c_lflag &= ~(ECHO | ECHONL | ICANON | IEXTEN | ISIG);
             pty_termios.c_lflag |= IGNBRK | IGNPAR | IGNCR | IUTF8;
             pty_termios.c_iflag &= ~(BRKINT | ICRNL | INPCK | ISTRIP | IXON);
+            pty_termios.c_oflag &= ~ONLCR; // windows programs already write \r\n, which we translate to \n
             pty_termios.c_cflag &= ~(CSIZE | PARENB);
             pty_termios.c_cflag |= CREAD | CS8;
             pty_termios.c_cc[VMIN] = 1;
@@ -1070,7 +5053,10 @@ int main(int argc, char **argv) {
     }
 
     /* watchdog */
-    {
+    if (state.cfg.service) {
+        NSLOG_DBG("not setting up watchdog since services don't have a console title");
+        state.watchdog.tfd = -1;
+    } else {
         NSLOG_DBG("setting up watchdog (timeout: initial=%d interval=%d)", NSWRAP_WATCHDOG_TIMEOUT_INITIAL, NSWRAP_WATCHDOG_TIMEOUT);
         if ((state.watchdog.tfd = timerfd_create(CLOCK_MONOTONIC, TFD_CLOEXEC | TFD_NONBLOCK)) == -1) {
             NSLOG_ERRNO("failed to create watchdog timerfd");
@@ -1085,6 +5071,105 @@ int main(int argc, char **argv) {
         NSLOG_DBG("timerfd %d", state.watchdog.tfd);
     }
 
+    /* shutdown grace period */
+    if (state.cfg.shutdown_grace) {
+        if ((state.sig.grace_tfd = timerfd_create(CLOCK_MONOTONIC, TFD_CLOEXEC | TFD_NONBLOCK)) == -1) {
+            NSLOG_ERRNO("failed to create shutdown grace timerfd");
+            goto cleanup;
+        }
+    }
+
+    /* health endpoint */
+    if (state.cfg.health_addr) {
+        struct sockaddr_in addr = {
+            .sin_family = AF_INET,
+            .sin_addr.s_addr = htonl(INADDR_ANY),
+        };
+        const char *port = strrchr(state.cfg.health_addr, ':');
+        char host[64];
+        if (!port || (size_t)(port - state.cfg.health_addr) >= sizeof(host) || !atoi(port + 1) || atoi(port + 1) > 65535) {
+            NSLOG_ERR("invalid health endpoint address %s (expected [ipv4]:port)", state.cfg.health_addr);
+            goto cleanup;
+        }
+        snprintf(host, sizeof(host), "%.*s", (int)(port - state.cfg.health_addr), state.cfg.health_addr);
+        if (*host && inet_pton(AF_INET, host, &addr.sin_addr) != 1) {
+            NSLOG_ERR("invalid health endpoint address %s (expected [ipv4]:port)", state.cfg.health_addr);
+            goto cleanup;
+        }
+        addr.sin_port = htons(atoi(port + 1));
+        if ((state.health.fd = socket(AF_INET, SOCK_STREAM | SOCK_NONBLOCK | SOCK_CLOEXEC, 0)) == -1) {
+            NSLOG_ERRNO("failed to create health endpoint socket");
+            goto cleanup;
+        }
+        setsockopt(state.health.fd, SOL_SOCKET, SO_REUSEADDR, &(int){1}, sizeof(int));
+        if (bind(state.health.fd, (struct sockaddr*)(&addr), sizeof(addr)) == -1 || listen(state.health.fd, 16) == -1) {
+            NSLOG_ERRNO("failed to listen on health endpoint address %s", state.cfg.health_addr);
+            goto cleanup;
+        }
+    }
+
+    /* otlp metrics */
+    if (state.cfg.otlp_endpoint) {
+        if ((state.otlp.tfd = timerfd_create(CLOCK_MONOTONIC, TFD_CLOEXEC | TFD_NONBLOCK)) == -1) {
+            NSLOG_ERRNO("failed to create otlp timerfd");
+            goto cleanup;
+        }
+        if (timerfd_settime(state.otlp.tfd, 0, &(struct itimerspec){
+            .it_value.tv_sec = NSWRAP_OTLP_INTERVAL,
+            .it_interval.tv_sec = NSWRAP_OTLP_INTERVAL,
+        }, NULL) == -1) {
+            NSLOG_ERRNO("failed to set otlp timer");
+            goto cleanup;
+        }
+    }
+
+    /* instance prefix */
+    trace_end("setup");
+    if (*state.cfg.instance) {
+        NSLOG_INF("creating instance prefix");
+        trace_begin("instance");
+        if (!instance_setup(false)) {
+            NSLOG_ERR("failed to create instance prefix");
+            goto cleanup;
+        }
+        if (state.cfg.readonly && !readonly_check()) {
+            NSLOG_ERR("instance prefix would write into the read-only runtime");
+            goto cleanup;
+        }
+        trace_end("instance");
+        if (state.cfg.quota_projid) {
+            instance_set_projid();
+        }
+        if (state.cfg.quota) {
+            if ((state.quota.tfd = timerfd_create(CLOCK_MONOTONIC, TFD_CLOEXEC | TFD_NONBLOCK)) == -1) {
+                NSLOG_ERRNO("failed to create quota timerfd");
+                goto cleanup;
+            }
+            if (timerfd_settime(state.quota.tfd, 0, &(struct itimerspec){
+                .it_value.tv_sec = NSWRAP_QUOTA_INTERVAL,
+                .it_interval.tv_sec = NSWRAP_QUOTA_INTERVAL,
+            }, NULL) == -1) {
+                NSLOG_ERRNO("failed to set quota timer");
+                goto cleanup;
+            }
+        }
+    }
+
+    /* optional components */
+    if (*state.cfg.components) {
+        if (state.cfg.extwine) {
+            NSLOG_ERR("optional components are not supported with NSWRAP_EXTWINE");
+            goto cleanup;
+        }
+        char *names = strdupa(state.cfg.components), *name;
+        while ((name = strsep(&names, ","))) {
+            if (*name && !component_install(name)) {
+                NSLOG_ERR("failed to install optional component %s", name);
+                goto cleanup;
+            }
+        }
+    }
+
     /* exec */
     {
         NSLOG_DBG("starting wine");
@@ -1093,7 +5178,7 @@ int main(int argc, char **argv) {
 
         i=0;
         wine_argv[i++] = strdup("wine64");
-        wine_argv[i++] = strdup("NorthstarLauncher.exe");
+        wine_argv[i++] = strdup(state.cfg.exe);
         for (int j = 1; j < argc; j++) {
             /* first argument is -dedicated */
             if (i >= sizeof(wine_argv)/(sizeof(*wine_argv))) {
@@ -1107,17 +5192,54 @@ int main(int argc, char **argv) {
             }
         }
         wine_argv[i++] = NULL;
+        for (i = 0; !state.health.port && wine_argv[i]; i++) {
+            if (!strcmp(wine_argv[i], "-port") && wine_argv[i+1]) {
+                state.health.port = strtoul(wine_argv[i+1], NULL, 10);
+            }
+        }
+        if (!state.health.port) {
+            state.health.port = NSWRAP_GAME_PORT;
+        }
 
         i=0;
-        wine_envp[i++] = strdup("USER=nswrap");
+        wine_envp[i++] = strdup("USER=" NSWRAP_PREFIX_USER); // wine uses this for the profile dir name
+        wine_envp[i++] = strdup("LOGNAME=" NSWRAP_PREFIX_USER);
         wine_envp[i++] = strdup("HOSTNAME=none");
-        wine_envp[i++] = strdup(getenve("HOME") ?: "HOME=/");
+        if (*state.runtime.locale) {
+            char tmp[sizeof(state.runtime.locale) + 8];
+            snprintf(tmp, sizeof(tmp), "LC_ALL=%s", state.runtime.locale);
+            wine_envp[i++] = strdup(tmp); // so wine keeps the windows locale set with nswine -locale
+        } else {
+            wine_envp[i++] = strdup("LC_ALL=C.UTF-8"); // so wine converts console output to utf-8 (this doesn't affect the windows locale, which is en-US for C)
+        }
+        if (*state.runtime.tz) {
+            char tmp[sizeof(state.runtime.tz) + 4];
+            snprintf(tmp, sizeof(tmp), "TZ=%s", state.runtime.tz);
+            wine_envp[i++] = strdup(tmp); // so wine keeps the timezone set with nswine -tz
+        }
+        {
+            char tmp[sizeof(state.ident.nss_lib) + 32];
+            snprintf(tmp, sizeof(tmp), "HOME=%s", state.ident.home);
+            wine_envp[i++] = strdup(tmp);
+            if (*state.ident.nss_lib) {
+                snprintf(tmp, sizeof(tmp), "LD_PRELOAD=%s", state.ident.nss_lib);
+                wine_envp[i++] = strdup(tmp);
+                snprintf(tmp, sizeof(tmp), "NSS_WRAPPER_PASSWD=%s", state.ident.nss_passwd);
+                wine_envp[i++] = strdup(tmp);
+                snprintf(tmp, sizeof(tmp), "NSS_WRAPPER_GROUP=%s", state.ident.nss_group);
+                wine_envp[i++] = strdup(tmp);
+            }
+        }
         wine_envp[i++] = strdup(getenve("WINEDEBUG") ?: "WINEDEBUG=+msgbox,fixme-secur32,fixme-bcrypt,fixme-ver,err-wldap32,err-kerberos,err-ntlm");
         wine_envp[i++] = strdup("WINEARCH=win64");
         if (state.cfg.extwine) {
             wine_envp[i++] = strdup(getenve("PATH") ?: "PATH=/usr/local/bin:/usr/bin:/bin");
             if (getenve("LD_LIBRARY_PATH")) wine_envp[i++] = strdup(getenve("LD_LIBRARY_PATH"));
-            if (getenve("WINEPREFIX")) wine_envp[i++] = strdup(getenve("WINEPREFIX"));
+            if (*state.cfg.instance) {
+                char tmp[PATH_MAX];
+                snprintf(tmp, sizeof(tmp), "WINEPREFIX=%s/prefix", state.cfg.instance);
+                wine_envp[i++] = strdup(tmp);
+            } else if (getenve("WINEPREFIX")) wine_envp[i++] = strdup(getenve("WINEPREFIX"));
             else {
                 NSLOG_ERR("since NSWRAP_EXTWINE is enabled, WINEPREFIX must be set");
                 goto cleanup;
@@ -1135,19 +5257,34 @@ int main(int argc, char **argv) {
             snprintf(tmp, sizeof(tmp), "LD_LIBRARY_PATH=%s/lib64", state.cfg.dir);
             wine_envp[i++] = strdup(tmp);
             #endif
-            snprintf(tmp, sizeof(tmp), "WINEPREFIX=%s/prefix", state.cfg.dir);
+            if (*state.cfg.instance) {
+                snprintf(tmp, sizeof(tmp), "WINEPREFIX=%s/prefix", state.cfg.instance);
+            } else {
+                snprintf(tmp, sizeof(tmp), "WINEPREFIX=%s/prefix", state.cfg.dir);
+            }
             wine_envp[i++] = strdup(tmp);
             snprintf(tmp, sizeof(tmp), "WINESERVER=%s/bin%s/wineserver", state.cfg.dir, BINEXTRA);
             wine_envp[i++] = strdup(tmp);
             snprintf(tmp, sizeof(tmp), "WINELOADER=%s/bin%s/wine64", state.cfg.dir, BINEXTRA);
             wine_envp[i++] = strdup(tmp);
-            snprintf(tmp, sizeof(tmp), "WINEDLLPATH=%s/lib64/wine", state.cfg.dir); // note: wine searches the x86_64-windows, x86_64-unix subdirs too
+            if (*state.cfg.instance && *state.cfg.components) {
+                snprintf(tmp, sizeof(tmp), "WINEDLLPATH=%s/lib64/wine:%s/components", state.cfg.dir, state.cfg.instance); // note: wine searches the x86_64-windows, x86_64-unix subdirs too
+            } else {
+                snprintf(tmp, sizeof(tmp), "WINEDLLPATH=%s/lib64/wine", state.cfg.dir); // note: wine searches the x86_64-windows, x86_64-unix subdirs too
+            }
             wine_envp[i++] = strdup(tmp);
             snprintf(tmp, sizeof(tmp), "%s/bin%s/wine64", state.cfg.dir, BINEXTRA);
             wine_exe = strdup(tmp);
             #undef BINEXTRA
         }
         if (getenve("WINDELLOVERRIDES")) wine_envp[i++] = strdup(getenve("WINDELLOVERRIDES"));
+        if (state.cfg.env) {
+            ssize_t n = env_map(wine_envp, i, sizeof(wine_envp)/sizeof(*wine_envp), state.cfg.env);
+            if (n == -1) {
+                goto cleanup;
+            }
+            i = (size_t)(n);
+        }
         wine_envp[i++] = NULL;
 
         for (i = 0; wine_argv[i]; i++) {
@@ -1170,6 +5307,46 @@ int main(int argc, char **argv) {
             NSLOG_WRNNO("failed to set PR_SET_CHILD_SUBREAPER=1 (grandchildren may not be reaped)");
         }
 
+        if (state.cfg.extwine) {
+            snprintf(state.service.wineserver, sizeof(state.service.wineserver), "%s", getenv("WINESERVER") ?: "wineserver");
+        } else {
+            snprintf(state.service.wineserver, sizeof(state.service.wineserver), "%s/bin/wineserver", state.cfg.dir);
+        }
+        if (!state.cfg.extwine || state.cfg.service) {
+            // start it separately so we can tell how long it takes (it forks into the background once it's ready), and for services, so we can wait for it to exit
+            // it's persistent (except for services, which rely on it exiting with the last process) so it doesn't exit between wine processes, and we stop it explicitly on shutdown
+            NSLOG_DBG("starting wineserver");
+            trace_begin("wineserver");
+            pid_t pid = fork();
+            if (pid == -1) {
+                NSLOG_ERRNO("failed to start wineserver: fork");
+                goto cleanup;
+            }
+            if (pid == 0) {
+                sigprocmask(SIG_SETMASK, &state.sig.origset, NULL);
+                execvpe(state.service.wineserver, (char*[]){"wineserver", state.cfg.service ? NULL : "-p", NULL}, wine_envp);
+                _exit(127);
+            }
+            int wstatus;
+            if (waitpid(pid, &wstatus, 0) == -1 || !WIFEXITED(wstatus) || WEXITSTATUS(wstatus)) {
+                NSLOG_WRN("failed to start wineserver, wine will start it instead");
+            } else {
+                for (i = 0; wine_envp[i]; i++) {
+                    if (starts_with(wine_envp[i], "WINEPREFIX=")) {
+                        state.server.pid = wineserver_find(state.server.dir, sizeof(state.server.dir), wine_envp[i] + strlen("WINEPREFIX="));
+                    }
+                }
+                if (state.server.pid) {
+                    NSLOG_DBG("started wineserver with pid %d (socket dir %s)", (int)(state.server.pid), state.server.dir);
+                } else {
+                    NSLOG_WRN("started wineserver, but couldn't find its socket dir or pid (it won't be stopped explicitly)");
+                }
+            }
+            trace_end("wineserver");
+        }
+
+        trace_begin("load");
+        supervise_started();
         if ((state.wine.pid = fork()) == -1) {
             NSLOG_ERRNO("failed to start process: fork");
             goto cleanup;
@@ -1183,20 +5360,49 @@ int main(int argc, char **argv) {
             close(state.io.pty_mastr_fd); // not cloexec
             close(state.io.pty_slave_fd); // already dup'd to stdin/stdout/stderr
             sigprocmask(SIG_SETMASK, &state.sig.origset, NULL);
-            execvpe(wine_exe, wine_argv, wine_envp);
+            if (state.cfg.service) {
+                execvpe(state.service.wineserver, (char*[]){"wineserver", "-w", NULL}, wine_envp); // the server exits once the service (the only non-system process) does
+            } else {
+                execvpe(wine_exe, wine_argv, wine_envp);
+            }
             const int n = errno;
             write(state.wine.errno_pipe[1], &n, sizeof(n));
             close(state.wine.errno_pipe[1]);
             _exit(127);
         }
+        NSLOG_DBG("started wine with pid %d", (int)(state.wine.pid));
+        otlp_event("wine.start", NULL);
+        state.service.exe = wine_exe; // also needed for wineserver -k
+        state.service.envp = malloc(sizeof(wine_envp));
+        memcpy(state.service.envp, wine_envp, sizeof(wine_envp));
+        if (state.cfg.service) {
+            char binpath[PATH_MAX*2], cwd[PATH_MAX];
+            if (!getcwd(cwd, sizeof(cwd))) {
+                NSLOG_ERRNO("failed to get current dir");
+                goto cleanup;
+            }
+            for (char *c = cwd; *c; c++) {
+                if (*c == '/') {
+                    *c = '\\';
+                }
+            }
+            size_t n = snprintf(binpath, sizeof(binpath), "\"Z:%s\\%s\"", cwd, state.cfg.exe);
+            for (i = 1; wine_argv[i+1] && n < sizeof(binpath); i++) {
+                n += service_quote(binpath + n, sizeof(binpath) - n, wine_argv[i+1]);
+            }
+            if (n >= sizeof(binpath)) {
+                NSLOG_ERR("service command line is too long");
+                goto cleanup;
+            }
+            NSLOG_INF("starting service %s", state.cfg.service);
+            NSLOG_DBG("service command line %s", binpath);
+            if (!(state.service.pid = service_ctl(binpath))) {
+                goto cleanup;
+            }
+        }
         for (i = 0; wine_argv[i]; i++) {
             free(wine_argv[i]);
         }
-        for (i = 0; wine_envp[i]; i++) {
-            free(wine_envp[i]);
-        }
-        free(wine_exe);
-        NSLOG_DBG("started wine with pid %d", (int)(state.wine.pid));
     }
     maybe_update_proctitle(); // this has to be done AFTER finishing up with argv
 
@@ -1206,6 +5412,10 @@ int main(int argc, char **argv) {
         poll_signal,
         poll_errno,
         poll_watchdog,
+        poll_quota,
+        poll_otlp,
+        poll_grace,
+        poll_health,
     };
     struct pollfd poll_[] = {
         [poll_master]   = { .fd = state.io.pty_mastr_fd, .events = POLLIN },
@@ -1213,6 +5423,10 @@ int main(int argc, char **argv) {
         [poll_signal]   = { .fd = state.sig.sfd, .events = POLLIN },
         [poll_errno]    = { .fd = state.wine.errno_pipe[0], .events = POLLIN },
         [poll_watchdog] = { .fd = state.watchdog.tfd, .events = POLLIN },
+        [poll_quota]    = { .fd = state.quota.tfd, .events = POLLIN },
+        [poll_otlp]     = { .fd = state.otlp.tfd, .events = POLLIN },
+        [poll_grace]    = { .fd = state.sig.grace_tfd, .events = POLLIN },
+        [poll_health]   = { .fd = state.health.fd, .events = POLLIN },
     };
     while (!state.force_quit && !state.wine.exited) {
         if (state.io.n_stdin_write) {
@@ -1220,10 +5434,14 @@ int main(int argc, char **argv) {
         } else {
             poll_[poll_master].events &= ~POLLOUT;
         }
-        if (poll(poll_, sizeof(poll_)/sizeof(*poll_), -1) == -1) {
+        int nready = poll(poll_, sizeof(poll_)/sizeof(*poll_), state.io.n_line ? NSWRAP_IOPROC_LINE_FLUSH_TIMEOUT : -1);
+        if (nready == -1) {
             NSLOG_ERRNO("poll failed");
             goto cleanup;
         }
+        if (nready == 0 && state.io.n_line) {
+            io_output_flush();
+        }
         if (!state.force_quit && poll_[poll_errno].revents & POLLIN) {
             int n;
             if (read(state.wine.errno_pipe[0], &n, sizeof(n)) == -1) {
@@ -1253,6 +5471,18 @@ int main(int argc, char **argv) {
         if (!state.force_quit && poll_[poll_watchdog].revents & POLLIN) {
             handle_watchdog_timer_trigger();
         }
+        if (!state.force_quit && poll_[poll_quota].revents & POLLIN) {
+            handle_quota_timer_trigger();
+        }
+        if (!state.force_quit && poll_[poll_otlp].revents & POLLIN) {
+            handle_otlp_timer_trigger();
+        }
+        if (!state.force_quit && poll_[poll_grace].revents & POLLIN) {
+            handle_grace_timer_trigger();
+        }
+        if (!state.force_quit && poll_[poll_health].revents & POLLIN) {
+            handle_health_accept();
+        }
         if (!state.force_quit && poll_[poll_master].revents & POLLHUP) {
             NSLOG_WRN("got POLLHUP/EOF on pty master; will not be able to read logs or send concommands anymore");
             poll_[poll_master].fd = -1; // don't poll it anymore
@@ -1279,8 +5509,15 @@ int main(int argc, char **argv) {
     }
 
 cleanup:
+    if (state.trace.n > 1) {
+        trace_finish(false);
+    }
     NSLOG_INF("cleaning up");
     if (state.wine.pid) {
+        if (!state.wine.exited && state.cfg.service) {
+            NSLOG_INF("killing service");
+            service_kill(SIGKILL);
+        }
         if (!state.wine.exited) {
             NSLOG_INF("killing wine");
             if (kill(state.wine.pid, SIGKILL) == -1) {
@@ -1310,8 +5547,16 @@ cleanup:
                     NSLOG_WRN("wine unexpectedly exited with status %d", WEXITSTATUS(state.wine.wstatus));
                 }
             }
+            char tmp[64];
+            if (WIFSIGNALED(state.wine.wstatus)) {
+                snprintf(tmp, sizeof(tmp), "signal %d%s", WTERMSIG(state.wine.wstatus), state.quit_requested ? "" : " (unexpected)");
+            } else {
+                snprintf(tmp, sizeof(tmp), "status %d%s", WEXITSTATUS(state.wine.wstatus), state.quit_requested ? "" : " (unexpected)");
+            }
+            otlp_event("wine.exit", tmp);
         }
     }
+    wineserver_stop();
     if (state.wine.errno_pipe[0]) {
         close(state.wine.errno_pipe[0]);
     }
@@ -1321,6 +5566,15 @@ cleanup:
     if (state.sig.sfd) {
         close(state.sig.sfd);
     }
+    if (state.health.fd != -1) {
+        close(state.health.fd);
+    }
+    if (*state.ident.nss_passwd) {
+        unlink(state.ident.nss_passwd);
+    }
+    if (*state.ident.nss_group) {
+        unlink(state.ident.nss_group);
+    }
     if (state.sig.origset_ok) {
         sigprocmask(SIG_SETMASK, &state.sig.origset, NULL);
     }
@@ -1349,7 +5603,7 @@ cleanup:
                 clock_gettime(CLOCK_MONOTONIC, &tc);
                 if (tc.tv_sec - ts.tv_sec > 5) {
                     NSLOG_WRN("children did not exit in time");
-                    return 1;
+                    break; // still save the instance and write the crash bundle
                 }
                 nanosleep(&(struct timespec){
                     .tv_nsec = 100 * 1000 * 1000,
@@ -1359,6 +5613,38 @@ cleanup:
             }
         }
     }
+    if (state.inst.ready) {
+        NSLOG_INF("saving instance registry deltas");
+        instance_save("prefix");
+        futimens(state.inst.lock, NULL); // last use
+        if (state.inst.overlay) {
+            char tmp[PATH_MAX];
+            snprintf(tmp, sizeof(tmp), "%s/prefix", state.cfg.instance);
+            if (umount2(tmp, MNT_DETACH) == -1) {
+                NSLOG_WRNNO("failed to unmount instance prefix");
+            }
+        }
+    }
+    if (state.io.n_line) {
+        io_output_line(); // incomplete last line
+    }
+    if (state.cfg.crash_dir && state.wine.pid && (state.crash.reason || (!state.quit_requested && state.wine.reaped && (WIFSIGNALED(state.wine.wstatus) || WEXITSTATUS(state.wine.wstatus))))) {
+        crash_write();
+    }
+    if (state.io.n_suppressed) {
+        NSLOG_INF("suppressed %llu lines of known-harmless wine debug output (set NSWRAP_DEBUG=1 to show them)", state.io.n_suppressed);
+    }
     NSLOG_INF("done");
-    exit(state.quit_requested ? 0 : 1);
+    if (state.quit_requested) {
+        exit(0);
+    }
+    if (state.wine.reaped) {
+        if (WIFSIGNALED(state.wine.wstatus)) {
+            exit(128 + WTERMSIG(state.wine.wstatus));
+        }
+        if (WEXITSTATUS(state.wine.wstatus)) {
+            exit(WEXITSTATUS(state.wine.wstatus));
+        }
+    }
+    exit(1);
 }